@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+type AdminConfig struct {
+	// Address is the listen address of the admin API, disabled when empty.
+	Address string `json:"address" yaml:"address"`
+	// Token is the bearer token every request has to carry.
+	Token string `json:"token" yaml:"token"`
+	// Pprof serves net/http/pprof under /debug/pprof/ and the Go runtime
+	// metrics on /debug/metrics.
+	Pprof bool `json:"pprof" yaml:"pprof"`
+}
+
+func (c *AdminConfig) Validate() error {
+	if c.Address != "" && c.Token == "" {
+		return errors.New("admin.token: must be set with admin.address")
+	}
+	if c.Pprof && c.Address == "" {
+		return errors.New("admin.pprof: needs admin.address")
+	}
+	return nil
+}
+
+// Admin serves the admin API of a consumer group member.
+type Admin struct {
+	token   string
+	pprof   bool
+	handler *consumer.Handler
+}
+
+func NewAdmin(config AdminConfig, handler *consumer.Handler) *Admin {
+	return &Admin{token: config.Token, pprof: config.Pprof, handler: handler}
+}
+
+// RunAdminServer serves the admin API on config.Address in the background.
+func RunAdminServer(config AdminConfig, admin *Admin) error {
+	return serveHTTP("admin", config.Address, admin.Handler())
+}
+
+// Handler returns the endpoints of the API, each checking the token.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/pause", a.action("pause", a.pause))
+	mux.HandleFunc("POST /admin/resume", a.action("resume", a.resume))
+	mux.HandleFunc("POST /admin/flush", a.action("flush", a.flush))
+	mux.HandleFunc("POST /admin/commit", a.action("commit", a.commit))
+	mux.HandleFunc("GET /admin/assignments", a.authorized(a.assignments))
+	mux.HandleFunc("GET /admin/log-level", a.authorized(logging.Level.ServeHTTP))
+	mux.HandleFunc("PUT /admin/log-level", a.action("log_level", func(w http.ResponseWriter, r *http.Request) error {
+		logging.Level.ServeHTTP(w, r)
+		return nil
+	}))
+	if a.pprof {
+		mux.HandleFunc("/debug/pprof/", a.authorized(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", a.authorized(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", a.authorized(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", a.authorized(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", a.authorized(pprof.Trace))
+		mux.Handle("GET /debug/metrics", a.authorized(runtimeMetrics().ServeHTTP))
+	}
+	return mux
+}
+
+// runtimeMetrics serves the GC, memory and scheduler metrics of the Go
+// runtime, with the pause and latency histograms, which /metrics leaves out
+// to keep the scrapes small.
+func runtimeMetrics() http.Handler {
+	runtime := prometheus.NewRegistry()
+	runtime.MustRegister(collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(
+		collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler)))
+	return promhttp.HandlerFor(runtime, promhttp.HandlerOpts{})
+}
+
+// authorized answers 401 to requests without the bearer token.
+func (a *Admin) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdmin(w, http.StatusUnauthorized, adminError{"invalid token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminStatusError is an error of an action answered with its status code.
+type adminStatusError struct {
+	code int
+	err  error
+}
+
+func (e *adminStatusError) Error() string { return e.err.Error() }
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// action serves an authorized action that changes the consumer, logging and
+// counting it. An error is answered as {"error":"..."}.
+func (a *Admin) action(name string, run func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		metrics.AdminRequestsTotal.WithLabelValues(name).Inc()
+		if err := run(w, r); err != nil {
+			code := http.StatusInternalServerError
+			var status *adminStatusError
+			if errors.As(err, &status) {
+				code = status.code
+			}
+			logging.Logger.Warn("admin action failed", zap.String("action", name), zap.String("remote", r.RemoteAddr), zap.Error(err))
+			writeAdmin(w, code, adminError{err.Error()})
+			return
+		}
+		logging.Logger.Info("admin action", zap.String("action", name), zap.String("remote", r.RemoteAddr))
+	})
+}
+
+func (a *Admin) pause(w http.ResponseWriter, _ *http.Request) error {
+	a.handler.Pause()
+	writeAdmin(w, http.StatusOK, map[string]string{"status": "paused"})
+	return nil
+}
+
+func (a *Admin) resume(w http.ResponseWriter, _ *http.Request) error {
+	a.handler.Resume()
+	writeAdmin(w, http.StatusOK, map[string]string{"status": "resumed"})
+	return nil
+}
+
+func (a *Admin) flush(w http.ResponseWriter, r *http.Request) error {
+	if err := a.handler.Flush(r.Context()); err != nil {
+		return err
+	}
+	writeAdmin(w, http.StatusOK, map[string]string{"status": "flushed"})
+	return nil
+}
+
+// commit flushes the sink and commits the marked offsets through the commit
+// loop of the session, as its interval does.
+func (a *Admin) commit(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), adminCommitWait)
+	defer cancel()
+	if err := a.handler.Commit(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+			return &adminStatusError{http.StatusConflict, errors.New("not in a group session")}
+		}
+		return err
+	}
+	writeAdmin(w, http.StatusOK, map[string]string{"status": "committed"})
+	return nil
+}
+
+// adminCommitWait is how long a commit waits for the commit loop of a
+// session, which is not running during rebalances.
+var adminCommitWait = 5 * time.Second
+
+type lagPartition struct {
+	consumer.HealthPartition
+	// Lag is unknown until the first message of the partition arrives.
+	Lag *int64 `json:"lag,omitempty"`
+}
+
+type adminAssignments struct {
+	InSession  bool           `json:"in_session"`
+	MemberID   string         `json:"member_id,omitempty"`
+	Generation int32          `json:"generation,omitempty"`
+	Paused     bool           `json:"paused"`
+	Partitions []lagPartition `json:"partitions"`
+}
+
+// assignments lists the claimed partitions with their next offset, high
+// water mark and lag.
+func (a *Admin) assignments(w http.ResponseWriter, _ *http.Request) {
+	status, _, _ := a.handler.Health().Status(time.Now())
+	response := adminAssignments{
+		InSession:  status.InSession,
+		MemberID:   status.MemberID,
+		Generation: status.Generation,
+		Paused:     a.handler.Paused(),
+		Partitions: withLag(status.Partitions),
+	}
+	writeAdmin(w, http.StatusOK, response)
+}
+
+// withLag adds the lag to the partitions of a health status.
+func withLag(partitions []consumer.HealthPartition) []lagPartition {
+	lags := make([]lagPartition, len(partitions))
+	for i, partition := range partitions {
+		lags[i].HealthPartition = partition
+		if partition.Offset >= 0 {
+			lag := max(partition.HighWatermark-partition.Offset, 0)
+			lags[i].Lag = &lag
+		}
+	}
+	return lags
+}
+
+func writeAdmin(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap/zapcore"
+
+	"consumer/internal/sinktest"
+	"consumer/pkg/consumer"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+)
+
+// partitionRecorder counts the calls of a PartitionPauser.
+type partitionRecorder struct {
+	pauses, resumes int
+	paused          map[string][]int32
+}
+
+func (p *partitionRecorder) PauseAll()                           { p.pauses++ }
+func (p *partitionRecorder) ResumeAll()                          { p.resumes++ }
+func (p *partitionRecorder) Pause(partitions map[string][]int32) { p.paused = partitions }
+
+// adminClaim is a claim of partition 1 of updates at offset 40.
+type adminClaim struct {
+	sarama.ConsumerGroupClaim
+}
+
+func (adminClaim) Topic() string              { return "updates" }
+func (adminClaim) Partition() int32           { return 1 }
+func (adminClaim) InitialOffset() int64       { return 40 }
+func (adminClaim) HighWaterMarkOffset() int64 { return 100 }
+
+// memberSession is a session of member.
+type memberSession struct {
+	sarama.ConsumerGroupSession
+}
+
+func (memberSession) GenerationID() int32 { return 3 }
+func (memberSession) MemberID() string    { return "member" }
+
+// seekBroker serves a topic with two partitions holding offsets 0 to 100.
+// Partition 0 has committed offset committed, partition 1 none.
+func seekBroker(t *testing.T, committed int64, commit *sarama.MockOffsetCommitResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("updates", 0, broker.BrokerID()).
+			SetLeader("updates", 1, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "updates", 0, committed, "", sarama.ErrNoError).
+			SetOffset("group", "updates", 1, -1, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("updates", 0, sarama.OffsetOldest, 0).
+			SetOffset("updates", 0, sarama.OffsetNewest, 100).
+			SetOffset("updates", 1, sarama.OffsetOldest, 0).
+			SetOffset("updates", 1, sarama.OffsetNewest, 100),
+		"OffsetCommitRequest": commit,
+	})
+	return broker
+}
+
+func adminRequest(t *testing.T, server *httptest.Server, method, path, token, body string) (int, map[string]any) {
+	t.Helper()
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var decoded map[string]any
+	json.NewDecoder(response.Body).Decode(&decoded)
+	return response.StatusCode, decoded
+}
+
+func TestAdmin(t *testing.T) {
+	defer logging.Level.SetLevel(logging.Level.Level())
+	recorder := &partitionRecorder{}
+	h := consumer.NewHandler(consumer.HandlerConfig{Sink: &sinktest.RecordSink{}})
+	h.AttachGroup(recorder)
+	server := httptest.NewServer(NewAdmin(AdminConfig{Token: "secret"}, h).Handler())
+	defer server.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := adminRequest(t, server, http.MethodPost, "/admin/pause", token, ""); code != http.StatusUnauthorized {
+			t.Fatalf("token %q got %d", token, code)
+		}
+	}
+	if recorder.pauses != 0 {
+		t.Fatal("paused without the token")
+	}
+
+	if code, _ := adminRequest(t, server, http.MethodPost, "/admin/pause", "secret", ""); code != http.StatusOK || recorder.pauses != 1 {
+		t.Fatalf("got %d, %d pauses", code, recorder.pauses)
+	}
+	if code, _ := adminRequest(t, server, http.MethodPost, "/admin/resume", "secret", ""); code != http.StatusOK || recorder.resumes != 1 {
+		t.Fatalf("got %d, %d resumes", code, recorder.resumes)
+	}
+
+	// commits go through the commit loop, none runs without a session
+	defer func(wait time.Duration) { adminCommitWait = wait }(adminCommitWait)
+	adminCommitWait = 10 * time.Millisecond
+	if code, body := adminRequest(t, server, http.MethodPost, "/admin/commit", "secret", ""); code != http.StatusConflict || body["error"] != "not in a group session" {
+		t.Fatalf("got %d %v", code, body)
+	}
+	if code, _ := adminRequest(t, server, http.MethodPost, "/admin/flush", "secret", ""); code != http.StatusOK {
+		t.Fatalf("flush got %d", code)
+	}
+
+	if code, body := adminRequest(t, server, http.MethodPut, "/admin/log-level", "secret", `{"level":"debug"}`); code != http.StatusOK || body["level"] != "debug" {
+		t.Fatalf("got %d %v", code, body)
+	}
+	if logging.Level.Level() != zapcore.DebugLevel {
+		t.Fatalf("level %s", logging.Level.Level())
+	}
+}
+
+func TestAdminAssignments(t *testing.T) {
+	broker := seekBroker(t, 50, nil)
+	defer broker.Close()
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	h := consumer.NewHandler(consumer.HandlerConfig{Health: consumer.NewHealth(client, consumer.HealthConfig{StallTimeout: duration.Duration(time.Minute)})})
+	h.Health().Setup(memberSession{})
+	h.Health().Claimed(adminClaim{})
+	server := httptest.NewServer(NewAdmin(AdminConfig{Token: "secret"}, h).Handler())
+	defer server.Close()
+
+	code, body := adminRequest(t, server, http.MethodGet, "/admin/assignments", "secret", "")
+	partitions, _ := body["partitions"].([]any)
+	if code != http.StatusOK || body["member_id"] != "member" || len(partitions) != 1 {
+		t.Fatalf("got %d %v", code, body)
+	}
+	if partition := partitions[0].(map[string]any); partition["topic"] != "updates" || partition["offset"] != 40.0 || partition["lag"] != 60.0 {
+		t.Fatalf("partition %v", partition)
+	}
+}
+
+func TestAdminPprof(t *testing.T) {
+	server := httptest.NewServer(NewAdmin(AdminConfig{Token: "secret", Pprof: true}, consumer.NewHandler(consumer.HandlerConfig{})).Handler())
+	defer server.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/metrics"} {
+		if code, _ := adminRequest(t, server, http.MethodGet, path, "", ""); code != http.StatusUnauthorized {
+			t.Fatalf("%s without the token got %d", path, code)
+		}
+	}
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/debug/metrics", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "go_gc_pauses_seconds") {
+		t.Fatalf("got %d %.200s", response.StatusCode, body)
+	}
+
+	// without pprof the endpoints are not served
+	plain := httptest.NewServer(NewAdmin(AdminConfig{Token: "secret"}, consumer.NewHandler(consumer.HandlerConfig{})).Handler())
+	defer plain.Close()
+	if code, _ := adminRequest(t, plain, http.MethodGet, "/debug/pprof/", "secret", ""); code != http.StatusNotFound {
+		t.Fatalf("got %d", code)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	for _, test := range []struct {
+		config AdminConfig
+		want   string
+	}{
+		{AdminConfig{Address: ":8874"}, "admin.token"},
+		{AdminConfig{Pprof: true}, "admin.pprof"},
+	} {
+		if err := test.config.Validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %s", err, test.want)
+		}
+	}
+}
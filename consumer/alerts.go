@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mr-tron/base58"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+	"consumer/proto"
+)
+
+// AlertsConfig notifies chat channels of the written transactions matching a
+// watchlist, disabled without rules.
+type AlertsConfig struct {
+	Destinations []AlertDestinationConfig `json:"destinations" yaml:"destinations"`
+	Rules        []AlertRuleConfig        `json:"rules" yaml:"rules"`
+	// RateLimit is how many alerts a destination receives per RateInterval,
+	// the alerts beyond it are dropped.
+	RateLimit    int               `json:"rate_limit" yaml:"rate_limit"`
+	RateInterval duration.Duration `json:"rate_interval" yaml:"rate_interval"`
+	// QueueSize is how many alerts wait for a destination before new ones
+	// are dropped.
+	QueueSize int               `json:"queue_size" yaml:"queue_size"`
+	Timeout   duration.Duration `json:"timeout" yaml:"timeout"`
+	// ExplorerURL links the transaction of an alert, {signature} replaced by
+	// its signature. No link is added when empty.
+	ExplorerURL string `json:"explorer_url" yaml:"explorer_url"`
+}
+
+// AlertDestinationConfig is a chat channel alerts are posted to.
+type AlertDestinationConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Type is slack, discord or telegram.
+	Type string `json:"type" yaml:"type"`
+	// URL is the incoming webhook of a Slack or Discord channel, or the base
+	// of the Telegram Bot API, https://api.telegram.org when empty.
+	URL      string `json:"url" yaml:"url"`
+	BotToken string `json:"bot_token" yaml:"bot_token"`
+	ChatID   string `json:"chat_id" yaml:"chat_id"`
+}
+
+// AlertRuleConfig matches the transactions touching one of Accounts, invoking
+// one of Programs and moving at least MinSOL in or out of a watched account,
+// or any account without Accounts. Unset conditions match everything, but a
+// rule needs at least one.
+type AlertRuleConfig struct {
+	Name          string   `json:"name" yaml:"name"`
+	Accounts      []string `json:"accounts" yaml:"accounts"`
+	Programs      []string `json:"programs" yaml:"programs"`
+	MinSOL        float64  `json:"min_sol" yaml:"min_sol"`
+	IncludeFailed bool     `json:"include_failed" yaml:"include_failed"`
+	// Destinations are the names of the destinations notified.
+	Destinations []string `json:"destinations" yaml:"destinations"`
+}
+
+func DefaultAlertsConfig() AlertsConfig {
+	return AlertsConfig{
+		RateLimit:    20,
+		RateInterval: duration.Duration(time.Minute),
+		QueueSize:    100,
+		Timeout:      duration.Duration(10 * time.Second),
+		ExplorerURL:  "https://explorer.solana.com/tx/{signature}",
+	}
+}
+
+func (c *AlertsConfig) Validate() error {
+	if len(c.Rules) == 0 {
+		return nil
+	}
+	if c.RateLimit <= 0 || c.RateInterval <= 0 {
+		return errors.New("alerts: rate_limit and rate_interval must be positive")
+	}
+	if c.QueueSize <= 0 {
+		return errors.New("alerts.queue_size: must be positive")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("alerts.timeout: must be positive")
+	}
+	_, _, err := newAlertRules(*c)
+	return err
+}
+
+func (c *AlertDestinationConfig) validate() error {
+	switch c.Type {
+	case "slack", "discord":
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alerts.destinations: %s: expected an http or https URL", c.Name)
+		}
+	case "telegram":
+		if c.BotToken == "" || c.ChatID == "" {
+			return fmt.Errorf("alerts.destinations: %s: telegram needs bot_token and chat_id", c.Name)
+		}
+	default:
+		return fmt.Errorf("alerts.destinations: %s: expected type slack, discord or telegram, got %q", c.Name, c.Type)
+	}
+	return nil
+}
+
+// alertRule is a validated AlertRuleConfig.
+type alertRule struct {
+	name          string
+	accounts      decode.KeySet
+	programs      decode.KeySet
+	minLamports   uint64
+	includeFailed bool
+	destinations  []*alertDestination
+}
+
+// newAlertRules returns the rules of config and the destinations they notify.
+func newAlertRules(config AlertsConfig) ([]*alertRule, []*alertDestination, error) {
+	byName := make(map[string]*alertDestination)
+	var destinations []*alertDestination
+	for _, destination := range config.Destinations {
+		if destination.Name == "" {
+			return nil, nil, errors.New("alerts.destinations: a destination needs a name")
+		}
+		if _, ok := byName[destination.Name]; ok {
+			return nil, nil, fmt.Errorf("alerts.destinations: %s is defined twice", destination.Name)
+		}
+		if err := destination.validate(); err != nil {
+			return nil, nil, err
+		}
+		d := newAlertDestination(destination, config)
+		byName[destination.Name] = d
+		destinations = append(destinations, d)
+	}
+
+	var rules []*alertRule
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, nil, errors.New("alerts.rules: a rule needs a name")
+		}
+		if len(rule.Accounts) == 0 && len(rule.Programs) == 0 && rule.MinSOL == 0 {
+			return nil, nil, fmt.Errorf("alerts.rules: %s: needs accounts, programs or min_sol", rule.Name)
+		}
+		if rule.MinSOL < 0 {
+			return nil, nil, fmt.Errorf("alerts.rules: %s: min_sol must not be negative", rule.Name)
+		}
+		if len(rule.Destinations) == 0 {
+			return nil, nil, fmt.Errorf("alerts.rules: %s: needs destinations", rule.Name)
+		}
+		r := &alertRule{name: rule.Name, minLamports: uint64(math.Round(rule.MinSOL * 1e9)), includeFailed: rule.IncludeFailed}
+		var err error
+		if r.accounts, err = decode.NewKeySet(rule.Accounts); err != nil {
+			return nil, nil, fmt.Errorf("alerts.rules: %s: accounts: %w", rule.Name, err)
+		}
+		if r.programs, err = decode.NewKeySet(rule.Programs); err != nil {
+			return nil, nil, fmt.Errorf("alerts.rules: %s: programs: %w", rule.Name, err)
+		}
+		for _, name := range rule.Destinations {
+			d, ok := byName[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("alerts.rules: %s: unknown destination %q", rule.Name, name)
+			}
+			r.destinations = append(r.destinations, d)
+		}
+		rules = append(rules, r)
+	}
+	return rules, destinations, nil
+}
+
+// match reports whether the rule matches a transaction, along with the SOL
+// changes of the watched accounts that moved at least the threshold.
+func (r *alertRule) match(info *proto.SubscribeUpdateTransactionInfo) ([]decode.BalanceChange, bool) {
+	if info.GetMeta().GetErr() != nil && !r.includeFailed {
+		return nil, false
+	}
+	if r.accounts != nil && !r.accounts.ContainsAny(decode.TransactionAccounts(info)) {
+		return nil, false
+	}
+	if r.programs != nil && !r.programs.ContainsAny(decode.TransactionPrograms(info)) {
+		return nil, false
+	}
+	threshold := new(big.Int).SetUint64(r.minLamports)
+	var moved []decode.BalanceChange
+	for _, change := range decode.BalanceChanges(info) {
+		if change.Mint != "" || new(big.Int).Abs(change.Change).Cmp(threshold) < 0 {
+			continue
+		}
+		if key, err := base58.Decode(change.Account); r.accounts == nil || (err == nil && r.accounts.ContainsAny([][]byte{key})) {
+			moved = append(moved, change)
+		}
+	}
+	return moved, r.minLamports == 0 || len(moved) > 0
+}
+
+// AlertSink evaluates every transaction written, alone or in a block, after
+// passing it on, and queues an alert for each rule it matches. Alerts are
+// posted in the background and never fail a write, those a destination
+// fails to receive are logged and counted.
+type AlertSink struct {
+	sink.Sink
+	// rules are replaced by a config reload, see prepareReload.
+	rules        atomic.Pointer[[]*alertRule]
+	destinations []*alertDestination
+	explorerURL  string
+	config       AlertsConfig
+	wg           sync.WaitGroup
+}
+
+func NewAlertSink(next sink.Sink, config AlertsConfig) (*AlertSink, error) {
+	rules, destinations, err := newAlertRules(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &AlertSink{Sink: next, destinations: destinations, explorerURL: config.ExplorerURL, config: config}
+	s.rules.Store(&rules)
+	for _, d := range destinations {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			d.run()
+		}()
+	}
+	return s, nil
+}
+
+func (s *AlertSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	for _, info := range decode.MessageTransactions(msg) {
+		for _, rule := range *s.rules.Load() {
+			moved, ok := rule.match(info)
+			if !ok {
+				continue
+			}
+			text := s.alertText(rule, info, msg.Slot, moved)
+			for _, d := range rule.destinations {
+				d.enqueue(text)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareReload validates the rules of config and returns the function
+// swapping them in. Only the rules change, they notify the destinations
+// created at startup, so the rest of config has to stay the same. A nil
+// AlertSink takes no rules.
+func (s *AlertSink) prepareReload(config AlertsConfig) (func(), error) {
+	if s == nil {
+		if len(config.Rules) > 0 {
+			return nil, errors.New("alerts: were disabled at startup, enabling them needs a restart")
+		}
+		return func() {}, nil
+	}
+	current, next := s.config, config
+	current.Rules, next.Rules = nil, nil
+	if !reflect.DeepEqual(current, next) {
+		return nil, errors.New("alerts: only the rules can change without a restart")
+	}
+	rules, _, err := newAlertRules(config)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*alertDestination, len(s.destinations))
+	for _, d := range s.destinations {
+		byName[d.name] = d
+	}
+	for _, rule := range rules {
+		for i, d := range rule.destinations {
+			rule.destinations[i] = byName[d.name]
+		}
+	}
+	return func() { s.rules.Store(&rules) }, nil
+}
+
+// Close waits for the queued alerts to be posted before closing the next
+// sink.
+func (s *AlertSink) Close() error {
+	for _, d := range s.destinations {
+		close(d.queue)
+	}
+	s.wg.Wait()
+	return s.Sink.Close()
+}
+
+// alertText is the plain text message of an alert, read the same in every
+// chat.
+func (s *AlertSink) alertText(rule *alertRule, info *proto.SubscribeUpdateTransactionInfo, slot uint64, moved []decode.BalanceChange) string {
+	signature := base58.Encode(info.GetSignature())
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] transaction %s in slot %d", rule.name, signature, slot)
+	if info.GetMeta().GetErr() != nil {
+		b.WriteString(" failed")
+	}
+	for _, change := range moved {
+		fmt.Fprintf(&b, "\n%s: %s SOL", change.Account, sink.FormatSOL(change.Change))
+	}
+	if s.explorerURL != "" {
+		b.WriteString("\n" + strings.ReplaceAll(s.explorerURL, "{signature}", signature))
+	}
+	return b.String()
+}
+
+// alertDestination posts the alerts queued for a destination one at a time.
+type alertDestination struct {
+	name   string
+	kind   string
+	url    string
+	chatID string
+	client *http.Client
+	// limiter drops the alerts beyond the rate limit.
+	limiter *alertLimiter
+	queue   chan string
+}
+
+func newAlertDestination(config AlertDestinationConfig, alerts AlertsConfig) *alertDestination {
+	d := &alertDestination{
+		name:    config.Name,
+		kind:    config.Type,
+		url:     config.URL,
+		chatID:  config.ChatID,
+		client:  &http.Client{Timeout: time.Duration(alerts.Timeout)},
+		limiter: newAlertLimiter(alerts.RateLimit, time.Duration(alerts.RateInterval)),
+		queue:   make(chan string, alerts.QueueSize),
+	}
+	if d.kind == "telegram" {
+		base := d.url
+		if base == "" {
+			base = "https://api.telegram.org"
+		}
+		d.url = strings.TrimSuffix(base, "/") + "/bot" + config.BotToken + "/sendMessage"
+	}
+	return d
+}
+
+func (d *alertDestination) enqueue(text string) {
+	if !d.limiter.allow() {
+		metrics.AlertsTotal.WithLabelValues(d.name, "rate_limited").Inc()
+		return
+	}
+	select {
+	case d.queue <- text:
+	default:
+		metrics.AlertsTotal.WithLabelValues(d.name, "queue_full").Inc()
+	}
+}
+
+func (d *alertDestination) run() {
+	for text := range d.queue {
+		if err := d.post(text); err != nil {
+			metrics.AlertsTotal.WithLabelValues(d.name, "failed").Inc()
+			// the URL of a request error holds the webhook or bot token
+			logging.Logger.Warn("failed to post alert", zap.String("destination", d.name), zap.String("error", strings.ReplaceAll(err.Error(), d.url, d.kind)))
+			continue
+		}
+		metrics.AlertsTotal.WithLabelValues(d.name, "sent").Inc()
+	}
+}
+
+func (d *alertDestination) post(text string) error {
+	var payload any
+	switch d.kind {
+	case "slack":
+		payload = map[string]string{"text": text}
+	case "discord":
+		payload = map[string]string{"content": text}
+	case "telegram":
+		payload = map[string]any{"chat_id": d.chatID, "text": text, "disable_web_page_preview": true}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d %s", d.kind, resp.StatusCode, bytes.TrimSpace(text))
+	}
+	return nil
+}
+
+// alertLimiter is a token bucket holding up to limit alerts, refilled at
+// limit per interval.
+type alertLimiter struct {
+	limit    float64
+	interval time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newAlertLimiter(limit int, interval time.Duration) *alertLimiter {
+	return &alertLimiter{limit: float64(limit), interval: interval, tokens: float64(limit), last: time.Now()}
+}
+
+func (l *alertLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.limit, l.tokens+l.limit*float64(now.Sub(l.last))/float64(l.interval))
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// chatServer records the alerts posted to it by path.
+type chatServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	posts map[string][]map[string]any
+}
+
+func newChatServer(t *testing.T) *chatServer {
+	s := &chatServer{posts: make(map[string][]map[string]any)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var post map[string]any
+		if err := json.Unmarshal(body, &post); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.posts[r.URL.Path] = append(s.posts[r.URL.Path], post)
+		s.mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestAlertSink(t *testing.T) {
+	server := newChatServer(t)
+	config := DefaultAlertsConfig()
+	config.Destinations = []AlertDestinationConfig{
+		{Name: "ops", Type: "slack", URL: server.URL + "/slack"},
+		{Name: "community", Type: "discord", URL: server.URL + "/discord"},
+		{Name: "phone", Type: "telegram", URL: server.URL, BotToken: "123:abc", ChatID: "42"},
+	}
+	config.Rules = []AlertRuleConfig{
+		{Name: "treasury", Accounts: []string{testkey.String(1)}, MinSOL: 0.000005, Destinations: []string{"ops", "phone"}},
+		{Name: "market", Programs: []string{testkey.String(9)}, IncludeFailed: true, Destinations: []string{"community"}},
+		{Name: "whale", MinSOL: 1, Destinations: []string{"ops"}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	next := &sinktest.RecordSink{}
+	s, err := NewAlertSink(next, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := decodetest.BalanceTransaction(11)
+	failed.Update.GetTransaction().GetTransaction().Meta.Err = &proto.TransactionError{Err: []byte{1}}
+	for _, msg := range []*decode.Message{decodetest.BalanceTransaction(10), failed, decodetest.AccountMessage(12, testkey.Key(1), testkey.Key(2))} {
+		if err := s.Write(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Written) != 3 {
+		t.Fatalf("%d messages written, want all", len(next.Written))
+	}
+
+	want := "[treasury] transaction " + testkey.String(0xff) + " in slot 10\n" + testkey.String(1) + ": -0.000005 SOL\n" +
+		"https://explorer.solana.com/tx/" + testkey.String(0xff)
+	if posts := server.posts["/slack"]; len(posts) != 1 || posts[0]["text"] != want {
+		t.Fatalf("slack got %v, want %q", posts, want)
+	}
+	if posts := server.posts["/bot123:abc/sendMessage"]; len(posts) != 1 || posts[0]["chat_id"] != "42" || posts[0]["text"] != want {
+		t.Fatalf("telegram got %v", server.posts)
+	}
+	posts := server.posts["/discord"]
+	if len(posts) != 2 || !strings.Contains(posts[1]["content"].(string), "in slot 11 failed\n") {
+		t.Fatalf("discord got %v", posts)
+	}
+}
+
+func TestAlertRateLimit(t *testing.T) {
+	server := newChatServer(t)
+	config := DefaultAlertsConfig()
+	config.RateLimit, config.ExplorerURL = 2, ""
+	config.Destinations = []AlertDestinationConfig{{Name: "ops", Type: "slack", URL: server.URL}}
+	config.Rules = []AlertRuleConfig{{Name: "all", Programs: []string{testkey.String(9)}, Destinations: []string{"ops"}}}
+	s, err := NewAlertSink(&sinktest.RecordSink{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := uint64(1); slot <= 5; slot++ {
+		if err := s.Write(context.Background(), decodetest.TransactionMessage(slot, testkey.Key(9), testkey.Key(1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	if posts := server.posts["/"]; len(posts) != 2 || posts[1]["text"] != "[all] transaction "+testkey.String(0xff)+" in slot 2" {
+		t.Fatalf("got %v, want the first 2 alerts", posts)
+	}
+}
+
+func TestAlertsConfigValidate(t *testing.T) {
+	slack := AlertDestinationConfig{Name: "ops", Type: "slack", URL: "https://hooks.slack.com/services/x"}
+	for _, destinations := range [][]AlertDestinationConfig{
+		{{Name: "ops", Type: "teams", URL: slack.URL}},
+		{{Name: "ops", Type: "discord", URL: "discord"}},
+		{{Name: "ops", Type: "telegram", BotToken: "123:abc"}},
+		{slack, slack},
+	} {
+		config := DefaultAlertsConfig()
+		config.Destinations = destinations
+		config.Rules = []AlertRuleConfig{{Name: "all", MinSOL: 1, Destinations: []string{"ops"}}}
+		if err := config.Validate(); err == nil {
+			t.Errorf("validated %+v", destinations)
+		}
+	}
+	for _, rule := range []AlertRuleConfig{
+		{Name: "all", Destinations: []string{"ops"}},
+		{Name: "all", MinSOL: 1},
+		{Name: "all", MinSOL: 1, Destinations: []string{"dev"}},
+		{Name: "all", Accounts: []string{"nope"}, Destinations: []string{"ops"}},
+		{MinSOL: 1, Destinations: []string{"ops"}},
+	} {
+		config := DefaultAlertsConfig()
+		config.Destinations = []AlertDestinationConfig{slack}
+		config.Rules = []AlertRuleConfig{rule}
+		if err := config.Validate(); err == nil {
+			t.Errorf("validated %+v", rule)
+		}
+	}
+}
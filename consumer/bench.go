@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/sink"
+)
+
+// BenchOptions select the records of the bench command and where they go.
+// They are flags only, not part of the config file.
+type BenchOptions struct {
+	Count   int
+	File    string
+	Kafka   bool
+	Discard bool
+	JSON    bool
+	Mock    *MockOptions
+}
+
+func RegisterBenchFlags(fs *flag.FlagSet) *BenchOptions {
+	o := &BenchOptions{Mock: registerMockSourceFlags(fs)}
+	fs.IntVar(&o.Count, "messages", 100_000, "number of records to process")
+	fs.StringVar(&o.File, "file", "", "replay the records of this capture file instead of mock records")
+	fs.BoolVar(&o.Kafka, "kafka", false, "read the oldest records of the topics instead of mock records, fewer when the topics hold fewer")
+	fs.BoolVar(&o.Discard, "discard", false, "drop the messages after the filter instead of writing them to the sink")
+	fs.BoolVar(&o.JSON, "json", false, "print the result as JSON")
+	return o
+}
+
+// benchResult is what a bench run measured. Allocations are those of the
+// whole process while the records were processed, divided by the records.
+type benchResult struct {
+	Messages         int           `json:"messages"`
+	Bytes            int64         `json:"bytes"`
+	Elapsed          time.Duration `json:"elapsed_ns"`
+	MessagesPerSec   float64       `json:"messages_per_sec"`
+	MBPerSec         float64       `json:"mb_per_sec"`
+	AllocsPerMessage float64       `json:"allocs_per_message"`
+	BytesPerMessage  float64       `json:"alloc_bytes_per_message"`
+	P50              time.Duration `json:"p50_ns"`
+	P99              time.Duration `json:"p99_ns"`
+	Max              time.Duration `json:"max_ns"`
+	Filtered         int           `json:"filtered"`
+	Failed           int           `json:"failed"`
+}
+
+// runBench feeds records through replay and measures it, the flush of the
+// sink at the end included. The latency of a record is the time from the
+// start of its decoding to the return of the sink write.
+func runBench(ctx context.Context, records []*sarama.ConsumerMessage, replay *CaptureReplay) (benchResult, error) {
+	latencies := make([]time.Duration, 0, len(records))
+	var stats captureReplayStats
+	var size int64
+	for _, record := range records {
+		size += int64(len(record.Value))
+	}
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for _, record := range records {
+		if ctx.Err() != nil {
+			break
+		}
+		began := time.Now()
+		replay.replay(ctx, record, &stats)
+		latencies = append(latencies, time.Since(began))
+	}
+	err := replay.sink.Flush(ctx)
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	result := benchResult{
+		Messages: len(latencies),
+		Bytes:    size,
+		Elapsed:  elapsed,
+		Filtered: stats.Filtered,
+		Failed:   stats.Failed,
+	}
+	if result.Messages == 0 {
+		return result, err
+	}
+	seconds := elapsed.Seconds()
+	result.MessagesPerSec = float64(result.Messages) / seconds
+	result.MBPerSec = float64(size) / seconds / (1 << 20)
+	result.AllocsPerMessage = float64(after.Mallocs-before.Mallocs) / float64(result.Messages)
+	result.BytesPerMessage = float64(after.TotalAlloc-before.TotalAlloc) / float64(result.Messages)
+	slices.Sort(latencies)
+	result.P50 = latencies[len(latencies)/2]
+	result.P99 = latencies[min(len(latencies)*99/100, len(latencies)-1)]
+	result.Max = latencies[len(latencies)-1]
+	return result, err
+}
+
+func (r benchResult) write(w io.Writer) {
+	fmt.Fprintf(w, "messages      %d (%d filtered, %d failed)\n", r.Messages, r.Filtered, r.Failed)
+	fmt.Fprintf(w, "elapsed       %s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "messages/sec  %.0f\n", r.MessagesPerSec)
+	fmt.Fprintf(w, "MB/sec        %.2f\n", r.MBPerSec)
+	fmt.Fprintf(w, "allocs/msg    %.1f (%.0f bytes)\n", r.AllocsPerMessage, r.BytesPerMessage)
+	fmt.Fprintf(w, "latency       p50 %s, p99 %s, max %s\n", r.P50, r.P99, r.Max)
+}
+
+// mockRecords returns the first count records of source.
+func mockRecords(source *MockSource, count int) []*sarama.ConsumerMessage {
+	records := make([]*sarama.ConsumerMessage, 0, count)
+	now := time.Now()
+	for len(records) < count {
+		records = append(records, source.nextSlot(now)...)
+	}
+	return records[:count]
+}
+
+// discardSink drops every message, for measuring the decoder alone.
+type discardSink struct{}
+
+func (discardSink) Write(context.Context, *decode.Message) error { return nil }
+func (discardSink) Flush(context.Context) error                  { return nil }
+func (discardSink) Close() error                                 { return nil }
+
+func runBenchCommand(fs *flag.FlagSet, args []string) {
+	options := RegisterBenchFlags(fs)
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	if options.Count <= 0 || options.File != "" && options.Kafka {
+		logging.Logger.Fatal("invalid flags", zap.Error(errors.New("--messages must be positive, and --file and --kafka exclude each other")))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	decode.DefaultIDLDecoder, err = decode.LoadIDLs(context.Background(), config.Decoding.IDL)
+	if err != nil {
+		logging.Logger.Fatal("failed to load idls", zap.Error(err))
+	}
+	decoding := config.Decoding
+	var records []*sarama.ConsumerMessage
+	switch {
+	case options.File != "":
+		in, err := openCapture(options.File)
+		if err != nil {
+			logging.Logger.Fatal("failed to open capture file", zap.Error(err))
+		}
+		err = readCapture(in, func(record *sarama.ConsumerMessage) bool {
+			records = append(records, record)
+			return len(records) < options.Count
+		})
+		in.Close()
+		if err != nil {
+			logging.Logger.Fatal("failed to read capture file", zap.Error(err))
+		}
+	case options.Kafka:
+		saramaConfig, err := config.Kafka.Sarama()
+		if err != nil {
+			logging.Logger.Fatal("invalid config", zap.Error(err))
+		}
+		client, err := sarama.NewClient(config.Kafka.Brokers, saramaConfig)
+		if err != nil {
+			logging.Logger.Fatal("failed to create kafka client", zap.Error(err))
+		}
+		defer client.Close()
+		discovery, err := consumer.NewTopicDiscovery(client, config.Kafka)
+		if err != nil {
+			logging.Logger.Fatal("failed to discover topics", zap.Error(err))
+		}
+		capture, err := NewCapture(client, discovery.Topics(), options.Count, true)
+		if err != nil {
+			logging.Logger.Fatal("failed to create kafka consumer", zap.Error(err))
+		}
+		capture.toEnd = true
+		// fetched up front, so the run measures the pipeline and not the
+		// network
+		var buf bytes.Buffer
+		if _, err := capture.Run(ctx, &buf); err != nil {
+			logging.Logger.Fatal("failed to read records", zap.Error(err))
+		}
+		if err := readCapture(&buf, func(record *sarama.ConsumerMessage) bool {
+			records = append(records, record)
+			return true
+		}); err != nil {
+			logging.Logger.Fatal("failed to read records", zap.Error(err))
+		}
+	default:
+		options.Mock.Topic = mockTopic(config.Kafka)
+		source, err := NewMockSource(*options.Mock)
+		if err != nil {
+			logging.Logger.Fatal("invalid flags", zap.Error(err))
+		}
+		records = mockRecords(source, options.Count)
+		decoding = decode.Config{Kind: string(decode.KindUpdate), Sample: config.Decoding.Sample}
+	}
+	decoder, err := decode.NewDecoder(decoding)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	filter, err := filter.New(config.Filter)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	var s sink.Sink = discardSink{}
+	if !options.Discard {
+		if s, err = sink.NewRouted(context.Background(), config.Sink, config.Routes); err != nil {
+			logging.Logger.Fatal("failed to create sink", zap.Error(err))
+		}
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			logging.Logger.Error("failed to close sink", zap.Error(err))
+		}
+	}()
+
+	logging.Logger.Info("benchmark is running", zap.Int("messages", len(records)), zap.String("sink", config.Sink.Type), zap.Bool("discard", options.Discard))
+	result, err := runBench(ctx, records, NewCaptureReplay(decoder, filter, s, config.Retry))
+	if err != nil {
+		logging.Logger.Error("sink flush failed", zap.Error(err))
+	}
+	// stderr when the sink writes to stdout
+	out := io.Writer(os.Stdout)
+	if config.Sink.Type == "stdout" && !options.Discard {
+		out = os.Stderr
+	}
+	if options.JSON {
+		data, _ := json.Marshal(result)
+		fmt.Fprintln(out, string(data))
+		return
+	}
+	result.write(out)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+
+	"consumer/internal/sinktest"
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+)
+
+func TestRunBench(t *testing.T) {
+	source, err := NewMockSource(MockOptions{TPS: 1000, Programs: decode.SystemProgramID, FailureRate: 0.1, Seed: 3, Slot: 1, Topic: "updates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := mockRecords(source, 1000)
+	if len(records) != 1000 {
+		t.Fatalf("%d records", len(records))
+	}
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := filter.New(filter.Config{ExcludeFailed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.RecordSink{}
+	result, err := runBench(context.Background(), records, NewCaptureReplay(decoder, filter, sink, consumer.RetryConfig{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Messages != 1000 || result.Filtered == 0 || result.Filtered+len(sink.Written) != 1000 || result.Failed != 0 {
+		t.Fatalf("result %+v, %d written", result, len(sink.Written))
+	}
+	if result.Bytes == 0 || result.MessagesPerSec <= 0 || result.AllocsPerMessage <= 0 || result.P50 > result.P99 || result.P99 > result.Max {
+		t.Fatalf("result %+v", result)
+	}
+	var out bytes.Buffer
+	result.write(&out)
+	if !strings.Contains(out.String(), "messages/sec") || !strings.Contains(out.String(), "p99") {
+		t.Fatalf("output %q", out.String())
+	}
+}
+
+func TestBenchFlags(t *testing.T) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	options := RegisterBenchFlags(fs)
+	RegisterOverrides(fs)
+	// --messages is the only count, the --count of mock is not taken
+	if err := fs.Parse([]string{"--messages", "2000", "--tps", "50"}); err != nil {
+		t.Fatal(err)
+	}
+	if options.Count != 2000 || options.Mock.TPS != 50 || fs.Lookup("count") != nil {
+		t.Fatalf("options %+v, mock %+v", options, options.Mock)
+	}
+}
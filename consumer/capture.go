@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/sink"
+)
+
+// captureRecord is a Kafka record as a line of a capture file: the raw value
+// as produced, decoded again on replay, and the metadata the decoder and the
+// sinks read.
+type captureRecord struct {
+	Topic     string          `json:"topic"`
+	Partition int32           `json:"partition"`
+	Offset    int64           `json:"offset"`
+	Timestamp time.Time       `json:"timestamp"`
+	Key       []byte          `json:"key,omitempty"`
+	Headers   []captureHeader `json:"headers,omitempty"`
+	Value     []byte          `json:"value"`
+}
+
+// captureHeader is a record header, its value in base64 like the record
+// value since headers need not be UTF-8.
+type captureHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func newCaptureRecord(record *sarama.ConsumerMessage) captureRecord {
+	c := captureRecord{
+		Topic:     record.Topic,
+		Partition: record.Partition,
+		Offset:    record.Offset,
+		Timestamp: record.Timestamp,
+		Key:       record.Key,
+		Value:     record.Value,
+	}
+	for _, header := range record.Headers {
+		c.Headers = append(c.Headers, captureHeader{Key: string(header.Key), Value: header.Value})
+	}
+	return c
+}
+
+func (c captureRecord) consumerMessage() *sarama.ConsumerMessage {
+	record := &sarama.ConsumerMessage{
+		Topic:     c.Topic,
+		Partition: c.Partition,
+		Offset:    c.Offset,
+		Timestamp: c.Timestamp,
+		Key:       c.Key,
+		Value:     c.Value,
+	}
+	for _, header := range c.Headers {
+		record.Headers = append(record.Headers, &sarama.RecordHeader{Key: []byte(header.Key), Value: header.Value})
+	}
+	return record
+}
+
+// createCapture opens path for writing a capture, compressed with zstd when
+// its name ends in .zst, stdout for -.
+func createCapture(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".zst") {
+		return file, nil
+	}
+	zw, err := zstd.NewWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return zstdFile{Encoder: zw, file: file}, nil
+}
+
+// openCapture opens a capture written by createCapture, stdin for -.
+func openCapture(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".zst") {
+		return file, nil
+	}
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return readCloser{Reader: zr, close: func() error {
+		zr.Close()
+		return file.Close()
+	}}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// zstdFile closes the compressed stream before its file.
+type zstdFile struct {
+	*zstd.Encoder
+	file *os.File
+}
+
+func (f zstdFile) Close() error {
+	return errors.Join(f.Encoder.Close(), f.file.Close())
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// Capture writes the records of every partition of the topics to a capture
+// file until it holds count of them. Records of different partitions are
+// interleaved as they arrive; a replay reads them in the order written.
+type Capture struct {
+	consumer sarama.Consumer
+	client   sarama.Client
+	topics   []string
+	count    int
+	// start is sarama.OffsetOldest or sarama.OffsetNewest.
+	start int64
+	// toEnd stops each partition at the high water mark it had when the
+	// capture started, so a capture of topics holding fewer than count
+	// records ends instead of waiting for more.
+	toEnd bool
+
+	mu       sync.Mutex
+	w        *bufio.Writer
+	captured int
+}
+
+func NewCapture(client sarama.Client, topics []string, count int, oldest bool) (*Capture, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{consumer: consumer, client: client, topics: topics, count: count, start: sarama.OffsetNewest}
+	if oldest {
+		c.start = sarama.OffsetOldest
+	}
+	return c, nil
+}
+
+// Run captures to w and returns the number of records written once count
+// were, every partition reached its end with toEnd, or ctx is cancelled.
+func (c *Capture) Run(ctx context.Context, w io.Writer) (int, error) {
+	defer c.consumer.Close()
+	c.w = bufio.NewWriter(w)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var partitions sync.WaitGroup
+	stop := func(err error) (int, error) {
+		cancel(nil)
+		partitions.Wait()
+		return c.captured, errors.Join(err, c.w.Flush())
+	}
+	for _, topic := range c.topics {
+		ids, err := c.client.Partitions(topic)
+		if err != nil {
+			return stop(fmt.Errorf("partitions of %s: %w", topic, err))
+		}
+		for _, partition := range ids {
+			end := int64(-1)
+			if c.toEnd {
+				first, last, err := c.bounds(topic, partition)
+				if err != nil {
+					return stop(fmt.Errorf("offsets of %s/%d: %w", topic, partition, err))
+				}
+				if first >= last {
+					continue
+				}
+				end = last
+			}
+			pc, err := c.consumer.ConsumePartition(topic, partition, c.start)
+			if err != nil {
+				return stop(fmt.Errorf("consume %s/%d: %w", topic, partition, err))
+			}
+			partitions.Add(1)
+			go func() {
+				defer partitions.Done()
+				defer pc.Close()
+				if err := c.partition(ctx, pc, end); err != nil {
+					cancel(fmt.Errorf("consume %s/%d: %w", topic, partition, err))
+				}
+			}()
+		}
+	}
+	partitions.Wait()
+	err := context.Cause(ctx)
+	if errors.Is(err, errCaptureDone) || errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return c.captured, errors.Join(err, c.w.Flush())
+}
+
+// errCaptureDone stops the partitions once count records were captured.
+var errCaptureDone = errors.New("capture done")
+
+// bounds returns the offset a partition is captured from and its high water
+// mark.
+func (c *Capture) bounds(topic string, partition int32) (first, end int64, err error) {
+	if end, err = c.client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+		return 0, 0, err
+	}
+	if c.start == sarama.OffsetNewest {
+		return end, end, nil
+	}
+	first, err = c.client.GetOffset(topic, partition, c.start)
+	return first, end, err
+}
+
+// partition captures the records of pc, up to the offset before end unless
+// it is negative.
+func (c *Capture) partition(ctx context.Context, pc sarama.PartitionConsumer, end int64) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-pc.Errors():
+			return err
+		case record, ok := <-pc.Messages():
+			if !ok {
+				return nil
+			}
+			done, err := c.write(record)
+			if err != nil {
+				return err
+			}
+			if done {
+				return errCaptureDone
+			}
+			if end >= 0 && record.Offset+1 >= end {
+				return nil
+			}
+		}
+	}
+}
+
+// write appends record to the capture and reports whether it is complete.
+func (c *Capture) write(record *sarama.ConsumerMessage) (bool, error) {
+	line, err := json.Marshal(newCaptureRecord(record))
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.captured >= c.count {
+		return true, nil
+	}
+	if _, err := c.w.Write(append(line, '\n')); err != nil {
+		return false, err
+	}
+	c.captured++
+	return c.captured >= c.count, nil
+}
+
+// CaptureReplay feeds the records of a capture file through the decoder,
+// the filter and the sink as the consumer does, in the order of the file and
+// without Kafka, so a replay of the same capture writes the same messages.
+type CaptureReplay struct {
+	decoder *decode.Decoder
+	filter  *filter.Filter
+	sink    sink.Sink
+	retry   consumer.RetryConfig
+}
+
+func NewCaptureReplay(decoder *decode.Decoder, filter *filter.Filter, sink sink.Sink, retry consumer.RetryConfig) *CaptureReplay {
+	return &CaptureReplay{decoder: decoder, filter: filter, sink: sink, retry: retry}
+}
+
+// captureReplayStats counts the records of a CaptureReplay.
+type captureReplayStats struct {
+	Read     int
+	Filtered int
+	Written  int
+	Failed   int
+}
+
+// Run replays the capture in r and flushes the sink. Records failing to
+// decode or write are logged and counted.
+func (r *CaptureReplay) Run(ctx context.Context, in io.Reader) (captureReplayStats, error) {
+	var stats captureReplayStats
+	err := readCapture(in, func(record *sarama.ConsumerMessage) bool {
+		stats.Read++
+		r.replay(ctx, record, &stats)
+		return ctx.Err() == nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, r.sink.Flush(ctx)
+}
+
+// readCapture calls fn with the records of a capture in the order of the
+// file, until fn returns false.
+func readCapture(in io.Reader, fn func(record *sarama.ConsumerMessage) bool) error {
+	lines := bufio.NewScanner(in)
+	lines.Buffer(nil, 64<<20)
+	for line := 1; lines.Scan(); line++ {
+		var c captureRecord
+		if err := json.Unmarshal(lines.Bytes(), &c); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if !fn(c.consumerMessage()) {
+			return nil
+		}
+	}
+	return lines.Err()
+}
+
+func (r *CaptureReplay) replay(ctx context.Context, record *sarama.ConsumerMessage, stats *captureReplayStats) {
+	if !r.decoder.SampleRecord(record) {
+		stats.Filtered++
+		return
+	}
+	msg, err := r.decoder.Decode(record)
+	if err != nil {
+		stats.Failed++
+		logging.Logger.Error("captured record failed to decode", append(logging.RecordFields(record), zap.Error(err))...)
+		return
+	}
+	if ok, _ := r.filter.Allow(msg); !ok || !r.decoder.SampleMessage(msg) {
+		stats.Filtered++
+		return
+	}
+	err = r.retry.Do(ctx, func() error {
+		return r.sink.Write(ctx, msg)
+	}, func(attempt int, delay time.Duration, err error) {
+		logging.Logger.Warn("sink write failed, retrying",
+			append(decode.MessageFields(msg), zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.Error(err))...)
+	})
+	if err != nil {
+		stats.Failed++
+		logging.Logger.Error("captured record failed to write", append(decode.MessageFields(msg), zap.Error(err))...)
+		return
+	}
+	stats.Written++
+}
+
+func runCapture(fs *flag.FlagSet, args []string) {
+	file := fs.String("file", "", "capture file to write, zstd compressed when it ends in .zst, - for stdout")
+	count := fs.Int("count", 1000, "number of records to capture")
+	oldest := fs.Bool("oldest", false, "start at the oldest retained records instead of the next ones produced")
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	if *file == "" || *count <= 0 {
+		logging.Logger.Fatal("invalid flags", zap.Error(errors.New("--file is required and --count must be positive")))
+	}
+
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	client, err := sarama.NewClient(config.Kafka.Brokers, saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka client", zap.Error(err))
+	}
+	defer client.Close()
+	discovery, err := consumer.NewTopicDiscovery(client, config.Kafka)
+	if err != nil {
+		logging.Logger.Fatal("failed to discover topics", zap.Error(err))
+	}
+	capture, err := NewCapture(client, discovery.Topics(), *count, *oldest)
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka consumer", zap.Error(err))
+	}
+	w, err := createCapture(*file)
+	if err != nil {
+		logging.Logger.Fatal("failed to create capture file", zap.Error(err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	logging.Logger.Info("capturing records", zap.Strings("topics", discovery.Topics()), zap.Int("count", *count), zap.String("file", *file))
+	captured, err := capture.Run(ctx, w)
+	err = errors.Join(err, w.Close())
+	if err != nil {
+		logging.Logger.Fatal("capture failed", zap.Int("captured", captured), zap.Error(err))
+	}
+	logging.Logger.Info("records captured", zap.Int("captured", captured), zap.String("file", *file))
+}
+
+func runReplayCapture(fs *flag.FlagSet, args []string) {
+	file := fs.String("file", "", "capture file to replay, as written by capture, - for stdin")
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	// set when records failed to replay, to exit with a failure status once
+	// the sink was closed
+	var failed bool
+	defer func() {
+		if failed {
+			logging.Logger.Sync()
+			os.Exit(1)
+		}
+	}()
+	if *file == "" {
+		logging.Logger.Fatal("invalid flags", zap.Error(errors.New("--file is required")))
+	}
+
+	var err error
+	decode.DefaultIDLDecoder, err = decode.LoadIDLs(context.Background(), config.Decoding.IDL)
+	if err != nil {
+		logging.Logger.Fatal("failed to load idls", zap.Error(err))
+	}
+	decoder, err := decode.NewDecoder(config.Decoding)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	filter, err := filter.New(config.Filter)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	sink, err := sink.NewRouted(context.Background(), config.Sink, config.Routes)
+	if err != nil {
+		logging.Logger.Fatal("failed to create sink", zap.Error(err))
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			logging.Logger.Error("failed to close sink", zap.Error(err))
+		}
+	}()
+	in, err := openCapture(*file)
+	if err != nil {
+		logging.Logger.Fatal("failed to open capture file", zap.Error(err))
+	}
+	defer in.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	stats, err := NewCaptureReplay(decoder, filter, sink, config.Retry).Run(ctx, in)
+	fields := []zap.Field{
+		zap.String("file", *file),
+		zap.Int("read", stats.Read),
+		zap.Int("filtered", stats.Filtered),
+		zap.Int("written", stats.Written),
+		zap.Int("failed", stats.Failed),
+	}
+	if err != nil {
+		logging.Logger.Error("capture replay failed", append(fields, zap.Error(err))...)
+		failed = true
+		return
+	}
+	if stats.Failed > 0 {
+		logging.Logger.Error("some captured records failed to replay", fields...)
+		failed = true
+		return
+	}
+	logging.Logger.Info("capture replayed", fields...)
+}
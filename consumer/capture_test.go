@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson.zst")
+	w, err := createCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := &Capture{w: bufio.NewWriter(w), count: 3}
+	produced := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, program := range [][]byte{testkey.Key(1), testkey.Key(2), nil} {
+		value := []byte("not protobuf")
+		if program != nil {
+			if value, err = gproto.Marshal(decodetest.TransactionMessage(uint64(10+i), program).Update); err != nil {
+				t.Fatal(err)
+			}
+		}
+		record := &sarama.ConsumerMessage{Topic: "updates", Partition: 1, Offset: int64(i), Timestamp: produced, Value: value,
+			Headers: []*sarama.RecordHeader{{Key: []byte(decode.HeaderSource), Value: []byte("node1")}}}
+		if done, err := capture.write(record); err != nil || done != (i == 2) {
+			t.Fatalf("write %d: %t, %v", i, done, err)
+		}
+	}
+	if done, _ := capture.write(&sarama.ConsumerMessage{}); !done || capture.captured != 3 {
+		t.Fatalf("captured %d", capture.captured)
+	}
+	if err := capture.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := filter.New(filter.Config{ProgramInclude: []string{testkey.String(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := openCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	sink := &sinktest.RecordSink{}
+	stats, err := NewCaptureReplay(decoder, filter, sink, consumer.RetryConfig{MaxAttempts: 1}).Run(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (captureReplayStats{Read: 3, Filtered: 1, Written: 1, Failed: 1}) || len(sink.Written) != 1 {
+		t.Fatalf("stats %+v, %d written", stats, len(sink.Written))
+	}
+	msg := sink.Written[0]
+	if msg.Topic != "updates" || msg.Partition != 1 || msg.Offset != 0 || msg.Slot != 10 || !msg.Timestamp.Equal(produced) ||
+		msg.Headers[decode.HeaderSource] != "node1" {
+		t.Fatalf("written %+v", msg)
+	}
+}
+
+func TestCaptureRecordHeaders(t *testing.T) {
+	record := &sarama.ConsumerMessage{Topic: "updates", Value: []byte{1}, Headers: []*sarama.RecordHeader{
+		{Key: []byte(decode.HeaderSource), Value: []byte("node1")},
+		{Key: []byte("binary"), Value: []byte{0xff, 0x00, 0xc3}},
+		{Key: []byte("empty")},
+	}}
+	line, err := json.Marshal(newCaptureRecord(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var captured captureRecord
+	if err := json.Unmarshal(line, &captured); err != nil {
+		t.Fatal(err)
+	}
+	replayed := captured.consumerMessage()
+	if len(replayed.Headers) != 3 {
+		t.Fatalf("headers %v", replayed.Headers)
+	}
+	for i, header := range record.Headers {
+		if got := replayed.Headers[i]; string(got.Key) != string(header.Key) || !bytes.Equal(got.Value, header.Value) {
+			t.Errorf("header %s: got %s %x, want %x", header.Key, got.Key, got.Value, header.Value)
+		}
+	}
+}
+
+func TestCaptureToEnd(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	fetch := sarama.NewMockFetchResponse(t, 1).SetHighWaterMark("updates", 0, 3)
+	for offset := range int64(3) {
+		fetch.SetMessage("updates", 0, offset, sarama.StringEncoder(fmt.Sprint("record ", offset)))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("updates", 0, broker.BrokerID()).
+			SetLeader("updates", 1, broker.BrokerID()),
+		// partition 1 is empty
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("updates", 0, sarama.OffsetOldest, 0).
+			SetOffset("updates", 0, sarama.OffsetNewest, 3).
+			SetOffset("updates", 1, sarama.OffsetOldest, 0).
+			SetOffset("updates", 1, sarama.OffsetNewest, 0),
+		"FetchRequest": fetch,
+	})
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	capture, err := NewCapture(client, []string{"updates"}, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture.toEnd = true
+
+	// the topic holds fewer records than asked for
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var buf bytes.Buffer
+	captured, err := capture.Run(ctx, &buf)
+	if err != nil || ctx.Err() != nil {
+		t.Fatalf("captured %d, %v, %v", captured, err, ctx.Err())
+	}
+	var values []string
+	if err := readCapture(&buf, func(record *sarama.ConsumerMessage) bool {
+		values = append(values, string(record.Value))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if captured != 3 || !slices.Equal(values, []string{"record 0", "record 1", "record 2"}) {
+		t.Fatalf("captured %d: %q", captured, values)
+	}
+}
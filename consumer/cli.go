@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// command is a mode of the binary, run with the arguments after its name.
+type command struct {
+	name    string
+	aliases []string
+	summary string
+	run     func(fs *flag.FlagSet, args []string)
+}
+
+// commands lists the modes of the binary, consume runs without a command.
+var commands = []command{
+	{name: "consume", summary: "consume the topics and write the updates to the sink (default)", run: runConsumer},
+	{name: "produce", aliases: []string{"grpc2kafka"}, summary: "subscribe to Yellowstone gRPC endpoints and produce the updates to Kafka", run: runGrpc2Kafka},
+	{name: "dedup", summary: "merge redundant topics into one topic without duplicates", run: runDedup},
+	{name: "replay-dlq", aliases: []string{"replay"}, summary: "replay dead letters to their source topic or the sink", run: runReplayDLQ},
+	{name: "capture", summary: "write the next records of the topics to a capture file for offline development", run: runCapture},
+	{name: "replay-capture", summary: "feed the records of a capture file through the decoder, the filter and the sink, without Kafka, also run by replay --file", run: runReplayCapture},
+	{name: "mock", summary: "write synthetic updates to the sink, without Kafka, for demos and integration tests", run: runMock},
+	{name: "bench", summary: "measure the throughput, allocations and latency of the decoder and the sink on a fixed number of records", run: runBenchCommand},
+	{name: "offsets", summary: "export the committed offsets of the group to a JSON file or import one, with export or import", run: runOffsets},
+	{name: "check-config", summary: "validate the config and the overrides for a command, then exit", run: runCheckConfig},
+}
+
+func main() {
+	c, args, err := lookupCommand(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printCommands(os.Stdout)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printCommands(os.Stderr)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags]\n\n%s.\n\nFlags:\n", binaryName(), c.name, capitalize(c.summary))
+		fs.PrintDefaults()
+	}
+	c.run(fs, args)
+}
+
+// lookupCommand returns the command named by the first argument and the
+// arguments after it, consume when the first argument is a flag or missing.
+// replay with --file is replay-capture. It returns flag.ErrHelp for help.
+func lookupCommand(args []string) (command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && !slices.Contains([]string{"-h", "-help", "--help"}, args[0]) {
+		return commands[0], args, nil
+	}
+	if args[0] == "help" || strings.HasPrefix(args[0], "-") {
+		return command{}, nil, flag.ErrHelp
+	}
+	if args[0] == "replay" && slices.ContainsFunc(args[1:], isFileFlag) {
+		args = append([]string{"replay-capture"}, args[1:]...)
+	}
+	for _, c := range commands {
+		if c.name == args[0] || slices.Contains(c.aliases, args[0]) {
+			return c, args[1:], nil
+		}
+	}
+	return command{}, nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+// isFileFlag reports whether arg is the --file flag, in any of the forms the
+// flag package accepts.
+func isFileFlag(arg string) bool {
+	name, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+	return strings.HasPrefix(arg, "-") && name == "file"
+}
+
+func printCommands(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", binaryName())
+	for _, c := range commands {
+		name := c.name
+		if len(c.aliases) > 0 {
+			name += " (" + strings.Join(c.aliases, ", ") + ")"
+		}
+		fmt.Fprintf(out, "  %-28s %s\n", name, c.summary)
+	}
+	fmt.Fprintf(out, "\nRun '%s <command> --help' for the flags of a command.\n", binaryName())
+}
+
+func binaryName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// runCheckConfig validates the config for the command of --for, including
+// what the command checks before it starts, without connecting anywhere.
+func runCheckConfig(fs *flag.FlagSet, args []string) {
+	name := fs.String("for", "consume", "command to check the config for")
+	config, err := parseConfig(fs, args)
+	if err == nil {
+		err = checkConfig(config, *name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("config valid for %s\n", *name)
+}
+
+func checkConfig(config *Config, name string) error {
+	switch name {
+	case "consume", "produce", "grpc2kafka", "dedup", "replay-dlq", "replay", "capture", "replay-capture", "mock", "bench", "offsets":
+	default:
+		return fmt.Errorf("--for: expected consume, produce, dedup, replay-dlq, capture, replay-capture, mock, bench or offsets, got %q", name)
+	}
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		return err
+	}
+	switch name {
+	case "produce", "grpc2kafka":
+		if err := config.Grpc2Kafka.Validate(config.Decoding.SchemaRegistry); err != nil {
+			return err
+		}
+	case "dedup":
+		if err := config.Dedup.Validate(); err != nil {
+			return err
+		}
+		if saramaConfig, err = config.Dedup.ProducerConfig(saramaConfig); err != nil {
+			return err
+		}
+	case "replay-dlq", "replay":
+		if config.DLQ.Topic == "" {
+			return errors.New("dlq.topic: must not be empty")
+		}
+	}
+	if err := saramaConfig.Validate(); err != nil {
+		return fmt.Errorf("kafka: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLookupCommand(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		command string
+		rest    []string
+	}{
+		{nil, "consume", nil},
+		{[]string{"--config", "config.yaml"}, "consume", []string{"--config", "config.yaml"}},
+		{[]string{"grpc2kafka", "--config", "config.yaml"}, "produce", []string{"--config", "config.yaml"}},
+		{[]string{"replay", "--dry-run"}, "replay-dlq", []string{"--dry-run"}},
+		{[]string{"replay-capture", "--file", "capture.ndjson"}, "replay-capture", []string{"--file", "capture.ndjson"}},
+		// replay --file replays a capture, not dead letters
+		{[]string{"replay", "--file", "capture.ndjson"}, "replay-capture", []string{"--file", "capture.ndjson"}},
+		{[]string{"replay", "--config", "config.yaml", "-file=capture.ndjson"}, "replay-capture", []string{"--config", "config.yaml", "-file=capture.ndjson"}},
+		{[]string{"check-config"}, "check-config", []string{}},
+	} {
+		c, rest, err := lookupCommand(test.args)
+		if err != nil || c.name != test.command || !slices.Equal(rest, test.rest) {
+			t.Errorf("%v: got %s %v, %v", test.args, c.name, rest, err)
+		}
+	}
+	for _, args := range [][]string{{"help"}, {"-h"}, {"--help"}} {
+		if _, _, err := lookupCommand(args); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("%v: got %v, want help", args, err)
+		}
+	}
+	if _, _, err := lookupCommand([]string{"consumer"}); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	config := DefaultConfig()
+	if err := checkConfig(config, "consume"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"dedup":        "dedup.inputs",
+		"replay-dlq":   "dlq.topic",
+		"check-config": "--for",
+	} {
+		if err := checkConfig(config, name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", name, err, want)
+		}
+	}
+
+	config.Dedup.Inputs, config.Dedup.Output = []string{"node1", "node2"}, "grpc"
+	config.Dedup.TransactionalID = "dedup-{hostname}"
+	if err := checkConfig(config, "dedup"); err != nil {
+		t.Fatal(err)
+	}
+}
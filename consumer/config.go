@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/sink"
+	"consumer/pkg/tracing"
+)
+
+// Config is the configuration of the consumer and the grpc2kafka and dedup
+// commands, loaded from a YAML or JSON file.
+type Config struct {
+	// Prometheus is the listen address of the metrics and health endpoints,
+	// disabled when empty.
+	Prometheus string                `json:"prometheus" yaml:"prometheus"`
+	Health     consumer.HealthConfig `json:"health" yaml:"health"`
+	Lag        consumer.LagConfig    `json:"lag" yaml:"lag"`
+	WebSocket  StreamServerConfig    `json:"websocket" yaml:"websocket"`
+	// GeyserServer serves the written updates over the Yellowstone gRPC API.
+	GeyserServer GeyserServerConfig        `json:"geyser_server" yaml:"geyser_server"`
+	Query        QueryConfig               `json:"query" yaml:"query"`
+	GraphQL      StreamServerConfig        `json:"graphql" yaml:"graphql"`
+	Tracing      tracing.Config            `json:"tracing" yaml:"tracing"`
+	Kafka        consumer.KafkaConfig      `json:"kafka" yaml:"kafka"`
+	Failover     consumer.FailoverConfig   `json:"failover" yaml:"failover"`
+	Decoding     decode.Config             `json:"decoding" yaml:"decoding"`
+	Processing   consumer.ProcessingConfig `json:"processing" yaml:"processing"`
+	Retry        consumer.RetryConfig      `json:"retry" yaml:"retry"`
+	Filter       filter.Config             `json:"filter" yaml:"filter"`
+	Gaps         consumer.GapConfig        `json:"gaps" yaml:"gaps"`
+	Transfers    TransfersConfig           `json:"transfers" yaml:"transfers"`
+	Swaps        SwapsConfig               `json:"swaps" yaml:"swaps"`
+	Mints        MintsConfig               `json:"mints" yaml:"mints"`
+	// SlotCompletion produces a record once all the transactions of a slot
+	// were written.
+	SlotCompletion SlotCompletionConfig `json:"slot_completion" yaml:"slot_completion"`
+	Rollback       RollbackConfig       `json:"rollback" yaml:"rollback"`
+	Fees           FeesConfig           `json:"fees" yaml:"fees"`
+	Throughput     ThroughputConfig     `json:"throughput" yaml:"throughput"`
+	MEV            MEVConfig            `json:"mev" yaml:"mev"`
+	Alerts         AlertsConfig         `json:"alerts" yaml:"alerts"`
+	Sink           sink.Config          `json:"sink" yaml:"sink"`
+	DLQ            consumer.DLQConfig   `json:"dlq" yaml:"dlq"`
+	Log            logging.Config       `json:"log" yaml:"log"`
+	Reload         ReloadConfig         `json:"reload" yaml:"reload"`
+	Admin          AdminConfig          `json:"admin" yaml:"admin"`
+	// Routes are sinks receiving the messages their filter selects, besides
+	// Sink.
+	Routes []sink.RouteConfig `json:"routes" yaml:"routes"`
+	// Backfill consumes offset ranges instead of joining kafka.group_id.
+	Backfill consumer.BackfillConfig `json:"backfill" yaml:"backfill"`
+	// Grpc2Kafka and Dedup are only used by the commands of the same name.
+	Grpc2Kafka Grpc2KafkaConfig     `json:"grpc2kafka" yaml:"grpc2kafka"`
+	Dedup      consumer.DedupConfig `json:"dedup" yaml:"dedup"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Kafka: consumer.KafkaConfig{
+			Brokers:          []string{"localhost:9092"},
+			Topics:           []string{"test-topic"},
+			GroupID:          "my-consumer-group",
+			TopicRefresh:     duration.Duration(time.Minute),
+			OffsetReset:      "latest",
+			OffsetOutOfRange: "earliest",
+			Commit:           consumer.DefaultCommitConfig(),
+			Fetch:            consumer.DefaultFetchConfig(),
+			Producer:         consumer.DefaultProducerConfig(),
+			BalanceStrategy:  "roundrobin",
+			SessionTimeout:   duration.Duration(10 * time.Second),
+			IsolationLevel:   "read_uncommitted",
+			Client:           consumer.ClientSarama,
+		},
+		Decoding: decode.Config{
+			Kind:           string(decode.KindTransaction),
+			IDL:            decode.DefaultIDLConfig(),
+			LookupTables:   decode.DefaultLookupTablesConfig(),
+			Format:         decode.EncodingProtobuf,
+			WireFormat:     decode.WireFormatAuto,
+			SchemaRegistry: decode.DefaultSchemaRegistryConfig(),
+		},
+		Log: logging.Config{
+			Level:  "info",
+			Format: "console",
+		},
+		Processing: consumer.ProcessingConfig{
+			Workers:     1,
+			QueueSize:   64,
+			OrderingKey: consumer.OrderingByKey,
+			Reorder: sink.ReorderConfig{
+				MaxSlots: 4,
+				MaxDelay: duration.Duration(time.Second),
+			},
+			Commitment: sink.CommitmentConfig{
+				Level:           decode.CommitmentProcessed,
+				MaxPendingSlots: 150,
+			},
+			Blocks:      sink.BlocksConfig{MaxPendingSlots: 150},
+			AccountDiff: sink.AccountDiffConfig{MaxAccounts: 1_000_000},
+			SignatureDedup: consumer.SignatureDedupConfig{
+				TTL:     duration.Duration(2 * time.Minute),
+				MaxSize: 1_000_000,
+			},
+		},
+		Retry:  consumer.DefaultRetryConfig(),
+		Gaps:   consumer.GapConfig{MinSlots: 8, Window: 64},
+		Alerts: DefaultAlertsConfig(),
+		Health: consumer.HealthConfig{StallTimeout: duration.Duration(5 * time.Minute)},
+		Lag:    consumer.DefaultLagConfig(),
+		WebSocket: StreamServerConfig{
+			Path:      "/updates",
+			QueueSize: 1024,
+		},
+		GeyserServer: GeyserServerConfig{QueueSize: 1024},
+		Query:        QueryConfig{Slots: 150},
+		GraphQL: StreamServerConfig{
+			Path:      "/graphql",
+			QueueSize: 1024,
+		},
+		Tracing: tracing.Config{
+			Protocol:    "grpc",
+			SampleRatio: 1,
+			ServiceName: "yellowstone-kafka-consumer",
+		},
+		SlotCompletion: SlotCompletionConfig{MaxPendingSlots: 150},
+		Fees:           DefaultFeesConfig(),
+		Throughput:     DefaultThroughputConfig(),
+		MEV:            DefaultMEVConfig(),
+		Rollback:       DefaultRollbackConfig(),
+		Sink:           sink.DefaultConfig(),
+		Reload:         DefaultReloadConfig(),
+		Failover:       consumer.DefaultFailoverConfig(),
+		Grpc2Kafka:     DefaultGrpc2KafkaConfig(),
+		Dedup:          consumer.DefaultDedupConfig(),
+		Backfill:       consumer.DefaultBackfillConfig(),
+	}
+}
+
+// LoadConfig reads the file at path over the defaults. An empty path returns
+// the defaults. Files ending in .json are parsed as JSON, anything else as YAML.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(config)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(config); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Validate reports the first invalid setting.
+func (c *Config) Validate() error {
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	if err := c.Kafka.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateTopicPattern(); err != nil {
+		return err
+	}
+	if err := c.Failover.Validate(); err != nil {
+		return err
+	}
+	decoder, err := decode.NewDecoder(c.Decoding)
+	if err != nil {
+		return err
+	}
+	if err := c.Decoding.IDL.Validate(); err != nil {
+		return err
+	}
+	if err := c.Decoding.LookupTables.Validate(); err != nil {
+		return err
+	}
+	if err := c.Decoding.SchemaRegistry.Validate(); err != nil {
+		return err
+	}
+	if err := c.Processing.Validate(); err != nil {
+		return err
+	}
+	// the topics matching kafka.topic_pattern are only known once consumed
+	if c.Processing.Commitment.Level != decode.CommitmentProcessed && c.Kafka.TopicPattern == "" && !slices.ContainsFunc(c.Kafka.Topics, func(topic string) bool {
+		kind := decoder.KindOf(topic)
+		return kind == decode.KindSlot || kind == decode.KindUpdate
+	}) {
+		return fmt.Errorf("processing.commitment.level: %s needs slot updates, but no topic of kafka.topics carries slot or update payloads",
+			c.Processing.Commitment.Level)
+	}
+	if c.Processing.Blocks.Enable && c.Kafka.TopicPattern == "" && !slices.ContainsFunc(c.Kafka.Topics, func(topic string) bool {
+		kind := decoder.KindOf(topic)
+		return kind == decode.KindBlockMeta || kind == decode.KindUpdate
+	}) {
+		return errors.New("processing.blocks: needs block metas, but no topic of kafka.topics carries block_meta or update payloads")
+	}
+	if c.Processing.AccountDiff.Enable && c.Kafka.TopicPattern == "" && !slices.ContainsFunc(c.Kafka.Topics, func(topic string) bool {
+		kind := decoder.KindOf(topic)
+		return kind == decode.KindAccount || kind == decode.KindUpdate
+	}) {
+		return errors.New("processing.account_diff: needs account updates, but no topic of kafka.topics carries account or update payloads")
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	if err := c.Health.Validate(); err != nil {
+		return err
+	}
+	if err := c.Lag.Validate(); err != nil {
+		return err
+	}
+	if err := c.WebSocket.validate("websocket"); err != nil {
+		return err
+	}
+	if err := c.Query.Validate(); err != nil {
+		return err
+	}
+	if err := c.GraphQL.validate("graphql"); err != nil {
+		return err
+	}
+	if err := c.GeyserServer.Validate(); err != nil {
+		return err
+	}
+	if c.Decoding.ReuseMessages && c.GeyserServer.Address != "" {
+		return errors.New("decoding.reuse_messages: cannot be used with geyser_server, whose subscriptions keep the updates past their write")
+	}
+	if err := c.Retry.Validate(c.DLQ); err != nil {
+		return err
+	}
+	if err := c.Filter.Validate(); err != nil {
+		return err
+	}
+	if err := c.Gaps.Validate(); err != nil {
+		return err
+	}
+	if err := c.Transfers.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	if err := c.Swaps.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	if err := c.Mints.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	if err := c.SlotCompletion.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	if err := c.Rollback.Validate(c.Kafka.Topics, c.Sink.Type); err != nil {
+		return err
+	}
+	if c.Rollback.enabled() && c.Kafka.TopicPattern == "" && !slices.ContainsFunc(c.Kafka.Topics, func(topic string) bool {
+		kind := decoder.KindOf(topic)
+		return kind == decode.KindSlot || kind == decode.KindUpdate
+	}) {
+		return errors.New("rollback: needs slot updates, but no topic of kafka.topics carries slot or update payloads")
+	}
+	if c.SlotCompletion.Topic != "" && c.Kafka.TopicPattern == "" && !slices.ContainsFunc(c.Kafka.Topics, func(topic string) bool {
+		kind := decoder.KindOf(topic)
+		return kind == decode.KindBlockMeta || kind == decode.KindBlock || kind == decode.KindUpdate
+	}) {
+		return errors.New("slot_completion.topic: needs block metas, but no topic of kafka.topics carries block_meta, block or update payloads")
+	}
+	if err := c.Fees.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	if err := c.Throughput.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	if err := c.MEV.Validate(c.Kafka.Topics); err != nil {
+		return err
+	}
+	for _, section := range []struct {
+		name   string
+		enable bool
+	}{{"fees", c.Fees.Enable}, {"throughput", c.Throughput.Enable}, {"mev", c.MEV.Enable}, {"swaps.topic", c.Swaps.Topic != ""}, {"mints.topic", c.Mints.Topic != ""}, {"query.address", c.Query.Address != ""}} {
+		if section.enable && c.Kafka.TopicPattern == "" && !slices.ContainsFunc(c.Kafka.Topics, func(topic string) bool {
+			kind := decoder.KindOf(topic)
+			return kind == decode.KindTransaction || kind == decode.KindBlock || kind == decode.KindUpdate
+		}) {
+			return fmt.Errorf("%s: needs transactions, but no topic of kafka.topics carries transaction, block or update payloads", section.name)
+		}
+	}
+	if err := c.Alerts.Validate(); err != nil {
+		return err
+	}
+	if err := c.Backfill.Validate(); err != nil {
+		return err
+	}
+	if c.Sink.Type == "postgres" && c.Sink.Postgres.OffsetsTable != "" {
+		// the rows of a partition have to reach the sink in offset order
+		switch {
+		case c.Processing.Workers != 1:
+			return errors.New("sink.postgres.offsets_table: needs processing.workers 1 to write every partition in order")
+		case c.Processing.Reorder.Enable:
+			return errors.New("sink.postgres.offsets_table: cannot be used with processing.reorder, which writes out of offset order")
+		case c.Processing.Commitment.Level != decode.CommitmentProcessed:
+			return errors.New("sink.postgres.offsets_table: needs processing.commitment.level processed, other levels write out of offset order")
+		case c.Processing.Blocks.Enable:
+			return errors.New("sink.postgres.offsets_table: cannot be used with processing.blocks, which writes out of offset order")
+		case len(c.Backfill.Ranges) > 0:
+			return errors.New("sink.postgres.offsets_table: a backfill would move the stored offsets of kafka.group_id")
+		case len(c.Retry.Topics.Delays) > 0:
+			return errors.New("sink.postgres.offsets_table: cannot be used with retry.topics, whose rows would store the offsets of the source topics")
+		case len(c.Failover.Brokers) > 0:
+			return errors.New("sink.postgres.offsets_table: cannot be used with failover, whose rows would mix the offsets of two clusters")
+		}
+	}
+	if len(c.Retry.Topics.Delays) > 0 && len(c.Backfill.Ranges) > 0 {
+		return errors.New("retry.topics: a backfill does not consume the retry topics")
+	}
+	if err := c.Reload.Validate(); err != nil {
+		return err
+	}
+	if err := c.Admin.Validate(); err != nil {
+		return err
+	}
+	if err := sink.ValidateRoutes(c.Routes); err != nil {
+		return err
+	}
+	return c.Sink.Validate()
+}
+
+// validateTopicPattern checks kafka.topic_pattern, which must not match the
+// topics the consumer produces to.
+func (c *Config) validateTopicPattern() error {
+	if c.Kafka.TopicPattern == "" {
+		return nil
+	}
+	re, err := consumer.TopicRegexp(c.Kafka.TopicPattern)
+	if err != nil {
+		return err
+	}
+	if c.Kafka.TopicRefresh <= 0 {
+		return errors.New("kafka.topic_refresh: must be positive")
+	}
+	if len(c.Retry.Topics.Delays) > 0 {
+		return errors.New("retry.topics: cannot be used with kafka.topic_pattern, the retry topics of discovered topics do not exist")
+	}
+	for _, produced := range []struct{ name, topic string }{
+		{"dlq.topic", c.DLQ.Topic},
+		{"transfers.topic", c.Transfers.Topic},
+		{"swaps.topic", c.Swaps.Topic},
+		{"mints.topic", c.Mints.Topic},
+		{"slot_completion.topic", c.SlotCompletion.Topic},
+		{"rollback.topic", c.Rollback.Topic},
+		{"fees.topic", c.Fees.Topic},
+		{"throughput.topic", c.Throughput.Topic},
+		{"mev.topic", c.MEV.Topic},
+		{"gaps.topic", c.Gaps.Topic},
+	} {
+		if produced.topic != "" && re.MatchString(produced.topic) {
+			return fmt.Errorf("kafka.topic_pattern: matches %s %s, which is produced to", produced.name, produced.topic)
+		}
+	}
+	return nil
+}
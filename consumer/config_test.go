@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/filter"
+	"consumer/pkg/sink"
+)
+
+func TestKafkaConfigGroupMembership(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig().Kafka
+	config.BalanceStrategy = "sticky"
+	config.InstanceID = "consumer-{hostname}"
+	config.SessionTimeout = duration.Duration(45 * time.Second)
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saramaConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	group := saramaConfig.Consumer.Group
+	if group.Rebalance.GroupStrategies[0].Name() != sarama.StickyBalanceStrategyName ||
+		group.InstanceId != "consumer-"+hostname || group.Session.Timeout != 45*time.Second {
+		t.Fatalf("strategy %s, instance %q, session timeout %s", group.Rebalance.GroupStrategies[0].Name(), group.InstanceId, group.Session.Timeout)
+	}
+
+	config.IsolationLevel = "read_committed"
+	if saramaConfig, err = config.Sarama(); err != nil || saramaConfig.Consumer.IsolationLevel != sarama.ReadCommitted {
+		t.Fatalf("isolation level %v, %v", saramaConfig.Consumer.IsolationLevel, err)
+	}
+	config.IsolationLevel = "serializable"
+	if _, err := config.Sarama(); err == nil || !strings.Contains(err.Error(), "kafka.isolation_level") {
+		t.Errorf("serializable: got %v", err)
+	}
+	config.IsolationLevel = ""
+
+	for strategy, want := range map[string]string{"cooperative-sticky": "incremental rebalance protocol", "balanced": "expected roundrobin"} {
+		config.BalanceStrategy = strategy
+		if _, err := config.Sarama(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", strategy, err, want)
+		}
+	}
+	// franz-go implements the incremental rebalance protocol
+	config.Client, config.BalanceStrategy = consumer.ClientFranz, "cooperative-sticky"
+	if _, err := config.Sarama(); err != nil {
+		t.Errorf("cooperative-sticky with franz-go: %v", err)
+	}
+}
+
+func TestPostgresOffsetsTable(t *testing.T) {
+	config := DefaultConfig()
+	config.Sink.Type = "postgres"
+	config.Sink.Postgres.DSN = "postgres://localhost/postgres"
+	config.Sink.Postgres.OffsetsTable = "consumer_offsets"
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(c *Config){
+		"workers": func(c *Config) { c.Processing.Workers = 4 },
+		"reorder": func(c *Config) { c.Processing.Reorder.Enable = true },
+		"commitment": func(c *Config) {
+			c.Processing.Commitment.Level = decode.CommitmentConfirmed
+			c.Decoding.Kind = string(decode.KindUpdate)
+		},
+		"backfill": func(c *Config) {
+			c.Backfill.Ranges = []consumer.OffsetRange{{Topic: "updates", End: 10}}
+			c.Backfill.Checkpoint.Path = "backfill.json"
+		},
+		"retry topics": func(c *Config) { c.Retry.Topics.Delays = []duration.Duration{duration.Duration(time.Minute)} },
+		"failover":     func(c *Config) { c.Failover.Brokers = []string{"kafka-b:9092"} },
+	} {
+		invalid := *config
+		change(&invalid)
+		if err := invalid.Validate(); err == nil || !strings.Contains(err.Error(), "offsets_table") {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestKafkaConfigFetch(t *testing.T) {
+	config := DefaultConfig().Kafka
+	config.Fetch = consumer.FetchConfig{MinBytes: 65536, DefaultBytes: 4 << 20, MaxBytes: 8 << 20, MaxWait: duration.Duration(100 * time.Millisecond), ChannelBufferSize: 1024}
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saramaConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fetch := saramaConfig.Consumer.Fetch
+	if fetch.Min != 65536 || fetch.Default != 4<<20 || fetch.Max != 8<<20 || saramaConfig.Consumer.MaxWaitTime != 100*time.Millisecond ||
+		saramaConfig.ChannelBufferSize != 1024 || saramaConfig.Consumer.MaxProcessingTime != 100*time.Millisecond {
+		t.Fatalf("fetch %+v, max wait %s, buffer %d, max processing time %s", fetch, saramaConfig.Consumer.MaxWaitTime,
+			saramaConfig.ChannelBufferSize, saramaConfig.Consumer.MaxProcessingTime)
+	}
+
+	for name, invalid := range map[string]consumer.FetchConfig{
+		"min_bytes":           {MinBytes: -1},
+		"max_bytes":           {DefaultBytes: 1 << 20, MaxBytes: 1 << 10},
+		"max_wait":            {MaxWait: duration.Duration(time.Microsecond)},
+		"channel_buffer_size": {ChannelBufferSize: -1},
+	} {
+		if err := invalid.Validate(); err == nil || !strings.Contains(err.Error(), "kafka.fetch."+name) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestKafkaConfigProducer(t *testing.T) {
+	config := DefaultConfig().Kafka
+	config.Producer = consumer.ProducerConfig{Compression: "zstd", CompressionLevel: 3, Linger: duration.Duration(10 * time.Millisecond), BatchSize: 1000}
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saramaConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	producer := saramaConfig.Producer
+	if producer.Compression != sarama.CompressionZSTD || producer.CompressionLevel != 3 ||
+		producer.Flush.Frequency != 10*time.Millisecond || producer.Flush.Messages != 1000 {
+		t.Fatalf("compression %s level %d, flush %+v", producer.Compression, producer.CompressionLevel, producer.Flush)
+	}
+
+	config.Producer = consumer.ProducerConfig{}
+	if saramaConfig, err = config.Sarama(); err != nil || saramaConfig.Producer.Compression != sarama.CompressionNone ||
+		saramaConfig.Producer.CompressionLevel != sarama.CompressionLevelDefault {
+		t.Fatalf("empty config: %v", err)
+	}
+	config.Producer.Compression = "brotli"
+	if err := config.Producer.Validate(); err == nil || !strings.Contains(err.Error(), "kafka.producer.compression") {
+		t.Errorf("brotli: got %v", err)
+	}
+}
+
+func TestRoutesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(`
+routes:
+  - name: token
+    kinds: [transaction]
+    filter:
+      program_include: [TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA]
+    sink:
+      type: postgres
+      postgres:
+        dsn: postgres://localhost/solana
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	route := config.Routes[0]
+	if route.OnError != sink.RouteErrorFail || route.Sink.Postgres.BatchSize != sink.DefaultPostgresConfig().BatchSize {
+		t.Fatalf("route defaults %+v", route)
+	}
+
+	for _, test := range []struct {
+		routes []sink.RouteConfig
+		want   string
+	}{
+		{[]sink.RouteConfig{{Name: "a", OnError: sink.RouteErrorFail}}, `routes[0].sink.type: unknown sink ""`},
+		{[]sink.RouteConfig{{OnError: sink.RouteErrorFail}}, "routes[0].name: must not be empty"},
+		{[]sink.RouteConfig{route, route}, `routes[1].name: "token" is used twice`},
+		{[]sink.RouteConfig{{Name: "a", Kinds: []string{"tx"}}}, "routes[0].kinds:"},
+		{[]sink.RouteConfig{{Name: "a", Filter: filter.Config{ProgramInclude: []string{"short"}}}}, "routes[0].filter.program_include:"},
+		{[]sink.RouteConfig{{Name: "a", OnError: "dlq"}}, "routes[0].on_error: expected fail or skip"},
+	} {
+		if err := sink.ValidateRoutes(test.routes); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %s", err, test.want)
+		}
+	}
+}
+
+func TestAccountDiffConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Processing.AccountDiff.Enable = true
+	config.Kafka.Topics = []string{"transactions"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "processing.account_diff") {
+		t.Fatalf("got %v", err)
+	}
+	config.Kafka.Topics = append(config.Kafka.Topics, "accounts")
+	config.Decoding.Topics = map[string]string{"accounts": string(decode.KindAccount)}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Processing.AccountDiff.MaxAccounts = 0
+	if err := config.Validate(); err == nil {
+		t.Fatal("max_accounts 0 accepted")
+	}
+}
+
+func TestBlocksConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Processing.Blocks.Enable = true
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "processing.blocks") {
+		t.Fatalf("got %v", err)
+	}
+	config.Kafka.Topics = append(config.Kafka.Topics, "blocks")
+	config.Decoding.Topics = map[string]string{"blocks": string(decode.KindBlockMeta)}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitmentConfigNeedsSlotTopic(t *testing.T) {
+	config := DefaultConfig()
+	config.Kafka.Topics = []string{"grpc.transactions"}
+	config.Processing.Commitment.Level = decode.CommitmentConfirmed
+	if err := config.Validate(); err == nil {
+		t.Fatal("commitment accepted without a slot topic")
+	}
+	config.Kafka.Topics = append(config.Kafka.Topics, "grpc.slots")
+	config.Decoding.InferKind = true
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopicPatternConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Kafka.Topics = nil
+	config.Kafka.TopicPattern = `geyser\.tx\..+`
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(c *Config){
+		"missing closing )": func(c *Config) { c.Kafka.TopicPattern = "geyser.(" },
+		"dlq.topic":         func(c *Config) { c.DLQ.Topic = "geyser.tx.dlq" },
+		"retry.topics":      func(c *Config) { c.Retry.Topics.Delays = []duration.Duration{duration.Duration(time.Minute)} },
+		"kafka.topics":      func(c *Config) { c.Kafka.TopicPattern = "" },
+	} {
+		invalid := *config
+		change(&invalid)
+		if err := invalid.Validate(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestFailoverConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Failover.Brokers = []string{"kafka-b:9092"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	secondary := config.Failover.Kafka(config.Kafka)
+	if secondary.Brokers[0] != "kafka-b:9092" || secondary.Topics[0] != config.Kafka.Topics[0] || secondary.GroupID != config.Kafka.GroupID {
+		t.Fatalf("secondary %+v", secondary)
+	}
+
+	config.Failover.Interval = duration.Duration(time.Minute)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "failover.interval") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestLagConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Lag.Window = duration.Duration(time.Second)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "lag.window") {
+		t.Fatalf("got %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := RegisterOverrides(fs)
+	if err := fs.Parse([]string{"--max-lag-exit", "5000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := overrides.Apply(config); err != nil || config.Lag.MaxExit != 5000 {
+		t.Fatalf("max exit %d, %v", config.Lag.MaxExit, err)
+	}
+}
+
+func TestReuseMessagesConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Decoding.ReuseMessages = true
+	config.GeyserServer.Address = ":10000"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "decoding.reuse_messages") {
+		t.Fatalf("got %v", err)
+	}
+}
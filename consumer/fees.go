@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// allPrograms labels the metrics of every transaction, besides those of
+// single programs.
+const allPrograms = "all"
+
+// FeesConfig computes percentiles of the compute unit prices and of the
+// compute units consumed by the written transactions, for fee estimation.
+type FeesConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// Topic receives a JSON record per slot keyed by slot, disabled when
+	// empty.
+	Topic string `json:"topic" yaml:"topic"`
+	// Percentiles are computed, each in (0, 100].
+	Percentiles []float64 `json:"percentiles" yaml:"percentiles"`
+	// DelaySlots closes a slot once a transaction of a slot this many slots
+	// newer was written, the transactions of a closed slot are not counted.
+	DelaySlots uint64 `json:"delay_slots" yaml:"delay_slots"`
+	// WindowSlots are the newest closed slots the metrics are computed over.
+	WindowSlots uint64 `json:"window_slots" yaml:"window_slots"`
+	// Programs get percentiles of their own in the metrics and are the only
+	// programs in the records, every program is in the records when empty.
+	Programs []string `json:"programs" yaml:"programs"`
+}
+
+func DefaultFeesConfig() FeesConfig {
+	return FeesConfig{
+		Percentiles: []float64{50, 75, 90, 99},
+		DelaySlots:  4,
+		WindowSlots: 150,
+	}
+}
+
+func (c *FeesConfig) Validate(topics []string) error {
+	if !c.Enable {
+		if c.Topic != "" {
+			return errors.New("fees.topic: needs fees.enable")
+		}
+		return nil
+	}
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("fees.topic: %s is also consumed", c.Topic)
+	}
+	if len(c.Percentiles) == 0 {
+		return errors.New("fees.percentiles: at least one percentile is required")
+	}
+	for _, p := range c.Percentiles {
+		if !(p > 0 && p <= 100) {
+			return fmt.Errorf("fees.percentiles: %v is not in (0, 100]", p)
+		}
+	}
+	if c.WindowSlots == 0 {
+		return errors.New("fees.window_slots: must be positive")
+	}
+	for _, program := range c.Programs {
+		if key, err := base58.Decode(program); err != nil || len(key) != 32 {
+			return fmt.Errorf("fees.programs: %q is not a base58 public key", program)
+		}
+	}
+	return nil
+}
+
+// feeRecord is the record produced to FeesConfig.Topic. The percentiles are
+// keyed like p50 or p99.9.
+type feeRecord struct {
+	Slot uint64 `json:"slot"`
+	feeStats
+	Programs map[string]feeStats `json:"programs,omitempty"`
+}
+
+type feeStats struct {
+	Transactions int `json:"transactions"`
+	// UnitPrice is in micro-lamports per compute unit, 0 for the
+	// transactions not setting one.
+	UnitPrice    map[string]uint64 `json:"unit_price"`
+	ComputeUnits map[string]uint64 `json:"compute_units"`
+}
+
+// feeSample is what a transaction tells about fees.
+type feeSample struct {
+	unitPrice    uint64
+	computeUnits uint64
+	programs     []string
+}
+
+// FeesSink collects the compute unit price and the compute units consumed of
+// every non-vote transaction written, alone or in a block. A slot is closed
+// DelaySlots after it: its percentiles, over all its transactions and over
+// those invoking each program, are queued as a record and the metrics are
+// computed again over the last WindowSlots closed slots. Records are
+// produced after the next Flush succeeded, a failed produce fails the Flush
+// and they are produced again with the next one.
+type FeesSink struct {
+	sink.Sink
+	producer    sarama.SyncProducer
+	topic       string
+	percentiles []float64
+	delaySlots  uint64
+	windowSlots uint64
+	// programs are those of FeesConfig.Programs, nil for every program.
+	programs map[string]struct{}
+
+	mu sync.Mutex
+	// pending are the samples of the open slots by signature, so that a
+	// transaction written again counts once.
+	pending map[uint64]map[string]feeSample
+	// window are the samples of the closed slots in the metrics.
+	window  map[uint64][]feeSample
+	newest  uint64
+	records []feeRecord
+}
+
+// NewFeesSink produces the records with producer, which is nil without
+// FeesConfig.Topic.
+func NewFeesSink(next sink.Sink, producer sarama.SyncProducer, config FeesConfig) *FeesSink {
+	s := &FeesSink{
+		Sink:        next,
+		producer:    producer,
+		topic:       config.Topic,
+		percentiles: config.Percentiles,
+		delaySlots:  config.DelaySlots,
+		windowSlots: config.WindowSlots,
+		pending:     make(map[uint64]map[string]feeSample),
+		window:      make(map[uint64][]feeSample),
+	}
+	if len(config.Programs) > 0 {
+		s.programs = make(map[string]struct{}, len(config.Programs))
+		for _, program := range config.Programs {
+			s.programs[program] = struct{}{}
+		}
+	}
+	return s
+}
+
+func (s *FeesSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	transactions := decode.MessageTransactions(msg)
+	if msg.Slot == 0 || len(transactions) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Slot+s.delaySlots < s.newest {
+		return nil
+	}
+	samples := s.pending[msg.Slot]
+	if samples == nil {
+		samples = make(map[string]feeSample)
+		s.pending[msg.Slot] = samples
+	}
+	for _, info := range transactions {
+		if info.GetIsVote() {
+			continue
+		}
+		sample := feeSample{computeUnits: info.GetMeta().GetComputeUnitsConsumed()}
+		if budget, ok := decode.DecodeComputeBudget(info); ok && budget.UnitPrice != nil {
+			sample.unitPrice = *budget.UnitPrice
+		}
+		for _, program := range decode.TransactionPrograms(info) {
+			if id := base58.Encode(program); id != decode.ComputeBudgetProgramID {
+				sample.programs = append(sample.programs, id)
+			}
+		}
+		samples[string(info.GetSignature())] = sample
+	}
+	if msg.Slot > s.newest {
+		s.newest = msg.Slot
+		s.close()
+	}
+	return nil
+}
+
+// close closes the slots DelaySlots behind the newest one.
+func (s *FeesSink) close() {
+	if s.newest <= s.delaySlots {
+		return
+	}
+	horizon := s.newest - s.delaySlots
+	closed := false
+	for _, slot := range slices.Sorted(maps.Keys(s.pending)) {
+		if slot >= horizon {
+			break
+		}
+		samples := slices.Collect(maps.Values(s.pending[slot]))
+		delete(s.pending, slot)
+		if s.producer != nil {
+			s.records = append(s.records, s.record(slot, samples))
+		}
+		s.window[slot] = samples
+		closed = true
+	}
+	if !closed {
+		return
+	}
+	if horizon > s.windowSlots {
+		maps.DeleteFunc(s.window, func(slot uint64, _ []feeSample) bool { return slot < horizon-s.windowSlots })
+	}
+	s.observe()
+}
+
+// record returns the record of the samples of slot.
+func (s *FeesSink) record(slot uint64, samples []feeSample) feeRecord {
+	record := feeRecord{Slot: slot, feeStats: s.stats(samples), Programs: make(map[string]feeStats)}
+	for program, samples := range s.byProgram(samples) {
+		record.Programs[program] = s.stats(samples)
+	}
+	return record
+}
+
+// byProgram groups samples by the programs they invoked, of s.programs when
+// not nil.
+func (s *FeesSink) byProgram(samples []feeSample) map[string][]feeSample {
+	out := make(map[string][]feeSample)
+	for _, sample := range samples {
+		for _, program := range sample.programs {
+			if _, ok := s.programs[program]; ok || s.programs == nil {
+				out[program] = append(out[program], sample)
+			}
+		}
+	}
+	return out
+}
+
+func (s *FeesSink) stats(samples []feeSample) feeStats {
+	prices := make([]uint64, len(samples))
+	units := make([]uint64, len(samples))
+	for i, sample := range samples {
+		prices[i], units[i] = sample.unitPrice, sample.computeUnits
+	}
+	stats := feeStats{
+		Transactions: len(samples),
+		UnitPrice:    make(map[string]uint64, len(s.percentiles)),
+		ComputeUnits: make(map[string]uint64, len(s.percentiles)),
+	}
+	slices.Sort(prices)
+	slices.Sort(units)
+	for _, p := range s.percentiles {
+		key := "p" + strconv.FormatFloat(p, 'f', -1, 64)
+		stats.UnitPrice[key], stats.ComputeUnits[key] = percentile(prices, p), percentile(units, p)
+	}
+	return stats
+}
+
+// observe sets the metrics to the percentiles over the window, for every
+// transaction and for each of s.programs.
+func (s *FeesSink) observe() {
+	var samples []feeSample
+	for _, slot := range s.window {
+		samples = append(samples, slot...)
+	}
+	stats := map[string]feeStats{allPrograms: s.stats(samples)}
+	byProgram := s.byProgram(samples)
+	for program := range s.programs {
+		stats[program] = s.stats(byProgram[program])
+	}
+	for program, stats := range stats {
+		for _, p := range s.percentiles {
+			key, quantile := "p"+strconv.FormatFloat(p, 'f', -1, 64), strconv.FormatFloat(p/100, 'f', -1, 64)
+			metrics.FeesUnitPrice.WithLabelValues(program, quantile).Set(float64(stats.UnitPrice[key]))
+			metrics.FeesComputeUnits.WithLabelValues(program, quantile).Set(float64(stats.ComputeUnits[key]))
+		}
+	}
+}
+
+// percentile returns the nearest rank percentile p of the sorted values, 0
+// when there are none.
+func percentile(sorted []uint64, p float64) uint64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+func (s *FeesSink) Flush(ctx context.Context) error {
+	if err := s.Sink.Flush(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	records := s.records
+	s.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+	messages := make([]*sarama.ProducerMessage, len(records))
+	for i, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		messages[i] = &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(strconv.FormatUint(record.Slot, 10)),
+			Value: sarama.ByteEncoder(value),
+		}
+	}
+	if err := s.producer.SendMessages(messages); err != nil {
+		return fmt.Errorf("produce fee records: %w", err)
+	}
+	s.mu.Lock()
+	s.records = slices.Delete(s.records, 0, len(records))
+	s.mu.Unlock()
+	metrics.FeeRecordsProducedTotal.Add(float64(len(records)))
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mr-tron/base58"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// feeTransaction returns the transaction signature of slot calling program
+// with a compute unit price, none when 0, and consuming units.
+func feeTransaction(slot uint64, signature byte, program []byte, price, units uint64) *decode.Message {
+	budget, _ := base58.Decode(decode.ComputeBudgetProgramID)
+	msg := decodetest.TransactionMessage(slot, program, testkey.Key(1), budget)
+	info := msg.Update.GetTransaction().GetTransaction()
+	info.Signature = testkey.Key(signature)
+	info.Meta.ComputeUnitsConsumed = &units
+	if price != 0 {
+		message := info.GetTransaction().GetMessage()
+		message.Instructions = append(message.Instructions, &proto.CompiledInstruction{
+			ProgramIdIndex: 1,
+			Data:           binary.LittleEndian.AppendUint64([]byte{decode.ComputeBudgetSetUnitPrice}, price),
+		})
+	}
+	return msg
+}
+
+func TestFeesSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	producer := &jsonProducer[feeRecord]{}
+	config := DefaultFeesConfig()
+	config.Enable, config.Topic, config.Percentiles, config.DelaySlots = true, "fees", []float64{50, 100}, 2
+	s := NewFeesSink(next, producer, config)
+	ctx := context.Background()
+
+	for _, msg := range []*decode.Message{
+		feeTransaction(10, 1, testkey.Key(2), 100, 1000),
+		feeTransaction(10, 2, testkey.Key(2), 300, 3000),
+		feeTransaction(10, 3, testkey.Key(3), 0, 2000),
+		// written again after a retry
+		feeTransaction(10, 3, testkey.Key(3), 0, 2000),
+		feeTransaction(11, 4, testkey.Key(3), 50, 500),
+		feeTransaction(13, 5, testkey.Key(3), 50, 500),
+		// after slot 10 was closed
+		feeTransaction(10, 6, testkey.Key(3), 1, 1),
+	} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(next.Written) != 7 {
+		t.Fatalf("%d written", len(next.Written))
+	}
+	producer.err = errors.New("unavailable")
+	if err := s.Flush(ctx); err == nil || len(producer.records) != 0 {
+		t.Fatal("failed produce not reported")
+	}
+	producer.err = nil
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.records) != 1 {
+		t.Fatalf("produced %+v", producer.records)
+	}
+	record := producer.records[0]
+	if record.Slot != 10 || record.Transactions != 3 || record.UnitPrice["p50"] != 100 || record.UnitPrice["p100"] != 300 ||
+		record.ComputeUnits["p50"] != 2000 {
+		t.Fatalf("record %+v", record)
+	}
+	program := record.Programs[testkey.String(2)]
+	if len(record.Programs) != 2 || program.Transactions != 2 || program.UnitPrice["p50"] != 100 {
+		t.Fatalf("programs %+v", record.Programs)
+	}
+	if _, ok := record.Programs[decode.ComputeBudgetProgramID]; ok {
+		t.Fatal("compute budget program in the record")
+	}
+	if got := testutil.ToFloat64(metrics.FeesComputeUnits.WithLabelValues(allPrograms, "1")); got != 3000 {
+		t.Fatalf("compute units p100 %v", got)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, want := range map[float64]uint64{1: 1, 50: 5, 90: 9, 95: 10, 100: 10} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%v: got %d, want %d", p, got, want)
+		}
+	}
+	if percentile(nil, 50) != 0 {
+		t.Error("percentile of nothing")
+	}
+}
+
+func TestFeesConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Fees.Topic = "fees"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "fees.enable") {
+		t.Fatalf("got %v", err)
+	}
+	config.Fees.Enable = true
+	config.Fees.Percentiles = []float64{0}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "fees.percentiles") {
+		t.Fatalf("got %v", err)
+	}
+	config.Fees.Percentiles = []float64{99.9}
+	config.Fees.Programs = []string{"nope"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "fees.programs") {
+		t.Fatalf("got %v", err)
+	}
+}
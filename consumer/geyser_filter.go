@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// geyserFilter is a compiled SubscribeRequest. It follows the semantics of
+// the Yellowstone server: every named filter is matched on its own and an
+// update is sent with the names of the filters it matched.
+type geyserFilter struct {
+	accounts           map[string]*geyserAccountFilter
+	slots              map[string]*proto.SubscribeRequestFilterSlots
+	transactions       map[string]*geyserTransactionFilter
+	transactionsStatus map[string]*geyserTransactionFilter
+	blocks             map[string]*geyserBlockFilter
+	blocksMeta         []string
+	entry              []string
+	commitment         proto.CommitmentLevel
+	dataSlices         []*proto.SubscribeRequestAccountsDataSlice
+}
+
+type geyserAccountFilter struct {
+	accounts decode.KeySet
+	owners   decode.KeySet
+	memcmp   []geyserMemcmp
+	dataSize *uint64
+	lamports []func(uint64) bool
+	// tokenAccount requires the data to be an initialized SPL token account.
+	tokenAccount bool
+	// nonemptySignature, when set, requires the update to come with or
+	// without the signature of the transaction writing the account.
+	nonemptySignature *bool
+}
+
+type geyserMemcmp struct {
+	offset uint64
+	data   []byte
+}
+
+type geyserTransactionFilter struct {
+	vote      *bool
+	failed    *bool
+	signature []byte
+	include   decode.KeySet
+	exclude   decode.KeySet
+	required  decode.KeySet
+}
+
+type geyserBlockFilter struct {
+	include             decode.KeySet
+	includeTransactions bool
+	includeAccounts     bool
+	includeEntries      bool
+}
+
+func newGeyserFilter(request *proto.SubscribeRequest) (*geyserFilter, error) {
+	if request.FromSlot != nil {
+		return nil, errors.New("from_slot: not supported, updates are served as they are consumed")
+	}
+	f := &geyserFilter{
+		accounts:           make(map[string]*geyserAccountFilter),
+		slots:              request.GetSlots(),
+		transactions:       make(map[string]*geyserTransactionFilter),
+		transactionsStatus: make(map[string]*geyserTransactionFilter),
+		blocks:             make(map[string]*geyserBlockFilter),
+		blocksMeta:         slices.Sorted(maps.Keys(request.GetBlocksMeta())),
+		entry:              slices.Sorted(maps.Keys(request.GetEntry())),
+		commitment:         request.GetCommitment(),
+		dataSlices:         request.GetAccountsDataSlice(),
+	}
+	for name, config := range request.GetAccounts() {
+		filter, err := newGeyserAccountFilter(config)
+		if err != nil {
+			return nil, fmt.Errorf("accounts.%s: %w", name, err)
+		}
+		f.accounts[name] = filter
+	}
+	for name, config := range request.GetTransactions() {
+		filter, err := newGeyserTransactionFilter(config)
+		if err != nil {
+			return nil, fmt.Errorf("transactions.%s: %w", name, err)
+		}
+		f.transactions[name] = filter
+	}
+	for name, config := range request.GetTransactionsStatus() {
+		filter, err := newGeyserTransactionFilter(config)
+		if err != nil {
+			return nil, fmt.Errorf("transactions_status.%s: %w", name, err)
+		}
+		f.transactionsStatus[name] = filter
+	}
+	for name, config := range request.GetBlocks() {
+		include, err := decode.NewKeySet(config.GetAccountInclude())
+		if err != nil {
+			return nil, fmt.Errorf("blocks.%s.account_include: %w", name, err)
+		}
+		f.blocks[name] = &geyserBlockFilter{
+			include: include,
+			// the defaults of the Yellowstone server
+			includeTransactions: config.IncludeTransactions == nil || config.GetIncludeTransactions(),
+			includeAccounts:     config.GetIncludeAccounts(),
+			includeEntries:      config.GetIncludeEntries(),
+		}
+	}
+	var end uint64
+	for i, slice := range f.dataSlices {
+		if i > 0 && slice.GetOffset() < end {
+			return nil, errors.New("accounts_data_slice: slices must be sorted and must not overlap")
+		}
+		end = slice.GetOffset() + slice.GetLength()
+	}
+	return f, nil
+}
+
+func newGeyserAccountFilter(config *proto.SubscribeRequestFilterAccounts) (*geyserAccountFilter, error) {
+	f := &geyserAccountFilter{nonemptySignature: config.NonemptyTxnSignature}
+	var err error
+	if f.accounts, err = decode.NewKeySet(config.GetAccount()); err != nil {
+		return nil, fmt.Errorf("account: %w", err)
+	}
+	if f.owners, err = decode.NewKeySet(config.GetOwner()); err != nil {
+		return nil, fmt.Errorf("owner: %w", err)
+	}
+	for _, filter := range config.GetFilters() {
+		switch filter := filter.GetFilter().(type) {
+		case *proto.SubscribeRequestFilterAccountsFilter_Memcmp:
+			memcmp := geyserMemcmp{offset: filter.Memcmp.GetOffset()}
+			switch data := filter.Memcmp.GetData().(type) {
+			case *proto.SubscribeRequestFilterAccountsFilterMemcmp_Bytes:
+				memcmp.data = data.Bytes
+			case *proto.SubscribeRequestFilterAccountsFilterMemcmp_Base58:
+				memcmp.data, err = base58.Decode(data.Base58)
+			case *proto.SubscribeRequestFilterAccountsFilterMemcmp_Base64:
+				memcmp.data, err = base64.StdEncoding.DecodeString(data.Base64)
+			default:
+				err = errors.New("no data")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("filters.memcmp: %w", err)
+			}
+			f.memcmp = append(f.memcmp, memcmp)
+		case *proto.SubscribeRequestFilterAccountsFilter_Datasize:
+			if f.dataSize != nil {
+				return nil, errors.New("filters.datasize: set more than once")
+			}
+			f.dataSize = &filter.Datasize
+		case *proto.SubscribeRequestFilterAccountsFilter_TokenAccountState:
+			f.tokenAccount = filter.TokenAccountState
+		case *proto.SubscribeRequestFilterAccountsFilter_Lamports:
+			switch cmp := filter.Lamports.GetCmp().(type) {
+			case *proto.SubscribeRequestFilterAccountsFilterLamports_Eq:
+				f.lamports = append(f.lamports, func(v uint64) bool { return v == cmp.Eq })
+			case *proto.SubscribeRequestFilterAccountsFilterLamports_Ne:
+				f.lamports = append(f.lamports, func(v uint64) bool { return v != cmp.Ne })
+			case *proto.SubscribeRequestFilterAccountsFilterLamports_Lt:
+				f.lamports = append(f.lamports, func(v uint64) bool { return v < cmp.Lt })
+			case *proto.SubscribeRequestFilterAccountsFilterLamports_Gt:
+				f.lamports = append(f.lamports, func(v uint64) bool { return v > cmp.Gt })
+			default:
+				return nil, errors.New("filters.lamports: no comparison")
+			}
+		default:
+			return nil, errors.New("filters: empty filter")
+		}
+	}
+	return f, nil
+}
+
+func newGeyserTransactionFilter(config *proto.SubscribeRequestFilterTransactions) (*geyserTransactionFilter, error) {
+	f := &geyserTransactionFilter{vote: config.Vote, failed: config.Failed}
+	if config.Signature != nil {
+		signature, err := base58.Decode(config.GetSignature())
+		if err != nil || len(signature) != 64 {
+			return nil, fmt.Errorf("signature: invalid signature %q", config.GetSignature())
+		}
+		f.signature = signature
+	}
+	var err error
+	if f.include, err = decode.NewKeySet(config.GetAccountInclude()); err != nil {
+		return nil, fmt.Errorf("account_include: %w", err)
+	}
+	if f.exclude, err = decode.NewKeySet(config.GetAccountExclude()); err != nil {
+		return nil, fmt.Errorf("account_exclude: %w", err)
+	}
+	if f.required, err = decode.NewKeySet(config.GetAccountRequired()); err != nil {
+		return nil, fmt.Errorf("account_required: %w", err)
+	}
+	return f, nil
+}
+
+// match returns the updates sent for msg, each with the names of the filters
+// it matched. A transaction goes out twice when it matched transactions and
+// transactions_status filters, as a transaction and as its status.
+func (f *geyserFilter) match(msg *decode.Message) []*proto.SubscribeUpdate {
+	var updates []*proto.SubscribeUpdate
+	send := func(names []string, update *proto.SubscribeUpdate) {
+		if len(names) == 0 {
+			return
+		}
+		update.Filters = slices.Sorted(slices.Values(names))
+		update.CreatedAt = msg.Update.GetCreatedAt()
+		updates = append(updates, update)
+	}
+
+	switch update := msg.Update.GetUpdateOneof().(type) {
+	case *proto.SubscribeUpdate_Account:
+		var names []string
+		for name, filter := range f.accounts {
+			if filter.match(update.Account.GetAccount()) {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			send(names, &proto.SubscribeUpdate{UpdateOneof: f.sliceAccount(update)})
+		}
+	case *proto.SubscribeUpdate_Slot:
+		var names []string
+		for name, filter := range f.slots {
+			if f.matchSlot(filter, update.Slot) {
+				names = append(names, name)
+			}
+		}
+		send(names, &proto.SubscribeUpdate{UpdateOneof: update})
+	case *proto.SubscribeUpdate_Transaction:
+		info := update.Transaction.GetTransaction()
+		var names, statusNames []string
+		for name, filter := range f.transactions {
+			if filter.match(info) {
+				names = append(names, name)
+			}
+		}
+		for name, filter := range f.transactionsStatus {
+			if filter.match(info) {
+				statusNames = append(statusNames, name)
+			}
+		}
+		send(names, &proto.SubscribeUpdate{UpdateOneof: update})
+		send(statusNames, &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_TransactionStatus{
+			TransactionStatus: &proto.SubscribeUpdateTransactionStatus{
+				Slot:      update.Transaction.GetSlot(),
+				Signature: info.GetSignature(),
+				IsVote:    info.GetIsVote(),
+				Index:     info.GetIndex(),
+				Err:       info.GetMeta().GetErr(),
+			},
+		}})
+	case *proto.SubscribeUpdate_TransactionStatus:
+		var names []string
+		for name, filter := range f.transactionsStatus {
+			if !filter.hasAccounts() && filter.matchStatus(update.TransactionStatus) {
+				names = append(names, name)
+			}
+		}
+		send(names, &proto.SubscribeUpdate{UpdateOneof: update})
+	case *proto.SubscribeUpdate_Block:
+		for _, name := range slices.Sorted(maps.Keys(f.blocks)) {
+			if block := f.blocks[name].apply(update.Block); block != nil {
+				send([]string{name}, &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Block{Block: block}})
+			}
+		}
+	case *proto.SubscribeUpdate_BlockMeta:
+		send(f.blocksMeta, &proto.SubscribeUpdate{UpdateOneof: update})
+	case *proto.SubscribeUpdate_Entry:
+		send(f.entry, &proto.SubscribeUpdate{UpdateOneof: update})
+	}
+	return updates
+}
+
+func (f *geyserAccountFilter) match(account *proto.SubscribeUpdateAccountInfo) bool {
+	if f.accounts != nil && !f.accounts.ContainsAny([][]byte{account.GetPubkey()}) {
+		return false
+	}
+	if f.owners != nil && !f.owners.ContainsAny([][]byte{account.GetOwner()}) {
+		return false
+	}
+	if f.nonemptySignature != nil && *f.nonemptySignature != (len(account.GetTxnSignature()) > 0) {
+		return false
+	}
+	data := account.GetData()
+	if f.dataSize != nil && uint64(len(data)) != *f.dataSize {
+		return false
+	}
+	for _, memcmp := range f.memcmp {
+		if memcmp.offset > uint64(len(data)) || !bytes.HasPrefix(data[memcmp.offset:], memcmp.data) {
+			return false
+		}
+	}
+	for _, cmp := range f.lamports {
+		if !cmp(account.GetLamports()) {
+			return false
+		}
+	}
+	if f.tokenAccount && !isTokenAccount(data) {
+		return false
+	}
+	return true
+}
+
+// isTokenAccount reports whether data holds an initialized SPL Token or
+// Token-2022 account.
+func isTokenAccount(data []byte) bool {
+	if len(data) < decode.TokenAccountSize || data[decode.TokenAccountStateOffset] == 0 {
+		return false
+	}
+	return len(data) == decode.TokenAccountSize || data[decode.TokenAccountSize] == decode.TokenAccountTypeAccount
+}
+
+// sliceAccount applies accounts_data_slice, the update is shared otherwise.
+func (f *geyserFilter) sliceAccount(update *proto.SubscribeUpdate_Account) *proto.SubscribeUpdate_Account {
+	if len(f.dataSlices) == 0 {
+		return update
+	}
+	account := update.Account.GetAccount()
+	data := account.GetData()
+	var sliced []byte
+	for _, slice := range f.dataSlices {
+		start := min(slice.GetOffset(), uint64(len(data)))
+		end := min(start+slice.GetLength(), uint64(len(data)))
+		sliced = append(sliced, data[start:end]...)
+	}
+	return &proto.SubscribeUpdate_Account{Account: &proto.SubscribeUpdateAccount{
+		Account: &proto.SubscribeUpdateAccountInfo{
+			Pubkey:       account.GetPubkey(),
+			Lamports:     account.GetLamports(),
+			Owner:        account.GetOwner(),
+			Executable:   account.GetExecutable(),
+			RentEpoch:    account.GetRentEpoch(),
+			Data:         sliced,
+			WriteVersion: account.GetWriteVersion(),
+			TxnSignature: account.GetTxnSignature(),
+		},
+		Slot:      update.Account.GetSlot(),
+		IsStartup: update.Account.GetIsStartup(),
+	}}
+}
+
+func (f *geyserFilter) matchSlot(filter *proto.SubscribeRequestFilterSlots, slot *proto.SubscribeUpdateSlot) bool {
+	if filter.GetFilterByCommitment() && slot.GetStatus() != f.commitment {
+		return false
+	}
+	switch slot.GetStatus() {
+	case proto.CommitmentLevel_PROCESSED, proto.CommitmentLevel_CONFIRMED, proto.CommitmentLevel_FINALIZED:
+		return true
+	}
+	return filter.GetInterslotUpdates()
+}
+
+func (f *geyserTransactionFilter) match(info *proto.SubscribeUpdateTransactionInfo) bool {
+	if !f.matchStatus(&proto.SubscribeUpdateTransactionStatus{
+		Signature: info.GetSignature(),
+		IsVote:    info.GetIsVote(),
+		Err:       info.GetMeta().GetErr(),
+	}) {
+		return false
+	}
+	if f.include == nil && f.exclude == nil && f.required == nil {
+		return true
+	}
+	accounts := decode.TransactionAccounts(info)
+	if f.include != nil && !f.include.ContainsAny(accounts) {
+		return false
+	}
+	if f.exclude.ContainsAny(accounts) {
+		return false
+	}
+	for required := range f.required {
+		if !slices.ContainsFunc(accounts, func(account []byte) bool { return string(account) == required }) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchStatus checks the fields a transaction status carries. A status
+// update without the transaction does not list its accounts, it only
+// matches filters without account rules.
+func (f *geyserTransactionFilter) matchStatus(status *proto.SubscribeUpdateTransactionStatus) bool {
+	if f.vote != nil && *f.vote != status.GetIsVote() {
+		return false
+	}
+	if f.failed != nil && *f.failed != (status.GetErr() != nil) {
+		return false
+	}
+	if f.signature != nil && !bytes.Equal(f.signature, status.GetSignature()) {
+		return false
+	}
+	return true
+}
+
+// hasAccounts reports whether the filter has account rules, which the
+// status updates without their transaction cannot be matched against.
+func (f *geyserTransactionFilter) hasAccounts() bool {
+	return f.include != nil || f.exclude != nil || f.required != nil
+}
+
+// apply returns the block as sent for the filter, or nil when it does not
+// match.
+func (f *geyserBlockFilter) apply(block *proto.SubscribeUpdateBlock) *proto.SubscribeUpdateBlock {
+	transactions := block.GetTransactions()
+	accounts := block.GetAccounts()
+	if f.include != nil {
+		transactions = slices.DeleteFunc(slices.Clone(transactions), func(info *proto.SubscribeUpdateTransactionInfo) bool {
+			return !f.include.ContainsAny(decode.TransactionAccounts(info))
+		})
+		accounts = slices.DeleteFunc(slices.Clone(accounts), func(account *proto.SubscribeUpdateAccountInfo) bool {
+			return !f.include.ContainsAny([][]byte{account.GetPubkey()})
+		})
+		if len(transactions) == 0 && len(accounts) == 0 {
+			return nil
+		}
+	}
+	out := &proto.SubscribeUpdateBlock{
+		Slot:                     block.GetSlot(),
+		Blockhash:                block.GetBlockhash(),
+		Rewards:                  block.GetRewards(),
+		BlockTime:                block.GetBlockTime(),
+		BlockHeight:              block.GetBlockHeight(),
+		ParentSlot:               block.GetParentSlot(),
+		ParentBlockhash:          block.GetParentBlockhash(),
+		ExecutedTransactionCount: block.GetExecutedTransactionCount(),
+		UpdatedAccountCount:      block.GetUpdatedAccountCount(),
+		EntriesCount:             block.GetEntriesCount(),
+	}
+	if f.includeTransactions {
+		out.Transactions = transactions
+	}
+	if f.includeAccounts {
+		out.Accounts = accounts
+	}
+	if f.includeEntries {
+		out.Entries = block.GetEntries()
+	}
+	return out
+}
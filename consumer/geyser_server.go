@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+type GeyserServerConfig struct {
+	// Address is the listen address of the gRPC server, disabled when empty.
+	Address string `json:"address" yaml:"address"`
+	// XToken is required in the x-token metadata of every call when set.
+	XToken string `json:"x_token" yaml:"x_token"`
+	// QueueSize is the number of updates buffered per subscription, a client
+	// falling further behind is disconnected.
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+}
+
+func (c *GeyserServerConfig) Validate() error {
+	if c.Address == "" {
+		return nil
+	}
+	if c.QueueSize <= 0 {
+		return errors.New("geyser_server.queue_size: must be positive")
+	}
+	return nil
+}
+
+// geyserPingInterval is how often subscriptions get a ping update, as the
+// Yellowstone server sends them to keep load balancers from closing idle
+// streams.
+const geyserPingInterval = 15 * time.Second
+
+// geyserRecentBlockhashes is the number of blockhashes kept for
+// IsBlockhashValid, and geyserBlockhashValidity the block heights a
+// blockhash stays valid for.
+const (
+	geyserRecentBlockhashes = 300
+	geyserBlockhashValidity = 150
+)
+
+// GeyserServer serves the Yellowstone Geyser gRPC service from the written
+// updates, so Yellowstone clients can subscribe to the consumer instead of a
+// validator. Subscriptions are filtered server-side like by Yellowstone.
+type GeyserServer struct {
+	proto.UnimplementedGeyserServer
+	queueSize int
+
+	mu      sync.RWMutex
+	clients map[*geyserClient]struct{}
+
+	// state answers the unary calls from the slot and block updates seen.
+	state geyserState
+}
+
+type geyserClient struct {
+	send chan *proto.SubscribeUpdate
+
+	mu     sync.RWMutex
+	filter *geyserFilter
+	// slow is closed once the client fell behind and is disconnected.
+	slow     chan struct{}
+	slowOnce sync.Once
+}
+
+type geyserState struct {
+	mu          sync.RWMutex
+	slots       map[proto.CommitmentLevel]uint64
+	blockhashes map[string]geyserBlockhash
+	// order lists blockhashes by arrival to drop the oldest.
+	order  []string
+	latest geyserBlockhash
+}
+
+type geyserBlockhash struct {
+	slot        uint64
+	blockhash   string
+	blockHeight uint64
+}
+
+func NewGeyserServer(config GeyserServerConfig) *GeyserServer {
+	return &GeyserServer{
+		queueSize: config.QueueSize,
+		clients:   make(map[*geyserClient]struct{}),
+		state: geyserState{
+			slots:       make(map[proto.CommitmentLevel]uint64),
+			blockhashes: make(map[string]geyserBlockhash),
+		},
+	}
+}
+
+// RunGeyserServer serves s on config.Address in the background.
+func RunGeyserServer(config GeyserServerConfig, s *GeyserServer) error {
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(geyserServerOptions(config)...)
+	proto.RegisterGeyserServer(server, s)
+	logging.Logger.Info("geyser server started", zap.String("address", config.Address))
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logging.Logger.Error("geyser server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// geyserServerOptions checks the x-token of every call when one is
+// configured.
+func geyserServerOptions(config GeyserServerConfig) []grpc.ServerOption {
+	if config.XToken == "" {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := checkXToken(ctx, config.XToken); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkXToken(stream.Context(), config.XToken); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+func checkXToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("x-token") {
+		if subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid x-token")
+}
+
+// Subscribe streams the updates matching the filters of the last request.
+// Like Yellowstone, a request carrying a ping is only answered with a pong
+// and leaves the filters alone, and an invalid request ends the stream.
+func (s *GeyserServer) Subscribe(stream grpc.BidiStreamingServer[proto.SubscribeRequest, proto.SubscribeUpdate]) error {
+	client := &geyserClient{
+		send:   make(chan *proto.SubscribeUpdate, s.queueSize),
+		filter: &geyserFilter{},
+		slow:   make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.clients[client] = struct{}{}
+	metrics.GeyserClients.Set(float64(len(s.clients)))
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		metrics.GeyserClients.Set(float64(len(s.clients)))
+		s.mu.Unlock()
+	}()
+
+	received := make(chan error, 1)
+	go func() {
+		received <- client.readLoop(stream)
+	}()
+	// a client not reading blocks Send, so sending runs on its own and a
+	// slow client is dropped by returning, which cancels the blocked Send
+	done := make(chan struct{})
+	defer close(done)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.writeLoop(stream, done)
+	}()
+
+	select {
+	case <-stream.Context().Done():
+		return nil
+	case err := <-received:
+		return err
+	case err := <-sent:
+		return err
+	case <-client.slow:
+		return status.Error(codes.ResourceExhausted, "client too slow")
+	}
+}
+
+func (c *geyserClient) writeLoop(stream grpc.BidiStreamingServer[proto.SubscribeRequest, proto.SubscribeUpdate], done <-chan struct{}) error {
+	ping := time.NewTicker(geyserPingInterval)
+	defer ping.Stop()
+	for {
+		var update *proto.SubscribeUpdate
+		select {
+		case <-done:
+			return nil
+		case <-ping.C:
+			update = &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Ping{Ping: &proto.SubscribeUpdatePing{}}}
+		case update = <-c.send:
+		}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+	}
+}
+
+// readLoop applies the requests until the client closes its side, which
+// leaves the subscription running, or a request is invalid.
+func (c *geyserClient) readLoop(stream grpc.BidiStreamingServer[proto.SubscribeRequest, proto.SubscribeUpdate]) error {
+	for {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			<-stream.Context().Done()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ping := request.GetPing(); ping != nil {
+			c.enqueue(&proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Pong{Pong: &proto.SubscribeUpdatePong{Id: ping.GetId()}}})
+			continue
+		}
+		filter, err := newGeyserFilter(request)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		c.mu.Lock()
+		c.filter = filter
+		c.mu.Unlock()
+	}
+}
+
+// enqueue queues update without blocking, a full queue disconnects the
+// client.
+func (c *geyserClient) enqueue(update *proto.SubscribeUpdate) {
+	select {
+	case c.send <- update:
+	default:
+		c.slowOnce.Do(func() {
+			metrics.GeyserSlowTotal.Inc()
+			close(c.slow)
+		})
+	}
+}
+
+func (c *geyserClient) match(msg *decode.Message) []*proto.SubscribeUpdate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.filter.match(msg)
+}
+
+// Publish sends msg to the matching subscriptions. The updates share the
+// messages of msg, which are not modified after decoding.
+func (s *GeyserServer) Publish(msg *decode.Message) {
+	s.state.observe(msg)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for client := range s.clients {
+		for _, update := range client.match(msg) {
+			client.enqueue(update)
+		}
+	}
+}
+
+func (st *geyserState) observe(msg *decode.Message) {
+	var block geyserBlockhash
+	switch update := msg.Update.GetUpdateOneof().(type) {
+	case *proto.SubscribeUpdate_Slot:
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		level := update.Slot.GetStatus()
+		st.slots[level] = max(st.slots[level], update.Slot.GetSlot())
+		return
+	case *proto.SubscribeUpdate_BlockMeta:
+		meta := update.BlockMeta
+		block = geyserBlockhash{slot: meta.GetSlot(), blockhash: meta.GetBlockhash(), blockHeight: meta.GetBlockHeight().GetBlockHeight()}
+	case *proto.SubscribeUpdate_Block:
+		b := update.Block
+		block = geyserBlockhash{slot: b.GetSlot(), blockhash: b.GetBlockhash(), blockHeight: b.GetBlockHeight().GetBlockHeight()}
+	default:
+		return
+	}
+	if block.blockhash == "" {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.blockhashes[block.blockhash]; !ok {
+		st.order = append(st.order, block.blockhash)
+	}
+	st.blockhashes[block.blockhash] = block
+	if block.slot > st.latest.slot {
+		st.latest = block
+	}
+	for len(st.order) > geyserRecentBlockhashes {
+		delete(st.blockhashes, st.order[0])
+		st.order = st.order[1:]
+	}
+}
+
+func (s *GeyserServer) Ping(_ context.Context, request *proto.PingRequest) (*proto.PongResponse, error) {
+	return &proto.PongResponse{Count: request.GetCount()}, nil
+}
+
+func (s *GeyserServer) GetVersion(context.Context, *proto.GetVersionRequest) (*proto.GetVersionResponse, error) {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+	data, _ := json.Marshal(map[string]string{"package": "yellowstone-kafka-consumer", "version": version})
+	return &proto.GetVersionResponse{Version: string(data)}, nil
+}
+
+// GetSlot returns the newest slot a slot update reported at the commitment,
+// processed by default.
+func (s *GeyserServer) GetSlot(_ context.Context, request *proto.GetSlotRequest) (*proto.GetSlotResponse, error) {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	slot, ok := s.state.slots[request.GetCommitment()]
+	if !ok {
+		return nil, status.Errorf(codes.Unavailable, "no %s slot consumed yet", request.GetCommitment())
+	}
+	return &proto.GetSlotResponse{Slot: slot}, nil
+}
+
+// GetBlockHeight, GetLatestBlockhash and IsBlockhashValid answer from the
+// block and block meta updates consumed, whatever commitment they were
+// produced at.
+func (s *GeyserServer) GetBlockHeight(context.Context, *proto.GetBlockHeightRequest) (*proto.GetBlockHeightResponse, error) {
+	latest, err := s.state.latestBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.GetBlockHeightResponse{BlockHeight: latest.blockHeight}, nil
+}
+
+func (s *GeyserServer) GetLatestBlockhash(context.Context, *proto.GetLatestBlockhashRequest) (*proto.GetLatestBlockhashResponse, error) {
+	latest, err := s.state.latestBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.GetLatestBlockhashResponse{
+		Slot:                 latest.slot,
+		Blockhash:            latest.blockhash,
+		LastValidBlockHeight: latest.blockHeight + geyserBlockhashValidity,
+	}, nil
+}
+
+func (s *GeyserServer) IsBlockhashValid(_ context.Context, request *proto.IsBlockhashValidRequest) (*proto.IsBlockhashValidResponse, error) {
+	latest, err := s.state.latestBlock()
+	if err != nil {
+		return nil, err
+	}
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	block, ok := s.state.blockhashes[request.GetBlockhash()]
+	return &proto.IsBlockhashValidResponse{
+		Slot:  latest.slot,
+		Valid: ok && latest.blockHeight <= block.blockHeight+geyserBlockhashValidity,
+	}, nil
+}
+
+func (st *geyserState) latestBlock() (geyserBlockhash, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.latest.blockhash == "" {
+		return geyserBlockhash{}, status.Error(codes.Unavailable, "no block consumed yet")
+	}
+	return st.latest, nil
+}
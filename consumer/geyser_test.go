@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-tron/base58"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// filterNames renders the updates sent by f for msg as kind:filters.
+func filterNames(f *geyserFilter, msg *decode.Message) []string {
+	var got []string
+	for _, update := range f.match(msg) {
+		got = append(got, string(decode.UpdateKindOf(update))+":"+strings.Join(update.Filters, ","))
+	}
+	return got
+}
+
+func TestGeyserFilter(t *testing.T) {
+	program, account, owner := testkey.Key(1), testkey.Key(3), testkey.Key(4)
+	signature := bytes.Repeat([]byte{7}, 64)
+
+	tx := decodetest.TransactionMessage(10, program, account)
+	vote := decodetest.TransactionMessage(10, program)
+	vote.Update.GetTransaction().Transaction.IsVote = true
+	failed := decodetest.TransactionMessage(10, program, account)
+	failed.Update.GetTransaction().Transaction.Meta.Err = &proto.TransactionError{Err: []byte{1}}
+	failed.Update.GetTransaction().Transaction.Signature = signature
+	acc := decodetest.AccountMessage(10, account, owner)
+	acc.Update.GetAccount().Account.Data = []byte("0123456789")
+	acc.Update.GetAccount().Account.Lamports = 500
+	confirmed := decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED)
+	dead := decodetest.SlotMessage(11, 9, proto.CommitmentLevel_DEAD)
+	status := &decode.Message{Slot: 10, Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_TransactionStatus{
+		TransactionStatus: &proto.SubscribeUpdateTransactionStatus{Slot: 10, Signature: signature},
+	}}}
+	meta := &decode.Message{Slot: 10, Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{
+		BlockMeta: &proto.SubscribeUpdateBlockMeta{Slot: 10, Blockhash: "hash"},
+	}}}
+	messages := []*decode.Message{tx, vote, failed, acc, confirmed, dead, status, meta}
+
+	yes, no := true, false
+	memcmp := func(offset uint64, data string) *proto.SubscribeRequestFilterAccountsFilter {
+		return &proto.SubscribeRequestFilterAccountsFilter{Filter: &proto.SubscribeRequestFilterAccountsFilter_Memcmp{
+			Memcmp: &proto.SubscribeRequestFilterAccountsFilterMemcmp{Offset: offset,
+				Data: &proto.SubscribeRequestFilterAccountsFilterMemcmp_Base58{Base58: base58.Encode([]byte(data))}},
+		}}
+	}
+	lamports := func(cmp *proto.SubscribeRequestFilterAccountsFilterLamports) *proto.SubscribeRequestFilterAccountsFilter {
+		return &proto.SubscribeRequestFilterAccountsFilter{Filter: &proto.SubscribeRequestFilterAccountsFilter_Lamports{Lamports: cmp}}
+	}
+
+	tests := []struct {
+		name    string
+		request *proto.SubscribeRequest
+		// want lists the updates sent per message of messages
+		want [][]string
+	}{
+		{
+			name:    "empty request matches nothing",
+			request: &proto.SubscribeRequest{},
+			want:    make([][]string, len(messages)),
+		},
+		{
+			name: "transactions",
+			request: &proto.SubscribeRequest{Transactions: map[string]*proto.SubscribeRequestFilterTransactions{
+				"all":      {},
+				"non-vote": {Vote: &no},
+				"failed":   {Failed: &yes},
+				"include":  {AccountInclude: []string{testkey.String(3)}},
+				"exclude":  {AccountExclude: []string{testkey.String(3)}},
+				"required": {AccountRequired: []string{testkey.String(1), testkey.String(3)}},
+				"sig":      {Signature: ptr(base58.Encode(signature))},
+			}},
+			want: [][]string{
+				{"transaction:all,include,non-vote,required"},
+				{"transaction:all,exclude"},
+				{"transaction:all,failed,include,non-vote,required,sig"},
+				nil, nil, nil, nil, nil,
+			},
+		},
+		{
+			name: "transaction status",
+			request: &proto.SubscribeRequest{
+				Transactions: map[string]*proto.SubscribeRequestFilterTransactions{"votes": {Vote: &yes}},
+				TransactionsStatus: map[string]*proto.SubscribeRequestFilterTransactions{
+					"status":  {},
+					"include": {AccountInclude: []string{testkey.String(3)}},
+				},
+			},
+			want: [][]string{
+				{"transaction_status:include,status"},
+				{"transaction:votes", "transaction_status:status"},
+				{"transaction_status:include,status"},
+				nil, nil, nil,
+				// a bare status lists no accounts
+				{"transaction_status:status"},
+				nil,
+			},
+		},
+		{
+			name: "accounts",
+			request: &proto.SubscribeRequest{Accounts: map[string]*proto.SubscribeRequestFilterAccounts{
+				"owner":     {Owner: []string{testkey.String(4)}},
+				"both":      {Account: []string{testkey.String(3)}, Owner: []string{testkey.String(1)}},
+				"memcmp":    {Filters: []*proto.SubscribeRequestFilterAccountsFilter{memcmp(2, "234")}},
+				"no-memcmp": {Filters: []*proto.SubscribeRequestFilterAccountsFilter{memcmp(8, "999")}},
+				"size":      {Filters: []*proto.SubscribeRequestFilterAccountsFilter{{Filter: &proto.SubscribeRequestFilterAccountsFilter_Datasize{Datasize: 10}}}},
+				"lamports": {Filters: []*proto.SubscribeRequestFilterAccountsFilter{
+					lamports(&proto.SubscribeRequestFilterAccountsFilterLamports{Cmp: &proto.SubscribeRequestFilterAccountsFilterLamports_Gt{Gt: 100}}),
+					lamports(&proto.SubscribeRequestFilterAccountsFilterLamports{Cmp: &proto.SubscribeRequestFilterAccountsFilterLamports_Lt{Lt: 1000}}),
+				}},
+				"signed": {NonemptyTxnSignature: &yes},
+				"token":  {Filters: []*proto.SubscribeRequestFilterAccountsFilter{{Filter: &proto.SubscribeRequestFilterAccountsFilter_TokenAccountState{TokenAccountState: true}}}},
+			}},
+			want: [][]string{nil, nil, nil, {"account:lamports,memcmp,owner,size"}, nil, nil, nil, nil},
+		},
+		{
+			name: "slots",
+			request: &proto.SubscribeRequest{
+				Slots: map[string]*proto.SubscribeRequestFilterSlots{
+					"slots":      {},
+					"interslot":  {InterslotUpdates: &yes},
+					"commitment": {FilterByCommitment: &yes},
+				},
+				Commitment: proto.CommitmentLevel_CONFIRMED.Enum(),
+			},
+			want: [][]string{nil, nil, nil, nil, {"slot:commitment,interslot,slots"}, {"slot:interslot"}, nil, nil},
+		},
+		{
+			name:    "blocks meta",
+			request: &proto.SubscribeRequest{BlocksMeta: map[string]*proto.SubscribeRequestFilterBlocksMeta{"meta": {}}},
+			want:    [][]string{nil, nil, nil, nil, nil, nil, nil, {"block_meta:meta"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newGeyserFilter(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, msg := range messages {
+				if got := filterNames(f, msg); !slices.Equal(got, tt.want[i]) {
+					t.Errorf("message %d (%s): got %v, want %v", i, msg.Kind(), got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGeyserFilterErrors(t *testing.T) {
+	for _, request := range []*proto.SubscribeRequest{
+		{FromSlot: ptr[uint64](10)},
+		{Accounts: map[string]*proto.SubscribeRequestFilterAccounts{"a": {Owner: []string{"bogus"}}}},
+		{Accounts: map[string]*proto.SubscribeRequestFilterAccounts{"a": {Filters: []*proto.SubscribeRequestFilterAccountsFilter{{}}}}},
+		{Transactions: map[string]*proto.SubscribeRequestFilterTransactions{"t": {Signature: ptr(testkey.String(1))}}},
+		{TransactionsStatus: map[string]*proto.SubscribeRequestFilterTransactions{"t": {AccountRequired: []string{"x"}}}},
+		{Blocks: map[string]*proto.SubscribeRequestFilterBlocks{"b": {AccountInclude: []string{"x"}}}},
+		{AccountsDataSlice: []*proto.SubscribeRequestAccountsDataSlice{{Offset: 4, Length: 4}, {Offset: 6, Length: 1}}},
+	} {
+		if _, err := newGeyserFilter(request); err == nil {
+			t.Errorf("request %v accepted", request)
+		}
+	}
+}
+
+func TestGeyserFilterDataSlice(t *testing.T) {
+	f, err := newGeyserFilter(&proto.SubscribeRequest{
+		Accounts:          map[string]*proto.SubscribeRequestFilterAccounts{"all": {}},
+		AccountsDataSlice: []*proto.SubscribeRequestAccountsDataSlice{{Offset: 1, Length: 2}, {Offset: 8, Length: 4}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decodetest.AccountMessage(10, testkey.Key(3), testkey.Key(4))
+	msg.Update.GetAccount().Account.Data = []byte("0123456789")
+	updates := f.match(msg)
+	if len(updates) != 1 {
+		t.Fatalf("%d updates", len(updates))
+	}
+	if got := string(updates[0].GetAccount().GetAccount().GetData()); got != "1289" {
+		t.Fatalf("sliced data %q, want 1289", got)
+	}
+	if string(msg.Update.GetAccount().Account.Data) != "0123456789" {
+		t.Fatal("slicing modified the consumed update")
+	}
+}
+
+func TestGeyserFilterBlocks(t *testing.T) {
+	tx := decodetest.TransactionMessage(10, testkey.Key(1), testkey.Key(3)).Update.GetTransaction().Transaction
+	other := decodetest.TransactionMessage(10, testkey.Key(2)).Update.GetTransaction().Transaction
+	block := &decode.Message{Slot: 10, Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Block{Block: &proto.SubscribeUpdateBlock{
+		Slot:         10,
+		Transactions: []*proto.SubscribeUpdateTransactionInfo{tx, other},
+		Accounts:     []*proto.SubscribeUpdateAccountInfo{{Pubkey: testkey.Key(3)}, {Pubkey: testkey.Key(5)}},
+		Entries:      []*proto.SubscribeUpdateEntry{{Slot: 10}},
+	}}}}
+
+	f, err := newGeyserFilter(&proto.SubscribeRequest{Blocks: map[string]*proto.SubscribeRequestFilterBlocks{
+		"full":    {IncludeAccounts: ptr(true), IncludeEntries: ptr(true)},
+		"include": {AccountInclude: []string{testkey.String(3)}, IncludeAccounts: ptr(true)},
+		"none":    {AccountInclude: []string{testkey.String(9)}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := f.match(block)
+	if len(updates) != 2 {
+		t.Fatalf("%d updates, want 2", len(updates))
+	}
+	full, include := updates[0].GetBlock(), updates[1].GetBlock()
+	if updates[0].Filters[0] != "full" || len(full.Transactions) != 2 || len(full.Accounts) != 2 || len(full.Entries) != 1 {
+		t.Fatalf("full block %v", full)
+	}
+	if updates[1].Filters[0] != "include" || len(include.Transactions) != 1 || len(include.Accounts) != 1 || include.Entries != nil {
+		t.Fatalf("included block %v", include)
+	}
+}
+
+func TestIsTokenAccount(t *testing.T) {
+	account := make([]byte, decode.TokenAccountSize)
+	if isTokenAccount(account) {
+		t.Fatal("uninitialized account accepted")
+	}
+	account[decode.TokenAccountStateOffset] = 1
+	if !isTokenAccount(account) {
+		t.Fatal("initialized account rejected")
+	}
+	extended := append(slices.Clone(account), decode.TokenAccountTypeAccount, 0, 0)
+	if !isTokenAccount(extended) {
+		t.Fatal("Token-2022 account rejected")
+	}
+	extended[decode.TokenAccountSize] = 1
+	if isTokenAccount(extended) || isTokenAccount(account[:100]) {
+		t.Fatal("mint accepted as token account")
+	}
+}
+
+// startGeyserServer serves s over an in-memory listener and returns a client.
+func startGeyserServer(t *testing.T, config GeyserServerConfig, s *GeyserServer) proto.GeyserClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(geyserServerOptions(config)...)
+	proto.RegisterGeyserServer(server, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return proto.NewGeyserClient(conn)
+}
+
+func TestGeyserServerSubscribe(t *testing.T) {
+	config := GeyserServerConfig{QueueSize: 16}
+	s := NewGeyserServer(config)
+	client := startGeyserServer(t, config, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&proto.SubscribeRequest{Slots: map[string]*proto.SubscribeRequestFilterSlots{"slots": {}}})
+	// answered after the filters were applied, requests are handled in order
+	stream.Send(&proto.SubscribeRequest{Ping: &proto.SubscribeRequestPing{Id: 7}})
+	if update, err := stream.Recv(); err != nil || update.GetPong().GetId() != 7 {
+		t.Fatalf("got %v, %v, want pong 7", update, err)
+	}
+
+	s.Publish(decodetest.TransactionMessage(10, testkey.Key(1)))
+	s.Publish(decodetest.SlotMessage(10, 9, proto.CommitmentLevel_PROCESSED))
+	update, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.GetSlot().GetSlot() != 10 || !slices.Equal(update.Filters, []string{"slots"}) {
+		t.Fatalf("got %v, want slot 10", update)
+	}
+
+	// an invalid request ends the stream
+	stream.Send(&proto.SubscribeRequest{FromSlot: ptr[uint64](1)})
+	for {
+		_, err = stream.Recv()
+		if err != nil {
+			break
+		}
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.clients) == 0
+	})
+}
+
+func TestGeyserServerSlowClient(t *testing.T) {
+	config := GeyserServerConfig{QueueSize: 1}
+	s := NewGeyserServer(config)
+	client := startGeyserServer(t, config, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&proto.SubscribeRequest{Accounts: map[string]*proto.SubscribeRequestFilterAccounts{"all": {}}})
+	stream.Send(&proto.SubscribeRequest{Ping: &proto.SubscribeRequestPing{Id: 1}})
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	// flow control lets a few updates through before the queue fills
+	data := make([]byte, 1<<20)
+	var slot uint64
+	waitFor(t, func() bool {
+		slot++
+		msg := decodetest.AccountMessage(slot, testkey.Key(3), testkey.Key(4))
+		msg.Update.GetAccount().Account.Data = data
+		s.Publish(msg)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.clients) == 0
+	})
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+}
+
+func TestGeyserServerUnary(t *testing.T) {
+	config := GeyserServerConfig{QueueSize: 16, XToken: "secret"}
+	s := NewGeyserServer(config)
+	client := startGeyserServer(t, config, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.Ping(ctx, &proto.PingRequest{Count: 1}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v without x-token, want Unauthenticated", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-token", "secret")
+	if pong, err := client.Ping(ctx, &proto.PingRequest{Count: 3}); err != nil || pong.GetCount() != 3 {
+		t.Fatalf("got %v, %v", pong, err)
+	}
+	if _, err := client.GetSlot(ctx, &proto.GetSlotRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v before any slot, want Unavailable", err)
+	}
+
+	s.Publish(decodetest.SlotMessage(10, 9, proto.CommitmentLevel_PROCESSED))
+	s.Publish(decodetest.SlotMessage(8, 7, proto.CommitmentLevel_CONFIRMED))
+	for i, hash := range []string{"old", "new"} {
+		s.Publish(&decode.Message{Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{BlockMeta: &proto.SubscribeUpdateBlockMeta{
+			Slot: uint64(9 + i), Blockhash: hash, BlockHeight: &proto.BlockHeight{BlockHeight: uint64(100 + i*200)},
+		}}}})
+	}
+
+	if slot, err := client.GetSlot(ctx, &proto.GetSlotRequest{Commitment: proto.CommitmentLevel_CONFIRMED.Enum()}); err != nil || slot.GetSlot() != 8 {
+		t.Fatalf("got %v, %v, want confirmed slot 8", slot, err)
+	}
+	latest, err := client.GetLatestBlockhash(ctx, &proto.GetLatestBlockhashRequest{})
+	if err != nil || latest.GetBlockhash() != "new" || latest.GetLastValidBlockHeight() != 450 {
+		t.Fatalf("got %v, %v", latest, err)
+	}
+	if height, err := client.GetBlockHeight(ctx, &proto.GetBlockHeightRequest{}); err != nil || height.GetBlockHeight() != 300 {
+		t.Fatalf("got %v, %v", height, err)
+	}
+	for hash, want := range map[string]bool{"new": true, "old": false, "unknown": false} {
+		valid, err := client.IsBlockhashValid(ctx, &proto.IsBlockhashValidRequest{Blockhash: hash})
+		if err != nil || valid.GetValid() != want {
+			t.Errorf("IsBlockhashValid(%s) = %v, %v, want %v", hash, valid, err, want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
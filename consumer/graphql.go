@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// gqlSubprotocol is the WebSocket subprotocol of GraphQL over WebSocket.
+const gqlSubprotocol = "graphql-transport-ws"
+
+// Close codes of the subprotocol.
+const (
+	gqlCloseInvalid      = 4400
+	gqlCloseUnauthorized = 4401
+	gqlCloseDuplicate    = 4409
+)
+
+// gqlRootField is a field of the subscription type, the updates of kind
+// taken from the field key of the update.
+type gqlRootField struct {
+	kind decode.UpdateKind
+	key  string
+	// arguments are those the field takes.
+	arguments []string
+}
+
+var gqlRootFields = map[string]gqlRootField{
+	"transactions": {decode.KindTransaction, "transaction", []string{"programs", "accounts", "excludeFailed", "excludeVotes"}},
+	"accounts":     {decode.KindAccount, "account", []string{"programs", "accounts"}},
+	"slots":        {decode.KindSlot, "slot", nil},
+	"blockMetas":   {decode.KindBlockMeta, "block_meta", nil},
+}
+
+// gqlField is a field of a selection set, named alias in the result.
+type gqlField struct {
+	alias     string
+	name      string
+	arguments map[string]any
+	selection []gqlField
+}
+
+// gqlSubscription is a subscription of a client, the updates of its root
+// field matching its filter, projected onto its selection.
+type gqlSubscription struct {
+	root          gqlRootField
+	field         gqlField
+	filter        *wsSubscription
+	excludeFailed bool
+	excludeVotes  bool
+}
+
+// newGQLSubscription parses the subscription operation of query, with the
+// values of its variables.
+func newGQLSubscription(query string, variables map[string]any) (*gqlSubscription, error) {
+	field, err := parseGQLSubscription(query, variables)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := gqlRootFields[field.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown subscription field %q", field.name)
+	}
+	s := &gqlSubscription{root: root, field: field, filter: &wsSubscription{}}
+	for name, value := range field.arguments {
+		if !slices.Contains(root.arguments, name) {
+			return nil, fmt.Errorf("unknown argument %q of %s", name, field.name)
+		}
+		switch name {
+		case "programs", "accounts":
+			keys, err := gqlStrings(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if name == "programs" {
+				s.filter.Programs = keys
+			} else {
+				s.filter.Accounts = keys
+			}
+		case "excludeFailed", "excludeVotes":
+			b, ok := value.(bool)
+			if !ok && value != nil {
+				return nil, fmt.Errorf("%s: must be a boolean", name)
+			}
+			if name == "excludeFailed" {
+				s.excludeFailed = b
+			} else {
+				s.excludeVotes = b
+			}
+		}
+	}
+	if err := s.filter.compile(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// gqlStrings takes a list of strings, or a single one, from an argument.
+func gqlStrings(value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []any:
+		out := make([]string, len(value))
+		for i, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("must be a list of strings")
+			}
+			out[i] = s
+		}
+		return out, nil
+	}
+	return nil, errors.New("must be a list of strings")
+}
+
+func (s *gqlSubscription) match(msg *decode.Message) bool {
+	if msg.Kind() != s.root.kind || !s.filter.match(msg) {
+		return false
+	}
+	if info := msg.Update.GetTransaction().GetTransaction(); info != nil {
+		if s.excludeVotes && info.GetIsVote() || s.excludeFailed && info.GetMeta().GetErr() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// gqlProject keeps the fields of the selection of a value in the JSON form
+// of an update, lists field by field. A field is looked up by its name, then
+// by its name in snake case, and is null when missing.
+func gqlProject(value any, selection []gqlField) any {
+	if len(selection) == 0 {
+		return value
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(selection))
+		for _, field := range selection {
+			v, ok := value[field.name]
+			if !ok {
+				v = value[decode.SnakeCase(field.name)]
+			}
+			out[field.alias] = gqlProject(v, field.selection)
+		}
+		return out
+	case []any:
+		out := make([]any, len(value))
+		for i, v := range value {
+			out[i] = gqlProject(v, selection)
+		}
+		return out
+	}
+	return value
+}
+
+// gqlMessage is a message of the subprotocol.
+type gqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type gqlSubscribePayload struct {
+	Query     string         `json:"query"`
+	Variables map[string]any `json:"variables"`
+}
+
+type gqlError struct {
+	Message string `json:"message"`
+}
+
+// GraphQLServer serves GraphQL subscriptions over WebSocket and sends the
+// written updates to every subscription matching them.
+type GraphQLServer struct {
+	queueSize int
+	upgrader  websocket.Upgrader
+
+	mu      sync.RWMutex
+	clients map[*gqlClient]struct{}
+}
+
+type gqlClient struct {
+	*wsClient
+
+	mu            sync.RWMutex
+	initialized   bool
+	subscriptions map[string]*gqlSubscription
+}
+
+func NewGraphQLServer(config StreamServerConfig) *GraphQLServer {
+	g := &GraphQLServer{
+		queueSize: config.QueueSize,
+		clients:   make(map[*gqlClient]struct{}),
+	}
+	g.upgrader.Subprotocols = []string{gqlSubprotocol}
+	g.upgrader.CheckOrigin = config.checkOrigin
+	return g
+}
+
+// RunGraphQLServer serves g on config.Address in the background.
+func RunGraphQLServer(config StreamServerConfig, g *GraphQLServer) error {
+	return config.serve("graphql", g)
+}
+
+// ServeHTTP upgrades the request and serves its subscriptions until the
+// connection ends.
+func (g *GraphQLServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	if conn.Subprotocol() != gqlSubprotocol {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "subprotocol "+gqlSubprotocol+" required"), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	client := &gqlClient{
+		wsClient: &wsClient{
+			conn:      conn,
+			send:      make(chan []byte, g.queueSize),
+			slow:      make(chan struct{}),
+			slowTotal: metrics.GraphqlSlowTotal,
+		},
+		subscriptions: make(map[string]*gqlSubscription),
+	}
+	g.mu.Lock()
+	g.clients[client] = struct{}{}
+	g.mu.Unlock()
+	logging.Logger.Debug("graphql client connected", zap.String("remote", r.RemoteAddr))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		defer cancel()
+		client.readLoop()
+	}()
+	client.writeLoop(ctx)
+
+	g.mu.Lock()
+	delete(g.clients, client)
+	g.mu.Unlock()
+	client.mu.Lock()
+	metrics.GraphqlSubscriptions.Sub(float64(len(client.subscriptions)))
+	client.mu.Unlock()
+	conn.Close()
+	logging.Logger.Debug("graphql client disconnected", zap.String("remote", r.RemoteAddr))
+}
+
+// readLoop handles the messages of the client until the connection fails or
+// the client breaks the protocol.
+func (c *gqlClient) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg gqlMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.close(gqlCloseInvalid, "invalid message")
+			return
+		}
+		c.mu.Lock()
+		initialized := c.initialized
+		c.mu.Unlock()
+		switch msg.Type {
+		case "connection_init":
+			c.mu.Lock()
+			c.initialized = true
+			c.mu.Unlock()
+			c.reply(gqlMessage{Type: "connection_ack"})
+		case "ping":
+			c.reply(gqlMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !initialized {
+				c.close(gqlCloseUnauthorized, "Unauthorized")
+				return
+			}
+			if !c.subscribe(msg) {
+				return
+			}
+		case "complete":
+			c.mu.Lock()
+			if _, ok := c.subscriptions[msg.ID]; ok {
+				delete(c.subscriptions, msg.ID)
+				metrics.GraphqlSubscriptions.Dec()
+			}
+			c.mu.Unlock()
+		default:
+			c.close(gqlCloseInvalid, "unknown message type "+strconv.Quote(msg.Type))
+			return
+		}
+	}
+}
+
+// subscribe starts the subscription of msg, an invalid one is answered with
+// an error message. It returns false once the connection was closed.
+func (c *gqlClient) subscribe(msg gqlMessage) bool {
+	if msg.ID == "" {
+		c.close(gqlCloseInvalid, "subscribe without id")
+		return false
+	}
+	var payload gqlSubscribePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.close(gqlCloseInvalid, "invalid subscribe payload")
+		return false
+	}
+	subscription, err := newGQLSubscription(payload.Query, payload.Variables)
+	if err != nil {
+		errs, _ := json.Marshal([]gqlError{{err.Error()}})
+		c.reply(gqlMessage{ID: msg.ID, Type: "error", Payload: errs})
+		return true
+	}
+	c.mu.Lock()
+	_, duplicate := c.subscriptions[msg.ID]
+	if !duplicate {
+		c.subscriptions[msg.ID] = subscription
+		metrics.GraphqlSubscriptions.Inc()
+	}
+	c.mu.Unlock()
+	if duplicate {
+		c.close(gqlCloseDuplicate, "Subscriber for "+msg.ID+" already exists")
+		return false
+	}
+	return true
+}
+
+// reply queues msg, written by the write loop since writes are not
+// concurrency safe.
+func (c *gqlClient) reply(msg gqlMessage) {
+	frame, _ := json.Marshal(msg)
+	c.enqueue(frame)
+}
+
+func (c *gqlClient) close(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+type gqlNext struct {
+	Data map[string]any `json:"data"`
+}
+
+// Publish sends msg to the matching subscriptions. It is formatted once,
+// only when a subscription wants it, and decoded back from JSON so that the
+// decoded instructions are projected like the rest. Numbers are decoded as
+// json.Number, a u64 such as a rent epoch keeping every digit.
+func (g *GraphQLServer) Publish(msg *decode.Message) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var update map[string]any
+	for client := range g.clients {
+		client.mu.RLock()
+		for id, subscription := range client.subscriptions {
+			if !subscription.match(msg) {
+				continue
+			}
+			if update == nil {
+				formatted, err := decode.FormatJSON(msg.Update)
+				if err == nil {
+					decoder := json.NewDecoder(bytes.NewReader(formatted))
+					decoder.UseNumber()
+					err = decoder.Decode(&update)
+				}
+				if err != nil {
+					client.mu.RUnlock()
+					logging.Logger.Warn("failed to encode update for graphql clients", append(decode.MessageFields(msg), zap.Error(err))...)
+					return
+				}
+			}
+			value := gqlProject(update[subscription.root.key], subscription.field.selection)
+			payload, err := json.Marshal(gqlNext{Data: map[string]any{subscription.field.alias: value}})
+			if err != nil {
+				logging.Logger.Warn("failed to encode update for graphql clients", append(decode.MessageFields(msg), zap.Error(err))...)
+				continue
+			}
+			frame, _ := json.Marshal(gqlMessage{ID: id, Type: "next", Payload: payload})
+			client.enqueue(frame)
+		}
+		client.mu.RUnlock()
+	}
+}
+
+// gqlLexer splits a GraphQL document into tokens: punctuators, names,
+// numbers and strings. Commas, white space and comments are ignored.
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+type gqlToken struct {
+	kind  byte // 'p'unctuator, 'n'ame, 'i'nt, 'f'loat, 's'tring, 0 at the end
+	value string
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return l.token()
+		}
+	}
+	return gqlToken{}, nil
+}
+
+func (l *gqlLexer) token() (gqlToken, error) {
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$()[]{}:=@|", c) >= 0:
+		l.pos++
+		return gqlToken{'p', string(c)}, nil
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{'p', "..."}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isAlnum(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{'n', l.src[start:l.pos]}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		kind := byte('i')
+		l.pos++
+		for l.pos < len(l.src) && (isAlnum(l.src[l.pos]) || strings.IndexByte(".+-", l.src[l.pos]) >= 0) {
+			if strings.IndexByte(".eE", l.src[l.pos]) >= 0 {
+				kind = 'f'
+			}
+			l.pos++
+		}
+		return gqlToken{kind, l.src[start:l.pos]}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return gqlToken{}, errors.New("unterminated string")
+		}
+		l.pos++
+		var s string
+		if err := json.Unmarshal([]byte(l.src[start:l.pos]), &s); err != nil {
+			return gqlToken{}, fmt.Errorf("invalid string %s", l.src[start:l.pos])
+		}
+		return gqlToken{'s', s}, nil
+	}
+	return gqlToken{}, fmt.Errorf("unexpected character %q", c)
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// gqlParser parses the subset of GraphQL subscriptions need: a single
+// subscription operation with variables, aliases and arguments, without
+// fragments or directives.
+type gqlParser struct {
+	lexer     gqlLexer
+	token     gqlToken
+	variables map[string]any
+}
+
+// parseGQLSubscription returns the root field of the subscription of query.
+func parseGQLSubscription(query string, variables map[string]any) (gqlField, error) {
+	if variables == nil {
+		variables = make(map[string]any)
+	}
+	p := &gqlParser{lexer: gqlLexer{src: query}, variables: variables}
+	if err := p.advance(); err != nil {
+		return gqlField{}, err
+	}
+	if p.token.kind != 'n' || p.token.value != "subscription" {
+		return gqlField{}, errors.New("only subscription operations are supported")
+	}
+	if err := p.advance(); err != nil {
+		return gqlField{}, err
+	}
+	if p.token.kind == 'n' {
+		if err := p.advance(); err != nil {
+			return gqlField{}, err
+		}
+	}
+	if p.is("(") {
+		if err := p.variableDefinitions(); err != nil {
+			return gqlField{}, err
+		}
+	}
+	selection, err := p.selectionSet()
+	if err != nil {
+		return gqlField{}, err
+	}
+	if p.token.kind != 0 {
+		return gqlField{}, errors.New("a document holds a single operation")
+	}
+	if len(selection) != 1 {
+		return gqlField{}, errors.New("a subscription selects a single root field")
+	}
+	return selection[0], nil
+}
+
+func (p *gqlParser) advance() (err error) {
+	p.token, err = p.lexer.next()
+	return err
+}
+
+func (p *gqlParser) is(punctuator string) bool {
+	return p.token.kind == 'p' && p.token.value == punctuator
+}
+
+func (p *gqlParser) expect(punctuator string) error {
+	if !p.is(punctuator) {
+		return fmt.Errorf("expected %q, got %q", punctuator, p.token.value)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.token.kind != 'n' {
+		return "", fmt.Errorf("expected a name, got %q", p.token.value)
+	}
+	name := p.token.value
+	return name, p.advance()
+}
+
+// variableDefinitions reads the definitions of the variables, giving those
+// not set their default value.
+func (p *gqlParser) variableDefinitions() error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeReference(); err != nil {
+			return err
+		}
+		if p.is("=") {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			value, err := p.value()
+			if err != nil {
+				return err
+			}
+			if _, ok := p.variables[name]; !ok {
+				p.variables[name] = value
+			}
+		}
+	}
+	return p.advance()
+}
+
+// typeReference skips a type like [String!]!, types are not checked.
+func (p *gqlParser) typeReference() error {
+	if p.is("[") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if err := p.typeReference(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.is("!") {
+		return p.advance()
+	}
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for !p.is("}") {
+		if p.is("...") || p.is("@") {
+			return nil, errors.New("fragments and directives are not supported")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("empty selection set")
+	}
+	return fields, p.advance()
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	name, err := p.name()
+	if err != nil {
+		return gqlField{}, err
+	}
+	field := gqlField{alias: name, name: name}
+	if p.is(":") {
+		if err := p.advance(); err != nil {
+			return gqlField{}, err
+		}
+		if field.name, err = p.name(); err != nil {
+			return gqlField{}, err
+		}
+	}
+	if p.is("(") {
+		if field.arguments, err = p.arguments(); err != nil {
+			return gqlField{}, err
+		}
+	}
+	if p.is("{") {
+		if field.selection, err = p.selectionSet(); err != nil {
+			return gqlField{}, err
+		}
+	}
+	return field, nil
+}
+
+func (p *gqlParser) arguments() (map[string]any, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arguments := make(map[string]any)
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if arguments[name], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	return arguments, p.advance()
+}
+
+// value reads a value, variables are replaced by their values and enum
+// values are strings.
+func (p *gqlParser) value() (any, error) {
+	token := p.token
+	switch token.kind {
+	case 'i':
+		n, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %s", token.value)
+		}
+		return float64(n), p.advance()
+	case 'f':
+		f, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %s", token.value)
+		}
+		return f, p.advance()
+	case 's':
+		return token.value, p.advance()
+	case 'n':
+		var value any = token.value
+		switch token.value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		}
+		return value, p.advance()
+	}
+	switch {
+	case p.is("$"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		value, ok := p.variables[name]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not set", name)
+		}
+		return value, nil
+	case p.is("["):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []any{}
+		for !p.is("]") {
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, p.advance()
+	case p.is("{"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		object := make(map[string]any)
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		return object, p.advance()
+	}
+	return nil, fmt.Errorf("unexpected %q", token.value)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+)
+
+func TestParseGQLSubscription(t *testing.T) {
+	field, err := parseGQLSubscription(`
+		# comment
+		subscription Live($programs: [String!]!, $failed: Boolean = true) {
+			txs: transactions(programs: $programs, excludeFailed: $failed, accounts: ["a", "b"]) {
+				slot
+				transaction { signature, meta { fee } }
+			}
+		}`, map[string]any{"programs": []any{"p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gqlField{
+		alias: "txs", name: "transactions",
+		arguments: map[string]any{"programs": []any{"p"}, "excludeFailed": true, "accounts": []any{"a", "b"}},
+		selection: []gqlField{
+			{alias: "slot", name: "slot"},
+			{alias: "transaction", name: "transaction", selection: []gqlField{
+				{alias: "signature", name: "signature"},
+				{alias: "meta", name: "meta", selection: []gqlField{{alias: "fee", name: "fee"}}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(field, want) {
+		t.Fatalf("got %+v\nwant %+v", field, want)
+	}
+
+	for _, query := range []string{
+		`{ slots { slot } }`,
+		`query { slots { slot } }`,
+		`subscription { slots { slot } accounts { slot } }`,
+		`subscription { slots { ...fields } }`,
+		`subscription { slots(x: $missing) }`,
+		`subscription { slots { slot }`,
+		`subscription { slots { } }`,
+		`subscription { slots("unterminated) }`,
+	} {
+		if _, err := parseGQLSubscription(query, nil); err == nil {
+			t.Errorf("parsed %q", query)
+		}
+	}
+	for _, query := range []string{
+		`subscription { blocks { slot } }`,
+		`subscription { slots(programs: ["x"]) { slot } }`,
+		`subscription { transactions(excludeVotes: "yes") { slot } }`,
+		`subscription { transactions(programs: ["not base58 0OIl"]) { slot } }`,
+	} {
+		if _, err := newGQLSubscription(query, nil); err == nil {
+			t.Errorf("subscribed %q", query)
+		}
+	}
+}
+
+func TestGQLProject(t *testing.T) {
+	update := map[string]any{
+		"slot": 5.0,
+		"transaction": map[string]any{
+			"signature": "sig",
+			"swaps":     []any{map[string]any{"input_mint": "m", "pool": "p"}},
+		},
+	}
+	selection := []gqlField{
+		{alias: "slot", name: "slot"},
+		{alias: "transaction", name: "transaction", selection: []gqlField{
+			{alias: "swaps", name: "swaps", selection: []gqlField{{alias: "mint", name: "inputMint"}}},
+			{alias: "missing", name: "missing"},
+		}},
+	}
+	want := map[string]any{
+		"slot": 5.0,
+		"transaction": map[string]any{
+			"swaps":   []any{map[string]any{"mint": "m"}},
+			"missing": nil,
+		},
+	}
+	if got := gqlProject(update, selection); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestGraphQLServer(t *testing.T) {
+	g := NewGraphQLServer(StreamServerConfig{QueueSize: 16})
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	dialer := websocket.Dialer{Subprotocols: []string{gqlSubprotocol}}
+
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(msg string) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() map[string]any {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]any
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	send(`{"type":"connection_init"}`)
+	if msg := read(); msg["type"] != "connection_ack" {
+		t.Fatalf("got %v", msg)
+	}
+	send(`{"id":"1","type":"subscribe","payload":{"query":"subscription { transactions(programs: $p) { slot tx: transaction { signature } } }","variables":{"p":["` + testkey.String(1) + `"]}}}`)
+	send(`{"id":"2","type":"subscribe","payload":{"query":"subscription { nope }"}}`)
+	if msg := read(); msg["id"] != "2" || msg["type"] != "error" {
+		t.Fatalf("got %v", msg)
+	}
+	waitFor(t, func() bool {
+		g.mu.RLock()
+		defer g.mu.RUnlock()
+		for client := range g.clients {
+			client.mu.RLock()
+			defer client.mu.RUnlock()
+			return len(client.subscriptions) == 1
+		}
+		return false
+	})
+
+	sink := NewBroadcastSink(&sinktest.RecordSink{}, g)
+	ctx := context.Background()
+	sink.Write(ctx, decodetest.TransactionMessage(5, testkey.Key(2)))
+	sink.Write(ctx, decodetest.TransactionMessage(6, testkey.Key(1)))
+	msg := read()
+	want := map[string]any{"data": map[string]any{"transactions": map[string]any{
+		"slot": 6.0,
+		"tx":   map[string]any{"signature": testkey.String(0xff)},
+	}}}
+	if msg["id"] != "1" || msg["type"] != "next" || !reflect.DeepEqual(msg["payload"], want) {
+		t.Fatalf("got %v", msg)
+	}
+
+	// a completed subscription gets nothing more
+	send(`{"id":"1","type":"complete"}`)
+	send(`{"type":"ping"}`)
+	if msg := read(); msg["type"] != "pong" {
+		t.Fatalf("got %v", msg)
+	}
+	sink.Write(ctx, decodetest.TransactionMessage(7, testkey.Key(1)))
+	send(`{"type":"ping"}`)
+	if msg := read(); msg["type"] != "pong" {
+		t.Fatalf("got %v after complete", msg)
+	}
+
+	// subscribing before connection_init closes the connection
+	other, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"subscribe","payload":{"query":"subscription { slots }"}}`))
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := other.ReadMessage(); !websocket.IsCloseError(err, gqlCloseUnauthorized) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestGraphQLServerNumbers(t *testing.T) {
+	g := NewGraphQLServer(StreamServerConfig{QueueSize: 16})
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{gqlSubprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"connection_init"}`))
+	read()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"subscribe","payload":{"query":"subscription { accounts { account { lamports rent_epoch } } }"}}`))
+	waitFor(t, func() bool {
+		g.mu.RLock()
+		defer g.mu.RUnlock()
+		for client := range g.clients {
+			client.mu.RLock()
+			defer client.mu.RUnlock()
+			return len(client.subscriptions) == 1
+		}
+		return false
+	})
+
+	// u64 values past 2^53 keep every digit
+	msg := decodetest.AccountMessage(5, testkey.Key(1), testkey.Key(2))
+	msg.Update.GetAccount().Account.Lamports = 1<<53 + 1
+	msg.Update.GetAccount().Account.RentEpoch = math.MaxUint64
+	g.Publish(msg)
+	frame := read()
+	if !strings.Contains(frame, `"lamports":9007199254740993`) || !strings.Contains(frame, `"rent_epoch":18446744073709551615`) {
+		t.Fatalf("got %s", frame)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	gproto "google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// Payloads for Grpc2KafkaConfig.Payload.
+const (
+	payloadUpdate = "update"
+	payloadInner  = "inner"
+)
+
+// Grpc2KafkaConfig configures the grpc2kafka command, which subscribes to a
+// Yellowstone gRPC endpoint and produces the updates to Kafka. Brokers, SASL
+// and TLS come from the kafka section.
+type Grpc2KafkaConfig struct {
+	// Endpoints are tried in turn, moving to the next one whenever the
+	// connection or the stream fails. http:// connects without TLS.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+	XToken    string   `json:"x_token" yaml:"x_token"`
+	// Request is the SubscribeRequest in its protobuf JSON form.
+	Request SubscribeRequestConfig `json:"request" yaml:"request"`
+	// Topic receives every update whose kind is not mapped in Topics.
+	Topic  string            `json:"topic" yaml:"topic"`
+	Topics map[string]string `json:"topics" yaml:"topics"`
+	// Payload is update for the SubscribeUpdate envelope or inner for the
+	// message inside it, transactions being written as the bare
+	// SubscribeUpdateTransactionInfo like the Rust grpc2kafka does.
+	Payload string `json:"payload" yaml:"payload"`
+	// WireFormat is raw, or confluent to register geyser.proto with the
+	// schema registry of the decoding section under <topic>-value and prefix
+	// the payloads with the schema registry header.
+	WireFormat string `json:"wire_format" yaml:"wire_format"`
+	// QueueSize bounds the records produced but not yet acknowledged.
+	QueueSize      int               `json:"queue_size" yaml:"queue_size"`
+	ReconnectDelay duration.Duration `json:"reconnect_delay" yaml:"reconnect_delay"`
+}
+
+func DefaultGrpc2KafkaConfig() Grpc2KafkaConfig {
+	return Grpc2KafkaConfig{
+		Endpoints:      []string{"http://127.0.0.1:10000"},
+		Topic:          "test-topic",
+		Payload:        payloadInner,
+		WireFormat:     decode.WireFormatRaw,
+		QueueSize:      10_000,
+		ReconnectDelay: duration.Duration(2 * time.Second),
+	}
+}
+
+func (c *Grpc2KafkaConfig) Validate(registry decode.SchemaRegistryConfig) error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("grpc2kafka.endpoints: at least one endpoint is required")
+	}
+	for _, endpoint := range c.Endpoints {
+		if _, _, err := parseEndpoint(endpoint); err != nil {
+			return fmt.Errorf("grpc2kafka.endpoints: %w", err)
+		}
+	}
+	if c.Request.SubscribeRequest == nil {
+		return errors.New("grpc2kafka.request: must not be empty")
+	}
+	if c.Topic == "" {
+		return errors.New("grpc2kafka.topic: must not be empty")
+	}
+	for kind, topic := range c.Topics {
+		if _, err := decode.ParseUpdateKind(kind); err != nil {
+			return fmt.Errorf("grpc2kafka.topics: %w", err)
+		}
+		if topic == "" {
+			return fmt.Errorf("grpc2kafka.topics.%s: must not be empty", kind)
+		}
+	}
+	if c.Payload != payloadUpdate && c.Payload != payloadInner {
+		return fmt.Errorf("grpc2kafka.payload: expected update or inner, got %q", c.Payload)
+	}
+	switch c.WireFormat {
+	case decode.WireFormatRaw:
+	case decode.WireFormatConfluent:
+		if registry.URL == "" {
+			return errors.New("grpc2kafka.wire_format: confluent needs decoding.schema_registry.url")
+		}
+	default:
+		return fmt.Errorf("grpc2kafka.wire_format: expected raw or confluent, got %q", c.WireFormat)
+	}
+	if c.QueueSize <= 0 {
+		return errors.New("grpc2kafka.queue_size: must be positive")
+	}
+	if c.ReconnectDelay < 0 {
+		return errors.New("grpc2kafka.reconnect_delay: must not be negative")
+	}
+	return nil
+}
+
+// SubscribeRequestConfig reads a SubscribeRequest from the config file. Both
+// the protobuf field names and their lowerCamelCase JSON names are accepted.
+type SubscribeRequestConfig struct {
+	*proto.SubscribeRequest
+}
+
+func (c *SubscribeRequestConfig) UnmarshalJSON(data []byte) error {
+	request := &proto.SubscribeRequest{}
+	if err := protojson.Unmarshal(data, request); err != nil {
+		return err
+	}
+	c.SubscribeRequest = request
+	return nil
+}
+
+func (c *SubscribeRequestConfig) UnmarshalYAML(node *yaml.Node) error {
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.UnmarshalJSON(data)
+}
+
+// parseEndpoint returns the host:port of a gRPC endpoint and whether it uses
+// TLS, which is the default without a scheme.
+func parseEndpoint(endpoint string) (string, bool, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint, true, nil
+	}
+	switch u.Scheme {
+	case "http":
+		return hostPort(u, "80"), false, nil
+	case "https":
+		return hostPort(u, "443"), true, nil
+	}
+	return "", false, fmt.Errorf("%s: unsupported scheme %q", endpoint, u.Scheme)
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return u.Host + ":" + port
+}
+
+// Grpc2Kafka forwards a Yellowstone gRPC subscription to Kafka.
+type Grpc2Kafka struct {
+	config   Grpc2KafkaConfig
+	producer sarama.AsyncProducer
+	// schemaIDs are the ids geyser.proto was registered with, by topic, nil
+	// for the raw wire format.
+	schemaIDs map[string]int32
+	// inflight holds a token for every record not yet acknowledged.
+	inflight chan struct{}
+	cancel   context.CancelCauseFunc
+}
+
+// NewGrpc2Kafka registers the schema of the payloads with registry first
+// for the confluent wire format.
+func NewGrpc2Kafka(ctx context.Context, config Grpc2KafkaConfig, brokers []string, saramaConfig *sarama.Config, registry *decode.SchemaRegistry) (*Grpc2Kafka, error) {
+	var schemaIDs map[string]int32
+	if config.WireFormat == decode.WireFormatConfluent {
+		schemaIDs = make(map[string]int32)
+		for _, topic := range append(slices.Collect(maps.Values(config.Topics)), config.Topic) {
+			if _, ok := schemaIDs[topic]; ok {
+				continue
+			}
+			id, err := registry.RegisterGeyser(ctx, topic+"-value")
+			if err != nil {
+				return nil, err
+			}
+			schemaIDs[topic] = id
+		}
+	}
+	producer, err := sarama.NewAsyncProducer(brokers, saramaConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Grpc2Kafka{
+		config:    config,
+		producer:  producer,
+		schemaIDs: schemaIDs,
+		inflight:  make(chan struct{}, config.QueueSize),
+	}, nil
+}
+
+// Run forwards updates until ctx is done or a record could not be produced,
+// switching endpoints whenever the stream fails. Records already handed to
+// the producer are flushed before it returns.
+func (g *Grpc2Kafka) Run(ctx context.Context) error {
+	ctx, g.cancel = context.WithCancelCause(ctx)
+	defer g.cancel(nil)
+
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		g.acknowledge()
+	}()
+
+	for i := 0; ctx.Err() == nil; i = (i + 1) % len(g.config.Endpoints) {
+		endpoint := g.config.Endpoints[i]
+		err := g.subscribe(ctx, endpoint)
+		if ctx.Err() != nil {
+			break
+		}
+		logging.Logger.Warn("grpc stream failed, switching endpoint",
+			zap.String("endpoint", endpoint), zap.Error(err))
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(g.config.ReconnectDelay)):
+		}
+	}
+
+	g.producer.AsyncClose()
+	<-acked
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// acknowledge releases the in-flight token of every produced record and
+// stops Run on the first failure.
+func (g *Grpc2Kafka) acknowledge() {
+	successes, failures := g.producer.Successes(), g.producer.Errors()
+	for successes != nil || failures != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			<-g.inflight
+			metrics.ProducerSentTotal.WithLabelValues(string(msg.Metadata.(decode.UpdateKind))).Inc()
+		case err, ok := <-failures:
+			if !ok {
+				failures = nil
+				continue
+			}
+			<-g.inflight
+			metrics.ProducerFailuresTotal.WithLabelValues(string(err.Msg.Metadata.(decode.UpdateKind))).Inc()
+			logging.Logger.Error("failed to produce record",
+				zap.String("topic", err.Msg.Topic), zap.Error(err.Err))
+			g.cancel(fmt.Errorf("produce to %s: %w", err.Msg.Topic, err.Err))
+		}
+	}
+}
+
+func (g *Grpc2Kafka) subscribe(ctx context.Context, endpoint string) error {
+	target, useTLS, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if g.config.XToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-token", g.config.XToken)
+	}
+	stream, err := proto.NewGeyserClient(conn).Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(g.config.Request.SubscribeRequest); err != nil {
+		return err
+	}
+	logging.Logger.Info("subscribed to grpc", zap.String("endpoint", endpoint))
+
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch update.GetUpdateOneof().(type) {
+		case *proto.SubscribeUpdate_Ping:
+			// load balancers drop streams that stay silent
+			if err := stream.Send(&proto.SubscribeRequest{Ping: &proto.SubscribeRequestPing{Id: 1}}); err != nil {
+				return err
+			}
+			continue
+		case *proto.SubscribeUpdate_Pong:
+			continue
+		}
+		if err := g.produce(ctx, target, update); err != nil {
+			return err
+		}
+	}
+}
+
+// produce hands the update to the producer, waiting while QueueSize records
+// are in flight. Records are keyed `<slot>_<sha256 hex of the payload>` and
+// carry the headers of UpdateHeaders, source being the host:port of the
+// endpoint.
+func (g *Grpc2Kafka) produce(ctx context.Context, source string, update *proto.SubscribeUpdate) error {
+	kind := decode.UpdateKindOf(update)
+	message, err := g.payload(update)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", kind, err)
+	}
+	payload, err := gproto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", kind, err)
+	}
+	slot, _ := decode.UpdateSlot(update)
+
+	topic := g.config.Topic
+	if mapped, ok := g.config.Topics[string(kind)]; ok {
+		topic = mapped
+	}
+	// the key hashes the message alone, so it does not depend on the format
+	key := fmt.Sprintf("%d_%x", slot, sha256.Sum256(payload))
+	if id, ok := g.schemaIDs[topic]; ok {
+		payload = append(decode.AppendWireFormat(nil, id, decode.MessageIndexes(message.ProtoReflect().Descriptor())), payload...)
+	}
+
+	select {
+	case g.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	metrics.ProducerReceivedTotal.WithLabelValues(string(kind)).Inc()
+	g.producer.Input() <- &sarama.ProducerMessage{
+		Topic:    topic,
+		Key:      sarama.StringEncoder(key),
+		Value:    sarama.ByteEncoder(payload),
+		Headers:  decode.UpdateHeaders(update, g.commitment(), source),
+		Metadata: kind,
+	}
+	return nil
+}
+
+// commitment returns the commitment level of the subscription, in lower
+// case like processing.commitment.level.
+func (g *Grpc2Kafka) commitment() string {
+	level := proto.CommitmentLevel_PROCESSED
+	if request := g.config.Request.SubscribeRequest; request != nil && request.Commitment != nil {
+		level = *request.Commitment
+	}
+	return strings.ToLower(level.String())
+}
+
+// payload returns the message produced for an update.
+func (g *Grpc2Kafka) payload(update *proto.SubscribeUpdate) (gproto.Message, error) {
+	if g.config.Payload == payloadUpdate {
+		return update, nil
+	}
+	if tx := update.GetTransaction(); tx != nil {
+		return tx.GetTransaction(), nil
+	}
+	m := update.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("update_oneof"))
+	if field == nil {
+		return nil, errors.New("empty update")
+	}
+	return m.Get(field).Message().Interface(), nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"google.golang.org/grpc"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+// serveGeyser serves s on a local port and returns its address and server.
+func serveGeyser(t *testing.T, config GeyserServerConfig, s *GeyserServer) (string, *grpc.Server) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(geyserServerOptions(config)...)
+	proto.RegisterGeyserServer(server, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), server
+}
+
+// publishSubscribed publishes msg once a subscription of s matches it.
+func publishSubscribed(t *testing.T, s *GeyserServer, msg *decode.Message) {
+	t.Helper()
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for client := range s.clients {
+			if len(client.match(msg)) > 0 {
+				return true
+			}
+		}
+		return false
+	})
+	s.Publish(msg)
+}
+
+func newTestGrpc2Kafka(t *testing.T, endpoints ...string) (*Grpc2Kafka, *mocks.AsyncProducer) {
+	t.Helper()
+	config := DefaultGrpc2KafkaConfig()
+	config.Endpoints, config.XToken, config.ReconnectDelay = endpoints, "secret", duration.Duration(10*time.Millisecond)
+	config.Topics = map[string]string{string(decode.KindSlot): "slots"}
+	commitment := proto.CommitmentLevel_CONFIRMED
+	config.Request.SubscribeRequest = &proto.SubscribeRequest{
+		Transactions: map[string]*proto.SubscribeRequestFilterTransactions{"all": {}},
+		Slots:        map[string]*proto.SubscribeRequestFilterSlots{"all": {}},
+		Commitment:   &commitment,
+	}
+	saramaConfig := mocks.NewTestConfig()
+	saramaConfig.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, saramaConfig)
+	return &Grpc2Kafka{config: config, producer: producer, inflight: make(chan struct{}, config.QueueSize)}, producer
+}
+
+func TestGrpc2Kafka(t *testing.T) {
+	config := GeyserServerConfig{XToken: "secret", QueueSize: 16}
+	first, second := NewGeyserServer(config), NewGeyserServer(config)
+	firstAddr, firstServer := serveGeyser(t, config, first)
+	secondAddr, _ := serveGeyser(t, config, second)
+	// nothing listens on the first endpoint
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	g, producer := newTestGrpc2Kafka(t, "http://"+closed.Addr().String(), "http://"+firstAddr, "http://"+secondAddr)
+	produced := make(chan *sarama.ProducerMessage, 2)
+	record := func(msg *sarama.ProducerMessage) error {
+		produced <- msg
+		return nil
+	}
+	producer.ExpectInputWithMessageCheckerFunctionAndSucceed(record).ExpectInputWithMessageCheckerFunctionAndSucceed(record)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run: %v", err)
+		}
+	}()
+
+	// the transaction is keyed by the hash of its info and produced to the
+	// default topic, with the endpoint and commitment in the headers
+	publishSubscribed(t, first, decodetest.TransactionMessage(10, testkey.Key(1)))
+	msg := <-produced
+	value, _ := msg.Value.Encode()
+	key, _ := msg.Key.Encode()
+	info := &proto.SubscribeUpdateTransactionInfo{}
+	if err := gproto.Unmarshal(value, info); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "test-topic" || string(key) != fmt.Sprintf("10_%x", sha256.Sum256(value)) || string(info.Signature) != string(testkey.Key(0xff)) {
+		t.Fatalf("produced %s key %s: %v", msg.Topic, key, info)
+	}
+	headers := make(map[string]string)
+	for _, header := range msg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	if headers[decode.HeaderSource] != firstAddr || headers[decode.HeaderCommitment] != "confirmed" {
+		t.Fatalf("headers %v", headers)
+	}
+
+	// a failed stream moves on to the next endpoint
+	firstServer.Stop()
+	publishSubscribed(t, second, decodetest.SlotMessage(11, 10, proto.CommitmentLevel_CONFIRMED))
+	msg = <-produced
+	value, _ = msg.Value.Encode()
+	slot := &proto.SubscribeUpdateSlot{}
+	if err := gproto.Unmarshal(value, slot); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "slots" || slot.Slot != 11 || string(msg.Headers[1].Value) != secondAddr {
+		t.Fatalf("produced %s %v from %s", msg.Topic, slot, msg.Headers[1].Value)
+	}
+}
+
+func TestGrpc2KafkaProduceFails(t *testing.T) {
+	config := GeyserServerConfig{XToken: "secret", QueueSize: 16}
+	s := NewGeyserServer(config)
+	addr, _ := serveGeyser(t, config, s)
+	g, producer := newTestGrpc2Kafka(t, "http://"+addr)
+	producer.ExpectInputAndFail(sarama.ErrMessageSizeTooLarge)
+
+	done := make(chan error, 1)
+	go func() { done <- g.Run(context.Background()) }()
+	publishSubscribed(t, s, decodetest.TransactionMessage(10, testkey.Key(1)))
+	select {
+	case err := <-done:
+		if !errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a failed record did not stop grpc2kafka")
+	}
+}
+
+func TestGrpc2KafkaXToken(t *testing.T) {
+	config := GeyserServerConfig{XToken: "other", QueueSize: 16}
+	addr, _ := serveGeyser(t, config, NewGeyserServer(config))
+	g, _ := newTestGrpc2Kafka(t, "http://"+addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.subscribe(ctx, "http://"+addr); err == nil || ctx.Err() != nil {
+		t.Fatalf("subscribed with an invalid x-token: %v", err)
+	}
+}
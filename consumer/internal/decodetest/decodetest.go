@@ -0,0 +1,281 @@
+// Package decodetest builds the messages and transactions the tests of the
+// packages handling decoded messages write, as the tests of package decode
+// build them.
+package decodetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// TransactionMessage returns a transaction of slot calling program with the
+// given accounts, the program is the last account key.
+func TransactionMessage(slot uint64, program []byte, accounts ...[]byte) *decode.Message {
+	keys := append(append([][]byte{}, accounts...), program)
+	return &decode.Message{
+		Slot: slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{
+			Transaction: &proto.SubscribeUpdateTransaction{
+				Slot: slot,
+				Transaction: &proto.SubscribeUpdateTransactionInfo{
+					Signature: testkey.Key(0xff),
+					Transaction: &proto.Transaction{Message: &proto.Message{
+						AccountKeys:  keys,
+						Instructions: []*proto.CompiledInstruction{{ProgramIdIndex: uint32(len(keys) - 1)}},
+					}},
+					Meta: &proto.TransactionStatusMeta{},
+				},
+			},
+		}},
+	}
+}
+
+func AccountMessage(slot uint64, pubkey, owner []byte) *decode.Message {
+	return &decode.Message{
+		Slot: slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Account{
+			Account: &proto.SubscribeUpdateAccount{
+				Slot:    slot,
+				Account: &proto.SubscribeUpdateAccountInfo{Pubkey: pubkey, Owner: owner},
+			},
+		}},
+	}
+}
+
+// SlotMessage returns a slot status update, parent is left unset when 0.
+func SlotMessage(slot, parent uint64, status proto.CommitmentLevel) *decode.Message {
+	update := &proto.SubscribeUpdateSlot{Slot: slot, Status: status}
+	if parent != 0 {
+		update.Parent = &parent
+	}
+	return &decode.Message{
+		Slot:   slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Slot{Slot: update}},
+	}
+}
+
+// ProgramTransaction calls programs with the accounts testkey.Key(1) to testkey.Key(3), the
+// programs follow them as accounts 3 and up.
+func ProgramTransaction(programs []string, outer []*proto.CompiledInstruction, inner []*proto.InnerInstructions) *proto.SubscribeUpdateTransactionInfo {
+	keys := [][]byte{testkey.Key(1), testkey.Key(2), testkey.Key(3)}
+	for _, program := range programs {
+		key, _ := base58.Decode(program)
+		keys = append(keys, key)
+	}
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature:   testkey.Key(0xff),
+		Transaction: &proto.Transaction{Message: &proto.Message{AccountKeys: keys, Instructions: outer}},
+		Meta:        &proto.TransactionStatusMeta{InnerInstructions: inner},
+	}
+}
+
+// SystemData is the data of the System program instruction with fields.
+func SystemData(instruction uint32, fields ...[]byte) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, instruction)
+	for _, field := range fields {
+		data = append(data, field...)
+	}
+	return data
+}
+
+func LE64(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+// BalanceTransaction moves 5000 lamports from testkey.Key(1) to testkey.Key(2) and 30 tokens
+// of mint testkey.Key(20) from account testkey.Key(3), which it closes, to the new account
+// testkey.Key(4).
+func BalanceTransaction(slot uint64) *decode.Message {
+	msg := TransactionMessage(slot, testkey.Key(9), testkey.Key(1), testkey.Key(2), testkey.Key(3), testkey.Key(4))
+	tokenBalance := func(index uint32, owner byte, amount string) *proto.TokenBalance {
+		return &proto.TokenBalance{
+			AccountIndex:  index,
+			Mint:          testkey.String(20),
+			Owner:         testkey.String(owner),
+			UiTokenAmount: &proto.UiTokenAmount{Amount: amount, Decimals: 6},
+		}
+	}
+	msg.Update.GetTransaction().GetTransaction().Meta = &proto.TransactionStatusMeta{
+		PreBalances:       []uint64{1_000_000, 0, 2_039_280, 0, 1},
+		PostBalances:      []uint64{995_000, 5_000, 2_039_280, 0, 1},
+		PreTokenBalances:  []*proto.TokenBalance{tokenBalance(2, 10, "30")},
+		PostTokenBalances: []*proto.TokenBalance{tokenBalance(3, 11, "30")},
+	}
+	return msg
+}
+
+// PrunableTransaction is a failed transaction of program with logs, balances
+// and an inner instruction.
+func PrunableTransaction(program []byte) *proto.SubscribeUpdateTransactionInfo {
+	info := TransactionMessage(10, program, testkey.Key(2)).Update.GetTransaction().GetTransaction()
+	info.Meta = &proto.TransactionStatusMeta{
+		Err:                     &proto.TransactionError{Err: []byte{1}},
+		Fee:                     5000,
+		PreBalances:             []uint64{10, 20},
+		PostBalances:            []uint64{5, 20},
+		LogMessages:             []string{"Program log: hello"},
+		InnerInstructions:       []*proto.InnerInstructions{{Index: 0, Instructions: []*proto.InnerInstruction{{ProgramIdIndex: 0}}}},
+		LoadedWritableAddresses: [][]byte{testkey.Key(3)},
+	}
+	return info
+}
+
+// borshString appends s to data as a borsh string.
+func borshString(data []byte, s string) []byte {
+	return append(binary.LittleEndian.AppendUint32(data, uint32(len(s))), s...)
+}
+
+// metadataArgs appends the name, symbol, URI and seller fee of the metadata
+// arguments to data.
+func metadataArgs(data []byte, name string) []byte {
+	data = borshString(data, name)
+	data = borshString(data, "TKN\x00\x00")
+	data = borshString(data, "https://example.com/"+name)
+	return binary.LittleEndian.AppendUint16(data, 500)
+}
+
+// MintTransaction has the mint at 0, its authority at 1, the metadata at 3,
+// the collection mint at 4, the leaf owner and the tree at 5 and 6, the
+// collection of the compressed NFT at 7 and a mint created through a CPI at
+// 8, then the token, Token Metadata and Bubblegum programs at 9, 10 and 11.
+func MintTransaction() *proto.SubscribeUpdateTransactionInfo {
+	var keys [][]byte
+	for i := range byte(9) {
+		keys = append(keys, testkey.Key(i+1))
+	}
+	for _, program := range []string{decode.TokenProgramID, decode.TokenMetadataProgramID, decode.BubblegumProgramID} {
+		key, _ := base58.Decode(program)
+		keys = append(keys, key)
+	}
+
+	// InitializeMint2, then InitializeMint
+	initialize := append([]byte{20, 6}, testkey.Key(2)...)
+	initialize = append(append(initialize, 1), testkey.Key(3)...)
+
+	// CreateMetadataAccountV3 with one creator, then the collection
+	metadata := metadataArgs([]byte{33}, "Token")
+	metadata = binary.LittleEndian.AppendUint32(append(metadata, 1), 1)
+	metadata = append(metadata, make([]byte, 34)...)
+	metadata = append(append(metadata, 1, 0), testkey.Key(5)...)
+	metadata = append(metadata, 0, 1, 0)
+
+	// no edition nonce, a token standard and no collection
+	discriminator := sha256.Sum256([]byte("global:mint_to_collection_v1"))
+	compressed := metadataArgs(discriminator[:8], "Ticket")
+	compressed = append(compressed, 0, 1, 0, 1, 0, 0)
+
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature: testkey.Key(0xff),
+		Transaction: &proto.Transaction{Message: &proto.Message{
+			AccountKeys: keys,
+			Instructions: []*proto.CompiledInstruction{
+				{ProgramIdIndex: 9, Accounts: []byte{0}, Data: initialize},
+				{ProgramIdIndex: 10, Accounts: []byte{3, 0, 1, 1, 1}, Data: metadata},
+				{ProgramIdIndex: 11, Accounts: []byte{1, 5, 1, 6, 1, 1, 1, 1, 7}, Data: compressed},
+				// truncated
+				{ProgramIdIndex: 10, Accounts: []byte{3, 0, 1, 1, 1}, Data: metadata[:20]},
+			},
+		}},
+		Meta: &proto.TransactionStatusMeta{
+			InnerInstructions: []*proto.InnerInstructions{{Index: 2, Instructions: []*proto.InnerInstruction{
+				{ProgramIdIndex: 9, Accounts: []byte{8, 1}, Data: append([]byte{0, 0}, append(testkey.Key(2), 0)...)},
+			}}},
+		},
+	}
+}
+
+// anchorEventTag prefixes the data of the self CPIs emitting Anchor events.
+var anchorEventTag = []byte{0xe4, 0x45, 0xa5, 0x2e, 0x51, 0xcb, 0x9a, 0x1d}
+
+func orderPlacedData(price uint64) []byte {
+	return binary.LittleEndian.AppendUint64([]byte{8, 7, 6, 5, 4, 3, 2, 1}, price)
+}
+
+// LoggedTransaction calls the market program testkey.Key(40) of the IDLs of LoadIDLs
+// after the compute budget program, then testkey.Key(41), which fails.
+func LoggedTransaction() *proto.SubscribeUpdateTransactionInfo {
+	market, other := testkey.String(40), testkey.String(41)
+	settled := sha256.Sum256([]byte("event:Settled"))
+	stackHeight := uint32(2)
+	// a token Transfer of 1
+	transfer := binary.LittleEndian.AppendUint64([]byte{3}, 1)
+	info := ProgramTransaction([]string{market, testkey.String(41), decode.TokenProgramID}, nil,
+		[]*proto.InnerInstructions{{Index: 1, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 5, Accounts: []byte{0, 1, 2}, Data: transfer},
+			{ProgramIdIndex: 3, Data: append(append([]byte{}, anchorEventTag...), orderPlacedData(7)...), StackHeight: &stackHeight},
+		}}, {Index: 2, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 4, Data: append(append(append([]byte{}, anchorEventTag...), settled[:8]...), 5, 0, 0, 0)},
+		}}},
+	)
+	info.Meta.LogMessages = []string{
+		"Program " + decode.ComputeBudgetProgramID + " invoke [1]",
+		"Program " + decode.ComputeBudgetProgramID + " success",
+		"Program " + market + " invoke [1]",
+		"Program log: Instruction: PlaceOrder",
+		"Program data: " + base64.StdEncoding.EncodeToString(orderPlacedData(1500)),
+		"Program " + decode.TokenProgramID + " invoke [2]",
+		"Program log: Instruction: Transfer",
+		"Program " + decode.TokenProgramID + " consumed 4645 of 180000 compute units",
+		"Program " + decode.TokenProgramID + " success",
+		"Program " + market + " invoke [2]",
+		"Program " + market + " consumed 2000 of 170000 compute units",
+		"Program " + market + " success",
+		"Program return: " + market + " AQID",
+		"Program " + market + " consumed 30000 of 199850 compute units",
+		"Program " + market + " success",
+		"Program " + other + " invoke [1]",
+		"Program log: panicked",
+		"Program " + other + " failed: custom program error: 0x1",
+	}
+	return info
+}
+
+// marketIDL is an Anchor 0.30 IDL of the program testkey.Key(40) emitting
+// OrderPlaced events.
+var marketIDL = `{
+  "address": "` + testkey.String(40) + `",
+  "metadata": {"name": "market", "version": "0.1.0", "spec": "0.1.0"},
+  "instructions": [],
+  "events": [{"name": "OrderPlaced", "discriminator": [8, 7, 6, 5, 4, 3, 2, 1]}],
+  "types": [
+    {"name": "OrderPlaced", "type": {"kind": "struct", "fields": [{"name": "price", "type": "u64"}]}}
+  ]
+}`
+
+// legacyIDL is an IDL of the program testkey.Key(41) from before Anchor 0.30,
+// emitting Settled events.
+const legacyIDL = `{
+  "version": "0.1.0",
+  "name": "legacy",
+  "instructions": [],
+  "events": [{"name": "Settled", "fields": [{"name": "amount", "type": "u32", "index": false}]}]
+}`
+
+// LoadIDLs loads the IDLs of the programs of LoggedTransaction.
+func LoadIDLs(t testing.TB) *decode.IDLDecoder {
+	t.Helper()
+	dir := t.TempDir()
+	for name, idl := range map[string]string{"market.json": marketIDL, testkey.String(41) + ".json": legacyIDL} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(idl), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := decode.DefaultIDLConfig()
+	config.Dir = dir
+	d, err := decode.LoadIDLs(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
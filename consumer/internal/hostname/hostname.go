@@ -0,0 +1,20 @@
+// Package hostname expands the {hostname} placeholder of config values.
+package hostname
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Expand replaces {hostname} in the value of field by the host name.
+func Expand(field, value string) (string, error) {
+	if !strings.Contains(value, "{hostname}") {
+		return value, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", field, err)
+	}
+	return strings.ReplaceAll(value, "{hostname}", hostname), nil
+}
@@ -0,0 +1,60 @@
+// Package sinktest provides the sinks the tests of the packages writing
+// decoded messages write into.
+package sinktest
+
+import (
+	"context"
+	"sync"
+
+	"consumer/pkg/decode"
+)
+
+// RecordSink keeps the written messages in memory, failing the writes of the
+// slots in Fail.
+type RecordSink struct {
+	mu      sync.Mutex
+	Written []*decode.Message
+	Fail    map[uint64]error
+	Flushes int
+}
+
+func (s *RecordSink) Write(_ context.Context, msg *decode.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Fail[msg.Slot]; err != nil {
+		return err
+	}
+	s.Written = append(s.Written, msg)
+	return nil
+}
+
+func (s *RecordSink) Flush(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Flushes++
+	return nil
+}
+
+func (s *RecordSink) Close() error { return nil }
+
+// Slots returns the slots of the written messages in write order.
+func (s *RecordSink) Slots() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slots := make([]uint64, len(s.Written))
+	for i, msg := range s.Written {
+		slots[i] = msg.Slot
+	}
+	return slots
+}
+
+// HoldingSink holds every message written to it, as a batching sink does.
+type HoldingSink struct {
+	RecordSink
+	Held []func()
+}
+
+func (s *HoldingSink) Write(ctx context.Context, msg *decode.Message) error {
+	s.Held = append(s.Held, msg.Hold())
+	return s.RecordSink.Write(ctx, msg)
+}
@@ -0,0 +1,19 @@
+// Package testkey builds the public keys of the tests, for package decode as
+// for the packages handling decoded messages.
+package testkey
+
+import (
+	"bytes"
+
+	"github.com/mr-tron/base58"
+)
+
+// Key returns a distinct 32 byte public key.
+func Key(n byte) []byte {
+	return bytes.Repeat([]byte{n}, 32)
+}
+
+// String returns Key(n) in base58.
+func String(n byte) string {
+	return base58.Encode(Key(n))
+}
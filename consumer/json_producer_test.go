@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/IBM/sarama"
+)
+
+// jsonProducer keeps the keys, headers and JSON values of the records it
+// sends, the values decoded as T, failing the sends while err is set.
+type jsonProducer[T any] struct {
+	sarama.SyncProducer
+	err     error
+	keys    []string
+	headers [][]sarama.RecordHeader
+	records []T
+}
+
+func (p *jsonProducer[T]) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+	for _, msg := range msgs {
+		value, _ := msg.Value.Encode()
+		var record T
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if msg.Key != nil {
+			key, _ := msg.Key.Encode()
+			p.keys = append(p.keys, string(key))
+		}
+		p.headers = append(p.headers, msg.Headers)
+		p.records = append(p.records, record)
+	}
+	return nil
+}
@@ -2,82 +2,691 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/IBM/sarama"
-	gproto "google.golang.org/protobuf/proto"
+	"go.uber.org/zap"
 
-	"consumer/proto"
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+	"consumer/pkg/tracing"
 )
 
-func main() {
-	config := sarama.NewConfig()
-	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+// loadConfig registers the shared flags on fs, parses args and returns the
+// validated config, installing the configured logger.
+func loadConfig(fs *flag.FlagSet, args []string) *Config {
+	config, _ := loadConfigSource(fs, args)
+	return config
+}
 
-	consumerGroup, err := sarama.NewConsumerGroup(
-		[]string{"localhost:9092"},
-		"my-consumer-group",
-		config,
-	)
+// loadConfigSource is loadConfig for the commands reloading the config, see
+// Reloader.
+func loadConfigSource(fs *flag.FlagSet, args []string) (*Config, *configSource) {
+	source := registerConfigFlags(fs)
+	fs.Parse(args)
+	config, err := source.Load()
 	if err != nil {
-		log.Fatalf("Error creating consumer group: %v", err)
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	l, err := logging.NewLogger(config.Log)
+	if err != nil {
+		logging.Logger.Fatal("failed to create logger", zap.Error(err))
+	}
+	logging.Logger = l
+	return config, source
+}
+
+// parseConfig registers the shared flags on fs, parses args and returns the
+// validated config.
+func parseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	source := registerConfigFlags(fs)
+	fs.Parse(args)
+	return source.Load()
+}
+
+// configSource is the config file and the overrides given on the command
+// line, loaded again on every reload.
+type configSource struct {
+	path      *string
+	overrides *Overrides
+}
+
+func registerConfigFlags(fs *flag.FlagSet) *configSource {
+	return &configSource{
+		path:      fs.String("config", os.Getenv("CONSUMER_CONFIG"), "path to YAML or JSON config file (env CONSUMER_CONFIG)"),
+		overrides: RegisterOverrides(fs),
+	}
+}
+
+// Load returns the validated config of the file with the overrides applied.
+func (s *configSource) Load() (*Config, error) {
+	config, err := LoadConfig(*s.path)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if err := s.overrides.Apply(config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func runGrpc2Kafka(fs *flag.FlagSet, args []string) {
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	if err := config.Grpc2Kafka.Validate(config.Decoding.SchemaRegistry); err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	producer, err := NewGrpc2Kafka(ctx, config.Grpc2Kafka, config.Kafka.Brokers, saramaConfig,
+		decode.NewSchemaRegistry(config.Decoding.SchemaRegistry))
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka producer", zap.Error(err))
+	}
+	if config.Prometheus != "" {
+		if err := RunMetricsServer(config.Prometheus, nil); err != nil {
+			logging.Logger.Fatal("failed to start prometheus server", zap.Error(err))
+		}
 	}
-	defer consumerGroup.Close()
 
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	logging.Logger.Info("grpc2kafka is running",
+		zap.Strings("endpoints", config.Grpc2Kafka.Endpoints),
+		zap.String("topic", config.Grpc2Kafka.Topic))
+	if err := producer.Run(ctx); err != nil {
+		logging.Logger.Fatal("grpc2kafka failed", zap.Error(err))
+	}
+	logging.Logger.Info("grpc2kafka stopped")
+}
 
-	handler := &ConsumerHandler{}
+func runDedup(fs *flag.FlagSet, args []string) {
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	if err := config.Dedup.Validate(); err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	producerConfig, err := config.Dedup.ProducerConfig(saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	producer, err := sarama.NewSyncProducer(config.Kafka.Brokers, producerConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka producer", zap.Error(err))
+	}
+	defer producer.Close()
+	consumerGroup, err := sarama.NewConsumerGroup(config.Kafka.Brokers, config.Dedup.GroupID, saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create consumer group", zap.Error(err))
+	}
+	defer consumerGroup.Close()
+	if config.Prometheus != "" {
+		if err := RunMetricsServer(config.Prometheus, nil); err != nil {
+			logging.Logger.Fatal("failed to start prometheus server", zap.Error(err))
+		}
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancelCause(signals)
+	defer cancel(nil)
+	handler := consumer.NewDedupHandler(config.Dedup, producer, time.Duration(config.Kafka.Commit.Interval), cancel)
 
 	go func() {
-		for {
-			if err := consumerGroup.Consume(
-				context.Background(),
-				[]string{"test-topic"},
-				handler,
-			); err != nil {
-				log.Printf("Error from consumer: %v", err)
+		for err := range consumerGroup.Errors() {
+			logging.Logger.Error("consumer group error", zap.Error(err))
+		}
+	}()
+
+	logging.Logger.Info("dedup is running",
+		zap.Strings("inputs", config.Dedup.Inputs),
+		zap.String("output", config.Dedup.Output),
+		zap.String("group_id", config.Dedup.GroupID),
+		zap.Bool("transactional", producer.IsTransactional()))
+	for ctx.Err() == nil {
+		err := consumerGroup.Consume(ctx, config.Dedup.Inputs, handler)
+		if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			break
+		}
+		if err != nil {
+			logging.Logger.Error("consumer error", zap.Error(err))
+		}
+	}
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		logging.Logger.Fatal("dedup failed", zap.Error(err))
+	}
+	logging.Logger.Info("dedup stopped")
+}
+
+func runReplayDLQ(fs *flag.FlagSet, args []string) {
+	options := RegisterDLQReplayFlags(fs)
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	// set when dead letters failed to replay, to exit with a failure status
+	// once the sink was flushed
+	var failed bool
+	defer func() {
+		if failed {
+			logging.Logger.Sync()
+			os.Exit(1)
+		}
+	}()
+	filter, err := options.Filter(time.Now())
+	if err != nil {
+		logging.Logger.Fatal("invalid flags", zap.Error(err))
+	}
+	if config.DLQ.Topic == "" {
+		logging.Logger.Fatal("invalid config", zap.Error(errors.New("dlq.topic: must not be empty")))
+	}
+
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	// the records go back to the partition they were consumed from
+	saramaConfig.Producer.Partitioner = sarama.NewManualPartitioner
+	client, err := sarama.NewClient(config.Kafka.Brokers, saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka client", zap.Error(err))
+	}
+	defer client.Close()
+
+	var replay replayer
+	switch {
+	case options.DryRun:
+	case options.To == replayToSink:
+		decode.DefaultIDLDecoder, err = decode.LoadIDLs(context.Background(), config.Decoding.IDL)
+		if err != nil {
+			logging.Logger.Fatal("failed to load idls", zap.Error(err))
+		}
+		decoder, err := decode.NewDecoder(config.Decoding)
+		if err != nil {
+			logging.Logger.Fatal("invalid config", zap.Error(err))
+		}
+		s, err := sink.NewRouted(context.Background(), config.Sink, config.Routes)
+		if err != nil {
+			logging.Logger.Fatal("failed to create sink", zap.Error(err))
+		}
+		defer func() {
+			if err := s.Flush(context.Background()); err != nil {
+				logging.Logger.Error("sink flush failed", zap.Error(err))
 			}
+			if err := s.Close(); err != nil {
+				logging.Logger.Error("failed to close sink", zap.Error(err))
+			}
+		}()
+		replay = sinkReplayer(decoder, s, config.Retry)
+	default:
+		producer, err := sarama.NewSyncProducerFromClient(client)
+		if err != nil {
+			logging.Logger.Fatal("failed to create kafka producer", zap.Error(err))
+		}
+		defer producer.Close()
+		replay = produceReplayer(producer)
+	}
 
-			if context.Canceled != nil {
-				return
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	logging.Logger.Info("replaying dead letters",
+		zap.String("topic", config.DLQ.Topic),
+		zap.String("to", options.To),
+		zap.Bool("dry_run", options.DryRun))
+	stats, err := NewDLQReplay(client, config.DLQ.Topic, filter, replay).Run(ctx)
+	fields := []zap.Field{
+		zap.Int("read", stats.Read),
+		zap.Int("selected", stats.Selected),
+		zap.Int("replayed", stats.Replayed),
+		zap.Int("failed", stats.Failed),
+	}
+	if ctx.Err() != nil {
+		logging.Logger.Info("dead letter replay stopped", fields...)
+		return
+	}
+	if err != nil {
+		logging.Logger.Error("dead letter replay failed", append(fields, zap.Error(err))...)
+		failed = true
+		return
+	}
+	if stats.Failed > 0 {
+		logging.Logger.Error("some dead letters failed to replay", fields...)
+		failed = true
+		return
+	}
+	logging.Logger.Info("dead letters replayed", fields...)
+}
+
+func runConsumer(fs *flag.FlagSet, args []string) {
+	seek := RegisterSeekFlags(fs)
+	config, source := loadConfigSource(fs, args)
+	defer logging.Logger.Sync()
+	// set when the consumer stopped on an error, to exit with a failure
+	// status once everything deferred ran
+	var failed bool
+	defer func() {
+		if failed {
+			logging.Logger.Sync()
+			os.Exit(1)
+		}
+	}()
+	seekTarget, err := seek.Target(time.Now())
+	if err != nil {
+		logging.Logger.Fatal("invalid flags", zap.Error(err))
+	}
+	backfill := len(config.Backfill.Ranges) > 0
+	if seekTarget != nil && backfill {
+		logging.Logger.Fatal("invalid flags", zap.Error(errors.New("a backfill has no group offsets to seek, set the start of its ranges")))
+	}
+	if seekTarget != nil && config.Sink.Type == "postgres" && config.Sink.Postgres.OffsetsTable != "" {
+		logging.Logger.Fatal("invalid flags", zap.Error(errors.New("the offsets stored in sink.postgres.offsets_table win over the group offsets, update them there to replay")))
+	}
+
+	if config.Tracing.Enable {
+		provider, err := tracing.NewTracerProvider(context.Background(), config.Tracing)
+		if err != nil {
+			logging.Logger.Fatal("failed to create tracer provider", zap.Error(err))
+		}
+		defer func() {
+			if err := provider.Shutdown(context.Background()); err != nil {
+				logging.Logger.Error("failed to flush traces", zap.Error(err))
 			}
+		}()
+	}
+
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+
+	if seekTarget != nil {
+		if err := consumer.SeekGroup(config.Kafka, saramaConfig, seekTarget); err != nil {
+			logging.Logger.Fatal("failed to reset group offsets", zap.Error(err))
+		}
+	}
+
+	decode.DefaultIDLDecoder, err = decode.LoadIDLs(context.Background(), config.Decoding.IDL)
+	if err != nil {
+		logging.Logger.Fatal("failed to load idls", zap.Error(err))
+	}
+	if decode.DefaultIDLDecoder.Len() > 0 {
+		logging.Logger.Info("loaded idls", zap.Int("programs", decode.DefaultIDLDecoder.Len()))
+	}
+
+	s, err := sink.New(context.Background(), config.Sink)
+	if err != nil {
+		logging.Logger.Fatal("failed to create sink", zap.Error(err))
+	}
+	// taken before the sink is wrapped
+	stored, _ := s.(consumer.StoredOffsets)
+	rollbackTarget, _ := s.(slotRollback)
+	if len(config.Routes) > 0 {
+		if s, err = sink.NewRouterSink(context.Background(), s, config.Routes); err != nil {
+			logging.Logger.Fatal("failed to create sink", zap.Error(err))
+		}
+		logging.Logger.Info("routing to sinks", zap.String("routes", sink.RouteNames(config.Routes)))
+	}
+	if config.SlotCompletion.Topic != "" {
+		producer, err := sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+		if err != nil {
+			logging.Logger.Fatal("failed to create slot completion producer", zap.Error(err))
+		}
+		defer producer.Close()
+		s = NewSlotCompletionSink(s, producer, config.SlotCompletion)
+	}
+	if config.WebSocket.Address != "" {
+		broadcaster := NewBroadcaster(config.WebSocket)
+		if err := RunWebSocketServer(config.WebSocket, broadcaster); err != nil {
+			logging.Logger.Fatal("failed to start websocket server", zap.Error(err))
+		}
+		s = NewBroadcastSink(s, broadcaster)
+	}
+	if config.GraphQL.Address != "" {
+		server := NewGraphQLServer(config.GraphQL)
+		if err := RunGraphQLServer(config.GraphQL, server); err != nil {
+			logging.Logger.Fatal("failed to start graphql server", zap.Error(err))
+		}
+		s = NewBroadcastSink(s, server)
+	}
+	if config.Query.Address != "" {
+		store := NewRecentStore(config.Query)
+		if err := RunQueryServer(config.Query, store); err != nil {
+			logging.Logger.Fatal("failed to start query server", zap.Error(err))
+		}
+		s = NewBroadcastSink(s, store)
+	}
+	if config.GeyserServer.Address != "" {
+		server := NewGeyserServer(config.GeyserServer)
+		if err := RunGeyserServer(config.GeyserServer, server); err != nil {
+			logging.Logger.Fatal("failed to start geyser server", zap.Error(err))
+		}
+		s = NewBroadcastSink(s, server)
+	}
+	if config.Transfers.Topic != "" {
+		producer, err := sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+		if err != nil {
+			logging.Logger.Fatal("failed to create transfers producer", zap.Error(err))
+		}
+		defer producer.Close()
+		s = NewTransfersSink(s, producer, config.Transfers)
+	}
+	if config.Swaps.Topic != "" {
+		producer, err := sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+		if err != nil {
+			logging.Logger.Fatal("failed to create swaps producer", zap.Error(err))
+		}
+		defer producer.Close()
+		s = NewSwapsSink(s, producer, config.Swaps)
+	}
+	if config.Mints.Topic != "" {
+		producer, err := sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+		if err != nil {
+			logging.Logger.Fatal("failed to create mints producer", zap.Error(err))
+		}
+		defer producer.Close()
+		s = NewMintsSink(s, producer, config.Mints)
+	}
+	if config.Fees.Enable {
+		var producer sarama.SyncProducer
+		if config.Fees.Topic != "" {
+			producer, err = sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+			if err != nil {
+				logging.Logger.Fatal("failed to create fees producer", zap.Error(err))
+			}
+			defer producer.Close()
+		}
+		s = NewFeesSink(s, producer, config.Fees)
+	}
+	if config.Throughput.Enable {
+		var producer sarama.SyncProducer
+		if config.Throughput.Topic != "" {
+			producer, err = sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+			if err != nil {
+				logging.Logger.Fatal("failed to create throughput producer", zap.Error(err))
+			}
+			defer producer.Close()
+		}
+		s = NewThroughputSink(s, producer, config.Throughput)
+	}
+	if config.MEV.Enable {
+		var producer sarama.SyncProducer
+		if config.MEV.Topic != "" {
+			producer, err = sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+			if err != nil {
+				logging.Logger.Fatal("failed to create mev producer", zap.Error(err))
+			}
+			defer producer.Close()
+		}
+		s = NewMEVSink(s, producer, config.MEV)
+	}
+	var alerts *AlertSink
+	if len(config.Alerts.Rules) > 0 {
+		alerts, err = NewAlertSink(s, config.Alerts)
+		if err != nil {
+			logging.Logger.Fatal("failed to create alert sink", zap.Error(err))
+		}
+		s = alerts
+	}
+	if config.Processing.Blocks.Enable {
+		s = sink.NewBlockSink(s, config.Processing.Blocks)
+	}
+	if config.Processing.AccountDiff.Enable {
+		s = sink.NewAccountDiffSink(s, config.Processing.AccountDiff)
+	}
+	if config.Rollback.enabled() {
+		var producer sarama.SyncProducer
+		if config.Rollback.Topic != "" {
+			producer, err = sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+			if err != nil {
+				logging.Logger.Fatal("failed to create rollback producer", zap.Error(err))
+			}
+			defer producer.Close()
+		}
+		s = NewRollbackSink(s, rollbackTarget, producer, config.Rollback)
+	}
+	if config.Processing.Commitment.Level != decode.CommitmentProcessed {
+		s = sink.NewCommitmentSink(s, config.Processing.Commitment)
+	}
+	if config.Processing.Reorder.Enable {
+		s = sink.NewReorderSink(s, config.Processing.Reorder)
+	}
+	if len(config.Processing.Middlewares) > 0 {
+		chain, err := sink.NewMiddlewares(config.Processing.Middlewares)
+		if err != nil {
+			logging.Logger.Fatal("invalid config", zap.Error(err))
+		}
+		s = sink.NewMiddlewareSink(s, chain)
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			logging.Logger.Error("failed to close sink", zap.Error(err))
 		}
 	}()
 
-	log.Println("Kafka consumer is running...")
-	<-sigchan
-	log.Println("Shutting down consumer")
-}
+	var dlq *consumer.DeadLetterQueue
+	if config.DLQ.Topic != "" {
+		dlq, err = consumer.NewDeadLetterQueue(config.Kafka.Brokers, saramaConfig, config.DLQ.Topic)
+		if err != nil {
+			logging.Logger.Fatal("failed to create dead-letter producer", zap.Error(err))
+		}
+		defer dlq.Close()
+	}
 
-type ConsumerHandler struct{}
+	client, err := sarama.NewClient(config.Kafka.Brokers, saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka client", zap.Error(err))
+	}
+	defer client.Close()
 
-func (h *ConsumerHandler) Setup(sarama.ConsumerGroupSession) error {
-	return nil
-}
+	discovery, err := consumer.NewTopicDiscovery(client, config.Kafka)
+	if err != nil {
+		logging.Logger.Fatal("failed to discover topics", zap.Error(err))
+	}
 
-func (h *ConsumerHandler) Cleanup(sarama.ConsumerGroupSession) error {
-	return nil
-}
+	health := consumer.NewHealth(client, config.Health)
+	var failover *consumer.Failover
+	if len(config.Failover.Brokers) > 0 {
+		failover = consumer.NewFailover(config.Failover, client, discovery.Topics)
+		health.Failover = failover
+	}
+	if config.Prometheus != "" {
+		if err := RunMetricsServer(config.Prometheus, health); err != nil {
+			logging.Logger.Fatal("failed to start prometheus server", zap.Error(err))
+		}
+	}
+
+	decoder, err := decode.NewDecoder(config.Decoding)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	metrics.SamplingRate.Set(float64(max(config.Decoding.Sample, 1)))
+	filter, err := filter.New(config.Filter)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
 
-func (h *ConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		// log.Printf("Received message: Topic(%s) Partition(%d) Offset(%d) Key(%s) Value(%s)\n",
-		// message.Topic, message.Partition, message.Offset, string(message.Key), string(message.Value))
-		tx := &proto.SubscribeUpdateTransactionInfo{}
-		err := gproto.Unmarshal(message.Value, tx)
+	var gaps *consumer.GapDetector
+	if config.Gaps.Enable {
+		var producer sarama.SyncProducer
+		if config.Gaps.Topic != "" {
+			producer, err = sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
+			if err != nil {
+				logging.Logger.Fatal("failed to create gap producer", zap.Error(err))
+			}
+			defer producer.Close()
+		}
+		gaps = consumer.NewGapDetector(config.Gaps, producer)
+	}
+
+	var retryTopics *consumer.RetryTopics
+	if len(config.Retry.Topics.Delays) > 0 {
+		producer, err := sarama.NewSyncProducer(config.Kafka.Brokers, saramaConfig)
 		if err != nil {
-			fmt.Println("err: ", err)
-		} else {
-			fmt.Println("tx: ", tx)
+			logging.Logger.Fatal("failed to create retry topic producer", zap.Error(err))
 		}
+		retryTopics = consumer.NewRetryTopics(config.Retry.Topics, config.Kafka.Topics, producer)
+		defer retryTopics.Close()
+	}
+
+	handlerConfig := consumer.HandlerConfig{
+		Group:        config.Kafka.GroupID,
+		Decoder:      decoder,
+		LookupTables: decode.NewLookupTableResolver(config.Decoding.LookupTables),
+		Filter:       filter,
+		Gaps:         gaps,
+		Sink:         s,
+		DLQ:          dlq,
+		RetryTopics:  retryTopics,
+		Processing:   config.Processing,
+		Retry:        config.Retry,
+		Health:       health,
+		Failover:     failover,
+		Committer:    consumer.NewOffsetCommitter(client, config.Kafka.GroupID, saramaConfig.Consumer.Group.InstanceId, config.Kafka.Commit),
+		Offsets:      &consumer.ClientOffsets{Client: client, Group: config.Kafka.GroupID},
+		OutOfRange:   config.Kafka.OffsetOutOfRange,
+		Stored:       stored,
+	}
+	var store consumer.CheckpointStore
+	if backfill {
+		store, err = consumer.NewCheckpointStore(config.Backfill.Checkpoint)
+		if err != nil {
+			logging.Logger.Fatal("failed to create checkpoint store", zap.Error(err))
+		}
+		defer store.Close()
+		// no group: the progress goes to the checkpoint store
+		handlerConfig.Group = ""
+		handlerConfig.Committer = consumer.NewCheckpointCommitter(store, config.Kafka.Commit)
+		handlerConfig.Offsets = nil
+	}
+	handler := consumer.NewHandler(handlerConfig)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go NewReloader(source, config, handler, alerts).Run(ctx, config.Reload)
+	go RunStatsDump(ctx, health)
+
+	if backfill {
+		logging.Logger.Info("kafka consumer is backfilling",
+			zap.Int("ranges", len(config.Backfill.Ranges)),
+			zap.Int("workers", config.Processing.Workers))
+		if err := consumer.NewBackfill(client, handler, store, config.Backfill.Ranges).Run(ctx); err != nil {
+			logging.Logger.Error("backfill failed", zap.Error(err))
+			failed = true
+			return
+		}
+		if ctx.Err() != nil {
+			logging.Logger.Info("backfill stopped, a new run resumes at the checkpoint")
+			return
+		}
+		logging.Logger.Info("backfill finished")
+		return
+	}
+
+	consumerGroup, err := consumer.NewConsumerGroup(config.Kafka, client, saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create consumer group", zap.Error(err))
+	}
+	handler.AttachGroup(consumerGroup)
+	if config.Admin.Address != "" {
+		if err := RunAdminServer(config.Admin, NewAdmin(config.Admin, handler)); err != nil {
+			logging.Logger.Fatal("failed to start admin server", zap.Error(err))
+		}
+	}
+	var failovers sync.WaitGroup
+	if failover != nil {
+		secondary := config.Failover.Kafka(config.Kafka)
+		secondaryConfig, err := secondary.Sarama()
+		if err != nil {
+			logging.Logger.Fatal("invalid config", zap.Error(err))
+		}
+		failovers.Add(1)
+		go func() {
+			defer failovers.Done()
+			failover.Run(ctx, consumer.ConsumeSecondary(secondary, secondaryConfig, config.Health, handler, failover))
+		}()
+	}
+
+	go func() {
+		for err := range consumerGroup.Errors() {
+			logging.Logger.Error("consumer group error", zap.Error(err))
+		}
+	}()
+
+	go discovery.Run(ctx)
+	lagExceeded := make(chan error, 1)
+	go func() {
+		if err := consumer.NewLagMonitor(config.Lag, client, health).Run(ctx); err != nil {
+			lagExceeded <- err
+		}
+	}()
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for {
+			// a session ends on every rebalance, after its claims finished
+			// and their offsets were committed, and when the discovered
+			// topics changed
+			err := consumer.ConsumeDiscovered(ctx, consumerGroup, discovery, retryTopics.Topics(), handler)
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return
+			}
+			if errors.Is(err, consumer.ErrOffsetOutOfRange) {
+				logging.Logger.Error("consumer stopped", zap.Error(err))
+				failed = true
+				return
+			}
+			if err != nil {
+				logging.Logger.Error("consumer error", zap.Error(err))
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	logging.Logger.Info("kafka consumer is running",
+		zap.Strings("topics", append(discovery.Topics(), retryTopics.Topics()...)),
+		zap.String("group_id", config.Kafka.GroupID),
+		zap.Int("workers", config.Processing.Workers))
+	var lagged bool
+	select {
+	case <-ctx.Done():
+	case <-consumed:
+	case err := <-lagExceeded:
+		logging.Logger.Error("consumer stopped", zap.Error(err))
+		lagged = true
+	}
+	// a second signal terminates immediately
+	stop()
 
-		session.MarkMessage(message, "")
+	logging.Logger.Info("shutting down consumer, draining in-flight messages")
+	<-consumed
+	// set once the consumer goroutine no longer sets it
+	failed = failed || lagged
+	failovers.Wait()
+	if err := consumerGroup.Close(); err != nil {
+		logging.Logger.Error("failed to close consumer group", zap.Error(err))
 	}
-	return nil
+	logging.Logger.Info("consumer stopped")
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// jitoTipAccounts are the accounts Jito block engines take the tips of
+// bundles in.
+var jitoTipAccounts = map[string]struct{}{
+	"96gYZGLnJYVFmbjzopPSU6QiEV5fGqZNyN9nmNhvrZU5": {},
+	"HFqU5x63VTqvQss8hp11i4wVV8bD44PvwucfZ2bU7gRe": {},
+	"Cw8CFyM9FkoMi7K7Crf6HNQqf4uEMzpKw6QNghXLvLkY": {},
+	"ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49": {},
+	"DfXygSm4jCyNCybVYYK6DwvWqjKee8pbDmJGcLWNDXjh": {},
+	"ADuUkR4vqLUMWXxW9gh6D6L8pMSawimctcNZ5pGwDcEt": {},
+	"DttWaMuVvTiduZRnguLF7jNxTgiMBZ1hyAumKUiL2KRL": {},
+	"3AVi9Tg9Uo68tJfuvoKvqKNWKc5wPdSSdeBnizKZ6jT":  {},
+}
+
+// maxBundleTransactions is the most transactions a Jito bundle holds.
+const maxBundleTransactions = 5
+
+// Types of mevEvent, and the roles of their transactions.
+const (
+	mevBundle   = "bundle"
+	mevSandwich = "sandwich"
+
+	mevMember = "member"
+	mevFront  = "front"
+	mevVictim = "victim"
+	mevBack   = "back"
+)
+
+// MEVConfig flags the likely Jito bundles and sandwiches among the written
+// transactions, once the transactions of their slot are all known.
+type MEVConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// Topic receives a JSON record per event keyed by slot, disabled when
+	// empty.
+	Topic string `json:"topic" yaml:"topic"`
+	// DelaySlots closes a slot once a transaction of a slot this many slots
+	// newer was written, the transactions of a closed slot are not looked at.
+	DelaySlots uint64 `json:"delay_slots" yaml:"delay_slots"`
+}
+
+func DefaultMEVConfig() MEVConfig {
+	return MEVConfig{DelaySlots: 4}
+}
+
+func (c *MEVConfig) Validate(topics []string) error {
+	if !c.Enable {
+		if c.Topic != "" {
+			return errors.New("mev.topic: needs mev.enable")
+		}
+		return nil
+	}
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("mev.topic: %s is also consumed", c.Topic)
+	}
+	return nil
+}
+
+// mevEvent is a likely bundle or sandwich of a slot, the record produced to
+// MEVConfig.Topic. The transactions are in slot order. Profit is what the
+// attacker of a sandwich got back less what it paid, in base units of
+// ProfitMint, the quote mint of the pool when the front-run bought.
+type mevEvent struct {
+	Type         string           `json:"type"`
+	Slot         uint64           `json:"slot"`
+	Transactions []mevTransaction `json:"transactions"`
+	Signer       string           `json:"signer"`
+	Tip          uint64           `json:"tip,omitempty"`
+	Dex          string           `json:"dex,omitempty"`
+	Pool         string           `json:"pool,omitempty"`
+	ProfitMint   string           `json:"profit_mint,omitempty"`
+	Profit       *int64           `json:"profit,omitempty"`
+}
+
+type mevTransaction struct {
+	Signature string `json:"signature"`
+	Index     uint64 `json:"index"`
+	Role      string `json:"role"`
+}
+
+// mevSample is what a transaction tells about MEV. Failed and vote
+// transactions are kept as ignored, so that they break the runs of bundles.
+type mevSample struct {
+	signature string
+	index     uint64
+	payer     string
+	ignored   bool
+	swaps     []decode.Swap
+	tip       uint64
+}
+
+// MEVSink detects likely Jito bundles and sandwiches in the transactions
+// written, alone or in a block, ordered by their index in the slot. A slot
+// is closed DelaySlots after it, its events are counted and queued as
+// records. Records are produced after the next Flush succeeded, a failed
+// produce fails the Flush and they are produced again with the next one.
+type MEVSink struct {
+	sink.Sink
+	producer   sarama.SyncProducer
+	topic      string
+	delaySlots uint64
+
+	mu sync.Mutex
+	// pending are the samples of the open slots by signature, so that a
+	// transaction written again counts once.
+	pending map[uint64]map[string]mevSample
+	newest  uint64
+	events  []mevEvent
+}
+
+// NewMEVSink produces the records with producer, which is nil without
+// MEVConfig.Topic.
+func NewMEVSink(next sink.Sink, producer sarama.SyncProducer, config MEVConfig) *MEVSink {
+	return &MEVSink{
+		Sink:       next,
+		producer:   producer,
+		topic:      config.Topic,
+		delaySlots: config.DelaySlots,
+		pending:    make(map[uint64]map[string]mevSample),
+	}
+}
+
+func (s *MEVSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	transactions := decode.MessageTransactions(msg)
+	if msg.Slot == 0 || len(transactions) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Slot+s.delaySlots < s.newest {
+		return nil
+	}
+	samples := s.pending[msg.Slot]
+	if samples == nil {
+		samples = make(map[string]mevSample)
+		s.pending[msg.Slot] = samples
+	}
+	for _, info := range transactions {
+		sample := mevSample{signature: base58.Encode(info.GetSignature()), index: info.GetIndex()}
+		if keys := decode.TransactionAccounts(info); len(keys) > 0 {
+			sample.payer = base58.Encode(keys[0])
+		}
+		sample.ignored = info.GetIsVote() || info.GetMeta().GetErr() != nil
+		if !sample.ignored {
+			sample.swaps = decode.DecodeSwaps(info)
+			for _, instruction := range decode.DecodeSystemInstructions(info) {
+				if _, ok := jitoTipAccounts[instruction.Destination]; ok && instruction.Type == "transfer" {
+					sample.tip += instruction.Lamports
+				}
+			}
+		}
+		samples[sample.signature] = sample
+	}
+	if msg.Slot > s.newest {
+		s.newest = msg.Slot
+		s.close()
+	}
+	return nil
+}
+
+// close closes the slots DelaySlots behind the newest one.
+func (s *MEVSink) close() {
+	if s.newest <= s.delaySlots {
+		return
+	}
+	horizon := s.newest - s.delaySlots
+	for _, slot := range slices.Sorted(maps.Keys(s.pending)) {
+		if slot >= horizon {
+			break
+		}
+		samples := slices.SortedFunc(maps.Values(s.pending[slot]), func(a, b mevSample) int { return cmp.Compare(a.index, b.index) })
+		delete(s.pending, slot)
+		events := append(detectBundles(slot, samples), detectSandwiches(slot, samples)...)
+		for _, event := range events {
+			metrics.MEVEventsTotal.WithLabelValues(event.Type).Inc()
+		}
+		if s.producer != nil {
+			s.events = append(s.events, events...)
+		}
+	}
+}
+
+// detectBundles flags as a bundle every transaction tipping Jito with the
+// transactions of the same fee payer right before it in the slot, when there
+// are any: a single transaction tipping is not told apart from a transaction
+// sent alone.
+func detectBundles(slot uint64, samples []mevSample) []mevEvent {
+	var out []mevEvent
+	for i, sample := range samples {
+		if sample.tip == 0 {
+			continue
+		}
+		start := i
+		for start > 0 && i-start+1 < maxBundleTransactions {
+			previous := samples[start-1]
+			if previous.index+1 != samples[start].index || previous.ignored || previous.payer != sample.payer || previous.tip != 0 {
+				break
+			}
+			start--
+		}
+		if start == i {
+			continue
+		}
+		event := mevEvent{Type: mevBundle, Slot: slot, Signer: sample.payer, Tip: sample.tip}
+		for _, member := range samples[start : i+1] {
+			event.Transactions = append(event.Transactions, mevTransaction{Signature: member.signature, Index: member.index, Role: mevMember})
+		}
+		out = append(out, event)
+	}
+	return out
+}
+
+// openSandwich is a swap that may be the front-run of a sandwich, with the
+// swaps of other signers in the same direction since.
+type openSandwich struct {
+	front   decode.Swap
+	sample  int
+	victims []int
+}
+
+// detectSandwiches flags as a sandwich a swap followed on the same pool by
+// swaps of other signers in the same direction, then by a swap of the signer
+// of the first in the other direction.
+func detectSandwiches(slot uint64, samples []mevSample) []mevEvent {
+	var out []mevEvent
+	// open are the possible front-runs by pool and signer.
+	open := make(map[string]map[string]*openSandwich)
+	for i, sample := range samples {
+		for _, swap := range sample.swaps {
+			if swap.Pool == "" || swap.Signer == "" {
+				continue
+			}
+			fronts := open[swap.Pool]
+			if fronts == nil {
+				fronts = make(map[string]*openSandwich)
+				open[swap.Pool] = fronts
+			}
+			if f := fronts[swap.Signer]; f != nil && f.sample != i && f.front.Direction != swap.Direction && len(f.victims) > 0 {
+				out = append(out, sandwich(slot, samples, f, swap, i))
+				delete(fronts, swap.Signer)
+				continue
+			}
+			for signer, f := range fronts {
+				if signer != swap.Signer && f.front.Direction == swap.Direction && !slices.Contains(f.victims, i) {
+					f.victims = append(f.victims, i)
+				}
+			}
+			fronts[swap.Signer] = &openSandwich{front: swap, sample: i}
+		}
+	}
+	return out
+}
+
+// sandwich returns the event of the sandwich f closed by back, the swap of
+// samples[i].
+func sandwich(slot uint64, samples []mevSample, f *openSandwich, back decode.Swap, i int) mevEvent {
+	event := mevEvent{
+		Type:   mevSandwich,
+		Slot:   slot,
+		Signer: f.front.Signer,
+		Tip:    samples[f.sample].tip + samples[i].tip,
+		Dex:    f.front.Dex,
+		Pool:   f.front.Pool,
+	}
+	transaction := func(sample mevSample, role string) {
+		event.Transactions = append(event.Transactions, mevTransaction{Signature: sample.signature, Index: sample.index, Role: role})
+	}
+	transaction(samples[f.sample], mevFront)
+	for _, victim := range f.victims {
+		transaction(samples[victim], mevVictim)
+	}
+	transaction(samples[i], mevBack)
+	var profit int64
+	if f.front.Direction == "buy" {
+		event.ProfitMint, profit = f.front.QuoteMint, int64(back.QuoteAmount)-int64(f.front.QuoteAmount)
+	} else {
+		event.ProfitMint, profit = f.front.BaseMint, int64(back.BaseAmount)-int64(f.front.BaseAmount)
+	}
+	event.Profit = &profit
+	return event
+}
+
+func (s *MEVSink) Flush(ctx context.Context) error {
+	if err := s.Sink.Flush(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	events := s.events
+	s.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+	messages := make([]*sarama.ProducerMessage, len(events))
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages[i] = &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(strconv.FormatUint(event.Slot, 10)),
+			Value: sarama.ByteEncoder(value),
+		}
+	}
+	if err := s.producer.SendMessages(messages); err != nil {
+		return fmt.Errorf("produce mev events: %w", err)
+	}
+	s.mu.Lock()
+	s.events = slices.Delete(s.events, 0, len(events))
+	s.mu.Unlock()
+	metrics.MEVEventsProducedTotal.Add(float64(len(events)))
+	return nil
+}
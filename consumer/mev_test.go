@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// tipTransaction returns the transaction signature at index of slot, paid
+// by payer and tipping Jito tip lamports, none when 0.
+func tipTransaction(slot uint64, signature byte, index uint64, payer byte, tip uint64) *decode.Message {
+	system, _ := base58.Decode(decode.SystemProgramID)
+	account, _ := base58.Decode("96gYZGLnJYVFmbjzopPSU6QiEV5fGqZNyN9nmNhvrZU5")
+	msg := decodetest.TransactionMessage(slot, system, testkey.Key(payer), account)
+	info := msg.Update.GetTransaction().GetTransaction()
+	info.Signature, info.Index = testkey.Key(signature), index
+	if tip != 0 {
+		info.Transaction.Message.Instructions[0].Accounts = []byte{0, 1}
+		info.Transaction.Message.Instructions[0].Data = decodetest.SystemData(decode.SystemTransfer, decodetest.LE64(tip))
+	}
+	return msg
+}
+
+func TestMEVSink(t *testing.T) {
+	producer := &jsonProducer[mevEvent]{}
+	s := NewMEVSink(&sinktest.RecordSink{}, producer, MEVConfig{Enable: true, Topic: "mev", DelaySlots: 2})
+	ctx := context.Background()
+
+	failed := tipTransaction(10, 5, 3, 1, 0)
+	failed.Update.GetTransaction().GetTransaction().Meta.Err = &proto.TransactionError{Err: []byte{1}}
+	for _, msg := range []*decode.Message{
+		tipTransaction(10, 2, 1, 1, 1000),
+		tipTransaction(10, 1, 0, 1, 0),
+		// written again after a retry
+		tipTransaction(10, 1, 0, 1, 0),
+		failed,
+		tipTransaction(10, 6, 4, 1, 500),
+		tipTransaction(13, 7, 0, 2, 0),
+	} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	producer.err = errors.New("unavailable")
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("failed produce not reported")
+	}
+	producer.err = nil
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.records) != 1 {
+		t.Fatalf("produced %+v", producer.records)
+	}
+	event := producer.records[0]
+	if event.Type != mevBundle || event.Slot != 10 || event.Tip != 1000 || event.Signer != testkey.String(1) || len(event.Transactions) != 2 ||
+		event.Transactions[0].Signature != testkey.String(1) || event.Transactions[1].Index != 1 {
+		t.Fatalf("event %+v", event)
+	}
+}
+
+func TestDetectBundles(t *testing.T) {
+	sample := func(index uint64, payer string, tip uint64) mevSample {
+		return mevSample{signature: strings.Repeat("s", int(index)+1), index: index, payer: payer, tip: tip}
+	}
+	samples := []mevSample{
+		sample(0, "a", 0), sample(1, "b", 0), sample(2, "b", 0), sample(3, "b", 0), sample(4, "b", 0),
+		sample(5, "b", 0), sample(6, "b", 10),
+		// a gap
+		sample(8, "c", 0), sample(10, "c", 10),
+	}
+	events := detectBundles(1, samples)
+	if len(events) != 1 || len(events[0].Transactions) != maxBundleTransactions || events[0].Transactions[0].Index != 2 {
+		t.Fatalf("events %+v", events)
+	}
+}
+
+func TestDetectSandwiches(t *testing.T) {
+	swap := func(signer, pool, direction string, base, quote uint64) decode.Swap {
+		return decode.Swap{Dex: "raydium_amm", Pool: pool, Signer: signer, Direction: direction,
+			BaseMint: "base", QuoteMint: "quote", BaseAmount: base, QuoteAmount: quote}
+	}
+	samples := []mevSample{
+		{signature: "front", index: 0, swaps: []decode.Swap{swap("attacker", "pool", "buy", 10, 100)}},
+		{signature: "victim", index: 1, swaps: []decode.Swap{swap("victim", "pool", "buy", 5, 60)}},
+		// another pool, and a round trip without victims
+		{signature: "other", index: 2, swaps: []decode.Swap{swap("trader", "other", "buy", 1, 1)}},
+		{signature: "other-back", index: 3, swaps: []decode.Swap{swap("trader", "other", "sell", 1, 1)}},
+		{signature: "back", index: 4, swaps: []decode.Swap{swap("attacker", "pool", "sell", 10, 120)}},
+	}
+	events := detectSandwiches(1, samples)
+	if len(events) != 1 {
+		t.Fatalf("events %+v", events)
+	}
+	event := events[0]
+	roles := []string{}
+	for _, transaction := range event.Transactions {
+		roles = append(roles, transaction.Signature+":"+transaction.Role)
+	}
+	if !slices.Equal(roles, []string{"front:front", "victim:victim", "back:back"}) {
+		t.Fatalf("transactions %v", roles)
+	}
+	if event.Signer != "attacker" || event.Pool != "pool" || event.ProfitMint != "quote" || *event.Profit != 20 {
+		t.Fatalf("event %+v", event)
+	}
+}
+
+func TestMEVConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.MEV.Topic = "mev"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "mev.topic") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// MintsConfig produces the mint events of the written transactions to a
+// topic of their own, for collection indexers.
+type MintsConfig struct {
+	// Topic receives a JSON record per mint event keyed by mint, or by tree
+	// for compressed NFTs, disabled when empty.
+	Topic string `json:"topic" yaml:"topic"`
+}
+
+func (c *MintsConfig) Validate(topics []string) error {
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("mints.topic: %s is also consumed", c.Topic)
+	}
+	return nil
+}
+
+// mintRecord is the record produced to MintsConfig.Topic.
+type mintRecord struct {
+	Signature string `json:"signature"`
+	Slot      uint64 `json:"slot"`
+	decode.MintEvent
+}
+
+// MintsSink produces the mint events of every transaction written, alone or
+// in a block, after passing it on. A failed produce fails the write, so a
+// retry writes the message to the next sink again.
+type MintsSink struct {
+	sink.Sink
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewMintsSink(next sink.Sink, producer sarama.SyncProducer, config MintsConfig) *MintsSink {
+	return &MintsSink{Sink: next, producer: producer, topic: config.Topic}
+}
+
+func (s *MintsSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	var records []*sarama.ProducerMessage
+	for _, info := range decode.MessageTransactions(msg) {
+		if info.GetMeta().GetErr() != nil {
+			continue
+		}
+		signature := base58.Encode(info.GetSignature())
+		for _, event := range decode.DecodeMintEvents(info) {
+			value, err := json.Marshal(mintRecord{Signature: signature, Slot: msg.Slot, MintEvent: event})
+			if err != nil {
+				return err
+			}
+			key := event.Mint
+			if key == "" {
+				key = event.Tree
+			}
+			records = append(records, &sarama.ProducerMessage{
+				Topic:   s.topic,
+				Key:     sarama.StringEncoder(key),
+				Value:   sarama.ByteEncoder(value),
+				Headers: decode.ProducerHeaders(msg),
+			})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := s.producer.SendMessages(records); err != nil {
+		return fmt.Errorf("produce mint events: %w", err)
+	}
+	metrics.MintsProducedTotal.Add(float64(len(records)))
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// mintProducer records the keys of the messages it sends, or fails with err.
+type mintProducer struct {
+	sarama.SyncProducer
+	err  error
+	keys []string
+}
+
+func (p *mintProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+	for _, msg := range msgs {
+		key, _ := msg.Key.Encode()
+		p.keys = append(p.keys, string(key))
+	}
+	return nil
+}
+
+func TestMintsSink(t *testing.T) {
+	producer := &mintProducer{}
+	s := NewMintsSink(&sinktest.RecordSink{}, producer, MintsConfig{Topic: "mints"})
+	msg := &decode.Message{Slot: 10, Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{
+		Transaction: &proto.SubscribeUpdateTransaction{Slot: 10, Transaction: decodetest.MintTransaction()},
+	}}}
+	if err := s.Write(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{testkey.String(1), testkey.String(1), testkey.String(7), testkey.String(9)}
+	if !slices.Equal(producer.keys, want) {
+		t.Fatalf("keys %v", producer.keys)
+	}
+	producer.err = errors.New("unavailable")
+	if err := s.Write(context.Background(), msg); err == nil {
+		t.Fatal("failed produce not reported")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+	"go.uber.org/zap"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/sink"
+	"consumer/proto"
+)
+
+// mockSlotDuration is the time between the slots of the mock source, that
+// of mainnet.
+const mockSlotDuration = 400 * time.Millisecond
+
+// MockOptions shape the synthetic updates of the mock command. They are
+// flags only, not part of the config file.
+type MockOptions struct {
+	TPS         float64
+	Programs    string
+	FailureRate float64
+	VoteRate    float64
+	Count       int
+	Seed        int64
+	Slot        uint64
+	// Topic is the topic the records appear to be consumed from, the first
+	// of kafka.topics.
+	Topic string
+}
+
+func RegisterMockFlags(fs *flag.FlagSet) *MockOptions {
+	o := registerMockSourceFlags(fs)
+	fs.IntVar(&o.Count, "count", 0, "stop after this many transactions, 0 runs until stopped")
+	return o
+}
+
+// registerMockSourceFlags defines the flags shaping the mock transactions,
+// which bench shares with mock while counting records with its own flag.
+func registerMockSourceFlags(fs *flag.FlagSet) *MockOptions {
+	o := &MockOptions{}
+	fs.Float64Var(&o.TPS, "tps", 100, "transactions per second")
+	fs.StringVar(&o.Programs, "programs", decode.SystemProgramID+","+decode.TokenProgramID, "comma-separated programs the transactions invoke, one each")
+	fs.Float64Var(&o.FailureRate, "failure-rate", 0.05, "fraction of the transactions failing with a custom program error")
+	fs.Float64Var(&o.VoteRate, "vote-rate", 0, "fraction of the transactions that are votes")
+	fs.Int64Var(&o.Seed, "seed", 1, "seed of the generator, the same seed generates the same transactions")
+	fs.Uint64Var(&o.Slot, "slot", 300_000_000, "first slot")
+	return o
+}
+
+// mockTopic is the topic of the mock records, the first of kafka.topics.
+func mockTopic(config consumer.KafkaConfig) string {
+	if len(config.Topics) > 0 {
+		return config.Topics[0]
+	}
+	return "updates"
+}
+
+func (o *MockOptions) validate() ([][]byte, error) {
+	if o.TPS <= 0 {
+		return nil, errors.New("--tps: must be positive")
+	}
+	if o.FailureRate < 0 || o.FailureRate > 1 || o.VoteRate < 0 || o.VoteRate > 1 {
+		return nil, errors.New("--failure-rate and --vote-rate: must be between 0 and 1")
+	}
+	if o.Count < 0 {
+		return nil, errors.New("--count: must not be negative")
+	}
+	var programs [][]byte
+	for _, program := range splitList(o.Programs) {
+		key, err := base58.Decode(program)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("--programs: expected base58 public keys, got %q", program)
+		}
+		programs = append(programs, key)
+	}
+	if len(programs) == 0 {
+		return nil, errors.New("--programs: must not be empty")
+	}
+	return programs, nil
+}
+
+// MockSource generates the records grpc2kafka would produce for a chain
+// running at TPS transactions per second: every slot a processed slot
+// update, its transactions, its block meta and the confirmed and finalized
+// updates of earlier slots. The transactions transfer lamports or tokens, or
+// call the other programs with random data, and fail at FailureRate with a
+// custom program error and its logs.
+type MockSource struct {
+	options  MockOptions
+	programs [][]byte
+	rand     *rand.Rand
+
+	slot   uint64
+	offset int64
+	// carry is the fraction of a transaction left over from the last slot.
+	carry float64
+	// generated counts the transactions.
+	generated int
+}
+
+func NewMockSource(options MockOptions) (*MockSource, error) {
+	programs, err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &MockSource{
+		options:  options,
+		programs: programs,
+		rand:     rand.New(rand.NewSource(options.Seed)),
+		slot:     options.Slot,
+	}, nil
+}
+
+// done reports whether Count transactions were generated.
+func (s *MockSource) done() bool {
+	return s.options.Count > 0 && s.generated >= s.options.Count
+}
+
+// nextSlot returns the records of the next slot, stamped with now.
+func (s *MockSource) nextSlot(now time.Time) []*sarama.ConsumerMessage {
+	slot := s.slot
+	s.slot++
+	var records []*sarama.ConsumerMessage
+	add := func(update *proto.SubscribeUpdate) {
+		records = append(records, s.record(update, now))
+	}
+	status := func(slot uint64, level proto.CommitmentLevel) *proto.SubscribeUpdate {
+		parent := slot - 1
+		return &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Slot{Slot: &proto.SubscribeUpdateSlot{
+			Slot: slot, Parent: &parent, Status: level,
+		}}}
+	}
+
+	add(status(slot, proto.CommitmentLevel_PROCESSED))
+	transactions := s.options.TPS*mockSlotDuration.Seconds() + s.carry
+	count := int(transactions)
+	s.carry = transactions - float64(count)
+	if s.options.Count > 0 {
+		count = min(count, s.options.Count-s.generated)
+	}
+	for index := range count {
+		add(&proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{Transaction: &proto.SubscribeUpdateTransaction{
+			Slot: slot, Transaction: s.transaction(uint64(index)),
+		}}})
+	}
+	s.generated += count
+	height := slot - s.options.Slot + 1
+	add(&proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{BlockMeta: &proto.SubscribeUpdateBlockMeta{
+		Slot: slot, ParentSlot: slot - 1, Blockhash: base58.Encode(s.key()),
+		BlockTime:                &proto.UnixTimestamp{Timestamp: now.Unix()},
+		BlockHeight:              &proto.BlockHeight{BlockHeight: height},
+		ExecutedTransactionCount: uint64(count),
+	}}})
+	if slot > s.options.Slot {
+		add(status(slot-1, proto.CommitmentLevel_CONFIRMED))
+	}
+	if slot >= s.options.Slot+32 {
+		add(status(slot-32, proto.CommitmentLevel_FINALIZED))
+	}
+	return records
+}
+
+// record wraps update as grpc2kafka produces it.
+func (s *MockSource) record(update *proto.SubscribeUpdate, now time.Time) *sarama.ConsumerMessage {
+	update.CreatedAt = timestamppb.New(now)
+	payload, _ := gproto.Marshal(update)
+	slot, _ := decode.UpdateSlot(update)
+	record := &sarama.ConsumerMessage{
+		Topic:     s.options.Topic,
+		Offset:    s.offset,
+		Timestamp: now,
+		Key:       fmt.Appendf(nil, "%d_%x", slot, sha256.Sum256(payload)),
+		Value:     payload,
+	}
+	s.offset++
+	for _, header := range decode.UpdateHeaders(update, "processed", "mock") {
+		record.Headers = append(record.Headers, &header)
+	}
+	return record
+}
+
+func (s *MockSource) key() []byte {
+	key := make([]byte, 32)
+	s.rand.Read(key)
+	return key
+}
+
+// transaction returns a transaction signed by a random fee payer, with one
+// instruction of a random program.
+func (s *MockSource) transaction(index uint64) *proto.SubscribeUpdateTransactionInfo {
+	signature := make([]byte, 64)
+	s.rand.Read(signature)
+	payer, destination := s.key(), s.key()
+	program := s.programs[s.rand.Intn(len(s.programs))]
+	vote := s.rand.Float64() < s.options.VoteRate
+	if vote {
+		program, _ = base58.Decode(decode.VoteProgramID)
+	}
+	failed := !vote && s.rand.Float64() < s.options.FailureRate
+
+	balance := 1_000_000_000 + uint64(s.rand.Int63n(9_000_000_000))
+	fee := uint64(5000)
+	var amount uint64
+	var data []byte
+	switch base58.Encode(program) {
+	case decode.SystemProgramID:
+		amount = 1 + uint64(s.rand.Int63n(int64(balance/2)))
+		data = binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint32(nil, decode.SystemTransfer), amount)
+	case decode.TokenProgramID, decode.Token2022ProgramID:
+		// a Token Program transfer
+		data = binary.LittleEndian.AppendUint64([]byte{3}, 1+uint64(s.rand.Int63n(1_000_000_000)))
+	default:
+		data = make([]byte, 8+s.rand.Intn(24))
+		s.rand.Read(data)
+	}
+
+	programKey := base58.Encode(program)
+	meta := &proto.TransactionStatusMeta{
+		Fee:         fee,
+		PreBalances: []uint64{balance, 0, 1},
+		// a failed transaction still pays its fee
+		PostBalances: []uint64{balance - fee, 0, 1},
+		LogMessages:  []string{"Program " + programKey + " invoke [1]"},
+	}
+	units := 150 + uint64(s.rand.Intn(200_000))
+	meta.ComputeUnitsConsumed = &units
+	if failed {
+		// InstructionError(0, Custom(1))
+		meta.Err = &proto.TransactionError{Err: []byte{8, 0, 0, 0, 0, 25, 0, 0, 0, 1, 0, 0, 0}}
+		meta.LogMessages = append(meta.LogMessages,
+			fmt.Sprintf("Program %s consumed %d of 200000 compute units", programKey, units),
+			"Program "+programKey+" failed: custom program error: 0x1")
+	} else {
+		meta.PostBalances[0] -= amount
+		meta.PostBalances[1] += amount
+		meta.LogMessages = append(meta.LogMessages,
+			fmt.Sprintf("Program %s consumed %d of 200000 compute units", programKey, units),
+			"Program "+programKey+" success")
+	}
+
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature: signature,
+		IsVote:    vote,
+		Index:     index,
+		Transaction: &proto.Transaction{
+			Signatures: [][]byte{signature},
+			Message: &proto.Message{
+				Header:          &proto.MessageHeader{NumRequiredSignatures: 1, NumReadonlyUnsignedAccounts: 1},
+				AccountKeys:     [][]byte{payer, destination, program},
+				RecentBlockhash: s.key(),
+				Instructions:    []*proto.CompiledInstruction{{ProgramIdIndex: 2, Accounts: []byte{0, 1}, Data: data}},
+			},
+		},
+		Meta: meta,
+	}
+}
+
+// Run feeds the records through replay every slot until Count transactions
+// were generated or ctx is cancelled, then flushes the sink.
+func (s *MockSource) Run(ctx context.Context, replay *CaptureReplay) (captureReplayStats, error) {
+	var stats captureReplayStats
+	ticker := time.NewTicker(mockSlotDuration)
+	defer ticker.Stop()
+	for {
+		for _, record := range s.nextSlot(time.Now()) {
+			stats.Read++
+			replay.replay(ctx, record, &stats)
+		}
+		if s.done() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return stats, replay.sink.Flush(context.Background())
+		case <-ticker.C:
+		}
+	}
+	return stats, replay.sink.Flush(ctx)
+}
+
+func runMock(fs *flag.FlagSet, args []string) {
+	options := RegisterMockFlags(fs)
+	config := loadConfig(fs, args)
+	defer logging.Logger.Sync()
+	// set when the sink failed, to exit with a failure status once it was
+	// closed
+	var failed bool
+	defer func() {
+		if failed {
+			logging.Logger.Sync()
+			os.Exit(1)
+		}
+	}()
+	options.Topic = mockTopic(config.Kafka)
+	source, err := NewMockSource(*options)
+	if err != nil {
+		logging.Logger.Fatal("invalid flags", zap.Error(err))
+	}
+
+	decode.DefaultIDLDecoder, err = decode.LoadIDLs(context.Background(), config.Decoding.IDL)
+	if err != nil {
+		logging.Logger.Fatal("failed to load idls", zap.Error(err))
+	}
+	// the records are SubscribeUpdate messages whatever the topics carry
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate), Sample: config.Decoding.Sample})
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	filter, err := filter.New(config.Filter)
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	if config.Prometheus != "" {
+		if err := RunMetricsServer(config.Prometheus, nil); err != nil {
+			logging.Logger.Fatal("failed to start prometheus server", zap.Error(err))
+		}
+	}
+	sink, err := sink.NewRouted(context.Background(), config.Sink, config.Routes)
+	if err != nil {
+		logging.Logger.Fatal("failed to create sink", zap.Error(err))
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			logging.Logger.Error("failed to close sink", zap.Error(err))
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	logging.Logger.Info("mock source is running",
+		zap.Float64("tps", options.TPS),
+		zap.Strings("programs", splitList(options.Programs)),
+		zap.Float64("failure_rate", options.FailureRate))
+	stats, err := source.Run(ctx, NewCaptureReplay(decoder, filter, sink, config.Retry))
+	fields := []zap.Field{
+		zap.Int("transactions", source.generated),
+		zap.Int("records", stats.Read),
+		zap.Int("filtered", stats.Filtered),
+		zap.Int("written", stats.Written),
+		zap.Int("failed", stats.Failed),
+	}
+	if err != nil {
+		logging.Logger.Error("mock source failed", append(fields, zap.Error(err))...)
+		failed = true
+		return
+	}
+	logging.Logger.Info("mock source stopped", fields...)
+}
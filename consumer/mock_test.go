@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"consumer/internal/sinktest"
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/proto"
+)
+
+func TestMockSource(t *testing.T) {
+	options := MockOptions{TPS: 10, Programs: decode.SystemProgramID, FailureRate: 0.5, Count: 10, Seed: 7, Slot: 100, Topic: "updates"}
+	source, err := NewMockSource(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []decode.UpdateKind
+	var failed, transfers int
+	now := time.Now()
+	for slot := 0; !source.done(); slot++ {
+		for _, record := range source.nextSlot(now) {
+			msg, err := decoder.Decode(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if slot == 1 {
+				kinds = append(kinds, msg.Kind())
+			}
+			info := msg.Update.GetTransaction().GetTransaction()
+			if info == nil {
+				continue
+			}
+			if meta := info.GetMeta(); meta.GetErr() != nil {
+				failed++
+				if _, err := decode.DecodeTransactionError(meta.GetErr().GetErr()); err != nil {
+					t.Fatal(err)
+				}
+			} else if len(decode.DecodeSystemInstructions(info)) == 1 {
+				transfers++
+			}
+		}
+	}
+	// 4 transactions a slot, the last slot cut short by Count
+	want := []decode.UpdateKind{decode.KindSlot, decode.KindTransaction, decode.KindTransaction, decode.KindTransaction, decode.KindTransaction, decode.KindBlockMeta, decode.KindSlot}
+	if !reflect.DeepEqual(kinds, want) || source.generated != 10 || source.slot != 103 {
+		t.Fatalf("kinds %v, %d transactions up to slot %d", kinds, source.generated, source.slot)
+	}
+	if failed == 0 || failed+transfers != 10 {
+		t.Fatalf("%d failed, %d transfers", failed, transfers)
+	}
+
+	// the same seed generates the same records
+	a, _ := NewMockSource(options)
+	b, _ := NewMockSource(options)
+	if !reflect.DeepEqual(a.nextSlot(now), b.nextSlot(now)) {
+		t.Fatal("a seed generated different records")
+	}
+}
+
+func TestMockSourceRun(t *testing.T) {
+	source, err := NewMockSource(MockOptions{TPS: 20, Programs: decode.TokenProgramID, FailureRate: 1, Count: 8, Seed: 1, Slot: 5, Topic: "updates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := filter.New(filter.Config{ExcludeFailed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.RecordSink{}
+	stats, err := source.Run(context.Background(), NewCaptureReplay(decoder, filter, sink, consumer.RetryConfig{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one slot of 8 failed transactions, its slot and block meta
+	if stats != (captureReplayStats{Read: 10, Filtered: 8, Written: 2}) {
+		t.Fatalf("stats %+v", stats)
+	}
+	if msg := sink.Written[0]; msg.Slot != 5 || msg.Headers[decode.HeaderSource] != "mock" || msg.Update.GetSlot().GetStatus() != proto.CommitmentLevel_PROCESSED {
+		t.Fatalf("written %+v", msg)
+	}
+}
+
+func TestMockFlags(t *testing.T) {
+	// the flags share the flag set with the config overrides
+	fs := flag.NewFlagSet("mock", flag.ContinueOnError)
+	options := RegisterMockFlags(fs)
+	RegisterOverrides(fs)
+	if err := fs.Parse([]string{"--tps", "250", "--failure-rate", "0.2", "--seed", "9"}); err != nil {
+		t.Fatal(err)
+	}
+	if options.TPS != 250 || options.FailureRate != 0.2 || options.Seed != 9 || options.Programs == "" {
+		t.Fatalf("options %+v", options)
+	}
+}
+
+func TestMockOptionsValidate(t *testing.T) {
+	for _, options := range []MockOptions{
+		{TPS: 0, Programs: decode.SystemProgramID},
+		{TPS: 1, Programs: decode.SystemProgramID, FailureRate: 2},
+		{TPS: 1, Programs: "not a key"},
+	} {
+		if _, err := NewMockSource(options); err == nil || !strings.HasPrefix(err.Error(), "--") {
+			t.Errorf("%+v: got %v", options, err)
+		}
+	}
+}
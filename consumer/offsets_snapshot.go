@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/logging"
+)
+
+// Actions of the offsets command.
+const (
+	offsetsExport = "export"
+	offsetsImport = "import"
+)
+
+// offsetSnapshot is the file of the offsets command.
+type offsetSnapshot struct {
+	Group      string    `json:"group"`
+	ExportedAt time.Time `json:"exported_at"`
+	// Offsets are the next offsets to consume by topic and partition.
+	Offsets map[string]map[int32]int64 `json:"offsets"`
+}
+
+// runOffsets exports the committed offsets of kafka.group_id to a file, or
+// imports such a file into the group.
+func runOffsets(fs *flag.FlagSet, args []string) {
+	if len(args) == 0 || args[0] != offsetsExport && args[0] != offsetsImport {
+		fmt.Fprintf(os.Stderr, "Usage: %s offsets export|import [flags]\n", binaryName())
+		os.Exit(2)
+	}
+	action := args[0]
+	file := fs.String("file", "-", "JSON file of the offsets, - for stdout or stdin")
+	dryRun := fs.Bool("dry-run", false, "import: log the offsets without committing them")
+	config := loadConfig(fs, args[1:])
+	defer logging.Logger.Sync()
+
+	saramaConfig, err := config.Kafka.Sarama()
+	if err != nil {
+		logging.Logger.Fatal("invalid config", zap.Error(err))
+	}
+	client, err := sarama.NewClient(config.Kafka.Brokers, saramaConfig)
+	if err != nil {
+		logging.Logger.Fatal("failed to create kafka client", zap.Error(err))
+	}
+	defer client.Close()
+
+	if action == offsetsExport {
+		snapshot, err := exportOffsets(client, config.Kafka.GroupID, time.Now())
+		if err == nil {
+			err = writeSnapshot(*file, snapshot)
+		}
+		if err != nil {
+			logging.Logger.Fatal("failed to export offsets", zap.Error(err))
+		}
+		logging.Logger.Info("offsets exported", zap.String("group_id", snapshot.Group), zap.Int("topics", len(snapshot.Offsets)))
+		return
+	}
+
+	snapshot, err := readSnapshot(*file)
+	if err == nil {
+		err = importOffsets(client, config.Kafka.GroupID, snapshot, *dryRun)
+	}
+	if err != nil {
+		logging.Logger.Fatal("failed to import offsets", zap.Error(err))
+	}
+}
+
+// exportOffsets returns the offsets group committed on every partition.
+func exportOffsets(client sarama.Client, group string, now time.Time) (*offsetSnapshot, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	// from version 2 no partitions fetch those of every topic
+	request := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 2}
+	request.ZeroPartitions()
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return nil, err
+	}
+	if !errors.Is(response.Err, sarama.ErrNoError) {
+		return nil, response.Err
+	}
+	snapshot := &offsetSnapshot{Group: group, ExportedAt: now.UTC(), Offsets: make(map[string]map[int32]int64)}
+	for topic, blocks := range response.Blocks {
+		for partition, block := range blocks {
+			if !errors.Is(block.Err, sarama.ErrNoError) {
+				return nil, fmt.Errorf("%s/%d: %w", topic, partition, block.Err)
+			}
+			// nothing committed
+			if block.Offset < 0 {
+				continue
+			}
+			if snapshot.Offsets[topic] == nil {
+				snapshot.Offsets[topic] = make(map[int32]int64)
+			}
+			snapshot.Offsets[topic][partition] = block.Offset
+		}
+	}
+	return snapshot, nil
+}
+
+// importOffsets commits the offsets of snapshot to group, clamped to the
+// retained range. Partitions that no longer exist are skipped.
+func importOffsets(client sarama.Client, group string, snapshot *offsetSnapshot, dryRun bool) error {
+	if snapshot.Group != group {
+		logging.Logger.Info("importing the offsets of another group",
+			zap.String("from", snapshot.Group), zap.String("group_id", group))
+	}
+	offsets := make(map[string]map[int32]int64)
+	for _, topic := range slices.Sorted(maps.Keys(snapshot.Offsets)) {
+		partitions, err := client.Partitions(topic)
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			logging.Logger.Warn("skipping a topic that does not exist", zap.String("topic", topic))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", topic, err)
+		}
+		for partition, offset := range snapshot.Offsets[topic] {
+			if !slices.Contains(partitions, partition) {
+				logging.Logger.Warn("skipping a partition that does not exist", zap.String("topic", topic), zap.Int32("partition", partition))
+				continue
+			}
+			oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				return fmt.Errorf("%s/%d: %w", topic, partition, err)
+			}
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return fmt.Errorf("%s/%d: %w", topic, partition, err)
+			}
+			if clamped := min(max(offset, oldest), newest); clamped != offset {
+				logging.Logger.Warn("offset out of the retained range, clamped",
+					zap.String("topic", topic), zap.Int32("partition", partition),
+					zap.Int64("offset", offset), zap.Int64("clamped", clamped))
+				offset = clamped
+			}
+			if offsets[topic] == nil {
+				offsets[topic] = make(map[int32]int64)
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+	if dryRun {
+		for topic, partitions := range offsets {
+			for partition, offset := range partitions {
+				logging.Logger.Info("would reset group offset",
+					zap.String("topic", topic), zap.Int32("partition", partition), zap.Int64("offset", offset))
+			}
+		}
+		return nil
+	}
+	return consumer.CommitOffsets(client, group, offsets)
+}
+
+func writeSnapshot(path string, snapshot *offsetSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func readSnapshot(path string) (*offsetSnapshot, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &offsetSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// committedOffsets returns the offsets of the commit requests broker received.
+func committedOffsets(t *testing.T, broker *sarama.MockBroker) map[int32]int64 {
+	t.Helper()
+	offsets := make(map[int32]int64)
+	for _, rr := range broker.History() {
+		request, ok := rr.Request.(*sarama.OffsetCommitRequest)
+		if !ok {
+			continue
+		}
+		for _, partition := range []int32{0, 1} {
+			if offset, _, err := request.Offset("updates", partition); err == nil {
+				offsets[partition] = offset
+			}
+		}
+	}
+	return offsets
+}
+
+func TestExportOffsets(t *testing.T) {
+	broker := seekBroker(t, 50, sarama.NewMockOffsetCommitResponse(t))
+	defer broker.Close()
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	snapshot, err := exportOffsets(client, "group", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// updates/1 has no committed offset
+	if snapshot.Group != "group" || !snapshot.ExportedAt.Equal(now) || len(snapshot.Offsets) != 1 ||
+		!maps.Equal(snapshot.Offsets["updates"], map[int32]int64{0: 50}) {
+		t.Fatalf("snapshot %+v", snapshot)
+	}
+
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	if err := writeSnapshot(path, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Group != "group" || !read.ExportedAt.Equal(now) || !maps.Equal(read.Offsets["updates"], snapshot.Offsets["updates"]) {
+		t.Fatalf("read %+v", read)
+	}
+}
+
+func TestImportOffsets(t *testing.T) {
+	snapshot := &offsetSnapshot{
+		Group: "other",
+		Offsets: map[string]map[int32]int64{
+			"updates": {0: 500, 1: 30, 7: 10},
+			"deleted": {0: 10},
+		},
+	}
+	for _, dryRun := range []bool{true, false} {
+		broker := seekBroker(t, 50, sarama.NewMockOffsetCommitResponse(t))
+		client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := importOffsets(client, "group", snapshot, dryRun); err != nil {
+			t.Fatal(err)
+		}
+		got := committedOffsets(t, broker)
+		client.Close()
+		broker.Close()
+
+		want := map[int32]int64{0: 100, 1: 30}
+		if dryRun {
+			want = map[int32]int64{}
+		}
+		if !maps.Equal(got, want) {
+			t.Fatalf("dry run %t: committed %v, want %v", dryRun, got, want)
+		}
+	}
+}
@@ -0,0 +1,1178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/duration"
+)
+
+// setting binds a config field to a command line flag and an environment
+// variable. Values are applied over the config file in the order
+// environment, then flag, so a flag always wins.
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	apply  func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{
+		flag:  "log-level",
+		env:   "LOG_LEVEL",
+		usage: "log level: debug, info, warn or error",
+		apply: func(c *Config, v string) error {
+			c.Log.Level = v
+			return nil
+		},
+	},
+	{
+		flag:  "log-format",
+		env:   "LOG_FORMAT",
+		usage: "log format: console or json",
+		apply: func(c *Config, v string) error {
+			c.Log.Format = v
+			return nil
+		},
+	},
+	{
+		flag:  "prometheus",
+		env:   "PROMETHEUS_ADDRESS",
+		usage: "prometheus listen address",
+		apply: func(c *Config, v string) error {
+			c.Prometheus = v
+			return nil
+		},
+	},
+	{
+		flag:  "admin",
+		env:   "ADMIN_ADDRESS",
+		usage: "listen address of the admin API",
+		apply: func(c *Config, v string) error {
+			c.Admin.Address = v
+			return nil
+		},
+	},
+	{
+		flag:  "admin-token",
+		env:   "ADMIN_TOKEN",
+		usage: "bearer token of the admin API",
+		apply: func(c *Config, v string) error {
+			c.Admin.Token = v
+			return nil
+		},
+	},
+	{
+		flag:   "admin-pprof",
+		env:    "ADMIN_PPROF",
+		usage:  "serve pprof and the Go runtime metrics on the admin API",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Admin.Pprof, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "websocket",
+		env:   "WEBSOCKET_ADDRESS",
+		usage: "listen address of the WebSocket server broadcasting the written updates",
+		apply: func(c *Config, v string) error {
+			c.WebSocket.Address = v
+			return nil
+		},
+	},
+	{
+		flag:  "graphql",
+		env:   "GRAPHQL_ADDRESS",
+		usage: "listen address of the GraphQL server streaming the written updates to subscriptions",
+		apply: func(c *Config, v string) error {
+			c.GraphQL.Address = v
+			return nil
+		},
+	},
+	{
+		flag:  "query",
+		env:   "QUERY_ADDRESS",
+		usage: "listen address of the REST API serving the transactions of the newest slots",
+		apply: func(c *Config, v string) error {
+			c.Query.Address = v
+			return nil
+		},
+	},
+	{
+		flag:  "geyser-server",
+		env:   "GEYSER_SERVER_ADDRESS",
+		usage: "listen address of the Yellowstone gRPC server streaming the written updates",
+		apply: func(c *Config, v string) error {
+			c.GeyserServer.Address = v
+			return nil
+		},
+	},
+	{
+		flag:   "tracing",
+		env:    "TRACING_ENABLE",
+		usage:  "export OpenTelemetry traces over OTLP",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Tracing.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "tracing-endpoint",
+		env:   "TRACING_ENDPOINT",
+		usage: "OTLP collector host:port",
+		apply: func(c *Config, v string) error {
+			c.Tracing.Endpoint = v
+			return nil
+		},
+	},
+	{
+		flag:  "brokers",
+		env:   "KAFKA_BROKERS",
+		usage: "comma-separated bootstrap brokers",
+		apply: func(c *Config, v string) error {
+			c.Kafka.Brokers = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "topic",
+		env:   "KAFKA_TOPIC",
+		usage: "comma-separated topics to consume",
+		apply: func(c *Config, v string) error {
+			c.Kafka.Topics = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "group-id",
+		env:   "KAFKA_GROUP_ID",
+		usage: "consumer group id",
+		apply: func(c *Config, v string) error {
+			c.Kafka.GroupID = v
+			return nil
+		},
+	},
+	{
+		flag:  "topic-pattern",
+		env:   "KAFKA_TOPIC_PATTERN",
+		usage: "also consume the topics whose whole name matches the regular expression, looked up again every kafka.topic_refresh",
+		apply: func(c *Config, v string) error {
+			c.Kafka.TopicPattern = v
+			return nil
+		},
+	},
+	{
+		flag:  "offset-reset",
+		env:   "KAFKA_OFFSET_RESET",
+		usage: "where to start without committed offsets: earliest or latest",
+		apply: func(c *Config, v string) error {
+			c.Kafka.OffsetReset = v
+			return nil
+		},
+	},
+	{
+		flag:  "offset-out-of-range",
+		env:   "KAFKA_OFFSET_OUT_OF_RANGE",
+		usage: "where to start when the committed offset is no longer retained: earliest, latest or fail",
+		apply: func(c *Config, v string) error {
+			c.Kafka.OffsetOutOfRange = v
+			return nil
+		},
+	},
+	{
+		flag:  "commit-interval",
+		env:   "KAFKA_COMMIT_INTERVAL",
+		usage: "interval between offset commits, such as 1s",
+		apply: func(c *Config, v string) error {
+			return c.Kafka.Commit.Interval.UnmarshalText([]byte(v))
+		},
+	},
+	{
+		flag:  "commit-messages",
+		env:   "KAFKA_COMMIT_MESSAGES",
+		usage: "commit once that many messages were written since the last commit, 0 on the interval only",
+		apply: func(c *Config, v string) (err error) {
+			c.Kafka.Commit.Messages, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:  "balance-strategy",
+		env:   "KAFKA_BALANCE_STRATEGY",
+		usage: "partition assignment of the group: roundrobin, range or sticky",
+		apply: func(c *Config, v string) error {
+			c.Kafka.BalanceStrategy = v
+			return nil
+		},
+	},
+	{
+		flag:  "instance-id",
+		env:   "KAFKA_INSTANCE_ID",
+		usage: "static group member id, {hostname} is replaced by the host name",
+		apply: func(c *Config, v string) error {
+			c.Kafka.InstanceID = v
+			return nil
+		},
+	},
+	{
+		flag:  "isolation-level",
+		env:   "KAFKA_ISOLATION_LEVEL",
+		usage: "read_uncommitted, or read_committed to skip the records of aborted transactions",
+		apply: func(c *Config, v string) error {
+			c.Kafka.IsolationLevel = v
+			return nil
+		},
+	},
+	{
+		flag:  "kafka-client",
+		env:   "KAFKA_CLIENT",
+		usage: "client consuming the group: sarama or franz-go",
+		apply: func(c *Config, v string) error {
+			c.Kafka.Client = v
+			return nil
+		},
+	},
+	{
+		flag:  "max-lag-exit",
+		env:   "LAG_MAX_EXIT",
+		usage: "exit with a failure status once the lag summed over the partitions stayed above this many messages for lag.exit_after, 0 disables",
+		apply: func(c *Config, v string) (err error) {
+			c.Lag.MaxExit, err = strconv.ParseInt(v, 10, 64)
+			return err
+		},
+	},
+	{
+		flag:  "failover-brokers",
+		env:   "FAILOVER_BROKERS",
+		usage: "comma-separated brokers of the secondary cluster consumed while the primary stops progressing",
+		apply: func(c *Config, v string) error {
+			c.Failover.Brokers = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "producer-compression",
+		env:   "KAFKA_PRODUCER_COMPRESSION",
+		usage: "compression of the produced records: none, gzip, snappy, lz4 or zstd",
+		apply: func(c *Config, v string) error {
+			c.Kafka.Producer.Compression = v
+			return nil
+		},
+	},
+	{
+		flag:  "sasl-mechanism",
+		env:   "KAFKA_SASL_MECHANISM",
+		usage: "SASL mechanism: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or AWS_MSK_IAM",
+		apply: func(c *Config, v string) error {
+			c.Kafka.SASL.Mechanism = v
+			return nil
+		},
+	},
+	{
+		flag:  "sasl-username",
+		env:   "KAFKA_SASL_USERNAME",
+		usage: "SASL username",
+		apply: func(c *Config, v string) error {
+			c.Kafka.SASL.Username = v
+			return nil
+		},
+	},
+	{
+		flag:  "sasl-password",
+		env:   "KAFKA_SASL_PASSWORD",
+		usage: "SASL password",
+		apply: func(c *Config, v string) error {
+			c.Kafka.SASL.Password = v
+			return nil
+		},
+	},
+	{
+		flag:  "sasl-aws-region",
+		env:   "KAFKA_SASL_AWS_REGION",
+		usage: "AWS region of the MSK cluster for AWS_MSK_IAM",
+		apply: func(c *Config, v string) error {
+			c.Kafka.SASL.AWSRegion = v
+			return nil
+		},
+	},
+	{
+		flag:  "sasl-aws-role-arn",
+		env:   "KAFKA_SASL_AWS_ROLE_ARN",
+		usage: "IAM role assumed for AWS_MSK_IAM instead of the default credentials",
+		apply: func(c *Config, v string) error {
+			c.Kafka.SASL.AWSRoleARN = v
+			return nil
+		},
+	},
+	{
+		flag:   "tls",
+		env:    "KAFKA_TLS",
+		usage:  "connect to the brokers over TLS",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Kafka.TLS.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "tls-ca-file",
+		env:   "KAFKA_TLS_CA_FILE",
+		usage: "CA bundle used to verify the brokers",
+		apply: func(c *Config, v string) error {
+			c.Kafka.TLS.CAFile = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-cert-file",
+		env:   "KAFKA_TLS_CERT_FILE",
+		usage: "client certificate for mutual TLS",
+		apply: func(c *Config, v string) error {
+			c.Kafka.TLS.CertFile = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-key-file",
+		env:   "KAFKA_TLS_KEY_FILE",
+		usage: "client private key for mutual TLS",
+		apply: func(c *Config, v string) error {
+			c.Kafka.TLS.KeyFile = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-server-name",
+		env:   "KAFKA_TLS_SERVER_NAME",
+		usage: "override the server name verified in broker certificates",
+		apply: func(c *Config, v string) error {
+			c.Kafka.TLS.ServerName = v
+			return nil
+		},
+	},
+	{
+		flag:   "tls-insecure-skip-verify",
+		env:    "KAFKA_TLS_INSECURE_SKIP_VERIFY",
+		usage:  "do not verify broker certificates",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Kafka.TLS.InsecureSkipVerify, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "dlq-topic",
+		env:   "KAFKA_DLQ_TOPIC",
+		usage: "dead-letter topic for messages that fail to decode or sink",
+		apply: func(c *Config, v string) error {
+			c.DLQ.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "kind",
+		env:   "DECODING_KIND",
+		usage: "payload type of the topics",
+		apply: func(c *Config, v string) error {
+			c.Decoding.Kind = v
+			return nil
+		},
+	},
+	{
+		flag:   "infer-kind",
+		env:    "DECODING_INFER_KIND",
+		usage:  "take the payload type of unmapped topics from their name",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Decoding.InferKind, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:   "discard-unknown",
+		env:    "DECODING_DISCARD_UNKNOWN",
+		usage:  "drop unknown protobuf fields",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Decoding.DiscardUnknown, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:   "reuse-messages",
+		env:    "DECODING_REUSE_MESSAGES",
+		usage:  "recycle the decoded messages once written",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Decoding.ReuseMessages, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:   "lazy-decoding",
+		env:    "DECODING_LAZY",
+		usage:  "decode transactions for the filter without their logs and balances first",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Decoding.Lazy, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "sample",
+		env:   "DECODING_SAMPLE",
+		usage: "keep 1 of that many transactions, chosen by signature",
+		apply: func(c *Config, v string) (err error) {
+			c.Decoding.Sample, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:  "idl-dir",
+		env:   "DECODING_IDL_DIR",
+		usage: "directory of Anchor IDL files to decode instructions with",
+		apply: func(c *Config, v string) error {
+			c.Decoding.IDL.Dir = v
+			return nil
+		},
+	},
+	{
+		flag:  "lookup-tables-rpc-url",
+		env:   "DECODING_LOOKUP_TABLES_RPC_URL",
+		usage: "Solana RPC endpoint the address lookup tables of transactions are resolved with",
+		apply: func(c *Config, v string) error {
+			c.Decoding.LookupTables.RPCURL = v
+			return nil
+		},
+	},
+	{
+		flag:  "format",
+		env:   "DECODING_FORMAT",
+		usage: "protobuf, json or avro payloads",
+		apply: func(c *Config, v string) error {
+			c.Decoding.Format = v
+			return nil
+		},
+	},
+	{
+		flag:  "wire-format",
+		env:   "DECODING_WIRE_FORMAT",
+		usage: "auto, raw or confluent for payloads with the Schema Registry header",
+		apply: func(c *Config, v string) error {
+			c.Decoding.WireFormat = v
+			return nil
+		},
+	},
+	{
+		flag:  "schema-registry-url",
+		env:   "DECODING_SCHEMA_REGISTRY_URL",
+		usage: "Confluent Schema Registry the schema ids of the payloads are checked with",
+		apply: func(c *Config, v string) error {
+			c.Decoding.SchemaRegistry.URL = v
+			return nil
+		},
+	},
+	{
+		flag:  "workers",
+		env:   "PROCESSING_WORKERS",
+		usage: "workers per claimed partition",
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.Workers, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:  "ordering-key",
+		env:   "PROCESSING_ORDERING_KEY",
+		usage: "messages kept in order across workers: key, slot or none",
+		apply: func(c *Config, v string) error {
+			c.Processing.OrderingKey = v
+			return nil
+		},
+	},
+	{
+		flag:   "signature-dedup",
+		env:    "PROCESSING_SIGNATURE_DEDUP_ENABLE",
+		usage:  "write every transaction signature once per commitment",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.SignatureDedup.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "max-messages-per-second",
+		env:   "PROCESSING_THROTTLE_MESSAGES_PER_SECOND",
+		usage: "messages dispatched per second at most, 0 for no limit",
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.Throttle.MessagesPerSecond, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:  "max-bytes-per-second",
+		env:   "PROCESSING_THROTTLE_BYTES_PER_SECOND",
+		usage: "payload bytes dispatched per second at most, 0 for no limit",
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.Throttle.BytesPerSecond, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:  "max-inflight",
+		env:   "PROCESSING_THROTTLE_MAX_INFLIGHT",
+		usage: "messages dispatched and not yet acknowledged by the sink at most, 0 for no limit",
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.Throttle.MaxInflight, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:   "reorder",
+		env:    "PROCESSING_REORDER_ENABLE",
+		usage:  "write updates to the sink in slot order",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.Reorder.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:   "blocks",
+		env:    "PROCESSING_BLOCKS_ENABLE",
+		usage:  "assemble the transactions and block metas of every slot into a block",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.Blocks.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:   "account-diff",
+		env:    "PROCESSING_ACCOUNT_DIFF_ENABLE",
+		usage:  "drop the account updates leaving the data of the account unchanged",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Processing.AccountDiff.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "commitment",
+		env:   "PROCESSING_COMMITMENT_LEVEL",
+		usage: "slot commitment required before writing updates: processed, confirmed or finalized",
+		apply: func(c *Config, v string) error {
+			c.Processing.Commitment.Level = v
+			return nil
+		},
+	},
+	{
+		flag:  "retry-max-attempts",
+		env:   "RETRY_MAX_ATTEMPTS",
+		usage: "sink write attempts per message, 1 disables retries",
+		apply: func(c *Config, v string) (err error) {
+			c.Retry.MaxAttempts, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		flag:  "retry-on-exhausted",
+		env:   "RETRY_ON_EXHAUSTED",
+		usage: "action once retries are exhausted: crash, dlq or skip",
+		apply: func(c *Config, v string) error {
+			c.Retry.OnExhausted = v
+			return nil
+		},
+	},
+	{
+		flag:  "retry-topics",
+		env:   "RETRY_TOPICS_DELAYS",
+		usage: "comma-separated delays of the retry topics such as 5s,1m,10m, consumed as <topic>.retry.<delay>",
+		apply: func(c *Config, v string) error {
+			c.Retry.Topics.Delays = nil
+			for _, delay := range splitList(v) {
+				var d duration.Duration
+				if err := d.UnmarshalText([]byte(delay)); err != nil {
+					return err
+				}
+				c.Retry.Topics.Delays = append(c.Retry.Topics.Delays, d)
+			}
+			return nil
+		},
+	},
+	{
+		flag:  "program-include",
+		env:   "FILTER_PROGRAM_INCLUDE",
+		usage: "comma-separated program ids, keep only transactions invoking one of them",
+		apply: func(c *Config, v string) error {
+			c.Filter.ProgramInclude = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "program-exclude",
+		env:   "FILTER_PROGRAM_EXCLUDE",
+		usage: "comma-separated program ids, drop transactions invoking any of them",
+		apply: func(c *Config, v string) error {
+			c.Filter.ProgramExclude = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "account-include",
+		env:   "FILTER_ACCOUNT_INCLUDE",
+		usage: "comma-separated accounts, keep only transactions referencing one of them",
+		apply: func(c *Config, v string) error {
+			c.Filter.AccountInclude = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "account-exclude",
+		env:   "FILTER_ACCOUNT_EXCLUDE",
+		usage: "comma-separated accounts, drop transactions referencing any of them",
+		apply: func(c *Config, v string) error {
+			c.Filter.AccountExclude = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "event-include",
+		env:   "FILTER_EVENT_INCLUDE",
+		usage: "comma-separated IDL event names, keep only transactions emitting one of them",
+		apply: func(c *Config, v string) error {
+			c.Filter.EventInclude = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:   "exclude-vote",
+		env:    "FILTER_EXCLUDE_VOTE",
+		usage:  "drop vote transactions",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Filter.ExcludeVote, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:   "exclude-failed",
+		env:    "FILTER_EXCLUDE_FAILED",
+		usage:  "drop failed transactions",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Filter.ExcludeFailed, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "filter-expression",
+		env:   "FILTER_EXPRESSION",
+		usage: "CEL expression the transactions written must be true for",
+		apply: func(c *Config, v string) error {
+			c.Filter.Expression = v
+			return nil
+		},
+	},
+	{
+		flag:   "gaps",
+		env:    "GAPS_ENABLE",
+		usage:  "report runs of slots missing from the consumed topics",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Gaps.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "gaps-topic",
+		env:   "GAPS_TOPIC",
+		usage: "topic receiving a record for every slot gap",
+		apply: func(c *Config, v string) error {
+			c.Gaps.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "transfers-topic",
+		env:   "TRANSFERS_TOPIC",
+		usage: "topic receiving a record for every balance change of the written transactions",
+		apply: func(c *Config, v string) error {
+			c.Transfers.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:   "fees",
+		env:    "FEES_ENABLE",
+		usage:  "compute percentiles of the priority fees and compute units of the written transactions",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Fees.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "fees-topic",
+		env:   "FEES_TOPIC",
+		usage: "topic receiving the fee percentiles of every slot",
+		apply: func(c *Config, v string) error {
+			c.Fees.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:   "throughput",
+		env:    "THROUGHPUT_ENABLE",
+		usage:  "count the written transactions in windows by status and program",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.Throughput.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "throughput-topic",
+		env:   "THROUGHPUT_TOPIC",
+		usage: "topic receiving the transaction counts of every window",
+		apply: func(c *Config, v string) error {
+			c.Throughput.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:   "mev",
+		env:    "MEV_ENABLE",
+		usage:  "flag the likely Jito bundles and sandwiches among the written transactions",
+		isBool: true,
+		apply: func(c *Config, v string) (err error) {
+			c.MEV.Enable, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		flag:  "mev-topic",
+		env:   "MEV_TOPIC",
+		usage: "topic receiving a record for every likely bundle and sandwich",
+		apply: func(c *Config, v string) error {
+			c.MEV.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "throughput-window",
+		env:   "THROUGHPUT_WINDOW",
+		usage: "length of the windows transactions are counted in",
+		apply: func(c *Config, v string) error {
+			return c.Throughput.Window.UnmarshalText([]byte(v))
+		},
+	},
+	{
+		flag:  "swaps-topic",
+		env:   "SWAPS_TOPIC",
+		usage: "topic receiving a record for every DEX swap of the written transactions",
+		apply: func(c *Config, v string) error {
+			c.Swaps.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "mints-topic",
+		env:   "MINTS_TOPIC",
+		usage: "topic receiving a record for every token mint, metadata creation and compressed NFT mint of the written transactions",
+		apply: func(c *Config, v string) error {
+			c.Mints.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "slot-completion-topic",
+		env:   "SLOT_COMPLETION_TOPIC",
+		usage: "topic receiving a record once all the transactions of a slot were written",
+		apply: func(c *Config, v string) error {
+			c.SlotCompletion.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "rollback-action",
+		env:   "ROLLBACK_ACTION",
+		usage: "what the postgres, clickhouse, timescale or sqlite sink does with the rows of dead and skipped slots: none, delete or mark",
+		apply: func(c *Config, v string) error {
+			c.Rollback.Action = v
+			return nil
+		},
+	},
+	{
+		flag:  "sink",
+		env:   "SINK_TYPE",
+		usage: "sink type: stdout, postgres, clickhouse, parquet, webhook, redis, nats, elasticsearch, timescale, file, sqlite, mongodb, scylla, bigquery or arrow",
+		apply: func(c *Config, v string) error {
+			c.Sink.Type = v
+			return nil
+		},
+	},
+	{
+		flag:   "stdout",
+		env:    "SINK_STDOUT",
+		usage:  "print every message as a JSON line to stdout, the stdout sink with format ndjson",
+		isBool: true,
+		apply: func(c *Config, v string) error {
+			enable, err := strconv.ParseBool(v)
+			if err != nil || !enable {
+				return err
+			}
+			c.Sink.Type, c.Sink.Stdout.Format = "stdout", "ndjson"
+			return nil
+		},
+	},
+	{
+		flag:   "inspect",
+		env:    "SINK_INSPECT",
+		usage:  "print transactions for humans to stdout, the stdout sink with format inspect",
+		isBool: true,
+		apply: func(c *Config, v string) error {
+			enable, err := strconv.ParseBool(v)
+			if err != nil || !enable {
+				return err
+			}
+			c.Sink.Type, c.Sink.Stdout.Format = "stdout", "inspect"
+			return nil
+		},
+	},
+	{
+		flag:  "stdout-format",
+		env:   "SINK_STDOUT_FORMAT",
+		usage: "stdout sink format, json, rpc, ndjson, inspect or template",
+		apply: func(c *Config, v string) error {
+			c.Sink.Stdout.Format = v
+			return nil
+		},
+	},
+	{
+		flag:  "template",
+		env:   "SINK_STDOUT_TEMPLATE",
+		usage: "print every message as the line this Go template renders to stdout, the stdout sink with format template",
+		apply: func(c *Config, v string) error {
+			c.Sink.Type, c.Sink.Stdout.Format, c.Sink.Stdout.Template = "stdout", "template", v
+			return nil
+		},
+	},
+	{
+		flag:  "parquet-bucket",
+		env:   "SINK_PARQUET_BUCKET",
+		usage: "S3 bucket of the parquet sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Parquet.Bucket = v
+			return nil
+		},
+	},
+	{
+		flag:  "webhook-url",
+		env:   "SINK_WEBHOOK_URL",
+		usage: "URL the webhook sink posts to",
+		apply: func(c *Config, v string) error {
+			c.Sink.Webhook.URL = v
+			return nil
+		},
+	},
+	{
+		flag:  "webhook-secret",
+		env:   "SINK_WEBHOOK_SECRET",
+		usage: "secret signing the requests of the webhook sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Webhook.Secret = v
+			return nil
+		},
+	},
+	{
+		flag:  "redis-url",
+		env:   "SINK_REDIS_URL",
+		usage: "redis URL of the redis sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Redis.URL = v
+			return nil
+		},
+	},
+	{
+		flag:  "redis-mode",
+		env:   "SINK_REDIS_MODE",
+		usage: "redis sink mode, stream or pubsub",
+		apply: func(c *Config, v string) error {
+			c.Sink.Redis.Mode = v
+			return nil
+		},
+	},
+	{
+		flag:  "nats-url",
+		env:   "SINK_NATS_URL",
+		usage: "comma-separated servers of the nats sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.NATS.URL = v
+			return nil
+		},
+	},
+	{
+		flag:  "elasticsearch-url",
+		env:   "SINK_ELASTICSEARCH_URL",
+		usage: "cluster URL of the elasticsearch sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Elasticsearch.URL = v
+			return nil
+		},
+	},
+	{
+		flag:  "elasticsearch-api-key",
+		env:   "SINK_ELASTICSEARCH_API_KEY",
+		usage: "API key of the elasticsearch sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Elasticsearch.APIKey = v
+			return nil
+		},
+	},
+	{
+		flag:  "timescale-dsn",
+		env:   "SINK_TIMESCALE_DSN",
+		usage: "connection string of the timescale sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Timescale.DSN = v
+			return nil
+		},
+	},
+	{
+		flag:  "file-dir",
+		env:   "SINK_FILE_DIR",
+		usage: "directory of the file sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.File.Dir = v
+			return nil
+		},
+	},
+	{
+		flag:  "sqlite-path",
+		env:   "SINK_SQLITE_PATH",
+		usage: "database file of the sqlite sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.SQLite.Path = v
+			return nil
+		},
+	},
+	{
+		flag:  "mongodb-uri",
+		env:   "SINK_MONGODB_URI",
+		usage: "connection string of the mongodb sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.MongoDB.URI = v
+			return nil
+		},
+	},
+	{
+		flag:  "scylla-hosts",
+		env:   "SINK_SCYLLA_HOSTS",
+		usage: "comma-separated contact points of the scylla sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Scylla.Hosts = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "bigquery-project",
+		env:   "SINK_BIGQUERY_PROJECT",
+		usage: "Google Cloud project of the bigquery sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.BigQuery.Project = v
+			return nil
+		},
+	},
+	{
+		flag:  "arrow-dir",
+		env:   "SINK_ARROW_DIR",
+		usage: "directory of the arrow sink",
+		apply: func(c *Config, v string) error {
+			c.Sink.Arrow.Dir = v
+			return nil
+		},
+	},
+	{
+		flag:  "grpc-endpoints",
+		env:   "GRPC2KAFKA_ENDPOINTS",
+		usage: "comma-separated gRPC endpoints of grpc2kafka, tried in turn",
+		apply: func(c *Config, v string) error {
+			c.Grpc2Kafka.Endpoints = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "x-token",
+		env:   "GRPC2KAFKA_X_TOKEN",
+		usage: "x-token sent to the gRPC endpoints by grpc2kafka",
+		apply: func(c *Config, v string) error {
+			c.Grpc2Kafka.XToken = v
+			return nil
+		},
+	},
+	{
+		flag:  "produce-topic",
+		env:   "GRPC2KAFKA_TOPIC",
+		usage: "topic grpc2kafka produces to",
+		apply: func(c *Config, v string) error {
+			c.Grpc2Kafka.Topic = v
+			return nil
+		},
+	},
+	{
+		flag:  "dedup-inputs",
+		env:   "DEDUP_INPUTS",
+		usage: "comma-separated redundant topics merged by dedup",
+		apply: func(c *Config, v string) error {
+			c.Dedup.Inputs = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:  "dedup-output",
+		env:   "DEDUP_OUTPUT",
+		usage: "topic dedup produces to",
+		apply: func(c *Config, v string) error {
+			c.Dedup.Output = v
+			return nil
+		},
+	},
+	{
+		flag:  "dedup-transactional-id",
+		env:   "DEDUP_TRANSACTIONAL_ID",
+		usage: "produce the dedup output in transactions with this id, {hostname} is replaced by the host name",
+		apply: func(c *Config, v string) error {
+			c.Dedup.TransactionalID = v
+			return nil
+		},
+	},
+	{
+		flag:  "backfill",
+		env:   "BACKFILL_RANGES",
+		usage: "comma-separated topic:partition:start-end offset ranges consumed without a group, an empty end is the high water mark",
+		apply: func(c *Config, v string) error {
+			ranges, err := parseOffsetRanges(v)
+			if err != nil {
+				return err
+			}
+			c.Backfill.Ranges = ranges
+			return nil
+		},
+	},
+	{
+		flag:  "checkpoint",
+		env:   "BACKFILL_CHECKPOINT",
+		usage: "file the progress of a backfill is saved to",
+		apply: func(c *Config, v string) error {
+			c.Backfill.Checkpoint.Path = v
+			return nil
+		},
+	},
+	{
+		flag:  "postgres-dsn",
+		env:   "POSTGRES_DSN",
+		usage: "postgres connection string",
+		apply: func(c *Config, v string) error {
+			c.Sink.Postgres.DSN = v
+			return nil
+		},
+	},
+}
+
+// Overrides collects the settings given on the command line.
+type Overrides struct {
+	values []*overrideValue
+}
+
+// RegisterOverrides defines a flag on fs for every setting.
+func RegisterOverrides(fs *flag.FlagSet) *Overrides {
+	o := &Overrides{}
+	for i := range settings {
+		s := &settings[i]
+		v := &overrideValue{isBool: s.isBool}
+		fs.Var(v, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+		o.values = append(o.values, v)
+	}
+	return o
+}
+
+// Apply writes environment variables and then explicitly set flags into c.
+func (o *Overrides) Apply(c *Config) error {
+	for i, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.apply(c, value); err != nil {
+				return fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+		if v := o.values[i]; v.set {
+			if err := s.apply(c, v.value); err != nil {
+				return fmt.Errorf("--%s: %w", s.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+type overrideValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (v *overrideValue) String() string {
+	return v.value
+}
+
+func (v *overrideValue) Set(value string) error {
+	v.value, v.set = value, true
+	return nil
+}
+
+func (v *overrideValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseOffsetRanges parses topic:partition:start-end ranges separated by
+// commas, an empty end is the high water mark.
+func parseOffsetRanges(s string) ([]consumer.OffsetRange, error) {
+	var ranges []consumer.OffsetRange
+	for _, item := range splitList(s) {
+		fields := strings.Split(item, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected topic:partition:start-end, got %q", item)
+		}
+		start, end, ok := strings.Cut(fields[2], "-")
+		r := consumer.OffsetRange{Topic: fields[0]}
+		partition, perr := strconv.ParseInt(fields[1], 10, 32)
+		offset, serr := strconv.ParseInt(start, 10, 64)
+		r.Partition, r.Start = int32(partition), offset
+		var eerr error
+		if end != "" {
+			r.End, eerr = strconv.ParseInt(end, 10, 64)
+		}
+		if !ok || perr != nil || serr != nil || eerr != nil {
+			return nil, fmt.Errorf("expected topic:partition:start-end, got %q", item)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
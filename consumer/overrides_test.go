@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"consumer/pkg/consumer"
+)
+
+// TestOverridesPrecedence checks that the environment overrides the config
+// file and a flag overrides both.
+func TestOverridesPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := "kafka:\n  group_id: file-group\n  brokers: [file:9092]\nprocessing:\n  workers: 2\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		group   string
+		brokers []string
+		workers int
+	}{
+		{
+			name:    "file",
+			group:   "file-group",
+			brokers: []string{"file:9092"},
+			workers: 2,
+		},
+		{
+			name:    "env over file",
+			env:     map[string]string{"KAFKA_GROUP_ID": "env-group", "PROCESSING_WORKERS": "4"},
+			group:   "env-group",
+			brokers: []string{"file:9092"},
+			workers: 4,
+		},
+		{
+			name:    "flag over env",
+			env:     map[string]string{"KAFKA_GROUP_ID": "env-group", "KAFKA_BROKERS": "env:9092"},
+			args:    []string{"--group-id", "flag-group"},
+			group:   "flag-group",
+			brokers: []string{"env:9092"},
+			workers: 2,
+		},
+		{
+			name:    "flag over file",
+			args:    []string{"--workers", "8", "--brokers", "a:9092, b:9092"},
+			group:   "file-group",
+			brokers: []string{"a:9092", "b:9092"},
+			workers: 8,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"KAFKA_GROUP_ID", "KAFKA_BROKERS", "PROCESSING_WORKERS"} {
+				value, ok := tt.env[env]
+				t.Setenv(env, value)
+				if !ok {
+					os.Unsetenv(env)
+				}
+			}
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			overrides := RegisterOverrides(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := overrides.Apply(config); err != nil {
+				t.Fatal(err)
+			}
+			if config.Kafka.GroupID != tt.group || !slices.Equal(config.Kafka.Brokers, tt.brokers) || config.Processing.Workers != tt.workers {
+				t.Fatalf("group %q, brokers %v, workers %d", config.Kafka.GroupID, config.Kafka.Brokers, config.Processing.Workers)
+			}
+		})
+	}
+}
+
+func TestOverridesErrors(t *testing.T) {
+	t.Setenv("PROCESSING_WORKERS", "many")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := RegisterOverrides(fs)
+	if err := overrides.Apply(DefaultConfig()); err == nil || !strings.HasPrefix(err.Error(), "PROCESSING_WORKERS:") {
+		t.Fatalf("env: got %v", err)
+	}
+
+	os.Unsetenv("PROCESSING_WORKERS")
+	if err := fs.Parse([]string{"--workers", "many"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := overrides.Apply(DefaultConfig()); err == nil || !strings.HasPrefix(err.Error(), "--workers:") {
+		t.Fatalf("flag: got %v", err)
+	}
+}
+
+func TestOverridesStdout(t *testing.T) {
+	config := DefaultConfig()
+	config.Sink.Type = "postgres"
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := RegisterOverrides(fs)
+	if err := fs.Parse([]string{"--stdout"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := overrides.Apply(config); err != nil || config.Sink.Type != "stdout" || config.Sink.Stdout.Format != "ndjson" {
+		t.Fatalf("sink %+v, %v", config.Sink.Type, err)
+	}
+}
+
+func TestParseOffsetRanges(t *testing.T) {
+	ranges, err := parseOffsetRanges("updates:0:100-200, updates:1:50-")
+	if err != nil || len(ranges) != 2 ||
+		ranges[0] != (consumer.OffsetRange{Topic: "updates", Partition: 0, Start: 100, End: 200}) ||
+		ranges[1] != (consumer.OffsetRange{Topic: "updates", Partition: 1, Start: 50}) {
+		t.Fatalf("got %+v, %v", ranges, err)
+	}
+	for _, s := range []string{"updates:0:100", "updates:x:1-2", "updates:0:1-y", "0:1-2"} {
+		if _, err := parseOffsetRanges(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+
+	config := consumer.BackfillConfig{
+		Ranges:     []consumer.OffsetRange{{Topic: "updates", Start: 10, End: 20}},
+		Checkpoint: consumer.CheckpointConfig{Path: "backfill.json"},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []consumer.BackfillConfig{
+		{Ranges: []consumer.OffsetRange{{Topic: "updates", Start: 10, End: 10}}, Checkpoint: config.Checkpoint},
+		{Ranges: []consumer.OffsetRange{{Topic: "updates"}, {Topic: "updates", Start: 5}}, Checkpoint: config.Checkpoint},
+		{Ranges: config.Ranges},
+		{Ranges: config.Ranges, Checkpoint: consumer.CheckpointConfig{Path: "backfill.json", RedisURL: "redis://localhost"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v accepted", invalid)
+		}
+	}
+}
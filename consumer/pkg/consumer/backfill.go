@@ -0,0 +1,411 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"consumer/pkg/logging"
+)
+
+// BackfillConfig consumes explicit offset ranges of partitions without a
+// consumer group, for deterministic backfills. The progress is saved to the
+// checkpoint store on every kafka.commit instead of being committed to the
+// group, a backfill started again resumes where it stopped.
+type BackfillConfig struct {
+	// Ranges selects the backfill mode when not empty, the consumer exits
+	// once all of them were written.
+	Ranges     []OffsetRange    `json:"ranges" yaml:"ranges"`
+	Checkpoint CheckpointConfig `json:"checkpoint" yaml:"checkpoint"`
+}
+
+// OffsetRange is the messages of a partition from offset Start up to End,
+// excluded. An End of 0 is the high water mark when the backfill starts.
+type OffsetRange struct {
+	Topic     string `json:"topic" yaml:"topic"`
+	Partition int32  `json:"partition" yaml:"partition"`
+	Start     int64  `json:"start" yaml:"start"`
+	End       int64  `json:"end" yaml:"end"`
+}
+
+// CheckpointConfig is where a backfill saves the next offset of every
+// partition: a JSON file at Path, or the hash Key of the Redis server at
+// RedisURL.
+type CheckpointConfig struct {
+	Path     string `json:"path" yaml:"path"`
+	RedisURL string `json:"redis_url" yaml:"redis_url"`
+	Key      string `json:"key" yaml:"key"`
+}
+
+func DefaultBackfillConfig() BackfillConfig {
+	return BackfillConfig{Checkpoint: CheckpointConfig{Key: "consumer:backfill"}}
+}
+
+func (c *BackfillConfig) Validate() error {
+	if len(c.Ranges) == 0 {
+		return nil
+	}
+	seen := make(map[topicPartition]bool)
+	for i, r := range c.Ranges {
+		if r.Topic == "" {
+			return fmt.Errorf("backfill.ranges[%d].topic: must not be empty", i)
+		}
+		if r.Partition < 0 || r.Start < 0 {
+			return fmt.Errorf("backfill.ranges[%d]: partition and start must not be negative", i)
+		}
+		if r.End != 0 && r.End <= r.Start {
+			return fmt.Errorf("backfill.ranges[%d].end: must be after start %d, or 0 for the high water mark", i, r.Start)
+		}
+		if seen[topicPartition{r.Topic, r.Partition}] {
+			return fmt.Errorf("backfill.ranges[%d]: %s/%d is in more than one range", i, r.Topic, r.Partition)
+		}
+		seen[topicPartition{r.Topic, r.Partition}] = true
+	}
+	switch {
+	case c.Checkpoint.Path == "" && c.Checkpoint.RedisURL == "":
+		return errors.New("backfill.checkpoint: path or redis_url is required")
+	case c.Checkpoint.Path != "" && c.Checkpoint.RedisURL != "":
+		return errors.New("backfill.checkpoint: only one of path and redis_url can be set")
+	case c.Checkpoint.RedisURL != "":
+		if _, err := redis.ParseURL(c.Checkpoint.RedisURL); err != nil {
+			return fmt.Errorf("backfill.checkpoint.redis_url: %w", err)
+		}
+		if c.Checkpoint.Key == "" {
+			return errors.New("backfill.checkpoint.key: must not be empty")
+		}
+	}
+	return nil
+}
+
+// CheckpointStore keeps the progress of a backfill.
+type CheckpointStore interface {
+	// Load returns the next offset of every partition saved.
+	Load(ctx context.Context) (map[string]map[int32]int64, error)
+	// Save records the next offset of the partitions of offsets, keeping
+	// those of the others.
+	Save(ctx context.Context, offsets map[string]map[int32]int64) error
+	Close() error
+}
+
+// NewCheckpointStore opens the store of config.
+func NewCheckpointStore(config CheckpointConfig) (CheckpointStore, error) {
+	if config.Path != "" {
+		return &fileCheckpoint{path: config.Path}, nil
+	}
+	options, err := redis.ParseURL(config.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCheckpoint{client: redis.NewClient(options), key: config.Key}, nil
+}
+
+// fileCheckpoint writes the offsets as JSON to a file, replaced at once so a
+// crash leaves either the previous or the new offsets.
+type fileCheckpoint struct {
+	path string
+
+	mu      sync.Mutex
+	offsets map[string]map[int32]int64
+}
+
+func (c *fileCheckpoint) Load(context.Context) (map[string]map[int32]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offsets = make(map[string]map[int32]int64)
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c.copy(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.offsets); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", c.path, err)
+	}
+	return c.copy(), nil
+}
+
+func (c *fileCheckpoint) Save(_ context.Context, offsets map[string]map[int32]int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.offsets == nil {
+		c.offsets = make(map[string]map[int32]int64)
+	}
+	for topic, partitions := range offsets {
+		if c.offsets[topic] == nil {
+			c.offsets[topic] = make(map[int32]int64)
+		}
+		for partition, offset := range partitions {
+			c.offsets[topic][partition] = offset
+		}
+	}
+	data, err := json.MarshalIndent(c.offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+func (c *fileCheckpoint) Close() error { return nil }
+
+// copy returns the offsets for a caller outside of mu.
+func (c *fileCheckpoint) copy() map[string]map[int32]int64 {
+	offsets := make(map[string]map[int32]int64, len(c.offsets))
+	for topic, partitions := range c.offsets {
+		offsets[topic] = make(map[int32]int64, len(partitions))
+		for partition, offset := range partitions {
+			offsets[topic][partition] = offset
+		}
+	}
+	return offsets
+}
+
+// redisCheckpoint keeps the offsets in a hash with a topic/partition field
+// for every partition.
+type redisCheckpoint struct {
+	client *redis.Client
+	key    string
+}
+
+func (c *redisCheckpoint) Load(ctx context.Context) (map[string]map[int32]int64, error) {
+	fields, err := c.client.HGetAll(ctx, c.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]map[int32]int64)
+	for field, value := range fields {
+		// topic names never contain a slash
+		topic, partition, ok := strings.Cut(field, "/")
+		p, perr := strconv.ParseInt(partition, 10, 32)
+		offset, oerr := strconv.ParseInt(value, 10, 64)
+		if !ok || perr != nil || oerr != nil {
+			return nil, fmt.Errorf("checkpoint %s: invalid field %s = %s", c.key, field, value)
+		}
+		if offsets[topic] == nil {
+			offsets[topic] = make(map[int32]int64)
+		}
+		offsets[topic][int32(p)] = offset
+	}
+	return offsets, nil
+}
+
+func (c *redisCheckpoint) Save(ctx context.Context, offsets map[string]map[int32]int64) error {
+	var values []any
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			values = append(values, fmt.Sprintf("%s/%d", topic, partition), offset)
+		}
+	}
+	return c.client.HSet(ctx, c.key, values...).Err()
+}
+
+func (c *redisCheckpoint) Close() error { return c.client.Close() }
+
+// Backfill consumes offset ranges with the handler of the consumer, reading
+// the partitions directly rather than as claims of a group session.
+type Backfill struct {
+	client  sarama.Client
+	handler *Handler
+	store   CheckpointStore
+	ranges  []OffsetRange
+}
+
+// NewBackfill returns a backfill of ranges, the committer of handler has to
+// save to store, see NewCheckpointCommitter.
+func NewBackfill(client sarama.Client, handler *Handler, store CheckpointStore, ranges []OffsetRange) *Backfill {
+	return &Backfill{client: client, handler: handler, store: store, ranges: ranges}
+}
+
+// Run consumes the ranges from their checkpoint on and returns once all of
+// them were written and saved, or ctx is cancelled. The checkpoint is saved
+// in both cases.
+func (b *Backfill) Run(ctx context.Context) error {
+	saved, err := b.store.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("load checkpoint: %w", err)
+	}
+	consumer, err := sarama.NewConsumerFromClient(b.client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	b.handler.backpressure.attach(consumer)
+
+	session := &backfillSession{claims: make(map[string][]int32)}
+	session.ctx, session.cancel = context.WithCancel(ctx)
+	defer session.cancel()
+	var claims []*backfillClaim
+	for _, r := range b.ranges {
+		claim, err := b.claim(consumer, r, saved[r.Topic])
+		if err != nil {
+			for _, claim := range claims {
+				claim.consumer.Close()
+			}
+			return err
+		}
+		if claim == nil {
+			logging.Logger.Info("backfill range already done", zap.String("topic", r.Topic), zap.Int32("partition", r.Partition))
+			continue
+		}
+		claims = append(claims, claim)
+		session.claims[r.Topic] = append(session.claims[r.Topic], r.Partition)
+	}
+
+	if err := b.handler.Setup(session); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	failed := make(chan error, len(claims))
+	for _, claim := range claims {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer claim.consumer.Close()
+			go claim.forward(session.ctx)
+			if err := b.handler.ConsumeClaim(session, claim); err != nil {
+				// the checkpoint stays before the message, the next run
+				// consumes it again
+				failed <- err
+				session.cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	// ends the commit loop before the last commit of Cleanup
+	session.cancel()
+	b.handler.Cleanup(session)
+	close(failed)
+	if err := <-failed; err != nil {
+		return err
+	}
+	if b.handler.committer.pending() {
+		return errors.New("backfill progress not saved, the messages since the last checkpoint are written again on the next run")
+	}
+	return nil
+}
+
+// claim starts consuming a range at its checkpoint, it returns nil for a
+// range consumed up to its end.
+func (b *Backfill) claim(consumer sarama.Consumer, r OffsetRange, saved map[int32]int64) (*backfillClaim, error) {
+	oldest, err := b.client.GetOffset(r.Topic, r.Partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, fmt.Errorf("fetch offsets of %s/%d: %w", r.Topic, r.Partition, err)
+	}
+	newest, err := b.client.GetOffset(r.Topic, r.Partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, fmt.Errorf("fetch offsets of %s/%d: %w", r.Topic, r.Partition, err)
+	}
+	start, end := r.Start, r.End
+	if offset, ok := saved[r.Partition]; ok && offset > start {
+		start = offset
+	}
+	if end == 0 {
+		end = newest
+	}
+	if start >= end {
+		return nil, nil
+	}
+	// a backfill never starts elsewhere than asked, a range no longer
+	// retained has to be changed
+	if start < oldest || end > newest {
+		return nil, fmt.Errorf("%s/%d: %w: [%d, %d) not in [%d, %d]", r.Topic, r.Partition, ErrOffsetOutOfRange, start, end, oldest, newest)
+	}
+	pc, err := consumer.ConsumePartition(r.Topic, r.Partition, start)
+	if err != nil {
+		return nil, fmt.Errorf("consume %s/%d: %w", r.Topic, r.Partition, err)
+	}
+	logging.Logger.Info("backfilling range", zap.String("topic", r.Topic), zap.Int32("partition", r.Partition),
+		zap.Int64("start", start), zap.Int64("end", end))
+	return &backfillClaim{
+		consumer:  pc,
+		topic:     r.Topic,
+		partition: r.Partition,
+		start:     start,
+		end:       end,
+		messages:  make(chan *sarama.ConsumerMessage),
+	}, nil
+}
+
+// backfillSession stands in for the group session of the handler. Offsets
+// are marked and saved by the committer of the handler.
+type backfillSession struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	claims map[string][]int32
+}
+
+func (s *backfillSession) Claims() map[string][]int32                  { return s.claims }
+func (s *backfillSession) MemberID() string                            { return "" }
+func (s *backfillSession) GenerationID() int32                         { return 0 }
+func (s *backfillSession) MarkOffset(string, int32, int64, string)     {}
+func (s *backfillSession) Commit()                                     {}
+func (s *backfillSession) ResetOffset(string, int32, int64, string)    {}
+func (s *backfillSession) MarkMessage(*sarama.ConsumerMessage, string) {}
+func (s *backfillSession) Context() context.Context                    { return s.ctx }
+
+// backfillClaim serves the messages of a partition consumer up to the end of
+// the range, then closes Messages so the handler finishes the claim.
+//
+// The last offset of the range has to hold a message: on a topic written with
+// transactions a range ending on a commit marker waits for the message after
+// it.
+type backfillClaim struct {
+	consumer   sarama.PartitionConsumer
+	topic      string
+	partition  int32
+	start, end int64
+	messages   chan *sarama.ConsumerMessage
+}
+
+func (c *backfillClaim) Topic() string              { return c.topic }
+func (c *backfillClaim) Partition() int32           { return c.partition }
+func (c *backfillClaim) InitialOffset() int64       { return c.start }
+func (c *backfillClaim) HighWaterMarkOffset() int64 { return c.consumer.HighWaterMarkOffset() }
+
+func (c *backfillClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func (c *backfillClaim) forward(ctx context.Context) {
+	defer close(c.messages)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-c.consumer.Messages():
+			if !ok {
+				return
+			}
+			select {
+			case c.messages <- message:
+			case <-ctx.Done():
+				return
+			}
+			if message.Offset >= c.end-1 {
+				logging.Logger.Info("backfill range consumed", zap.String("topic", c.topic), zap.Int32("partition", c.partition),
+					zap.Int64("end", c.end))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/alicebob/miniredis/v2"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+func TestCheckpointStores(t *testing.T) {
+	server := miniredis.RunT(t)
+	for name, config := range map[string]CheckpointConfig{
+		"file":  {Path: filepath.Join(t.TempDir(), "backfill.json")},
+		"redis": {RedisURL: "redis://" + server.Addr(), Key: "consumer:backfill"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := NewCheckpointStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if saved, err := store.Load(ctx); err != nil || len(saved) != 0 {
+				t.Fatalf("new store holds %v, %v", saved, err)
+			}
+			if err := store.Save(ctx, map[string]map[int32]int64{"updates": {0: 10, 1: 20}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Save(ctx, map[string]map[int32]int64{"updates": {0: 15}}); err != nil {
+				t.Fatal(err)
+			}
+
+			// saved offsets survive the store
+			store, err = NewCheckpointStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if saved, err := store.Load(ctx); err != nil || saved["updates"][0] != 15 || saved["updates"][1] != 20 {
+				t.Fatalf("loaded %v, %v", saved, err)
+			}
+		})
+	}
+}
+
+// backfillBroker serves the partitions of seekBroker, partition 0 holding
+// the transactions of slots 0 to 99 at their offset.
+func backfillBroker(t *testing.T) *sarama.MockBroker {
+	broker := seekBroker(t, -1, sarama.NewMockOffsetCommitResponse(t))
+	fetch := sarama.NewMockFetchResponse(t, 5).SetHighWaterMark("updates", 0, 100)
+	for offset := range int64(100) {
+		value, err := gproto.Marshal(decodetest.TransactionMessage(uint64(offset), testkey.Key(1)).Update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetch.SetMessage("updates", 0, offset, sarama.ByteEncoder(value))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("updates", 0, broker.BrokerID()).
+			SetLeader("updates", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("updates", 0, sarama.OffsetOldest, 0).
+			SetOffset("updates", 0, sarama.OffsetNewest, 100),
+		"FetchRequest": fetch,
+	})
+	return broker
+}
+
+func TestBackfill(t *testing.T) {
+	broker := backfillBroker(t)
+	defer broker.Close()
+	config := KafkaConfig{Brokers: []string{broker.Addr()}, Topics: []string{"updates"}, GroupID: "group", OffsetReset: "latest"}
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := sarama.NewClient(config.Brokers, saramaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCheckpointStore(CheckpointConfig{Path: filepath.Join(t.TempDir(), "backfill.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(ranges ...OffsetRange) (*sinktest.RecordSink, error) {
+		sink := &sinktest.RecordSink{}
+		handler := &Handler{
+			decoder:   decoder,
+			sink:      sink,
+			retry:     RetryConfig{MaxAttempts: 1},
+			health:    NewHealth(nil, HealthConfig{}),
+			committer: NewCheckpointCommitter(store, CommitConfig{Interval: duration.Duration(time.Hour), MaxAttempts: 1}),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := NewBackfill(client, handler, store, ranges).Run(ctx)
+		if ctx.Err() != nil {
+			t.Fatal("backfill did not finish")
+		}
+		return sink, err
+	}
+
+	sink, err := run(OffsetRange{Topic: "updates", Start: 10, End: 17})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.Slots(); !slices.Equal(got, []uint64{10, 11, 12, 13, 14, 15, 16}) {
+		t.Fatalf("wrote slots %v", got)
+	}
+	if saved, err := store.Load(context.Background()); err != nil || saved["updates"][0] != 17 {
+		t.Fatalf("saved %v, %v", saved, err)
+	}
+
+	// the range is done, a larger one resumes at the checkpoint
+	if sink, err := run(OffsetRange{Topic: "updates", Start: 10, End: 17}); err != nil || len(sink.Written) != 0 {
+		t.Fatalf("wrote slots %v again, %v", sink.Slots(), err)
+	}
+	if sink, err := run(OffsetRange{Topic: "updates", Start: 10, End: 20}); err != nil || !slices.Equal(sink.Slots(), []uint64{17, 18, 19}) {
+		t.Fatalf("wrote slots %v, %v", sink.Slots(), err)
+	}
+
+	// past the high water mark
+	if _, err := run(OffsetRange{Topic: "updates", Start: 90, End: 200}); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Fatalf("got %v, want %v", err, ErrOffsetOutOfRange)
+	}
+}
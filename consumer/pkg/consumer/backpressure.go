@@ -0,0 +1,189 @@
+package consumer
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// BackpressureConfig pauses fetching from the claimed partitions while the
+// sink falls behind, instead of buffering the fetched messages. The depth is
+// the messages dispatched and not yet acknowledged by the sink, as for
+// ThrottleConfig.MaxInflight.
+type BackpressureConfig struct {
+	// HighWater pauses every partition once the depth reached it, 0
+	// disables backpressure.
+	HighWater int `json:"high_water" yaml:"high_water"`
+	// LowWater resumes the partitions once the depth drained to it.
+	LowWater int `json:"low_water" yaml:"low_water"`
+}
+
+func (c *BackpressureConfig) Validate() error {
+	if c.HighWater < 0 {
+		return errors.New("processing.backpressure.high_water: must not be negative")
+	}
+	if c.HighWater > 0 && (c.LowWater < 0 || c.LowWater >= c.HighWater) {
+		return errors.New("processing.backpressure.low_water: must be below high_water and not negative")
+	}
+	return nil
+}
+
+// Pauser stops and restarts fetching from every partition being consumed, as
+// sarama.ConsumerGroup and sarama.Consumer do.
+type Pauser interface {
+	PauseAll()
+	ResumeAll()
+}
+
+// Backpressure tracks the depth of the sink and pauses the partitions of its
+// pauser between the marks of BackpressureConfig. The methods of a nil
+// Backpressure do nothing.
+type Backpressure struct {
+	config BackpressureConfig
+
+	mu     sync.Mutex
+	depth  int
+	paused bool
+	pauser Pauser
+}
+
+// NewBackpressure returns nil when config disables backpressure.
+func NewBackpressure(config BackpressureConfig) *Backpressure {
+	if config.HighWater == 0 {
+		return nil
+	}
+	return &Backpressure{config: config}
+}
+
+// attach pauses and resumes the partitions of p from now on.
+func (b *Backpressure) attach(p Pauser) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pauser = p
+}
+
+// add counts a message dispatched to the sink.
+func (b *Backpressure) add() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.depth++
+	if b.depth < b.config.HighWater || b.pauser == nil {
+		return
+	}
+	if !b.paused {
+		b.paused = true
+		metrics.PausesTotal.Inc()
+		metrics.PartitionsPaused.Set(1)
+		logging.Logger.Info("sink falling behind, pausing partitions", zap.Int("depth", b.depth))
+	}
+	// messages still arrive while paused from those already fetched, and from
+	// the partitions of a new session, which start unpaused
+	b.pauser.PauseAll()
+}
+
+// done counts a message acknowledged by the sink.
+func (b *Backpressure) done() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.depth--
+	if !b.paused || b.depth > b.config.LowWater {
+		return
+	}
+	b.paused = false
+	metrics.PartitionsPaused.Set(0)
+	logging.Logger.Info("sink drained, resuming partitions", zap.Int("depth", b.depth))
+	b.pauser.ResumeAll()
+}
+
+// PartitionPauser pauses single partitions besides all of them, as
+// sarama.ConsumerGroup does.
+type PartitionPauser interface {
+	Pauser
+	Pause(partitions map[string][]int32)
+}
+
+// pauseSwitch pauses the partitions on request of the admin API. It is the
+// pauser of the backpressure too, so the partitions only resume once neither
+// keeps them paused. The methods of a nil pauseSwitch do nothing.
+type pauseSwitch struct {
+	pauser PartitionPauser
+
+	mu sync.Mutex
+	// Held is set by the admin API, pressured by the backpressure.
+	held      bool
+	pressured bool
+}
+
+func newPauseSwitch(p PartitionPauser) *pauseSwitch {
+	return &pauseSwitch{pauser: p}
+}
+
+func (p *pauseSwitch) PauseAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pressured = true
+	p.pauser.PauseAll()
+}
+
+func (p *pauseSwitch) ResumeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pressured = false
+	if !p.held {
+		p.pauser.ResumeAll()
+	}
+}
+
+// hold pauses the partitions until release.
+func (p *pauseSwitch) hold() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.held = true
+	p.pauser.PauseAll()
+}
+
+// release resumes the partitions unless the backpressure paused them.
+func (p *pauseSwitch) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.held = false
+	if !p.pressured {
+		p.pauser.ResumeAll()
+	}
+}
+
+func (p *pauseSwitch) paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.held
+}
+
+// Claimed pauses the partition of a claim of a new session while held, the
+// partitions of a session start unpaused.
+func (p *pauseSwitch) Claimed(claim sarama.ConsumerGroupClaim) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held {
+		p.pauser.Pause(map[string][]int32{claim.Topic(): {claim.Partition()}})
+	}
+}
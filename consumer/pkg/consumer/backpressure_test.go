@@ -0,0 +1,113 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"consumer/pkg/metrics"
+)
+
+// pauseRecorder counts the calls of a pauser.
+type pauseRecorder struct {
+	pauses, resumes int
+}
+
+func (p *pauseRecorder) PauseAll()  { p.pauses++ }
+func (p *pauseRecorder) ResumeAll() { p.resumes++ }
+
+func TestBackpressure(t *testing.T) {
+	if NewBackpressure(BackpressureConfig{}) != nil {
+		t.Fatal("backpressure without a high water mark")
+	}
+	for _, invalid := range []BackpressureConfig{{HighWater: -1}, {HighWater: 10, LowWater: 10}, {HighWater: 10, LowWater: -1}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v accepted", invalid)
+		}
+	}
+
+	pauses := testutil.ToFloat64(metrics.PausesTotal)
+	recorder := &pauseRecorder{}
+	h := &Handler{backpressure: NewBackpressure(BackpressureConfig{HighWater: 3, LowWater: 1})}
+	h.backpressure.attach(recorder)
+	message := &sarama.ConsumerMessage{}
+	for range 3 {
+		if err := h.dispatch(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if recorder.pauses != 1 || testutil.ToFloat64(metrics.PartitionsPaused) != 1 || testutil.ToFloat64(metrics.InflightMessages) != 3 {
+		t.Fatalf("%d pauses at the high water mark", recorder.pauses)
+	}
+	// a message fetched before the pause pauses the partitions of a new
+	// session too
+	h.dispatch(context.Background(), message)
+	if counted := testutil.ToFloat64(metrics.PausesTotal) - pauses; recorder.pauses != 2 || counted != 1 {
+		t.Fatalf("%d pauses, %g counted", recorder.pauses, counted)
+	}
+
+	h.acknowledged()
+	h.acknowledged()
+	if recorder.resumes != 0 {
+		t.Fatal("resumed above the low water mark")
+	}
+	h.acknowledged()
+	if recorder.resumes != 1 || testutil.ToFloat64(metrics.PartitionsPaused) != 0 {
+		t.Fatalf("%d resumes at the low water mark", recorder.resumes)
+	}
+	h.acknowledged()
+	if recorder.resumes != 1 || testutil.ToFloat64(metrics.InflightMessages) != 0 {
+		t.Fatalf("%d resumes, %g in flight", recorder.resumes, testutil.ToFloat64(metrics.InflightMessages))
+	}
+}
+
+// partitionClaim is the claim of updates/partition starting at offset.
+type partitionClaim struct {
+	sarama.ConsumerGroupClaim
+	partition int32
+	offset    int64
+}
+
+func (c partitionClaim) Topic() string { return "updates" }
+
+func (c partitionClaim) Partition() int32 { return c.partition }
+
+func (c partitionClaim) InitialOffset() int64 { return c.offset }
+
+// partitionRecorder counts the calls of a PartitionPauser.
+type partitionRecorder struct {
+	pauseRecorder
+	paused map[string][]int32
+}
+
+func (p *partitionRecorder) Pause(partitions map[string][]int32) { p.paused = partitions }
+
+func TestPauseSwitch(t *testing.T) {
+	recorder := &partitionRecorder{}
+	p := newPauseSwitch(recorder)
+
+	// the admin pause outlasts the backpressure, and applies to new claims
+	p.hold()
+	p.PauseAll()
+	p.ResumeAll()
+	if !p.paused() || recorder.pauses != 2 || recorder.resumes != 0 {
+		t.Fatalf("%d pauses, %d resumes", recorder.pauses, recorder.resumes)
+	}
+	p.Claimed(partitionClaim{partition: 1})
+	if got := recorder.paused["updates"]; len(got) != 1 || got[0] != 1 {
+		t.Fatalf("paused partitions %v", recorder.paused)
+	}
+
+	// the release waits for the backpressure
+	p.PauseAll()
+	p.release()
+	if p.paused() || recorder.resumes != 0 {
+		t.Fatalf("%d resumes while pressured", recorder.resumes)
+	}
+	p.ResumeAll()
+	if recorder.resumes != 1 {
+		t.Fatalf("%d resumes", recorder.resumes)
+	}
+}
@@ -0,0 +1,235 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// CommitConfig controls when the offsets of the messages written are
+// committed. The sink is flushed before every commit.
+type CommitConfig struct {
+	// Interval between commits.
+	Interval duration.Duration `json:"interval" yaml:"interval"`
+	// Messages commits as soon as that many messages were marked since the
+	// last commit, 0 commits on Interval only.
+	Messages int `json:"messages" yaml:"messages"`
+	// MaxAttempts counts the first commit request, a commit still failing is
+	// retried with the next one. Backoff doubles between attempts.
+	MaxAttempts int               `json:"max_attempts" yaml:"max_attempts"`
+	Backoff     duration.Duration `json:"backoff" yaml:"backoff"`
+}
+
+func DefaultCommitConfig() CommitConfig {
+	return CommitConfig{
+		Interval:    duration.Duration(time.Second),
+		MaxAttempts: 3,
+		Backoff:     duration.Duration(100 * time.Millisecond),
+	}
+}
+
+func (c *CommitConfig) Validate() error {
+	if c.Interval <= 0 {
+		return errors.New("kafka.commit.interval: must be positive")
+	}
+	if c.Messages < 0 {
+		return errors.New("kafka.commit.messages: must not be negative")
+	}
+	if c.MaxAttempts <= 0 {
+		return errors.New("kafka.commit.max_attempts: must be positive")
+	}
+	if c.Backoff < 0 {
+		return errors.New("kafka.commit.backoff: must not be negative")
+	}
+	return nil
+}
+
+// OffsetCommitter commits the offsets marked in a group session itself, as
+// sarama drops failed commits without reporting them to the caller.
+type OffsetCommitter struct {
+	client sarama.Client
+	group  string
+	// instanceID fences the commits of a static member, see
+	// KafkaConfig.InstanceID
+	instanceID string
+	// checkpoints saves the offsets of a backfill instead of committing them
+	// to the group, see Backfill
+	checkpoints CheckpointStore
+	config      CommitConfig
+
+	mu sync.Mutex
+	// marked holds the next offset of every partition not yet committed
+	marked map[string]map[int32]int64
+	count  int
+	// due is signalled once config.Messages messages were marked
+	due chan struct{}
+}
+
+// NewOffsetCommitter returns a committer committing the offsets of group,
+// as the static member instanceID when set.
+func NewOffsetCommitter(client sarama.Client, group, instanceID string, config CommitConfig) *OffsetCommitter {
+	return &OffsetCommitter{
+		client:     client,
+		group:      group,
+		instanceID: instanceID,
+		config:     config,
+		marked:     make(map[string]map[int32]int64),
+		due:        make(chan struct{}, 1),
+	}
+}
+
+// NewCheckpointCommitter returns a committer saving the offsets to store.
+func NewCheckpointCommitter(store CheckpointStore, config CommitConfig) *OffsetCommitter {
+	c := NewOffsetCommitter(nil, "", "", config)
+	c.checkpoints = store
+	return c
+}
+
+// mark records that every message of the partition before next was written.
+func (c *OffsetCommitter) mark(topic string, partition int32, next int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	partitions, ok := c.marked[topic]
+	if !ok {
+		partitions = make(map[int32]int64)
+		c.marked[topic] = partitions
+	}
+	partitions[partition] = max(partitions[partition], next)
+	c.count++
+	if c.config.Messages > 0 && c.count >= c.config.Messages {
+		select {
+		case c.due <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reset drops the offsets marked in a previous session, whose partitions may
+// now belong to another member.
+func (c *OffsetCommitter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.marked = make(map[string]map[int32]int64)
+	c.count = 0
+}
+
+// pending reports whether offsets were marked since the last commit.
+func (c *OffsetCommitter) pending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.marked) > 0
+}
+
+// commit commits the marked offsets in the generation of session, retrying
+// failed requests. Offsets that could not be committed are kept for the next
+// commit of the session.
+func (c *OffsetCommitter) commit(session sarama.ConsumerGroupSession) error {
+	c.mu.Lock()
+	marked := c.marked
+	c.marked = make(map[string]map[int32]int64)
+	c.count = 0
+	c.mu.Unlock()
+	if len(marked) == 0 {
+		return nil
+	}
+
+	retry := RetryConfig{
+		MaxAttempts:  c.config.MaxAttempts,
+		InitialDelay: c.config.Backoff,
+		MaxDelay:     duration.Duration(10 * time.Second),
+		Multiplier:   2,
+	}
+	// the session context is already cancelled when Cleanup commits
+	err := retry.Do(context.Background(), func() error {
+		return c.send(session, marked)
+	}, func(attempt int, delay time.Duration, err error) {
+		metrics.CommitFailuresTotal.WithLabelValues(commitErrorReason(err)).Inc()
+		logging.Logger.Warn("offset commit failed, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.Error(err))
+	})
+	if err == nil {
+		return nil
+	}
+	metrics.CommitFailuresTotal.WithLabelValues(commitErrorReason(err)).Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic, partitions := range marked {
+		if c.marked[topic] == nil {
+			c.marked[topic] = make(map[int32]int64)
+		}
+		for partition, offset := range partitions {
+			c.marked[topic][partition] = max(c.marked[topic][partition], offset)
+		}
+	}
+	return err
+}
+
+// send commits offsets in a single request to the coordinator of the group.
+func (c *OffsetCommitter) send(session sarama.ConsumerGroupSession, offsets map[string]map[int32]int64) error {
+	if c.checkpoints != nil {
+		return c.checkpoints.Save(context.Background(), offsets)
+	}
+	coordinator, err := c.client.Coordinator(c.group)
+	if err != nil {
+		return err
+	}
+	request := &sarama.OffsetCommitRequest{
+		ConsumerGroup:           c.group,
+		ConsumerGroupGeneration: session.GenerationID(),
+		ConsumerID:              session.MemberID(),
+		Version:                 2,
+		// the retention configured on the brokers
+		RetentionTime: -1,
+	}
+	if c.instanceID != "" {
+		// version 7 adds the instance id, and drops the retention time
+		request.Version = 7
+		request.GroupInstanceId = &c.instanceID
+	}
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			request.AddBlock(topic, partition, offset, 0, "")
+		}
+	}
+	response, err := coordinator.CommitOffset(request)
+	if err != nil {
+		// a broken connection is opened anew by the next request
+		c.client.RefreshCoordinator(c.group)
+		return err
+	}
+	var errs []error
+	for topic, partitions := range offsets {
+		for partition := range partitions {
+			kerr, ok := response.Errors[topic][partition]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Errorf("%s/%d: %w", topic, partition, sarama.ErrIncompleteResponse))
+			case !errors.Is(kerr, sarama.ErrNoError):
+				errs = append(errs, fmt.Errorf("%s/%d: %w", topic, partition, kerr))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		c.client.RefreshCoordinator(c.group)
+	}
+	return errors.Join(errs...)
+}
+
+// commitErrorReason labels a failed commit request: rejected when the
+// coordinator refused offsets, request when it could not be sent.
+func commitErrorReason(err error) string {
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		return "rejected"
+	}
+	return "request"
+}
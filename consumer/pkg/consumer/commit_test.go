@@ -0,0 +1,113 @@
+package consumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/duration"
+)
+
+// generationSession is a session of generation 3.
+type generationSession struct {
+	sarama.ConsumerGroupSession
+}
+
+func (generationSession) GenerationID() int32 { return 3 }
+func (generationSession) MemberID() string    { return "member" }
+
+func TestOffsetCommitter(t *testing.T) {
+	broker := seekBroker(t, 50, sarama.NewMockOffsetCommitResponse(t).
+		SetError("group", "updates", 0, sarama.ErrRebalanceInProgress).
+		SetError("group", "updates", 1, sarama.ErrNoError))
+	defer broker.Close()
+	config := KafkaConfig{Brokers: []string{broker.Addr()}, Topics: []string{"updates"}, GroupID: "group", OffsetReset: "latest"}
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as with an instance id, for the commits of a static member below
+	saramaConfig.Version = sarama.V2_3_0_0
+	client, err := sarama.NewClient(config.Brokers, saramaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c := NewOffsetCommitter(client, "group", "", CommitConfig{Interval: duration.Duration(time.Minute), Messages: 3, MaxAttempts: 2})
+	c.mark("updates", 0, 11)
+	c.mark("updates", 0, 10)
+	select {
+	case <-c.due:
+		t.Fatal("commit due before 3 messages were marked")
+	default:
+	}
+	c.mark("updates", 1, 21)
+	select {
+	case <-c.due:
+	default:
+		t.Fatal("commit not due after 3 messages")
+	}
+
+	// the coordinator rejects partition 0 on every attempt
+	if err := c.commit(generationSession{}); !errors.Is(err, sarama.ErrRebalanceInProgress) {
+		t.Fatalf("got %v, want %v", err, sarama.ErrRebalanceInProgress)
+	}
+	for _, rr := range broker.History() {
+		if request, ok := rr.Request.(*sarama.OffsetCommitRequest); ok && (request.ConsumerGroupGeneration != 3 || request.ConsumerID != "member") {
+			t.Fatalf("committed in generation %d of %s", request.ConsumerGroupGeneration, request.ConsumerID)
+		}
+	}
+	if got := committedOffsets(t, broker); commitRequests(broker) != 2 || got[0] != 11 || got[1] != 21 {
+		t.Fatalf("%d requests committed %v", commitRequests(broker), got)
+	}
+
+	// the offsets are committed again with the next commit
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t).
+			SetError("group", "updates", 0, sarama.ErrNoError).
+			SetError("group", "updates", 1, sarama.ErrNoError),
+	})
+	c.mark("updates", 0, 12)
+	if err := c.commit(generationSession{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := committedOffsets(t, broker); got[0] != 12 || got[1] != 21 {
+		t.Fatalf("committed %v", got)
+	}
+	if err := c.commit(generationSession{}); err != nil || commitRequests(broker) != 3 {
+		t.Fatalf("committed nothing with %d requests, %v", commitRequests(broker), err)
+	}
+
+	// a static member commits with its instance id
+	c.instanceID = "consumer-1"
+	c.mark("updates", 1, 22)
+	if err := c.commit(generationSession{}); err != nil {
+		t.Fatal(err)
+	}
+	history := broker.History()
+	if request := history[len(history)-1].Request.(*sarama.OffsetCommitRequest); request.Version != 7 || *request.GroupInstanceId != "consumer-1" {
+		t.Fatalf("committed with version %d as %v", request.Version, request.GroupInstanceId)
+	}
+
+	// a new session does not commit the offsets of the previous one
+	c.mark("updates", 0, 13)
+	c.reset()
+	if err := c.commit(generationSession{}); err != nil || commitRequests(broker) != 4 {
+		t.Fatalf("committed offsets of a previous session, %v", err)
+	}
+}
+
+func commitRequests(broker *sarama.MockBroker) int {
+	var n int
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,529 @@
+// Package consumer reads Yellowstone gRPC updates from a Kafka consumer
+// group and writes them to a sink.Sink, committing the offsets of the
+// messages written.
+//
+// A Handler built by NewHandler from a HandlerConfig is the
+// sarama.ConsumerGroupHandler of a group joined with NewConsumerGroup, on the
+// Kafka cluster a KafkaConfig selects. Its parts, the Health, the
+// DeadLetterQueue, the RetryTopics, the GapDetector and the OffsetCommitter,
+// have their own constructors. A Backfill reads offset ranges with the same
+// handler outside of the group.
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+	"consumer/pkg/tracing"
+)
+
+// Handler decodes the claimed messages and writes them to the sink.
+type Handler struct {
+	group        string
+	decoder      *decode.Decoder
+	lookupTables *decode.LookupTableResolver
+	// filter is replaced by a config reload.
+	filter       atomic.Pointer[filter.Filter]
+	signatures   *signatureCache
+	gaps         *GapDetector
+	sink         sink.Sink
+	dlq          *DeadLetterQueue
+	retryTopics  *RetryTopics
+	processing   ProcessingConfig
+	retry        RetryConfig
+	health       *Health
+	throttle     *Throttle
+	backpressure *Backpressure
+	// pause pauses the partitions for the admin API, nil during a backfill.
+	pause     *pauseSwitch
+	committer *OffsetCommitter
+	// commitRequests are commits asked by the admin API, answered by the
+	// commit loop of the session with the result.
+	commitRequests chan chan error
+	// offsets of the claims are checked on Setup with outOfRange, see
+	// recoverOffsets. No check is made when nil.
+	offsets    GroupOffsets
+	outOfRange string
+	// stored offsets of the sink win over the committed ones on Setup when
+	// not nil, see seekStoredOffsets.
+	stored StoredOffsets
+	// Failover admits the messages of source, all of them when nil.
+	failover *Failover
+	source   int
+
+	// commitMu is held for reading while a message is written and marked, and
+	// for writing while the sink is flushed and offsets are committed, so no
+	// offset is committed before its message reached the sink.
+	commitMu sync.RWMutex
+}
+
+// HandlerConfig holds the parts of a Handler. Decoder, Sink, Health
+// and Committer are required, the other parts are left out when nil.
+type HandlerConfig struct {
+	// Group labels the traces, it is empty for a backfill.
+	Group        string
+	Decoder      *decode.Decoder
+	LookupTables *decode.LookupTableResolver
+	// Filter can be replaced later, see SetFilter.
+	Filter      *filter.Filter
+	Gaps        *GapDetector
+	Sink        sink.Sink
+	DLQ         *DeadLetterQueue
+	RetryTopics *RetryTopics
+	// Processing also configures the signature cache, the throttle and the
+	// backpressure of the handler.
+	Processing ProcessingConfig
+	Retry      RetryConfig
+	Health     *Health
+	// Failover admits the messages of the primary cluster, all of them when
+	// nil.
+	Failover *Failover
+	// Committer commits the offsets of the messages written, see
+	// NewOffsetCommitter and NewCheckpointCommitter.
+	Committer *OffsetCommitter
+	// Offsets of the claims are checked on Setup, the offsets out of the
+	// retained range are reset to OutOfRange. No check is made when nil.
+	Offsets    GroupOffsets
+	OutOfRange string
+	// Stored offsets of the sink win over the committed ones on Setup when
+	// not nil.
+	Stored StoredOffsets
+}
+
+// NewHandler returns a handler consuming with the parts of config.
+func NewHandler(config HandlerConfig) *Handler {
+	h := &Handler{
+		group:        config.Group,
+		decoder:      config.Decoder,
+		lookupTables: config.LookupTables,
+		signatures:   newSignatureCache(config.Processing.SignatureDedup),
+		gaps:         config.Gaps,
+		sink:         config.Sink,
+		dlq:          config.DLQ,
+		retryTopics:  config.RetryTopics,
+		processing:   config.Processing,
+		retry:        config.Retry,
+		health:       config.Health,
+		throttle:     NewThrottle(config.Processing.Throttle),
+		backpressure: NewBackpressure(config.Processing.Backpressure),
+		committer:    config.Committer,
+		offsets:      config.Offsets,
+		outOfRange:   config.OutOfRange,
+		stored:       config.Stored,
+		failover:     config.Failover,
+		// answered by the commit loop once the group session started
+		commitRequests: make(chan chan error),
+	}
+	h.filter.Store(config.Filter)
+	return h
+}
+
+// SetFilter replaces the filter of the messages consumed from now on.
+func (h *Handler) SetFilter(f *filter.Filter) {
+	h.filter.Store(f)
+}
+
+// Filter returns the filter the handler applies, nil when it keeps all
+// updates.
+func (h *Handler) Filter() *filter.Filter {
+	return h.filter.Load()
+}
+
+// Throttle returns the throttle of the handler, whose rates can be changed
+// while consuming.
+func (h *Handler) Throttle() *Throttle {
+	return h.throttle
+}
+
+// Health returns the health of the consumer the handler reports to.
+func (h *Handler) Health() *Health {
+	return h.health
+}
+
+// AttachGroup lets the handler pause the partitions of group, for the
+// backpressure and for Pause.
+func (h *Handler) AttachGroup(group PartitionPauser) {
+	h.pause = newPauseSwitch(group)
+	h.backpressure.attach(h.pause)
+}
+
+// Pause pauses the claimed partitions until Resume. The handler must be
+// attached to its group, see AttachGroup.
+func (h *Handler) Pause() {
+	h.pause.hold()
+}
+
+// Resume resumes the partitions paused by Pause, unless the backpressure
+// keeps them paused.
+func (h *Handler) Resume() {
+	h.pause.release()
+}
+
+// Paused reports whether the partitions are paused by Pause.
+func (h *Handler) Paused() bool {
+	return h.pause.paused()
+}
+
+// Commit flushes the sink and commits the marked offsets through the commit
+// loop of the group session, as its interval does. It returns the error of
+// ctx when no session took the commit before ctx was done.
+func (h *Handler) Commit(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case h.commitRequests <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-done
+}
+
+func (h *Handler) Setup(session sarama.ConsumerGroupSession) error {
+	if h.offsets != nil {
+		if err := recoverOffsets(session, h.offsets, h.outOfRange); err != nil {
+			return err
+		}
+	}
+	if h.stored != nil {
+		if err := seekStoredOffsets(session, h.stored); err != nil {
+			return err
+		}
+	}
+	h.committer.reset()
+	h.health.Setup(session)
+	go h.commitLoop(session)
+	return nil
+}
+
+func (h *Handler) Cleanup(session sarama.ConsumerGroupSession) error {
+	h.commit(session)
+	h.health.Cleanup()
+	return nil
+}
+
+// commitLoop commits marked offsets every kafka.commit.interval, or once
+// kafka.commit.messages were marked, until the session ends.
+func (h *Handler) commitLoop(session sarama.ConsumerGroupSession) {
+	ticker := time.NewTicker(time.Duration(h.committer.config.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.Context().Done():
+			return
+		case <-ticker.C:
+			h.commit(session)
+		case <-h.committer.due:
+			h.commit(session)
+			ticker.Reset(time.Duration(h.committer.config.Interval))
+		case done := <-h.commitRequests:
+			done <- h.commit(session)
+			ticker.Reset(time.Duration(h.committer.config.Interval))
+		}
+	}
+}
+
+// commit flushes the sink and commits the marked offsets. Failures are
+// logged, the error is also returned for the admin API.
+func (h *Handler) commit(session sarama.ConsumerGroupSession) error {
+	h.commitMu.Lock()
+	defer h.commitMu.Unlock()
+
+	if err := h.sink.Flush(context.Background()); err != nil {
+		logging.Logger.Error("sink flush failed, offsets not committed", zap.Error(err))
+		return err
+	}
+	if err := h.committer.commit(session); err != nil {
+		logging.Logger.Error("offset commit failed, retried with the next commit", zap.Error(err))
+		return err
+	}
+	metrics.CommitsTotal.Inc()
+	return nil
+}
+
+// Flush flushes the sink without committing, waiting for the messages being
+// written.
+func (h *Handler) Flush(ctx context.Context) error {
+	h.commitMu.Lock()
+	defer h.commitMu.Unlock()
+	return h.sink.Flush(ctx)
+}
+
+// ConsumeClaim processes messages until the claim is revoked or the session
+// is cancelled. The message in flight is always finished, Cleanup then
+// flushes the sink and commits.
+func (h *Handler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	// in-flight messages must still reach the sink after cancellation
+	ctx := context.WithoutCancel(session.Context())
+	h.health.Claimed(claim)
+	h.pause.Claimed(claim)
+	tracker := newOffsetTracker(func(offset int64) {
+		h.committer.mark(claim.Topic(), claim.Partition(), offset+1)
+	})
+	if h.processing.Workers > 1 {
+		return h.consumeParallel(ctx, session, claim, tracker)
+	}
+
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			// Held back outside of commitMu, a commit flushing the sink
+			// releases the messages it held
+			if err := h.dispatch(session.Context(), message); err != nil {
+				return nil
+			}
+			tracker.add(message.Offset)
+			h.commitMu.RLock()
+			err := h.process(ctx, claim, message, func() {
+				h.acknowledged()
+				tracker.complete(message.Offset)
+			})
+			h.commitMu.RUnlock()
+			if err != nil {
+				// the offset is not marked, ending the session consumes the
+				// message again from the committed offset
+				h.acknowledged()
+				return err
+			}
+		}
+	}
+}
+
+// dispatch holds message back until it is due when it was consumed from a
+// retry topic and while a throttle limit is reached, or returns the error of
+// ctx, and counts it until it is acknowledged.
+func (h *Handler) dispatch(ctx context.Context, message *sarama.ConsumerMessage) error {
+	if err := h.retryTopics.wait(ctx, message); err != nil {
+		return err
+	}
+	if err := h.throttle.acquire(ctx, message); err != nil {
+		return err
+	}
+	metrics.InflightMessages.Inc()
+	h.backpressure.add()
+	return nil
+}
+
+// acknowledged releases a dispatched message the sink acknowledged, or that
+// completed without reaching it.
+func (h *Handler) acknowledged() {
+	h.throttle.done()
+	metrics.InflightMessages.Dec()
+	h.backpressure.done()
+}
+
+// process decodes a message and writes it to the sink, dead-lettering it on
+// failure. The caller holds commitMu for reading. complete marks the offset,
+// it is called before process returns unless the sink held the message. A
+// message that could not be dead-lettered is not completed, the error is
+// returned.
+func (h *Handler) process(ctx context.Context, claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage, complete func()) (failed error) {
+	defer h.health.Processed(message)
+
+	// a sink holding msg may complete it at any time, and more than once
+	complete = sync.OnceFunc(complete)
+	var msg *decode.Message
+	// msg is released once process returned and, when it reached the sink,
+	// the sink completed it. A message failing the sink is left to the
+	// garbage collector.
+	var refs atomic.Int32
+	refs.Store(1)
+	release := func() {
+		if refs.Add(-1) == 0 {
+			h.decoder.Release(msg)
+		}
+	}
+	defer func() {
+		if failed == nil && (msg == nil || !msg.Held()) {
+			complete()
+		}
+		release()
+	}()
+
+	var err error
+	ctx, span := tracing.StartConsumeSpan(ctx, h.group, message)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	if ce := logging.Logger.Check(zap.DebugLevel, "received message"); ce != nil {
+		ce.Write(append(logging.RecordFields(message), zap.ByteString("key", message.Key), zap.Int("size", len(message.Value)))...)
+	}
+	metrics.BytesTotal.WithLabelValues(message.Topic).Add(float64(len(message.Value)))
+	metrics.SetPartitionLag(message.Topic, message.Partition, claim.HighWaterMarkOffset(), message.Offset)
+
+	// a message of a retry topic is written as it was consumed from its
+	// source topic
+	source := h.retryTopics.source(message)
+	if !h.decoder.SampleRecord(source) {
+		metrics.FilteredTotal.WithLabelValues(message.Topic, filter.ReasonSampled).Inc()
+		span.SetAttributes(attribute.String("consumer.filter.reason", filter.ReasonSampled))
+		return
+	}
+	f := h.filter.Load()
+	// a pruned transaction is decoded in full once it passed the filter,
+	// which needs the lookup tables resolved on the full one
+	var pruned bool
+	_, decodeSpan := tracing.Tracer.Start(ctx, "decode")
+	if f.Prefilters() && h.lookupTables == nil {
+		msg, pruned, err = h.decoder.DecodeLazy(source)
+	} else {
+		msg, err = h.decoder.Decode(source)
+	}
+	tracing.EndSpan(decodeSpan, err)
+	if err != nil {
+		metrics.DecodeFailuresTotal.WithLabelValues(message.Topic).Inc()
+		return h.fail(ctx, source, logging.RecordFields(message), StageDecode, err)
+	}
+	if !h.decoder.SampleMessage(msg) {
+		metrics.FilteredTotal.WithLabelValues(message.Topic, filter.ReasonSampled).Inc()
+		span.SetAttributes(attribute.String("consumer.filter.reason", filter.ReasonSampled))
+		return
+	}
+	kind := string(msg.Kind())
+	metrics.MessagesTotal.WithLabelValues(message.Topic, kind).Inc()
+	produced := msg.ProducedAt()
+	metrics.ObserveLatency(metrics.ConsumeLatency, message.Topic, produced)
+	span.SetAttributes(attribute.String("solana.update.kind", kind), tracing.SlotAttribute(msg.Slot))
+	if h.gaps != nil {
+		h.gaps.Observe(msg)
+	}
+
+	if h.lookupTables != nil {
+		resolveCtx, resolveSpan := tracing.Tracer.Start(ctx, "resolve lookup tables")
+		err = h.lookupTables.Resolve(resolveCtx, msg)
+		tracing.EndSpan(resolveSpan, err)
+		if err != nil {
+			return h.fail(ctx, source, decode.MessageFields(msg), StageResolve, err)
+		}
+	}
+
+	if ok, reason := f.Allow(msg); !ok {
+		metrics.FilteredTotal.WithLabelValues(message.Topic, reason).Inc()
+		span.SetAttributes(attribute.String("consumer.filter.reason", reason))
+		if pruned {
+			metrics.LazyDecodeSkippedTotal.WithLabelValues(message.Topic).Inc()
+		}
+		return
+	}
+	if pruned {
+		_, decodeSpan := tracing.Tracer.Start(ctx, "decode")
+		var full *decode.Message
+		full, err = h.decoder.Decode(source)
+		tracing.EndSpan(decodeSpan, err)
+		if err != nil {
+			metrics.DecodeFailuresTotal.WithLabelValues(message.Topic).Inc()
+			return h.fail(ctx, source, logging.RecordFields(message), StageDecode, err)
+		}
+		h.decoder.Release(msg)
+		msg = full
+	}
+	if !h.failover.admit(h.source, msg) {
+		metrics.FilteredTotal.WithLabelValues(message.Topic, filter.ReasonFailover).Inc()
+		span.SetAttributes(attribute.String("consumer.filter.reason", filter.ReasonFailover))
+		return
+	}
+	if !h.signatures.add(msg, time.Now()) {
+		metrics.FilteredTotal.WithLabelValues(message.Topic, filter.ReasonDuplicate).Inc()
+		span.SetAttributes(attribute.String("consumer.filter.reason", filter.ReasonDuplicate))
+		return
+	}
+
+	// the sink acknowledges msg once its offset may be committed, which a
+	// sink holding msg does later
+	refs.Add(1)
+	msg.Complete = sync.OnceFunc(func() {
+		metrics.ObserveLatency(metrics.SinkAckLatency, message.Topic, produced)
+		complete()
+		release()
+	})
+	start := time.Now()
+	writeCtx, writeSpan := tracing.Tracer.Start(ctx, "sink write")
+	err = h.retry.Do(writeCtx, func() error {
+		return h.sink.Write(writeCtx, msg)
+	}, func(attempt int, delay time.Duration, err error) {
+		metrics.SinkRetriesTotal.Inc()
+		writeSpan.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+		logging.Logger.Warn("sink write failed, retrying",
+			append(decode.MessageFields(msg), zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.Error(err))...)
+	})
+	tracing.EndSpan(writeSpan, err)
+	if err != nil {
+		if !h.retryLater(message, decode.MessageFields(msg), err) {
+			failed = h.exhausted(ctx, source, decode.MessageFields(msg), err)
+		}
+	} else if !msg.Held() {
+		msg.Complete()
+	}
+	metrics.HandlerDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	return failed
+}
+
+// retryLater hands a message the sink kept rejecting to the next retry
+// topic, and reports whether it did. A message failing in the last tier, or
+// that could not be produced, is not.
+func (h *Handler) retryLater(record *sarama.ConsumerMessage, fields []zap.Field, cause error) bool {
+	sent, err := h.retryTopics.Send(record, cause)
+	if err != nil {
+		logging.Logger.Error("retry topic produce failed", append(fields, zap.NamedError("retry_error", err))...)
+		return false
+	}
+	if sent {
+		logging.Logger.Warn("message failed, retried later", append(fields, zap.String("stage", StageSink), zap.Error(cause))...)
+	}
+	return sent
+}
+
+// exhausted applies the terminal retry action to a message the sink kept
+// rejecting, and returns the error of fail.
+func (h *Handler) exhausted(ctx context.Context, record *sarama.ConsumerMessage, fields []zap.Field, cause error) error {
+	switch h.retry.OnExhausted {
+	case exhaustedCrash:
+		// the offset is not marked, the message is consumed again on restart
+		logging.Logger.Fatal("message failed, retries exhausted", append(fields, zap.String("stage", StageSink), zap.Error(cause))...)
+	case exhaustedSkip:
+		logging.Logger.Warn("message skipped, retries exhausted", append(fields, zap.String("stage", StageSink), zap.Error(cause))...)
+	default:
+		return h.fail(ctx, record, fields, StageSink, cause)
+	}
+	return nil
+}
+
+// fail reports a message that could not be processed and dead-letters it,
+// retrying the produce as retry configures. The error of the last attempt is
+// returned, the message must then not be completed.
+func (h *Handler) fail(ctx context.Context, record *sarama.ConsumerMessage, fields []zap.Field, stage string, cause error) error {
+	fields = append(fields, zap.String("stage", stage), zap.Error(cause))
+	logging.Logger.Warn("message failed", fields...)
+	if h.dlq == nil {
+		return nil
+	}
+	err := h.retry.Do(ctx, func() error {
+		return h.dlq.Send(record, stage, cause)
+	}, func(attempt int, delay time.Duration, err error) {
+		logging.Logger.Warn("dead-letter produce failed, retrying",
+			append(fields, zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.NamedError("dlq_error", err))...)
+	})
+	if err != nil {
+		metrics.DLQFailuresTotal.Inc()
+		logging.Logger.Error("dead-letter produce failed", append(fields, zap.NamedError("dlq_error", err))...)
+		return fmt.Errorf("dead-letter %s/%d at offset %d: %w", record.Topic, record.Partition, record.Offset, err)
+	}
+	metrics.DLQMessagesTotal.WithLabelValues(stage).Inc()
+	return nil
+}
@@ -0,0 +1,277 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/filter"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+	"consumer/proto"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// latencySamples returns the count and sum of a latency histogram of topic.
+func latencySamples(t *testing.T, histogram *prometheus.HistogramVec, topic string) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := histogram.WithLabelValues(topic).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// latencySince returns the count and sum a latency histogram of topic gained
+// since the call, the histograms are global and outlive a test.
+func latencySince(t *testing.T, histogram *prometheus.HistogramVec, topic string) func() (uint64, float64) {
+	t.Helper()
+	count, sum := latencySamples(t, histogram, topic)
+	return func() (uint64, float64) {
+		t.Helper()
+		c, s := latencySamples(t, histogram, topic)
+		return c - count, s - sum
+	}
+}
+
+func TestLatency(t *testing.T) {
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.HoldingSink{}
+	h := &Handler{
+		decoder: decoder,
+		sink:    sink,
+		retry:   RetryConfig{MaxAttempts: 1},
+		health:  NewHealth(nil, HealthConfig{}),
+	}
+	value, err := gproto.Marshal(decodetest.TransactionMessage(10, testkey.Key(1)).Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumed := latencySince(t, metrics.ConsumeLatency, "latency")
+	acknowledged := latencySince(t, metrics.SinkAckLatency, "latency")
+
+	// the created_at header wins over the timestamp of the record
+	createdAt := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	completed := 0
+	h.process(context.Background(), claimStub{}, &sarama.ConsumerMessage{
+		Topic:     "latency",
+		Value:     value,
+		Timestamp: time.Now(),
+		Headers:   []*sarama.RecordHeader{{Key: []byte(decode.HeaderCreatedAt), Value: []byte(createdAt)}},
+	}, func() { completed++ })
+	if count, sum := consumed(); count != 1 || sum < 60 {
+		t.Fatalf("consume latency %d samples, %gs, want a minute", count, sum)
+	}
+	if count, _ := acknowledged(); count != 0 || completed != 0 {
+		t.Fatal("acknowledged a message the sink holds")
+	}
+	sink.Held[0]()
+	sink.Held[0]()
+	if count, sum := acknowledged(); count != 1 || sum < 60 || completed != 1 {
+		t.Fatalf("sink ack latency %d samples, %gs, %d completions", count, sum, completed)
+	}
+
+	// without a timestamp the latency is unknown
+	h.sink = &sinktest.RecordSink{}
+	h.process(context.Background(), claimStub{}, &sarama.ConsumerMessage{Topic: "latency", Value: value}, func() { completed++ })
+	if count, _ := acknowledged(); count != 1 || completed != 2 {
+		t.Fatalf("sink ack latency %d samples, %d completions", count, completed)
+	}
+}
+
+func TestLazyDecode(t *testing.T) {
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindTransaction), Lazy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.RecordSink{}
+	h := &Handler{
+		decoder: decoder,
+		sink:    sink,
+		retry:   RetryConfig{MaxAttempts: 1},
+		health:  NewHealth(nil, HealthConfig{}),
+	}
+	f, err := filter.New(filter.Config{ProgramInclude: []string{testkey.String(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.filter.Store(f)
+	skipped := testutil.ToFloat64(metrics.LazyDecodeSkippedTotal.WithLabelValues("lazy"))
+	for _, program := range [][]byte{testkey.Key(1), testkey.Key(4)} {
+		value, err := gproto.Marshal(decodetest.PrunableTransaction(program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.process(context.Background(), claimStub{}, &sarama.ConsumerMessage{Topic: "lazy", Key: []byte("10_hash"), Value: value}, func() {})
+	}
+
+	// the transaction that passed reaches the sink in full
+	if len(sink.Written) != 1 {
+		t.Fatalf("%d written", len(sink.Written))
+	}
+	if logs := sink.Written[0].Update.GetTransaction().GetTransaction().GetMeta().GetLogMessages(); len(logs) != 1 {
+		t.Fatalf("logs %v", logs)
+	}
+	if got := testutil.ToFloat64(metrics.LazyDecodeSkippedTotal.WithLabelValues("lazy")) - skipped; got != 1 {
+		t.Fatalf("%g skipped", got)
+	}
+
+	// the event filter reads the logs, it gets the full transaction
+	f, err = filter.New(filter.Config{EventInclude: []string{"Swap"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Prefilters() {
+		t.Fatal("event_include prefilters")
+	}
+}
+
+// memoryStore counts the uploaded files.
+type memoryStore struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *memoryStore) Upload(_ context.Context, key string, _ *os.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+func (s *memoryStore) uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// claimStub is the part of a claim process uses.
+type claimStub struct {
+	sarama.ConsumerGroupClaim
+}
+
+func (claimStub) HighWaterMarkOffset() int64 { return 100 }
+
+// TestHeldOffsetsAcrossSinks checks that an offset is only marked once its
+// update went through reorder and commitment and was uploaded in a file.
+func TestHeldOffsetsAcrossSinks(t *testing.T) {
+	store := &memoryStore{}
+	config := sink.DefaultParquetConfig()
+	config.Bucket, config.Dir, config.MaxRows = "archive", t.TempDir(), 2
+	parquetSink, err := sink.NewParquetSinkWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s sink.Sink = parquetSink
+	s = sink.NewCommitmentSink(s, sink.CommitmentConfig{Level: decode.CommitmentConfirmed, MaxPendingSlots: 150})
+	s = sink.NewReorderSink(s, sink.ReorderConfig{Enable: true, MaxSlots: 1, MaxDelay: duration.Duration(time.Hour)})
+	defer s.Close()
+
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		decoder: decoder,
+		sink:    s,
+		retry:   RetryConfig{MaxAttempts: 1},
+		health:  NewHealth(nil, HealthConfig{}),
+	}
+
+	var mu sync.Mutex
+	marked := int64(-1)
+	tracker := newOffsetTracker(func(offset int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		marked = offset
+	})
+	markedOffset := func() int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return marked
+	}
+	var offset int64
+	consume := func(msg *decode.Message) {
+		t.Helper()
+		value, err := gproto.Marshal(msg.Update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := &sarama.ConsumerMessage{Topic: "updates", Offset: offset, Value: value}
+		tracker.add(message.Offset)
+		h.process(context.Background(), claimStub{}, message, func() { tracker.complete(message.Offset) })
+		offset++
+	}
+
+	consume(decodetest.TransactionMessage(10, testkey.Key(1)))              // 0, held by reorder
+	consume(decodetest.TransactionMessage(11, testkey.Key(1)))              // 1, releases 10 to commitment
+	consume(decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED)) // 2, writes 10 to a file
+	consume(decodetest.TransactionMessage(12, testkey.Key(1)))              // 3, releases 11 to commitment
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := markedOffset(); got != -1 || store.uploads() != 0 {
+		t.Fatalf("marked %d before any upload", got)
+	}
+
+	// the file gets its second row and is uploaded
+	consume(decodetest.SlotMessage(11, 10, proto.CommitmentLevel_CONFIRMED)) // 4
+	waitFor(t, func() bool { return markedOffset() == 2 })
+	if store.uploads() != 1 {
+		t.Fatalf("%d uploads, want 1", store.uploads())
+	}
+
+	// 12 is never confirmed, its offset and the later ones stay unmarked
+	consume(decodetest.SlotMessage(12, 11, proto.CommitmentLevel_PROCESSED)) // 5
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := markedOffset(); got != 2 {
+		t.Fatalf("marked %d, want 2", got)
+	}
+}
+
+func TestHandlerCommit(t *testing.T) {
+	h := NewHandler(HandlerConfig{Sink: &sinktest.RecordSink{}})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.Commit(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("commit without a session: %v", err)
+	}
+
+	// the commit loop answers with the error of the commit
+	go func() {
+		(<-h.commitRequests) <- errors.New("commit failed")
+	}()
+	if err := h.Commit(context.Background()); err == nil || err.Error() != "commit failed" {
+		t.Fatalf("got %v", err)
+	}
+}
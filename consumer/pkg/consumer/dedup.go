@@ -0,0 +1,381 @@
+package consumer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/internal/hostname"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// DedupConfig configures the dedup command, which merges redundant topics,
+// each written by a grpc2kafka attached to its own node, into one topic
+// without duplicates. Brokers, SASL and TLS come from the kafka section.
+type DedupConfig struct {
+	Inputs  []string `json:"inputs" yaml:"inputs"`
+	Output  string   `json:"output" yaml:"output"`
+	GroupID string   `json:"group_id" yaml:"group_id"`
+	// TTL is how long a record hash is remembered. A copy arriving later on
+	// another input is forwarded again.
+	TTL duration.Duration `json:"ttl" yaml:"ttl"`
+	// BatchSize bounds the records of a partition produced at once.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+	// TransactionalID produces every batch in a Kafka transaction together
+	// with the offsets of its records, so output only ever holds a record
+	// once for readers with kafka.isolation_level read_committed. {hostname}
+	// is replaced by the host name, the id has to stay the same across
+	// restarts of an instance and differ between instances. The topics
+	// consume produces to, enrichment, retry and dead-letter topics, are not
+	// transactional.
+	TransactionalID string `json:"transactional_id" yaml:"transactional_id"`
+}
+
+func DefaultDedupConfig() DedupConfig {
+	return DedupConfig{
+		GroupID:   "dedup",
+		TTL:       duration.Duration(time.Minute),
+		BatchSize: 1000,
+	}
+}
+
+func (c *DedupConfig) Validate() error {
+	if len(c.Inputs) == 0 {
+		return errors.New("dedup.inputs: at least one topic is required")
+	}
+	if c.Output == "" {
+		return errors.New("dedup.output: must not be empty")
+	}
+	if slices.Contains(c.Inputs, c.Output) {
+		return fmt.Errorf("dedup.output: %s is also an input", c.Output)
+	}
+	if c.GroupID == "" {
+		return errors.New("dedup.group_id: must not be empty")
+	}
+	if c.TTL <= 0 {
+		return errors.New("dedup.ttl: must be positive")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("dedup.batch_size: must be positive")
+	}
+	return nil
+}
+
+// ProducerConfig returns the configuration of the output producer, base
+// itself unless TransactionalID is set.
+func (c *DedupConfig) ProducerConfig(base *sarama.Config) (*sarama.Config, error) {
+	if c.TransactionalID == "" {
+		return base, nil
+	}
+	id, err := hostname.Expand("dedup.transactional_id", c.TransactionalID)
+	if err != nil {
+		return nil, err
+	}
+	config := *base
+	config.Producer.Transaction.ID = id
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Net.MaxOpenRequests = 1
+	return &config, nil
+}
+
+// SignatureDedupConfig drops the transactions and transaction statuses
+// whose signature was already written with the same commitment, as received
+// from redundant topics or partitions.
+type SignatureDedupConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// TTL is how long a signature is remembered.
+	TTL duration.Duration `json:"ttl" yaml:"ttl"`
+	// MaxSize bounds the signatures remembered, the oldest are forgotten
+	// first.
+	MaxSize int `json:"max_size" yaml:"max_size"`
+}
+
+func (c *SignatureDedupConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.TTL <= 0 {
+		return errors.New("processing.signature_dedup.ttl: must be positive")
+	}
+	if c.MaxSize <= 0 {
+		return errors.New("processing.signature_dedup.max_size: must be positive")
+	}
+	return nil
+}
+
+// signatureCache remembers the signatures written, see SignatureDedupConfig.
+type signatureCache struct {
+	cache *hashCache
+}
+
+// newSignatureCache returns nil when config is not enabled.
+func newSignatureCache(config SignatureDedupConfig) *signatureCache {
+	if !config.Enable {
+		return nil
+	}
+	cache := newHashCache(time.Duration(config.TTL))
+	cache.maxSize = config.MaxSize
+	return &signatureCache{cache: cache}
+}
+
+// add records the signature of msg and reports whether it was not already
+// known. Messages without a signature are always new.
+func (c *signatureCache) add(msg *decode.Message, now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	signature := decode.MessageSignature(msg)
+	if signature == nil {
+		return true
+	}
+	// a transaction and its status are different updates
+	h := sha256.New()
+	h.Write([]byte(msg.Kind()))
+	h.Write([]byte{0})
+	h.Write(signature)
+	h.Write([]byte(msg.Headers[decode.HeaderCommitment]))
+	var hash [32]byte
+	h.Sum(hash[:0])
+	added := c.cache.add(hash, now)
+	metrics.SignatureCacheSize.Set(float64(c.cache.len()))
+	return added
+}
+
+// hashCache remembers record hashes for a fixed time.
+type hashCache struct {
+	ttl time.Duration
+	// maxSize bounds the hashes remembered when positive, the oldest are
+	// forgotten first.
+	maxSize int
+
+	mu      sync.Mutex
+	expires map[[32]byte]time.Time
+	// order lists the hashes by insertion, and so by expiry, from head on.
+	order []cachedHash
+	head  int
+}
+
+type cachedHash struct {
+	hash    [32]byte
+	expires time.Time
+}
+
+func newHashCache(ttl time.Duration) *hashCache {
+	return &hashCache{ttl: ttl, expires: make(map[[32]byte]time.Time)}
+}
+
+// add records hash and reports whether it was not already known.
+func (c *hashCache) add(hash [32]byte, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.head < len(c.order) && !c.order[c.head].expires.After(now) {
+		delete(c.expires, c.order[c.head].hash)
+		c.head++
+	}
+	if c.head > len(c.order)/2 {
+		c.order = slices.Delete(c.order, 0, c.head)
+		c.head = 0
+	}
+
+	if _, ok := c.expires[hash]; ok {
+		return false
+	}
+	if c.maxSize > 0 && len(c.expires) >= c.maxSize {
+		delete(c.expires, c.order[c.head].hash)
+		c.head++
+	}
+	expires := now.Add(c.ttl)
+	c.expires[hash] = expires
+	c.order = append(c.order, cachedHash{hash, expires})
+	return true
+}
+
+func (c *hashCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.expires)
+}
+
+// recordHash takes the hash from a `<slot>_<sha256 hex>` key and hashes the
+// value for records without one.
+func recordHash(record *sarama.ConsumerMessage) [32]byte {
+	var hash [32]byte
+	if _, ok := decode.ParseKeySlot(record.Key); ok {
+		if i := len(record.Key) - hex.EncodedLen(len(hash)); i > 0 && record.Key[i-1] == '_' {
+			if _, err := hex.Decode(hash[:], record.Key[i:]); err == nil {
+				return hash
+			}
+		}
+	}
+	return sha256.Sum256(record.Value)
+}
+
+// DedupHandler forwards the first copy of every record to the output topic.
+// Offsets are only marked once the records up to them were produced, or
+// committed in the transaction of the records with a transactional producer.
+type DedupHandler struct {
+	output         string
+	groupID        string
+	batchSize      int
+	cache          *hashCache
+	producer       sarama.SyncProducer
+	commitInterval time.Duration
+	cancel         context.CancelCauseFunc
+
+	// txnMu serializes the transactions of the claims, a producer runs one
+	// at a time.
+	txnMu sync.Mutex
+}
+
+func NewDedupHandler(config DedupConfig, producer sarama.SyncProducer, commitInterval time.Duration, cancel context.CancelCauseFunc) *DedupHandler {
+	return &DedupHandler{
+		output:         config.Output,
+		groupID:        config.GroupID,
+		batchSize:      config.BatchSize,
+		cache:          newHashCache(time.Duration(config.TTL)),
+		producer:       producer,
+		commitInterval: commitInterval,
+		cancel:         cancel,
+	}
+}
+
+func (h *DedupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	go func() {
+		ticker := time.NewTicker(h.commitInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-session.Context().Done():
+				return
+			case <-ticker.C:
+				session.Commit()
+				metrics.DedupCacheSize.Set(float64(h.cache.len()))
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *DedupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	session.Commit()
+	return nil
+}
+
+func (h *DedupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	batch := make([]*sarama.ConsumerMessage, 0, h.batchSize)
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			batch = append(batch[:0], message)
+			// take what is already buffered without waiting for more
+		fill:
+			for len(batch) < h.batchSize {
+				select {
+				case message, ok := <-claim.Messages():
+					if !ok {
+						break fill
+					}
+					batch = append(batch, message)
+				default:
+					break fill
+				}
+			}
+			var err error
+			if h.producer.IsTransactional() {
+				err = h.forwardTxn(batch)
+			} else if err = h.forward(batch); err == nil {
+				session.MarkMessage(batch[len(batch)-1], "")
+			}
+			if err != nil {
+				logging.Logger.Error("failed to produce deduplicated records",
+					zap.String("topic", claim.Topic()),
+					zap.Int32("partition", claim.Partition()),
+					zap.Error(err))
+				h.cancel(err)
+				return err
+			}
+		}
+	}
+}
+
+// forwardTxn forwards batch and commits the offset after it in one
+// transaction. An aborted transaction leaves the offset where it was, its
+// records are forwarded again after the restart.
+func (h *DedupHandler) forwardTxn(batch []*sarama.ConsumerMessage) error {
+	h.txnMu.Lock()
+	defer h.txnMu.Unlock()
+
+	if err := h.producer.BeginTxn(); err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	last := batch[len(batch)-1]
+	err := h.forward(batch)
+	if err == nil {
+		offsets := map[string][]*sarama.PartitionOffsetMetadata{
+			last.Topic: {{Partition: last.Partition, Offset: last.Offset + 1}},
+		}
+		if err = h.producer.AddOffsetsToTxn(offsets, h.groupID); err != nil {
+			err = fmt.Errorf("add offsets to transaction: %w", err)
+		}
+	}
+	if err == nil {
+		if err = h.producer.CommitTxn(); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("commit transaction: %w", err)
+	}
+	if abortErr := h.producer.AbortTxn(); abortErr != nil {
+		logging.Logger.Warn("failed to abort transaction", zap.Error(abortErr))
+	}
+	return err
+}
+
+func (h *DedupHandler) forward(batch []*sarama.ConsumerMessage) error {
+	now := time.Now()
+	var out []*sarama.ProducerMessage
+	for _, record := range batch {
+		metrics.DedupReceivedTotal.WithLabelValues(record.Topic).Inc()
+		if !h.cache.add(recordHash(record), now) {
+			metrics.DedupDuplicatesTotal.WithLabelValues(record.Topic).Inc()
+			continue
+		}
+		msg := &sarama.ProducerMessage{
+			Topic:   h.output,
+			Value:   sarama.ByteEncoder(record.Value),
+			Headers: make([]sarama.RecordHeader, len(record.Headers)),
+		}
+		if record.Key != nil {
+			msg.Key = sarama.ByteEncoder(record.Key)
+		}
+		for i, header := range record.Headers {
+			msg.Headers[i] = *header
+		}
+		out = append(out, msg)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	if err := h.producer.SendMessages(out); err != nil {
+		return fmt.Errorf("produce to %s: %w", h.output, err)
+	}
+	metrics.DedupSentTotal.Add(float64(len(out)))
+	return nil
+}
@@ -0,0 +1,186 @@
+package consumer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+func TestHashCache(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache := newHashCache(time.Minute)
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+
+	if !cache.add(a, now) {
+		t.Fatal("first copy of a reported as known")
+	}
+	if cache.add(a, now.Add(30*time.Second)) {
+		t.Fatal("second copy of a within the ttl reported as new")
+	}
+	if !cache.add(b, now.Add(45*time.Second)) {
+		t.Fatal("first copy of b reported as known")
+	}
+	// a expires, b does not
+	if !cache.add(a, now.Add(time.Minute)) {
+		t.Fatal("a reported as known after its ttl")
+	}
+	if cache.add(b, now.Add(time.Minute)) {
+		t.Fatal("b forgotten before its ttl")
+	}
+	if n := cache.len(); n != 2 {
+		t.Fatalf("len = %d, want 2", n)
+	}
+}
+
+func TestHashCacheCompacts(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache := newHashCache(time.Second)
+	for i := range 1000 {
+		cache.add(sha256.Sum256(fmt.Append(nil, i)), now.Add(time.Duration(i)*time.Millisecond*10))
+	}
+	// a second after the last insertion everything expired
+	cache.add(sha256.Sum256([]byte("last")), now.Add(11*time.Second))
+	if n := cache.len(); n != 1 {
+		t.Fatalf("len = %d, want 1", n)
+	}
+	if len(cache.order)-cache.head != 1 || len(cache.order) > 2 {
+		t.Fatalf("order not compacted: %d entries from %d", len(cache.order), cache.head)
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	if newSignatureCache(SignatureDedupConfig{TTL: duration.Duration(time.Minute), MaxSize: 10}) != nil {
+		t.Fatal("signature cache while disabled")
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache := newSignatureCache(SignatureDedupConfig{Enable: true, TTL: duration.Duration(time.Minute), MaxSize: 2})
+
+	processed := decodetest.TransactionMessage(10, testkey.Key(1))
+	if !cache.add(processed, now) || cache.add(decodetest.TransactionMessage(10, testkey.Key(1)), now) {
+		t.Fatal("second copy of the transaction reported as new")
+	}
+	// the same signature with another commitment or as a status is new
+	confirmed := decodetest.TransactionMessage(10, testkey.Key(1))
+	confirmed.Headers = map[string]string{decode.HeaderCommitment: decode.CommitmentConfirmed}
+	if !cache.add(confirmed, now) {
+		t.Fatal("confirmed copy reported as known")
+	}
+	if !cache.add(decodetest.SlotMessage(10, 9, 0), now) || !cache.add(decodetest.SlotMessage(10, 9, 0), now) {
+		t.Fatal("update without a signature reported as known")
+	}
+
+	// max_size forgets the oldest signature
+	other := decodetest.TransactionMessage(11, testkey.Key(1))
+	other.Update.GetTransaction().Transaction.Signature = testkey.Key(0xfe)
+	if !cache.add(other, now) || !cache.add(processed, now) {
+		t.Fatal("oldest signature still known past max_size")
+	}
+}
+
+func TestRecordHash(t *testing.T) {
+	hash := sha256.Sum256([]byte("update"))
+	keyed := &sarama.ConsumerMessage{Key: fmt.Appendf(nil, "42_%x", hash), Value: []byte("ignored")}
+	if got := recordHash(keyed); got != hash {
+		t.Fatalf("hash of a keyed record = %x, want %x from the key", got, hash)
+	}
+	for _, key := range []string{"", "not-a-slot_ab", "42_short", fmt.Sprintf("42_%x", hash)[:60] + "zz"} {
+		record := &sarama.ConsumerMessage{Key: []byte(key), Value: []byte("value")}
+		if got, want := recordHash(record), sha256.Sum256([]byte("value")); got != want {
+			t.Errorf("hash of key %q = %x, want the value hash", key, got)
+		}
+	}
+}
+
+// txnProducer records the transaction calls of a transactional producer,
+// failing the sends while err is set.
+type txnProducer struct {
+	sarama.SyncProducer
+	err     error
+	calls   []string
+	sent    int
+	offsets map[string][]*sarama.PartitionOffsetMetadata
+}
+
+func (p *txnProducer) IsTransactional() bool { return true }
+func (p *txnProducer) BeginTxn() error       { p.calls = append(p.calls, "begin"); return nil }
+func (p *txnProducer) CommitTxn() error      { p.calls = append(p.calls, "commit"); return nil }
+func (p *txnProducer) AbortTxn() error       { p.calls = append(p.calls, "abort"); return nil }
+
+func (p *txnProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.calls = append(p.calls, "send")
+	if p.err != nil {
+		return p.err
+	}
+	p.sent += len(msgs)
+	return nil
+}
+
+func (p *txnProducer) AddOffsetsToTxn(offsets map[string][]*sarama.PartitionOffsetMetadata, groupID string) error {
+	p.calls = append(p.calls, "offsets "+groupID)
+	p.offsets = offsets
+	return nil
+}
+
+func TestDedupTransactions(t *testing.T) {
+	config := DefaultDedupConfig()
+	config.Inputs, config.Output = []string{"node1", "node2"}, "grpc"
+	config.TransactionalID = "dedup-{hostname}"
+	base := sarama.NewConfig()
+	producerConfig, err := config.ProducerConfig(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producerConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if producerConfig.Producer.Transaction.ID != "dedup-"+hostname || base.Producer.Transaction.ID != "" || base.Producer.Idempotent {
+		t.Fatalf("transactional id %q, base config %q", producerConfig.Producer.Transaction.ID, base.Producer.Transaction.ID)
+	}
+
+	producer := &txnProducer{}
+	h := NewDedupHandler(config, producer, time.Minute, func(error) {})
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "node1", Partition: 2, Offset: 40, Value: []byte("a")},
+		{Topic: "node1", Partition: 2, Offset: 41, Value: []byte("a")},
+		{Topic: "node1", Partition: 2, Offset: 42, Value: []byte("b")},
+	}
+	if err := h.forwardTxn(batch); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"begin", "send", "offsets dedup", "commit"}; !slices.Equal(producer.calls, want) {
+		t.Fatalf("calls %v, want %v", producer.calls, want)
+	}
+	if offset := producer.offsets["node1"][0]; producer.sent != 2 || offset.Partition != 2 || offset.Offset != 43 {
+		t.Fatalf("%d records sent, offset %+v", producer.sent, offset)
+	}
+
+	// a batch of duplicates only moves the offset
+	producer.calls = nil
+	if err := h.forwardTxn(batch[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"begin", "offsets dedup", "commit"}; !slices.Equal(producer.calls, want) {
+		t.Fatalf("calls %v, want %v", producer.calls, want)
+	}
+
+	producer.calls, producer.err = nil, errors.New("broker down")
+	batch = []*sarama.ConsumerMessage{{Topic: "node2", Partition: 0, Offset: 7, Value: []byte("c")}}
+	if err := h.forwardTxn(batch); !errors.Is(err, producer.err) {
+		t.Fatalf("got %v, want %v", err, producer.err)
+	}
+	if want := []string{"begin", "send", "abort"}; !slices.Equal(producer.calls, want) {
+		t.Fatalf("calls %v, want %v", producer.calls, want)
+	}
+}
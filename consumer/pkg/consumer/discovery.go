@@ -0,0 +1,159 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// TopicRegexp compiles kafka.topic_pattern, which has to match a whole topic
+// name.
+func TopicRegexp(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("kafka.topic_pattern: %w", err)
+	}
+	return re, nil
+}
+
+// TopicDiscovery resolves the topics consumed: those of kafka.topics and the
+// existing ones matching kafka.topic_pattern, looked up again every
+// kafka.topic_refresh so that topics created later are consumed without a
+// restart. Without a pattern the topics are those of kafka.topics.
+type TopicDiscovery struct {
+	client  sarama.Client
+	listed  []string
+	pattern *regexp.Regexp
+	refresh time.Duration
+
+	mu     sync.Mutex
+	topics []string
+	// changed is signalled when the topics changed.
+	changed chan struct{}
+}
+
+// NewTopicDiscovery resolves the topics of config a first time.
+func NewTopicDiscovery(client sarama.Client, config KafkaConfig) (*TopicDiscovery, error) {
+	d := &TopicDiscovery{
+		client:  client,
+		listed:  slices.Clone(config.Topics),
+		refresh: time.Duration(config.TopicRefresh),
+		topics:  slices.Clone(config.Topics),
+		changed: make(chan struct{}, 1),
+	}
+	if config.TopicPattern == "" {
+		return d, nil
+	}
+	var err error
+	if d.pattern, err = TopicRegexp(config.TopicPattern); err != nil {
+		return nil, err
+	}
+	if _, err := d.resolve(); err != nil {
+		return nil, fmt.Errorf("discover topics: %w", err)
+	}
+	return d, nil
+}
+
+// Topics returns the topics to consume.
+func (d *TopicDiscovery) Topics() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.topics)
+}
+
+// Changed is signalled whenever Topics changed, it is never signalled
+// without a pattern.
+func (d *TopicDiscovery) Changed() <-chan struct{} {
+	return d.changed
+}
+
+// Run looks the topics up every kafka.topic_refresh until ctx is done, it
+// returns at once without a pattern.
+func (d *TopicDiscovery) Run(ctx context.Context) {
+	if d.pattern == nil {
+		return
+	}
+	ticker := time.NewTicker(d.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := d.resolve()
+			if err != nil {
+				logging.Logger.Warn("failed to discover topics", zap.Error(err))
+				continue
+			}
+			if changed {
+				select {
+				case d.changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// resolve refreshes the metadata of the cluster and matches its topics
+// against the pattern, it reports whether the topics changed.
+func (d *TopicDiscovery) resolve() (bool, error) {
+	if err := d.client.RefreshMetadata(); err != nil {
+		return false, err
+	}
+	existing, err := d.client.Topics()
+	if err != nil {
+		return false, err
+	}
+	topics := slices.Clone(d.listed)
+	for _, topic := range existing {
+		if d.pattern.MatchString(topic) && !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	slices.Sort(topics)
+	metrics.DiscoveredTopics.Set(float64(len(topics)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if slices.Equal(topics, d.topics) {
+		return false, nil
+	}
+	logging.Logger.Info("topics discovered", zap.Strings("topics", topics), zap.Strings("previous", d.topics))
+	d.topics = topics
+	return true, nil
+}
+
+// ConsumeDiscovered runs one session of group on the discovered topics and
+// extra, ended early once the discovered topics changed so that the next
+// session consumes them.
+func ConsumeDiscovered(ctx context.Context, group sarama.ConsumerGroup, discovery *TopicDiscovery, extra []string, handler sarama.ConsumerGroupHandler) error {
+	topics := append(discovery.Topics(), extra...)
+	if len(topics) == 0 {
+		logging.Logger.Warn("no topic matches kafka.topic_pattern yet")
+		select {
+		case <-discovery.Changed():
+		case <-ctx.Done():
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-discovery.Changed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return group.Consume(ctx, topics, handler)
+}
@@ -0,0 +1,78 @@
+package consumer
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/duration"
+)
+
+// topicsClient is a cluster with the topics.
+type topicsClient struct {
+	sarama.Client
+	topics []string
+}
+
+func (c *topicsClient) RefreshMetadata(...string) error { return nil }
+
+func (c *topicsClient) Topics() ([]string, error) { return c.topics, nil }
+
+// sessionGroup hands the topics of every session to sessions, a session
+// lasts until its context is done.
+type sessionGroup struct {
+	sarama.ConsumerGroup
+	sessions chan []string
+}
+
+func (g *sessionGroup) Consume(ctx context.Context, topics []string, _ sarama.ConsumerGroupHandler) error {
+	g.sessions <- topics
+	<-ctx.Done()
+	return nil
+}
+
+func TestTopicDiscovery(t *testing.T) {
+	client := &topicsClient{topics: []string{"geyser.tx.1", "geyser.tx.x", "pre.geyser.tx.2", "other"}}
+	config := KafkaConfig{Topics: []string{"listed"}, TopicPattern: `geyser\.tx\.\d+`, TopicRefresh: duration.Duration(time.Minute)}
+	discovery, err := NewTopicDiscovery(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := discovery.Topics(); !slices.Equal(topics, []string{"geyser.tx.1", "listed"}) {
+		t.Fatalf("topics %v", topics)
+	}
+
+	group := &sessionGroup{sessions: make(chan []string, 1)}
+	done := make(chan error)
+	go func() {
+		done <- ConsumeDiscovered(context.Background(), group, discovery, []string{"extra"}, nil)
+	}()
+	if topics := <-group.sessions; !slices.Equal(topics, []string{"geyser.tx.1", "listed", "extra"}) {
+		t.Fatalf("session topics %v", topics)
+	}
+
+	// a new shard ends the session so the next one consumes it
+	client.topics = append(client.topics, "geyser.tx.2")
+	if changed, err := discovery.resolve(); !changed || err != nil {
+		t.Fatalf("changed %t, %v", changed, err)
+	}
+	discovery.changed <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if topics := discovery.Topics(); !slices.Equal(topics, []string{"geyser.tx.1", "geyser.tx.2", "listed"}) {
+		t.Fatalf("topics %v", topics)
+	}
+	if changed, _ := discovery.resolve(); changed {
+		t.Fatal("unchanged topics reported")
+	}
+
+	// without a pattern the listed topics are consumed
+	discovery, err = NewTopicDiscovery(nil, KafkaConfig{Topics: []string{"b", "a"}})
+	if err != nil || !slices.Equal(discovery.Topics(), []string{"b", "a"}) {
+		t.Fatalf("topics %v, %v", discovery.Topics(), err)
+	}
+}
@@ -0,0 +1,77 @@
+package consumer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Headers attached to dead-lettered records, the value and key are copied
+// unchanged so the record can be replayed to its source topic.
+const (
+	HeaderDLQTopic     = "dlq.topic"
+	HeaderDLQPartition = "dlq.partition"
+	HeaderDLQOffset    = "dlq.offset"
+	HeaderDLQStage     = "dlq.stage"
+	HeaderDLQError     = "dlq.error"
+	HeaderDLQTime      = "dlq.time"
+)
+
+// Stages at which a message can fail.
+const (
+	StageDecode  = "decode"
+	StageResolve = "resolve"
+	StageSink    = "sink"
+)
+
+type DLQConfig struct {
+	// Topic receives messages that failed to decode, to have their lookup
+	// tables resolved or to be written to the sink. Failed messages are only logged when it is empty.
+	Topic string `json:"topic" yaml:"topic"`
+}
+
+// DeadLetterQueue produces failed messages to the dead-letter topic.
+type DeadLetterQueue struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewDeadLetterQueue(brokers []string, config *sarama.Config, topic string) (*DeadLetterQueue, error) {
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterQueue{producer: producer, topic: topic}, nil
+}
+
+// Send produces the raw record together with where and why it failed.
+func (q *DeadLetterQueue) Send(record *sarama.ConsumerMessage, stage string, cause error) error {
+	headers := make([]sarama.RecordHeader, 0, len(record.Headers)+6)
+	for _, header := range record.Headers {
+		headers = append(headers, *header)
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderDLQTopic), Value: []byte(record.Topic)},
+		sarama.RecordHeader{Key: []byte(HeaderDLQPartition), Value: []byte(strconv.Itoa(int(record.Partition)))},
+		sarama.RecordHeader{Key: []byte(HeaderDLQOffset), Value: []byte(strconv.FormatInt(record.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(HeaderDLQStage), Value: []byte(stage)},
+		sarama.RecordHeader{Key: []byte(HeaderDLQError), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte(HeaderDLQTime), Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	msg := &sarama.ProducerMessage{
+		Topic:   q.topic,
+		Value:   sarama.ByteEncoder(record.Value),
+		Headers: headers,
+	}
+	if record.Key != nil {
+		msg.Key = sarama.ByteEncoder(record.Key)
+	}
+	_, _, err := q.producer.SendMessage(msg)
+	return err
+}
+
+func (q *DeadLetterQueue) Close() error {
+	return q.producer.Close()
+}
@@ -0,0 +1,351 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// Sources of a Failover.
+const (
+	sourcePrimary = iota
+	sourceSecondary
+)
+
+// FailoverConfig consumes a secondary cluster, fed by an independent geyser
+// node, while the data of kafka.brokers stops progressing.
+type FailoverConfig struct {
+	// Brokers of the secondary cluster, failover is disabled when empty.
+	// Topics and GroupID are those of kafka when empty, SASL and TLS are
+	// not inherited.
+	Brokers []string   `json:"brokers" yaml:"brokers"`
+	Topics  []string   `json:"topics" yaml:"topics"`
+	GroupID string     `json:"group_id" yaml:"group_id"`
+	SASL    SASLConfig `json:"sasl" yaml:"sasl"`
+	TLS     TLSConfig  `json:"tls" yaml:"tls"`
+	// Stall is how long the high water marks of the primary topics may stand
+	// still before the secondary is consumed, Recover how long they have to
+	// advance again before the primary is consumed again.
+	Stall   duration.Duration `json:"stall" yaml:"stall"`
+	Recover duration.Duration `json:"recover" yaml:"recover"`
+	// Interval between reads of the primary high water marks.
+	Interval duration.Duration `json:"interval" yaml:"interval"`
+}
+
+func DefaultFailoverConfig() FailoverConfig {
+	return FailoverConfig{
+		Stall:    duration.Duration(30 * time.Second),
+		Recover:  duration.Duration(time.Minute),
+		Interval: duration.Duration(5 * time.Second),
+	}
+}
+
+func (c *FailoverConfig) Validate() error {
+	if len(c.Brokers) == 0 {
+		return nil
+	}
+	if c.Stall <= 0 {
+		return errors.New("failover.stall: must be positive")
+	}
+	if c.Recover < 0 {
+		return errors.New("failover.recover: must not be negative")
+	}
+	if c.Interval <= 0 || c.Interval > c.Stall {
+		return errors.New("failover.interval: must be positive and at most failover.stall")
+	}
+	if err := c.SASL.Validate(); err != nil {
+		return fmt.Errorf("failover: %w", err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("failover: %w", err)
+	}
+	return nil
+}
+
+// Kafka returns the configuration of the secondary cluster: primary with the
+// settings of c.
+func (c *FailoverConfig) Kafka(primary KafkaConfig) KafkaConfig {
+	secondary := primary
+	secondary.Brokers = c.Brokers
+	if len(c.Topics) > 0 {
+		secondary.Topics = c.Topics
+	}
+	if c.GroupID != "" {
+		secondary.GroupID = c.GroupID
+	}
+	secondary.SASL, secondary.TLS = c.SASL, c.TLS
+	return secondary
+}
+
+// Failover switches consumption to the secondary cluster while the high
+// water marks of the primary topics stand still, because its geyser node or
+// the cluster itself is down, and back once they advance again. The
+// consumers of both clusters write to the same sink: the messages of the
+// source not active are dropped, and so are those of slots older than the
+// other source already wrote, so the overlap of a switch is not delivered
+// twice. The methods of a nil Failover admit every message.
+type Failover struct {
+	config  FailoverConfig
+	primary sarama.Client
+	// topics returns the primary topics.
+	topics func() []string
+
+	mu     sync.Mutex
+	active int
+	// written is the newest slot written from each source.
+	written [2]uint64
+
+	// highWater is the sum of the primary high water marks at the last
+	// check, progressed when it last changed and advancing since when it
+	// changes while the secondary is consumed.
+	highWater  int64
+	progressed time.Time
+	advancing  time.Time
+	// stop cancels the consumer of the secondary, done is closed once it
+	// returned.
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func NewFailover(config FailoverConfig, primary sarama.Client, topics func() []string) *Failover {
+	return &Failover{config: config, primary: primary, topics: topics, progressed: time.Now()}
+}
+
+// Run watches the primary until ctx is done, then stops the consumer of the
+// secondary. consume consumes the secondary from the records produced at
+// from until its ctx is done.
+func (f *Failover) Run(ctx context.Context, consume func(ctx context.Context, from time.Time)) {
+	ticker := time.NewTicker(time.Duration(f.config.Interval))
+	defer ticker.Stop()
+	defer f.stopSecondary()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			f.check(ctx, now, consume)
+		}
+	}
+}
+
+// check reads the primary high water marks at now and switches the source
+// when due.
+func (f *Failover) check(ctx context.Context, now time.Time, consume func(ctx context.Context, from time.Time)) {
+	highWater, err := f.primaryHighWater()
+	if err != nil {
+		logging.Logger.Warn("failed to read the primary high water marks", zap.Error(err))
+	}
+	// a primary that cannot be read does not progress
+	advanced := err == nil && highWater != f.highWater
+	if err == nil {
+		f.highWater = highWater
+	}
+
+	switch f.source() {
+	case sourcePrimary:
+		if advanced {
+			f.progressed = now
+		} else if stalled := now.Sub(f.progressed); stalled >= time.Duration(f.config.Stall) {
+			// the records of the last interval might not have been read yet
+			from := f.progressed.Add(-time.Duration(f.config.Interval))
+			logging.Logger.Warn("primary cluster stopped progressing, consuming the secondary",
+				zap.Duration("stalled", stalled), zap.Time("from", from))
+			f.switchTo(sourceSecondary)
+			f.advancing = time.Time{}
+
+			ctx, f.stop = context.WithCancel(ctx)
+			f.done = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				consume(ctx, from)
+			}(f.done)
+		}
+	case sourceSecondary:
+		if !advanced {
+			f.advancing = time.Time{}
+			return
+		}
+		if f.advancing.IsZero() {
+			f.advancing = now
+		}
+		if now.Sub(f.advancing) >= time.Duration(f.config.Recover) {
+			f.mu.Lock()
+			slot := f.written[sourceSecondary]
+			f.mu.Unlock()
+			logging.Logger.Info("primary cluster progressing again, consuming it", zap.Uint64("after_slot", slot))
+			f.switchTo(sourcePrimary)
+			f.progressed = now
+			f.stopSecondary()
+		}
+	}
+}
+
+// primaryHighWater returns the sum of the high water marks of the primary
+// topics.
+func (f *Failover) primaryHighWater() (int64, error) {
+	var sum int64
+	for _, topic := range f.topics() {
+		partitions, err := f.primary.Partitions(topic)
+		if err != nil {
+			return 0, err
+		}
+		for _, partition := range partitions {
+			offset, err := f.primary.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return 0, err
+			}
+			sum += offset
+		}
+	}
+	return sum, nil
+}
+
+func (f *Failover) source() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+func (f *Failover) switchTo(source int) {
+	f.mu.Lock()
+	f.active = source
+	f.mu.Unlock()
+	metrics.FailoverActive.Set(float64(source))
+	metrics.FailoverSwitchesTotal.WithLabelValues(sourceName(source)).Inc()
+}
+
+// secondaryActive reports whether the secondary is consumed.
+func (f *Failover) secondaryActive() bool {
+	return f != nil && f.source() == sourceSecondary
+}
+
+func (f *Failover) stopSecondary() {
+	if f.stop == nil {
+		return
+	}
+	f.stop()
+	<-f.done
+	f.stop, f.done = nil, nil
+}
+
+// admit reports whether msg consumed from source is written: source is
+// active and the other one wrote no newer slot. Messages without a slot are
+// only checked for the source.
+func (f *Failover) admit(source int, msg *decode.Message) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if source != f.active {
+		return false
+	}
+	if msg.Slot > 0 && msg.Slot < f.written[1-source] {
+		return false
+	}
+	f.written[source] = max(f.written[source], msg.Slot)
+	return true
+}
+
+func sourceName(source int) string {
+	if source == sourceSecondary {
+		return "secondary"
+	}
+	return "primary"
+}
+
+// ConsumeSecondary returns the consume function of Failover.Run: it moves
+// the group of the secondary cluster to the records produced at from and
+// consumes it with a handler writing to the sink of primary, until ctx is
+// done. The filter is the one of primary when the secondary started.
+func ConsumeSecondary(config KafkaConfig, saramaConfig *sarama.Config, health HealthConfig, primary *Handler, failover *Failover) func(ctx context.Context, from time.Time) {
+	return func(ctx context.Context, from time.Time) {
+		if err := SeekGroup(config, saramaConfig, &SeekTarget{Timestamp: from}); err != nil {
+			logging.Logger.Error("failed to reset the secondary group, consuming from its committed offsets", zap.Error(err))
+		}
+		for {
+			err := consumeCluster(ctx, config, saramaConfig, health, primary, failover)
+			if errors.Is(err, ErrOffsetOutOfRange) {
+				logging.Logger.Error("secondary consumer stopped", zap.Error(err))
+				return
+			}
+			if err != nil {
+				logging.Logger.Error("secondary consumer error", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(failover.config.Interval)):
+			}
+		}
+	}
+}
+
+// consumeCluster consumes the secondary cluster until ctx is done or a
+// session fails.
+func consumeCluster(ctx context.Context, config KafkaConfig, saramaConfig *sarama.Config, health HealthConfig, primary *Handler, failover *Failover) error {
+	client, err := sarama.NewClient(config.Brokers, saramaConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(config.GroupID, client)
+	if err != nil {
+		return err
+	}
+	defer consumerGroup.Close()
+	discovery, err := NewTopicDiscovery(client, config)
+	if err != nil {
+		return err
+	}
+	go discovery.Run(ctx)
+	go func() {
+		for err := range consumerGroup.Errors() {
+			logging.Logger.Error("secondary consumer group error", zap.Error(err))
+		}
+	}()
+
+	handler := &Handler{
+		group:        config.GroupID,
+		decoder:      primary.decoder,
+		lookupTables: primary.lookupTables,
+		signatures:   primary.signatures,
+		gaps:         primary.gaps,
+		sink:         primary.sink,
+		dlq:          primary.dlq,
+		processing:   primary.processing,
+		retry:        primary.retry,
+		health:       NewHealth(client, health),
+		throttle:     primary.throttle,
+		committer:    NewOffsetCommitter(client, config.GroupID, saramaConfig.Consumer.Group.InstanceId, config.Commit),
+		offsets:      &ClientOffsets{Client: client, Group: config.GroupID},
+		outOfRange:   config.OffsetOutOfRange,
+		failover:     failover,
+		source:       sourceSecondary,
+	}
+	handler.filter.Store(primary.filter.Load())
+
+	logging.Logger.Info("consuming the secondary cluster",
+		zap.Strings("brokers", config.Brokers), zap.Strings("topics", discovery.Topics()), zap.String("group_id", config.GroupID))
+	for {
+		// a session ends on every rebalance
+		err := ConsumeDiscovered(ctx, consumerGroup, discovery, nil, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
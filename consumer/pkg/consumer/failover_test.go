@@ -0,0 +1,114 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/metrics"
+)
+
+// highWaterClient reports a single partition whose high water mark is
+// offset, or err.
+type highWaterClient struct {
+	sarama.Client
+	offset int64
+	err    error
+}
+
+func (c *highWaterClient) Partitions(string) ([]int32, error) { return []int32{0}, c.err }
+
+func (c *highWaterClient) GetOffset(string, int32, int64) (int64, error) { return c.offset, c.err }
+
+func TestFailover(t *testing.T) {
+	client := &highWaterClient{offset: 100}
+	f := NewFailover(DefaultFailoverConfig(), client, func() []string { return []string{"updates"} })
+	started := make(chan time.Time, 1)
+	consume := func(ctx context.Context, from time.Time) {
+		started <- from
+		<-ctx.Done()
+	}
+	admits := func(source int, slot uint64) bool {
+		return f.admit(source, decodetest.TransactionMessage(slot, testkey.Key(1)))
+	}
+	now := time.Now()
+	switches := testutil.ToFloat64(metrics.FailoverSwitchesTotal.WithLabelValues("primary"))
+	filtered := testutil.ToFloat64(metrics.FilteredTotal.WithLabelValues("secondary", filter.ReasonFailover))
+
+	f.check(context.Background(), now, consume)
+	if !admits(sourcePrimary, 10) || admits(sourceSecondary, 10) {
+		t.Fatal("secondary admitted while the primary progresses")
+	}
+	f.check(context.Background(), now.Add(20*time.Second), consume)
+	if f.secondaryActive() {
+		t.Fatal("failed over before failover.stall")
+	}
+	// an unreadable primary does not progress either
+	client.err = errors.New("broker down")
+	f.check(context.Background(), now.Add(30*time.Second), consume)
+	if !f.secondaryActive() {
+		t.Fatal("no failover after failover.stall")
+	}
+	if from := <-started; !from.Equal(now.Add(-5 * time.Second)) {
+		t.Fatalf("secondary consumed from %s", from)
+	}
+	if got := testutil.ToFloat64(metrics.FailoverActive); got != 1 {
+		t.Fatalf("failover active %g", got)
+	}
+
+	// the slots the primary wrote are skipped on the secondary
+	if admits(sourcePrimary, 11) || admits(sourceSecondary, 9) || !admits(sourceSecondary, 10) || !admits(sourceSecondary, 20) {
+		t.Fatal("wrong messages admitted after the failover")
+	}
+
+	client.err = nil
+	client.offset = 101
+	f.check(context.Background(), now.Add(35*time.Second), consume)
+	client.offset = 102
+	f.check(context.Background(), now.Add(65*time.Second), consume)
+	if !f.secondaryActive() {
+		t.Fatal("switched back before failover.recover")
+	}
+	client.offset = 103
+	f.check(context.Background(), now.Add(95*time.Second), consume)
+	if f.secondaryActive() || f.stop != nil {
+		t.Fatal("secondary still consumed after failover.recover")
+	}
+	if admits(sourceSecondary, 30) || admits(sourcePrimary, 19) || !admits(sourcePrimary, 20) {
+		t.Fatal("wrong messages admitted after the switch back")
+	}
+	if got := testutil.ToFloat64(metrics.FailoverSwitchesTotal.WithLabelValues("primary")) - switches; got != 1 {
+		t.Fatalf("%g switches back", got)
+	}
+
+	// the consumer drops what the failover does not admit
+	sink := &sinktest.RecordSink{}
+	decoder, _ := decode.NewDecoder(decode.Config{Kind: string(decode.KindTransaction)})
+	h := &Handler{
+		decoder:  decoder,
+		sink:     sink,
+		retry:    RetryConfig{MaxAttempts: 1},
+		health:   NewHealth(nil, HealthConfig{}),
+		failover: f,
+		source:   sourceSecondary,
+	}
+	h.filter.Store(&filter.Filter{})
+	value, err := gproto.Marshal(decodetest.TransactionMessage(40, testkey.Key(1)).Update.GetTransaction().GetTransaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.process(context.Background(), claimStub{}, &sarama.ConsumerMessage{Topic: "secondary", Key: []byte("40_hash"), Value: value}, func() {})
+	if len(sink.Written) != 0 || testutil.ToFloat64(metrics.FilteredTotal.WithLabelValues("secondary", filter.ReasonFailover))-filtered != 1 {
+		t.Fatalf("%d written from the secondary", len(sink.Written))
+	}
+}
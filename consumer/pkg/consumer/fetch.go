@@ -0,0 +1,84 @@
+package consumer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/duration"
+)
+
+// FetchConfig tunes the fetch requests of the partition consumers, trading
+// latency for throughput. The defaults are those of sarama, which a zero
+// setting keeps.
+type FetchConfig struct {
+	// MinBytes is the least a broker answers a fetch request with, unless
+	// MaxWait passed first.
+	MinBytes int32 `json:"min_bytes" yaml:"min_bytes"`
+	// DefaultBytes is fetched per partition and request, raised up to
+	// MaxBytes for larger records, without a limit when MaxBytes is 0.
+	DefaultBytes int32             `json:"default_bytes" yaml:"default_bytes"`
+	MaxBytes     int32             `json:"max_bytes" yaml:"max_bytes"`
+	MaxWait      duration.Duration `json:"max_wait" yaml:"max_wait"`
+	// ChannelBufferSize is the number of records buffered per partition
+	// ahead of the consumer, and of the channels of the producers.
+	ChannelBufferSize int `json:"channel_buffer_size" yaml:"channel_buffer_size"`
+	// MaxProcessingTime is how long a record may wait for the consumer to
+	// take it before the partition stops fetching until it does.
+	MaxProcessingTime duration.Duration `json:"max_processing_time" yaml:"max_processing_time"`
+}
+
+func DefaultFetchConfig() FetchConfig {
+	return FetchConfig{
+		MinBytes:          1,
+		DefaultBytes:      1024 * 1024,
+		MaxWait:           duration.Duration(500 * time.Millisecond),
+		ChannelBufferSize: 256,
+		MaxProcessingTime: duration.Duration(100 * time.Millisecond),
+	}
+}
+
+func (c *FetchConfig) Validate() error {
+	if c.MinBytes < 0 {
+		return errors.New("kafka.fetch.min_bytes: must not be negative")
+	}
+	if c.DefaultBytes < 0 {
+		return errors.New("kafka.fetch.default_bytes: must not be negative")
+	}
+	if c.MaxBytes < 0 {
+		return errors.New("kafka.fetch.max_bytes: must not be negative")
+	}
+	if c.MaxBytes > 0 && c.MaxBytes < max(c.MinBytes, c.DefaultBytes) {
+		return errors.New("kafka.fetch.max_bytes: must be at least min_bytes and default_bytes")
+	}
+	if c.MaxWait < 0 || c.MaxWait > 0 && c.MaxWait < duration.Duration(time.Millisecond) {
+		return errors.New("kafka.fetch.max_wait: must be at least 1ms")
+	}
+	if c.ChannelBufferSize < 0 {
+		return errors.New("kafka.fetch.channel_buffer_size: must not be negative")
+	}
+	if c.MaxProcessingTime < 0 {
+		return errors.New("kafka.fetch.max_processing_time: must not be negative")
+	}
+	return nil
+}
+
+func (c *FetchConfig) apply(config *sarama.Config) {
+	if c.MinBytes > 0 {
+		config.Consumer.Fetch.Min = c.MinBytes
+	}
+	if c.DefaultBytes > 0 {
+		config.Consumer.Fetch.Default = c.DefaultBytes
+	}
+	config.Consumer.Fetch.Max = c.MaxBytes
+	if c.MaxWait > 0 {
+		config.Consumer.MaxWaitTime = time.Duration(c.MaxWait)
+	}
+	if c.ChannelBufferSize > 0 {
+		config.ChannelBufferSize = c.ChannelBufferSize
+	}
+	if c.MaxProcessingTime > 0 {
+		config.Consumer.MaxProcessingTime = time.Duration(c.MaxProcessingTime)
+	}
+}
@@ -0,0 +1,685 @@
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IBM/sarama"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/oauth"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// The clients of kafka.client consuming the group.
+const (
+	ClientSarama = "sarama"
+	ClientFranz  = "franz-go"
+)
+
+// NewConsumerGroup returns the consumer group of the client config selects.
+// Both are a sarama.ConsumerGroup, so the handler, its offset commits through
+// client and the admin API work the same with either.
+func NewConsumerGroup(config KafkaConfig, client sarama.Client, saramaConfig *sarama.Config) (sarama.ConsumerGroup, error) {
+	if config.Client == ClientFranz {
+		options, err := franzOptions(config, saramaConfig)
+		if err != nil {
+			return nil, err
+		}
+		return newFranzGroup(config.GroupID, options, saramaConfig.ChannelBufferSize), nil
+	}
+	return sarama.NewConsumerGroupFromClient(config.GroupID, client)
+}
+
+// franzOptions translates the sarama configuration of the consumer group
+// into franz-go options, so kafka.* configures both clients alike.
+// fetch.max_bytes and fetch.max_processing_time have no counterpart: franz-go
+// returns a record larger than the fetch sizes whole, and buffers fetched
+// records ahead of the claims instead of stopping a partition.
+func franzOptions(kafka KafkaConfig, config *sarama.Config) ([]kgo.Opt, error) {
+	options := []kgo.Opt{
+		kgo.SeedBrokers(kafka.Brokers...),
+		kgo.ClientID(config.ClientID),
+		kgo.ConsumerGroup(kafka.GroupID),
+		// offsets are committed by Handler
+		kgo.DisableAutoCommit(),
+		kgo.SessionTimeout(config.Consumer.Group.Session.Timeout),
+		kgo.HeartbeatInterval(config.Consumer.Group.Heartbeat.Interval),
+		kgo.RebalanceTimeout(config.Consumer.Group.Rebalance.Timeout),
+		kgo.FetchMinBytes(config.Consumer.Fetch.Min),
+		kgo.FetchMaxPartitionBytes(config.Consumer.Fetch.Default),
+		kgo.FetchMaxWait(config.Consumer.MaxWaitTime),
+	}
+	if config.Consumer.Offsets.Initial == sarama.OffsetOldest {
+		options = append(options, kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	} else {
+		options = append(options, kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()))
+	}
+	if config.Consumer.IsolationLevel == sarama.ReadCommitted {
+		options = append(options, kgo.FetchIsolationLevel(kgo.ReadCommitted()))
+	}
+	if config.Consumer.Group.InstanceId != "" {
+		options = append(options, kgo.InstanceID(config.Consumer.Group.InstanceId))
+	}
+	// the eager balancers of sarama revoke every partition on a rebalance,
+	// the cooperative one only those moved to another member
+	var balancers []kgo.GroupBalancer
+	for _, strategy := range config.Consumer.Group.Rebalance.GroupStrategies {
+		switch strategy.Name() {
+		case sarama.RoundRobinBalanceStrategyName:
+			balancers = append(balancers, kgo.RoundRobinBalancer())
+		case sarama.RangeBalanceStrategyName:
+			balancers = append(balancers, kgo.RangeBalancer())
+		case sarama.StickyBalanceStrategyName:
+			balancers = append(balancers, kgo.StickyBalancer())
+		}
+	}
+	if kafka.BalanceStrategy == "cooperative-sticky" {
+		balancers = []kgo.GroupBalancer{kgo.CooperativeStickyBalancer()}
+	}
+	options = append(options, kgo.Balancers(balancers...))
+	if config.Net.TLS.Enable {
+		tlsConfig := config.Net.TLS.Config
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		options = append(options, kgo.DialTLSConfig(tlsConfig.Clone()))
+	}
+	if config.Net.SASL.Enable {
+		mechanism, err := franzSASL(config)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, kgo.SASL(mechanism))
+	}
+	return options, nil
+}
+
+func franzSASL(config *sarama.Config) (sasl.Mechanism, error) {
+	c := config.Net.SASL
+	switch c.Mechanism {
+	case sarama.SASLTypePlaintext:
+		return plain.Auth{User: c.User, Pass: c.Password}.AsMechanism(), nil
+	case sarama.SASLTypeSCRAMSHA256:
+		return scram.Auth{User: c.User, Pass: c.Password}.AsSha256Mechanism(), nil
+	case sarama.SASLTypeSCRAMSHA512:
+		return scram.Auth{User: c.User, Pass: c.Password}.AsSha512Mechanism(), nil
+	case sarama.SASLTypeOAuth:
+		// a token for every connection, as sarama asks the provider
+		provider := c.TokenProvider
+		return oauth.Oauth(func(context.Context) (oauth.Auth, error) {
+			token, err := provider.Token()
+			if err != nil {
+				return oauth.Auth{}, err
+			}
+			return oauth.Auth{Token: token.Token, Extensions: token.Extensions}, nil
+		}), nil
+	}
+	return nil, fmt.Errorf("kafka.sasl.mechanism: %s is not supported with kafka.client %s", c.Mechanism, ClientFranz)
+}
+
+// franzGroup is a sarama.ConsumerGroup consuming with franz-go, which fetches
+// the partitions of a broker in one request and decompresses the batches
+// ahead of the claims, where sarama runs goroutines per partition. Records
+// are handed to the handler as sarama messages in sessions like those of
+// sarama: a session starts once the committed offsets of the assigned
+// partitions were fetched, which Setup may move, and ends when they are
+// revoked, a claim returned or the context of Consume is cancelled. A Consume
+// not ended by a rebalance leaves the group, the next one joins it again.
+//
+// With the cooperative balancer a rebalance revokes only the partitions
+// moved to another member, and the client keeps fetching the others. The
+// session still ends with every generation, so offsets are committed with
+// the generation they were consumed in, and the next one claims the kept
+// partitions again from their committed offsets, see start.
+type franzGroup struct {
+	group   string
+	options []kgo.Opt
+	// buffer is the number of messages buffered per claim.
+	buffer int
+	errors chan error
+	// consumers holds the Consume waiting for its session.
+	consumers chan *franzConsume
+
+	mu      sync.Mutex
+	client  *kgo.Client
+	topics  []string
+	session *franzSession
+	// owned are the partitions assigned to the member, at the offsets their
+	// last session started at.
+	owned  map[string]map[int32]kgo.Offset
+	closed bool
+}
+
+// franzConsume is a Consume waiting for its session, started receives it or
+// the error of Setup.
+type franzConsume struct {
+	ctx     context.Context
+	handler sarama.ConsumerGroupHandler
+	started chan franzStart
+}
+
+type franzStart struct {
+	session *franzSession
+	err     error
+}
+
+func newFranzGroup(group string, options []kgo.Opt, buffer int) *franzGroup {
+	return &franzGroup{
+		group:     group,
+		options:   options,
+		buffer:    buffer,
+		errors:    make(chan error, buffer),
+		consumers: make(chan *franzConsume, 1),
+	}
+}
+
+// Consume joins the group for topics unless it is already a member for them,
+// and runs a session of handler until it ends.
+func (g *franzGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	client, err := g.join(topics)
+	if err != nil {
+		return err
+	}
+	consume := &franzConsume{ctx: ctx, handler: handler, started: make(chan franzStart, 1)}
+	g.consumers <- consume
+
+	var start franzStart
+	select {
+	case start = <-consume.started:
+	case <-ctx.Done():
+		select {
+		case <-g.consumers:
+			g.leave(client)
+			return nil
+		case start = <-consume.started:
+		}
+	}
+	if start.err != nil {
+		g.leave(client)
+		return start.err
+	}
+
+	session := start.session
+	closed := g.poll(client, session)
+	session.cancel()
+	<-session.done
+	if closed {
+		return sarama.ErrClosedConsumerGroup
+	}
+	// a session not revoked ended by ctx or by a claim, the next one starts
+	// at the committed offsets once it joined again
+	g.mu.Lock()
+	ended := g.session == session
+	if ended {
+		g.session = nil
+	}
+	g.mu.Unlock()
+	if ended || ctx.Err() != nil {
+		g.leave(client)
+	}
+	return nil
+}
+
+// join returns the client consuming topics, replacing that of other topics.
+func (g *franzGroup) join(topics []string) (*kgo.Client, error) {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil, sarama.ErrClosedConsumerGroup
+	}
+	client := g.client
+	if client != nil && slices.Equal(g.topics, topics) {
+		g.mu.Unlock()
+		return client, nil
+	}
+	g.client, g.topics, g.owned = nil, nil, nil
+	g.mu.Unlock()
+	if client != nil {
+		// revokes the partitions, ending the session of the old topics
+		client.Close()
+	}
+
+	options := append(slices.Clip(g.options),
+		kgo.ConsumeTopics(topics...),
+		kgo.AdjustFetchOffsetsFn(g.assigned),
+		kgo.OnPartitionsAssigned(g.kept),
+		kgo.OnPartitionsRevoked(g.revoked),
+		kgo.OnPartitionsLost(g.revoked))
+	client, err := kgo.NewClient(options...)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		client.Close()
+		return nil, sarama.ErrClosedConsumerGroup
+	}
+	g.client, g.topics = client, slices.Clone(topics)
+	return client, nil
+}
+
+// leave closes client unless it was replaced, so the next Consume joins the
+// group again.
+func (g *franzGroup) leave(client *kgo.Client) {
+	g.mu.Lock()
+	if g.client == client {
+		g.client, g.topics, g.owned = nil, nil, nil
+	}
+	g.mu.Unlock()
+	client.Close()
+}
+
+// assigned starts the session of the waiting Consume with the fetched
+// offsets of the partitions added to the member, and returns them as Setup
+// moved them.
+func (g *franzGroup) assigned(ctx context.Context, offsets map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	return g.start(ctx, g.current(), offsets)
+}
+
+// kept starts the session of the partitions a cooperative rebalance kept,
+// when it added none. Otherwise assigned starts it once the offsets of the
+// added partitions were fetched.
+func (g *franzGroup) kept(ctx context.Context, client *kgo.Client, added map[string][]int32) {
+	g.mu.Lock()
+	owned := len(g.owned) > 0
+	g.mu.Unlock()
+	if len(added) > 0 || !owned {
+		return
+	}
+	if _, err := g.start(ctx, client, nil); err != nil && ctx.Err() == nil {
+		g.error(err)
+	}
+}
+
+// start ends the running session and starts that of the waiting Consume with
+// the added partitions at offsets and the owned ones at their committed
+// offsets, see committed. It returns the offsets of the added partitions as
+// Setup moved them, those of the owned ones are set on client. It waits for a
+// Consume while none is waiting, as the previous session ended by a
+// rebalance returned.
+func (g *franzGroup) start(ctx context.Context, client *kgo.Client, offsets map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	g.end()
+	var consume *franzConsume
+	select {
+	case consume = <-g.consumers:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	g.mu.Lock()
+	owned := maps.Clone(g.owned)
+	g.mu.Unlock()
+	kept, err := g.committed(ctx, client, owned)
+	if err != nil {
+		consume.started <- franzStart{err: err}
+		return nil, err
+	}
+	all := maps.Clone(kept)
+	if all == nil {
+		all = make(map[string]map[int32]kgo.Offset)
+	}
+	for topic, partitions := range offsets {
+		if all[topic] == nil {
+			all[topic] = make(map[int32]kgo.Offset)
+		}
+		maps.Copy(all[topic], partitions)
+	}
+
+	var memberID string
+	var generation int32
+	if client != nil {
+		memberID, generation = client.GroupMetadata()
+	}
+	session := newFranzSession(consume, ctx, memberID, generation, all, g.buffer)
+	if err := consume.handler.Setup(session); err != nil {
+		session.cancel()
+		close(session.done)
+		consume.handler.Cleanup(session)
+		consume.started <- franzStart{err: err}
+		return nil, err
+	}
+	session.setup.Store(true)
+	added := make(map[string]map[int32]kgo.Offset, len(offsets))
+	keep := make(map[string]map[int32]kgo.EpochOffset)
+	for topic, partitions := range session.offsets {
+		for partition, offset := range partitions {
+			if _, ok := offsets[topic][partition]; ok {
+				if added[topic] == nil {
+					added[topic] = make(map[int32]kgo.Offset)
+				}
+				added[topic][partition] = offset
+				continue
+			}
+			if keep[topic] == nil {
+				keep[topic] = make(map[int32]kgo.EpochOffset)
+			}
+			keep[topic][partition] = offset.EpochOffset()
+		}
+	}
+	if len(keep) > 0 {
+		// the records of the previous session not yet processed are
+		// fetched again
+		client.SetOffsets(keep)
+	}
+
+	g.mu.Lock()
+	g.session = session
+	g.owned = make(map[string]map[int32]kgo.Offset, len(session.offsets))
+	for topic, partitions := range session.offsets {
+		g.owned[topic] = maps.Clone(partitions)
+	}
+	g.mu.Unlock()
+	go session.run(g.error)
+	consume.started <- franzStart{session: session}
+	return added, nil
+}
+
+// committed returns the committed offsets of the owned partitions, or the
+// offset their last session started at for those without one.
+func (g *franzGroup) committed(ctx context.Context, client *kgo.Client, owned map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	if len(owned) == 0 {
+		return nil, nil
+	}
+	req := kmsg.NewPtrOffsetFetchRequest()
+	req.Group = g.group
+	offsets := make(map[string]map[int32]kgo.Offset, len(owned))
+	for topic, partitions := range owned {
+		offsets[topic] = maps.Clone(partitions)
+		reqTopic := kmsg.NewOffsetFetchRequestTopic()
+		reqTopic.Topic = topic
+		reqTopic.Partitions = slices.Sorted(maps.Keys(partitions))
+		req.Topics = append(req.Topics, reqTopic)
+	}
+	resp, err := req.RequestWith(ctx, client)
+	if err == nil {
+		err = kerr.ErrorForCode(resp.ErrorCode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch the committed offsets of %s: %w", g.group, err)
+	}
+	for _, topic := range resp.Topics {
+		for _, partition := range topic.Partitions {
+			if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+				return nil, fmt.Errorf("fetch the committed offset of %s/%d: %w", topic.Topic, partition.Partition, err)
+			}
+			if _, ok := offsets[topic.Topic][partition.Partition]; ok && partition.Offset >= 0 {
+				offsets[topic.Topic][partition.Partition] = kgo.NewOffset().At(partition.Offset).WithEpoch(-1)
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// revoked ends the session, once its claims finished and Cleanup committed
+// their offsets, and forgets the partitions lost. A cooperative member is
+// revoked at the end of every generation, losing some or none of them.
+func (g *franzGroup) revoked(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+	g.end()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for topic, partitions := range lost {
+		for _, partition := range partitions {
+			delete(g.owned[topic], partition)
+		}
+		if len(g.owned[topic]) == 0 {
+			delete(g.owned, topic)
+		}
+	}
+}
+
+// end ends the running session and waits until Cleanup returned.
+func (g *franzGroup) end() {
+	g.mu.Lock()
+	session := g.session
+	g.session = nil
+	g.mu.Unlock()
+	if session != nil {
+		session.cancel()
+		<-session.done
+	}
+}
+
+// poll hands the fetched records to the claims of session until it ended,
+// and reports whether the client was closed.
+func (g *franzGroup) poll(client *kgo.Client, session *franzSession) bool {
+	for {
+		fetches := client.PollRecords(session.ctx, 0)
+		if fetches.IsClientClosed() {
+			return true
+		}
+		if session.ctx.Err() != nil {
+			// the records of the session are fetched again by the next one
+			return false
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if !errors.Is(err, context.Canceled) {
+				g.error(&sarama.ConsumerError{Topic: topic, Partition: partition, Err: err})
+			}
+		})
+		fetches.EachPartition(session.dispatch)
+	}
+}
+
+func (g *franzGroup) current() *kgo.Client {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.client
+}
+
+// error reports err on Errors, dropping it when nobody reads them.
+func (g *franzGroup) error(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	select {
+	case g.errors <- err:
+	default:
+	}
+}
+
+func (g *franzGroup) Errors() <-chan error {
+	return g.errors
+}
+
+// Close leaves the group, ending the session.
+func (g *franzGroup) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return sarama.ErrClosedConsumerGroup
+	}
+	g.closed = true
+	client := g.client
+	g.client = nil
+	close(g.errors)
+	g.mu.Unlock()
+	if client != nil {
+		client.Close()
+	}
+	return nil
+}
+
+func (g *franzGroup) Pause(partitions map[string][]int32) {
+	if client := g.current(); client != nil {
+		client.PauseFetchPartitions(partitions)
+	}
+}
+
+func (g *franzGroup) Resume(partitions map[string][]int32) {
+	if client := g.current(); client != nil {
+		client.ResumeFetchPartitions(partitions)
+	}
+}
+
+func (g *franzGroup) PauseAll() {
+	g.mu.Lock()
+	client, topics := g.client, g.topics
+	g.mu.Unlock()
+	if client != nil {
+		client.PauseFetchTopics(topics...)
+	}
+}
+
+func (g *franzGroup) ResumeAll() {
+	if client := g.current(); client != nil {
+		client.ResumeFetchTopics(client.PauseFetchTopics()...)
+		client.ResumeFetchPartitions(client.PauseFetchPartitions(nil))
+	}
+}
+
+// franzSession is the sarama.ConsumerGroupSession of the partitions assigned
+// in a generation of the group.
+type franzSession struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	handler    sarama.ConsumerGroupHandler
+	memberID   string
+	generation int32
+	claims     map[string][]int32
+	partitions map[string]map[int32]*franzClaim
+	// offsets are those the claims start at, moved by MarkOffset and
+	// ResetOffset until setup is set. Offsets are committed by the handler,
+	// see OffsetCommitter, so they are ignored afterwards.
+	offsets map[string]map[int32]kgo.Offset
+	setup   atomic.Bool
+	// done is closed once the claims finished and Cleanup returned.
+	done chan struct{}
+}
+
+// newFranzSession returns the session of offsets, ended by the context of
+// consume or by assigned, that of the group generation.
+func newFranzSession(consume *franzConsume, assigned context.Context, memberID string, generation int32, offsets map[string]map[int32]kgo.Offset, buffer int) *franzSession {
+	ctx, cancel := context.WithCancel(consume.ctx)
+	stop := context.AfterFunc(assigned, cancel)
+	s := &franzSession{
+		ctx:        ctx,
+		cancel:     func() { stop(); cancel() },
+		handler:    consume.handler,
+		memberID:   memberID,
+		generation: generation,
+		claims:     make(map[string][]int32),
+		partitions: make(map[string]map[int32]*franzClaim),
+		offsets:    offsets,
+		done:       make(chan struct{}),
+	}
+	for topic, partitions := range offsets {
+		s.partitions[topic] = make(map[int32]*franzClaim)
+		for partition := range partitions {
+			s.claims[topic] = append(s.claims[topic], partition)
+			s.partitions[topic][partition] = &franzClaim{topic: topic, partition: partition, messages: make(chan *sarama.ConsumerMessage, buffer)}
+		}
+		slices.Sort(s.claims[topic])
+	}
+	return s
+}
+
+// run consumes the claims until the session ends, then calls Cleanup.
+func (s *franzSession) run(report func(error)) {
+	defer close(s.done)
+	var claims sync.WaitGroup
+	for topic, partitions := range s.partitions {
+		for partition, claim := range partitions {
+			claim.initial = s.offsets[topic][partition].EpochOffset().Offset
+			claims.Add(1)
+			go func() {
+				defer claims.Done()
+				// a claim returning ends the session, as with sarama
+				defer s.cancel()
+				if err := s.handler.ConsumeClaim(s, claim); err != nil {
+					report(err)
+				}
+			}()
+		}
+	}
+	<-s.ctx.Done()
+	claims.Wait()
+	if err := s.handler.Cleanup(s); err != nil {
+		report(err)
+	}
+}
+
+// dispatch hands the records of a fetched partition to its claim, until the
+// session ends.
+func (s *franzSession) dispatch(p kgo.FetchTopicPartition) {
+	claim := s.partitions[p.Topic][p.Partition]
+	if claim == nil {
+		return
+	}
+	claim.highWaterMark.Store(p.HighWatermark)
+	for _, record := range p.Records {
+		select {
+		case claim.messages <- franzMessage(record):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// move starts the claim of a partition at offset, during Setup.
+func (s *franzSession) move(topic string, partition int32, offset int64) {
+	if s.setup.Load() {
+		return
+	}
+	if partitions, ok := s.offsets[topic]; ok {
+		if _, ok := partitions[partition]; ok {
+			partitions[partition] = kgo.NewOffset().At(offset).WithEpoch(-1)
+		}
+	}
+}
+
+func (s *franzSession) Claims() map[string][]int32 { return s.claims }
+func (s *franzSession) MemberID() string           { return s.memberID }
+func (s *franzSession) GenerationID() int32        { return s.generation }
+func (s *franzSession) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.move(topic, partition, offset)
+}
+func (s *franzSession) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.move(topic, partition, offset)
+}
+func (s *franzSession) MarkMessage(*sarama.ConsumerMessage, string) {}
+func (s *franzSession) Commit()                                     {}
+func (s *franzSession) Context() context.Context                    { return s.ctx }
+
+// franzClaim is the sarama.ConsumerGroupClaim of an assigned partition.
+type franzClaim struct {
+	topic         string
+	partition     int32
+	initial       int64
+	highWaterMark atomic.Int64
+	messages      chan *sarama.ConsumerMessage
+}
+
+func (c *franzClaim) Topic() string                            { return c.topic }
+func (c *franzClaim) Partition() int32                         { return c.partition }
+func (c *franzClaim) InitialOffset() int64                     { return c.initial }
+func (c *franzClaim) HighWaterMarkOffset() int64               { return c.highWaterMark.Load() }
+func (c *franzClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// franzMessage returns record as a sarama message.
+func franzMessage(record *kgo.Record) *sarama.ConsumerMessage {
+	headers := make([]*sarama.RecordHeader, len(record.Headers))
+	for i, header := range record.Headers {
+		headers[i] = &sarama.RecordHeader{Key: []byte(header.Key), Value: header.Value}
+	}
+	return &sarama.ConsumerMessage{
+		Headers:   headers,
+		Timestamp: record.Timestamp,
+		Key:       record.Key,
+		Value:     record.Value,
+		Topic:     record.Topic,
+		Partition: record.Partition,
+		Offset:    record.Offset,
+	}
+}
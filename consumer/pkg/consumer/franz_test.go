@@ -0,0 +1,204 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"consumer/pkg/duration"
+)
+
+func TestFranzOptions(t *testing.T) {
+	config := KafkaConfig{
+		Brokers: []string{"localhost:9092"}, Topics: []string{"updates"}, GroupID: "group", OffsetReset: "earliest",
+		BalanceStrategy: "sticky", InstanceID: "consumer-1", SessionTimeout: duration.Duration(30 * time.Second),
+		IsolationLevel: "read_committed", SASL: SASLConfig{Mechanism: "SCRAM-SHA-512", Username: "user", Password: "secret"},
+		TLS: TLSConfig{Enable: true},
+	}
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := franzOptions(config, saramaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// validates the options without connecting
+	client, err := kgo.NewClient(append(options, kgo.ConsumeTopics(config.Topics...))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	config.Client, config.BalanceStrategy = ClientFranz, "cooperative-sticky"
+	if saramaConfig, err = config.Sarama(); err != nil {
+		t.Fatal(err)
+	}
+	if options, err = franzOptions(config, saramaConfig); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = kgo.NewClient(append(options, kgo.ConsumeTopics(config.Topics...))...); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeGSSAPI
+	if _, err := franzOptions(config, saramaConfig); err == nil {
+		t.Fatal("GSSAPI accepted")
+	}
+}
+
+// recordingHandler starts partition 0 at offset 5 and records the messages
+// of the claims.
+type recordingHandler struct {
+	setupErr error
+
+	mu       sync.Mutex
+	messages []*sarama.ConsumerMessage
+	claims   []sarama.ConsumerGroupClaim
+	cleanups int
+}
+
+func (h *recordingHandler) Setup(session sarama.ConsumerGroupSession) error {
+	session.ResetOffset("updates", 0, 5, "")
+	return h.setupErr
+}
+
+func (h *recordingHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cleanups++
+	return nil
+}
+
+func (h *recordingHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+		case message := <-claim.Messages():
+			h.mu.Lock()
+			h.messages = append(h.messages, message)
+			h.claims = append(h.claims, claim)
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *recordingHandler) received() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.messages)
+}
+
+func TestFranzGroupSession(t *testing.T) {
+	g := newFranzGroup("group", nil, 4)
+	handler := &recordingHandler{}
+	consume := &franzConsume{ctx: context.Background(), handler: handler, started: make(chan franzStart, 1)}
+	g.consumers <- consume
+
+	offsets, err := g.assigned(context.Background(), map[string]map[int32]kgo.Offset{
+		"updates": {0: kgo.NewOffset().At(10), 1: kgo.NewOffset().AtStart()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := offsets["updates"][0].EpochOffset().Offset; at != 5 {
+		t.Fatalf("partition 0 starts at %d, want 5 as moved by Setup", at)
+	}
+	if at := offsets["updates"][1].EpochOffset().Offset; at != sarama.OffsetOldest {
+		t.Fatalf("partition 1 starts at %d", at)
+	}
+	start := <-consume.started
+	session := start.session
+	if start.err != nil || len(session.Claims()["updates"]) != 2 {
+		t.Fatalf("session %v, %v", session.Claims(), start.err)
+	}
+
+	// ignored once the session started
+	session.MarkOffset("updates", 0, 7, "")
+	session.dispatch(kgo.FetchTopicPartition{Topic: "updates", FetchPartition: kgo.FetchPartition{
+		Partition: 0, HighWatermark: 8,
+		Records: []*kgo.Record{{Topic: "updates", Partition: 0, Offset: 5, Key: []byte("k"), Value: []byte("v"),
+			Headers: []kgo.RecordHeader{{Key: "type", Value: []byte("tx")}}}},
+	}})
+	// not assigned
+	session.dispatch(kgo.FetchTopicPartition{Topic: "updates", FetchPartition: kgo.FetchPartition{
+		Partition: 2, Records: []*kgo.Record{{Topic: "updates", Partition: 2}},
+	}})
+	waitFor(t, func() bool { return handler.received() == 1 })
+	message, claim := handler.messages[0], handler.claims[0]
+	if message.Offset != 5 || string(message.Value) != "v" || string(message.Headers[0].Key) != "type" ||
+		claim.InitialOffset() != 5 || claim.HighWaterMarkOffset() != 8 {
+		t.Fatalf("message %+v of claim at %d", message, claim.InitialOffset())
+	}
+
+	g.revoked(context.Background(), nil, nil)
+	if handler.cleanups != 1 || session.Context().Err() == nil {
+		t.Fatal("revoke did not end the session")
+	}
+}
+
+func TestFranzGroupSetupFails(t *testing.T) {
+	g := newFranzGroup("group", nil, 4)
+	handler := &recordingHandler{setupErr: ErrOffsetOutOfRange}
+	consume := &franzConsume{ctx: context.Background(), handler: handler, started: make(chan franzStart, 1)}
+	g.consumers <- consume
+
+	_, err := g.assigned(context.Background(), map[string]map[int32]kgo.Offset{"updates": {0: kgo.NewOffset().At(10)}})
+	if !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Fatalf("got %v", err)
+	}
+	if start := <-consume.started; !errors.Is(start.err, ErrOffsetOutOfRange) || handler.cleanups != 1 {
+		t.Fatalf("started with %v after %d cleanups", start.err, handler.cleanups)
+	}
+
+	// no Consume is waiting for the next session
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.assigned(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestFranzGroupCooperative(t *testing.T) {
+	g := newFranzGroup("group", nil, 4)
+	handler := &recordingHandler{}
+	consume := &franzConsume{ctx: context.Background(), handler: handler, started: make(chan franzStart, 1)}
+	g.consumers <- consume
+	if _, err := g.assigned(context.Background(), map[string]map[int32]kgo.Offset{
+		"updates": {0: kgo.NewOffset().At(10), 1: kgo.NewOffset().At(20)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	session := (<-consume.started).session
+
+	// the end of a generation revoking nothing ends the session and keeps
+	// the partitions
+	g.revoked(context.Background(), nil, map[string][]int32{})
+	if handler.cleanups != 1 || session.Context().Err() == nil {
+		t.Fatal("the generation did not end the session")
+	}
+	if at := g.owned["updates"][0].EpochOffset().Offset; at != 5 || len(g.owned["updates"]) != 2 {
+		t.Fatalf("owned %v", g.owned)
+	}
+
+	// a partition added is claimed with the kept ones by assigned
+	g.kept(context.Background(), nil, map[string][]int32{"updates": {2}})
+	g.revoked(context.Background(), nil, map[string][]int32{"updates": {0, 1}})
+	if len(g.owned) != 0 {
+		t.Fatalf("owned %v after losing every partition", g.owned)
+	}
+	// no session of kept partitions is started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	g.kept(ctx, nil, nil)
+	if ctx.Err() != nil {
+		t.Fatal("waited for a Consume without partitions kept")
+	}
+}
@@ -0,0 +1,158 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+type GapConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// MinSlots is the shortest run of missing slots reported. A leader skips
+	// up to its four slots on its own, so shorter runs are mostly not data
+	// loss.
+	MinSlots uint64 `json:"min_slots" yaml:"min_slots"`
+	// Window is how far behind the newest slot a slot may still arrive out
+	// of order before it counts as missing.
+	Window uint64 `json:"window" yaml:"window"`
+	// Topic receives a JSON record for every gap, disabled when empty.
+	Topic string `json:"topic" yaml:"topic"`
+}
+
+func (c *GapConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.MinSlots == 0 {
+		return errors.New("gaps.min_slots: must be positive")
+	}
+	if c.Window == 0 {
+		return errors.New("gaps.window: must be positive")
+	}
+	return nil
+}
+
+// slotGap is the record produced to GapConfig.Topic, From and To are the
+// first and last missing slot.
+type slotGap struct {
+	From       uint64    `json:"from"`
+	To         uint64    `json:"to"`
+	Slots      uint64    `json:"slots"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// GapDetector follows the slots of the consumed updates and reports runs of
+// slots none arrived for. Slots a slot update names as skipped by its parent
+// are not missing.
+type GapDetector struct {
+	minSlots uint64
+	window   uint64
+	producer sarama.SyncProducer
+	topic    string
+
+	mu sync.Mutex
+	// settled is the lowest slot still open, every slot below was seen or
+	// reported.
+	settled uint64
+	newest  uint64
+	seen    map[uint64]struct{}
+}
+
+// NewGapDetector returns a detector producing gap records with producer,
+// which may be nil when GapConfig.Topic is empty.
+func NewGapDetector(config GapConfig, producer sarama.SyncProducer) *GapDetector {
+	return &GapDetector{
+		minSlots: config.MinSlots,
+		window:   config.Window,
+		producer: producer,
+		topic:    config.Topic,
+		seen:     make(map[uint64]struct{}),
+	}
+}
+
+// Observe records the slot of msg. Updates without a slot are ignored.
+func (d *GapDetector) Observe(msg *decode.Message) {
+	if msg.Slot == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.settled == 0 {
+		d.settled = msg.Slot
+	}
+	d.see(msg.Slot)
+	if update := msg.Update.GetSlot(); update != nil && update.Parent != nil {
+		for skipped := update.GetParent() + 1; skipped < msg.Slot; skipped++ {
+			d.see(skipped)
+		}
+	}
+	if msg.Slot > d.newest {
+		d.newest = msg.Slot
+		d.settle()
+	}
+}
+
+func (d *GapDetector) see(slot uint64) {
+	if slot >= d.settled {
+		d.seen[slot] = struct{}{}
+	}
+}
+
+// settle closes the slots more than window behind the newest one, reporting
+// the runs of missing slots among them.
+func (d *GapDetector) settle() {
+	if d.newest < d.window || d.newest-d.window <= d.settled {
+		return
+	}
+	horizon := d.newest - d.window
+	seen := slices.Sorted(maps.Keys(d.seen))
+	for _, slot := range seen {
+		if slot >= horizon {
+			break
+		}
+		if slot > d.settled {
+			d.report(d.settled, slot-1)
+		}
+		d.settled = slot + 1
+		delete(d.seen, slot)
+	}
+	// a run of missing slots reaching the horizon is reported once it ends
+}
+
+func (d *GapDetector) report(from, to uint64) {
+	slots := to - from + 1
+	if slots < d.minSlots {
+		return
+	}
+	metrics.SlotGapsTotal.Inc()
+	metrics.MissingSlotsTotal.Add(float64(slots))
+	logging.Logger.Warn("slots missing from the consumed topics",
+		zap.Uint64("from", from), zap.Uint64("to", to), zap.Uint64("slots", slots))
+
+	if d.producer == nil {
+		return
+	}
+	value, err := json.Marshal(slotGap{From: from, To: to, Slots: slots, DetectedAt: time.Now().UTC()})
+	if err == nil {
+		_, _, err = d.producer.SendMessage(&sarama.ProducerMessage{
+			Topic: d.topic,
+			Key:   sarama.StringEncoder(fmt.Sprintf("%d_%d", from, to)),
+			Value: sarama.ByteEncoder(value),
+		})
+	}
+	if err != nil {
+		logging.Logger.Error("failed to produce gap record", zap.String("topic", d.topic), zap.Error(err))
+	}
+}
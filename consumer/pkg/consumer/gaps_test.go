@@ -0,0 +1,121 @@
+package consumer
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// gapProducer keeps the gap records produced.
+type gapProducer struct {
+	sarama.SyncProducer
+	keys []string
+	gaps []slotGap
+}
+
+func (p *gapProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	key, _ := msg.Key.Encode()
+	value, _ := msg.Value.Encode()
+	var gap slotGap
+	if err := json.Unmarshal(value, &gap); err != nil {
+		return 0, 0, err
+	}
+	p.keys = append(p.keys, string(key))
+	p.gaps = append(p.gaps, gap)
+	return 0, int64(len(p.gaps)), nil
+}
+
+func observeSlots(d *GapDetector, slots ...uint64) {
+	for _, slot := range slots {
+		d.Observe(decodetest.AccountMessage(slot, testkey.Key(1), testkey.Key(2)))
+	}
+}
+
+func TestGapDetector(t *testing.T) {
+	tests := []struct {
+		name  string
+		slots []uint64
+		// parents adds a slot update of the slot with the parent
+		parents map[uint64]uint64
+		want    [][2]uint64
+	}{
+		{
+			name:  "contiguous",
+			slots: []uint64{10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		},
+		{
+			name:  "missing run",
+			slots: []uint64{10, 11, 15, 16, 17, 18, 19, 20, 21},
+			want:  [][2]uint64{{12, 14}},
+		},
+		{
+			name:  "run shorter than min_slots",
+			slots: []uint64{10, 12, 13, 14, 15, 16, 17, 18},
+		},
+		{
+			name:  "out of order within the window",
+			slots: []uint64{10, 14, 11, 12, 13, 15, 16, 17, 18, 19, 20},
+		},
+		{
+			name:  "late after the window",
+			slots: []uint64{10, 14, 15, 16, 17, 18, 19, 11, 20, 21, 22},
+			want:  [][2]uint64{{11, 13}},
+		},
+		{
+			name:    "skipped by the parent",
+			slots:   []uint64{10, 11, 16, 17, 18, 19, 20, 21},
+			parents: map[uint64]uint64{16: 11},
+		},
+		{
+			name:  "run reaching the horizon reported once it ends",
+			slots: []uint64{10, 40, 44, 45, 46, 47, 48},
+			want:  [][2]uint64{{11, 39}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer := &gapProducer{}
+			d := NewGapDetector(GapConfig{Enable: true, MinSlots: 2, Window: 4, Topic: "gaps"}, producer)
+			for _, slot := range tt.slots {
+				if parent, ok := tt.parents[slot]; ok {
+					d.Observe(decodetest.SlotMessage(slot, parent, proto.CommitmentLevel_PROCESSED))
+				}
+				observeSlots(d, slot)
+			}
+			var got [][2]uint64
+			for _, gap := range producer.gaps {
+				if gap.Slots != gap.To-gap.From+1 || gap.DetectedAt.IsZero() {
+					t.Errorf("gap record %+v", gap)
+				}
+				got = append(got, [2]uint64{gap.From, gap.To})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("gaps %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGapDetectorRecordKey(t *testing.T) {
+	producer := &gapProducer{}
+	d := NewGapDetector(GapConfig{Enable: true, MinSlots: 1, Window: 2, Topic: "gaps"}, producer)
+	observeSlots(d, 100, 103, 104, 105, 106)
+	if !slices.Equal(producer.keys, []string{"101_102"}) {
+		t.Fatalf("keys %v", producer.keys)
+	}
+}
+
+func TestGapDetectorWithoutProducer(t *testing.T) {
+	d := NewGapDetector(GapConfig{Enable: true, MinSlots: 1, Window: 2}, nil)
+	observeSlots(d, 100, 103, 104, 105, 106)
+	d.Observe(decodetest.TransactionMessage(0, testkey.Key(1)))
+	if d.settled != 104 || d.newest != 106 {
+		t.Fatalf("settled %d, newest %d", d.settled, d.newest)
+	}
+}
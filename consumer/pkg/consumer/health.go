@@ -0,0 +1,237 @@
+package consumer
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/duration"
+)
+
+type HealthConfig struct {
+	// StallTimeout is how long a partition with unread messages may go
+	// without progress, or the consumer without a group session, before
+	// /healthz fails.
+	StallTimeout duration.Duration `json:"stall_timeout" yaml:"stall_timeout"`
+}
+
+func (c *HealthConfig) Validate() error {
+	if c.StallTimeout <= 0 {
+		return errors.New("health.stall_timeout: must be positive")
+	}
+	return nil
+}
+
+// Health tracks group membership and consumption progress for the /healthz
+// and /readyz endpoints. The Handler calls Setup, Cleanup, Claimed and
+// Processed for its sessions.
+type Health struct {
+	client       sarama.Client
+	stallTimeout time.Duration
+	// Failover excuses the primary from being in a session while the
+	// secondary is consumed.
+	Failover *Failover
+
+	mu         sync.Mutex
+	inSession  bool
+	memberID   string
+	generation int32
+	// changed is when the consumer last joined or left a session.
+	changed time.Time
+	claims  map[topicPartition]*claimProgress
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// claimProgress is the next offset to process of a claim, when it last
+// moved and when the last message processed was produced.
+type claimProgress struct {
+	claim    sarama.ConsumerGroupClaim
+	next     int64
+	updated  time.Time
+	produced time.Time
+}
+
+// NewHealth returns the health of a consumer reading the high water marks
+// with client.
+func NewHealth(client sarama.Client, config HealthConfig) *Health {
+	return &Health{
+		client:       client,
+		stallTimeout: time.Duration(config.StallTimeout),
+		changed:      time.Now(),
+		claims:       make(map[topicPartition]*claimProgress),
+	}
+}
+
+// Setup records that the consumer joined session.
+func (h *Health) Setup(session sarama.ConsumerGroupSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inSession = true
+	h.memberID = session.MemberID()
+	h.generation = session.GenerationID()
+	h.changed = time.Now()
+}
+
+// Cleanup records that the consumer left its session.
+func (h *Health) Cleanup() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inSession = false
+	h.changed = time.Now()
+	clear(h.claims)
+}
+
+// Claimed records a claim of the session, whose progress is followed from
+// its initial offset.
+func (h *Health) Claimed(claim sarama.ConsumerGroupClaim) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.claims[topicPartition{claim.Topic(), claim.Partition()}] = &claimProgress{
+		claim:   claim,
+		next:    claim.InitialOffset(),
+		updated: time.Now(),
+	}
+}
+
+// Processed records that a message of a claim was handled.
+func (h *Health) Processed(message *sarama.ConsumerMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.claims[topicPartition{message.Topic, message.Partition}]; ok && message.Offset >= p.next {
+		p.next = message.Offset + 1
+		p.updated = time.Now()
+		p.produced = message.Timestamp
+	}
+}
+
+// partitionProgress is the progress of a claimed partition.
+type partitionProgress struct {
+	topic     string
+	partition int32
+	next      int64
+	produced  time.Time
+}
+
+// progress returns the progress of the claimed partitions.
+func (h *Health) progress() []partitionProgress {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	progress := make([]partitionProgress, 0, len(h.claims))
+	for tp, p := range h.claims {
+		progress = append(progress, partitionProgress{tp.topic, tp.partition, p.next, p.produced})
+	}
+	return progress
+}
+
+// HealthPartition is a claimed partition of a HealthStatus.
+type HealthPartition struct {
+	Topic         string `json:"topic"`
+	Partition     int32  `json:"partition"`
+	Offset        int64  `json:"offset"`
+	HighWatermark int64  `json:"high_watermark"`
+	Stalled       bool   `json:"stalled,omitempty"`
+}
+
+// HealthStatus is the state /healthz and /readyz answer with.
+type HealthStatus struct {
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	InSession  bool              `json:"in_session"`
+	MemberID   string            `json:"member_id,omitempty"`
+	Generation int32             `json:"generation,omitempty"`
+	Brokers    int               `json:"connected_brokers"`
+	Failover   bool              `json:"failover,omitempty"`
+	Partitions []HealthPartition `json:"partitions"`
+}
+
+// Status reports the current state, live tells whether the consumer is
+// making progress and ready whether it can consume.
+func (h *Health) Status(now time.Time) (status HealthStatus, live, ready error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status = HealthStatus{
+		InSession:  h.inSession,
+		MemberID:   h.memberID,
+		Generation: h.generation,
+		Failover:   h.Failover.secondaryActive(),
+		Partitions: make([]HealthPartition, 0, len(h.claims)),
+	}
+	for _, broker := range h.client.Brokers() {
+		if connected, _ := broker.Connected(); connected {
+			status.Brokers++
+		}
+	}
+
+	switch {
+	case status.Failover:
+		// the primary cluster may well be down while the secondary is consumed
+	case !h.inSession:
+		ready = errors.New("not in a group session")
+		if since := now.Sub(h.changed); since > h.stallTimeout {
+			live = fmt.Errorf("not in a group session for %s", since.Round(time.Second))
+		}
+	case status.Brokers == 0:
+		ready = errors.New("no broker connected")
+	}
+
+	for tp, p := range h.claims {
+		partition := HealthPartition{
+			Topic:         tp.topic,
+			Partition:     tp.partition,
+			Offset:        p.next,
+			HighWatermark: p.claim.HighWaterMarkOffset(),
+		}
+		// the start offset is unknown until the first message arrives
+		if since := now.Sub(p.updated); p.next >= 0 && partition.HighWatermark > p.next && since > h.stallTimeout {
+			partition.Stalled = true
+			if live == nil {
+				live = fmt.Errorf("partition %s/%d stalled at offset %d for %s", tp.topic, tp.partition, p.next, since.Round(time.Second))
+			}
+		}
+		status.Partitions = append(status.Partitions, partition)
+	}
+	slices.SortFunc(status.Partitions, func(a, b HealthPartition) int {
+		return cmp.Or(strings.Compare(a.Topic, b.Topic), cmp.Compare(a.Partition, b.Partition))
+	})
+	return status, live, ready
+}
+
+// ServeLive answers /healthz, failing when the consumer is wedged so it gets
+// restarted.
+func (h *Health) ServeLive(w http.ResponseWriter, _ *http.Request) {
+	status, live, _ := h.Status(time.Now())
+	writeHealth(w, status, live)
+}
+
+// ServeReady answers /readyz, failing while the consumer is not in a group
+// session or has no broker connection.
+func (h *Health) ServeReady(w http.ResponseWriter, _ *http.Request) {
+	status, _, ready := h.Status(time.Now())
+	writeHealth(w, status, ready)
+}
+
+func writeHealth(w http.ResponseWriter, status HealthStatus, err error) {
+	code := http.StatusOK
+	status.Status = "ok"
+	if err != nil {
+		code = http.StatusServiceUnavailable
+		status.Status = "error"
+		status.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,200 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/internal/hostname"
+	"consumer/pkg/duration"
+)
+
+// KafkaConfig selects the cluster, the topics and the consumer group.
+type KafkaConfig struct {
+	Brokers []string `json:"brokers" yaml:"brokers"`
+	Topics  []string `json:"topics" yaml:"topics"`
+	GroupID string   `json:"group_id" yaml:"group_id"`
+	// TopicPattern consumes the existing topics whose whole name the regular
+	// expression matches besides Topics, looked up every TopicRefresh, see
+	// TopicDiscovery.
+	TopicPattern string            `json:"topic_pattern" yaml:"topic_pattern"`
+	TopicRefresh duration.Duration `json:"topic_refresh" yaml:"topic_refresh"`
+	// OffsetReset is where a group without committed offsets starts: earliest or latest.
+	OffsetReset string `json:"offset_reset" yaml:"offset_reset"`
+	// OffsetOutOfRange is where a partition whose committed offset is no
+	// longer retained starts: earliest, latest, or fail to stop the consumer.
+	OffsetOutOfRange string       `json:"offset_out_of_range" yaml:"offset_out_of_range"`
+	Commit           CommitConfig `json:"commit" yaml:"commit"`
+	Fetch            FetchConfig  `json:"fetch" yaml:"fetch"`
+	// Producer configures the records produced to the dlq and retry topics,
+	// by dedup and by grpc2kafka.
+	Producer ProducerConfig `json:"producer" yaml:"producer"`
+	// BalanceStrategy assigns the partitions among the members: roundrobin
+	// (when empty), range or sticky, which keeps the assignments of the
+	// members across rebalances.
+	BalanceStrategy string `json:"balance_strategy" yaml:"balance_strategy"`
+	// InstanceID makes the consumer a static member of the group, {hostname}
+	// is replaced by the host name. A static member restarting within
+	// SessionTimeout gets its partitions back without a rebalance.
+	InstanceID     string            `json:"instance_id" yaml:"instance_id"`
+	SessionTimeout duration.Duration `json:"session_timeout" yaml:"session_timeout"`
+	// IsolationLevel is read_uncommitted (when empty), or read_committed to
+	// skip the records of aborted transactions and stop at the first open
+	// one, as written by dedup with a transactional_id.
+	IsolationLevel string `json:"isolation_level" yaml:"isolation_level"`
+	// Client consumes the group with sarama (when empty) or franz-go, which
+	// fetches the partitions of many topics with fewer requests, see
+	// franzGroup. The other requests are made with sarama either way.
+	Client string     `json:"client" yaml:"client"`
+	SASL   SASLConfig `json:"sasl" yaml:"sasl"`
+	TLS    TLSConfig  `json:"tls" yaml:"tls"`
+}
+
+// Validate reports the first invalid setting of the kafka section.
+func (c *KafkaConfig) Validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("kafka.brokers: at least one broker is required")
+	}
+	if len(c.Topics) == 0 && c.TopicPattern == "" {
+		return errors.New("kafka.topics: at least one topic or kafka.topic_pattern is required")
+	}
+	if c.GroupID == "" {
+		return errors.New("kafka.group_id: must not be empty")
+	}
+	if _, err := c.initialOffset(); err != nil {
+		return err
+	}
+	switch c.OffsetOutOfRange {
+	case "earliest", "latest", "fail":
+	default:
+		return fmt.Errorf("kafka.offset_out_of_range: expected earliest, latest or fail, got %q", c.OffsetOutOfRange)
+	}
+	if err := c.Commit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Fetch.Validate(); err != nil {
+		return err
+	}
+	if err := c.Producer.Validate(); err != nil {
+		return err
+	}
+	if _, err := c.balanceStrategy(); err != nil {
+		return err
+	}
+	if c.SessionTimeout <= 0 {
+		return errors.New("kafka.session_timeout: must be positive")
+	}
+	if _, err := c.isolationLevel(); err != nil {
+		return err
+	}
+	switch c.Client {
+	case "", ClientSarama, ClientFranz:
+	default:
+		return fmt.Errorf("kafka.client: expected sarama or franz-go, got %q", c.Client)
+	}
+	if err := c.SASL.Validate(); err != nil {
+		return err
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *KafkaConfig) initialOffset() (int64, error) {
+	switch c.OffsetReset {
+	case "earliest":
+		return sarama.OffsetOldest, nil
+	case "latest":
+		return sarama.OffsetNewest, nil
+	}
+	return 0, fmt.Errorf("kafka.offset_reset: expected earliest or latest, got %q", c.OffsetReset)
+}
+
+func (c *KafkaConfig) balanceStrategy() (sarama.BalanceStrategy, error) {
+	switch c.BalanceStrategy {
+	case "", "roundrobin":
+		return sarama.NewBalanceStrategyRoundRobin(), nil
+	case "range":
+		return sarama.NewBalanceStrategyRange(), nil
+	case "sticky":
+		return sarama.NewBalanceStrategySticky(), nil
+	case "cooperative-sticky":
+		if c.Client != ClientFranz {
+			return nil, errors.New("kafka.balance_strategy: cooperative-sticky needs the incremental rebalance protocol, which sarama does not implement, use kafka.client: franz-go or sticky with instance_id")
+		}
+		// franz-go balances with its cooperative balancer, see franzOptions
+		return sarama.NewBalanceStrategySticky(), nil
+	}
+	return nil, fmt.Errorf("kafka.balance_strategy: expected roundrobin, range, sticky or cooperative-sticky, got %q", c.BalanceStrategy)
+}
+
+// instanceID returns InstanceID with the host name filled in.
+func (c *KafkaConfig) instanceID() (string, error) {
+	return hostname.Expand("kafka.instance_id", c.InstanceID)
+}
+
+func (c *KafkaConfig) isolationLevel() (sarama.IsolationLevel, error) {
+	switch c.IsolationLevel {
+	case "", "read_uncommitted":
+		return sarama.ReadUncommitted, nil
+	case "read_committed":
+		return sarama.ReadCommitted, nil
+	}
+	return 0, fmt.Errorf("kafka.isolation_level: expected read_uncommitted or read_committed, got %q", c.IsolationLevel)
+}
+
+// Sarama builds the client configuration for the consumer group.
+func (c *KafkaConfig) Sarama() (*sarama.Config, error) {
+	initial, err := c.initialOffset()
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := c.balanceStrategy()
+	if err != nil {
+		return nil, err
+	}
+	instanceID, err := c.instanceID()
+	if err != nil {
+		return nil, err
+	}
+	isolation, err := c.isolationLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{strategy}
+	if c.SessionTimeout > 0 {
+		config.Consumer.Group.Session.Timeout = time.Duration(c.SessionTimeout)
+		// the heartbeat has to be well within the session timeout
+		config.Consumer.Group.Heartbeat.Interval = min(config.Consumer.Group.Heartbeat.Interval, time.Duration(c.SessionTimeout)/3)
+	}
+	if instanceID != "" {
+		// static membership came with Kafka 2.3
+		config.Consumer.Group.InstanceId = instanceID
+		config.Version = sarama.V2_3_0_0
+	}
+	config.Consumer.Offsets.Initial = initial
+	config.Consumer.IsolationLevel = isolation
+	// out of range offsets are recovered by Handler.Setup, sarama
+	// only resets those aged out in between
+	config.Consumer.Group.ResetInvalidOffsets = c.OffsetOutOfRange != "fail"
+	config.Consumer.Return.Errors = true
+	c.Fetch.apply(config)
+	// offsets are committed by Handler so commits can be observed
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	// required by the dead-letter producer
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	if err := c.Producer.apply(config); err != nil {
+		return nil, err
+	}
+	c.SASL.apply(config)
+	if err := c.TLS.apply(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
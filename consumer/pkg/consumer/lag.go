@@ -0,0 +1,131 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// LagConfig publishes the lag of the claimed partitions for autoscalers and
+// optionally stops the consumer when it falls too far behind.
+type LagConfig struct {
+	// Interval between reads of the high water marks of the claimed
+	// partitions.
+	Interval duration.Duration `json:"interval" yaml:"interval"`
+	// Window is the time constant of the exponential moving average of
+	// consumer_seconds_behind_head.
+	Window duration.Duration `json:"window" yaml:"window"`
+	// MaxExit stops the consumer with a failure status once the lag summed
+	// over its partitions stayed above it for ExitAfter, disabled when 0.
+	MaxExit   int64             `json:"max_exit" yaml:"max_exit"`
+	ExitAfter duration.Duration `json:"exit_after" yaml:"exit_after"`
+}
+
+func DefaultLagConfig() LagConfig {
+	return LagConfig{
+		Interval:  duration.Duration(10 * time.Second),
+		Window:    duration.Duration(time.Minute),
+		ExitAfter: duration.Duration(time.Minute),
+	}
+}
+
+func (c *LagConfig) Validate() error {
+	if c.Interval <= 0 {
+		return errors.New("lag.interval: must be positive")
+	}
+	if c.Window < c.Interval {
+		return errors.New("lag.window: must be at least lag.interval")
+	}
+	if c.MaxExit < 0 {
+		return errors.New("lag.max_exit: must not be negative")
+	}
+	if c.ExitAfter < 0 {
+		return errors.New("lag.exit_after: must not be negative")
+	}
+	return nil
+}
+
+// LagMonitor reads the high water marks of the partitions claimed in health
+// every lag.interval, so the lag gauges keep growing while the consumer is
+// stuck instead of freezing at the last message processed.
+type LagMonitor struct {
+	config LagConfig
+	client sarama.Client
+	health *Health
+	// behind is the smoothed seconds behind head, exceeded since when the lag
+	// is above lag.max_exit.
+	behind   float64
+	exceeded time.Time
+}
+
+func NewLagMonitor(config LagConfig, client sarama.Client, health *Health) *LagMonitor {
+	return &LagMonitor{config: config, client: client, health: health}
+}
+
+// Run publishes the lag until ctx is done, it returns an error once the lag
+// stayed above lag.max_exit for lag.exit_after.
+func (m *LagMonitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Duration(m.config.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := m.check(now); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// check publishes the lag at now.
+func (m *LagMonitor) check(now time.Time) error {
+	var total int64
+	var behind time.Duration
+	for _, p := range m.health.progress() {
+		// the start offset is unknown until the first message arrives
+		if p.next < 0 {
+			continue
+		}
+		newest, err := m.client.GetOffset(p.topic, p.partition, sarama.OffsetNewest)
+		if err != nil {
+			logging.Logger.Warn("failed to read the high water mark", zap.String("topic", p.topic), zap.Int32("partition", p.partition), zap.Error(err))
+			continue
+		}
+		metrics.SetPartitionLag(p.topic, p.partition, newest, p.next-1)
+		lag := max(newest-p.next, 0)
+		total += lag
+		// a partition read to its end is not behind, however old its last
+		// record
+		if lag > 0 && !p.produced.IsZero() {
+			behind = max(behind, now.Sub(p.produced))
+		}
+	}
+
+	alpha := 1 - math.Exp(-float64(m.config.Interval)/float64(m.config.Window))
+	m.behind += alpha * (behind.Seconds() - m.behind)
+	metrics.SecondsBehindHead.Set(m.behind)
+
+	if m.config.MaxExit == 0 || total <= m.config.MaxExit {
+		m.exceeded = time.Time{}
+		return nil
+	}
+	if m.exceeded.IsZero() {
+		m.exceeded = now
+		logging.Logger.Warn("lag above lag.max_exit", zap.Int64("lag", total), zap.Int64("max_exit", m.config.MaxExit))
+	}
+	if since := now.Sub(m.exceeded); since >= time.Duration(m.config.ExitAfter) {
+		return fmt.Errorf("lag of %d messages above lag.max_exit %d for %s", total, m.config.MaxExit, since.Round(time.Second))
+	}
+	return nil
+}
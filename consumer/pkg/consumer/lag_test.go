@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"consumer/pkg/duration"
+	"consumer/pkg/metrics"
+)
+
+func TestLagMonitor(t *testing.T) {
+	client := &highWaterClient{offset: 100}
+	health := NewHealth(client, HealthConfig{StallTimeout: duration.Duration(time.Minute)})
+	health.Claimed(partitionClaim{partition: 0, offset: 40})
+	health.Claimed(partitionClaim{partition: 1, offset: 90})
+	// the start of a claim from the newest offset is unknown
+	health.Claimed(partitionClaim{partition: 2, offset: sarama.OffsetNewest})
+
+	now := time.Now()
+	health.Processed(&sarama.ConsumerMessage{Topic: "updates", Partition: 0, Offset: 59, Timestamp: now.Add(-60 * time.Second)})
+	// read to its end, however old
+	health.Processed(&sarama.ConsumerMessage{Topic: "updates", Partition: 1, Offset: 99, Timestamp: now.Add(-time.Hour)})
+
+	config := DefaultLagConfig()
+	config.MaxExit = 30
+	m := NewLagMonitor(config, client, health)
+	if err := m.check(now); err != nil {
+		t.Fatal(err)
+	}
+	if lag := testutil.ToFloat64(metrics.PartitionLag.WithLabelValues("updates", "0")); lag != 40 {
+		t.Fatalf("lag %g", lag)
+	}
+	if lag := testutil.ToFloat64(metrics.PartitionLag.WithLabelValues("updates", "1")); lag != 0 {
+		t.Fatalf("lag %g", lag)
+	}
+	// a sixth of the way after one interval of a window of a minute
+	if behind := testutil.ToFloat64(metrics.SecondsBehindHead); behind < 9 || behind > 10 {
+		t.Fatalf("%gs behind head", behind)
+	}
+
+	if err := m.check(now.Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	err := m.check(now.Add(time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "lag of 40 messages") {
+		t.Fatalf("got %v", err)
+	}
+
+	// the lag has to stay above lag.max_exit
+	client.offset = 61
+	if err := m.check(now.Add(2 * time.Minute)); err != nil || !m.exceeded.IsZero() {
+		t.Fatalf("got %v, exceeded since %s", err, m.exceeded)
+	}
+}
@@ -0,0 +1,157 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// ErrOffsetOutOfRange ends the consumer when a committed offset is out of
+// range and kafka.offset_out_of_range is fail.
+var ErrOffsetOutOfRange = errors.New("committed offset out of range")
+
+// GroupOffsets reads the committed offsets of a group and the offsets the
+// partitions retain.
+type GroupOffsets interface {
+	// Committed returns the next offset of every partition, -1 when none was
+	// committed.
+	Committed(claims map[string][]int32) (map[string]map[int32]int64, error)
+	// Retained returns the oldest offset and the high water mark.
+	Retained(topic string, partition int32) (oldest, newest int64, err error)
+}
+
+// ClientOffsets reads the offsets of group with the client of the consumer.
+type ClientOffsets struct {
+	Client sarama.Client
+	Group  string
+}
+
+// Committed implements GroupOffsets.
+func (o *ClientOffsets) Committed(claims map[string][]int32) (map[string]map[int32]int64, error) {
+	coordinator, err := o.Client.Coordinator(o.Group)
+	if err != nil {
+		return nil, err
+	}
+	// version 1 reads the offsets committed to Kafka rather than ZooKeeper
+	request := &sarama.OffsetFetchRequest{ConsumerGroup: o.Group, Version: 1}
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			request.AddPartition(topic, partition)
+		}
+	}
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return nil, err
+	}
+	committed := make(map[string]map[int32]int64, len(claims))
+	for topic, partitions := range claims {
+		committed[topic] = make(map[int32]int64, len(partitions))
+		for _, partition := range partitions {
+			block := response.GetBlock(topic, partition)
+			if block == nil {
+				committed[topic][partition] = -1
+				continue
+			}
+			if !errors.Is(block.Err, sarama.ErrNoError) {
+				return nil, fmt.Errorf("%s/%d: %w", topic, partition, block.Err)
+			}
+			committed[topic][partition] = block.Offset
+		}
+	}
+	return committed, nil
+}
+
+// Retained implements GroupOffsets.
+func (o *ClientOffsets) Retained(topic string, partition int32) (int64, int64, error) {
+	oldest, err := o.Client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, err
+	}
+	newest, err := o.Client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+	return oldest, newest, nil
+}
+
+// recoverOffsets moves the claimed partitions whose committed offset is no
+// longer retained, aged out by retention or past a truncated partition, to
+// the oldest or newest offset before they are consumed. Sarama would
+// otherwise silently start them at kafka.offset_reset. With fail it returns
+// ErrOffsetOutOfRange instead.
+func recoverOffsets(session sarama.ConsumerGroupSession, offsets GroupOffsets, fallback string) error {
+	committed, err := offsets.Committed(session.Claims())
+	if err != nil {
+		return fmt.Errorf("fetch committed offsets: %w", err)
+	}
+	for topic, partitions := range committed {
+		for partition, offset := range partitions {
+			if offset < 0 {
+				continue
+			}
+			oldest, newest, err := offsets.Retained(topic, partition)
+			if err != nil {
+				return fmt.Errorf("fetch offsets of %s/%d: %w", topic, partition, err)
+			}
+			if offset >= oldest && offset <= newest {
+				continue
+			}
+
+			metrics.OffsetOutOfRangeTotal.WithLabelValues(topic, fallback).Inc()
+			fields := []zap.Field{
+				zap.String("topic", topic), zap.Int32("partition", partition), zap.Int64("committed", offset),
+				zap.Int64("oldest", oldest), zap.Int64("newest", newest), zap.String("fallback", fallback),
+			}
+			if fallback == "fail" {
+				logging.Logger.Error("committed offset out of range", fields...)
+				return fmt.Errorf("%s/%d: %w: %d not in [%d, %d]", topic, partition, ErrOffsetOutOfRange, offset, oldest, newest)
+			}
+			logging.Logger.Warn("committed offset out of range, resetting", fields...)
+			next := oldest
+			if fallback == "latest" {
+				next = newest
+			}
+			// MarkOffset only moves forward and ResetOffset only backward
+			if next > offset {
+				session.MarkOffset(topic, partition, next, "")
+			} else {
+				session.ResetOffset(topic, partition, next, "")
+			}
+		}
+	}
+	return nil
+}
+
+// StoredOffsets is implemented by sinks storing the next offset of every
+// partition in the same transaction as the data, see
+// sink.PostgresConfig.OffsetsTable.
+type StoredOffsets interface {
+	StoredOffsets(ctx context.Context, claims map[string][]int32) (map[string]map[int32]int64, error)
+}
+
+// seekStoredOffsets starts the claimed partitions at the offsets stored by
+// the sink. They are ahead of the committed offsets when the consumer stopped
+// between a write and the next commit, and win over them so nothing written
+// is written again.
+func seekStoredOffsets(session sarama.ConsumerGroupSession, stored StoredOffsets) error {
+	offsets, err := stored.StoredOffsets(session.Context(), session.Claims())
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			logging.Logger.Debug("starting at the stored offset",
+				zap.String("topic", topic), zap.Int32("partition", partition), zap.Int64("offset", offset))
+			// one moves the offset forward, the other backward
+			session.MarkOffset(topic, partition, offset, "")
+			session.ResetOffset(topic, partition, offset, "")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// offsetSession records the offsets marked and reset in a session.
+type offsetSession struct {
+	sarama.ConsumerGroupSession
+	claims map[string][]int32
+	marked map[int32]int64
+	reset  map[int32]int64
+}
+
+func (s *offsetSession) Claims() map[string][]int32 { return s.claims }
+func (s *offsetSession) Context() context.Context   { return context.Background() }
+
+func (s *offsetSession) MarkOffset(_ string, partition int32, offset int64, _ string) {
+	s.marked[partition] = offset
+}
+
+func (s *offsetSession) ResetOffset(_ string, partition int32, offset int64, _ string) {
+	s.reset[partition] = offset
+}
+
+func TestRecoverOffsets(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed int64
+		fallback  string
+		marked    map[int32]int64
+		reset     map[int32]int64
+	}{
+		{"in range", 50, "earliest", map[int32]int64{}, map[int32]int64{}},
+		{"high water mark", 100, "fail", map[int32]int64{}, map[int32]int64{}},
+		{"truncated earliest", 500, "earliest", map[int32]int64{}, map[int32]int64{0: 0}},
+		{"truncated latest", 500, "latest", map[int32]int64{}, map[int32]int64{0: 100}},
+		{"truncated fail", 500, "fail", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := seekBroker(t, tt.committed, sarama.NewMockOffsetCommitResponse(t))
+			defer broker.Close()
+			config := KafkaConfig{Brokers: []string{broker.Addr()}, Topics: []string{"updates"}, GroupID: "group", OffsetReset: "latest"}
+			saramaConfig, err := config.Sarama()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := sarama.NewClient(config.Brokers, saramaConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			offsets := &ClientOffsets{Client: client, Group: "group"}
+
+			session := &offsetSession{
+				claims: map[string][]int32{"updates": {0, 1}},
+				marked: make(map[int32]int64),
+				reset:  make(map[int32]int64),
+			}
+			err = recoverOffsets(session, offsets, tt.fallback)
+			if tt.marked == nil {
+				if !errors.Is(err, ErrOffsetOutOfRange) {
+					t.Fatalf("got %v, want %v", err, ErrOffsetOutOfRange)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(session.marked) != len(tt.marked) || len(session.reset) != len(tt.reset) ||
+				session.reset[0] != tt.reset[0] {
+				t.Fatalf("marked %v reset %v, want %v %v", session.marked, session.reset, tt.marked, tt.reset)
+			}
+		})
+	}
+
+	// aged out by retention, the oldest offset is ahead
+	session := &offsetSession{claims: map[string][]int32{"updates": {0}}, marked: make(map[int32]int64), reset: make(map[int32]int64)}
+	if err := recoverOffsets(session, stubOffsets{committed: 10, oldest: 40, newest: 90}, "earliest"); err != nil || session.marked[0] != 40 {
+		t.Fatalf("marked %v, %v, want 40", session.marked, err)
+	}
+}
+
+func TestSeekStoredOffsets(t *testing.T) {
+	session := &offsetSession{
+		claims: map[string][]int32{"updates": {0, 1, 2}},
+		marked: make(map[int32]int64),
+		reset:  make(map[int32]int64),
+	}
+	stored := stubStoredOffsets{"updates": {0: 120, 2: 7}}
+	if err := seekStoredOffsets(session, stored); err != nil {
+		t.Fatal(err)
+	}
+	// partition 1 has none stored and starts at its committed offset
+	if len(session.marked) != 2 || session.marked[0] != 120 || session.reset[0] != 120 || session.reset[2] != 7 {
+		t.Fatalf("marked %v reset %v", session.marked, session.reset)
+	}
+}
+
+// stubStoredOffsets are offsets stored by a sink.
+type stubStoredOffsets map[string]map[int32]int64
+
+func (o stubStoredOffsets) StoredOffsets(context.Context, map[string][]int32) (map[string]map[int32]int64, error) {
+	return o, nil
+}
+
+// stubOffsets serves the same offsets for every partition.
+type stubOffsets struct {
+	committed, oldest, newest int64
+}
+
+func (o stubOffsets) Committed(claims map[string][]int32) (map[string]map[int32]int64, error) {
+	committed := make(map[string]map[int32]int64)
+	for topic, partitions := range claims {
+		committed[topic] = make(map[int32]int64)
+		for _, partition := range partitions {
+			committed[topic][partition] = o.committed
+		}
+	}
+	return committed, nil
+}
+
+func (o stubOffsets) Retained(string, int32) (int64, int64, error) {
+	return o.oldest, o.newest, nil
+}
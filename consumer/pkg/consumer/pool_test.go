@@ -0,0 +1,81 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+)
+
+func TestReuseMessages(t *testing.T) {
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindTransaction), ReuseMessages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.HoldingSink{}
+	h := &Handler{
+		decoder: decoder,
+		sink:    sink,
+		retry:   RetryConfig{MaxAttempts: 1},
+		health:  NewHealth(nil, HealthConfig{}),
+	}
+	h.filter.Store(&filter.Filter{})
+	record := func(slot uint64, program []byte) *sarama.ConsumerMessage {
+		value, err := gproto.Marshal(decodetest.TransactionMessage(slot, program).Update.GetTransaction().GetTransaction())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &sarama.ConsumerMessage{
+			Topic:   "transactions",
+			Key:     []byte("10_hash"),
+			Value:   value,
+			Headers: []*sarama.RecordHeader{{Key: []byte(decode.HeaderSource), Value: []byte("validator")}},
+		}
+	}
+
+	// a held message stays as it is until the sink completed it
+	h.process(context.Background(), claimStub{}, record(10, testkey.Key(1)), func() {})
+	msg := sink.Written[0]
+	keys := msg.Update.GetTransaction().GetTransaction().GetTransaction().GetMessage().GetAccountKeys()
+	if msg.Update == nil || msg.Headers[decode.HeaderSource] != "validator" || !bytes.Equal(keys[len(keys)-1], testkey.Key(1)) {
+		t.Fatalf("held message %+v", msg)
+	}
+	sink.Held[0]()
+	if msg.Update != nil || msg.Topic != "" || len(msg.Headers) != 0 {
+		t.Fatalf("released message %+v", msg)
+	}
+	// byte slices read from the update stay valid
+	if !bytes.Equal(keys[len(keys)-1], testkey.Key(1)) {
+		t.Fatal("account keys overwritten")
+	}
+
+	// released messages decode as new ones
+	for i := range 4 {
+		h.process(context.Background(), claimStub{}, record(10, testkey.Key(byte(i))), func() {})
+		sink.Held[len(sink.Held)-1]()
+	}
+	next, err := decoder.Decode(record(10, testkey.Key(9)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = next.Update.GetTransaction().GetTransaction().GetTransaction().GetMessage().GetAccountKeys()
+	if next.Slot != 10 || next.Kind() != decode.KindTransaction || len(next.Headers) != 1 || !bytes.Equal(keys[len(keys)-1], testkey.Key(9)) {
+		t.Fatalf("decoded %+v", next)
+	}
+
+	// without reuse_messages nothing is released
+	h.decoder, _ = decode.NewDecoder(decode.Config{Kind: string(decode.KindTransaction)})
+	h.sink = &sinktest.RecordSink{}
+	h.process(context.Background(), claimStub{}, record(11, testkey.Key(1)), func() {})
+	if msg := h.sink.(*sinktest.RecordSink).Written[0]; msg.Update == nil {
+		t.Fatal("released without reuse_messages")
+	}
+}
@@ -0,0 +1,72 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/duration"
+)
+
+// ProducerConfig configures the records the consumer produces itself: to the
+// dead-letter and retry topics, the dedup output and grpc2kafka.
+type ProducerConfig struct {
+	// Compression is none, gzip, snappy, lz4 or zstd, none when empty.
+	// CompressionLevel 0 is the default level of the codec.
+	Compression      string `json:"compression" yaml:"compression"`
+	CompressionLevel int    `json:"compression_level" yaml:"compression_level"`
+	// Linger is how long records wait to be batched with the next ones to
+	// the same partition, unless BatchSize records or BatchBytes are
+	// pending first. 0 sends them as soon as possible.
+	Linger     duration.Duration `json:"linger" yaml:"linger"`
+	BatchSize  int               `json:"batch_size" yaml:"batch_size"`
+	BatchBytes int               `json:"batch_bytes" yaml:"batch_bytes"`
+}
+
+func DefaultProducerConfig() ProducerConfig {
+	return ProducerConfig{Compression: "none"}
+}
+
+func (c *ProducerConfig) Validate() error {
+	if _, err := c.codec(); err != nil {
+		return err
+	}
+	if c.Linger < 0 {
+		return errors.New("kafka.producer.linger: must not be negative")
+	}
+	if c.BatchSize < 0 {
+		return errors.New("kafka.producer.batch_size: must not be negative")
+	}
+	if c.BatchBytes < 0 {
+		return errors.New("kafka.producer.batch_bytes: must not be negative")
+	}
+	return nil
+}
+
+func (c *ProducerConfig) codec() (sarama.CompressionCodec, error) {
+	if c.Compression == "" {
+		return sarama.CompressionNone, nil
+	}
+	var codec sarama.CompressionCodec
+	if err := codec.UnmarshalText([]byte(c.Compression)); err != nil {
+		return 0, fmt.Errorf("kafka.producer.compression: expected none, gzip, snappy, lz4 or zstd, got %q", c.Compression)
+	}
+	return codec, nil
+}
+
+func (c *ProducerConfig) apply(config *sarama.Config) error {
+	codec, err := c.codec()
+	if err != nil {
+		return err
+	}
+	config.Producer.Compression = codec
+	if c.CompressionLevel != 0 {
+		config.Producer.CompressionLevel = c.CompressionLevel
+	}
+	config.Producer.Flush.Frequency = time.Duration(c.Linger)
+	config.Producer.Flush.Messages = c.BatchSize
+	config.Producer.Flush.Bytes = c.BatchBytes
+	return nil
+}
@@ -0,0 +1,85 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"consumer/pkg/duration"
+)
+
+// Actions for RetryConfig.OnExhausted.
+const (
+	exhaustedDLQ   = "dlq"
+	exhaustedSkip  = "skip"
+	exhaustedCrash = "crash"
+)
+
+// RetryConfig retries failed sink writes with exponential backoff.
+type RetryConfig struct {
+	// MaxAttempts counts the first write, one disables retries.
+	MaxAttempts  int               `json:"max_attempts" yaml:"max_attempts"`
+	InitialDelay duration.Duration `json:"initial_delay" yaml:"initial_delay"`
+	MaxDelay     duration.Duration `json:"max_delay" yaml:"max_delay"`
+	Multiplier   float64           `json:"multiplier" yaml:"multiplier"`
+	// OnExhausted is crash to exit without committing the offset of the
+	// message, dlq to dead-letter it, which requires a dead-letter topic, or
+	// skip to drop it.
+	OnExhausted string            `json:"on_exhausted" yaml:"on_exhausted"`
+	Topics      RetryTopicsConfig `json:"topics" yaml:"topics"`
+}
+
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:  5,
+		InitialDelay: duration.Duration(100 * time.Millisecond),
+		MaxDelay:     duration.Duration(10 * time.Second),
+		Multiplier:   2,
+		OnExhausted:  exhaustedCrash,
+	}
+}
+
+// Validate checks the retry settings against dlq, which on_exhausted dlq
+// produces to.
+func (c *RetryConfig) Validate(dlq DLQConfig) error {
+	if c.MaxAttempts <= 0 {
+		return errors.New("retry.max_attempts: must be positive")
+	}
+	if c.InitialDelay < 0 || c.MaxDelay < 0 {
+		return errors.New("retry: delays must not be negative")
+	}
+	if c.Multiplier < 1 {
+		return errors.New("retry.multiplier: must be at least 1")
+	}
+	switch c.OnExhausted {
+	case exhaustedDLQ, exhaustedSkip, exhaustedCrash:
+	default:
+		return fmt.Errorf("retry.on_exhausted: expected dlq, skip or crash, got %q", c.OnExhausted)
+	}
+	if c.OnExhausted == exhaustedDLQ && dlq.Topic == "" {
+		// the message would be dropped without a trace
+		return errors.New("retry.on_exhausted: dlq requires dlq.topic")
+	}
+	return c.Topics.Validate()
+}
+
+// Do calls fn until it succeeds or MaxAttempts calls failed, returning the
+// last error. retrying is called before every wait.
+func (c *RetryConfig) Do(ctx context.Context, fn func() error, retrying func(attempt int, delay time.Duration, err error)) error {
+	delay := time.Duration(c.InitialDelay)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.MaxAttempts {
+			return err
+		}
+
+		retrying(attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(time.Duration(float64(delay)*c.Multiplier), time.Duration(c.MaxDelay))
+	}
+}
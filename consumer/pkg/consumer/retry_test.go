@@ -0,0 +1,291 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+)
+
+func TestRetryDo(t *testing.T) {
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		name     string
+		config   RetryConfig
+		failures int
+		calls    int
+		delays   []time.Duration
+		err      bool
+	}{
+		{
+			name:   "success",
+			config: RetryConfig{MaxAttempts: 5, InitialDelay: duration.Duration(ms), MaxDelay: duration.Duration(5 * ms), Multiplier: 2},
+			calls:  1,
+		},
+		{
+			name:     "growth",
+			config:   RetryConfig{MaxAttempts: 5, InitialDelay: duration.Duration(ms), MaxDelay: duration.Duration(time.Second), Multiplier: 2},
+			failures: 3,
+			calls:    4,
+			delays:   []time.Duration{ms, 2 * ms, 4 * ms},
+		},
+		{
+			name:     "max delay",
+			config:   RetryConfig{MaxAttempts: 6, InitialDelay: duration.Duration(ms), MaxDelay: duration.Duration(5 * ms), Multiplier: 3},
+			failures: 10,
+			calls:    6,
+			delays:   []time.Duration{ms, 3 * ms, 5 * ms, 5 * ms, 5 * ms},
+			err:      true,
+		},
+		{
+			name:     "constant",
+			config:   RetryConfig{MaxAttempts: 3, InitialDelay: duration.Duration(2 * ms), MaxDelay: duration.Duration(time.Second), Multiplier: 1},
+			failures: 10,
+			calls:    3,
+			delays:   []time.Duration{2 * ms, 2 * ms},
+			err:      true,
+		},
+		{
+			name:     "no retries",
+			config:   RetryConfig{MaxAttempts: 1, InitialDelay: duration.Duration(ms), MaxDelay: duration.Duration(time.Second), Multiplier: 2},
+			failures: 10,
+			calls:    1,
+			err:      true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			var delays []time.Duration
+			var attempts []int
+			err := tt.config.Do(context.Background(), func() error {
+				calls++
+				if calls <= tt.failures {
+					return fmt.Errorf("failure %d", calls)
+				}
+				return nil
+			}, func(attempt int, delay time.Duration, err error) {
+				if err.Error() != fmt.Sprintf("failure %d", attempt) {
+					t.Errorf("attempt %d retried on %v", attempt, err)
+				}
+				attempts = append(attempts, attempt)
+				delays = append(delays, delay)
+			})
+			if calls != tt.calls || !slices.Equal(delays, tt.delays) || (err != nil) != tt.err {
+				t.Fatalf("%d calls, delays %v, %v", calls, delays, err)
+			}
+			// the last error is returned
+			if tt.err && err.Error() != fmt.Sprintf("failure %d", tt.calls) {
+				t.Fatalf("got %v", err)
+			}
+			for i, attempt := range attempts {
+				if attempt != i+1 {
+					t.Fatalf("attempts %v", attempts)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDoCancelled(t *testing.T) {
+	config := RetryConfig{MaxAttempts: 5, InitialDelay: duration.Duration(time.Hour), MaxDelay: duration.Duration(time.Hour), Multiplier: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := config.Do(ctx, func() error {
+		calls++
+		return errors.New("sink down")
+	}, func(int, time.Duration, error) { cancel() })
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("%d calls, %v", calls, err)
+	}
+}
+
+func TestRetryConfigValidate(t *testing.T) {
+	for want, update := range map[string]func(*RetryConfig){
+		"retry.max_attempts":   func(c *RetryConfig) { c.MaxAttempts = 0 },
+		"must not be negative": func(c *RetryConfig) { c.MaxDelay = -1 },
+		"retry.multiplier":     func(c *RetryConfig) { c.Multiplier = 0.5 },
+		"retry.on_exhausted":   func(c *RetryConfig) { c.OnExhausted = "retry" },
+		"requires dlq.topic":   func(c *RetryConfig) { c.OnExhausted = exhaustedDLQ },
+	} {
+		config := DefaultRetryConfig()
+		update(&config)
+		if err := config.Validate(DLQConfig{}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v", want, err)
+		}
+	}
+	config := DefaultRetryConfig()
+	if err := config.Validate(DLQConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	config.OnExhausted = exhaustedDLQ
+	if err := config.Validate(DLQConfig{Topic: "updates.dlq"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	// logger.Fatal panics instead of exiting
+	defer func(l *zap.Logger) { logging.Logger = l }(logging.Logger)
+	logging.Logger = zap.NewNop().WithOptions(zap.WithFatalHook(zapcore.WriteThenPanic))
+
+	record := &sarama.ConsumerMessage{Topic: "updates", Partition: 1, Offset: 7, Value: []byte("payload")}
+	for _, tt := range []struct {
+		action string
+		dlq    bool
+		sent   int
+		crash  bool
+	}{
+		{action: exhaustedDLQ, dlq: true, sent: 1},
+		// without a dead-letter topic the message is only logged
+		{action: exhaustedDLQ},
+		{action: exhaustedSkip, dlq: true},
+		{action: exhaustedCrash, dlq: true, crash: true},
+	} {
+		t.Run(fmt.Sprintf("%s dlq %t", tt.action, tt.dlq), func(t *testing.T) {
+			producer := &retryProducer{}
+			h := &Handler{retry: RetryConfig{MaxAttempts: 1, OnExhausted: tt.action}}
+			if tt.dlq {
+				h.dlq = &DeadLetterQueue{producer: producer, topic: "updates.dlq"}
+			}
+			crashed := func() (crashed bool) {
+				defer func() { crashed = recover() != nil }()
+				h.exhausted(context.Background(), record, logging.RecordFields(record), errors.New("sink down"))
+				return false
+			}()
+			if crashed != tt.crash || len(producer.sent) != tt.sent {
+				t.Fatalf("crashed %t, %d dead-lettered", crashed, len(producer.sent))
+			}
+			if tt.sent == 0 {
+				return
+			}
+			dead := producer.consumed()
+			headers := decode.RecordHeaders(dead.Headers)
+			if dead.Topic != "updates.dlq" || string(dead.Value) != "payload" || headers[HeaderDLQStage] != StageSink ||
+				headers[HeaderDLQOffset] != "7" || headers[HeaderDLQError] != "sink down" {
+				t.Fatalf("dead-lettered %s %q, headers %v", dead.Topic, dead.Value, headers)
+			}
+		})
+	}
+}
+
+// exitHook stands for the exit of logger.Fatal: it reports it and blocks the
+// logging goroutine for good, so that none of its deferred calls run.
+type exitHook chan struct{}
+
+func (h exitHook) OnWrite(*zapcore.CheckedEntry, []zapcore.Field) {
+	close(h)
+	select {}
+}
+
+func TestRetryExhaustedByDefault(t *testing.T) {
+	exited := make(exitHook)
+	defer func(l *zap.Logger) { logging.Logger = l }(logging.Logger)
+	logging.Logger = zap.NewNop().WithOptions(zap.WithFatalHook(exited))
+
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := &queuedClaim{messages: make(chan *sarama.ConsumerMessage, 2)}
+	for offset, slot := range []uint64{10, 11} {
+		value, err := gproto.Marshal(decodetest.TransactionMessage(slot, testkey.Key(byte(slot))).Update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claim.messages <- &sarama.ConsumerMessage{Topic: "updates", Offset: int64(offset), Value: value}
+	}
+	close(claim.messages)
+
+	retry := DefaultRetryConfig()
+	retry.InitialDelay = duration.Duration(time.Millisecond)
+	sink := &sinktest.RecordSink{Fail: map[uint64]error{11: errors.New("sink down")}}
+	h := &Handler{
+		decoder:   decoder,
+		sink:      sink,
+		retry:     retry,
+		health:    NewHealth(nil, HealthConfig{}),
+		committer: NewOffsetCommitter(nil, "group", "", DefaultCommitConfig()),
+	}
+	h.filter.Store(&filter.Filter{})
+	returned := make(chan error)
+	go func() { returned <- h.ConsumeClaim(&offsetSession{}, claim) }()
+	select {
+	case err := <-returned:
+		t.Fatalf("consumed past the failed message: %v", err)
+	case <-exited:
+	}
+	// the consumer exits before the offset of the failed message is marked
+	if next := h.committer.marked["updates"][0]; next != 1 {
+		t.Fatalf("marked %d", next)
+	}
+}
+
+// queuedClaim is a claim of the messages queued on it.
+type queuedClaim struct {
+	claimStub
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *queuedClaim) Topic() string                            { return "updates" }
+func (c *queuedClaim) Partition() int32                         { return 0 }
+func (c *queuedClaim) InitialOffset() int64                     { return 0 }
+func (c *queuedClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestDeadLetterFails(t *testing.T) {
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := gproto.Marshal(decodetest.TransactionMessage(10, testkey.Key(1)).Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			producer := &retryProducer{err: errors.New("broker down")}
+			sink := &sinktest.RecordSink{}
+			h := &Handler{
+				decoder:    decoder,
+				sink:       sink,
+				dlq:        &DeadLetterQueue{producer: producer, topic: "updates.dlq"},
+				processing: ProcessingConfig{Workers: workers, QueueSize: 1},
+				retry:      RetryConfig{MaxAttempts: 2, InitialDelay: duration.Duration(time.Millisecond), Multiplier: 1},
+				health:     NewHealth(nil, HealthConfig{}),
+				committer:  NewOffsetCommitter(nil, "group", "", DefaultCommitConfig()),
+			}
+			h.filter.Store(&filter.Filter{})
+			claim := &queuedClaim{messages: make(chan *sarama.ConsumerMessage, 3)}
+			// the undecodable message can not be dead-lettered
+			claim.messages <- &sarama.ConsumerMessage{Topic: "updates", Offset: 0, Value: value}
+			claim.messages <- &sarama.ConsumerMessage{Topic: "updates", Offset: 1, Value: []byte("garbage")}
+			claim.messages <- &sarama.ConsumerMessage{Topic: "updates", Offset: 2, Value: value}
+
+			err := h.ConsumeClaim(&offsetSession{}, claim)
+			if !errors.Is(err, producer.err) || len(producer.sent) != 2 {
+				t.Fatalf("got %v after %d dead-letter attempts", err, len(producer.sent))
+			}
+			// only the offset before the message is marked, the session ends
+			// and the message is consumed again
+			if next := h.committer.marked["updates"][0]; next != 1 {
+				t.Fatalf("marked %d", next)
+			}
+		})
+	}
+}
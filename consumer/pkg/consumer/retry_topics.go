@@ -0,0 +1,207 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/duration"
+	"consumer/pkg/metrics"
+	"consumer/pkg/tracing"
+)
+
+// Headers attached to the records produced to a retry topic, the value and
+// key are copied unchanged.
+const (
+	HeaderRetryTopic     = "retry.topic"
+	HeaderRetryPartition = "retry.partition"
+	HeaderRetryOffset    = "retry.offset"
+	HeaderRetryTier      = "retry.tier"
+	HeaderRetryError     = "retry.error"
+	HeaderRetryDue       = "retry.due"
+)
+
+// RetryTopicsConfig hands the messages the sink kept rejecting to retry
+// topics instead of holding their partition, so a sink outage heals by itself
+// once the sink is back.
+type RetryTopicsConfig struct {
+	// Delays are the tiers a message goes through, each a topic named
+	// <topic>.retry.<delay> such as updates.retry.5s whose records are
+	// consumed once their delay passed. A message failing in the last tier
+	// gets retry.on_exhausted. Retry topics are disabled when empty.
+	Delays []duration.Duration `json:"delays" yaml:"delays"`
+}
+
+func (c *RetryTopicsConfig) Validate() error {
+	for i, delay := range c.Delays {
+		if delay < duration.Duration(time.Millisecond) {
+			return errors.New("retry.topics.delays: must be at least 1ms")
+		}
+		if i > 0 && delay <= c.Delays[i-1] {
+			return errors.New("retry.topics.delays: must be increasing")
+		}
+	}
+	return nil
+}
+
+// retryTopicName is the topic of the tier waiting delay for the messages of
+// topic.
+func retryTopicName(topic string, delay time.Duration) string {
+	var suffix string
+	switch {
+	case delay%time.Hour == 0:
+		suffix = fmt.Sprintf("%dh", delay/time.Hour)
+	case delay%time.Minute == 0:
+		suffix = fmt.Sprintf("%dm", delay/time.Minute)
+	case delay%time.Second == 0:
+		suffix = fmt.Sprintf("%ds", delay/time.Second)
+	default:
+		suffix = fmt.Sprintf("%dms", delay/time.Millisecond)
+	}
+	return topic + ".retry." + suffix
+}
+
+// RetryTopics produces failed messages to the tier after the one they were
+// consumed from, and holds back the records of a tier until they are due.
+// The methods of a nil RetryTopics do nothing.
+type RetryTopics struct {
+	producer sarama.SyncProducer
+	delays   []time.Duration
+	// tiers numbers the retry topics from 1, the source topics are tier 0.
+	tiers  map[string]int
+	topics []string
+}
+
+// NewRetryTopics returns nil when config has no delays. topics are the
+// source topics whose messages are retried.
+func NewRetryTopics(config RetryTopicsConfig, topics []string, producer sarama.SyncProducer) *RetryTopics {
+	if len(config.Delays) == 0 {
+		return nil
+	}
+	r := &RetryTopics{producer: producer, tiers: make(map[string]int)}
+	for _, delay := range config.Delays {
+		r.delays = append(r.delays, time.Duration(delay))
+	}
+	for _, topic := range topics {
+		for i, delay := range r.delays {
+			name := retryTopicName(topic, delay)
+			r.tiers[name] = i + 1
+			r.topics = append(r.topics, name)
+		}
+	}
+	return r
+}
+
+// Topics returns the retry topics to consume along with the source topics.
+func (r *RetryTopics) Topics() []string {
+	if r == nil {
+		return nil
+	}
+	return r.topics
+}
+
+// wait holds back a record of a retry topic until it is due, or returns the
+// error of ctx.
+func (r *RetryTopics) wait(ctx context.Context, record *sarama.ConsumerMessage) error {
+	if r == nil || r.tiers[record.Topic] == 0 {
+		return nil
+	}
+	due, err := time.Parse(time.RFC3339Nano, tracing.HeaderCarrier(record.Headers).Get(HeaderRetryDue))
+	if err != nil {
+		// not written by RetryTopics, retried at once
+		return nil
+	}
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	metrics.RetryTopicsWaiting.Inc()
+	defer metrics.RetryTopicsWaiting.Dec()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// source returns record as it was consumed from its source topic, so a
+// retried message is decoded and written like the first time.
+func (r *RetryTopics) source(record *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	if r == nil || r.tiers[record.Topic] == 0 {
+		return record
+	}
+	partition, err := strconv.ParseInt(tracing.HeaderCarrier(record.Headers).Get(HeaderRetryPartition), 10, 32)
+	if err != nil {
+		return record
+	}
+	offset, err := strconv.ParseInt(tracing.HeaderCarrier(record.Headers).Get(HeaderRetryOffset), 10, 64)
+	if err != nil {
+		return record
+	}
+	source := *record
+	source.Topic = tracing.HeaderCarrier(record.Headers).Get(HeaderRetryTopic)
+	source.Partition = int32(partition)
+	source.Offset = offset
+	return &source
+}
+
+// Send produces record to the tier after its own and reports whether it did,
+// false when record failed in the last tier. The offset of record is marked
+// afterwards and committed with the next flush of the sink, not in a
+// transaction with the produce: a crash in between consumes record again
+// while its copy waits in the retry topic, so a hop is at-least-once.
+func (r *RetryTopics) Send(record *sarama.ConsumerMessage, cause error) (bool, error) {
+	if r == nil {
+		return false, nil
+	}
+	tier := r.tiers[record.Topic]
+	if tier >= len(r.delays) {
+		return false, nil
+	}
+	source := r.source(record)
+	delay := r.delays[tier]
+	headers := make([]sarama.RecordHeader, 0, len(record.Headers)+6)
+	for _, header := range record.Headers {
+		if !strings.HasPrefix(string(header.Key), "retry.") {
+			headers = append(headers, *header)
+		}
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderRetryTopic), Value: []byte(source.Topic)},
+		sarama.RecordHeader{Key: []byte(HeaderRetryPartition), Value: []byte(strconv.Itoa(int(source.Partition)))},
+		sarama.RecordHeader{Key: []byte(HeaderRetryOffset), Value: []byte(strconv.FormatInt(source.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(HeaderRetryTier), Value: []byte(strconv.Itoa(tier + 1))},
+		sarama.RecordHeader{Key: []byte(HeaderRetryError), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte(HeaderRetryDue), Value: []byte(time.Now().Add(delay).UTC().Format(time.RFC3339Nano))},
+	)
+
+	topic := retryTopicName(source.Topic, delay)
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(record.Value),
+		Headers: headers,
+	}
+	if record.Key != nil {
+		msg.Key = sarama.ByteEncoder(record.Key)
+	}
+	if _, _, err := r.producer.SendMessage(msg); err != nil {
+		return false, fmt.Errorf("produce to %s: %w", topic, err)
+	}
+	metrics.RetryTopicMessagesTotal.WithLabelValues(topic).Inc()
+	return true, nil
+}
+
+func (r *RetryTopics) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.producer.Close()
+}
@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/tracing"
+)
+
+// retryProducer keeps the records produced to the retry topics, failing
+// them with err when set.
+type retryProducer struct {
+	sarama.SyncProducer
+	sent []*sarama.ProducerMessage
+	err  error
+}
+
+func (p *retryProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent) - 1), p.err
+}
+
+// consumed returns the last record produced as consumed from its topic.
+func (p *retryProducer) consumed() *sarama.ConsumerMessage {
+	msg := p.sent[len(p.sent)-1]
+	record := &sarama.ConsumerMessage{Topic: msg.Topic, Offset: int64(len(p.sent) - 1)}
+	record.Value, _ = msg.Value.Encode()
+	if msg.Key != nil {
+		record.Key, _ = msg.Key.Encode()
+	}
+	for _, header := range msg.Headers {
+		record.Headers = append(record.Headers, &header)
+	}
+	return record
+}
+
+func TestRetryTopicName(t *testing.T) {
+	for delay, want := range map[time.Duration]string{
+		5 * time.Second:         "updates.retry.5s",
+		90 * time.Second:        "updates.retry.90s",
+		10 * time.Minute:        "updates.retry.10m",
+		2 * time.Hour:           "updates.retry.2h",
+		1500 * time.Millisecond: "updates.retry.1500ms",
+	} {
+		if got := retryTopicName("updates", delay); got != want {
+			t.Errorf("%s: got %s, want %s", delay, got, want)
+		}
+	}
+
+	config := RetryTopicsConfig{Delays: []duration.Duration{duration.Duration(time.Minute), duration.Duration(5 * time.Second)}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "increasing") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestRetryTopics(t *testing.T) {
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := &retryProducer{}
+	retryTopics := NewRetryTopics(RetryTopicsConfig{Delays: []duration.Duration{duration.Duration(5 * time.Second), duration.Duration(time.Minute)}}, []string{"updates"}, producer)
+	if got := retryTopics.Topics(); len(got) != 2 || got[0] != "updates.retry.5s" || got[1] != "updates.retry.1m" {
+		t.Fatalf("retry topics %v", got)
+	}
+	sink := &sinktest.RecordSink{Fail: map[uint64]error{10: errors.New("sink down")}}
+	h := &Handler{
+		decoder:     decoder,
+		sink:        sink,
+		retryTopics: retryTopics,
+		retry:       RetryConfig{MaxAttempts: 1, OnExhausted: exhaustedSkip},
+		health:      NewHealth(nil, HealthConfig{}),
+	}
+	value, err := gproto.Marshal(decodetest.TransactionMessage(10, testkey.Key(1)).Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed message goes to the first tier and completes
+	completed := 0
+	h.process(context.Background(), claimStub{}, &sarama.ConsumerMessage{Topic: "updates", Partition: 3, Offset: 42, Value: value}, func() { completed++ })
+	if len(producer.sent) != 1 || producer.sent[0].Topic != "updates.retry.5s" || completed != 1 {
+		t.Fatalf("%d records produced, %d completions", len(producer.sent), completed)
+	}
+	first := producer.consumed()
+	due, err := time.Parse(time.RFC3339Nano, tracing.HeaderCarrier(first.Headers).Get(HeaderRetryDue))
+	if err != nil || time.Until(due) < 4*time.Second {
+		t.Fatalf("due %s, %v", due, err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := retryTopics.wait(cancelled, first); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait for a record not due: %v", err)
+	}
+
+	// failing again it goes to the next tier, keeping its source
+	h.process(context.Background(), claimStub{}, first, func() { completed++ })
+	second := producer.consumed()
+	if second.Topic != "updates.retry.1m" || completed != 2 {
+		t.Fatalf("produced to %s, %d completions", second.Topic, completed)
+	}
+	headers := decode.RecordHeaders(second.Headers)
+	if headers[HeaderRetryTopic] != "updates" || headers[HeaderRetryPartition] != "3" || headers[HeaderRetryOffset] != "42" || headers[HeaderRetryTier] != "2" {
+		t.Fatalf("headers %v", headers)
+	}
+
+	// and is written as consumed from its source once the sink is back
+	delete(sink.Fail, 10)
+	h.process(context.Background(), claimStub{}, second, func() { completed++ })
+	if len(sink.Written) != 1 || completed != 3 {
+		t.Fatalf("%d written, %d completions", len(sink.Written), completed)
+	}
+	if msg := sink.Written[0]; msg.Topic != "updates" || msg.Partition != 3 || msg.Offset != 42 {
+		t.Fatalf("written from %s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+	}
+
+	// a message failing in the last tier gets on_exhausted
+	sink.Fail[10] = errors.New("sink down")
+	h.process(context.Background(), claimStub{}, second, func() { completed++ })
+	if len(producer.sent) != 2 || completed != 4 {
+		t.Fatalf("%d records produced, %d completions", len(producer.sent), completed)
+	}
+
+	// records due are consumed at once
+	past := &sarama.ConsumerMessage{Topic: "updates.retry.5s", Headers: []*sarama.RecordHeader{
+		{Key: []byte(HeaderRetryDue), Value: []byte(time.Now().Add(-time.Second).Format(time.RFC3339Nano))},
+	}}
+	if err := retryTopics.wait(cancelled, past); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,134 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IBM/sarama"
+	"github.com/aws/aws-msk-iam-sasl-signer-go/signer"
+	"github.com/xdg-go/scram"
+)
+
+// saslAWSMSKIAM authenticates to Amazon MSK with IAM credentials. It is sent
+// to the brokers as OAUTHBEARER carrying a signed token.
+const saslAWSMSKIAM = "AWS_MSK_IAM"
+
+type SASLConfig struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or AWS_MSK_IAM, SASL
+	// is disabled when it is empty.
+	Mechanism string `json:"mechanism" yaml:"mechanism"`
+	Username  string `json:"username" yaml:"username"`
+	Password  string `json:"password" yaml:"password"`
+	// AWS settings for AWS_MSK_IAM. Credentials come from the default chain
+	// (environment, web identity, instance role) unless a role is given.
+	AWSRegion      string `json:"aws_region" yaml:"aws_region"`
+	AWSRoleARN     string `json:"aws_role_arn" yaml:"aws_role_arn"`
+	AWSSessionName string `json:"aws_session_name" yaml:"aws_session_name"`
+}
+
+func (c *SASLConfig) Validate() error {
+	switch c.Mechanism {
+	case "":
+		return nil
+	case saslAWSMSKIAM:
+		if c.AWSRegion == "" {
+			return errors.New("kafka.sasl.aws_region: required for AWS_MSK_IAM")
+		}
+		return nil
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+	default:
+		return fmt.Errorf("kafka.sasl.mechanism: expected PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or AWS_MSK_IAM, got %q", c.Mechanism)
+	}
+	if c.Username == "" {
+		return errors.New("kafka.sasl.username: must not be empty")
+	}
+	return nil
+}
+
+func (c *SASLConfig) apply(config *sarama.Config) {
+	if c.Mechanism == "" {
+		return
+	}
+
+	if c.Mechanism == saslAWSMSKIAM {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		config.Net.SASL.TokenProvider = &mskTokenProvider{
+			region:      c.AWSRegion,
+			roleARN:     c.AWSRoleARN,
+			sessionName: c.AWSSessionName,
+		}
+		// MSK only accepts IAM authentication over TLS
+		config.Net.TLS.Enable = true
+		return
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(c.Mechanism)
+	config.Net.SASL.User = c.Username
+	config.Net.SASL.Password = c.Password
+
+	switch c.Mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA512}
+		}
+	}
+}
+
+// mskTokenProvider signs a fresh MSK IAM token whenever a broker connection
+// authenticates.
+type mskTokenProvider struct {
+	region      string
+	roleARN     string
+	sessionName string
+}
+
+func (p *mskTokenProvider) Token() (*sarama.AccessToken, error) {
+	ctx := context.Background()
+
+	var token string
+	var err error
+	if p.roleARN != "" {
+		sessionName := p.sessionName
+		if sessionName == "" {
+			sessionName = "yellowstone-kafka-consumer"
+		}
+		token, _, err = signer.GenerateAuthTokenFromRole(ctx, p.region, p.roleARN, sessionName)
+	} else {
+		token, _, err = signer.GenerateAuthToken(ctx, p.region)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("msk iam token: %w", err)
+	}
+	return &sarama.AccessToken{Token: token}, nil
+}
+
+// scramClient implements sarama.SCRAMClient on top of xdg-go/scram.
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
@@ -0,0 +1,217 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+)
+
+// seekReadTimeout bounds the wait for a single record while searching for a
+// slot.
+const seekReadTimeout = 10 * time.Second
+
+// SeekTarget selects the offsets SeekGroup commits, by the one field set:
+// the first record at or after Timestamp, the first record of Slot, read
+// from the <slot>_<hash> record keys, Offset on every partition or Offsets
+// on the partitions listed. The offsets are clamped to the retained range.
+type SeekTarget struct {
+	Timestamp time.Time
+	// Offset applies to every partition unless the partition is in Offsets.
+	Offset  *int64
+	Offsets map[int32]int64
+	Slot    *uint64
+}
+
+// SeekGroup commits the offsets selected by target for every partition of
+// the topics, those matching kafka.topic_pattern included. Kafka only
+// accepts the commit while the group has no active members, so every other
+// consumer of the group must be stopped first.
+func SeekGroup(config KafkaConfig, saramaConfig *sarama.Config, target *SeekTarget) error {
+	client, err := sarama.NewClient(config.Brokers, saramaConfig)
+	if err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	defer client.Close()
+
+	discovery, err := NewTopicDiscovery(client, config)
+	if err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	offsets := make(map[string]map[int32]int64)
+	for _, topic := range discovery.Topics() {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return fmt.Errorf("seek %s: %w", topic, err)
+		}
+		for _, partition := range partitions {
+			offset, err := target.resolve(client, topic, partition)
+			if err != nil {
+				return fmt.Errorf("seek %s/%d: %w", topic, partition, err)
+			}
+			if offset < 0 {
+				continue
+			}
+			if offsets[topic] == nil {
+				offsets[topic] = make(map[int32]int64)
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+	return CommitOffsets(client, config.GroupID, offsets)
+}
+
+// CommitOffsets commits the next offsets of group by topic and partition,
+// moving them back as well as forward. Kafka only accepts the commit while
+// the group has no active members.
+func CommitOffsets(client sarama.Client, group string, offsets map[string]map[int32]int64) error {
+	offsetManager, err := sarama.NewOffsetManagerFromClient(group, client)
+	if err != nil {
+		return fmt.Errorf("commit offsets: %w", err)
+	}
+	var managers []sarama.PartitionOffsetManager
+	// without auto commit the partition managers are only released, and their
+	// error channels closed, by closing the offset manager
+	defer func() {
+		for _, manager := range managers {
+			manager.AsyncClose()
+		}
+		offsetManager.Close()
+	}()
+
+	for _, topic := range slices.Sorted(maps.Keys(offsets)) {
+		for _, partition := range slices.Sorted(maps.Keys(offsets[topic])) {
+			offset := offsets[topic][partition]
+			manager, err := offsetManager.ManagePartition(topic, partition)
+			if err != nil {
+				return fmt.Errorf("commit offsets %s/%d: %w", topic, partition, err)
+			}
+			managers = append(managers, manager)
+			// MarkOffset only moves forward and ResetOffset only backward
+			if next, _ := manager.NextOffset(); offset > next {
+				manager.MarkOffset(offset, "")
+			} else {
+				manager.ResetOffset(offset, "")
+			}
+			logging.Logger.Info("group offset reset",
+				zap.String("topic", topic), zap.Int32("partition", partition), zap.Int64("offset", offset))
+		}
+	}
+
+	offsetManager.Commit()
+	for _, manager := range managers {
+		manager.AsyncClose()
+	}
+	offsetManager.Close()
+	var errs []error
+	for _, manager := range managers {
+		for err := range manager.Errors() {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("commit offsets: %w", err)
+	}
+	return nil
+}
+
+// resolve returns the offset to commit for a partition, clamped to the
+// retained range, or -1 to leave the partition alone.
+func (t *SeekTarget) resolve(client sarama.Client, topic string, partition int32) (int64, error) {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	switch {
+	case !t.Timestamp.IsZero():
+		offset, err = client.GetOffset(topic, partition, t.Timestamp.UnixMilli())
+		if err != nil {
+			return 0, err
+		}
+		// no record at or after the timestamp
+		if offset < 0 {
+			offset = newest
+		}
+	case t.Slot != nil:
+		offset, err = seekSlot(client, topic, partition, oldest, newest, *t.Slot)
+		if err != nil {
+			return 0, err
+		}
+	case t.Offsets != nil:
+		var ok bool
+		if offset, ok = t.Offsets[partition]; !ok {
+			return -1, nil
+		}
+	default:
+		offset = *t.Offset
+	}
+	return min(max(offset, oldest), newest), nil
+}
+
+// seekSlot binary searches a partition for the first record whose key slot
+// is at least slot. Slots only grow roughly along a partition, so the result
+// may be preceded by a few records of the slot and followed by a few older
+// ones.
+func seekSlot(client sarama.Client, topic string, partition int32, oldest, newest int64, slot uint64) (int64, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return 0, err
+	}
+	defer consumer.Close()
+
+	lo, hi := oldest, newest
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		record, err := readRecord(consumer, topic, partition, mid)
+		if err != nil {
+			return 0, err
+		}
+		// only control records or compacted gaps up to the end
+		if record == nil || record.Offset >= hi {
+			hi = mid
+			continue
+		}
+		recordSlot, ok := decode.ParseKeySlot(record.Key)
+		if !ok {
+			return 0, fmt.Errorf("offset %d: record key %q does not start with a slot", record.Offset, record.Key)
+		}
+		if recordSlot < slot {
+			lo = record.Offset + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// readRecord returns the first record at or after offset, or nil when none
+// arrives in time.
+func readRecord(consumer sarama.Consumer, topic string, partition int32, offset int64) (*sarama.ConsumerMessage, error) {
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	select {
+	case record := <-pc.Messages():
+		return record, nil
+	case err := <-pc.Errors():
+		return nil, err
+	case <-time.After(seekReadTimeout):
+		return nil, nil
+	}
+}
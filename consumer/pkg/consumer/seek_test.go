@@ -0,0 +1,109 @@
+package consumer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// seekBroker serves a topic with two partitions holding offsets 0 to 100.
+// Partition 0 has committed offset committed, partition 1 none.
+func seekBroker(t *testing.T, committed int64, commit *sarama.MockOffsetCommitResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("updates", 0, broker.BrokerID()).
+			SetLeader("updates", 1, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "updates", 0, committed, "", sarama.ErrNoError).
+			SetOffset("group", "updates", 1, -1, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("updates", 0, sarama.OffsetOldest, 0).
+			SetOffset("updates", 0, sarama.OffsetNewest, 100).
+			SetOffset("updates", 1, sarama.OffsetOldest, 0).
+			SetOffset("updates", 1, sarama.OffsetNewest, 100),
+		"OffsetCommitRequest": commit,
+	})
+	return broker
+}
+
+// committedOffsets returns the offsets of the commit requests broker received.
+func committedOffsets(t *testing.T, broker *sarama.MockBroker) map[int32]int64 {
+	t.Helper()
+	offsets := make(map[int32]int64)
+	for _, rr := range broker.History() {
+		request, ok := rr.Request.(*sarama.OffsetCommitRequest)
+		if !ok {
+			continue
+		}
+		for _, partition := range []int32{0, 1} {
+			if offset, _, err := request.Offset("updates", partition); err == nil {
+				offsets[partition] = offset
+			}
+		}
+	}
+	return offsets
+}
+
+func TestSeekGroup(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed int64
+		target    SeekTarget
+		want      map[int32]int64
+	}{
+		{"forward", 50, SeekTarget{Offset: ptr(int64(80))}, map[int32]int64{0: 80, 1: 80}},
+		{"backward", 50, SeekTarget{Offset: ptr(int64(20))}, map[int32]int64{0: 20, 1: 20}},
+		{"clamped", 50, SeekTarget{Offset: ptr(int64(500))}, map[int32]int64{0: 100, 1: 100}},
+		{"single partition", 50, SeekTarget{Offsets: map[int32]int64{1: 30}}, map[int32]int64{1: 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := seekBroker(t, tt.committed, sarama.NewMockOffsetCommitResponse(t))
+			defer broker.Close()
+
+			config := KafkaConfig{Brokers: []string{broker.Addr()}, Topics: []string{"updates"}, GroupID: "group", OffsetReset: "latest"}
+			saramaConfig, err := config.Sarama()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := SeekGroup(config, saramaConfig, &tt.target); err != nil {
+				t.Fatal(err)
+			}
+			got := committedOffsets(t, broker)
+			if len(got) != len(tt.want) {
+				t.Fatalf("committed %v, want %v", got, tt.want)
+			}
+			for partition, offset := range tt.want {
+				if got[partition] != offset {
+					t.Fatalf("committed %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSeekGroupActiveMembers(t *testing.T) {
+	// a group with members rejects commits without a generation
+	broker := seekBroker(t, 50, sarama.NewMockOffsetCommitResponse(t).
+		SetError("group", "updates", 0, sarama.ErrUnknownMemberId).
+		SetError("group", "updates", 1, sarama.ErrUnknownMemberId))
+	defer broker.Close()
+
+	config := KafkaConfig{Brokers: []string{broker.Addr()}, Topics: []string{"updates"}, GroupID: "group", OffsetReset: "latest"}
+	saramaConfig, err := config.Sarama()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SeekGroup(config, saramaConfig, &SeekTarget{Offset: ptr(int64(10))}); !errors.Is(err, sarama.ErrUnknownMemberId) {
+		t.Fatalf("got %v, want %v", err, sarama.ErrUnknownMemberId)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,180 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/IBM/sarama"
+	"golang.org/x/time/rate"
+
+	"consumer/pkg/metrics"
+)
+
+// Limits reported by the throttle metrics.
+const (
+	limitMessages = "messages"
+	limitBytes    = "bytes"
+	limitInflight = "inflight"
+)
+
+// ThrottleConfig bounds the pace at which the claimed messages are
+// dispatched, so a backfill or a consumer far behind does not overwhelm the
+// sink. A zero value disables its bound.
+type ThrottleConfig struct {
+	// MessagesPerSecond and BytesPerSecond are token buckets holding one
+	// second worth of messages or payload bytes, shared by every partition.
+	MessagesPerSecond int `json:"messages_per_second" yaml:"messages_per_second"`
+	BytesPerSecond    int `json:"bytes_per_second" yaml:"bytes_per_second"`
+	// MaxInflight bounds the messages dispatched but not yet acknowledged by
+	// the sink, those in the worker queues and those held by batching sinks
+	// until a flush included.
+	MaxInflight int `json:"max_inflight" yaml:"max_inflight"`
+}
+
+func (c *ThrottleConfig) Validate() error {
+	if c.MessagesPerSecond < 0 {
+		return errors.New("processing.throttle.messages_per_second: must not be negative")
+	}
+	if c.BytesPerSecond < 0 {
+		return errors.New("processing.throttle.bytes_per_second: must not be negative")
+	}
+	if c.MaxInflight < 0 {
+		return errors.New("processing.throttle.max_inflight: must not be negative")
+	}
+	return nil
+}
+
+// Throttle holds back the messages of the claims while a limit of
+// ThrottleConfig is reached. The methods of a nil Throttle never block.
+type Throttle struct {
+	// messages and bytes let everything through without their limit, so
+	// that a reload can set it, see SetRates.
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+	inflight chan struct{}
+}
+
+// NewThrottle returns nil when config sets no limit.
+func NewThrottle(config ThrottleConfig) *Throttle {
+	if config == (ThrottleConfig{}) {
+		return nil
+	}
+	t := &Throttle{
+		messages: rate.NewLimiter(rate.Inf, 0),
+		bytes:    rate.NewLimiter(rate.Inf, 0),
+	}
+	t.SetRates(config)
+	if config.MaxInflight > 0 {
+		t.inflight = make(chan struct{}, config.MaxInflight)
+	}
+	return t
+}
+
+// CheckReload reports whether config can be applied by SetRates: the rates
+// of a throttle can change, its max_inflight and a nil Throttle cannot.
+func (t *Throttle) CheckReload(config ThrottleConfig) error {
+	if t == nil {
+		if config != (ThrottleConfig{}) {
+			return errors.New("processing.throttle: was disabled at startup, enabling it needs a restart")
+		}
+		return nil
+	}
+	if config.MaxInflight != cap(t.inflight) {
+		return errors.New("processing.throttle.max_inflight: changing it needs a restart")
+	}
+	return nil
+}
+
+// SetRates sets the messages_per_second and bytes_per_second of config, a
+// zero one lifting its limit.
+func (t *Throttle) SetRates(config ThrottleConfig) {
+	if t == nil {
+		return
+	}
+	for _, limit := range []struct {
+		limiter *rate.Limiter
+		rate    int
+	}{
+		{t.messages, config.MessagesPerSecond},
+		{t.bytes, config.BytesPerSecond},
+	} {
+		if limit.rate == 0 {
+			limit.limiter.SetLimit(rate.Inf)
+			continue
+		}
+		limit.limiter.SetBurst(limit.rate)
+		limit.limiter.SetLimit(rate.Limit(limit.rate))
+	}
+}
+
+// acquire waits until message may be dispatched, or returns the error of ctx.
+// Every message acquired is released with done once the sink acknowledged
+// it.
+func (t *Throttle) acquire(ctx context.Context, message *sarama.ConsumerMessage) error {
+	if t == nil {
+		return nil
+	}
+	if t.inflight != nil {
+		if err := t.acquireInflight(ctx); err != nil {
+			return err
+		}
+	}
+	err := t.wait(ctx, t.messages, limitMessages, 1)
+	if err == nil {
+		// a payload larger than a second worth takes the whole bucket
+		err = t.wait(ctx, t.bytes, limitBytes, min(len(message.Value), t.bytes.Burst()))
+	}
+	if err != nil && t.inflight != nil {
+		t.done()
+	}
+	return err
+}
+
+// done releases a message acquired.
+func (t *Throttle) done() {
+	if t == nil || t.inflight == nil {
+		return
+	}
+	<-t.inflight
+}
+
+func (t *Throttle) acquireInflight(ctx context.Context) error {
+	select {
+	case t.inflight <- struct{}{}:
+		return nil
+	default:
+	}
+	metrics.ThrottleWaiting.WithLabelValues(limitInflight).Inc()
+	defer metrics.ThrottleWaiting.WithLabelValues(limitInflight).Dec()
+	start := time.Now()
+	defer func() { metrics.ThrottleWaitSeconds.WithLabelValues(limitInflight).Add(time.Since(start).Seconds()) }()
+	select {
+	case t.inflight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait takes n tokens of limiter, sleeping until they are available.
+func (t *Throttle) wait(ctx context.Context, limiter *rate.Limiter, limit string, n int) error {
+	reservation := limiter.ReserveN(time.Now(), n)
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	metrics.ThrottleWaiting.WithLabelValues(limit).Inc()
+	defer metrics.ThrottleWaiting.WithLabelValues(limit).Dec()
+	start := time.Now()
+	defer func() { metrics.ThrottleWaitSeconds.WithLabelValues(limit).Add(time.Since(start).Seconds()) }()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
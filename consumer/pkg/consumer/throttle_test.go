@@ -0,0 +1,83 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+
+	"consumer/pkg/metrics"
+)
+
+func TestThrottle(t *testing.T) {
+	if NewThrottle(ThrottleConfig{}) != nil {
+		t.Fatal("throttle without limits")
+	}
+	ctx := context.Background()
+	message := &sarama.ConsumerMessage{Value: make([]byte, 100)}
+
+	// the second message waits for the first to be acknowledged
+	throttle := NewThrottle(ThrottleConfig{MaxInflight: 1})
+	if err := throttle.acquire(ctx, message); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := throttle.acquire(timeout, message); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if testutil.ToFloat64(metrics.ThrottleWaitSeconds.WithLabelValues(limitInflight)) == 0 {
+		t.Fatal("wait not counted")
+	}
+	throttle.done()
+	if err := throttle.acquire(ctx, message); err != nil {
+		t.Fatal(err)
+	}
+	throttle.done()
+
+	// a second worth passes at once, the next message waits for a token
+	throttle = NewThrottle(ThrottleConfig{MessagesPerSecond: 20})
+	start := time.Now()
+	for range 21 {
+		if err := throttle.acquire(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("21 messages passed in %s", elapsed)
+	}
+
+	// a payload larger than the bucket waits for all of it
+	throttle = NewThrottle(ThrottleConfig{BytesPerSecond: 1000})
+	large := &sarama.ConsumerMessage{Value: make([]byte, 5000)}
+	if err := throttle.acquire(ctx, large); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := throttle.acquire(timeout, large); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := testutil.ToFloat64(metrics.ThrottleWaiting.WithLabelValues(limitBytes)); got != 0 {
+		t.Fatalf("%g claims still waiting", got)
+	}
+}
+
+func TestThrottleSetRates(t *testing.T) {
+	throttle := NewThrottle(ThrottleConfig{MessagesPerSecond: 100, MaxInflight: 10})
+	next := ThrottleConfig{BytesPerSecond: 1000, MaxInflight: 10}
+	if err := throttle.CheckReload(next); err != nil {
+		t.Fatal(err)
+	}
+	throttle.SetRates(next)
+	if throttle.messages.Limit() != rate.Inf || throttle.bytes.Limit() != 1000 || throttle.bytes.Burst() != 1000 {
+		t.Fatalf("rates %v and %v", throttle.messages.Limit(), throttle.bytes.Limit())
+	}
+	if err := throttle.CheckReload(ThrottleConfig{MaxInflight: 20}); err == nil {
+		t.Fatal("max_inflight changed")
+	}
+}
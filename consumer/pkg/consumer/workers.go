@@ -0,0 +1,207 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/IBM/sarama"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/sink"
+)
+
+// Ordering keys for ProcessingConfig.OrderingKey.
+const (
+	OrderingByKey  = "key"
+	OrderingBySlot = "slot"
+	OrderingNone   = "none"
+)
+
+type ProcessingConfig struct {
+	// Workers is the number of goroutines processing each claimed partition.
+	// One keeps the partition strictly ordered.
+	Workers int `json:"workers" yaml:"workers"`
+	// QueueSize is the number of messages buffered per worker.
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+	// OrderingKey selects which messages keep their relative order: key for
+	// equal record keys, slot for equal slots or none.
+	OrderingKey    string                 `json:"ordering_key" yaml:"ordering_key"`
+	Reorder        sink.ReorderConfig     `json:"reorder" yaml:"reorder"`
+	Commitment     sink.CommitmentConfig  `json:"commitment" yaml:"commitment"`
+	Blocks         sink.BlocksConfig      `json:"blocks" yaml:"blocks"`
+	AccountDiff    sink.AccountDiffConfig `json:"account_diff" yaml:"account_diff"`
+	SignatureDedup SignatureDedupConfig   `json:"signature_dedup" yaml:"signature_dedup"`
+	Throttle       ThrottleConfig         `json:"throttle" yaml:"throttle"`
+	Backpressure   BackpressureConfig     `json:"backpressure" yaml:"backpressure"`
+	// Middlewares are the steps between the filter and the sink, the first
+	// one seeing every message first.
+	Middlewares []sink.MiddlewareConfig `json:"middlewares" yaml:"middlewares"`
+}
+
+func (c *ProcessingConfig) Validate() error {
+	if c.Workers <= 0 {
+		return errors.New("processing.workers: must be positive")
+	}
+	if c.QueueSize <= 0 {
+		return errors.New("processing.queue_size: must be positive")
+	}
+	switch c.OrderingKey {
+	case OrderingByKey, OrderingBySlot, OrderingNone:
+	default:
+		return fmt.Errorf("processing.ordering_key: expected key, slot or none, got %q", c.OrderingKey)
+	}
+	if err := c.Reorder.Validate(); err != nil {
+		return err
+	}
+	if err := c.Blocks.Validate(); err != nil {
+		return err
+	}
+	if err := c.AccountDiff.Validate(); err != nil {
+		return err
+	}
+	if err := c.SignatureDedup.Validate(); err != nil {
+		return err
+	}
+	if err := c.Throttle.Validate(); err != nil {
+		return err
+	}
+	if err := c.Backpressure.Validate(); err != nil {
+		return err
+	}
+	if _, err := sink.NewMiddlewares(c.Middlewares); err != nil {
+		return err
+	}
+	return c.Commitment.Validate()
+}
+
+// consumeParallel processes a claim with a pool of workers. Messages with the
+// same ordering key always go to the same worker, so they are processed in
+// partition order, while the offset is only marked once every earlier
+// message of the partition completed. A message that could not be
+// dead-lettered ends the claim with the error of process.
+func (h *Handler) consumeParallel(ctx context.Context, session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, tracker *offsetTracker) (err error) {
+	claimCtx, stop := context.WithCancel(session.Context())
+	defer stop()
+	failed := make(chan error, 1)
+	var wg sync.WaitGroup
+	queues := make([]chan *sarama.ConsumerMessage, h.processing.Workers)
+	for i := range queues {
+		queues[i] = make(chan *sarama.ConsumerMessage, h.processing.QueueSize)
+		wg.Add(1)
+		go func(queue <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for message := range queue {
+				h.commitMu.RLock()
+				err := h.process(ctx, claim, message, func() {
+					h.acknowledged()
+					tracker.complete(message.Offset)
+				})
+				h.commitMu.RUnlock()
+				if err != nil {
+					h.acknowledged()
+					select {
+					case failed <- err:
+					default:
+					}
+					stop()
+				}
+			}
+		}(queues[i])
+	}
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		wg.Wait()
+		select {
+		case err = <-failed:
+		default:
+		}
+	}()
+
+	var next int
+	for {
+		select {
+		case <-claimCtx.Done():
+			return nil
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			worker := next
+			switch h.processing.OrderingKey {
+			case OrderingByKey:
+				worker = hashWorker(message.Key, len(queues))
+			case OrderingBySlot:
+				if slot, ok := decode.ParseKeySlot(message.Key); ok {
+					worker = int(slot % uint64(len(queues)))
+				}
+			}
+			next = (next + 1) % len(queues)
+
+			// held back outside of commitMu, a commit flushing the sink
+			// releases the messages it held
+			if err := h.dispatch(claimCtx, message); err != nil {
+				return nil
+			}
+			tracker.add(message.Offset)
+			select {
+			case queues[worker] <- message:
+			case <-claimCtx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func hashWorker(key []byte, workers int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(workers))
+}
+
+// offsetTracker reports the highest offset below which every dispatched
+// message has completed.
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending []int64
+	done    map[int64]struct{}
+	mark    func(offset int64)
+}
+
+func newOffsetTracker(mark func(offset int64)) *offsetTracker {
+	return &offsetTracker{done: make(map[int64]struct{}), mark: mark}
+}
+
+// add registers a dispatched offset, offsets are added in partition order.
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	t.pending = append(t.pending, offset)
+	t.mu.Unlock()
+}
+
+func (t *offsetTracker) complete(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// already marked
+	if len(t.pending) == 0 || offset < t.pending[0] {
+		return
+	}
+	t.done[offset] = struct{}{}
+	last := int64(-1)
+	for len(t.pending) > 0 {
+		if _, ok := t.done[t.pending[0]]; !ok {
+			break
+		}
+		last = t.pending[0]
+		delete(t.done, last)
+		t.pending = t.pending[1:]
+	}
+	if last >= 0 {
+		t.mark(last)
+	}
+}
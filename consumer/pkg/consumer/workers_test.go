@@ -0,0 +1,78 @@
+package consumer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOffsetTrackerMarksContiguousPrefix(t *testing.T) {
+	var marked []int64
+	tracker := newOffsetTracker(func(offset int64) { marked = append(marked, offset) })
+	for offset := int64(10); offset < 15; offset++ {
+		tracker.add(offset)
+	}
+
+	steps := []struct {
+		complete int64
+		want     []int64
+	}{
+		{12, nil},
+		{11, nil},
+		{10, []int64{12}},
+		{14, []int64{12}},
+		{13, []int64{12, 14}},
+	}
+	for _, step := range steps {
+		tracker.complete(step.complete)
+		if !slices.Equal(marked, step.want) {
+			t.Fatalf("after completing %d marked %v, want %v", step.complete, marked, step.want)
+		}
+	}
+	if len(tracker.pending) != 0 || len(tracker.done) != 0 {
+		t.Fatalf("tracker kept state: pending %v, done %v", tracker.pending, tracker.done)
+	}
+}
+
+func TestOffsetTrackerSparseOffsets(t *testing.T) {
+	// compacted topics and transaction markers leave holes in the offsets
+	var marked []int64
+	tracker := newOffsetTracker(func(offset int64) { marked = append(marked, offset) })
+	for _, offset := range []int64{3, 7, 8} {
+		tracker.add(offset)
+	}
+	tracker.complete(8)
+	tracker.complete(3)
+	tracker.complete(7)
+	if want := []int64{3, 8}; !slices.Equal(marked, want) {
+		t.Fatalf("marked %v, want %v", marked, want)
+	}
+}
+
+func TestHashWorker(t *testing.T) {
+	for _, key := range []string{"", "1_ab", "265000104_ff"} {
+		worker := hashWorker([]byte(key), 4)
+		if worker < 0 || worker >= 4 {
+			t.Fatalf("hashWorker(%q) = %d, out of range", key, worker)
+		}
+		if again := hashWorker([]byte(key), 4); again != worker {
+			t.Fatalf("hashWorker(%q) not stable: %d then %d", key, worker, again)
+		}
+	}
+}
+
+func TestOffsetTrackerIgnoresMarkedOffsets(t *testing.T) {
+	var marked []int64
+	tracker := newOffsetTracker(func(offset int64) { marked = append(marked, offset) })
+	tracker.add(1)
+	tracker.add(2)
+	tracker.complete(1)
+	tracker.complete(1)
+	tracker.complete(2)
+	tracker.complete(2)
+	if want := []int64{1, 2}; !slices.Equal(marked, want) {
+		t.Fatalf("marked %v, want %v", marked, want)
+	}
+	if len(tracker.done) != 0 {
+		t.Fatalf("tracker kept completed offsets %v", tracker.done)
+	}
+}
@@ -0,0 +1,231 @@
+package decode
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// loadAvroSchemas returns the codecs of the .avsc files by topic.
+func loadAvroSchemas(files map[string]string) (map[string]*goavro.Codec, error) {
+	codecs := make(map[string]*goavro.Codec, len(files))
+	for topic, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("decoding.avro_schemas.%s: %w", topic, err)
+		}
+		codec, err := goavro.NewCodec(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("decoding.avro_schemas.%s: %w", topic, err)
+		}
+		codecs[topic] = codec
+	}
+	return codecs, nil
+}
+
+// setAvroMessage sets the fields of m from a record goavro decoded, matching
+// the Avro fields with the protobuf fields of the same name. A null field is
+// left unset, so the members of a oneof are nullable fields of which one is
+// set. Unknown fields fail unless discardUnknown is set.
+func setAvroMessage(m protoreflect.Message, datum any, discardUnknown bool) error {
+	descriptor := m.Descriptor()
+	if t, ok := datum.(time.Time); ok && descriptor.FullName() == "google.protobuf.Timestamp" {
+		// a timestamp-millis or timestamp-micros long
+		m.Set(descriptor.Fields().ByName("seconds"), protoreflect.ValueOfInt64(t.Unix()))
+		m.Set(descriptor.Fields().ByName("nanos"), protoreflect.ValueOfInt32(int32(t.Nanosecond())))
+		return nil
+	}
+	record, ok := datum.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: expected a record, got %T", descriptor.FullName(), datum)
+	}
+	for name, value := range record {
+		field := descriptor.Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			if discardUnknown {
+				continue
+			}
+			return fmt.Errorf("%s: unknown field %q", descriptor.FullName(), name)
+		}
+		if err := setAvroField(m, field, value, discardUnknown); err != nil {
+			return fmt.Errorf("%s.%s: %w", descriptor.Name(), name, err)
+		}
+	}
+	return nil
+}
+
+func setAvroField(m protoreflect.Message, field protoreflect.FieldDescriptor, value any, discardUnknown bool) error {
+	switch {
+	case field.IsList():
+		value = avroBranch(value, "array")
+		if value == nil {
+			return nil
+		}
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("expected an array, got %T", value)
+		}
+		list := m.Mutable(field).List()
+		for _, item := range items {
+			element := list.NewElement()
+			if err := avroValue(field, &element, avroUnion(item, field.Message()), discardUnknown); err != nil {
+				return err
+			}
+			list.Append(element)
+		}
+	case field.IsMap():
+		value = avroBranch(value, "map")
+		if value == nil {
+			return nil
+		}
+		entries, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected a map, got %T", value)
+		}
+		if field.MapKey().Kind() != protoreflect.StringKind {
+			return fmt.Errorf("map keys of kind %s are not supported", field.MapKey().Kind())
+		}
+		target := m.Mutable(field).Map()
+		for key, entry := range entries {
+			element := target.NewValue()
+			if err := avroValue(field.MapValue(), &element, avroUnion(entry, field.MapValue().Message()), discardUnknown); err != nil {
+				return err
+			}
+			target.Set(protoreflect.ValueOfString(key).MapKey(), element)
+		}
+	default:
+		value = avroUnion(value, field.Message())
+		if value == nil {
+			return nil
+		}
+		var v protoreflect.Value
+		if field.Message() != nil {
+			v = m.NewField(field)
+		}
+		if err := avroValue(field, &v, value, discardUnknown); err != nil {
+			return err
+		}
+		m.Set(field, v)
+	}
+	return nil
+}
+
+// avroValue converts an Avro value to the kind of field. v holds a new
+// message for message fields, which is filled in place.
+func avroValue(field protoreflect.FieldDescriptor, v *protoreflect.Value, value any, discardUnknown bool) error {
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return setAvroMessage(v.Message(), value, discardUnknown)
+	case protoreflect.BoolKind:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected a boolean, got %T", value)
+		}
+		*v = protoreflect.ValueOfBool(b)
+	case protoreflect.StringKind:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+		*v = protoreflect.ValueOfString(s)
+	case protoreflect.BytesKind:
+		switch b := value.(type) {
+		case []byte:
+			*v = protoreflect.ValueOfBytes(b)
+		case string:
+			*v = protoreflect.ValueOfBytes([]byte(b))
+		default:
+			return fmt.Errorf("expected bytes, got %T", value)
+		}
+	case protoreflect.EnumKind:
+		switch e := value.(type) {
+		case string:
+			ev := field.Enum().Values().ByName(protoreflect.Name(e))
+			if ev == nil {
+				return fmt.Errorf("unknown %s value %q", field.Enum().Name(), e)
+			}
+			*v = protoreflect.ValueOfEnum(ev.Number())
+		default:
+			n, ok := avroInteger(value)
+			if !ok {
+				return fmt.Errorf("expected an enum, got %T", value)
+			}
+			*v = protoreflect.ValueOfEnum(protoreflect.EnumNumber(n))
+		}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		var f float64
+		switch n := value.(type) {
+		case float32:
+			f = float64(n)
+		case float64:
+			f = n
+		default:
+			return fmt.Errorf("expected a float, got %T", value)
+		}
+		*v = protoreflect.ValueOfFloat64(f)
+		if field.Kind() == protoreflect.FloatKind {
+			*v = protoreflect.ValueOfFloat32(float32(f))
+		}
+	default:
+		n, ok := avroInteger(value)
+		if !ok {
+			return fmt.Errorf("expected an integer, got %T", value)
+		}
+		// Avro has no unsigned integers, a uint64 is written as the long of
+		// the same bits
+		switch field.Kind() {
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+			*v = protoreflect.ValueOfInt32(int32(n))
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+			*v = protoreflect.ValueOfUint32(uint32(n))
+		case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			*v = protoreflect.ValueOfInt64(n)
+		default:
+			*v = protoreflect.ValueOfUint64(uint64(n))
+		}
+	}
+	return nil
+}
+
+func avroInteger(value any) (int64, bool) {
+	switch n := value.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// avroUnion returns the value of a union branch, which goavro decodes as a
+// map from the name of the branch to its value. The record of a message
+// with a single field is told apart by the name of that field.
+func avroUnion(value any, message protoreflect.MessageDescriptor) any {
+	branch, ok := value.(map[string]any)
+	if !ok || len(branch) != 1 {
+		return value
+	}
+	for name, v := range branch {
+		if message != nil && message.Fields().ByName(protoreflect.Name(name)) != nil {
+			return value
+		}
+		return v
+	}
+	return value
+}
+
+// avroBranch returns the value of the union branch name, for arrays and
+// maps whose own values cannot tell.
+func avroBranch(value any, name string) any {
+	if branch, ok := value.(map[string]any); ok && len(branch) == 1 {
+		if v, ok := branch[name]; ok {
+			return v
+		}
+	}
+	return value
+}
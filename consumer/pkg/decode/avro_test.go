@@ -0,0 +1,184 @@
+package decode
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/linkedin/goavro/v2"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"consumer/internal/testkey"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+// updateAvroSchema writes SubscribeUpdate envelopes carrying account or slot
+// updates.
+const updateAvroSchema = `{
+  "type": "record", "name": "SubscribeUpdate", "namespace": "geyser",
+  "fields": [
+    {"name": "filters", "type": {"type": "array", "items": "string"}},
+    {"name": "account", "type": ["null", {"type": "record", "name": "SubscribeUpdateAccount", "fields": [
+      {"name": "account", "type": {"type": "record", "name": "SubscribeUpdateAccountInfo", "fields": [
+        {"name": "pubkey", "type": "bytes"},
+        {"name": "lamports", "type": "long"},
+        {"name": "txn_signature", "type": ["null", "bytes"]}
+      ]}},
+      {"name": "slot", "type": "long"}
+    ]}], "default": null},
+    {"name": "slot", "type": ["null", {"type": "record", "name": "SubscribeUpdateSlot", "fields": [
+      {"name": "slot", "type": "long"},
+      {"name": "parent", "type": ["null", "long"]},
+      {"name": "status", "type": {"type": "enum", "name": "CommitmentLevel", "symbols": ["PROCESSED", "CONFIRMED", "FINALIZED"]}}
+    ]}], "default": null},
+    {"name": "created_at", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null}
+  ]
+}`
+
+func TestDecodeAvro(t *testing.T) {
+	codec, err := goavro.NewCodec(updateAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.UnixMilli(1_714_564_800_123).UTC()
+	account, err := codec.BinaryFromNative(nil, map[string]any{
+		"filters": []any{"wallets"},
+		"account": goavro.Union("geyser.SubscribeUpdateAccount", map[string]any{
+			"account": map[string]any{
+				"pubkey":        testkey.Key(1),
+				"lamports":      int64(-1),
+				"txn_signature": goavro.Union("bytes", testkey.Key(2)),
+			},
+			"slot": int64(42),
+		}),
+		"slot":       nil,
+		"created_at": goavro.Union("long.timestamp-millis", createdAt),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, err := codec.BinaryFromNative(nil, map[string]any{
+		"filters": []any{},
+		"account": nil,
+		"slot": goavro.Union("geyser.SubscribeUpdateSlot", map[string]any{
+			"slot": int64(43), "parent": goavro.Union("long", int64(42)), "status": "FINALIZED",
+		}),
+		"created_at": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "update.avsc")
+	if err := os.WriteFile(file, []byte(updateAvroSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDecoder(Config{
+		Kind:        "update",
+		Formats:     map[string]string{"updates.avro": EncodingAvro},
+		AvroSchemas: map[string]string{"updates.avro": file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := d.Decode(&sarama.ConsumerMessage{Topic: "updates.avro", Value: account})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &proto.SubscribeUpdate{
+		Filters: []string{"wallets"},
+		UpdateOneof: &proto.SubscribeUpdate_Account{Account: &proto.SubscribeUpdateAccount{
+			Account: &proto.SubscribeUpdateAccountInfo{Pubkey: testkey.Key(1), Lamports: 1<<64 - 1, TxnSignature: testkey.Key(2)},
+			Slot:    42,
+		}},
+		CreatedAt: timestamppb.New(createdAt),
+	}
+	if !gproto.Equal(msg.Update, want) || msg.Slot != 42 {
+		t.Fatalf("decoded %v, want %v", msg.Update, want)
+	}
+	msg, err = d.Decode(&sarama.ConsumerMessage{Topic: "updates.avro", Value: slot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := uint64(42)
+	if want := (&proto.SubscribeUpdateSlot{Slot: 43, Parent: &parent, Status: proto.CommitmentLevel_FINALIZED}); !gproto.Equal(msg.Update.GetSlot(), want) {
+		t.Fatalf("decoded %v, want %v", msg.Update.GetSlot(), want)
+	}
+
+	// the same records framed with the id of the schema in the registry
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"schema": updateAvroSchema})
+	}))
+	defer registry.Close()
+	d, err = NewDecoder(Config{
+		Kind:           "update",
+		Format:         EncodingAvro,
+		SchemaRegistry: SchemaRegistryConfig{URL: registry.URL, Timeout: duration.Duration(time.Second)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := append([]byte{0, 0, 0, 0, 5}, slot...)
+	if msg, err := d.Decode(&sarama.ConsumerMessage{Topic: "updates", Value: framed}); err != nil || msg.Update.GetSlot().GetSlot() != 43 {
+		t.Fatalf("decoded %v, %v", msg, err)
+	}
+	if _, err := d.Decode(&sarama.ConsumerMessage{Topic: "updates", Value: slot}); err == nil {
+		t.Fatal("decoded a record without the header or a schema file")
+	}
+}
+
+func TestDecodeAvroUnknownField(t *testing.T) {
+	const schema = `{"type": "record", "name": "SubscribeUpdateSlot", "fields": [
+	  {"name": "slot", "type": "long"}, {"name": "leader", "type": "string"}]}`
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := codec.BinaryFromNative(nil, map[string]any{"slot": int64(7), "leader": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, discard := range []bool{false, true} {
+		msg := &proto.SubscribeUpdateSlot{}
+		datum, _, _ := codec.NativeFromBinary(value)
+		err := setAvroMessage(msg.ProtoReflect(), datum, discard)
+		if discard != (err == nil) || (discard && msg.GetSlot() != 7) {
+			t.Errorf("discard %v: got %v, %v", discard, msg, err)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	d, err := NewDecoder(Config{Kind: "transaction", Format: EncodingJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := `{"signature": "` + "AQ==" + `", "isVote": true, "index": "3"}`
+	for _, payload := range [][]byte{[]byte(value), append([]byte{0, 0, 0, 0, 9}, value...)} {
+		msg, err := d.Decode(&sarama.ConsumerMessage{Key: []byte("42_ff"), Value: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := msg.Update.GetTransaction().GetTransaction()
+		if msg.Slot != 42 || !info.GetIsVote() || info.GetIndex() != 3 || string(info.GetSignature()) != "\x01" {
+			t.Fatalf("decoded %v", msg.Update)
+		}
+	}
+	if _, err := d.Decode(&sarama.ConsumerMessage{Value: []byte(`{"bogus": 1}`)}); err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Fatalf("got %v, want the unknown field", err)
+	}
+
+	if _, err := NewDecoder(Config{Kind: "transaction", Formats: map[string]string{"t": "xml"}}); err == nil {
+		t.Fatal("NewDecoder accepted an unknown format")
+	}
+}
@@ -0,0 +1,95 @@
+package decode
+
+import (
+	"math/big"
+	"slices"
+	"strconv"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// BalanceChange is how a transaction changed the lamports of an account, or
+// the tokens of a token account when Mint is set. Amounts are in lamports or
+// base units, Change is Post minus Pre. The fee payer's change includes the
+// fee.
+type BalanceChange struct {
+	Account  string   `json:"account"`
+	Owner    string   `json:"owner,omitempty"`
+	Mint     string   `json:"mint,omitempty"`
+	Pre      uint64   `json:"pre"`
+	Post     uint64   `json:"post"`
+	Change   *big.Int `json:"change"`
+	Decimals *uint32  `json:"decimals,omitempty"`
+}
+
+// BalanceChanges returns the SOL changes of a transaction by account index,
+// followed by its token changes. Accounts whose balance did not change are
+// left out, a token account missing from the pre or post balances was
+// created or closed and held nothing then.
+func BalanceChanges(info *proto.SubscribeUpdateTransactionInfo) []BalanceChange {
+	keys := TransactionAccounts(info)
+	meta := info.GetMeta()
+	var changes []BalanceChange
+	pre, post := meta.GetPreBalances(), meta.GetPostBalances()
+	for i := 0; i < len(pre) && i < len(post) && i < len(keys); i++ {
+		if pre[i] != post[i] {
+			changes = append(changes, newBalanceChange(base58.Encode(keys[i]), pre[i], post[i]))
+		}
+	}
+
+	type tokenBalances struct {
+		pre, post *proto.TokenBalance
+	}
+	tokens := make(map[uint32]*tokenBalances)
+	for _, balance := range meta.GetPreTokenBalances() {
+		tokens[balance.GetAccountIndex()] = &tokenBalances{pre: balance}
+	}
+	for _, balance := range meta.GetPostTokenBalances() {
+		if balances, ok := tokens[balance.GetAccountIndex()]; ok {
+			balances.post = balance
+		} else {
+			tokens[balance.GetAccountIndex()] = &tokenBalances{post: balance}
+		}
+	}
+	indexes := make([]uint32, 0, len(tokens))
+	for index := range tokens {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	for _, index := range indexes {
+		balances := tokens[index]
+		preAmount, ok := tokenAmount(balances.pre)
+		postAmount, ok2 := tokenAmount(balances.post)
+		if !ok || !ok2 || preAmount == postAmount || int(index) >= len(keys) {
+			continue
+		}
+		// the post balance knows the mint and owner of a created account
+		known := balances.post
+		if known == nil {
+			known = balances.pre
+		}
+		change := newBalanceChange(base58.Encode(keys[index]), preAmount, postAmount)
+		change.Owner, change.Mint = known.GetOwner(), known.GetMint()
+		decimals := known.GetUiTokenAmount().GetDecimals()
+		change.Decimals = &decimals
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func newBalanceChange(account string, pre, post uint64) BalanceChange {
+	change := new(big.Int).SetUint64(post)
+	change.Sub(change, new(big.Int).SetUint64(pre))
+	return BalanceChange{Account: account, Pre: pre, Post: post, Change: change}
+}
+
+// tokenAmount returns the amount of a token balance, 0 for a missing one.
+func tokenAmount(balance *proto.TokenBalance) (uint64, bool) {
+	if balance == nil {
+		return 0, true
+	}
+	amount, err := strconv.ParseUint(balance.GetUiTokenAmount().GetAmount(), 10, 64)
+	return amount, err == nil
+}
@@ -0,0 +1,65 @@
+package decode
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// balanceTransaction moves 5000 lamports from testkey.Key(1) to testkey.Key(2) and 30
+// tokens of mint testkey.Key(20) from account testkey.Key(3), which it closes, to the
+// new account testkey.Key(4).
+func balanceTransaction(slot uint64) *Message {
+	msg := transactionMessage(slot, testkey.Key(9), testkey.Key(1), testkey.Key(2), testkey.Key(3), testkey.Key(4))
+	tokenBalance := func(index uint32, owner byte, amount string) *proto.TokenBalance {
+		return &proto.TokenBalance{
+			AccountIndex:  index,
+			Mint:          testkey.String(20),
+			Owner:         testkey.String(owner),
+			UiTokenAmount: &proto.UiTokenAmount{Amount: amount, Decimals: 6},
+		}
+	}
+	msg.Update.GetTransaction().GetTransaction().Meta = &proto.TransactionStatusMeta{
+		PreBalances:       []uint64{1_000_000, 0, 2_039_280, 0, 1},
+		PostBalances:      []uint64{995_000, 5_000, 2_039_280, 0, 1},
+		PreTokenBalances:  []*proto.TokenBalance{tokenBalance(2, 10, "30")},
+		PostTokenBalances: []*proto.TokenBalance{tokenBalance(3, 11, "30")},
+	}
+	return msg
+}
+
+func TestBalanceChanges(t *testing.T) {
+	six := uint32(6)
+	want := []BalanceChange{
+		{Account: testkey.String(1), Pre: 1_000_000, Post: 995_000, Change: big.NewInt(-5_000)},
+		{Account: testkey.String(2), Pre: 0, Post: 5_000, Change: big.NewInt(5_000)},
+		{Account: testkey.String(3), Owner: testkey.String(10), Mint: testkey.String(20), Pre: 30, Post: 0, Change: big.NewInt(-30), Decimals: &six},
+		{Account: testkey.String(4), Owner: testkey.String(11), Mint: testkey.String(20), Pre: 0, Post: 30, Change: big.NewInt(30), Decimals: &six},
+	}
+	got := BalanceChanges(balanceTransaction(10).Update.GetTransaction().GetTransaction())
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+
+	out, err := FormatJSON(balanceTransaction(10).Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update struct {
+		Transaction struct {
+			Transaction struct {
+				BalanceChanges []map[string]any `json:"balance_changes"`
+			} `json:"transaction"`
+		} `json:"transaction"`
+	}
+	if err := json.Unmarshal(out, &update); err != nil {
+		t.Fatal(err)
+	}
+	if changes := update.Transaction.Transaction.BalanceChanges; len(changes) != 4 || changes[0]["change"] != -5000.0 {
+		t.Fatalf("balance_changes in %s", out)
+	}
+}
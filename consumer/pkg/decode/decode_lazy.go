@@ -0,0 +1,75 @@
+package decode
+
+import (
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// transactionInfoMeta is the field number of the meta of a
+// SubscribeUpdateTransactionInfo.
+const transactionInfoMeta protowire.Number = 4
+
+// prunedMetaFields are the fields of TransactionStatusMeta that no filter
+// but the event and expression filters reads: the pre and post balances,
+// the logs, the token balances, the rewards and the return data, most of the
+// bytes of a transaction.
+var prunedMetaFields = map[protowire.Number]bool{3: true, 4: true, 6: true, 7: true, 8: true, 9: true, 14: true}
+
+// DecodeLazy decodes record as Decode does, except for the protobuf
+// transactions of decoding.lazy, decoded without their prunedMetaFields. It
+// reports whether msg was pruned, a pruned message has to be decoded again
+// with Decode for the sink once it passed the filter.
+func (d *Decoder) DecodeLazy(record *sarama.ConsumerMessage) (msg *Message, pruned bool, err error) {
+	pruned = d.lazy && d.KindOf(record.Topic) == KindTransaction && d.FormatOf(record.Topic) == EncodingProtobuf
+	msg, err = d.decode(record, pruned)
+	return msg, pruned, err
+}
+
+// pruneTransactionInfo returns the SubscribeUpdateTransactionInfo in payload
+// with the prunedMetaFields left out of its meta.
+func pruneTransactionInfo(payload []byte) ([]byte, error) {
+	out := make([]byte, 0, len(payload)/2)
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, payload[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		if num == transactionInfoMeta && typ == protowire.BytesType {
+			meta, _ := protowire.ConsumeBytes(payload[n:])
+			pruned, err := pruneFields(meta, prunedMetaFields)
+			if err != nil {
+				return nil, err
+			}
+			out = protowire.AppendTag(out, num, typ)
+			out = protowire.AppendBytes(out, pruned)
+		} else {
+			out = append(out, payload[:n+m]...)
+		}
+		payload = payload[n+m:]
+	}
+	return out, nil
+}
+
+// pruneFields returns the message in payload without the fields of drop.
+func pruneFields(payload []byte, drop map[protowire.Number]bool) ([]byte, error) {
+	out := make([]byte, 0, len(payload)/4)
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, payload[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		if !drop[num] {
+			out = append(out, payload[:n+m]...)
+		}
+		payload = payload[n+m:]
+	}
+	return out, nil
+}
@@ -0,0 +1,63 @@
+package decode
+
+import (
+	"bytes"
+	"testing"
+
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// prunableTransaction is a failed transaction of program with logs, balances
+// and an inner instruction.
+func prunableTransaction(program []byte) *proto.SubscribeUpdateTransactionInfo {
+	info := transactionMessage(10, program, testkey.Key(2)).Update.GetTransaction().GetTransaction()
+	info.Meta = &proto.TransactionStatusMeta{
+		Err:                     &proto.TransactionError{Err: []byte{1}},
+		Fee:                     5000,
+		PreBalances:             []uint64{10, 20},
+		PostBalances:            []uint64{5, 20},
+		LogMessages:             []string{"Program log: hello"},
+		InnerInstructions:       []*proto.InnerInstructions{{Index: 0, Instructions: []*proto.InnerInstruction{{ProgramIdIndex: 0}}}},
+		LoadedWritableAddresses: [][]byte{testkey.Key(3)},
+	}
+	return info
+}
+
+func TestPruneTransactionInfo(t *testing.T) {
+	payload, err := gproto.Marshal(prunableTransaction(testkey.Key(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := pruneTransactionInfo(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) >= len(payload) {
+		t.Fatalf("pruned %d of %d bytes", len(payload)-len(pruned), len(payload))
+	}
+	info := &proto.SubscribeUpdateTransactionInfo{}
+	if err := gproto.Unmarshal(pruned, info); err != nil {
+		t.Fatal(err)
+	}
+	meta := info.GetMeta()
+	if len(meta.GetLogMessages()) != 0 || len(meta.GetPreBalances()) != 0 || len(meta.GetPostBalances()) != 0 {
+		t.Fatalf("meta kept %v", meta)
+	}
+	if !bytes.Equal(info.GetSignature(), testkey.Key(0xff)) || meta.GetErr() == nil || meta.GetFee() != 5000 {
+		t.Fatalf("pruned info %v", info)
+	}
+	// the programs and accounts the filters read stay
+	if programs := TransactionPrograms(info); len(programs) != 2 || !bytes.Equal(programs[0], testkey.Key(1)) {
+		t.Fatalf("programs %x", programs)
+	}
+	if accounts := TransactionAccounts(info); len(accounts) != 3 || !bytes.Equal(accounts[2], testkey.Key(3)) {
+		t.Fatalf("accounts %x", accounts)
+	}
+
+	if _, err := pruneTransactionInfo([]byte{0x22, 0x05, 0x01}); err == nil {
+		t.Fatal("truncated payload accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package decode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/mr-tron/base58"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"consumer/proto"
+)
+
+// bytesFormat is how a bytes field is rendered for humans.
+type bytesFormat int
+
+const (
+	// bytesBase58 is used for keys, signatures, hashes and instruction
+	// data, matching what explorers and the Solana RPC show.
+	bytesBase58 bytesFormat = iota
+	// bytesBase64 is used for opaque blobs such as account data.
+	bytesBase64
+	// bytesIndexes is used for account index lists, rendered as numbers.
+	bytesIndexes
+)
+
+// bytesFormats overrides the base58 default for fields that are not keys.
+var bytesFormats = map[protoreflect.FullName]bytesFormat{
+	"geyser.SubscribeUpdateAccountInfo.data":                                   bytesBase64,
+	"geyser.SubscribeRequestFilterAccountsFilterMemcmp.bytes":                  bytesBase64,
+	"solana.storage.ConfirmedBlock.TransactionError.err":                       bytesBase64,
+	"solana.storage.ConfirmedBlock.ReturnData.data":                            bytesBase64,
+	"solana.storage.ConfirmedBlock.CompiledInstruction.accounts":               bytesIndexes,
+	"solana.storage.ConfirmedBlock.InnerInstruction.accounts":                  bytesIndexes,
+	"solana.storage.ConfirmedBlock.MessageAddressTableLookup.writable_indexes": bytesIndexes,
+	"solana.storage.ConfirmedBlock.MessageAddressTableLookup.readonly_indexes": bytesIndexes,
+}
+
+// FormatJSON renders a protobuf message as JSON with proto field names,
+// base58 keys and signatures, and integers as numbers. Transactions get the
+// decoded instructions of the token, system and compute budget programs and
+// of programs with an IDL, their balance changes and parsed logs, see
+// addDecodedInstructions, and the accounts of the token programs their token
+// account or mint.
+func FormatJSON(m gproto.Message) ([]byte, error) {
+	return json.Marshal(FormatMessage(m.ProtoReflect()))
+}
+
+// JSONRecord is a message as one JSON object, with the position of its
+// Kafka record.
+type JSONRecord struct {
+	Kind      UpdateKind        `json:"kind"`
+	Slot      uint64            `json:"slot"`
+	Topic     string            `json:"topic"`
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Timestamp time.Time         `json:"timestamp"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Update    json.RawMessage   `json:"update"`
+}
+
+// FormatRecordJSON renders msg as a JSON object holding its kind, slot,
+// record position and headers, and the update as FormatJSON does.
+func FormatRecordJSON(msg *Message) ([]byte, error) {
+	update, err := FormatJSON(msg.Update)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(JSONRecord{
+		Kind:      msg.Kind(),
+		Slot:      msg.Slot,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: msg.Timestamp,
+		Headers:   msg.Headers,
+		Update:    update,
+	})
+}
+
+// FormatMessage converts a message into values encoding/json understands.
+// Unset message fields and oneofs are left out, scalars are always present.
+func FormatMessage(m protoreflect.Message) map[string]any {
+	out := make(map[string]any)
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !m.Has(fd) {
+			continue
+		}
+		out[string(fd.Name())] = FormatField(fd, m.Get(fd))
+	}
+	switch info := m.Interface().(type) {
+	case *proto.SubscribeUpdateTransactionInfo:
+		addDecodedInstructions(out, info)
+	case *proto.SubscribeUpdateAccountInfo:
+		addDecodedAccount(out, info)
+	}
+	return out
+}
+
+// addDecodedInstructions adds the decoded instructions of well-known programs,
+// the balance changes and the parsed program logs to the JSON of a
+// transaction, leaving out those it does not have.
+func addDecodedInstructions(out map[string]any, info *proto.SubscribeUpdateTransactionInfo) {
+	if instructions := DecodeTokenInstructions(info); len(instructions) > 0 {
+		out["token_instructions"] = instructions
+	}
+	if instructions := DecodeSystemInstructions(info); len(instructions) > 0 {
+		out["system_instructions"] = instructions
+	}
+	if swaps := DecodeSwaps(info); len(swaps) > 0 {
+		out["swaps"] = swaps
+	}
+	if events := DecodeMintEvents(info); len(events) > 0 {
+		out["mint_events"] = events
+	}
+	if budget, ok := DecodeComputeBudget(info); ok {
+		out["compute_budget"] = budget
+	}
+	if instructions := DefaultIDLDecoder.DecodeInstructions(info); len(instructions) > 0 {
+		out["anchor_instructions"] = instructions
+	}
+	if changes := BalanceChanges(info); len(changes) > 0 {
+		out["balance_changes"] = changes
+	}
+	if logs, ok := ParseProgramLogs(info); ok {
+		out["program_logs"] = logs
+	}
+}
+
+// addDecodedAccount adds the token account or the mint an account of a token
+// program holds to its JSON.
+func addDecodedAccount(out map[string]any, info *proto.SubscribeUpdateAccountInfo) {
+	switch decoded := decodeTokenAccount(info).(type) {
+	case *TokenAccountState:
+		out["token_account"] = decoded
+	case *TokenMintState:
+		out["token_mint"] = decoded
+	}
+}
+
+func FormatField(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		out := make([]any, list.Len())
+		for i := range out {
+			out[i] = formatValue(fd, list.Get(i))
+		}
+		return out
+	case fd.IsMap():
+		out := make(map[string]any)
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			out[k.String()] = formatValue(fd.MapValue(), v)
+			return true
+		})
+		return out
+	}
+	return formatValue(fd, v)
+}
+
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return FormatMessage(v.Message())
+	case protoreflect.EnumKind:
+		if value := fd.Enum().Values().ByNumber(v.Enum()); value != nil {
+			return string(value.Name())
+		}
+		return int32(v.Enum())
+	case protoreflect.BytesKind:
+		return formatBytes(fd, v.Bytes())
+	}
+	return v.Interface()
+}
+
+func formatBytes(fd protoreflect.FieldDescriptor, b []byte) any {
+	switch bytesFormats[fd.FullName()] {
+	case bytesBase64:
+		return base64.StdEncoding.EncodeToString(b)
+	case bytesIndexes:
+		return accountIndexes(b)
+	}
+	return base58.Encode(b)
+}
+
+// EncodeKeys renders account keys as base58.
+func EncodeKeys(keys [][]byte) []string {
+	out := make([]string, len(keys))
+	for i, key := range keys {
+		out[i] = base58.Encode(key)
+	}
+	return out
+}
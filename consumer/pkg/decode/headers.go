@@ -0,0 +1,74 @@
+package decode
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"consumer/proto"
+)
+
+// Headers grpc2kafka attaches to every record it produces.
+const (
+	HeaderCreatedAt  = "created_at"
+	HeaderCommitment = "commitment"
+	HeaderSource     = "source"
+)
+
+// Commitment levels, the values of the commitment header.
+const (
+	CommitmentProcessed = "processed"
+	CommitmentConfirmed = "confirmed"
+	CommitmentFinalized = "finalized"
+)
+
+// RecordHeaders returns the headers of a consumed record by key, the last
+// value winning when a key repeats. It returns nil without headers.
+func RecordHeaders(headers []*sarama.RecordHeader) map[string]string {
+	return fillHeaders(nil, headers)
+}
+
+// fillHeaders adds headers to the empty map out, allocating it when nil.
+func fillHeaders(out map[string]string, headers []*sarama.RecordHeader) map[string]string {
+	if len(headers) == 0 {
+		return out
+	}
+	if out == nil {
+		out = make(map[string]string, len(headers))
+	}
+	for _, header := range headers {
+		if header != nil {
+			out[string(header.Key)] = string(header.Value)
+		}
+	}
+	return out
+}
+
+// ProducerHeaders carries the headers of msg over to a record produced from
+// it, in the order of their keys.
+func ProducerHeaders(msg *Message) []sarama.RecordHeader {
+	if len(msg.Headers) == 0 {
+		return nil
+	}
+	out := make([]sarama.RecordHeader, 0, len(msg.Headers))
+	for _, key := range slices.Sorted(maps.Keys(msg.Headers)) {
+		out = append(out, sarama.RecordHeader{Key: []byte(key), Value: []byte(msg.Headers[key])})
+	}
+	return out
+}
+
+// UpdateHeaders returns the headers of a record grpc2kafka produces for an
+// update received from source at commitment.
+func UpdateHeaders(update *proto.SubscribeUpdate, commitment, source string) []sarama.RecordHeader {
+	headers := []sarama.RecordHeader{
+		{Key: []byte(HeaderCommitment), Value: []byte(commitment)},
+		{Key: []byte(HeaderSource), Value: []byte(source)},
+	}
+	if update.GetCreatedAt() != nil {
+		createdAt := update.GetCreatedAt().AsTime().UTC().Format(time.RFC3339Nano)
+		headers = append(headers, sarama.RecordHeader{Key: []byte(HeaderCreatedAt), Value: []byte(createdAt)})
+	}
+	return headers
+}
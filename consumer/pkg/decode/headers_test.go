@@ -0,0 +1,54 @@
+package decode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"consumer/proto"
+)
+
+func TestHeaders(t *testing.T) {
+	d, err := NewDecoder(Config{Kind: "slot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 5, time.UTC)
+	update := &proto.SubscribeUpdate{CreatedAt: timestamppb.New(createdAt)}
+	var headers []*sarama.RecordHeader
+	for _, header := range UpdateHeaders(update, "confirmed", "mainnet:10000") {
+		headers = append(headers, &header)
+	}
+	headers = append(headers, &sarama.RecordHeader{Key: []byte(HeaderSource), Value: []byte("backup:10000")})
+
+	msg, err := d.Decode(&sarama.ConsumerMessage{Value: []byte{8, 42}, Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		HeaderCommitment: "confirmed",
+		HeaderSource:     "backup:10000",
+		HeaderCreatedAt:  "2024-05-01T12:00:00.000000005Z",
+	}
+	if len(msg.Headers) != len(want) {
+		t.Fatalf("headers %v, want %v", msg.Headers, want)
+	}
+	for key, value := range want {
+		if msg.Headers[key] != value {
+			t.Errorf("header %s = %q, want %q", key, msg.Headers[key], value)
+		}
+	}
+
+	// re-produced in the order of their keys
+	produced := ProducerHeaders(msg)
+	for i, key := range []string{HeaderCommitment, HeaderCreatedAt, HeaderSource} {
+		if string(produced[i].Key) != key || string(produced[i].Value) != want[key] {
+			t.Errorf("produced header %d = %s: %s, want %s", i, produced[i].Key, produced[i].Value, key)
+		}
+	}
+	if ProducerHeaders(&Message{}) != nil || RecordHeaders(nil) != nil {
+		t.Error("headers of a record without them")
+	}
+}
@@ -0,0 +1,756 @@
+package decode
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/duration"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// IDLConfig points at the Anchor IDLs of the programs whose instructions are
+// decoded in the JSON output.
+type IDLConfig struct {
+	// Dir holds IDL JSON files. A file is for the program at its address, or
+	// named by the file name without .json for IDLs without one.
+	Dir string `json:"dir" yaml:"dir"`
+	// Registry is a URL with a {program} placeholder the IDL of each of
+	// Programs is fetched from at startup.
+	Registry string            `json:"registry" yaml:"registry"`
+	Programs []string          `json:"programs" yaml:"programs"`
+	Timeout  duration.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func DefaultIDLConfig() IDLConfig {
+	return IDLConfig{Timeout: duration.Duration(10 * time.Second)}
+}
+
+func (c *IDLConfig) Validate() error {
+	if c.Registry != "" && !strings.Contains(c.Registry, "{program}") {
+		return errors.New("decoding.idl.registry: must contain {program}")
+	}
+	if len(c.Programs) > 0 && c.Registry == "" {
+		return errors.New("decoding.idl.programs: needs decoding.idl.registry")
+	}
+	if _, err := NewKeySet(c.Programs); err != nil {
+		return fmt.Errorf("decoding.idl.programs: %w", err)
+	}
+	if c.Timeout <= 0 {
+		return errors.New("decoding.idl.timeout: must be positive")
+	}
+	return nil
+}
+
+// DefaultIDLDecoder decodes the instructions of the programs with a loaded
+// IDL into the JSON output, it is installed at startup and nil without IDLs.
+var DefaultIDLDecoder *IDLDecoder
+
+// IDLDecoder decodes instructions with Anchor IDLs, keyed by program.
+type IDLDecoder struct {
+	programs map[string]*idlProgram
+}
+
+// LoadIDLs reads the IDLs of the directory and fetches those of the registry.
+func LoadIDLs(ctx context.Context, config IDLConfig) (*IDLDecoder, error) {
+	d := &IDLDecoder{programs: make(map[string]*idlProgram)}
+	if config.Dir != "" {
+		entries, err := os.ReadDir(config.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("read idl dir: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+				continue
+			}
+			path := filepath.Join(config.Dir, entry.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read idl: %w", err)
+			}
+			if err := d.add(data, strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), false); err != nil {
+				return nil, fmt.Errorf("idl %s: %w", path, err)
+			}
+		}
+	}
+	client := &http.Client{Timeout: time.Duration(config.Timeout)}
+	for _, program := range config.Programs {
+		data, err := fetchIDL(ctx, client, strings.ReplaceAll(config.Registry, "{program}", program))
+		if err != nil {
+			return nil, fmt.Errorf("fetch idl of %s: %w", program, err)
+		}
+		if err := d.add(data, program, true); err != nil {
+			return nil, fmt.Errorf("idl of %s: %w", program, err)
+		}
+	}
+	return d, nil
+}
+
+func fetchIDL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// add parses an IDL for the program at its address, or at address when it
+// has none or override is set.
+func (d *IDLDecoder) add(data []byte, address string, override bool) error {
+	program, idlAddress, err := parseIDL(data)
+	if err != nil {
+		return err
+	}
+	if !override {
+		address = cmp.Or(idlAddress, address)
+	}
+	key, err := base58.Decode(address)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid program address %q", address)
+	}
+	if _, ok := d.programs[string(key)]; ok {
+		return fmt.Errorf("program %s has two IDLs", address)
+	}
+	program.id = address
+	d.programs[string(key)] = program
+	return nil
+}
+
+// Len returns the number of programs with an IDL.
+func (d *IDLDecoder) Len() int {
+	if d == nil {
+		return 0
+	}
+	return len(d.programs)
+}
+
+// AnchorInstruction is an instruction decoded with the IDL of its program,
+// numbered like TokenInstruction. Accounts are named by the IDL, accounts of
+// nested groups as group.name, and Args hold the decoded arguments.
+type AnchorInstruction struct {
+	Program          string            `json:"program"`
+	ProgramID        string            `json:"program_id"`
+	Name             string            `json:"name"`
+	Instruction      int               `json:"instruction"`
+	InnerInstruction *int              `json:"inner_instruction,omitempty"`
+	Accounts         map[string]string `json:"accounts,omitempty"`
+	Args             map[string]any    `json:"args"`
+}
+
+// DecodeInstructions decodes the instructions of a transaction calling
+// programs with an IDL. Instructions the IDL does not know, such as event
+// CPIs, are left out, as are those failing to decode.
+func (d *IDLDecoder) DecodeInstructions(info *proto.SubscribeUpdateTransactionInfo) []AnchorInstruction {
+	if d.Len() == 0 {
+		return nil
+	}
+	keys := TransactionAccounts(info)
+	var out []AnchorInstruction
+	eachInstruction(info, func(outer int, inner *int, programIndex uint32, accounts, data []byte) {
+		if int(programIndex) >= len(keys) {
+			return
+		}
+		program, ok := d.programs[string(keys[programIndex])]
+		if !ok {
+			return
+		}
+		decoded, ok, err := program.decode(keys, accounts, data)
+		if err != nil {
+			metrics.IDLDecodeFailuresTotal.WithLabelValues(program.id).Inc()
+			return
+		}
+		if ok {
+			decoded.Instruction, decoded.InnerInstruction = outer, inner
+			out = append(out, decoded)
+		}
+	})
+	return out
+}
+
+// decodeEvent decodes the data of an event emitted by program, a discriminator
+// followed by the Borsh encoded event. It reports false for programs without
+// an IDL and events the IDL does not know or fails to decode.
+func (d *IDLDecoder) decodeEvent(program []byte, data []byte) (string, any, bool) {
+	if d.Len() == 0 || len(data) < 8 {
+		return "", nil, false
+	}
+	p, ok := d.programs[string(program)]
+	if !ok {
+		return "", nil, false
+	}
+	event, ok := p.events[string(data[:8])]
+	if !ok {
+		return "", nil, false
+	}
+	r := &borshReader{program: p, data: data[8:]}
+	var fields any
+	var err error
+	if event.fields != nil {
+		fields, err = r.fields(event.fields)
+	} else if def, ok := p.types[event.name]; ok {
+		fields, err = r.defined(def)
+	} else {
+		err = fmt.Errorf("undefined event %s", event.name)
+	}
+	if err != nil {
+		metrics.IDLDecodeFailuresTotal.WithLabelValues(p.id).Inc()
+		return "", nil, false
+	}
+	return event.name, fields, true
+}
+
+// idlProgram is a parsed IDL, its instructions keyed by discriminator.
+type idlProgram struct {
+	id           string
+	name         string
+	instructions map[string]*idlInstruction
+	// lengths are the distinct discriminator lengths, 8 unless the IDL sets
+	// custom discriminators
+	lengths []int
+	types   map[string]*idlTypeDef
+	// events are keyed by their 8 byte discriminator
+	events map[string]*idlEvent
+}
+
+type idlEvent struct {
+	name   string
+	fields idlFields
+}
+
+type idlInstruction struct {
+	name     string
+	accounts []string
+	args     []idlField
+}
+
+func (p *idlProgram) decode(keys [][]byte, accounts, data []byte) (AnchorInstruction, bool, error) {
+	var ix *idlInstruction
+	var length int
+	for _, length = range p.lengths {
+		if len(data) >= length {
+			if ix = p.instructions[string(data[:length])]; ix != nil {
+				break
+			}
+		}
+	}
+	if ix == nil {
+		return AnchorInstruction{}, false, nil
+	}
+
+	r := &borshReader{program: p, data: data[length:]}
+	args := make(map[string]any, len(ix.args))
+	for _, arg := range ix.args {
+		v, err := r.value(&arg.Type)
+		if err != nil {
+			return AnchorInstruction{}, false, fmt.Errorf("%s.%s: %w", ix.name, arg.Name, err)
+		}
+		args[arg.Name] = v
+	}
+	decoded := AnchorInstruction{
+		Program:   p.name,
+		ProgramID: p.id,
+		Name:      ix.name,
+		Args:      args,
+	}
+	for i, name := range ix.accounts {
+		if i >= len(accounts) || int(accounts[i]) >= len(keys) {
+			break
+		}
+		if decoded.Accounts == nil {
+			decoded.Accounts = make(map[string]string, len(ix.accounts))
+		}
+		decoded.Accounts[name] = base58.Encode(keys[accounts[i]])
+	}
+	return decoded, true, nil
+}
+
+// idlFile is the part of an IDL used for decoding. Anchor 0.30 IDLs carry
+// their address and discriminators and keep all types under types, earlier
+// ones name the program at the top and define account types under accounts.
+type idlFile struct {
+	Address  string `json:"address"`
+	Name     string `json:"name"`
+	Metadata struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"metadata"`
+	Instructions []struct {
+		Name          string           `json:"name"`
+		Discriminator []int            `json:"discriminator"`
+		Accounts      []idlAccountItem `json:"accounts"`
+		Args          []idlField       `json:"args"`
+	} `json:"instructions"`
+	Accounts []idlTypeDef `json:"accounts"`
+	Events   []struct {
+		Name          string `json:"name"`
+		Discriminator []int  `json:"discriminator"`
+		// Fields are only set by IDLs before 0.30, later ones define the
+		// event under types
+		Fields idlFields `json:"fields"`
+	} `json:"events"`
+	Types []idlTypeDef `json:"types"`
+}
+
+type idlAccountItem struct {
+	Name     string           `json:"name"`
+	Accounts []idlAccountItem `json:"accounts"`
+}
+
+type idlField struct {
+	Name string  `json:"name"`
+	Type idlType `json:"type"`
+}
+
+type idlTypeDef struct {
+	Name string `json:"name"`
+	Type struct {
+		Kind     string    `json:"kind"`
+		Fields   idlFields `json:"fields"`
+		Variants []struct {
+			Name   string    `json:"name"`
+			Fields idlFields `json:"fields"`
+		} `json:"variants"`
+		Alias *idlType `json:"alias"`
+	} `json:"type"`
+}
+
+// parseIDL parses an IDL and returns the program address it names, if any.
+func parseIDL(data []byte) (*idlProgram, string, error) {
+	var file idlFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", err
+	}
+	program := &idlProgram{
+		name:         cmp.Or(file.Metadata.Name, file.Name),
+		instructions: make(map[string]*idlInstruction, len(file.Instructions)),
+		types:        make(map[string]*idlTypeDef),
+		events:       make(map[string]*idlEvent, len(file.Events)),
+	}
+	for _, defs := range [][]idlTypeDef{file.Accounts, file.Types} {
+		for i := range defs {
+			// accounts of 0.30 IDLs only carry their discriminator
+			if defs[i].Type.Kind != "" {
+				program.types[defs[i].Name] = &defs[i]
+			}
+		}
+	}
+	for _, ix := range file.Instructions {
+		discriminator := idlDiscriminator(ix.Discriminator, "global:"+SnakeCase(ix.Name))
+		if _, ok := program.instructions[string(discriminator)]; ok {
+			return nil, "", fmt.Errorf("instruction %s: duplicate discriminator", ix.Name)
+		}
+		program.instructions[string(discriminator)] = &idlInstruction{
+			name:     ix.Name,
+			accounts: flattenAccounts("", ix.Accounts),
+			args:     ix.Args,
+		}
+		if !slices.Contains(program.lengths, len(discriminator)) {
+			program.lengths = append(program.lengths, len(discriminator))
+		}
+	}
+	for _, event := range file.Events {
+		discriminator := idlDiscriminator(event.Discriminator, "event:"+event.Name)
+		program.events[string(discriminator)] = &idlEvent{name: event.Name, fields: event.Fields}
+	}
+	return program, cmp.Or(file.Address, file.Metadata.Address), nil
+}
+
+// idlDiscriminator returns the discriminator set by the IDL, or the first 8
+// bytes of the sha256 of preimage for IDLs before 0.30.
+func idlDiscriminator(discriminator []int, preimage string) []byte {
+	if len(discriminator) == 0 {
+		sum := sha256.Sum256([]byte(preimage))
+		return sum[:8]
+	}
+	out := make([]byte, len(discriminator))
+	for i, b := range discriminator {
+		out[i] = byte(b)
+	}
+	return out
+}
+
+func flattenAccounts(prefix string, items []idlAccountItem) []string {
+	var names []string
+	for _, item := range items {
+		if item.Accounts != nil {
+			names = append(names, flattenAccounts(prefix+item.Name+".", item.Accounts)...)
+			continue
+		}
+		names = append(names, prefix+item.Name)
+	}
+	return names
+}
+
+// SnakeCase turns the camelCase instruction names of IDLs before Anchor 0.30
+// into the Rust function names their discriminators are derived from.
+func SnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// idlFields are the named fields of a struct or enum variant, or the
+// unnamed ones of a tuple, which have an empty Name.
+type idlFields []idlField
+
+func (f *idlFields) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	fields := make(idlFields, len(items))
+	for i, item := range items {
+		var named map[string]json.RawMessage
+		if json.Unmarshal(item, &named) == nil && named["name"] != nil && named["type"] != nil {
+			if err := json.Unmarshal(item, &fields[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := json.Unmarshal(item, &fields[i].Type); err != nil {
+			return err
+		}
+	}
+	*f = fields
+	return nil
+}
+
+func (f idlFields) tuple() bool {
+	return len(f) > 0 && f[0].Name == ""
+}
+
+// idlType is a type of an IDL: a primitive such as u64 or pubkey, one of
+// option, coption, vec and array of elem, or defined, naming a type of the
+// IDL. Generics and types this decoder does not know are unsupported and
+// fail to decode, not to load.
+type idlType struct {
+	kind   string
+	name   string
+	elem   *idlType
+	length int
+}
+
+func (t *idlType) UnmarshalJSON(data []byte) error {
+	var primitive string
+	if json.Unmarshal(data, &primitive) == nil {
+		if primitive == "publicKey" {
+			primitive = "pubkey"
+		}
+		t.kind = primitive
+		return nil
+	}
+	var object struct {
+		Option  *idlType          `json:"option"`
+		COption *idlType          `json:"coption"`
+		Vec     *idlType          `json:"vec"`
+		Array   []json.RawMessage `json:"array"`
+		Defined json.RawMessage   `json:"defined"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	switch {
+	case object.Option != nil:
+		t.kind, t.elem = "option", object.Option
+	case object.COption != nil:
+		t.kind, t.elem = "coption", object.COption
+	case object.Vec != nil:
+		t.kind, t.elem = "vec", object.Vec
+	case len(object.Array) == 2:
+		t.kind, t.elem = "array", new(idlType)
+		if err := json.Unmarshal(object.Array[0], t.elem); err != nil {
+			return err
+		}
+		// a generic length
+		if json.Unmarshal(object.Array[1], &t.length) != nil {
+			t.kind, t.name = "unsupported", string(data)
+		}
+	case object.Defined != nil:
+		t.kind = "defined"
+		if json.Unmarshal(object.Defined, &t.name) != nil {
+			var defined struct {
+				Name     string            `json:"name"`
+				Generics []json.RawMessage `json:"generics"`
+			}
+			if err := json.Unmarshal(object.Defined, &defined); err != nil {
+				return err
+			}
+			t.name = defined.Name
+			if len(defined.Generics) > 0 {
+				t.kind, t.name = "unsupported", string(data)
+			}
+		}
+	default:
+		t.kind, t.name = "unsupported", string(data)
+	}
+	return nil
+}
+
+var errIDLShortData = errors.New("data too short")
+
+// borshReader decodes Borsh encoded values of the types of program.
+type borshReader struct {
+	program *idlProgram
+	data    []byte
+	depth   int
+}
+
+// maxIDLDepth bounds the nesting of defined types, recursive types would
+// otherwise decode for as long as the data lasts.
+const maxIDLDepth = 32
+
+func (r *borshReader) read(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data) {
+		return nil, errIDLShortData
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// value decodes a value of t. Integers up to 64 bits are numbers, larger ones
+// decimal strings, bytes base64 through encoding/json and keys base58.
+func (r *borshReader) value(t *idlType) (any, error) {
+	switch t.kind {
+	case "bool":
+		b, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "u8", "u16", "u32", "u64":
+		b, err := r.read(integerSize(t.kind))
+		if err != nil {
+			return nil, err
+		}
+		return littleEndian(b), nil
+	case "i8", "i16", "i32", "i64":
+		size := integerSize(t.kind)
+		b, err := r.read(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extended from the top bit
+		shift := 64 - 8*size
+		return int64(littleEndian(b)<<shift) >> shift, nil
+	case "u128", "i128", "u256", "i256":
+		b, err := r.read(integerSize(t.kind))
+		if err != nil {
+			return nil, err
+		}
+		return bigInteger(b, t.kind[0] == 'i').String(), nil
+	case "f32":
+		b, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return jsonFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))), nil
+	case "f64":
+		b, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return jsonFloat(math.Float64frombits(binary.LittleEndian.Uint64(b))), nil
+	case "string", "bytes":
+		n, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.read(int(binary.LittleEndian.Uint32(n)))
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == "string" {
+			return string(b), nil
+		}
+		return b, nil
+	case "pubkey":
+		b, err := r.read(32)
+		if err != nil {
+			return nil, err
+		}
+		return base58.Encode(b), nil
+	case "option", "coption":
+		tag, err := r.read(map[string]int{"option": 1, "coption": 4}[t.kind])
+		if err != nil {
+			return nil, err
+		}
+		switch littleEndian(tag) {
+		case 0:
+			return nil, nil
+		case 1:
+			return r.value(t.elem)
+		}
+		return nil, fmt.Errorf("invalid %s tag %d", t.kind, littleEndian(tag))
+	case "vec":
+		n, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		length := binary.LittleEndian.Uint32(n)
+		// every element takes a byte at least, this bounds the allocation
+		if uint64(length) > uint64(len(r.data)) {
+			return nil, errIDLShortData
+		}
+		return r.list(t.elem, int(length))
+	case "array":
+		return r.list(t.elem, t.length)
+	case "defined":
+		def, ok := r.program.types[t.name]
+		if !ok {
+			return nil, fmt.Errorf("undefined type %s", t.name)
+		}
+		if r.depth++; r.depth > maxIDLDepth {
+			return nil, fmt.Errorf("type %s nested too deep", t.name)
+		}
+		defer func() { r.depth-- }()
+		return r.defined(def)
+	}
+	return nil, fmt.Errorf("unsupported type %s", cmp.Or(t.name, t.kind))
+}
+
+func (r *borshReader) list(elem *idlType, length int) ([]any, error) {
+	out := make([]any, length)
+	for i := range out {
+		v, err := r.value(elem)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// defined decodes a struct as an object, or a list for tuple structs, and an
+// enum as the name of its variant, or an object with the variant name as the
+// only key for variants with fields.
+func (r *borshReader) defined(def *idlTypeDef) (any, error) {
+	switch def.Type.Kind {
+	case "struct":
+		return r.fields(def.Type.Fields)
+	case "enum":
+		b, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		if int(b[0]) >= len(def.Type.Variants) {
+			return nil, fmt.Errorf("invalid %s variant %d", def.Name, b[0])
+		}
+		variant := def.Type.Variants[b[0]]
+		if len(variant.Fields) == 0 {
+			return variant.Name, nil
+		}
+		fields, err := r.fields(variant.Fields)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{variant.Name: fields}, nil
+	case "type":
+		if def.Type.Alias != nil {
+			return r.value(def.Type.Alias)
+		}
+	}
+	return nil, fmt.Errorf("unsupported type %s of kind %s", def.Name, def.Type.Kind)
+}
+
+func (r *borshReader) fields(fields idlFields) (any, error) {
+	if fields.tuple() {
+		out := make([]any, len(fields))
+		for i := range fields {
+			v, err := r.value(&fields[i].Type)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+	out := make(map[string]any, len(fields))
+	for i := range fields {
+		v, err := r.value(&fields[i].Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fields[i].Name, err)
+		}
+		out[fields[i].Name] = v
+	}
+	return out, nil
+}
+
+func integerSize(kind string) int {
+	switch kind[1:] {
+	case "8":
+		return 1
+	case "16":
+		return 2
+	case "32":
+		return 4
+	case "64":
+		return 8
+	case "128":
+		return 16
+	}
+	return 32
+}
+
+func littleEndian(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+func bigInteger(b []byte, signed bool) *big.Int {
+	bigEndian := make([]byte, len(b))
+	for i := range b {
+		bigEndian[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(bigEndian)
+	if signed && len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	return v
+}
+
+// jsonFloat keeps NaN and infinities, which encoding/json rejects, as strings.
+func jsonFloat(f float64) any {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return f
+}
@@ -0,0 +1,235 @@
+package decode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// marketIDL is an Anchor 0.30 IDL of the program testkey.Key(40).
+var marketIDL = `{
+  "address": "` + testkey.String(40) + `",
+  "metadata": {"name": "market", "version": "0.1.0", "spec": "0.1.0"},
+  "instructions": [{
+    "name": "place_order",
+    "discriminator": [1, 2, 3, 4, 5, 6, 7, 8],
+    "accounts": [
+      {"name": "owner", "signer": true},
+      {"name": "market", "accounts": [{"name": "state", "writable": true}, {"name": "vault"}]}
+    ],
+    "args": [
+      {"name": "side", "type": {"defined": {"name": "Side"}}},
+      {"name": "price", "type": "u64"},
+      {"name": "size", "type": "i32"},
+      {"name": "client_id", "type": {"option": "u128"}},
+      {"name": "memo", "type": "string"},
+      {"name": "params", "type": {"defined": {"name": "Params"}}}
+    ]
+  }],
+  "accounts": [{"name": "Market", "discriminator": [9, 9, 9, 9, 9, 9, 9, 9]}],
+  "events": [{"name": "OrderPlaced", "discriminator": [8, 7, 6, 5, 4, 3, 2, 1]}],
+  "types": [
+    {"name": "OrderPlaced", "type": {"kind": "struct", "fields": [{"name": "price", "type": "u64"}]}},
+    {"name": "Side", "type": {"kind": "enum", "variants": [{"name": "Bid"}, {"name": "Ask"}]}},
+    {"name": "Params", "type": {"kind": "struct", "fields": [
+      {"name": "referrer", "type": "pubkey"},
+      {"name": "fees", "type": {"vec": "u16"}},
+      {"name": "expiry", "type": {"defined": {"name": "Expiry"}}}
+    ]}},
+    {"name": "Expiry", "type": {"kind": "enum", "variants": [
+      {"name": "Never"},
+      {"name": "At", "fields": ["i64", {"array": ["u8", 2]}]}
+    ]}}
+  ]
+}`
+
+// legacyIDL is an IDL from before Anchor 0.30, without an address.
+const legacyIDL = `{
+  "version": "0.1.0",
+  "name": "legacy",
+  "instructions": [{
+    "name": "initializeMarket",
+    "accounts": [{"name": "payer", "isMut": true, "isSigner": true}],
+    "args": [{"name": "authority", "type": "publicKey"}, {"name": "config", "type": {"defined": "Config"}}]
+  }],
+  "accounts": [{"name": "Config", "type": {"kind": "struct", "fields": [{"name": "enabled", "type": "bool"}]}}],
+  "events": [{"name": "Settled", "fields": [{"name": "amount", "type": "u32", "index": false}]}]
+}`
+
+func placeOrderData() []byte {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 1}
+	data = binary.LittleEndian.AppendUint64(data, 1500)
+	data = binary.LittleEndian.AppendUint32(data, uint32(math.MaxUint32-2))
+	// Some(2^64 + 1)
+	data = append(data, 1)
+	data = binary.LittleEndian.AppendUint64(data, 1)
+	data = binary.LittleEndian.AppendUint64(data, 1)
+	data = binary.LittleEndian.AppendUint32(data, 2)
+	data = append(data, "hi"...)
+	data = append(data, testkey.Key(9)...)
+	data = binary.LittleEndian.AppendUint32(data, 2)
+	data = binary.LittleEndian.AppendUint16(data, 5)
+	data = binary.LittleEndian.AppendUint16(data, 10)
+	data = append(data, 1)
+	data = binary.LittleEndian.AppendUint64(data, math.MaxUint64)
+	return append(data, 7, 8)
+}
+
+func loadTestIDLs(t *testing.T) *IDLDecoder {
+	t.Helper()
+	dir := t.TempDir()
+	for name, idl := range map[string]string{"market.json": marketIDL, testkey.String(41) + ".json": legacyIDL, "README.md": "not an idl"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(idl), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := DefaultIDLConfig()
+	config.Dir = dir
+	d, err := LoadIDLs(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != 2 {
+		t.Fatalf("loaded %d idls, want 2", d.Len())
+	}
+	return d
+}
+
+func TestIDLDecodeInstructions(t *testing.T) {
+	d := loadTestIDLs(t)
+	legacy := sha256.Sum256([]byte("global:initialize_market"))
+	info := programTransaction([]string{testkey.String(40), testkey.String(41)},
+		[]*proto.CompiledInstruction{
+			{ProgramIdIndex: 3, Accounts: []byte{0, 1, 2}, Data: placeOrderData()},
+			// an unknown discriminator, such as an event CPI
+			{ProgramIdIndex: 3, Accounts: []byte{0}, Data: []byte{0xe4, 0x45, 0xa5, 0x2e, 0x51, 0xcb, 0x9a, 0x1d}},
+			// truncated arguments
+			{ProgramIdIndex: 3, Accounts: []byte{0}, Data: placeOrderData()[:20]},
+		},
+		[]*proto.InnerInstructions{{Index: 0, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 4, Accounts: []byte{2}, Data: append(append(legacy[:8:8], testkey.Key(7)...), 1)},
+		}}},
+	)
+
+	got, err := json.Marshal(d.DecodeInstructions(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"program":"market","program_id":"` + testkey.String(40) + `","name":"place_order","instruction":0,` +
+		`"accounts":{"market.state":"` + testkey.String(2) + `","market.vault":"` + testkey.String(3) + `","owner":"` + testkey.String(1) + `"},` +
+		`"args":{"client_id":"18446744073709551617","memo":"hi","params":{"expiry":{"At":[-1,[7,8]]},"fees":[5,10],"referrer":"` + testkey.String(9) + `"},` +
+		`"price":1500,"side":"Ask","size":-3}},` +
+		`{"program":"legacy","program_id":"` + testkey.String(41) + `","name":"initializeMarket","instruction":0,"inner_instruction":0,` +
+		`"accounts":{"payer":"` + testkey.String(3) + `"},"args":{"authority":"` + testkey.String(7) + `","config":{"enabled":true}}}]`
+	if string(got) != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+
+	DefaultIDLDecoder = d
+	t.Cleanup(func() { DefaultIDLDecoder = nil })
+	out, err := FormatJSON(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		AnchorInstructions []AnchorInstruction `json:"anchor_instructions"`
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.AnchorInstructions) != 2 {
+		t.Fatalf("anchor_instructions in %s", out)
+	}
+}
+
+func TestIDLRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/idl/"+testkey.String(41) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(legacyIDL))
+	}))
+	defer server.Close()
+
+	config := DefaultIDLConfig()
+	config.Registry, config.Programs = server.URL+"/idl/{program}", []string{testkey.String(41)}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := LoadIDLs(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program := d.programs[string(testkey.Key(41))]; program == nil || program.name != "legacy" {
+		t.Fatalf("programs %v", d.programs)
+	}
+
+	config.Programs = append(config.Programs, testkey.String(42))
+	if _, err := LoadIDLs(context.Background(), config); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("got %v, want the missing IDL", err)
+	}
+}
+
+func TestIDLConfigValidate(t *testing.T) {
+	for _, config := range []IDLConfig{
+		{Registry: "https://idl.example", Timeout: 1},
+		{Programs: []string{testkey.String(1)}, Timeout: 1},
+		{Registry: "https://idl.example/{program}", Programs: []string{"nope"}, Timeout: 1},
+		{Dir: "idl"},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("validated %+v", config)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"initialize":       "initialize",
+		"initializeMarket": "initialize_market",
+		"withdrawV2":       "withdraw_v2",
+		"setURL":           "set_url",
+		"parseHTTPRequest": "parse_http_request",
+		"place_order":      "place_order",
+	} {
+		if got := SnakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestBorshIntegers(t *testing.T) {
+	r := &borshReader{data: []byte{0xff, 0xfe, 0xff, 0x80}}
+	for _, kind := range []string{"i8", "i16", "u8"} {
+		v, err := r.value(&idlType{kind: kind})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]any{"i8": int64(-1), "i16": int64(-2), "u8": uint64(0x80)}[kind]; !reflect.DeepEqual(v, want) {
+			t.Errorf("%s = %v, want %v", kind, v, want)
+		}
+	}
+	if _, err := r.value(&idlType{kind: "u8"}); err != errIDLShortData {
+		t.Fatalf("got %v, want short data", err)
+	}
+	i128 := append(make([]byte, 0, 16), 0xfe)
+	for len(i128) < 16 {
+		i128 = append(i128, 0xff)
+	}
+	if got := bigInteger(i128, true).String(); got != "-2" {
+		t.Fatalf("i128 = %s", got)
+	}
+}
@@ -0,0 +1,172 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// anchorEventTag starts the data of the self CPIs Anchor programs emit events
+// with, emit_cpi!, followed by the event discriminator.
+var anchorEventTag = []byte{0xe4, 0x45, 0xa5, 0x2e, 0x51, 0xcb, 0x9a, 0x1d}
+
+// ProgramLogs is what the log messages of a transaction tell: the programs
+// invoked, in the order of their invocation, and the events they emitted.
+// Truncated is set when the runtime cut the logs short, the invocations
+// after that are missing.
+type ProgramLogs struct {
+	Invocations []*ProgramInvocation `json:"invocations"`
+	Events      []ProgramEvent       `json:"events,omitempty"`
+	Truncated   bool                 `json:"truncated,omitempty"`
+}
+
+// ProgramInvocation is a program invoked by the outer instruction
+// Instruction, at Depth 1 for the outer instruction itself. Logs are the
+// messages the program logged, Error the reason it failed.
+type ProgramInvocation struct {
+	Program      string   `json:"program"`
+	Depth        int      `json:"depth"`
+	Instruction  int      `json:"instruction"`
+	Logs         []string `json:"logs,omitempty"`
+	ComputeUnits *uint64  `json:"compute_units,omitempty"`
+	ReturnData   []byte   `json:"return_data,omitempty"`
+	Success      bool     `json:"success"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// ProgramEvent is data a program emitted, logged as Program data, or passed
+// to itself in an Anchor event CPI. Name and Fields are decoded with the IDL
+// of the program when it has one.
+type ProgramEvent struct {
+	Program     string `json:"program"`
+	Depth       int    `json:"depth"`
+	Instruction int    `json:"instruction"`
+	// Source is log or cpi.
+	Source string `json:"source"`
+	Data   []byte `json:"data"`
+	Name   string `json:"name,omitempty"`
+	Fields any    `json:"fields,omitempty"`
+}
+
+// ParseProgramLogs parses the log messages and the event CPIs of a
+// transaction. Events are ordered by instruction, logged ones first. It
+// reports false when the transaction has neither.
+func ParseProgramLogs(info *proto.SubscribeUpdateTransactionInfo) (ProgramLogs, bool) {
+	var logs ProgramLogs
+	var stack []*ProgramInvocation
+	instruction := -1
+	top := func() *ProgramInvocation {
+		if len(stack) == 0 {
+			return nil
+		}
+		return stack[len(stack)-1]
+	}
+
+	for _, line := range info.GetMeta().GetLogMessages() {
+		if line == "Log truncated" {
+			logs.Truncated = true
+			break
+		}
+		current := top()
+		if message, ok := strings.CutPrefix(line, "Program log: "); ok && current != nil {
+			current.Logs = append(current.Logs, message)
+			continue
+		}
+		if chunks, ok := strings.CutPrefix(line, "Program data: "); ok && current != nil {
+			var data []byte
+			for _, chunk := range strings.Fields(chunks) {
+				decoded, err := base64.StdEncoding.DecodeString(chunk)
+				if err != nil {
+					break
+				}
+				data = append(data, decoded...)
+			}
+			logs.Events = append(logs.Events, newProgramEvent(current.Program, current.Depth, current.Instruction, "log", data))
+			continue
+		}
+		if payload, ok := strings.CutPrefix(line, "Program return: "); ok && current != nil {
+			if _, data, ok := strings.Cut(payload, " "); ok {
+				current.ReturnData, _ = base64.StdEncoding.DecodeString(data)
+			}
+			continue
+		}
+
+		program, rest, ok := strings.Cut(strings.TrimPrefix(line, "Program "), " ")
+		if !ok || !strings.HasPrefix(line, "Program ") {
+			if current != nil {
+				current.Logs = append(current.Logs, line)
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(rest, "invoke ["):
+			depth, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rest, "invoke ["), "]"))
+			if err != nil {
+				continue
+			}
+			if depth == 1 {
+				instruction++
+			}
+			invocation := &ProgramInvocation{Program: program, Depth: depth, Instruction: max(instruction, 0)}
+			logs.Invocations = append(logs.Invocations, invocation)
+			stack = append(stack, invocation)
+		case strings.HasPrefix(rest, "consumed "):
+			if current != nil && current.Program == program {
+				units, _, _ := strings.Cut(strings.TrimPrefix(rest, "consumed "), " ")
+				if n, err := strconv.ParseUint(units, 10, 64); err == nil {
+					current.ComputeUnits = &n
+				}
+			}
+		case rest == "success":
+			if current != nil && current.Program == program {
+				current.Success = true
+				stack = stack[:len(stack)-1]
+			}
+		case strings.HasPrefix(rest, "failed: "):
+			reason := strings.TrimPrefix(rest, "failed: ")
+			if current != nil && current.Program == program {
+				current.Error = reason
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			// a program failing before it was invoked, such as one that
+			// does not exist
+			logs.Invocations = append(logs.Invocations, &ProgramInvocation{
+				Program: program, Depth: len(stack) + 1, Instruction: max(instruction, 0), Error: reason,
+			})
+		default:
+			if current != nil {
+				current.Logs = append(current.Logs, line)
+			}
+		}
+	}
+
+	keys := TransactionAccounts(info)
+	for _, list := range info.GetMeta().GetInnerInstructions() {
+		for _, cpi := range list.GetInstructions() {
+			if !bytes.HasPrefix(cpi.GetData(), anchorEventTag) || int(cpi.GetProgramIdIndex()) >= len(keys) {
+				continue
+			}
+			logs.Events = append(logs.Events, newProgramEvent(base58.Encode(keys[cpi.GetProgramIdIndex()]),
+				int(cpi.GetStackHeight()), int(list.GetIndex()), "cpi", cpi.GetData()[len(anchorEventTag):]))
+		}
+	}
+	slices.SortStableFunc(logs.Events, func(a, b ProgramEvent) int {
+		return a.Instruction - b.Instruction
+	})
+	return logs, len(logs.Invocations) > 0 || len(logs.Events) > 0
+}
+
+func newProgramEvent(program string, depth, instruction int, source string, data []byte) ProgramEvent {
+	event := ProgramEvent{Program: program, Depth: depth, Instruction: instruction, Source: source, Data: data}
+	if key, err := base58.Decode(program); err == nil {
+		event.Name, event.Fields, _ = DefaultIDLDecoder.decodeEvent(key, data)
+	}
+	return event
+}
@@ -0,0 +1,108 @@
+package decode
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+func orderPlacedData(price uint64) []byte {
+	return binary.LittleEndian.AppendUint64([]byte{8, 7, 6, 5, 4, 3, 2, 1}, price)
+}
+
+// loggedTransaction calls the market program testkey.Key(40) after the compute
+// budget program, then testkey.Key(41), which fails.
+func loggedTransaction() *proto.SubscribeUpdateTransactionInfo {
+	market, other := testkey.String(40), testkey.String(41)
+	settled := sha256.Sum256([]byte("event:Settled"))
+	info := programTransaction([]string{market, testkey.String(41), TokenProgramID}, nil,
+		[]*proto.InnerInstructions{{Index: 1, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 5, Accounts: []byte{0, 1, 2}, Data: tokenData(3, 1)},
+			{ProgramIdIndex: 3, Data: append(append([]byte{}, anchorEventTag...), orderPlacedData(7)...), StackHeight: ptr(uint32(2))},
+		}}, {Index: 2, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 4, Data: append(append(append([]byte{}, anchorEventTag...), settled[:8]...), 5, 0, 0, 0)},
+		}}},
+	)
+	info.Meta.LogMessages = []string{
+		"Program " + ComputeBudgetProgramID + " invoke [1]",
+		"Program " + ComputeBudgetProgramID + " success",
+		"Program " + market + " invoke [1]",
+		"Program log: Instruction: PlaceOrder",
+		"Program data: " + base64.StdEncoding.EncodeToString(orderPlacedData(1500)),
+		"Program " + TokenProgramID + " invoke [2]",
+		"Program log: Instruction: Transfer",
+		"Program " + TokenProgramID + " consumed 4645 of 180000 compute units",
+		"Program " + TokenProgramID + " success",
+		"Program " + market + " invoke [2]",
+		"Program " + market + " consumed 2000 of 170000 compute units",
+		"Program " + market + " success",
+		"Program return: " + market + " AQID",
+		"Program " + market + " consumed 30000 of 199850 compute units",
+		"Program " + market + " success",
+		"Program " + other + " invoke [1]",
+		"Program log: panicked",
+		"Program " + other + " failed: custom program error: 0x1",
+	}
+	return info
+}
+
+func TestParseProgramLogs(t *testing.T) {
+	DefaultIDLDecoder = loadTestIDLs(t)
+	t.Cleanup(func() { DefaultIDLDecoder = nil })
+	market, other := testkey.String(40), testkey.String(41)
+
+	logs, ok := ParseProgramLogs(loggedTransaction())
+	if !ok {
+		t.Fatal("no logs")
+	}
+	want := []*ProgramInvocation{
+		{Program: ComputeBudgetProgramID, Depth: 1, Instruction: 0, Success: true},
+		{Program: market, Depth: 1, Instruction: 1, Logs: []string{"Instruction: PlaceOrder"}, ComputeUnits: ptr(uint64(30000)), ReturnData: []byte{1, 2, 3}, Success: true},
+		{Program: TokenProgramID, Depth: 2, Instruction: 1, Logs: []string{"Instruction: Transfer"}, ComputeUnits: ptr(uint64(4645)), Success: true},
+		{Program: market, Depth: 2, Instruction: 1, ComputeUnits: ptr(uint64(2000)), Success: true},
+		{Program: other, Depth: 1, Instruction: 2, Logs: []string{"panicked"}, Error: "custom program error: 0x1"},
+	}
+	if !reflect.DeepEqual(logs.Invocations, want) {
+		got, _ := json.Marshal(logs.Invocations)
+		t.Fatalf("invocations %s", got)
+	}
+
+	wantEvents := []ProgramEvent{
+		{Program: market, Depth: 1, Instruction: 1, Source: "log", Data: orderPlacedData(1500), Name: "OrderPlaced", Fields: map[string]any{"price": uint64(1500)}},
+		{Program: market, Depth: 2, Instruction: 1, Source: "cpi", Data: orderPlacedData(7), Name: "OrderPlaced", Fields: map[string]any{"price": uint64(7)}},
+		{Program: other, Depth: 0, Instruction: 2, Source: "cpi", Data: loggedTransaction().Meta.InnerInstructions[1].Instructions[0].Data[8:],
+			Name: "Settled", Fields: map[string]any{"amount": uint64(5)}},
+	}
+	if !reflect.DeepEqual(logs.Events, wantEvents) {
+		t.Fatalf("events %+v", logs.Events)
+	}
+	if logs.Truncated {
+		t.Fatal("truncated")
+	}
+}
+
+func TestParseProgramLogsTruncated(t *testing.T) {
+	info := loggedTransaction()
+	info.Meta.InnerInstructions = nil
+	info.Meta.LogMessages = append(info.Meta.LogMessages[:4:4], "Log truncated")
+	logs, _ := ParseProgramLogs(info)
+	if !logs.Truncated || len(logs.Invocations) != 2 || logs.Invocations[1].Success || len(logs.Events) != 0 {
+		t.Fatalf("logs %+v", logs)
+	}
+	// without an IDL the events keep their data only
+	info = loggedTransaction()
+	logs, _ = ParseProgramLogs(info)
+	if len(logs.Events) != 3 || logs.Events[0].Name != "" || logs.Events[0].Fields != nil {
+		t.Fatalf("events %+v", logs.Events)
+	}
+
+	if _, ok := ParseProgramLogs(programTransaction(nil, nil, nil)); ok {
+		t.Fatal("logs of a transaction without any")
+	}
+}
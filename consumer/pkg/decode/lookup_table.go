@@ -0,0 +1,339 @@
+package decode
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/duration"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// AddressLookupTableProgramID owns the address lookup tables.
+const AddressLookupTableProgramID = "AddressLookupTab1e1111111111111111111111111"
+
+// lookupTableMetaSize is the size of the table header, the addresses follow.
+const lookupTableMetaSize = 56
+
+// getMultipleAccountsLimit is the most accounts the RPC returns at once.
+const getMultipleAccountsLimit = 100
+
+// LookupTablesConfig resolves the addresses versioned transactions load from
+// address lookup tables when the meta does not list them, so the filters,
+// decoders and sinks see every account of the transaction.
+type LookupTablesConfig struct {
+	// RPCURL is the Solana JSON-RPC endpoint the tables are read from,
+	// resolution is disabled when empty.
+	RPCURL     string `json:"rpc_url" yaml:"rpc_url"`
+	Commitment string `json:"commitment" yaml:"commitment"`
+	// CacheSize bounds the cached tables and CacheTTL is how long a table is
+	// used before it is read again. A table is read again earlier when a
+	// transaction indexes past the addresses known of it.
+	CacheSize int               `json:"cache_size" yaml:"cache_size"`
+	CacheTTL  duration.Duration `json:"cache_ttl" yaml:"cache_ttl"`
+	Timeout   duration.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func DefaultLookupTablesConfig() LookupTablesConfig {
+	return LookupTablesConfig{
+		Commitment: CommitmentConfirmed,
+		CacheSize:  10000,
+		CacheTTL:   duration.Duration(10 * time.Minute),
+		Timeout:    duration.Duration(5 * time.Second),
+	}
+}
+
+func (c *LookupTablesConfig) Validate() error {
+	if c.RPCURL == "" {
+		return nil
+	}
+	switch c.Commitment {
+	case CommitmentProcessed, CommitmentConfirmed, CommitmentFinalized:
+	default:
+		return fmt.Errorf("decoding.lookup_tables.commitment: expected processed, confirmed or finalized, got %q", c.Commitment)
+	}
+	if c.CacheSize <= 0 {
+		return errors.New("decoding.lookup_tables.cache_size: must be positive")
+	}
+	if c.CacheTTL <= 0 {
+		return errors.New("decoding.lookup_tables.cache_ttl: must be positive")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("decoding.lookup_tables.timeout: must be positive")
+	}
+	return nil
+}
+
+// LookupTableResolver fills in the loaded addresses of transactions from
+// lookup tables read over RPC and kept in an LRU cache.
+type LookupTableResolver struct {
+	config LookupTablesConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	tables map[string]*list.Element
+	// lru holds the cached tables, most recently used first.
+	lru *list.List
+}
+
+type lookupTable struct {
+	key       string
+	addresses [][]byte
+	fetched   time.Time
+}
+
+// NewLookupTableResolver returns nil when resolution is disabled.
+func NewLookupTableResolver(config LookupTablesConfig) *LookupTableResolver {
+	if config.RPCURL == "" {
+		return nil
+	}
+	return &LookupTableResolver{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout)},
+		now:    time.Now,
+		tables: make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// Resolve sets the loaded addresses of the transactions of msg, a transaction
+// or a block update, that use lookup tables and have none in their meta.
+func (r *LookupTableResolver) Resolve(ctx context.Context, msg *Message) error {
+	if r == nil {
+		return nil
+	}
+	infos := msg.Update.GetBlock().GetTransactions()
+	if info := msg.Update.GetTransaction().GetTransaction(); info != nil {
+		infos = []*proto.SubscribeUpdateTransactionInfo{info}
+	}
+	for _, info := range infos {
+		if err := r.resolve(ctx, info); err != nil {
+			return fmt.Errorf("resolve lookup tables of %s: %w", base58.Encode(info.GetSignature()), err)
+		}
+	}
+	return nil
+}
+
+func (r *LookupTableResolver) resolve(ctx context.Context, info *proto.SubscribeUpdateTransactionInfo) error {
+	lookups := info.GetTransaction().GetMessage().GetAddressTableLookups()
+	meta := info.GetMeta()
+	if len(lookups) == 0 || len(meta.GetLoadedWritableAddresses())+len(meta.GetLoadedReadonlyAddresses()) > 0 {
+		return nil
+	}
+	tables, err := r.lookupTables(ctx, lookups)
+	if err != nil {
+		return err
+	}
+
+	// all writable addresses come first, in the order of the lookups
+	var writable, readonly [][]byte
+	for _, lookup := range lookups {
+		addresses := tables[string(lookup.GetAccountKey())]
+		for _, index := range lookup.GetWritableIndexes() {
+			writable = append(writable, addresses[index])
+		}
+		for _, index := range lookup.GetReadonlyIndexes() {
+			readonly = append(readonly, addresses[index])
+		}
+	}
+	if info.Meta == nil {
+		info.Meta = &proto.TransactionStatusMeta{}
+	}
+	info.Meta.LoadedWritableAddresses = writable
+	info.Meta.LoadedReadonlyAddresses = readonly
+	return nil
+}
+
+// lookupTables returns the addresses of the tables of lookups, reading those
+// missing from the cache, expired or too short for the indexes used.
+func (r *LookupTableResolver) lookupTables(ctx context.Context, lookups []*proto.MessageAddressTableLookup) (map[string][][]byte, error) {
+	// the highest index used of every table, a table may be looked up twice
+	highest := make(map[string]int, len(lookups))
+	var keys []string
+	for _, lookup := range lookups {
+		key := string(lookup.GetAccountKey())
+		index, ok := highest[key]
+		if !ok {
+			keys, index = append(keys, key), -1
+		}
+		highest[key] = max(index, maxIndex(lookup))
+	}
+
+	tables := make(map[string][][]byte, len(keys))
+	var missing []string
+	r.mu.Lock()
+	now := r.now()
+	for _, key := range keys {
+		if element, ok := r.tables[key]; ok {
+			table := element.Value.(*lookupTable)
+			if now.Sub(table.fetched) < time.Duration(r.config.CacheTTL) && highest[key] < len(table.addresses) {
+				r.lru.MoveToFront(element)
+				tables[key] = table.addresses
+				metrics.LookupTableCacheHitsTotal.Inc()
+				continue
+			}
+		}
+		missing = append(missing, key)
+	}
+	r.mu.Unlock()
+	if len(missing) == 0 {
+		return tables, nil
+	}
+
+	fetched, err := r.fetch(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, addresses := range fetched {
+		tables[key] = addresses
+		r.store(&lookupTable{key: key, addresses: addresses, fetched: now})
+	}
+	for _, key := range missing {
+		if highest[key] >= len(tables[key]) {
+			return nil, fmt.Errorf("lookup table %s has %d addresses, index %d is used",
+				base58.Encode([]byte(key)), len(tables[key]), highest[key])
+		}
+	}
+	return tables, nil
+}
+
+// store caches a table, evicting the least recently used one when full.
+// The caller holds mu.
+func (r *LookupTableResolver) store(table *lookupTable) {
+	if element, ok := r.tables[table.key]; ok {
+		element.Value = table
+		r.lru.MoveToFront(element)
+		return
+	}
+	r.tables[table.key] = r.lru.PushFront(table)
+	if r.lru.Len() > r.config.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.tables, oldest.Value.(*lookupTable).key)
+	}
+}
+
+// fetch reads tables with getMultipleAccounts, a closed table is an error.
+func (r *LookupTableResolver) fetch(ctx context.Context, keys []string) (map[string][][]byte, error) {
+	tables := make(map[string][][]byte, len(keys))
+	for start := 0; start < len(keys); start += getMultipleAccountsLimit {
+		chunk := keys[start:min(start+getMultipleAccountsLimit, len(keys))]
+		encoded := make([]string, len(chunk))
+		for i, key := range chunk {
+			encoded[i] = base58.Encode([]byte(key))
+		}
+		accounts, err := r.getMultipleAccounts(ctx, encoded)
+		if err != nil {
+			metrics.LookupTableRequestsTotal.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		metrics.LookupTableRequestsTotal.WithLabelValues("ok").Inc()
+		if len(accounts) != len(chunk) {
+			return nil, fmt.Errorf("getMultipleAccounts returned %d accounts for %d keys", len(accounts), len(chunk))
+		}
+		for i, account := range accounts {
+			addresses, err := parseLookupTable(account)
+			if err != nil {
+				return nil, fmt.Errorf("lookup table %s: %w", encoded[i], err)
+			}
+			tables[chunk[i]] = addresses
+		}
+	}
+	return tables, nil
+}
+
+// rpcAccount is an account of a getMultipleAccounts response, null for
+// accounts that do not exist.
+type rpcAccount struct {
+	Owner string    `json:"owner"`
+	Data  [2]string `json:"data"`
+}
+
+func (r *LookupTableResolver) getMultipleAccounts(ctx context.Context, keys []string) ([]*rpcAccount, error) {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "getMultipleAccounts",
+		"params":  []any{keys, map[string]string{"encoding": "base64", "commitment": r.config.Commitment}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.config.RPCURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("getMultipleAccounts: %s", resp.Status)
+	}
+	var response struct {
+		Result struct {
+			Value []*rpcAccount `json:"value"`
+		} `json:"result"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("getMultipleAccounts: %w", err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("getMultipleAccounts: %s (%d)", response.Error.Message, response.Error.Code)
+	}
+	return response.Result.Value, nil
+}
+
+// parseLookupTable returns the addresses stored in a lookup table account.
+func parseLookupTable(account *rpcAccount) ([][]byte, error) {
+	if account == nil {
+		return nil, errors.New("not found")
+	}
+	if account.Owner != AddressLookupTableProgramID {
+		return nil, fmt.Errorf("owned by %s", account.Owner)
+	}
+	data, err := base64.StdEncoding.DecodeString(account.Data[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < lookupTableMetaSize || (len(data)-lookupTableMetaSize)%32 != 0 {
+		return nil, fmt.Errorf("invalid size %d", len(data))
+	}
+	addresses := make([][]byte, 0, (len(data)-lookupTableMetaSize)/32)
+	for offset := lookupTableMetaSize; offset < len(data); offset += 32 {
+		addresses = append(addresses, data[offset:offset+32])
+	}
+	return addresses, nil
+}
+
+// maxIndex returns the highest index a lookup uses, -1 for none.
+func maxIndex(lookup *proto.MessageAddressTableLookup) int {
+	highest := -1
+	for _, indexes := range [][]byte{lookup.GetWritableIndexes(), lookup.GetReadonlyIndexes()} {
+		for _, index := range indexes {
+			highest = max(highest, int(index))
+		}
+	}
+	return highest
+}
@@ -0,0 +1,226 @@
+package decode
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// rpcServer answers getMultipleAccounts with the lookup tables of tables,
+// keyed by base58 address, and records the requested keys.
+type rpcServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	tables   map[string][][]byte
+	requests [][]string
+}
+
+func newRPCServer(t *testing.T) *rpcServer {
+	s := &rpcServer{tables: make(map[string][][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		var keys []string
+		json.Unmarshal(request.Params[0], &keys)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, keys)
+		accounts := make([]any, len(keys))
+		for i, key := range keys {
+			addresses, ok := s.tables[key]
+			if !ok {
+				continue
+			}
+			data := make([]byte, lookupTableMetaSize)
+			for _, address := range addresses {
+				data = append(data, address...)
+			}
+			accounts[i] = map[string]any{
+				"owner": AddressLookupTableProgramID,
+				"data":  []string{base64.StdEncoding.EncodeToString(data), "base64"},
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      1,
+			"result":  map[string]any{"context": map[string]any{"slot": 1}, "value": accounts},
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rpcServer) setTable(key byte, addresses ...byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys [][]byte
+	for _, address := range addresses {
+		keys = append(keys, testkey.Key(address))
+	}
+	s.tables[testkey.String(key)] = keys
+}
+
+func newTestLookupTableResolver(t *testing.T, url string) *LookupTableResolver {
+	t.Helper()
+	config := DefaultLookupTablesConfig()
+	config.RPCURL = url
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewLookupTableResolver(config)
+}
+
+// versionedTransaction is a transaction loading accounts with lookups, without
+// the loaded addresses in its meta.
+func versionedTransaction(lookups ...*proto.MessageAddressTableLookup) *Message {
+	msg := transactionMessage(10, testkey.Key(1))
+	msg.Update.GetTransaction().GetTransaction().GetTransaction().GetMessage().AddressTableLookups = lookups
+	return msg
+}
+
+func lookup(table byte, writable, readonly []byte) *proto.MessageAddressTableLookup {
+	return &proto.MessageAddressTableLookup{AccountKey: testkey.Key(table), WritableIndexes: writable, ReadonlyIndexes: readonly}
+}
+
+func loadedAddresses(msg *Message) (writable, readonly []string) {
+	meta := msg.Update.GetTransaction().GetTransaction().GetMeta()
+	return EncodeKeys(meta.GetLoadedWritableAddresses()), EncodeKeys(meta.GetLoadedReadonlyAddresses())
+}
+
+func TestLookupTableResolve(t *testing.T) {
+	server := newRPCServer(t)
+	server.setTable(100, 10, 11, 12)
+	server.setTable(101, 20, 21)
+	r := newTestLookupTableResolver(t, server.URL)
+	ctx := context.Background()
+
+	msg := versionedTransaction(lookup(100, []byte{2}, []byte{0}), lookup(101, []byte{1}, []byte{0}))
+	if err := r.Resolve(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	writable, readonly := loadedAddresses(msg)
+	if want := []string{testkey.String(12), testkey.String(21)}; !reflect.DeepEqual(writable, want) {
+		t.Fatalf("writable %v, want %v", writable, want)
+	}
+	if want := []string{testkey.String(10), testkey.String(20)}; !reflect.DeepEqual(readonly, want) {
+		t.Fatalf("readonly %v, want %v", readonly, want)
+	}
+	// the loaded accounts are seen by the filters
+	accounts := TransactionAccounts(msg.Update.GetTransaction().GetTransaction())
+	if !slices.ContainsFunc(accounts, func(key []byte) bool { return bytes.Equal(key, testkey.Key(21)) }) {
+		t.Fatalf("accounts %v", EncodeKeys(accounts))
+	}
+	if len(server.requests) != 1 || len(server.requests[0]) != 2 {
+		t.Fatalf("requests %v", server.requests)
+	}
+
+	// cached
+	if err := r.Resolve(ctx, versionedTransaction(lookup(101, nil, []byte{1}))); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.requests) != 1 {
+		t.Fatalf("requests %v, want the cached table", server.requests)
+	}
+
+	// the table was extended after it was cached
+	server.setTable(101, 20, 21, 22)
+	msg = versionedTransaction(lookup(101, []byte{2}, nil))
+	if err := r.Resolve(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if writable, _ := loadedAddresses(msg); len(writable) != 1 || writable[0] != testkey.String(22) {
+		t.Fatalf("writable %v", writable)
+	}
+
+	// expired
+	r.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := r.Resolve(ctx, versionedTransaction(lookup(100, []byte{0}, nil))); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.requests) != 3 || server.requests[2][0] != testkey.String(100) {
+		t.Fatalf("requests %v, want the expired table", server.requests)
+	}
+}
+
+func TestLookupTableResolveErrors(t *testing.T) {
+	server := newRPCServer(t)
+	server.setTable(100, 10)
+	r := newTestLookupTableResolver(t, server.URL)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		msg  *Message
+		want string
+	}{
+		{versionedTransaction(lookup(102, []byte{0}, nil)), "not found"},
+		{versionedTransaction(lookup(100, nil, []byte{0}), lookup(100, nil, []byte{3})), "index 3 is used"},
+	} {
+		if err := r.Resolve(ctx, tt.msg); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("got %v, want %s", err, tt.want)
+		}
+	}
+
+	server.Close()
+	if err := r.Resolve(ctx, versionedTransaction(lookup(103, []byte{0}, nil))); err == nil {
+		t.Fatal("resolved without an RPC server")
+	}
+}
+
+func TestLookupTableResolveSkips(t *testing.T) {
+	server := newRPCServer(t)
+	r := newTestLookupTableResolver(t, server.URL)
+	ctx := context.Background()
+
+	// the producer resolved them already
+	resolved := versionedTransaction(lookup(100, []byte{0}, nil))
+	resolved.Update.GetTransaction().GetTransaction().GetMeta().LoadedWritableAddresses = [][]byte{testkey.Key(10)}
+	for _, msg := range []*Message{transactionMessage(10, testkey.Key(1)), accountMessage(10, testkey.Key(1), testkey.Key(2)), resolved} {
+		if err := r.Resolve(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(server.requests) != 0 {
+		t.Fatalf("requests %v", server.requests)
+	}
+	if r := NewLookupTableResolver(DefaultLookupTablesConfig()); r != nil {
+		t.Fatal("resolution enabled without rpc_url")
+	}
+}
+
+func TestLookupTableCacheEviction(t *testing.T) {
+	server := newRPCServer(t)
+	for table := byte(100); table < 103; table++ {
+		server.setTable(table, table)
+	}
+	config := DefaultLookupTablesConfig()
+	config.RPCURL, config.CacheSize = server.URL, 2
+	r := NewLookupTableResolver(config)
+	ctx := context.Background()
+
+	for _, table := range []byte{100, 101, 100, 102, 100, 101} {
+		if err := r.Resolve(ctx, versionedTransaction(lookup(table, []byte{0}, nil))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 101 was the least recently used table when 102 was stored
+	if got := fmt.Sprint(server.requests); got != fmt.Sprint([][]string{{testkey.String(100)}, {testkey.String(101)}, {testkey.String(102)}, {testkey.String(101)}}) {
+		t.Fatalf("requests %s", got)
+	}
+}
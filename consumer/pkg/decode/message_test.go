@@ -0,0 +1,56 @@
+package decode
+
+import (
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// transactionMessage returns a transaction of slot calling program with the
+// given accounts, the program is the last account key.
+func transactionMessage(slot uint64, program []byte, accounts ...[]byte) *Message {
+	keys := append(append([][]byte{}, accounts...), program)
+	return &Message{
+		Slot: slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{
+			Transaction: &proto.SubscribeUpdateTransaction{
+				Slot: slot,
+				Transaction: &proto.SubscribeUpdateTransactionInfo{
+					Signature: testkey.Key(0xff),
+					Transaction: &proto.Transaction{Message: &proto.Message{
+						AccountKeys:  keys,
+						Instructions: []*proto.CompiledInstruction{{ProgramIdIndex: uint32(len(keys) - 1)}},
+					}},
+					Meta: &proto.TransactionStatusMeta{},
+				},
+			},
+		}},
+	}
+}
+
+func accountMessage(slot uint64, pubkey, owner []byte) *Message {
+	return &Message{
+		Slot: slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Account{
+			Account: &proto.SubscribeUpdateAccount{
+				Slot:    slot,
+				Account: &proto.SubscribeUpdateAccountInfo{Pubkey: pubkey, Owner: owner},
+			},
+		}},
+	}
+}
+
+// slotMessage returns a slot status update, parent is left unset when 0.
+func slotMessage(slot, parent uint64, status proto.CommitmentLevel) *Message {
+	update := &proto.SubscribeUpdateSlot{Slot: slot, Status: status}
+	if parent != 0 {
+		update.Parent = &parent
+	}
+	return &Message{
+		Slot:   slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Slot{Slot: update}},
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
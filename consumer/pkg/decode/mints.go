@@ -0,0 +1,276 @@
+package decode
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// Program IDs of Metaplex Token Metadata and Bubblegum, which mints
+// compressed NFTs.
+const (
+	TokenMetadataProgramID = "metaqbxxUerdq28cj1RbAWkYQm3ybzjb6a8bt518x1s"
+	BubblegumProgramID     = "BGUMAp9Gq7iTEuizy4pqaxsTyUCBK68MDfK752saRPUY"
+)
+
+// Types of MintEvent.
+const (
+	mintNew           = "new_mint"
+	mintMetadata      = "metadata_created"
+	mintCompressedNFT = "compressed_nft_minted"
+)
+
+// Instructions creating mints and metadata, by their first data byte, and
+// the size of the data of InitializeMint without the freeze authority.
+const (
+	tokenInitMint     = 0
+	tokenInitMint2    = 20
+	tokenMintDataSize = 1 + 1 + 32 + 1
+	metadataCreateV3  = 33
+	metadataCreate    = 42
+)
+
+// bubblegumMints are the mint instructions of Bubblegum by discriminator,
+// with the position of the collection mint among their accounts, -1 when
+// they have none.
+var bubblegumMints = map[string]int{
+	string(idlDiscriminator(nil, "global:mint_v1")):               -1,
+	string(idlDiscriminator(nil, "global:mint_to_collection_v1")): 8,
+}
+
+// tokenStandards names the token standards of Token Metadata by value.
+var tokenStandards = []string{
+	"non_fungible", "fungible_asset", "fungible", "non_fungible_edition",
+	"programmable_non_fungible", "programmable_non_fungible_edition",
+}
+
+// MintEvent is a new mint of a token program, the metadata Token Metadata
+// created for a mint, or a compressed NFT minted by Bubblegum into the leaf
+// of a tree for an owner. Instruction is the index of the outer
+// instruction, InnerInstruction the position within its inner instructions
+// for CPIs.
+type MintEvent struct {
+	Type             string  `json:"type"`
+	Program          string  `json:"program"`
+	Instruction      int     `json:"instruction"`
+	InnerInstruction *int    `json:"inner_instruction,omitempty"`
+	Mint             string  `json:"mint,omitempty"`
+	Decimals         *uint32 `json:"decimals,omitempty"`
+	MintAuthority    string  `json:"mint_authority,omitempty"`
+	FreezeAuthority  string  `json:"freeze_authority,omitempty"`
+	Metadata         string  `json:"metadata,omitempty"`
+	UpdateAuthority  string  `json:"update_authority,omitempty"`
+	Name             string  `json:"name,omitempty"`
+	Symbol           string  `json:"symbol,omitempty"`
+	URI              string  `json:"uri,omitempty"`
+	TokenStandard    string  `json:"token_standard,omitempty"`
+	Collection       string  `json:"collection,omitempty"`
+	Owner            string  `json:"owner,omitempty"`
+	Tree             string  `json:"tree,omitempty"`
+}
+
+// DecodeMintEvents decodes the mint events of a transaction in execution
+// order, outer instructions followed by their CPIs. Instructions whose data
+// fails to decode are left out.
+func DecodeMintEvents(info *proto.SubscribeUpdateTransactionInfo) []MintEvent {
+	keys := TransactionAccounts(info)
+	var out []MintEvent
+	eachInstruction(info, func(outer int, inner *int, programIndex uint32, accounts, data []byte) {
+		if int(programIndex) >= len(keys) || len(data) == 0 {
+			return
+		}
+		for _, index := range accounts {
+			if int(index) >= len(keys) {
+				return
+			}
+		}
+		key := func(position int) string {
+			if position < 0 || position >= len(accounts) {
+				return ""
+			}
+			return base58.Encode(keys[accounts[position]])
+		}
+		var event MintEvent
+		var ok bool
+		switch program := base58.Encode(keys[programIndex]); program {
+		case TokenProgramID, Token2022ProgramID:
+			event, ok = decodeInitializeMint(data, key)
+			event.Program = tokenPrograms[program]
+		case TokenMetadataProgramID:
+			event, ok = decodeCreateMetadata(data, key)
+			event.Program = "token-metadata"
+		case BubblegumProgramID:
+			event, ok = decodeBubblegumMint(data, key)
+			event.Program = "bubblegum"
+		}
+		if ok {
+			event.Instruction, event.InnerInstruction = outer, inner
+			out = append(out, event)
+		}
+	})
+	return out
+}
+
+// decodeInitializeMint decodes InitializeMint and InitializeMint2: the
+// decimals, the mint authority and an optional freeze authority.
+func decodeInitializeMint(data []byte, key func(int) string) (MintEvent, bool) {
+	if data[0] != tokenInitMint && data[0] != tokenInitMint2 || len(data) < tokenMintDataSize {
+		return MintEvent{}, false
+	}
+	decimals := uint32(data[1])
+	event := MintEvent{Type: mintNew, Mint: key(0), Decimals: &decimals, MintAuthority: base58.Encode(data[2:34])}
+	if data[34] == 1 && len(data) >= tokenMintDataSize+32 {
+		event.FreezeAuthority = base58.Encode(data[35:67])
+	}
+	return event, event.Mint != ""
+}
+
+// decodeCreateMetadata decodes CreateMetadataAccountV3 and Create, the
+// latter for its V1 arguments.
+func decodeCreateMetadata(data []byte, key func(int) string) (MintEvent, bool) {
+	event := MintEvent{Type: mintMetadata, Metadata: key(0)}
+	r := &borshReader{data: data[1:]}
+	switch data[0] {
+	case metadataCreateV3:
+		event.Mint, event.MintAuthority, event.UpdateAuthority = key(1), key(2), key(4)
+		if err := r.metadataFields(&event); err != nil {
+			return MintEvent{}, false
+		}
+		if err := r.skipCreators(); err != nil {
+			return MintEvent{}, false
+		}
+	case metadataCreate:
+		event.Mint, event.MintAuthority, event.UpdateAuthority = key(2), key(3), key(5)
+		if variant, err := r.read(1); err != nil || variant[0] != 0 {
+			return MintEvent{}, false
+		}
+		if err := r.metadataFields(&event); err != nil {
+			return MintEvent{}, false
+		}
+		if err := r.skipCreators(); err != nil {
+			return MintEvent{}, false
+		}
+		// primary_sale_happened and is_mutable, then the token standard
+		b, err := r.read(3)
+		if err != nil {
+			return MintEvent{}, false
+		}
+		event.TokenStandard = tokenStandardName(b[2])
+	default:
+		return MintEvent{}, false
+	}
+	if err := r.collection(&event); err != nil {
+		return MintEvent{}, false
+	}
+	return event, event.Mint != ""
+}
+
+// decodeBubblegumMint decodes mint_v1 and mint_to_collection_v1, whose
+// collection is the collection mint of their accounts.
+func decodeBubblegumMint(data []byte, key func(int) string) (MintEvent, bool) {
+	if len(data) < 8 {
+		return MintEvent{}, false
+	}
+	collection, ok := bubblegumMints[string(data[:8])]
+	if !ok {
+		return MintEvent{}, false
+	}
+	event := MintEvent{Type: mintCompressedNFT, Owner: key(1), Tree: key(3)}
+	r := &borshReader{data: data[8:]}
+	if err := r.metadataFields(&event); err != nil {
+		return MintEvent{}, false
+	}
+	// primary_sale_happened, is_mutable and the edition nonce
+	if _, err := r.read(2); err != nil {
+		return MintEvent{}, false
+	}
+	if _, err := r.option(1); err != nil {
+		return MintEvent{}, false
+	}
+	standard, err := r.option(1)
+	if err != nil {
+		return MintEvent{}, false
+	}
+	if standard != nil {
+		event.TokenStandard = tokenStandardName(standard[0])
+	}
+	if err := r.collection(&event); err != nil {
+		return MintEvent{}, false
+	}
+	if collection >= 0 {
+		event.Collection = key(collection)
+	}
+	return event, event.Tree != ""
+}
+
+func tokenStandardName(standard byte) string {
+	if int(standard) < len(tokenStandards) {
+		return tokenStandards[standard]
+	}
+	return ""
+}
+
+// metadataFields reads the name, symbol, URI and seller fee of the metadata
+// arguments of Token Metadata and Bubblegum.
+func (r *borshReader) metadataFields(event *MintEvent) error {
+	for _, field := range []*string{&event.Name, &event.Symbol, &event.URI} {
+		s, err := r.string()
+		if err != nil {
+			return err
+		}
+		*field = s
+	}
+	_, err := r.read(2)
+	return err
+}
+
+// string reads a string, without the NUL padding of older metadata.
+func (r *borshReader) string() (string, error) {
+	b, err := r.read(4)
+	if err != nil {
+		return "", err
+	}
+	s, err := r.read(int(binary.LittleEndian.Uint32(b)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(s), "\x00"), nil
+}
+
+// option reads an Option of a value of size bytes, nil when it is None.
+func (r *borshReader) option(size int) ([]byte, error) {
+	tag, err := r.read(1)
+	if err != nil || tag[0] == 0 {
+		return nil, err
+	}
+	return r.read(size)
+}
+
+// skipCreators skips an optional list of creators, an address, the verified
+// flag and a share each.
+func (r *borshReader) skipCreators() error {
+	tag, err := r.read(1)
+	if err != nil || tag[0] == 0 {
+		return err
+	}
+	n, err := r.read(4)
+	if err != nil {
+		return err
+	}
+	_, err = r.read(int(binary.LittleEndian.Uint32(n)) * 34)
+	return err
+}
+
+// collection reads an optional collection, the verified flag and the
+// collection mint.
+func (r *borshReader) collection(event *MintEvent) error {
+	collection, err := r.option(33)
+	if err != nil || collection == nil {
+		return err
+	}
+	event.Collection = base58.Encode(collection[1:])
+	return nil
+}
@@ -0,0 +1,94 @@
+package decode
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// borshString appends s to data as a borsh string.
+func borshString(data []byte, s string) []byte {
+	return append(binary.LittleEndian.AppendUint32(data, uint32(len(s))), s...)
+}
+
+// metadataArgs appends the name, symbol, URI and seller fee of the metadata
+// arguments to data.
+func metadataArgs(data []byte, name string) []byte {
+	data = borshString(data, name)
+	data = borshString(data, "TKN\x00\x00")
+	data = borshString(data, "https://example.com/"+name)
+	return binary.LittleEndian.AppendUint16(data, 500)
+}
+
+// mintTransaction has the mint at 0, its authority at 1, the metadata at 3,
+// the collection mint at 4, the leaf owner and the tree at 5 and 6, the
+// collection of the compressed NFT at 7 and a mint created through a CPI at
+// 8, then the token, Token Metadata and Bubblegum programs at 9, 10 and 11.
+func mintTransaction() *proto.SubscribeUpdateTransactionInfo {
+	var keys [][]byte
+	for i := range byte(9) {
+		keys = append(keys, testkey.Key(i+1))
+	}
+	for _, program := range []string{TokenProgramID, TokenMetadataProgramID, BubblegumProgramID} {
+		key, _ := base58.Decode(program)
+		keys = append(keys, key)
+	}
+
+	initialize := append([]byte{tokenInitMint2, 6}, testkey.Key(2)...)
+	initialize = append(append(initialize, 1), testkey.Key(3)...)
+
+	// one creator, then the collection
+	metadata := metadataArgs([]byte{metadataCreateV3}, "Token")
+	metadata = binary.LittleEndian.AppendUint32(append(metadata, 1), 1)
+	metadata = append(metadata, make([]byte, 34)...)
+	metadata = append(append(metadata, 1, 0), testkey.Key(5)...)
+	metadata = append(metadata, 0, 1, 0)
+
+	// no edition nonce, a token standard and no collection
+	compressed := metadataArgs(idlDiscriminator(nil, "global:mint_to_collection_v1"), "Ticket")
+	compressed = append(compressed, 0, 1, 0, 1, 0, 0)
+
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature: testkey.Key(0xff),
+		Transaction: &proto.Transaction{Message: &proto.Message{
+			AccountKeys: keys,
+			Instructions: []*proto.CompiledInstruction{
+				{ProgramIdIndex: 9, Accounts: []byte{0}, Data: initialize},
+				{ProgramIdIndex: 10, Accounts: []byte{3, 0, 1, 1, 1}, Data: metadata},
+				{ProgramIdIndex: 11, Accounts: []byte{1, 5, 1, 6, 1, 1, 1, 1, 7}, Data: compressed},
+				// truncated
+				{ProgramIdIndex: 10, Accounts: []byte{3, 0, 1, 1, 1}, Data: metadata[:20]},
+			},
+		}},
+		Meta: &proto.TransactionStatusMeta{
+			InnerInstructions: []*proto.InnerInstructions{{Index: 2, Instructions: []*proto.InnerInstruction{
+				{ProgramIdIndex: 9, Accounts: []byte{8, 1}, Data: append([]byte{tokenInitMint, 0}, append(testkey.Key(2), 0)...)},
+			}}},
+		},
+	}
+}
+
+func TestDecodeMintEvents(t *testing.T) {
+	zero, six := uint32(0), uint32(6)
+	inner := 0
+	want := []MintEvent{
+		{Type: mintNew, Program: "spl-token", Mint: testkey.String(1), Decimals: &six,
+			MintAuthority: testkey.String(2), FreezeAuthority: testkey.String(3)},
+		{Type: mintMetadata, Program: "token-metadata", Instruction: 1, Mint: testkey.String(1),
+			MintAuthority: testkey.String(2), Metadata: testkey.String(4), UpdateAuthority: testkey.String(2),
+			Name: "Token", Symbol: "TKN", URI: "https://example.com/Token", Collection: testkey.String(5)},
+		{Type: mintCompressedNFT, Program: "bubblegum", Instruction: 2, Name: "Ticket", Symbol: "TKN",
+			URI: "https://example.com/Ticket", TokenStandard: "non_fungible", Collection: testkey.String(8),
+			Owner: testkey.String(6), Tree: testkey.String(7)},
+		{Type: mintNew, Program: "spl-token", Instruction: 2, InnerInstruction: &inner, Mint: testkey.String(9),
+			Decimals: &zero, MintAuthority: testkey.String(2)},
+	}
+	if got := DecodeMintEvents(mintTransaction()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
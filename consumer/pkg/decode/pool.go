@@ -0,0 +1,116 @@
+package decode
+
+import (
+	"sync"
+
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/proto"
+)
+
+// messagePool recycles the Messages the Decoder returns, their header maps,
+// their SubscribeUpdates and the struct in the oneof of those, such as the
+// SubscribeUpdateTransactionInfo, saving a few allocations per message at
+// high rates. Only these top-level structs are reused: unmarshalling resets
+// its target, so the messages nested in them and their lists are allocated
+// again on every decode. The methods of a nil messagePool allocate and
+// release nothing.
+//
+// A released Message is reset and handed out again by a later Decode, so
+// nothing may keep a pointer to it, its Update or the structs below once the
+// consumer is done with it: after Write returned, or once the sink holding it
+// completed it, see Message.Hold. Byte slices and strings read from the update
+// stay valid, unmarshalling always allocates new ones.
+type messagePool struct {
+	messages sync.Pool
+	updates  sync.Pool
+	// inners are the messages in the oneof of the updates by kind.
+	inners map[UpdateKind]*sync.Pool
+}
+
+func newMessagePool() *messagePool {
+	p := &messagePool{inners: make(map[UpdateKind]*sync.Pool)}
+	for _, kind := range []UpdateKind{KindAccount, KindSlot, KindTransaction, KindTransactionStatus, KindBlock, KindBlockMeta, KindEntry} {
+		p.inners[kind] = &sync.Pool{}
+	}
+	return p
+}
+
+func (p *messagePool) message() *Message {
+	if p != nil {
+		if msg, ok := p.messages.Get().(*Message); ok {
+			return msg
+		}
+	}
+	return &Message{}
+}
+
+func (p *messagePool) update() *proto.SubscribeUpdate {
+	if p != nil {
+		if update, ok := p.updates.Get().(*proto.SubscribeUpdate); ok {
+			return update
+		}
+	}
+	return &proto.SubscribeUpdate{}
+}
+
+// pooledInner returns a message of kind from the pool, a new one when it
+// has none.
+func pooledInner[T any, P interface {
+	*T
+	gproto.Message
+}](p *messagePool, kind UpdateKind) P {
+	if p != nil {
+		if pool := p.inners[kind]; pool != nil {
+			if inner, ok := pool.Get().(P); ok {
+				return inner
+			}
+		}
+	}
+	return new(T)
+}
+
+// release puts msg back into the pool.
+func (p *messagePool) release(msg *Message) {
+	if p == nil || msg == nil {
+		return
+	}
+	if update := msg.Update; update != nil {
+		inner := innerUpdate(update)
+		if pool := p.inners[UpdateKindOf(update)]; pool != nil && inner != nil && inner.ProtoReflect().IsValid() {
+			// drops the nested messages for the garbage collector, the
+			// next unmarshal would reset them anyway
+			gproto.Reset(inner)
+			pool.Put(inner)
+		}
+		gproto.Reset(update)
+		p.updates.Put(update)
+	}
+	// the header map is kept for the next message
+	headers := msg.Headers
+	clear(headers)
+	*msg = Message{Headers: headers}
+	p.messages.Put(msg)
+}
+
+// innerUpdate returns the message in the oneof of update, nil for the kinds
+// without a pool.
+func innerUpdate(update *proto.SubscribeUpdate) gproto.Message {
+	switch u := update.GetUpdateOneof().(type) {
+	case *proto.SubscribeUpdate_Account:
+		return u.Account
+	case *proto.SubscribeUpdate_Slot:
+		return u.Slot
+	case *proto.SubscribeUpdate_Transaction:
+		return u.Transaction.GetTransaction()
+	case *proto.SubscribeUpdate_TransactionStatus:
+		return u.TransactionStatus
+	case *proto.SubscribeUpdate_Block:
+		return u.Block
+	case *proto.SubscribeUpdate_BlockMeta:
+		return u.BlockMeta
+	case *proto.SubscribeUpdate_Entry:
+		return u.Entry
+	}
+	return nil
+}
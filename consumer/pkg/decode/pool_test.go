@@ -0,0 +1,41 @@
+package decode
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/testkey"
+)
+
+func TestMessagePoolAllocs(t *testing.T) {
+	value, err := gproto.Marshal(transactionMessage(10, testkey.Key(1)).Update.GetTransaction().GetTransaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &sarama.ConsumerMessage{
+		Topic:   "transactions",
+		Key:     []byte("10_hash"),
+		Value:   value,
+		Headers: []*sarama.RecordHeader{{Key: []byte(HeaderSource), Value: []byte("validator")}},
+	}
+	allocs := func(reuse bool) float64 {
+		decoder, err := NewDecoder(Config{Kind: string(KindTransaction), ReuseMessages: reuse})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testing.AllocsPerRun(100, func() {
+			msg, err := decoder.Decode(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder.Release(msg)
+		})
+	}
+	// the Message, its header map, the SubscribeUpdate and the transaction
+	// info are reused, the messages nested in the transaction info are not
+	if fresh, reused := allocs(false), allocs(true); fresh-reused < 4 {
+		t.Fatalf("%g allocations per decode with reuse_messages, %g without", reused, fresh)
+	}
+}
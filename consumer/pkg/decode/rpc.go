@@ -0,0 +1,277 @@
+package decode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// The rpc* types mirror the response of Solana RPC getTransaction with the
+// json encoding, field for field and in the same order.
+
+type rpcTransactionResponse struct {
+	Slot        uint64         `json:"slot"`
+	BlockTime   *int64         `json:"blockTime"`
+	Transaction rpcTransaction `json:"transaction"`
+	Meta        *rpcMeta       `json:"meta"`
+	Version     any            `json:"version"`
+}
+
+type rpcTransaction struct {
+	Signatures []string   `json:"signatures"`
+	Message    rpcMessage `json:"message"`
+}
+
+type rpcMessage struct {
+	Header              rpcHeader                `json:"header"`
+	AccountKeys         []string                 `json:"accountKeys"`
+	RecentBlockhash     string                   `json:"recentBlockhash"`
+	Instructions        []rpcInstruction         `json:"instructions"`
+	AddressTableLookups []rpcAddressTableLookups `json:"addressTableLookups,omitempty"`
+}
+
+type rpcHeader struct {
+	NumRequiredSignatures       uint32 `json:"numRequiredSignatures"`
+	NumReadonlySignedAccounts   uint32 `json:"numReadonlySignedAccounts"`
+	NumReadonlyUnsignedAccounts uint32 `json:"numReadonlyUnsignedAccounts"`
+}
+
+type rpcInstruction struct {
+	ProgramIDIndex uint32  `json:"programIdIndex"`
+	Accounts       []int   `json:"accounts"`
+	Data           string  `json:"data"`
+	StackHeight    *uint32 `json:"stackHeight"`
+}
+
+type rpcAddressTableLookups struct {
+	AccountKey      string `json:"accountKey"`
+	WritableIndexes []int  `json:"writableIndexes"`
+	ReadonlyIndexes []int  `json:"readonlyIndexes"`
+}
+
+type rpcMeta struct {
+	Err                  any                    `json:"err"`
+	Status               map[string]any         `json:"status"`
+	Fee                  uint64                 `json:"fee"`
+	PreBalances          []uint64               `json:"preBalances"`
+	PostBalances         []uint64               `json:"postBalances"`
+	InnerInstructions    []rpcInnerInstructions `json:"innerInstructions"`
+	LogMessages          []string               `json:"logMessages"`
+	PreTokenBalances     []rpcTokenBalance      `json:"preTokenBalances"`
+	PostTokenBalances    []rpcTokenBalance      `json:"postTokenBalances"`
+	Rewards              []rpcReward            `json:"rewards"`
+	LoadedAddresses      rpcLoadedAddresses     `json:"loadedAddresses"`
+	ReturnData           *rpcReturnData         `json:"returnData,omitempty"`
+	ComputeUnitsConsumed *uint64                `json:"computeUnitsConsumed,omitempty"`
+}
+
+type rpcInnerInstructions struct {
+	Index        uint32           `json:"index"`
+	Instructions []rpcInstruction `json:"instructions"`
+}
+
+type rpcTokenBalance struct {
+	AccountIndex  uint32         `json:"accountIndex"`
+	Mint          string         `json:"mint"`
+	Owner         string         `json:"owner,omitempty"`
+	ProgramID     string         `json:"programId,omitempty"`
+	UITokenAmount rpcTokenAmount `json:"uiTokenAmount"`
+}
+
+type rpcTokenAmount struct {
+	Amount         string   `json:"amount"`
+	Decimals       uint32   `json:"decimals"`
+	UIAmount       *float64 `json:"uiAmount"`
+	UIAmountString string   `json:"uiAmountString"`
+}
+
+type rpcReward struct {
+	Pubkey      string  `json:"pubkey"`
+	Lamports    int64   `json:"lamports"`
+	PostBalance uint64  `json:"postBalance"`
+	RewardType  *string `json:"rewardType"`
+	Commission  *uint8  `json:"commission"`
+}
+
+type rpcLoadedAddresses struct {
+	Writable []string `json:"writable"`
+	Readonly []string `json:"readonly"`
+}
+
+type rpcReturnData struct {
+	ProgramID string    `json:"programId"`
+	Data      [2]string `json:"data"`
+}
+
+// FormatRPCTransaction renders a transaction like Solana RPC getTransaction
+// does with the json encoding. The block time is not part of transaction
+// updates and is always null.
+func FormatRPCTransaction(slot uint64, info *proto.SubscribeUpdateTransactionInfo) ([]byte, error) {
+	return json.Marshal(newRPCTransactionResponse(slot, info))
+}
+
+func newRPCTransactionResponse(slot uint64, info *proto.SubscribeUpdateTransactionInfo) rpcTransactionResponse {
+	tx := info.GetTransaction()
+	message := tx.GetMessage()
+
+	response := rpcTransactionResponse{
+		Slot: slot,
+		Transaction: rpcTransaction{
+			Signatures: EncodeKeys(tx.GetSignatures()),
+			Message: rpcMessage{
+				Header: rpcHeader{
+					NumRequiredSignatures:       message.GetHeader().GetNumRequiredSignatures(),
+					NumReadonlySignedAccounts:   message.GetHeader().GetNumReadonlySignedAccounts(),
+					NumReadonlyUnsignedAccounts: message.GetHeader().GetNumReadonlyUnsignedAccounts(),
+				},
+				AccountKeys:     EncodeKeys(message.GetAccountKeys()),
+				RecentBlockhash: base58.Encode(message.GetRecentBlockhash()),
+				Instructions:    make([]rpcInstruction, 0, len(message.GetInstructions())),
+			},
+		},
+		Version: "legacy",
+	}
+	for _, ix := range message.GetInstructions() {
+		response.Transaction.Message.Instructions = append(response.Transaction.Message.Instructions,
+			newRPCInstruction(ix.GetProgramIdIndex(), ix.GetAccounts(), ix.GetData(), nil))
+	}
+	if message.GetVersioned() {
+		response.Version = 0
+		lookups := make([]rpcAddressTableLookups, 0, len(message.GetAddressTableLookups()))
+		for _, lookup := range message.GetAddressTableLookups() {
+			lookups = append(lookups, rpcAddressTableLookups{
+				AccountKey:      base58.Encode(lookup.GetAccountKey()),
+				WritableIndexes: accountIndexes(lookup.GetWritableIndexes()),
+				ReadonlyIndexes: accountIndexes(lookup.GetReadonlyIndexes()),
+			})
+		}
+		response.Transaction.Message.AddressTableLookups = lookups
+	}
+	if meta := info.GetMeta(); meta != nil {
+		response.Meta = newRPCMeta(meta)
+	}
+	return response
+}
+
+func newRPCMeta(meta *proto.TransactionStatusMeta) *rpcMeta {
+	out := &rpcMeta{
+		Status:            map[string]any{"Ok": nil},
+		Fee:               meta.GetFee(),
+		PreBalances:       nonNil(meta.GetPreBalances()),
+		PostBalances:      nonNil(meta.GetPostBalances()),
+		PreTokenBalances:  newRPCTokenBalances(meta.GetPreTokenBalances()),
+		PostTokenBalances: newRPCTokenBalances(meta.GetPostTokenBalances()),
+		Rewards:           newRPCRewards(meta.GetRewards()),
+		LoadedAddresses: rpcLoadedAddresses{
+			Writable: EncodeKeys(meta.GetLoadedWritableAddresses()),
+			Readonly: EncodeKeys(meta.GetLoadedReadonlyAddresses()),
+		},
+		ComputeUnitsConsumed: meta.ComputeUnitsConsumed,
+	}
+
+	if raw := meta.GetErr().GetErr(); raw != nil {
+		err, decodeErr := DecodeTransactionError(raw)
+		if decodeErr != nil {
+			// keep the raw error rather than reporting success
+			err = base64.StdEncoding.EncodeToString(raw)
+		}
+		out.Err = err
+		out.Status = map[string]any{"Err": err}
+	}
+
+	if !meta.GetInnerInstructionsNone() {
+		out.InnerInstructions = make([]rpcInnerInstructions, 0, len(meta.GetInnerInstructions()))
+		for _, inner := range meta.GetInnerInstructions() {
+			instructions := make([]rpcInstruction, 0, len(inner.GetInstructions()))
+			for _, ix := range inner.GetInstructions() {
+				instructions = append(instructions, newRPCInstruction(ix.GetProgramIdIndex(), ix.GetAccounts(), ix.GetData(), ix.StackHeight))
+			}
+			out.InnerInstructions = append(out.InnerInstructions, rpcInnerInstructions{Index: inner.GetIndex(), Instructions: instructions})
+		}
+	}
+	if !meta.GetLogMessagesNone() {
+		out.LogMessages = nonNil(meta.GetLogMessages())
+	}
+	if data := meta.GetReturnData(); data != nil && !meta.GetReturnDataNone() {
+		out.ReturnData = &rpcReturnData{
+			ProgramID: base58.Encode(data.GetProgramId()),
+			Data:      [2]string{base64.StdEncoding.EncodeToString(data.GetData()), "base64"},
+		}
+	}
+	return out
+}
+
+func newRPCInstruction(programIDIndex uint32, accounts, data []byte, stackHeight *uint32) rpcInstruction {
+	return rpcInstruction{
+		ProgramIDIndex: programIDIndex,
+		Accounts:       accountIndexes(accounts),
+		Data:           base58.Encode(data),
+		StackHeight:    stackHeight,
+	}
+}
+
+func newRPCTokenBalances(balances []*proto.TokenBalance) []rpcTokenBalance {
+	out := make([]rpcTokenBalance, 0, len(balances))
+	for _, balance := range balances {
+		amount := balance.GetUiTokenAmount()
+		tokenAmount := rpcTokenAmount{
+			Amount:         amount.GetAmount(),
+			Decimals:       amount.GetDecimals(),
+			UIAmountString: amount.GetUiAmountString(),
+		}
+		// RPC reports a zero balance as a null ui amount
+		if uiAmount := amount.GetUiAmount(); uiAmount != 0 {
+			tokenAmount.UIAmount = &uiAmount
+		}
+		out = append(out, rpcTokenBalance{
+			AccountIndex:  balance.GetAccountIndex(),
+			Mint:          balance.GetMint(),
+			Owner:         balance.GetOwner(),
+			ProgramID:     balance.GetProgramId(),
+			UITokenAmount: tokenAmount,
+		})
+	}
+	return out
+}
+
+func newRPCRewards(rewards []*proto.Reward) []rpcReward {
+	out := make([]rpcReward, 0, len(rewards))
+	for _, reward := range rewards {
+		r := rpcReward{
+			Pubkey:      reward.GetPubkey(),
+			Lamports:    reward.GetLamports(),
+			PostBalance: reward.GetPostBalance(),
+		}
+		if reward.GetRewardType() != proto.RewardType_Unspecified {
+			rewardType := reward.GetRewardType().String()
+			r.RewardType = &rewardType
+		}
+		if commission, err := strconv.ParseUint(reward.GetCommission(), 10, 8); err == nil {
+			commission := uint8(commission)
+			r.Commission = &commission
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// accountIndexes turns a packed index list into numbers.
+func accountIndexes(b []byte) []int {
+	indexes := make([]int, len(b))
+	for i, index := range b {
+		indexes[i] = int(index)
+	}
+	return indexes
+}
+
+// nonNil keeps empty lists as [] rather than null in JSON.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
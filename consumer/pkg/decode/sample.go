@@ -0,0 +1,100 @@
+package decode
+
+import (
+	"hash/fnv"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"consumer/proto"
+)
+
+// signaturePaths are the field numbers leading to the signature in the
+// protobuf payload of each kind carrying one, the first match winning.
+var signaturePaths = map[UpdateKind][][]protowire.Number{
+	// SubscribeUpdateTransactionInfo.signature
+	KindTransaction: {{1}},
+	// SubscribeUpdateTransactionStatus.signature
+	KindTransactionStatus: {{2}},
+	// SubscribeUpdate.transaction.transaction.signature, then
+	// SubscribeUpdate.transaction_status.signature
+	KindUpdate: {{4, 1, 1}, {10, 2}},
+}
+
+var signatureDescriptors = map[UpdateKind]protoreflect.MessageDescriptor{
+	KindTransaction:       (&proto.SubscribeUpdateTransactionInfo{}).ProtoReflect().Descriptor(),
+	KindTransactionStatus: (&proto.SubscribeUpdateTransactionStatus{}).ProtoReflect().Descriptor(),
+	KindUpdate:            (&proto.SubscribeUpdate{}).ProtoReflect().Descriptor(),
+}
+
+// sampled reports whether decoding.sample keeps the transaction with
+// signature: 1 of every d.sample, by the FNV-1a hash of the signature, so
+// every consumer and every replay of a topic keeps the same transactions.
+// Updates without a signature are always kept.
+func (d *Decoder) sampled(signature []byte) bool {
+	if d.sample <= 1 || len(signature) == 0 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(signature)
+	return h.Sum64()%uint64(d.sample) == 0
+}
+
+// SampleRecord reports whether decoding.sample keeps record, reading the
+// signature of a protobuf transaction or transaction status off the wire
+// without decoding it. Records it cannot read the signature of, such as JSON
+// and Avro payloads, are kept for SampleMessage to decide once decoded.
+func (d *Decoder) SampleRecord(record *sarama.ConsumerMessage) bool {
+	if d.sample <= 1 || d.FormatOf(record.Topic) != EncodingProtobuf {
+		return true
+	}
+	kind := d.KindOf(record.Topic)
+	paths, ok := signaturePaths[kind]
+	if !ok {
+		return true
+	}
+	payload, err := d.unwrap(record.Value, signatureDescriptors[kind])
+	if err != nil {
+		// left for the decoding to fail on
+		return true
+	}
+	for _, path := range paths {
+		if signature, ok := peekBytes(payload, path); ok {
+			return d.sampled(signature)
+		}
+	}
+	return true
+}
+
+// SampleMessage reports whether decoding.sample keeps msg, the same
+// decision SampleRecord takes on its record.
+func (d *Decoder) SampleMessage(msg *Message) bool {
+	return d.sampled(MessageSignature(msg))
+}
+
+// peekBytes returns the bytes field at path in the protobuf message in
+// payload, each number but the last naming an embedded message.
+func peekBytes(payload []byte, path []protowire.Number) ([]byte, bool) {
+	var value []byte
+	var found bool
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, false
+		}
+		m := protowire.ConsumeFieldValue(num, typ, payload[n:])
+		if m < 0 {
+			return nil, false
+		}
+		if num == path[0] && typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(payload[n:])
+			found = true
+		}
+		payload = payload[n+m:]
+	}
+	if !found || len(path) == 1 {
+		return value, found
+	}
+	return peekBytes(value, path[1:])
+}
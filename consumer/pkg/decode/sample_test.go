@@ -0,0 +1,99 @@
+package decode
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/encoding/protojson"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+func TestSampleRecord(t *testing.T) {
+	decoder, err := NewDecoder(Config{
+		Kind:    string(KindTransaction),
+		Topics:  map[string]string{"updates": string(KindUpdate), "slots": string(KindSlot)},
+		Formats: map[string]string{"json": EncodingJSON},
+		Sample:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := range 1000 {
+		update := transactionMessage(10, testkey.Key(1)).Update
+		signature := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		update.GetTransaction().GetTransaction().Signature = signature[:]
+
+		info, err := gproto.Marshal(update.GetTransaction().GetTransaction())
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := &sarama.ConsumerMessage{Topic: "transactions", Key: []byte("10_ab"), Value: info}
+		keep := decoder.SampleRecord(record)
+		msg, err := decoder.Decode(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoder.SampleMessage(msg) != keep {
+			t.Fatalf("transaction %d: record and message sampled apart", i)
+		}
+
+		envelope, err := gproto.Marshal(update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoder.SampleRecord(&sarama.ConsumerMessage{Topic: "updates", Value: envelope}) != keep {
+			t.Fatalf("transaction %d: envelope sampled apart", i)
+		}
+
+		// JSON payloads are sampled once decoded
+		data, err := protojson.Marshal(update.GetTransaction().GetTransaction())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoder.SampleRecord(&sarama.ConsumerMessage{Topic: "json", Value: data}) {
+			t.Fatalf("transaction %d: JSON record sampled before decoding", i)
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept < 50 || kept > 150 {
+		t.Fatalf("kept %d of 1000 transactions, expected about 100", kept)
+	}
+
+	slot, err := gproto.Marshal(&proto.SubscribeUpdateSlot{Slot: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoder.SampleRecord(&sarama.ConsumerMessage{Topic: "slots", Value: slot}) {
+		t.Fatal("slot sampled")
+	}
+	// a payload the decoding fails on is left to it
+	if !decoder.SampleRecord(&sarama.ConsumerMessage{Topic: "transactions", Value: []byte{0x0a, 0x40}}) {
+		t.Fatal("truncated payload sampled")
+	}
+}
+
+func TestSampleDisabled(t *testing.T) {
+	for _, sample := range []int{0, 1} {
+		decoder, err := NewDecoder(Config{Kind: string(KindUpdate), Sample: sample})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 100 {
+			msg := transactionMessage(10, testkey.Key(1))
+			msg.Update.GetTransaction().GetTransaction().Signature = testkey.Key(byte(i))
+			if !decoder.SampleMessage(msg) {
+				t.Fatalf("sample %d dropped transaction %d", sample, i)
+			}
+		}
+	}
+	if _, err := NewDecoder(Config{Kind: string(KindUpdate), Sample: -1}); err == nil {
+		t.Fatal("negative sample accepted")
+	}
+}
@@ -0,0 +1,490 @@
+package decode
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+// Wire formats for Config.WireFormat and Grpc2KafkaConfig.WireFormat.
+const (
+	// WireFormatAuto strips the Confluent header off the payloads starting
+	// with its magic byte. A protobuf message never starts with a zero byte,
+	// field number 0 being invalid.
+	WireFormatAuto = "auto"
+	WireFormatRaw  = "raw"
+	// WireFormatConfluent is the magic byte, the big-endian schema id and
+	// the message indexes in front of every payload.
+	WireFormatConfluent = "confluent"
+)
+
+const wireMagic = 0
+
+// SchemaRegistryConfig is a Confluent Schema Registry.
+type SchemaRegistryConfig struct {
+	// URL of the registry, the schemas of the consumed payloads are not
+	// looked up when empty.
+	URL      string            `json:"url" yaml:"url"`
+	Username string            `json:"username" yaml:"username"`
+	Password string            `json:"password" yaml:"password"`
+	Timeout  duration.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func DefaultSchemaRegistryConfig() SchemaRegistryConfig {
+	return SchemaRegistryConfig{Timeout: duration.Duration(10 * time.Second)}
+}
+
+func (c *SchemaRegistryConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("decoding.schema_registry.url: expected an http or https URL, got %q", c.URL)
+	}
+	if c.Timeout <= 0 {
+		return errors.New("decoding.schema_registry.timeout: must be positive")
+	}
+	return nil
+}
+
+func validateWireFormat(field, format string) error {
+	switch format {
+	case WireFormatAuto, WireFormatRaw, WireFormatConfluent:
+		return nil
+	}
+	return fmt.Errorf("%s: expected auto, raw or confluent, got %q", field, format)
+}
+
+// parseWireHeader splits a payload in the Confluent wire format into its
+// schema id and the rest, the message of Avro and JSON schemas.
+func parseWireHeader(payload []byte) (int32, []byte, error) {
+	if len(payload) < 5 || payload[0] != wireMagic {
+		return 0, nil, errors.New("missing the schema registry header")
+	}
+	return int32(binary.BigEndian.Uint32(payload[1:5])), payload[5:], nil
+}
+
+// parseWireFormat splits a payload in the Confluent protobuf wire format into
+// its schema id, the indexes of its message in the schema, and the message.
+func parseWireFormat(payload []byte) (int32, []int, []byte, error) {
+	id, rest, err := parseWireHeader(payload)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	count, n := binary.Varint(rest)
+	if n <= 0 || count < 0 || count > int64(len(rest)) {
+		return 0, nil, nil, errors.New("invalid message indexes in the schema registry header")
+	}
+	rest = rest[n:]
+	// no indexes stand for the first message of the schema
+	indexes := []int{0}
+	if count > 0 {
+		indexes = make([]int, count)
+		for i := range indexes {
+			index, n := binary.Varint(rest)
+			if n <= 0 || index < 0 {
+				return 0, nil, nil, errors.New("invalid message indexes in the schema registry header")
+			}
+			indexes[i], rest = int(index), rest[n:]
+		}
+	}
+	return id, indexes, rest, nil
+}
+
+// AppendWireFormat appends the Confluent header of a payload to dst.
+func AppendWireFormat(dst []byte, id int32, indexes []int) []byte {
+	dst = append(dst, wireMagic)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(id))
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return append(dst, 0)
+	}
+	dst = binary.AppendVarint(dst, int64(len(indexes)))
+	for _, index := range indexes {
+		dst = binary.AppendVarint(dst, int64(index))
+	}
+	return dst
+}
+
+// MessageIndexes is the path of a message in its file, as the wire format
+// identifies it: its index among the messages of the file, then among the
+// nested messages of every parent. Map entries, not in the .proto source,
+// are not counted.
+func MessageIndexes(desc protoreflect.MessageDescriptor) []int {
+	var indexes []int
+	for message, ok := desc, true; ok; message, ok = message.Parent().(protoreflect.MessageDescriptor) {
+		siblings := message.ParentFile().Messages()
+		if parent, ok := message.Parent().(protoreflect.MessageDescriptor); ok {
+			siblings = parent.Messages()
+		}
+		index := 0
+		for i := 0; i < message.Index(); i++ {
+			if !siblings.Get(i).IsMapEntry() {
+				index++
+			}
+		}
+		indexes = append([]int{index}, indexes...)
+	}
+	return indexes
+}
+
+// SchemaRegistry looks up protobuf, Avro and JSON schemas and registers
+// protobuf ones. The schemas looked up are cached by id, they never change.
+type SchemaRegistry struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	mu      sync.Mutex
+	schemas map[int32]*registrySchema
+}
+
+// registrySchema is a schema looked up by id, with the messages parsed from
+// a protobuf source or the codec of an Avro one.
+type registrySchema struct {
+	schemaType string
+	pkg        string
+	messages   []*schemaMessage
+	codec      *goavro.Codec
+}
+
+type schemaMessage struct {
+	name   string
+	nested []*schemaMessage
+}
+
+// NewSchemaRegistry returns nil when config has no URL.
+func NewSchemaRegistry(config SchemaRegistryConfig) *SchemaRegistry {
+	if config.URL == "" {
+		return nil
+	}
+	return &SchemaRegistry{
+		url:      strings.TrimSuffix(config.URL, "/"),
+		username: config.Username,
+		password: config.Password,
+		client:   &http.Client{Timeout: time.Duration(config.Timeout)},
+		schemas:  make(map[int32]*registrySchema),
+	}
+}
+
+// lookup returns the schema id, looked up once.
+func (r *SchemaRegistry) lookup(id int32) (*registrySchema, error) {
+	r.mu.Lock()
+	schema, ok := r.schemas[id]
+	r.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	var response struct {
+		SchemaType string `json:"schemaType"`
+		Schema     string `json:"schema"`
+	}
+	if err := r.do(context.Background(), http.MethodGet, "/schemas/ids/"+strconv.Itoa(int(id)), nil, &response); err != nil {
+		return nil, fmt.Errorf("look up schema %d: %w", id, err)
+	}
+	// the registry leaves out the type of Avro schemas
+	schema = &registrySchema{schemaType: cmp.Or(response.SchemaType, "AVRO")}
+	switch schema.schemaType {
+	case "PROTOBUF":
+		schema.pkg, schema.messages = parseSchemaMessages(response.Schema)
+	case "AVRO":
+		codec, err := goavro.NewCodec(response.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema %d: %w", id, err)
+		}
+		schema.codec = codec
+	}
+	r.mu.Lock()
+	r.schemas[id] = schema
+	r.mu.Unlock()
+	return schema, nil
+}
+
+// messageName returns the full name of the message the indexes point at in
+// the schema id, which must be a protobuf schema.
+func (r *SchemaRegistry) messageName(id int32, indexes []int) (string, error) {
+	schema, err := r.lookup(id)
+	if err != nil {
+		return "", err
+	}
+	if schema.schemaType != "PROTOBUF" {
+		return "", fmt.Errorf("schema %d is not a protobuf schema", id)
+	}
+	name, messages := schema.pkg, schema.messages
+	for _, index := range indexes {
+		if index >= len(messages) {
+			return "", fmt.Errorf("schema %d has no message at %v", id, indexes)
+		}
+		name = strings.TrimPrefix(name+"."+messages[index].name, ".")
+		messages = messages[index].nested
+	}
+	return name, nil
+}
+
+// avroCodec returns the codec of the schema id, which must be an Avro schema.
+func (r *SchemaRegistry) avroCodec(id int32) (*goavro.Codec, error) {
+	schema, err := r.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if schema.codec == nil {
+		return nil, fmt.Errorf("schema %d is not an Avro schema", id)
+	}
+	return schema.codec, nil
+}
+
+// checkType fails unless the schema id is of schemaType.
+func (r *SchemaRegistry) checkType(id int32, schemaType string) error {
+	schema, err := r.lookup(id)
+	if err != nil {
+		return err
+	}
+	if schema.schemaType != schemaType {
+		return fmt.Errorf("schema %d is a %s schema, expected %s", id, schema.schemaType, schemaType)
+	}
+	return nil
+}
+
+// schemaToken splits a .proto source into words, braces and semicolons,
+// once schemaComment removed the block comments.
+var (
+	schemaToken   = regexp.MustCompile(`[{};]|[^\s{};]+`)
+	schemaComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+)
+
+// parseSchemaMessages returns the package of a .proto source and its
+// messages in the order of declaration, the only part of it the message
+// indexes need.
+func parseSchemaMessages(source string) (string, []*schemaMessage) {
+	var clean strings.Builder
+	for _, line := range strings.Split(schemaComment.ReplaceAllString(source, ""), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		clean.WriteString(line + "\n")
+	}
+	tokens := schemaToken.FindAllString(clean.String(), -1)
+
+	root := &schemaMessage{}
+	// stack holds the message of every open block, nil for enums, oneofs
+	// and the like
+	stack := []*schemaMessage{root}
+	var pkg string
+	var pending *schemaMessage
+	for i, token := range tokens {
+		switch {
+		case token == "package" && len(stack) == 1 && i+1 < len(tokens):
+			pkg = tokens[i+1]
+		case token == "message" && i+2 < len(tokens) && tokens[i+2] == "{":
+			pending = &schemaMessage{name: tokens[i+1]}
+			if parent := stack[len(stack)-1]; parent != nil {
+				parent.nested = append(parent.nested, pending)
+			}
+		case token == "{":
+			stack, pending = append(stack, pending), nil
+		case token == "}" && len(stack) > 1:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return pkg, root.nested
+}
+
+// schemaReference is a schema imported by another.
+type schemaReference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// RegisterGeyser registers geyser.proto, the schema of every payload, under
+// subject and returns its id. The files it imports are registered under
+// their path first, except the well-known types the registry knows.
+func (r *SchemaRegistry) RegisterGeyser(ctx context.Context, subject string) (int32, error) {
+	id, _, err := r.register(ctx, subject, proto.File_geyser_proto)
+	return id, err
+}
+
+func (r *SchemaRegistry) register(ctx context.Context, subject string, file protoreflect.FileDescriptor) (int32, int, error) {
+	request := struct {
+		SchemaType string            `json:"schemaType"`
+		Schema     string            `json:"schema"`
+		References []schemaReference `json:"references,omitempty"`
+	}{SchemaType: "PROTOBUF", Schema: protoSchema(file)}
+	imports := file.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		dep := imports.Get(i).FileDescriptor
+		if strings.HasPrefix(dep.Path(), "google/protobuf/") {
+			continue
+		}
+		_, version, err := r.register(ctx, dep.Path(), dep)
+		if err != nil {
+			return 0, 0, err
+		}
+		request.References = append(request.References, schemaReference{Name: dep.Path(), Subject: dep.Path(), Version: version})
+	}
+
+	path := "/subjects/" + url.PathEscape(subject)
+	var registered struct {
+		ID int32 `json:"id"`
+	}
+	if err := r.do(ctx, http.MethodPost, path+"/versions", request, &registered); err != nil {
+		return 0, 0, fmt.Errorf("register %s: %w", subject, err)
+	}
+	// the references of the dependents need the version
+	var existing struct {
+		Version int `json:"version"`
+	}
+	if err := r.do(ctx, http.MethodPost, path, request, &existing); err != nil {
+		return 0, 0, fmt.Errorf("look up %s: %w", subject, err)
+	}
+	return registered.ID, existing.Version, nil
+}
+
+func (r *SchemaRegistry) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if json.Unmarshal(text, &failure) != nil || failure.Message == "" {
+			failure.Message = string(bytes.TrimSpace(text))
+		}
+		return fmt.Errorf("schema registry returned %d %s", resp.StatusCode, failure.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// protoSchema prints the .proto source of a file, as registered: its
+// package, imports, messages and enums, without options or services.
+func protoSchema(file protoreflect.FileDescriptor) string {
+	var b strings.Builder
+	b.WriteString("syntax = \"" + file.Syntax().String() + "\";\n")
+	if file.Package() != "" {
+		b.WriteString("package " + string(file.Package()) + ";\n")
+	}
+	imports := file.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		imported := imports.Get(i)
+		public := ""
+		if imported.IsPublic {
+			public = "public "
+		}
+		b.WriteString("import " + public + strconv.Quote(imported.Path()) + ";\n")
+	}
+	for i := 0; i < file.Enums().Len(); i++ {
+		writeProtoEnum(&b, file.Enums().Get(i), "")
+	}
+	for i := 0; i < file.Messages().Len(); i++ {
+		writeProtoMessage(&b, file.Messages().Get(i), "")
+	}
+	return b.String()
+}
+
+func writeProtoMessage(b *strings.Builder, message protoreflect.MessageDescriptor, indent string) {
+	b.WriteString(indent + "message " + string(message.Name()) + " {\n")
+	inner := indent + "  "
+	for i := 0; i < message.Enums().Len(); i++ {
+		writeProtoEnum(b, message.Enums().Get(i), inner)
+	}
+	for i := 0; i < message.Messages().Len(); i++ {
+		// map entries are implied by the map fields
+		if nested := message.Messages().Get(i); !nested.IsMapEntry() {
+			writeProtoMessage(b, nested, inner)
+		}
+	}
+	fields := message.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		oneof := field.ContainingOneof()
+		if oneof == nil || oneof.IsSynthetic() {
+			writeProtoField(b, field, inner)
+			continue
+		}
+		// a oneof is printed at its first field
+		if oneof.Fields().Get(0) != field {
+			continue
+		}
+		b.WriteString(inner + "oneof " + string(oneof.Name()) + " {\n")
+		for j := 0; j < oneof.Fields().Len(); j++ {
+			writeProtoField(b, oneof.Fields().Get(j), inner+"  ")
+		}
+		b.WriteString(inner + "}\n")
+	}
+	b.WriteString(indent + "}\n")
+}
+
+func writeProtoField(b *strings.Builder, field protoreflect.FieldDescriptor, indent string) {
+	var label string
+	switch {
+	case field.IsMap():
+		label = "map<" + protoFieldType(field.MapKey()) + ", " + protoFieldType(field.MapValue()) + "> "
+	case field.IsList():
+		label = "repeated " + protoFieldType(field) + " "
+	case field.HasOptionalKeyword():
+		label = "optional " + protoFieldType(field) + " "
+	default:
+		label = protoFieldType(field) + " "
+	}
+	fmt.Fprintf(b, "%s%s%s = %d;\n", indent, label, field.Name(), field.Number())
+}
+
+func protoFieldType(field protoreflect.FieldDescriptor) string {
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "." + string(field.Message().FullName())
+	case protoreflect.EnumKind:
+		return "." + string(field.Enum().FullName())
+	}
+	return field.Kind().String()
+}
+
+func writeProtoEnum(b *strings.Builder, enum protoreflect.EnumDescriptor, indent string) {
+	b.WriteString(indent + "enum " + string(enum.Name()) + " {\n")
+	for i := 0; i < enum.Values().Len(); i++ {
+		value := enum.Values().Get(i)
+		fmt.Fprintf(b, "%s  %s = %d;\n", indent, value.Name(), value.Number())
+	}
+	b.WriteString(indent + "}\n")
+}
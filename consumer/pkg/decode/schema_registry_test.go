@@ -0,0 +1,194 @@
+package decode
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/IBM/sarama"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"consumer/internal/testkey"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+func TestWireFormat(t *testing.T) {
+	for _, indexes := range [][]int{{0}, {3}, {2, 1}} {
+		payload := append(AppendWireFormat(nil, 258, indexes), "message"...)
+		id, got, rest, err := parseWireFormat(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 258 || !reflect.DeepEqual(got, indexes) || string(rest) != "message" {
+			t.Errorf("parsed %d %v %q, want 258 %v", id, got, rest, indexes)
+		}
+	}
+	if len(AppendWireFormat(nil, 1, []int{0})) != 6 {
+		t.Error("the first message is not written as a single zero index")
+	}
+	for _, payload := range [][]byte{{0, 0, 0}, {1, 0, 0, 0, 1, 0}, {0, 0, 0, 0, 1, 4}} {
+		if _, _, _, err := parseWireFormat(payload); err == nil {
+			t.Errorf("parsed %v", payload)
+		}
+	}
+}
+
+// TestProtoSchema checks that the indexes of every message of geyser.proto
+// name it in the printed schema, as the registry resolves them.
+func TestProtoSchema(t *testing.T) {
+	pkg, messages := parseSchemaMessages(protoSchema(proto.File_geyser_proto))
+	schema := &registrySchema{schemaType: "PROTOBUF", pkg: pkg, messages: messages}
+	r := &SchemaRegistry{schemas: map[int32]*registrySchema{1: schema}}
+
+	var check func(protoreflect.MessageDescriptors)
+	check = func(descriptors protoreflect.MessageDescriptors) {
+		for i := 0; i < descriptors.Len(); i++ {
+			message := descriptors.Get(i)
+			if message.IsMapEntry() {
+				continue
+			}
+			name, err := r.messageName(1, MessageIndexes(message))
+			if err != nil || name != string(message.FullName()) {
+				t.Errorf("%v names %s, %v, want %s", MessageIndexes(message), name, err, message.FullName())
+			}
+			check(message.Messages())
+		}
+	}
+	check(proto.File_geyser_proto.Messages())
+
+	source := protoSchema(proto.File_geyser_proto)
+	for _, line := range []string{
+		`import public "solana-storage.proto";`,
+		"  map<string, .geyser.SubscribeRequestFilterAccounts> accounts = 1;",
+		"  optional .geyser.CommitmentLevel commitment = 6;",
+	} {
+		if !strings.Contains(source, line+"\n") {
+			t.Errorf("schema without %s", line)
+		}
+	}
+}
+
+// schemaRegistryServer serves geyser.proto as schema 7 and records the
+// registered schemas by subject.
+type schemaRegistryServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	lookups    int
+	registered map[string][]string
+}
+
+func newSchemaRegistryServer(t *testing.T) *schemaRegistryServer {
+	s := &schemaRegistryServer{registered: make(map[string][]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error_code":401,"message":"Unauthorized"}`))
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/7":
+			s.lookups++
+			json.NewEncoder(w).Encode(map[string]string{"schemaType": "PROTOBUF", "schema": protoSchema(proto.File_geyser_proto)})
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/8":
+			json.NewEncoder(w).Encode(map[string]string{"schema": `{"type":"record","name":"Update","fields":[]}`})
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/versions"):
+			var request struct {
+				References []schemaReference `json:"references"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+			for _, reference := range request.References {
+				subject += " " + reference.Subject
+			}
+			s.registered[subject] = append(s.registered[subject], r.URL.Path)
+			w.Write([]byte(`{"id":7}`))
+		case r.Method == http.MethodPost:
+			w.Write([]byte(`{"subject":"x","id":7,"version":3}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDecodeWireFormat(t *testing.T) {
+	server := newSchemaRegistryServer(t)
+	info := &proto.SubscribeUpdateTransactionInfo{Signature: testkey.Key(1)}
+	value, err := gproto.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := func(id int32, message protoreflect.MessageDescriptor) []byte {
+		return append(AppendWireFormat(nil, id, MessageIndexes(message)), value...)
+	}
+
+	d, err := NewDecoder(Config{Kind: "transaction"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range [][]byte{value, framed(7, info.ProtoReflect().Descriptor())} {
+		if msg, err := d.Decode(&sarama.ConsumerMessage{Key: []byte("42_ff"), Value: payload}); err != nil || msg.Slot != 42 {
+			t.Fatalf("decoded %v, %v", msg, err)
+		}
+	}
+	d, _ = NewDecoder(Config{Kind: "transaction", WireFormat: WireFormatConfluent})
+	if _, err := d.Decode(&sarama.ConsumerMessage{Value: value}); err == nil {
+		t.Fatal("decoded a payload without the header")
+	}
+
+	d, err = NewDecoder(Config{Kind: "transaction", SchemaRegistry: SchemaRegistryConfig{
+		URL: server.URL, Username: "user", Password: "secret", Timeout: duration.Duration(1e9),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := d.Decode(&sarama.ConsumerMessage{Value: framed(7, info.ProtoReflect().Descriptor())}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.lookups != 1 {
+		t.Fatalf("looked schema 7 up %d times, want once", server.lookups)
+	}
+	for payload, want := range map[string]string{
+		string(framed(7, (&proto.SubscribeUpdateSlot{}).ProtoReflect().Descriptor())): "schema 7 is geyser.SubscribeUpdateSlot, expected geyser.SubscribeUpdateTransactionInfo",
+		string(framed(8, info.ProtoReflect().Descriptor())):                           "schema 8 is not a protobuf schema",
+		string(framed(9, info.ProtoReflect().Descriptor())):                           "Schema not found",
+	} {
+		if _, err := d.Decode(&sarama.ConsumerMessage{Value: []byte(payload)}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	}
+}
+
+func TestRegisterGeyser(t *testing.T) {
+	server := newSchemaRegistryServer(t)
+	r := NewSchemaRegistry(SchemaRegistryConfig{URL: server.URL + "/", Username: "user", Password: "secret", Timeout: duration.Duration(1e9)})
+	id, err := r.RegisterGeyser(context.Background(), "grpc1-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"solana-storage.proto":             {"/subjects/solana-storage.proto/versions"},
+		"grpc1-value solana-storage.proto": {"/subjects/grpc1-value/versions"},
+	}
+	if id != 7 || !reflect.DeepEqual(server.registered, want) {
+		t.Fatalf("registered %v as %d", server.registered, id)
+	}
+
+	r.password = "wrong"
+	if _, err := r.RegisterGeyser(context.Background(), "grpc1-value"); err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Fatalf("got %v, want unauthorized", err)
+	}
+}
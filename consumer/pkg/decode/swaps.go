@@ -0,0 +1,293 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// Program IDs of the DEXes whose swaps are decoded.
+const (
+	RaydiumAMMProgramID  = "675kPX9MHTjS2zt1qfr1NYHuzeLXfQM9H24wFSUt1Mp8"
+	RaydiumCLMMProgramID = "CAMMCzo5YL8w4VFF8KVHrK22GGUsp5VTaW7grrKgrWqK"
+	RaydiumCPMMProgramID = "CPMMoo8L3F4NbTegBCKVNunggL7H1ZpdTHKxQB5qKP1C"
+	WhirlpoolProgramID   = "whirLbMiicVdio4qvUfM5KAg6Ct8VwpYzGff3uctyCc"
+	PhoenixProgramID     = "PhoeNiXZ8ByJGLkxNfZRnkUfjvmuYqLR89jjFHGqdXY"
+	JupiterProgramID     = "JUP6LkbZbjS1jKKwapdHNy74zcZ3tLUZoi5QNyVTaV4"
+)
+
+// quoteMints are the mints quoting a pair, preferred in order: USDC, USDT
+// and wrapped SOL.
+var quoteMints = []string{
+	"EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v",
+	"Es9vMFrzaCERmJfrF4H2FYD4KCoNkY11McCe8BenwNYB",
+	"So11111111111111111111111111111111111111112",
+}
+
+// dexProgram names a DEX and gives, by the prefix of the data of its swap
+// instructions, the position of the pool among their accounts.
+type dexProgram struct {
+	name  string
+	swaps map[string]int
+}
+
+var dexPrograms = map[string]dexProgram{
+	RaydiumAMMProgramID: {name: "raydium_amm", swaps: map[string]int{
+		// swapBaseIn and swapBaseOut
+		"\x09": 1, "\x0b": 1,
+	}},
+	RaydiumCLMMProgramID: {name: "raydium_clmm", swaps: map[string]int{
+		string(idlDiscriminator(nil, "global:swap")): 2, string(idlDiscriminator(nil, "global:swap_v2")): 2,
+	}},
+	RaydiumCPMMProgramID: {name: "raydium_cpmm", swaps: map[string]int{
+		string(idlDiscriminator(nil, "global:swap_base_input")): 3, string(idlDiscriminator(nil, "global:swap_base_output")): 3,
+	}},
+	WhirlpoolProgramID: {name: "orca_whirlpool", swaps: map[string]int{
+		string(idlDiscriminator(nil, "global:swap")): 2, string(idlDiscriminator(nil, "global:swap_v2")): 4,
+	}},
+	PhoenixProgramID: {name: "phoenix", swaps: map[string]int{
+		// swap and swapWithFreeFunds
+		"\x00": 2, "\x01": 2,
+	}},
+}
+
+// jupiterSwapEvent starts the data of the SwapEvent CPIs of Jupiter, one per
+// hop of a route: the amm, the input mint and amount and the output mint and
+// amount follow.
+var jupiterSwapEvent = append(slices.Clone(anchorEventTag), idlDiscriminator(nil, "event:SwapEvent")...)
+
+const jupiterSwapEventSize = 16 + 32 + 32 + 8 + 32 + 8
+
+// Swap is a trade against a pool, normalized across DEXes. Instruction is
+// the index of the outer instruction, InnerInstruction the position of the
+// swap, or of the Jupiter event reporting it, within its inner
+// instructions. Signer authorized the input, it is the fee payer for the
+// hops of Jupiter. Amounts are in base units. The pair is quoted in USDC,
+// USDT or SOL when it has one of them, and Direction is buy when the base
+// mint is the output.
+type Swap struct {
+	Dex              string `json:"dex"`
+	Aggregator       string `json:"aggregator,omitempty"`
+	Instruction      int    `json:"instruction"`
+	InnerInstruction *int   `json:"inner_instruction,omitempty"`
+	Pool             string `json:"pool,omitempty"`
+	Signer           string `json:"signer"`
+	InputMint        string `json:"input_mint"`
+	InputAmount      uint64 `json:"input_amount"`
+	OutputMint       string `json:"output_mint"`
+	OutputAmount     uint64 `json:"output_amount"`
+	BaseMint         string `json:"base_mint"`
+	QuoteMint        string `json:"quote_mint"`
+	BaseAmount       uint64 `json:"base_amount"`
+	QuoteAmount      uint64 `json:"quote_amount"`
+	Direction        string `json:"direction"`
+}
+
+// normalize sets the pair and the direction of s from its input and output.
+func (s *Swap) normalize() {
+	rank := func(mint string) int {
+		if i := slices.Index(quoteMints, mint); i >= 0 {
+			return len(quoteMints) - i
+		}
+		return 0
+	}
+	input, output := rank(s.InputMint), rank(s.OutputMint)
+	if input > output || input == output && s.InputMint > s.OutputMint {
+		s.BaseMint, s.BaseAmount, s.QuoteMint, s.QuoteAmount = s.OutputMint, s.OutputAmount, s.InputMint, s.InputAmount
+		s.Direction = "buy"
+		return
+	}
+	s.BaseMint, s.BaseAmount, s.QuoteMint, s.QuoteAmount = s.InputMint, s.InputAmount, s.OutputMint, s.OutputAmount
+	s.Direction = "sell"
+}
+
+// invocation is an instruction of a transaction with its stack height,
+// inner is nil for the outer instruction.
+type invocation struct {
+	inner    *int
+	program  string
+	accounts []byte
+	data     []byte
+	height   uint32
+}
+
+// DecodeSwaps decodes the swaps of a transaction in execution order: the
+// swap instructions of the known DEXes, from the token transfers they make,
+// and the hops of Jupiter routes, from the events Jupiter emits. The DEX
+// instructions of a Jupiter route are left to its events.
+func DecodeSwaps(info *proto.SubscribeUpdateTransactionInfo) []Swap {
+	keys := TransactionAccounts(info)
+	message := info.GetTransaction().GetMessage()
+	signers := make(map[string]bool)
+	for _, key := range keys[:min(int(message.GetHeader().GetNumRequiredSignatures()), len(keys))] {
+		signers[base58.Encode(key)] = true
+	}
+	// the token transfers by outer instruction and inner position, -1 for
+	// the outer instruction itself
+	transfers := make(map[[2]int]TokenInstruction)
+	for _, transfer := range DecodeTokenInstructions(info) {
+		if transfer.Type == "transfer" || transfer.Type == "transferChecked" {
+			inner := -1
+			if transfer.InnerInstruction != nil {
+				inner = *transfer.InnerInstruction
+			}
+			transfers[[2]int{transfer.Instruction, inner}] = transfer
+		}
+	}
+	innerInstructions := make(map[uint32][]*proto.InnerInstruction)
+	for _, list := range info.GetMeta().GetInnerInstructions() {
+		innerInstructions[list.GetIndex()] = list.GetInstructions()
+	}
+	var payer string
+	if len(keys) > 0 {
+		payer = base58.Encode(keys[0])
+	}
+	program := func(index uint32) string {
+		if int(index) >= len(keys) {
+			return ""
+		}
+		return base58.Encode(keys[index])
+	}
+
+	var out []Swap
+	for i, ix := range message.GetInstructions() {
+		invocations := []invocation{{program: program(ix.GetProgramIdIndex()), accounts: ix.GetAccounts(), data: ix.GetData(), height: 1}}
+		for j, cpi := range innerInstructions[uint32(i)] {
+			// unknown before Solana 1.14.6, every CPI is taken as a direct one
+			height := cpi.GetStackHeight()
+			if cpi.StackHeight == nil {
+				height = 2
+			}
+			invocations = append(invocations, invocation{inner: &j, program: program(cpi.GetProgramIdIndex()),
+				accounts: cpi.GetAccounts(), data: cpi.GetData(), height: height})
+		}
+		for n, call := range invocations {
+			var swap Swap
+			var ok bool
+			if call.program == JupiterProgramID {
+				swap, ok = jupiterSwap(invocations, n)
+				swap.Signer = payer
+			} else if dex, known := dexPrograms[call.program]; known && !underJupiter(invocations, n) {
+				swap, ok = dexSwap(dex, keys, signers, invocations, n, func(inner *int) (TokenInstruction, bool) {
+					position := -1
+					if inner != nil {
+						position = *inner
+					}
+					transfer, ok := transfers[[2]int{i, position}]
+					return transfer, ok
+				})
+			}
+			if !ok {
+				continue
+			}
+			swap.Instruction, swap.InnerInstruction = i, call.inner
+			swap.normalize()
+			out = append(out, swap)
+		}
+	}
+	return out
+}
+
+// parent returns the position of the invocation calling the one at n, -1
+// for the outer instruction.
+func parent(invocations []invocation, n int) int {
+	for p := n - 1; p >= 0; p-- {
+		if invocations[p].height < invocations[n].height {
+			return p
+		}
+	}
+	return -1
+}
+
+func underJupiter(invocations []invocation, n int) bool {
+	for p := parent(invocations, n); p >= 0; p = parent(invocations, p) {
+		if invocations[p].program == JupiterProgramID {
+			return true
+		}
+	}
+	return false
+}
+
+// dexSwap decodes the swap instruction at n from the token transfers it
+// makes directly: the input is the first one a signer authorized and the
+// output the first other one of another mint. Instructions without both are
+// not swaps.
+func dexSwap(dex dexProgram, keys [][]byte, signers map[string]bool, invocations []invocation, n int,
+	transfer func(inner *int) (TokenInstruction, bool)) (Swap, bool) {
+	call := invocations[n]
+	pool := -1
+	for prefix, position := range dex.swaps {
+		if bytes.HasPrefix(call.data, []byte(prefix)) {
+			pool = position
+			break
+		}
+	}
+	if pool < 0 {
+		return Swap{}, false
+	}
+	var input, output *TokenInstruction
+	for _, child := range invocations[n+1:] {
+		if child.height <= call.height {
+			break
+		}
+		if child.height != call.height+1 {
+			continue
+		}
+		t, ok := transfer(child.inner)
+		switch {
+		case !ok || t.Mint == "":
+		case input == nil && signers[t.Authority]:
+			input = &t
+		case output == nil && !signers[t.Authority] && (input == nil || input.Mint != t.Mint):
+			output = &t
+		}
+	}
+	if input == nil || output == nil || input.Mint == output.Mint {
+		return Swap{}, false
+	}
+	swap := Swap{
+		Dex:          dex.name,
+		Signer:       input.Authority,
+		InputMint:    input.Mint,
+		InputAmount:  input.Amount,
+		OutputMint:   output.Mint,
+		OutputAmount: output.Amount,
+	}
+	if pool < len(call.accounts) && int(call.accounts[pool]) < len(keys) {
+		swap.Pool = base58.Encode(keys[call.accounts[pool]])
+	}
+	return swap, true
+}
+
+// jupiterSwap decodes the SwapEvent at n, the DEX being the program of the
+// last instruction Jupiter called before emitting it.
+func jupiterSwap(invocations []invocation, n int) (Swap, bool) {
+	data := invocations[n].data
+	if invocations[n].inner == nil || len(data) < jupiterSwapEventSize || !bytes.HasPrefix(data, jupiterSwapEvent) {
+		return Swap{}, false
+	}
+	swap := Swap{
+		Aggregator:   "jupiter",
+		Pool:         base58.Encode(data[16:48]),
+		InputMint:    base58.Encode(data[48:80]),
+		InputAmount:  binary.LittleEndian.Uint64(data[80:88]),
+		OutputMint:   base58.Encode(data[88:120]),
+		OutputAmount: binary.LittleEndian.Uint64(data[120:128]),
+	}
+	for p := n - 1; p >= 0; p-- {
+		if call := invocations[p]; call.height == invocations[n].height && call.program != JupiterProgramID {
+			swap.Dex = call.program
+			if dex, ok := dexPrograms[call.program]; ok {
+				swap.Dex = dex.name
+			}
+			break
+		} else if call.height < invocations[n].height {
+			break
+		}
+	}
+	return swap, true
+}
@@ -0,0 +1,122 @@
+package decode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// swapTransaction has the signer at 0, its token accounts of mint testkey.Key(20)
+// and of wrapped SOL at 1 and 2, the vaults of the pool at 3 and 4, the pool
+// at 5, its authority at 6 and the token, Raydium AMM and Jupiter programs at
+// 7, 8 and 9. Instruction 0 swaps on Raydium, instruction 1 through Jupiter.
+func swapTransaction() *proto.SubscribeUpdateTransactionInfo {
+	var keys [][]byte
+	for i := range byte(7) {
+		keys = append(keys, testkey.Key(i+1))
+	}
+	for _, program := range []string{TokenProgramID, RaydiumAMMProgramID, JupiterProgramID} {
+		key, _ := base58.Decode(program)
+		keys = append(keys, key)
+	}
+	sol := quoteMints[2]
+	balance := func(index uint32, mint string) *proto.TokenBalance {
+		return &proto.TokenBalance{AccountIndex: index, Mint: mint, UiTokenAmount: &proto.UiTokenAmount{Decimals: 6}}
+	}
+	height := func(h uint32) *uint32 { return &h }
+	transfers := func(h uint32, in, out uint64) []*proto.InnerInstruction {
+		return []*proto.InnerInstruction{
+			{ProgramIdIndex: 7, Accounts: []byte{1, 3, 0}, Data: tokenData(3, in), StackHeight: height(h)},
+			{ProgramIdIndex: 7, Accounts: []byte{4, 2, 6}, Data: tokenData(3, out), StackHeight: height(h)},
+		}
+	}
+	mint, _ := base58.Decode(testkey.String(20))
+	solMint, _ := base58.Decode(sol)
+	event := append(slices.Clone(jupiterSwapEvent), testkey.Key(6)...)
+	event = append(event, mint...)
+	event = binary.LittleEndian.AppendUint64(event, 300)
+	event = append(event, solMint...)
+	event = binary.LittleEndian.AppendUint64(event, 15)
+
+	route := []*proto.InnerInstruction{{ProgramIdIndex: 8, Accounts: []byte{7, 5}, Data: []byte{9}, StackHeight: height(2)}}
+	route = append(route, transfers(3, 300, 15)...)
+	route = append(route, &proto.InnerInstruction{ProgramIdIndex: 9, Data: event, StackHeight: height(2)})
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature: testkey.Key(0xff),
+		Transaction: &proto.Transaction{Message: &proto.Message{
+			Header:      &proto.MessageHeader{NumRequiredSignatures: 1},
+			AccountKeys: keys,
+			Instructions: []*proto.CompiledInstruction{
+				{ProgramIdIndex: 8, Accounts: []byte{7, 5, 6, 3, 4}, Data: []byte{9}},
+				{ProgramIdIndex: 9, Accounts: []byte{0}},
+				// a deposit, both transfers go to the pool
+				{ProgramIdIndex: 8, Accounts: []byte{7, 5}, Data: []byte{3}},
+			},
+		}},
+		Meta: &proto.TransactionStatusMeta{
+			InnerInstructions: []*proto.InnerInstructions{
+				{Index: 0, Instructions: transfers(2, 100, 5)},
+				{Index: 1, Instructions: route},
+				{Index: 2, Instructions: []*proto.InnerInstruction{
+					{ProgramIdIndex: 7, Accounts: []byte{1, 3, 0}, Data: tokenData(3, 1), StackHeight: height(2)},
+					{ProgramIdIndex: 7, Accounts: []byte{2, 4, 0}, Data: tokenData(3, 1), StackHeight: height(2)},
+				}},
+			},
+			PreTokenBalances: []*proto.TokenBalance{balance(1, testkey.String(20)), balance(2, sol), balance(3, testkey.String(20)), balance(4, sol)},
+		},
+	}
+}
+
+func TestDecodeSwaps(t *testing.T) {
+	three := 3
+	sol := quoteMints[2]
+	want := []Swap{
+		{Dex: "raydium_amm", Instruction: 0, Pool: testkey.String(6), Signer: testkey.String(1),
+			InputMint: testkey.String(20), InputAmount: 100, OutputMint: sol, OutputAmount: 5,
+			BaseMint: testkey.String(20), BaseAmount: 100, QuoteMint: sol, QuoteAmount: 5, Direction: "sell"},
+		{Dex: "raydium_amm", Aggregator: "jupiter", Instruction: 1, InnerInstruction: &three, Pool: testkey.String(6),
+			Signer: testkey.String(1), InputMint: testkey.String(20), InputAmount: 300, OutputMint: sol, OutputAmount: 15,
+			BaseMint: testkey.String(20), BaseAmount: 300, QuoteMint: sol, QuoteAmount: 15, Direction: "sell"},
+	}
+	if got := DecodeSwaps(swapTransaction()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSwapNormalize(t *testing.T) {
+	usdc := quoteMints[0]
+	swap := Swap{InputMint: usdc, InputAmount: 10, OutputMint: quoteMints[2], OutputAmount: 1}
+	swap.normalize()
+	if swap.BaseMint != quoteMints[2] || swap.QuoteMint != usdc || swap.QuoteAmount != 10 || swap.Direction != "buy" {
+		t.Fatalf("got %+v", swap)
+	}
+}
+
+func TestFormatJSONSwaps(t *testing.T) {
+	out, err := FormatJSON(&proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{
+		Transaction: &proto.SubscribeUpdateTransaction{Slot: 10, Transaction: swapTransaction()},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update struct {
+		Transaction struct {
+			Transaction struct {
+				Swaps []map[string]any `json:"swaps"`
+			} `json:"transaction"`
+		} `json:"transaction"`
+	}
+	if err := json.Unmarshal(out, &update); err != nil {
+		t.Fatal(err)
+	}
+	if swaps := update.Transaction.Transaction.Swaps; len(swaps) != 2 || swaps[1]["aggregator"] != "jupiter" {
+		t.Fatalf("swaps %v in %s", swaps, out)
+	}
+}
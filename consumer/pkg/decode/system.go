@@ -0,0 +1,130 @@
+package decode
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// Program IDs of the System, Compute Budget and Vote programs.
+const (
+	SystemProgramID        = "11111111111111111111111111111111"
+	ComputeBudgetProgramID = "ComputeBudget111111111111111111111111111111"
+	VoteProgramID          = "Vote111111111111111111111111111111111111111"
+)
+
+// System program instructions are identified by a little endian u32.
+const (
+	systemCreateAccount uint32 = 0
+	SystemTransfer      uint32 = 2
+)
+
+// Compute Budget instructions are identified by their first byte.
+const (
+	computeBudgetSetUnitLimit byte = 2
+	ComputeBudgetSetUnitPrice byte = 3
+)
+
+// SystemInstruction is a decoded SOL transfer or account creation of the
+// System program, numbered like TokenInstruction. A createAccount moves
+// Lamports from Source to the new account at Destination.
+type SystemInstruction struct {
+	Type             string `json:"type"`
+	Instruction      int    `json:"instruction"`
+	InnerInstruction *int   `json:"inner_instruction,omitempty"`
+	Source           string `json:"source"`
+	Destination      string `json:"destination"`
+	Lamports         uint64 `json:"lamports"`
+	Space            uint64 `json:"space,omitempty"`
+	Owner            string `json:"owner,omitempty"`
+}
+
+// ComputeBudget holds what a transaction asked of the Compute Budget
+// program. PriorityFee is the prioritization fee in lamports, the unit price
+// in micro-lamports times the unit limit rounded up, and only set when both
+// are given since the default limit depends on the runtime version.
+type ComputeBudget struct {
+	UnitLimit   *uint32 `json:"unit_limit,omitempty"`
+	UnitPrice   *uint64 `json:"unit_price,omitempty"`
+	PriorityFee *uint64 `json:"priority_fee,omitempty"`
+}
+
+// DecodeSystemInstructions decodes the transfers and account creations of a
+// transaction in execution order.
+func DecodeSystemInstructions(info *proto.SubscribeUpdateTransactionInfo) []SystemInstruction {
+	keys := TransactionAccounts(info)
+	var out []SystemInstruction
+	eachInstruction(info, func(outer int, inner *int, programIndex uint32, accounts, data []byte) {
+		if int(programIndex) >= len(keys) || base58.Encode(keys[programIndex]) != SystemProgramID {
+			return
+		}
+		if len(data) < 12 || len(accounts) < 2 || int(accounts[0]) >= len(keys) || int(accounts[1]) >= len(keys) {
+			return
+		}
+		decoded := SystemInstruction{
+			Instruction:      outer,
+			InnerInstruction: inner,
+			Source:           base58.Encode(keys[accounts[0]]),
+			Destination:      base58.Encode(keys[accounts[1]]),
+			Lamports:         binary.LittleEndian.Uint64(data[4:12]),
+		}
+		switch binary.LittleEndian.Uint32(data) {
+		case SystemTransfer:
+			decoded.Type = "transfer"
+		case systemCreateAccount:
+			// lamports, space and the owner program
+			if len(data) < 52 {
+				return
+			}
+			decoded.Type = "createAccount"
+			decoded.Space = binary.LittleEndian.Uint64(data[12:20])
+			decoded.Owner = base58.Encode(data[20:52])
+		default:
+			return
+		}
+		out = append(out, decoded)
+	})
+	return out
+}
+
+// DecodeComputeBudget reads the compute unit limit and price set by the outer
+// instructions of a transaction, it reports false when neither is set.
+func DecodeComputeBudget(info *proto.SubscribeUpdateTransactionInfo) (ComputeBudget, bool) {
+	keys := TransactionAccounts(info)
+	var budget ComputeBudget
+	for _, ix := range info.GetTransaction().GetMessage().GetInstructions() {
+		if int(ix.GetProgramIdIndex()) >= len(keys) || base58.Encode(keys[ix.GetProgramIdIndex()]) != ComputeBudgetProgramID {
+			continue
+		}
+		data := ix.GetData()
+		switch {
+		case len(data) >= 5 && data[0] == computeBudgetSetUnitLimit:
+			limit := binary.LittleEndian.Uint32(data[1:5])
+			budget.UnitLimit = &limit
+		case len(data) >= 9 && data[0] == ComputeBudgetSetUnitPrice:
+			price := binary.LittleEndian.Uint64(data[1:9])
+			budget.UnitPrice = &price
+		}
+	}
+	if budget.UnitLimit == nil && budget.UnitPrice == nil {
+		return budget, false
+	}
+	if budget.UnitLimit != nil && budget.UnitPrice != nil {
+		// multiplied in 128 bits, a fee beyond u64 saturates
+		fee := uint64(math.MaxUint64)
+		hi, lo := bits.Mul64(*budget.UnitPrice, uint64(*budget.UnitLimit))
+		if hi < 1_000_000 {
+			quotient, remainder := bits.Div64(hi, lo, 1_000_000)
+			fee = quotient
+			if remainder > 0 {
+				fee++
+			}
+		}
+		budget.PriorityFee = &fee
+	}
+	return budget, true
+}
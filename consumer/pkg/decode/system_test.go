@@ -0,0 +1,130 @@
+package decode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// programTransaction calls programs with the accounts testkey.Key(1) to
+// testkey.Key(3), the programs follow them as accounts 3 and up.
+func programTransaction(programs []string, outer []*proto.CompiledInstruction, inner []*proto.InnerInstructions) *proto.SubscribeUpdateTransactionInfo {
+	keys := [][]byte{testkey.Key(1), testkey.Key(2), testkey.Key(3)}
+	for _, program := range programs {
+		key, _ := base58.Decode(program)
+		keys = append(keys, key)
+	}
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature:   testkey.Key(0xff),
+		Transaction: &proto.Transaction{Message: &proto.Message{AccountKeys: keys, Instructions: outer}},
+		Meta:        &proto.TransactionStatusMeta{InnerInstructions: inner},
+	}
+}
+
+func systemData(instruction uint32, fields ...[]byte) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, instruction)
+	for _, field := range fields {
+		data = append(data, field...)
+	}
+	return data
+}
+
+func le64(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func TestDecodeSystemInstructions(t *testing.T) {
+	info := programTransaction([]string{SystemProgramID, TokenProgramID},
+		[]*proto.CompiledInstruction{
+			{ProgramIdIndex: 3, Accounts: []byte{0, 1}, Data: systemData(SystemTransfer, le64(5000))},
+			// the token program
+			{ProgramIdIndex: 4, Accounts: []byte{0, 1}, Data: systemData(SystemTransfer, le64(5000))},
+			// an assign, not decoded
+			{ProgramIdIndex: 3, Accounts: []byte{0, 1}, Data: systemData(1, testkey.Key(9))},
+		},
+		[]*proto.InnerInstructions{{Index: 1, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 3, Accounts: []byte{1, 2}, Data: systemData(systemCreateAccount, le64(2_039_280), le64(165), testkey.Key(9))},
+			// truncated
+			{ProgramIdIndex: 3, Accounts: []byte{1, 2}, Data: systemData(systemCreateAccount, le64(1))},
+		}}},
+	)
+
+	want := []SystemInstruction{
+		{Type: "transfer", Instruction: 0, Source: testkey.String(1), Destination: testkey.String(2), Lamports: 5000},
+		{
+			Type: "createAccount", Instruction: 1, InnerInstruction: ptr(0),
+			Source: testkey.String(2), Destination: testkey.String(3), Lamports: 2_039_280, Space: 165, Owner: testkey.String(9),
+		},
+	}
+	if got := DecodeSystemInstructions(info); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestDecodeComputeBudget(t *testing.T) {
+	limit := func(units uint32) *proto.CompiledInstruction {
+		return &proto.CompiledInstruction{ProgramIdIndex: 3, Data: binary.LittleEndian.AppendUint32([]byte{computeBudgetSetUnitLimit}, units)}
+	}
+	price := func(microLamports uint64) *proto.CompiledInstruction {
+		return &proto.CompiledInstruction{ProgramIdIndex: 3, Data: append([]byte{ComputeBudgetSetUnitPrice}, le64(microLamports)...)}
+	}
+	for _, tt := range []struct {
+		name         string
+		instructions []*proto.CompiledInstruction
+		want         ComputeBudget
+		ok           bool
+	}{
+		{"none", nil, ComputeBudget{}, false},
+		{"limit", []*proto.CompiledInstruction{limit(300_000)}, ComputeBudget{UnitLimit: ptr(uint32(300_000))}, true},
+		{"price", []*proto.CompiledInstruction{price(10)}, ComputeBudget{UnitPrice: ptr(uint64(10))}, true},
+		{
+			"rounded up", []*proto.CompiledInstruction{price(1_500), limit(200_001)},
+			ComputeBudget{UnitLimit: ptr(uint32(200_001)), UnitPrice: ptr(uint64(1_500)), PriorityFee: ptr(uint64(301))}, true,
+		},
+		{
+			"saturated", []*proto.CompiledInstruction{price(math.MaxUint64), limit(1_400_000)},
+			ComputeBudget{UnitLimit: ptr(uint32(1_400_000)), UnitPrice: ptr(uint64(math.MaxUint64)), PriorityFee: ptr(uint64(math.MaxUint64))}, true,
+		},
+	} {
+		got, ok := DecodeComputeBudget(programTransaction([]string{ComputeBudgetProgramID}, tt.instructions, nil))
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v %v, want %+v %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatJSONSystemInstructions(t *testing.T) {
+	info := programTransaction([]string{SystemProgramID, ComputeBudgetProgramID}, []*proto.CompiledInstruction{
+		{ProgramIdIndex: 4, Data: append([]byte{ComputeBudgetSetUnitPrice}, le64(1)...)},
+		{ProgramIdIndex: 3, Accounts: []byte{0, 1}, Data: systemData(SystemTransfer, le64(5000))},
+	}, nil)
+	out, err := FormatJSON(&proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{
+		Transaction: &proto.SubscribeUpdateTransaction{Slot: 10, Transaction: info},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update struct {
+		Transaction struct {
+			Transaction struct {
+				SystemInstructions []SystemInstruction `json:"system_instructions"`
+				ComputeBudget      ComputeBudget       `json:"compute_budget"`
+			} `json:"transaction"`
+		} `json:"transaction"`
+	}
+	if err := json.Unmarshal(out, &update); err != nil {
+		t.Fatal(err)
+	}
+	decoded := update.Transaction.Transaction
+	if len(decoded.SystemInstructions) != 1 || decoded.SystemInstructions[0].Lamports != 5000 ||
+		decoded.ComputeBudget.UnitPrice == nil || *decoded.ComputeBudget.UnitPrice != 1 {
+		t.Fatalf("decoded %s", out)
+	}
+}
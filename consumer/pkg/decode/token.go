@@ -0,0 +1,280 @@
+package decode
+
+import (
+	"encoding/binary"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// Program IDs of the SPL Token program and Token-2022, which shares its
+// instruction layout.
+const (
+	TokenProgramID     = "TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA"
+	Token2022ProgramID = "TokenzQdBNbLqP5VEhdkAS6EPFLC1PazVyFS9HNGbCZ"
+)
+
+// tokenPrograms names the token programs like the parsed instructions of the
+// Solana RPC.
+var tokenPrograms = map[string]string{
+	TokenProgramID:     "spl-token",
+	Token2022ProgramID: "spl-token-2022",
+}
+
+// tokenInstructionLayout describes a decoded instruction: its type name, the
+// positions of its accounts, -1 when it has none, and whether the data
+// carries the decimals after the amount.
+type tokenInstructionLayout struct {
+	name                                 string
+	source, mint, destination, authority int
+	checked                              bool
+}
+
+// tokenInstructionLayouts is keyed by the first byte of the instruction data.
+var tokenInstructionLayouts = map[byte]tokenInstructionLayout{
+	3:  {name: "transfer", source: 0, mint: -1, destination: 1, authority: 2},
+	7:  {name: "mintTo", source: -1, mint: 0, destination: 1, authority: 2},
+	8:  {name: "burn", source: 0, mint: 1, destination: -1, authority: 2},
+	12: {name: "transferChecked", source: 0, mint: 1, destination: 2, authority: 3, checked: true},
+	14: {name: "mintToChecked", source: -1, mint: 0, destination: 1, authority: 2, checked: true},
+	15: {name: "burnChecked", source: 0, mint: 1, destination: -1, authority: 2, checked: true},
+}
+
+// TokenInstruction is a decoded transfer, mint or burn of a token program.
+// Instruction is the index of the outer instruction, InnerInstruction the
+// position within its inner instructions for CPIs. The mint, decimals and
+// owners are taken from the token balances of the transaction when the
+// instruction does not carry them.
+type TokenInstruction struct {
+	Program          string  `json:"program"`
+	Type             string  `json:"type"`
+	Instruction      int     `json:"instruction"`
+	InnerInstruction *int    `json:"inner_instruction,omitempty"`
+	Source           string  `json:"source,omitempty"`
+	SourceOwner      string  `json:"source_owner,omitempty"`
+	Destination      string  `json:"destination,omitempty"`
+	DestinationOwner string  `json:"destination_owner,omitempty"`
+	Mint             string  `json:"mint,omitempty"`
+	Authority        string  `json:"authority"`
+	Amount           uint64  `json:"amount"`
+	Decimals         *uint32 `json:"decimals,omitempty"`
+}
+
+// tokenAccount is what the token balances tell about a token account.
+type tokenAccount struct {
+	mint     string
+	owner    string
+	decimals uint32
+}
+
+// DecodeTokenInstructions decodes the token transfers, mints and burns of a
+// transaction in execution order, outer instructions followed by their CPIs.
+func DecodeTokenInstructions(info *proto.SubscribeUpdateTransactionInfo) []TokenInstruction {
+	keys := TransactionAccounts(info)
+	meta := info.GetMeta()
+	var accounts map[uint32]tokenAccount
+	resolve := func(index uint32) (tokenAccount, bool) {
+		if accounts == nil {
+			accounts = make(map[uint32]tokenAccount)
+			// post balances know accounts created by the transaction, pre
+			// balances those it closed
+			for _, balances := range [][]*proto.TokenBalance{meta.GetPreTokenBalances(), meta.GetPostTokenBalances()} {
+				for _, balance := range balances {
+					accounts[balance.GetAccountIndex()] = tokenAccount{
+						mint:     balance.GetMint(),
+						owner:    balance.GetOwner(),
+						decimals: balance.GetUiTokenAmount().GetDecimals(),
+					}
+				}
+			}
+		}
+		account, ok := accounts[index]
+		return account, ok
+	}
+
+	var out []TokenInstruction
+	eachInstruction(info, func(outer int, inner *int, programIndex uint32, accounts, data []byte) {
+		if decoded, ok := decodeTokenInstruction(keys, programIndex, accounts, data, resolve); ok {
+			decoded.Instruction, decoded.InnerInstruction = outer, inner
+			out = append(out, decoded)
+		}
+	})
+	return out
+}
+
+func decodeTokenInstruction(keys [][]byte, programIndex uint32, accounts, data []byte, resolve func(uint32) (tokenAccount, bool)) (TokenInstruction, bool) {
+	if int(programIndex) >= len(keys) || len(data) < 9 {
+		return TokenInstruction{}, false
+	}
+	program, ok := tokenPrograms[base58.Encode(keys[programIndex])]
+	if !ok {
+		return TokenInstruction{}, false
+	}
+	layout, ok := tokenInstructionLayouts[data[0]]
+	if !ok || (layout.checked && len(data) < 10) || len(accounts) <= layout.authority {
+		return TokenInstruction{}, false
+	}
+	for _, index := range accounts[:layout.authority+1] {
+		if int(index) >= len(keys) {
+			return TokenInstruction{}, false
+		}
+	}
+	key := func(position int) string {
+		if position < 0 {
+			return ""
+		}
+		return base58.Encode(keys[accounts[position]])
+	}
+
+	decoded := TokenInstruction{
+		Program:     program,
+		Type:        layout.name,
+		Source:      key(layout.source),
+		Destination: key(layout.destination),
+		Mint:        key(layout.mint),
+		Authority:   key(layout.authority),
+		Amount:      binary.LittleEndian.Uint64(data[1:9]),
+	}
+	if layout.checked {
+		decimals := uint32(data[9])
+		decoded.Decimals = &decimals
+	}
+	for _, position := range []int{layout.source, layout.destination} {
+		if position < 0 {
+			continue
+		}
+		account, ok := resolve(uint32(accounts[position]))
+		if !ok {
+			continue
+		}
+		if position == layout.source {
+			decoded.SourceOwner = account.owner
+		} else {
+			decoded.DestinationOwner = account.owner
+		}
+		if decoded.Mint == "" {
+			decoded.Mint = account.mint
+		}
+		if decoded.Decimals == nil {
+			decimals := account.decimals
+			decoded.Decimals = &decimals
+		}
+	}
+	return decoded, true
+}
+
+// Layout of SPL token accounts and mints. Token-2022 accounts and mints with
+// extensions are longer and store their account type right after the base
+// account layout, mints being padded to it.
+const (
+	tokenMintSize           = 82
+	TokenAccountSize        = 165
+	TokenAccountStateOffset = 108
+)
+
+// Token-2022 account types.
+const (
+	tokenAccountTypeMint    = 1
+	TokenAccountTypeAccount = 2
+)
+
+// TokenAccountState is a decoded token account. Amounts are in base units.
+type TokenAccountState struct {
+	Program         string `json:"program"`
+	Mint            string `json:"mint"`
+	Owner           string `json:"owner"`
+	Amount          uint64 `json:"amount"`
+	Delegate        string `json:"delegate,omitempty"`
+	DelegatedAmount uint64 `json:"delegated_amount,omitempty"`
+	// State is initialized or frozen.
+	State string `json:"state"`
+	// IsNative is set for wrapped SOL accounts, RentExemptReserve being the
+	// lamports not counted in Amount.
+	IsNative          bool    `json:"is_native,omitempty"`
+	RentExemptReserve *uint64 `json:"rent_exempt_reserve,omitempty"`
+	CloseAuthority    string  `json:"close_authority,omitempty"`
+}
+
+// TokenMintState is a decoded mint. Supply is in base units.
+type TokenMintState struct {
+	Program         string `json:"program"`
+	Supply          uint64 `json:"supply"`
+	Decimals        uint32 `json:"decimals"`
+	MintAuthority   string `json:"mint_authority,omitempty"`
+	FreezeAuthority string `json:"freeze_authority,omitempty"`
+}
+
+// tokenAccountType tells a token account from a mint by the length of its
+// data, and by the account type of Token-2022 accounts with extensions. It
+// returns 0 for anything else.
+func tokenAccountType(program string, data []byte) byte {
+	switch {
+	case len(data) == tokenMintSize:
+		return tokenAccountTypeMint
+	case len(data) == TokenAccountSize:
+		return TokenAccountTypeAccount
+	case program == Token2022ProgramID && len(data) > TokenAccountSize:
+		return data[TokenAccountSize]
+	}
+	return 0
+}
+
+// decodeTokenAccount decodes the token account or the mint of an account
+// owned by a token program, and returns nil for other and uninitialized
+// accounts.
+func decodeTokenAccount(info *proto.SubscribeUpdateAccountInfo) any {
+	owner := base58.Encode(info.GetOwner())
+	program, ok := tokenPrograms[owner]
+	if !ok {
+		return nil
+	}
+	data := info.GetData()
+	switch tokenAccountType(owner, data) {
+	case tokenAccountTypeMint:
+		// is_initialized
+		if data[45] == 0 {
+			return nil
+		}
+		return &TokenMintState{
+			Program:         program,
+			MintAuthority:   optionalKey(data[0:36]),
+			Supply:          binary.LittleEndian.Uint64(data[36:44]),
+			Decimals:        uint32(data[44]),
+			FreezeAuthority: optionalKey(data[46:82]),
+		}
+	case TokenAccountTypeAccount:
+		state := "initialized"
+		switch data[TokenAccountStateOffset] {
+		case 0:
+			return nil
+		case 2:
+			state = "frozen"
+		}
+		account := &TokenAccountState{
+			Program:         program,
+			Mint:            base58.Encode(data[0:32]),
+			Owner:           base58.Encode(data[32:64]),
+			Amount:          binary.LittleEndian.Uint64(data[64:72]),
+			Delegate:        optionalKey(data[72:108]),
+			State:           state,
+			DelegatedAmount: binary.LittleEndian.Uint64(data[121:129]),
+			CloseAuthority:  optionalKey(data[129:165]),
+		}
+		if binary.LittleEndian.Uint32(data[109:113]) == 1 {
+			reserve := binary.LittleEndian.Uint64(data[113:121])
+			account.IsNative, account.RentExemptReserve = true, &reserve
+		}
+		return account
+	}
+	return nil
+}
+
+// optionalKey decodes a COption<Pubkey>, a 4 byte tag followed by the key,
+// and returns "" when the tag is unset.
+func optionalKey(b []byte) string {
+	if binary.LittleEndian.Uint32(b[:4]) != 1 {
+		return ""
+	}
+	return base58.Encode(b[4:36])
+}
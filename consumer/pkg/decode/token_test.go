@@ -0,0 +1,212 @@
+package decode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+// tokenData encodes a token instruction with its amount and, when given, the
+// decimals.
+func tokenData(discriminator byte, amount uint64, decimals ...byte) []byte {
+	return append(binary.LittleEndian.AppendUint64([]byte{discriminator}, amount), decimals...)
+}
+
+// tokenTransaction has the accounts testkey.Key(1) to testkey.Key(5) followed by the
+// Token and Token-2022 programs at 5 and 6. Accounts 1 and 2 are token
+// accounts of mint testkey.Key(20), owned by testkey.Key(10) and testkey.Key(11).
+func tokenTransaction(outer []*proto.CompiledInstruction, inner []*proto.InnerInstructions) *proto.SubscribeUpdateTransactionInfo {
+	token, _ := base58.Decode(TokenProgramID)
+	token2022, _ := base58.Decode(Token2022ProgramID)
+	balance := func(index uint32, owner byte) *proto.TokenBalance {
+		return &proto.TokenBalance{
+			AccountIndex:  index,
+			Mint:          testkey.String(20),
+			Owner:         testkey.String(owner),
+			UiTokenAmount: &proto.UiTokenAmount{Decimals: 6},
+		}
+	}
+	return &proto.SubscribeUpdateTransactionInfo{
+		Signature: testkey.Key(0xff),
+		Transaction: &proto.Transaction{Message: &proto.Message{
+			AccountKeys:  [][]byte{testkey.Key(1), testkey.Key(2), testkey.Key(3), testkey.Key(4), testkey.Key(5), token, token2022},
+			Instructions: outer,
+		}},
+		Meta: &proto.TransactionStatusMeta{
+			InnerInstructions: inner,
+			// the source account is closed by the transaction
+			PreTokenBalances:  []*proto.TokenBalance{balance(1, 10), balance(2, 11)},
+			PostTokenBalances: []*proto.TokenBalance{balance(2, 11)},
+		},
+	}
+}
+
+func TestDecodeTokenInstructions(t *testing.T) {
+	six, nine, zero := uint32(6), uint32(9), 0
+	info := tokenTransaction(
+		[]*proto.CompiledInstruction{
+			{ProgramIdIndex: 5, Accounts: []byte{1, 2, 0}, Data: tokenData(3, 1000)},
+			// not a token program
+			{ProgramIdIndex: 4, Accounts: []byte{1, 2, 0}, Data: tokenData(3, 1000)},
+			{ProgramIdIndex: 5, Accounts: []byte{2, 3, 0}, Data: tokenData(8, 5)},
+		},
+		[]*proto.InnerInstructions{{Index: 1, Instructions: []*proto.InnerInstruction{
+			{ProgramIdIndex: 6, Accounts: []byte{1, 3, 2, 0}, Data: tokenData(12, 42, 9)},
+			{ProgramIdIndex: 6, Accounts: []byte{2, 3, 0}, Data: tokenData(7, 7)},
+			// an approve, not decoded
+			{ProgramIdIndex: 6, Accounts: []byte{1, 3, 0}, Data: tokenData(4, 1)},
+			// too short
+			{ProgramIdIndex: 6, Accounts: []byte{1, 2, 0}, Data: []byte{3, 1}},
+		}}},
+	)
+
+	want := []TokenInstruction{
+		{
+			Program: "spl-token", Type: "transfer", Instruction: 0,
+			Source: testkey.String(2), SourceOwner: testkey.String(10),
+			Destination: testkey.String(3), DestinationOwner: testkey.String(11),
+			Mint: testkey.String(20), Authority: testkey.String(1), Amount: 1000, Decimals: &six,
+		},
+		{
+			Program: "spl-token-2022", Type: "transferChecked", Instruction: 1, InnerInstruction: &zero,
+			Source: testkey.String(2), SourceOwner: testkey.String(10),
+			Destination: testkey.String(3), DestinationOwner: testkey.String(11),
+			Mint: testkey.String(4), Authority: testkey.String(1), Amount: 42, Decimals: &nine,
+		},
+		{
+			Program: "spl-token-2022", Type: "mintTo", Instruction: 1, InnerInstruction: ptr(1),
+			Destination: testkey.String(4), Mint: testkey.String(3), Authority: testkey.String(1), Amount: 7,
+		},
+		{
+			Program: "spl-token", Type: "burn", Instruction: 2,
+			Source: testkey.String(3), SourceOwner: testkey.String(11),
+			Mint: testkey.String(4), Authority: testkey.String(1), Amount: 5, Decimals: &six,
+		},
+	}
+	got := DecodeTokenInstructions(info)
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d instructions, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("instruction %d:\n got %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFormatJSONTokenInstructions(t *testing.T) {
+	info := tokenTransaction([]*proto.CompiledInstruction{
+		{ProgramIdIndex: 5, Accounts: []byte{1, 2, 0}, Data: tokenData(3, 1000)},
+	}, nil)
+	out, err := FormatJSON(&proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Transaction{
+		Transaction: &proto.SubscribeUpdateTransaction{Slot: 10, Transaction: info},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update struct {
+		Transaction struct {
+			Transaction struct {
+				TokenInstructions []map[string]any `json:"token_instructions"`
+			} `json:"transaction"`
+		} `json:"transaction"`
+	}
+	if err := json.Unmarshal(out, &update); err != nil {
+		t.Fatal(err)
+	}
+	instructions := update.Transaction.Transaction.TokenInstructions
+	if len(instructions) != 1 || instructions[0]["type"] != "transfer" || instructions[0]["amount"] != 1000.0 {
+		t.Fatalf("token_instructions %v in %s", instructions, out)
+	}
+
+	// transactions without token instructions are left as they are
+	out, err = FormatJSON(transactionMessage(10, testkey.Key(1)).Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update.Transaction.Transaction.TokenInstructions = nil
+	if err := json.Unmarshal(out, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Transaction.Transaction.TokenInstructions != nil {
+		t.Fatalf("token_instructions in %s", out)
+	}
+}
+
+// optionalKeyData encodes a COption<Pubkey> of key, unset when nil.
+func optionalKeyData(key []byte) []byte {
+	if key == nil {
+		return make([]byte, 36)
+	}
+	return append([]byte{1, 0, 0, 0}, key...)
+}
+
+func TestDecodeTokenAccount(t *testing.T) {
+	token, _ := base58.Decode(TokenProgramID)
+	token2022, _ := base58.Decode(Token2022ProgramID)
+
+	mint := optionalKeyData(testkey.Key(1))
+	mint = binary.LittleEndian.AppendUint64(mint, 1_000_000)
+	mint = append(mint, 6, 1)
+	mint = append(mint, optionalKeyData(nil)...)
+
+	account := append(testkey.Key(20), testkey.Key(10)...)
+	account = binary.LittleEndian.AppendUint64(account, 42)
+	account = append(account, optionalKeyData(testkey.Key(11))...)
+	account = append(account, 2)
+	account = append(account, 1, 0, 0, 0)
+	account = binary.LittleEndian.AppendUint64(account, 2039280)
+	account = binary.LittleEndian.AppendUint64(account, 7)
+	account = append(account, optionalKeyData(nil)...)
+	// a Token-2022 account with an extension
+	extended := append(append(append([]byte{}, account...), TokenAccountTypeAccount), make([]byte, 8)...)
+
+	reserve := uint64(2039280)
+	for _, test := range []struct {
+		name  string
+		owner []byte
+		data  []byte
+		want  any
+	}{
+		{"mint", token, mint, &TokenMintState{Program: "spl-token", Supply: 1_000_000, Decimals: 6, MintAuthority: testkey.String(1)}},
+		{"account", token, account, &TokenAccountState{Program: "spl-token", Mint: testkey.String(20), Owner: testkey.String(10),
+			Amount: 42, Delegate: testkey.String(11), DelegatedAmount: 7, State: "frozen", IsNative: true, RentExemptReserve: &reserve}},
+		{"token-2022 extensions", token2022, extended, &TokenAccountState{Program: "spl-token-2022", Mint: testkey.String(20),
+			Owner: testkey.String(10), Amount: 42, Delegate: testkey.String(11), DelegatedAmount: 7, State: "frozen", IsNative: true,
+			RentExemptReserve: &reserve}},
+		{"extensions of spl-token", token, extended, nil},
+		{"uninitialized", token, make([]byte, TokenAccountSize), nil},
+		{"other program", testkey.Key(1), account, nil},
+	} {
+		got := decodeTokenAccount(&proto.SubscribeUpdateAccountInfo{Owner: test.owner, Data: test.data})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	msg := accountMessage(10, testkey.Key(2), token)
+	msg.Update.GetAccount().GetAccount().Data = mint
+	out, err := FormatJSON(msg.Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update struct {
+		Account struct {
+			Account struct {
+				TokenMint map[string]any `json:"token_mint"`
+			} `json:"account"`
+		} `json:"account"`
+	}
+	if err := json.Unmarshal(out, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Account.Account.TokenMint["supply"] != 1_000_000.0 {
+		t.Fatalf("token_mint missing from %s", out)
+	}
+}
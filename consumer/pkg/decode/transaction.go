@@ -0,0 +1,147 @@
+package decode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/proto"
+)
+
+// TransactionAccounts lists the static account keys of a transaction followed
+// by the addresses loaded from lookup tables, in the order instructions index them.
+func TransactionAccounts(info *proto.SubscribeUpdateTransactionInfo) [][]byte {
+	message := info.GetTransaction().GetMessage()
+	meta := info.GetMeta()
+
+	keys := make([][]byte, 0, len(message.GetAccountKeys())+
+		len(meta.GetLoadedWritableAddresses())+len(meta.GetLoadedReadonlyAddresses()))
+	keys = append(keys, message.GetAccountKeys()...)
+	keys = append(keys, meta.GetLoadedWritableAddresses()...)
+	keys = append(keys, meta.GetLoadedReadonlyAddresses()...)
+	return keys
+}
+
+// TransactionErrorJSON returns the error of a failed transaction in the JSON
+// form of the Solana RPC, base64 when it does not decode, and nil for a
+// transaction that succeeded.
+func TransactionErrorJSON(info *proto.SubscribeUpdateTransactionInfo) *string {
+	raw := info.GetMeta().GetErr().GetErr()
+	if raw == nil {
+		return nil
+	}
+	var text string
+	if decoded, err := DecodeTransactionError(raw); err == nil {
+		data, _ := json.Marshal(decoded)
+		text = string(data)
+	} else {
+		text = base64.StdEncoding.EncodeToString(raw)
+	}
+	return &text
+}
+
+// MessageTransactions returns the transaction of a transaction update or
+// those of a block update.
+func MessageTransactions(msg *Message) []*proto.SubscribeUpdateTransactionInfo {
+	if info := msg.Update.GetTransaction().GetTransaction(); info != nil {
+		return []*proto.SubscribeUpdateTransactionInfo{info}
+	}
+	return msg.Update.GetBlock().GetTransactions()
+}
+
+// TransactionPrograms lists the programs invoked by the outer and inner
+// instructions of a transaction, without duplicates.
+func TransactionPrograms(info *proto.SubscribeUpdateTransactionInfo) [][]byte {
+	accounts := TransactionAccounts(info)
+	seen := make(map[uint32]struct{})
+	var programs [][]byte
+	add := func(index uint32) {
+		if _, ok := seen[index]; ok || int(index) >= len(accounts) {
+			return
+		}
+		seen[index] = struct{}{}
+		programs = append(programs, accounts[index])
+	}
+
+	for _, ix := range info.GetTransaction().GetMessage().GetInstructions() {
+		add(ix.GetProgramIdIndex())
+	}
+	for _, inner := range info.GetMeta().GetInnerInstructions() {
+		for _, ix := range inner.GetInstructions() {
+			add(ix.GetProgramIdIndex())
+		}
+	}
+	return programs
+}
+
+// eachInstruction calls visit for the instructions of a transaction in
+// execution order, every outer instruction followed by its inner ones. inner
+// is the position among the inner instructions, nil for outer ones.
+func eachInstruction(info *proto.SubscribeUpdateTransactionInfo, visit func(outer int, inner *int, programIndex uint32, accounts, data []byte)) {
+	innerInstructions := make(map[uint32][]*proto.InnerInstruction)
+	for _, list := range info.GetMeta().GetInnerInstructions() {
+		innerInstructions[list.GetIndex()] = list.GetInstructions()
+	}
+	for i, ix := range info.GetTransaction().GetMessage().GetInstructions() {
+		visit(i, nil, ix.GetProgramIdIndex(), ix.GetAccounts(), ix.GetData())
+		for j, cpi := range innerInstructions[uint32(i)] {
+			visit(i, &j, cpi.GetProgramIdIndex(), cpi.GetAccounts(), cpi.GetData())
+		}
+	}
+}
+
+// TransactionRow is the flattened transaction written by the database sinks,
+// with the signature and account keys in base58.
+type TransactionRow struct {
+	Signature string
+	Slot      uint64
+	Accounts  []string
+	Err       []byte
+	Logs      []string
+}
+
+func NewTransactionRow(msg *Message) (TransactionRow, bool) {
+	update := msg.Update.GetTransaction()
+	if update == nil {
+		return TransactionRow{}, false
+	}
+	info := update.GetTransaction()
+	meta := info.GetMeta()
+
+	return TransactionRow{
+		Signature: base58.Encode(info.GetSignature()),
+		Slot:      msg.Slot,
+		Accounts:  EncodeKeys(TransactionAccounts(info)),
+		Err:       meta.GetErr().GetErr(),
+		Logs:      meta.GetLogMessages(),
+	}, true
+}
+
+// KeySet holds decoded public keys, nil means no keys were configured.
+type KeySet map[string]struct{}
+
+func NewKeySet(keys []string) (KeySet, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	set := make(KeySet, len(keys))
+	for _, key := range keys {
+		decoded, err := base58.Decode(key)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("invalid public key %q", key)
+		}
+		set[string(decoded)] = struct{}{}
+	}
+	return set, nil
+}
+
+func (s KeySet) ContainsAny(keys [][]byte) bool {
+	for _, key := range keys {
+		if _, ok := s[string(key)]; ok {
+			return true
+		}
+	}
+	return false
+}
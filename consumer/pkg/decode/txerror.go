@@ -0,0 +1,207 @@
+package decode
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// transactionErrors names the variants of Solana's TransactionError in
+// declaration order, which is how bincode numbers them.
+var transactionErrors = []string{
+	"AccountInUse",
+	"AccountLoadedTwice",
+	"AccountNotFound",
+	"ProgramAccountNotFound",
+	"InsufficientFundsForFee",
+	"InvalidAccountForFee",
+	"AlreadyProcessed",
+	"BlockhashNotFound",
+	"InstructionError",
+	"CallChainTooDeep",
+	"MissingSignatureForFee",
+	"InvalidAccountIndex",
+	"SignatureFailure",
+	"InvalidProgramForExecution",
+	"SanitizeFailure",
+	"ClusterMaintenance",
+	"AccountBorrowOutstanding",
+	"WouldExceedMaxBlockCostLimit",
+	"UnsupportedVersion",
+	"InvalidWritableAccount",
+	"WouldExceedMaxAccountCostLimit",
+	"WouldExceedAccountDataBlockLimit",
+	"TooManyAccountLocks",
+	"AddressLookupTableNotFound",
+	"InvalidAddressLookupTableOwner",
+	"InvalidAddressLookupTableData",
+	"InvalidAddressLookupTableIndex",
+	"InvalidRentPayingAccount",
+	"WouldExceedMaxVoteCostLimit",
+	"WouldExceedAccountDataTotalLimit",
+	"DuplicateInstruction",
+	"InsufficientFundsForRent",
+	"MaxLoadedAccountsDataSizeExceeded",
+	"InvalidLoadedAccountsDataSizeLimit",
+	"ResanitizationNeeded",
+	"ProgramExecutionTemporarilyRestricted",
+	"UnbalancedTransaction",
+	"ProgramCacheHitMaxLimit",
+	"CommitCancelled",
+}
+
+// instructionErrors names the variants of Solana's InstructionError.
+var instructionErrors = []string{
+	"GenericError",
+	"InvalidArgument",
+	"InvalidInstructionData",
+	"InvalidAccountData",
+	"AccountDataTooSmall",
+	"InsufficientFunds",
+	"IncorrectProgramId",
+	"MissingRequiredSignature",
+	"AccountAlreadyInitialized",
+	"UninitializedAccount",
+	"UnbalancedInstruction",
+	"ModifiedProgramId",
+	"ExternalAccountLamportSpend",
+	"ExternalAccountDataModified",
+	"ReadonlyLamportChange",
+	"ReadonlyDataModified",
+	"DuplicateAccountIndex",
+	"ExecutableModified",
+	"RentEpochModified",
+	"NotEnoughAccountKeys",
+	"AccountDataSizeChanged",
+	"AccountNotExecutable",
+	"AccountBorrowFailed",
+	"AccountBorrowOutstanding",
+	"DuplicateAccountOutOfSync",
+	"Custom",
+	"InvalidError",
+	"ExecutableDataModified",
+	"ExecutableLamportChange",
+	"ExecutableAccountNoRentExempt",
+	"UnsupportedProgramId",
+	"CallDepth",
+	"MissingAccount",
+	"ReentrancyNotAllowed",
+	"MaxSeedLengthExceeded",
+	"InvalidSeeds",
+	"InvalidRealloc",
+	"ComputationalBudgetExceeded",
+	"PrivilegeEscalation",
+	"ProgramEnvironmentSetupFailure",
+	"ProgramFailedToComplete",
+	"ProgramFailedToCompile",
+	"Immutable",
+	"IncorrectAuthority",
+	"BorshIoError",
+	"AccountNotRentExempt",
+	"InvalidAccountOwner",
+	"ArithmeticOverflow",
+	"UnsupportedSysvar",
+	"IllegalOwner",
+	"MaxAccountsDataAllocationsExceeded",
+	"MaxAccountsExceeded",
+	"MaxInstructionTraceLengthExceeded",
+	"BuiltinProgramsMustConsumeComputeUnits",
+}
+
+var errShortTransactionError = errors.New("transaction error: unexpected end of data")
+
+// DecodeTransactionError decodes a bincode encoded TransactionError into the
+// value Solana RPC returns in meta.err: a variant name, or a single entry
+// object for variants carrying data, e.g. {"InstructionError":[0,{"Custom":1}]}.
+func DecodeTransactionError(data []byte) (any, error) {
+	r := bincodeReader{data: data}
+	variant := r.u32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if int(variant) >= len(transactionErrors) {
+		return nil, fmt.Errorf("transaction error: unknown variant %d", variant)
+	}
+	name := transactionErrors[variant]
+
+	var value any
+	switch name {
+	case "InstructionError":
+		index := r.u8()
+		value = []any{index, r.instructionError()}
+	case "DuplicateInstruction":
+		value = r.u8()
+	case "InsufficientFundsForRent", "ProgramExecutionTemporarilyRestricted":
+		value = map[string]any{"account_index": r.u8()}
+	default:
+		return name, nil
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return map[string]any{name: value}, nil
+}
+
+type bincodeReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bincodeReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errShortTransactionError
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *bincodeReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *bincodeReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *bincodeReader) string() string {
+	b := r.take(8)
+	if b == nil {
+		return ""
+	}
+	n := binary.LittleEndian.Uint64(b)
+	if n > uint64(len(r.data)) {
+		r.err = errShortTransactionError
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *bincodeReader) instructionError() any {
+	variant := r.u32()
+	if r.err != nil {
+		return nil
+	}
+	if int(variant) >= len(instructionErrors) {
+		r.err = fmt.Errorf("instruction error: unknown variant %d", variant)
+		return nil
+	}
+	switch name := instructionErrors[variant]; name {
+	case "Custom":
+		return map[string]any{name: r.u32()}
+	case "BorshIoError":
+		return map[string]any{name: r.string()}
+	default:
+		return name
+	}
+}
@@ -0,0 +1,56 @@
+package decode
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestDecodeTransactionError(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"unit variant", []byte{1, 0, 0, 0}, `"AccountLoadedTwice"`},
+		{"custom instruction error", []byte{8, 0, 0, 0, 2, 25, 0, 0, 0, 0x71, 0x17, 0, 0}, `{"InstructionError":[2,{"Custom":6001}]}`},
+		{"unit instruction error", []byte{8, 0, 0, 0, 0, 1, 0, 0, 0}, `{"InstructionError":[0,"InvalidArgument"]}`},
+		{"borsh io error", []byte{8, 0, 0, 0, 1, 44, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 'e', 'o', 'f'}, `{"InstructionError":[1,{"BorshIoError":"eof"}]}`},
+		{"duplicate instruction", []byte{30, 0, 0, 0, 4}, `{"DuplicateInstruction":4}`},
+		{"insufficient funds for rent", []byte{31, 0, 0, 0, 7}, `{"InsufficientFundsForRent":{"account_index":7}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := DecodeTransactionError(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTransactionErrorInvalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":                     nil,
+		"short variant":             {8, 0},
+		"unknown variant":           {0xff, 0, 0, 0},
+		"missing instruction index": {8, 0, 0, 0},
+		"unknown instruction error": {8, 0, 0, 0, 0, 0xff, 0, 0, 0},
+		"short custom code":         {8, 0, 0, 0, 0, 25, 0, 0, 0, 1},
+		"string past the end":       {8, 0, 0, 0, 1, 44, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0, 'e'},
+	} {
+		if value, err := DecodeTransactionError(data); err == nil {
+			t.Errorf("%s: decoded %v", name, value)
+		}
+	}
+	if _, err := DecodeTransactionError([]byte{8, 0}); !errors.Is(err, errShortTransactionError) {
+		t.Errorf("short data: got %v, want %v", err, errShortTransactionError)
+	}
+}
@@ -0,0 +1,623 @@
+// Package decode decodes the Kafka records of Yellowstone gRPC updates into
+// Messages, whatever their kind, encoding and wire format, and the
+// instructions, logs and balance changes of their transactions.
+//
+// A Decoder built by NewDecoder from a Config decodes the records of the
+// topics a consumer reads, FormatJSON renders an update as the sinks write it
+// and DefaultIDLDecoder decodes the instructions of Anchor programs.
+package decode
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mr-tron/base58"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"consumer/proto"
+)
+
+// UpdateKind names the Yellowstone payload carried by the messages of a topic.
+type UpdateKind string
+
+const (
+	// KindUpdate is a full SubscribeUpdate envelope, dispatched by its oneof.
+	KindUpdate            UpdateKind = "update"
+	KindAccount           UpdateKind = "account"
+	KindSlot              UpdateKind = "slot"
+	KindTransaction       UpdateKind = "transaction"
+	KindTransactionStatus UpdateKind = "transaction_status"
+	KindBlock             UpdateKind = "block"
+	KindBlockMeta         UpdateKind = "block_meta"
+	KindEntry             UpdateKind = "entry"
+	KindPing              UpdateKind = "ping"
+	KindPong              UpdateKind = "pong"
+)
+
+// ParseUpdateKind validates a kind name taken from configuration.
+func ParseUpdateKind(s string) (UpdateKind, error) {
+	switch kind := UpdateKind(s); kind {
+	case KindUpdate, KindAccount, KindSlot, KindTransaction, KindTransactionStatus,
+		KindBlock, KindBlockMeta, KindEntry, KindPing, KindPong:
+		return kind, nil
+	}
+	return "", fmt.Errorf("unknown update kind %q", s)
+}
+
+// Message is a decoded Kafka record. Every payload is normalized into a
+// SubscribeUpdate so downstream code has a single representation to deal with.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Timestamp time.Time
+	// Headers are the headers of the record by key, such as the created_at,
+	// commitment and source headers of grpc2kafka.
+	Headers map[string]string
+	// Slot is taken from the update when it carries one, otherwise from the
+	// `<slot>_<hash>` key written by grpc2kafka.
+	Slot   uint64
+	Update *proto.SubscribeUpdate
+
+	// Complete is set by the consumer to mark the offset of the record once
+	// the message was written, see Hold.
+	Complete func()
+	holds    atomic.Int32
+}
+
+// Hold is called by a sink that keeps msg past a successful Write, it takes
+// over marking the offset from the caller. The offset of msg is then not
+// committed until the returned function is called, once msg was written out
+// or deliberately discarded. A sink holds msg only when Write returns nil.
+func (m *Message) Hold() func() {
+	m.holds.Add(1)
+	if m.Complete == nil {
+		return func() {}
+	}
+	return m.Complete
+}
+
+// Holds returns how many times sinks held m.
+func (m *Message) Holds() int32 {
+	return m.holds.Load()
+}
+
+// Held reports whether a sink took msg over.
+func (m *Message) Held() bool {
+	return m.holds.Load() > 0
+}
+
+// ProducedAt returns when the update was produced: the time of its
+// created_at header, or the timestamp of the record without one, zero when
+// neither is known.
+func (m *Message) ProducedAt() time.Time {
+	if value, ok := m.Headers[HeaderCreatedAt]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+	return m.Timestamp
+}
+
+// Kind reports which update the message carries.
+func (m *Message) Kind() UpdateKind {
+	return UpdateKindOf(m.Update)
+}
+
+func UpdateKindOf(update *proto.SubscribeUpdate) UpdateKind {
+	switch update.GetUpdateOneof().(type) {
+	case *proto.SubscribeUpdate_Account:
+		return KindAccount
+	case *proto.SubscribeUpdate_Slot:
+		return KindSlot
+	case *proto.SubscribeUpdate_Transaction:
+		return KindTransaction
+	case *proto.SubscribeUpdate_TransactionStatus:
+		return KindTransactionStatus
+	case *proto.SubscribeUpdate_Block:
+		return KindBlock
+	case *proto.SubscribeUpdate_BlockMeta:
+		return KindBlockMeta
+	case *proto.SubscribeUpdate_Entry:
+		return KindEntry
+	case *proto.SubscribeUpdate_Ping:
+		return KindPing
+	case *proto.SubscribeUpdate_Pong:
+		return KindPong
+	}
+	return ""
+}
+
+// Decoder turns raw Kafka records into Messages. Each topic carries a single
+// kind of payload; topics without an explicit mapping use the fallback.
+type Decoder struct {
+	topics        map[string]UpdateKind
+	infer         bool
+	fallback      UpdateKind
+	formats       map[string]string
+	format        string
+	unmarshal     gproto.UnmarshalOptions
+	unmarshalJSON protojson.UnmarshalOptions
+	avroSchemas   map[string]*goavro.Codec
+	wireFormat    string
+	// registry checks the schema ids of the payloads in the wire format,
+	// nil when they are not checked.
+	registry *SchemaRegistry
+	// pool recycles the messages given to Release, nil without
+	// decoding.reuse_messages.
+	pool *messagePool
+	// lazy prunes transactions for the filter, see DecodeLazy.
+	lazy bool
+	// sample keeps 1 of that many transactions, see SampleRecord.
+	sample int
+}
+
+// Config is the decoding section of the configuration.
+type Config struct {
+	// Kind is the payload carried by the topics, see UpdateKind.
+	Kind string `json:"kind" yaml:"kind"`
+	// Topics maps topic names to the kind they carry, overriding Kind.
+	Topics map[string]string `json:"topics" yaml:"topics"`
+	// InferKind derives the kind of unmapped topics from a name suffix such
+	// as .accounts or -slots before falling back to Kind.
+	InferKind bool `json:"infer_kind" yaml:"infer_kind"`
+	// DiscardUnknown drops protobuf fields unknown to the generated code.
+	DiscardUnknown bool `json:"discard_unknown" yaml:"discard_unknown"`
+	// ReuseMessages recycles the decoded messages and their updates once
+	// they were written, see messagePool.
+	ReuseMessages bool `json:"reuse_messages" yaml:"reuse_messages"`
+	// Lazy decodes transactions without their logs, balances and rewards
+	// for the filter first, and in full only when they pass, see DecodeLazy.
+	Lazy bool `json:"lazy" yaml:"lazy"`
+	// Sample keeps 1 of that many transactions and transaction statuses,
+	// chosen by their signature before decoding, all of them when 0 or 1.
+	// See SampleRecord.
+	Sample int `json:"sample" yaml:"sample"`
+	// IDL decodes the instructions of Anchor programs in the JSON output.
+	IDL          IDLConfig          `json:"idl" yaml:"idl"`
+	LookupTables LookupTablesConfig `json:"lookup_tables" yaml:"lookup_tables"`
+	// Format is protobuf, json or avro, the encoding of the payloads of the
+	// topics, protobuf when empty. Formats maps topics to their own.
+	Format  string            `json:"format" yaml:"format"`
+	Formats map[string]string `json:"formats" yaml:"formats"`
+	// AvroSchemas maps topics to the .avsc file their Avro payloads are
+	// written with, when they are not looked up in the schema registry.
+	AvroSchemas map[string]string `json:"avro_schemas" yaml:"avro_schemas"`
+	// WireFormat is auto, raw or confluent for payloads prefixed with the
+	// Confluent Schema Registry header, auto when empty.
+	WireFormat     string               `json:"wire_format" yaml:"wire_format"`
+	SchemaRegistry SchemaRegistryConfig `json:"schema_registry" yaml:"schema_registry"`
+}
+
+func NewDecoder(config Config) (*Decoder, error) {
+	fallback, err := ParseUpdateKind(config.Kind)
+	if err != nil {
+		return nil, fmt.Errorf("decoding.kind: %w", err)
+	}
+	topics := make(map[string]UpdateKind, len(config.Topics))
+	for topic, name := range config.Topics {
+		kind, err := ParseUpdateKind(name)
+		if err != nil {
+			return nil, fmt.Errorf("decoding.topics.%s: %w", topic, err)
+		}
+		topics[topic] = kind
+	}
+	format := cmp.Or(config.Format, EncodingProtobuf)
+	if err := validateFormat("decoding.format", format); err != nil {
+		return nil, err
+	}
+	for topic, name := range config.Formats {
+		if err := validateFormat("decoding.formats."+topic, name); err != nil {
+			return nil, err
+		}
+	}
+	avroSchemas, err := loadAvroSchemas(config.AvroSchemas)
+	if err != nil {
+		return nil, err
+	}
+	wireFormat := cmp.Or(config.WireFormat, WireFormatAuto)
+	if err := validateWireFormat("decoding.wire_format", wireFormat); err != nil {
+		return nil, err
+	}
+	if config.Sample < 0 {
+		return nil, errors.New("decoding.sample: must not be negative")
+	}
+	var pool *messagePool
+	if config.ReuseMessages {
+		pool = newMessagePool()
+	}
+	return &Decoder{
+		topics:        topics,
+		infer:         config.InferKind,
+		fallback:      fallback,
+		formats:       config.Formats,
+		format:        format,
+		unmarshal:     gproto.UnmarshalOptions{DiscardUnknown: config.DiscardUnknown},
+		unmarshalJSON: protojson.UnmarshalOptions{DiscardUnknown: config.DiscardUnknown},
+		avroSchemas:   avroSchemas,
+		wireFormat:    wireFormat,
+		registry:      NewSchemaRegistry(config.SchemaRegistry),
+		pool:          pool,
+		lazy:          config.Lazy,
+		sample:        config.Sample,
+	}, nil
+}
+
+// Formats for Config.Format, the encoding of the payloads.
+const (
+	EncodingProtobuf = "protobuf"
+	// EncodingJSON is the protobuf JSON mapping of the payload message.
+	EncodingJSON = "json"
+	// EncodingAvro is a record with the fields of the payload message, see
+	// setAvroMessage.
+	EncodingAvro = "avro"
+)
+
+func validateFormat(field, format string) error {
+	switch format {
+	case EncodingProtobuf, EncodingJSON, EncodingAvro:
+		return nil
+	}
+	return fmt.Errorf("%s: expected protobuf, json or avro, got %q", field, format)
+}
+
+// FormatOf returns the format mapped to topic, then the default format.
+func (d *Decoder) FormatOf(topic string) string {
+	if format, ok := d.formats[topic]; ok {
+		return format
+	}
+	return d.format
+}
+
+// KindOf returns the kind mapped to topic, then the kind named by its suffix
+// when inference is enabled, then the default kind.
+func (d *Decoder) KindOf(topic string) UpdateKind {
+	if kind, ok := d.topics[topic]; ok {
+		return kind
+	}
+	if d.infer {
+		if kind, ok := kindFromTopic(topic); ok {
+			return kind
+		}
+	}
+	return d.fallback
+}
+
+// topicSuffixes are the topic name suffixes naming a kind, longest first so
+// transaction_status wins over a shorter match.
+var topicSuffixes = func() []topicSuffix {
+	names := map[UpdateKind][]string{
+		KindAccount:           {"account", "accounts"},
+		KindSlot:              {"slot", "slots"},
+		KindTransaction:       {"transaction", "transactions"},
+		KindTransactionStatus: {"transaction_status", "transaction_statuses", "transactions_status"},
+		KindBlock:             {"block", "blocks"},
+		KindBlockMeta:         {"block_meta", "blocks_meta"},
+		KindEntry:             {"entry", "entries"},
+	}
+	var suffixes []topicSuffix
+	for kind, list := range names {
+		for _, name := range list {
+			suffixes = append(suffixes, topicSuffix{name, kind})
+			if dashed := strings.ReplaceAll(name, "_", "-"); dashed != name {
+				suffixes = append(suffixes, topicSuffix{dashed, kind})
+			}
+		}
+	}
+	slices.SortFunc(suffixes, func(a, b topicSuffix) int {
+		return cmp.Or(cmp.Compare(len(b.name), len(a.name)), strings.Compare(a.name, b.name))
+	})
+	return suffixes
+}()
+
+type topicSuffix struct {
+	name string
+	kind UpdateKind
+}
+
+// kindFromTopic infers the kind from the last part of a topic name, such as
+// mainnet.accounts, solana-slots or geyser_transaction_status.
+func kindFromTopic(topic string) (UpdateKind, bool) {
+	topic = strings.ToLower(topic)
+	for _, suffix := range topicSuffixes {
+		rest, ok := strings.CutSuffix(topic, suffix.name)
+		if !ok {
+			continue
+		}
+		if rest == "" || strings.ContainsRune(".-_", rune(rest[len(rest)-1])) {
+			return suffix.kind, true
+		}
+	}
+	return "", false
+}
+
+func (d *Decoder) Decode(record *sarama.ConsumerMessage) (*Message, error) {
+	return d.decode(record, false)
+}
+
+// decode decodes record, a transaction without the prunedMetaFields with
+// prune.
+func (d *Decoder) decode(record *sarama.ConsumerMessage, prune bool) (*Message, error) {
+	keySlot, _ := ParseKeySlot(record.Key)
+	update, err := d.unmarshalUpdate(record.Topic, d.KindOf(record.Topic), record.Value, keySlot, prune)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := d.pool.message()
+	*msg = Message{
+		Topic:     record.Topic,
+		Partition: record.Partition,
+		Offset:    record.Offset,
+		Key:       record.Key,
+		Timestamp: record.Timestamp,
+		Headers:   fillHeaders(msg.Headers, record.Headers),
+		Slot:      keySlot,
+		Update:    update,
+	}
+	if slot, ok := UpdateSlot(update); ok {
+		msg.Slot = slot
+	}
+	return msg, nil
+}
+
+// Release hands msg back for reuse once the consumer is done with it, see
+// messagePool for what that allows. It does nothing without
+// decoding.reuse_messages.
+func (d *Decoder) Release(msg *Message) {
+	d.pool.release(msg)
+}
+
+func (d *Decoder) unmarshalUpdate(topic string, kind UpdateKind, payload []byte, slot uint64, prune bool) (*proto.SubscribeUpdate, error) {
+	update := d.pool.update()
+	var inner gproto.Message
+	switch kind {
+	case KindUpdate:
+		inner = update
+	case KindAccount:
+		msg := pooledInner[proto.SubscribeUpdateAccount](d.pool, KindAccount)
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_Account{Account: msg}, msg
+	case KindSlot:
+		msg := pooledInner[proto.SubscribeUpdateSlot](d.pool, KindSlot)
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_Slot{Slot: msg}, msg
+	case KindTransaction:
+		// grpc2kafka writes the bare transaction info, the slot lives in the key.
+		msg := pooledInner[proto.SubscribeUpdateTransactionInfo](d.pool, KindTransaction)
+		update.UpdateOneof = &proto.SubscribeUpdate_Transaction{
+			Transaction: &proto.SubscribeUpdateTransaction{Transaction: msg, Slot: slot},
+		}
+		inner = msg
+	case KindTransactionStatus:
+		msg := pooledInner[proto.SubscribeUpdateTransactionStatus](d.pool, KindTransactionStatus)
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_TransactionStatus{TransactionStatus: msg}, msg
+	case KindBlock:
+		msg := pooledInner[proto.SubscribeUpdateBlock](d.pool, KindBlock)
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_Block{Block: msg}, msg
+	case KindBlockMeta:
+		msg := pooledInner[proto.SubscribeUpdateBlockMeta](d.pool, KindBlockMeta)
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_BlockMeta{BlockMeta: msg}, msg
+	case KindEntry:
+		msg := pooledInner[proto.SubscribeUpdateEntry](d.pool, KindEntry)
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_Entry{Entry: msg}, msg
+	case KindPing:
+		msg := &proto.SubscribeUpdatePing{}
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_Ping{Ping: msg}, msg
+	case KindPong:
+		msg := &proto.SubscribeUpdatePong{}
+		update.UpdateOneof, inner = &proto.SubscribeUpdate_Pong{Pong: msg}, msg
+	default:
+		return nil, fmt.Errorf("unknown update kind %q", kind)
+	}
+
+	if err := d.unmarshalPayload(topic, payload, inner, prune); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", kind, err)
+	}
+	if update.UpdateOneof == nil {
+		return nil, fmt.Errorf("decode %s: empty update", kind)
+	}
+	return update, nil
+}
+
+// unmarshalPayload decodes a payload in the format of topic into message,
+// once stripped of the schema registry header. prune decodes a protobuf
+// transaction info without the prunedMetaFields.
+func (d *Decoder) unmarshalPayload(topic string, payload []byte, message gproto.Message, prune bool) error {
+	switch d.FormatOf(topic) {
+	case EncodingJSON:
+		payload, err := d.unwrapJSON(payload)
+		if err != nil {
+			return err
+		}
+		return d.unmarshalJSON.Unmarshal(payload, message)
+	case EncodingAvro:
+		codec, payload, err := d.unwrapAvro(topic, payload)
+		if err != nil {
+			return err
+		}
+		datum, rest, err := codec.NativeFromBinary(payload)
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			return fmt.Errorf("%d bytes after the Avro record", len(rest))
+		}
+		return setAvroMessage(message.ProtoReflect(), datum, d.unmarshal.DiscardUnknown)
+	}
+	payload, err := d.unwrap(payload, message.ProtoReflect().Descriptor())
+	if err == nil && prune {
+		payload, err = pruneTransactionInfo(payload)
+	}
+	if err != nil {
+		return err
+	}
+	return d.unmarshal.Unmarshal(payload, message)
+}
+
+// unwrapJSON strips the schema registry header off a JSON payload, which
+// never starts with a zero byte, checking with the registry that its schema
+// id is a JSON schema. The payload is not validated against it.
+func (d *Decoder) unwrapJSON(payload []byte) ([]byte, error) {
+	if d.wireFormat == WireFormatRaw || (d.wireFormat == WireFormatAuto && (len(payload) == 0 || payload[0] != wireMagic)) {
+		return payload, nil
+	}
+	id, rest, err := parseWireHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	if d.registry != nil {
+		if err := d.registry.checkType(id, "JSON"); err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
+// unwrapAvro returns the codec of an Avro payload and the record. An Avro
+// record may start with a zero byte, so in the auto wire format the payloads
+// of a topic with a schema in decoding.avro_schemas are taken to be without
+// the header and those of other topics with it. The schema id of the header
+// is looked up in the registry when there is one.
+func (d *Decoder) unwrapAvro(topic string, payload []byte) (*goavro.Codec, []byte, error) {
+	codec, ok := d.avroSchemas[topic]
+	if d.wireFormat == WireFormatRaw || (d.wireFormat == WireFormatAuto && ok) {
+		if !ok {
+			return nil, nil, errors.New("no schema in decoding.avro_schemas")
+		}
+		return codec, payload, nil
+	}
+	id, rest, err := parseWireHeader(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.registry != nil {
+		codec, err := d.registry.avroCodec(id)
+		return codec, rest, err
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("schema %d: Avro payloads need decoding.schema_registry.url or decoding.avro_schemas", id)
+	}
+	return codec, rest, nil
+}
+
+// unwrap strips the schema registry header off a protobuf payload, checking
+// with the registry that its schema id names the message expected.
+func (d *Decoder) unwrap(payload []byte, message protoreflect.MessageDescriptor) ([]byte, error) {
+	if d.wireFormat == WireFormatRaw || (d.wireFormat == WireFormatAuto && (len(payload) == 0 || payload[0] != wireMagic)) {
+		return payload, nil
+	}
+	id, indexes, rest, err := parseWireFormat(payload)
+	if err != nil {
+		return nil, err
+	}
+	if d.registry != nil {
+		name, err := d.registry.messageName(id, indexes)
+		if err != nil {
+			return nil, err
+		}
+		if name != string(message.FullName()) {
+			return nil, fmt.Errorf("schema %d is %s, expected %s", id, name, message.FullName())
+		}
+	}
+	return rest, nil
+}
+
+// UpdateSlot returns the slot carried by the update itself, if any.
+func UpdateSlot(update *proto.SubscribeUpdate) (uint64, bool) {
+	switch u := update.GetUpdateOneof().(type) {
+	case *proto.SubscribeUpdate_Account:
+		return u.Account.GetSlot(), true
+	case *proto.SubscribeUpdate_Slot:
+		return u.Slot.GetSlot(), true
+	case *proto.SubscribeUpdate_Transaction:
+		return u.Transaction.GetSlot(), u.Transaction.GetSlot() != 0
+	case *proto.SubscribeUpdate_TransactionStatus:
+		return u.TransactionStatus.GetSlot(), true
+	case *proto.SubscribeUpdate_Block:
+		return u.Block.GetSlot(), true
+	case *proto.SubscribeUpdate_BlockMeta:
+		return u.BlockMeta.GetSlot(), true
+	case *proto.SubscribeUpdate_Entry:
+		return u.Entry.GetSlot(), true
+	}
+	return 0, false
+}
+
+// ParseKeySlot extracts the slot from a `<slot>_<sha256 hex>` record key.
+func ParseKeySlot(key []byte) (uint64, bool) {
+	i := bytes.IndexByte(key, '_')
+	if i <= 0 {
+		return 0, false
+	}
+	slot, err := strconv.ParseUint(string(key[:i]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return slot, true
+}
+
+// RoutingKeys names the streams, channels or subjects an update is forwarded
+// to. With a ":" separator they are <prefix>:transaction:<program> once per
+// invoked program, <prefix>:account:<owner>, and <prefix>:<kind> for anything
+// else. A transaction invoking no program goes to
+// <prefix>:transaction:<fee payer>, or <prefix>:transaction without account
+// keys, so it is never dropped. Programs, owners and fee payers are base58.
+func RoutingKeys(prefix, separator string, update *proto.SubscribeUpdate) []string {
+	kind := prefix + separator + string(UpdateKindOf(update))
+	switch {
+	case update.GetTransaction() != nil:
+		info := update.GetTransaction().GetTransaction()
+		programs := TransactionPrograms(info)
+		if len(programs) == 0 {
+			if keys := info.GetTransaction().GetMessage().GetAccountKeys(); len(keys) > 0 {
+				return []string{kind + separator + base58.Encode(keys[0])}
+			}
+			return []string{kind}
+		}
+		keys := make([]string, len(programs))
+		for i, program := range programs {
+			keys[i] = kind + separator + base58.Encode(program)
+		}
+		return keys
+	case update.GetAccount() != nil:
+		return []string{kind + separator + base58.Encode(update.GetAccount().GetAccount().GetOwner())}
+	}
+	return []string{kind}
+}
+
+// MessageFields locates a decoded message and names its transaction, if any.
+func MessageFields(msg *Message) []zap.Field {
+	fields := []zap.Field{
+		zap.String("topic", msg.Topic),
+		zap.Int32("partition", msg.Partition),
+		zap.Int64("offset", msg.Offset),
+		zap.Uint64("slot", msg.Slot),
+	}
+	if signature := MessageSignature(msg); signature != nil {
+		fields = append(fields, zap.String("signature", base58.Encode(signature)))
+	}
+	return fields
+}
+
+// MessageSignature returns the transaction signature carried by msg, if any.
+func MessageSignature(msg *Message) []byte {
+	switch {
+	case msg.Update.GetTransaction() != nil:
+		return msg.Update.GetTransaction().GetTransaction().GetSignature()
+	case msg.Update.GetTransactionStatus() != nil:
+		return msg.Update.GetTransactionStatus().GetSignature()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package decode
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+func TestKindFromTopic(t *testing.T) {
+	tests := map[string]UpdateKind{
+		"accounts":                    KindAccount,
+		"mainnet.accounts":            KindAccount,
+		"solana-slots":                KindSlot,
+		"geyser_slot":                 KindSlot,
+		"mainnet.transactions":        KindTransaction,
+		"geyser_transaction_status":   KindTransactionStatus,
+		"geyser-transaction-status":   KindTransactionStatus,
+		"mainnet.transactions_status": KindTransactionStatus,
+		"Mainnet.Blocks":              KindBlock,
+		"mainnet.blocks-meta":         KindBlockMeta,
+		"mainnet.entries":             KindEntry,
+		"myaccounts":                  "",
+		"accounts.raw":                "",
+		"updates":                     "",
+	}
+	for topic, want := range tests {
+		kind, ok := kindFromTopic(topic)
+		if kind != want || ok != (want != "") {
+			t.Errorf("kindFromTopic(%q) = %q, %v, want %q", topic, kind, ok, want)
+		}
+	}
+}
+
+func TestDecoderKindOf(t *testing.T) {
+	d, err := NewDecoder(Config{
+		Kind:      "update",
+		Topics:    map[string]string{"mainnet.accounts": "transaction"},
+		InferKind: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string]UpdateKind{
+		"mainnet.accounts": KindTransaction,
+		"mainnet.slots":    KindSlot,
+		"updates":          KindUpdate,
+	} {
+		if kind := d.KindOf(topic); kind != want {
+			t.Errorf("KindOf(%q) = %q, want %q", topic, kind, want)
+		}
+	}
+
+	if _, err := NewDecoder(Config{Kind: "update", Topics: map[string]string{"t": "bogus"}}); err == nil {
+		t.Error("NewDecoder accepted an unknown kind")
+	}
+}
+
+func TestParseKeySlot(t *testing.T) {
+	for key, want := range map[string]uint64{
+		"265000104_ab12": 265000104,
+		"0_ab":           0,
+	} {
+		if slot, ok := ParseKeySlot([]byte(key)); !ok || slot != want {
+			t.Errorf("parseKeySlot(%q) = %d, %v, want %d", key, slot, ok, want)
+		}
+	}
+	for _, key := range []string{"", "_ab", "abc_12", "265000104"} {
+		if slot, ok := ParseKeySlot([]byte(key)); ok {
+			t.Errorf("parseKeySlot(%q) = %d, want no slot", key, slot)
+		}
+	}
+}
+
+func TestDecodeTransactionTakesSlotFromKey(t *testing.T) {
+	info := &proto.SubscribeUpdateTransactionInfo{Signature: testkey.Key(1)}
+	value, err := gproto.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDecoder(Config{Kind: "transaction"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Decode(&sarama.ConsumerMessage{Topic: "tx", Key: []byte("42_ff"), Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Kind() != KindTransaction || msg.Slot != 42 || msg.Update.GetTransaction().GetSlot() != 42 {
+		t.Fatalf("decoded %s of slot %d", msg.Kind(), msg.Slot)
+	}
+
+	// a slot update carries its own slot
+	value, _ = gproto.Marshal(&proto.SubscribeUpdateSlot{Slot: 7})
+	d, _ = NewDecoder(Config{Kind: "slot"})
+	if msg, err = d.Decode(&sarama.ConsumerMessage{Key: []byte("42_ff"), Value: value}); err != nil || msg.Slot != 7 {
+		t.Fatalf("decoded slot %d, %v, want 7", msg.Slot, err)
+	}
+}
+
+func TestRoutingKeys(t *testing.T) {
+	program := base58.Encode(testkey.Key(1))
+	for _, tt := range []struct {
+		name string
+		msg  *Message
+		want []string
+	}{
+		{"transaction", transactionMessage(10, testkey.Key(1), testkey.Key(2)), []string{"solana:transaction:" + program}},
+		{"account", accountMessage(10, testkey.Key(2), testkey.Key(1)), []string{"solana:account:" + program}},
+		{"slot", slotMessage(10, 9, 0), []string{"solana:slot"}},
+	} {
+		if got := RoutingKeys("solana", ":", tt.msg.Update); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// a transaction invoking no program is routed by its fee payer
+	noPrograms := transactionMessage(10, testkey.Key(1))
+	message := noPrograms.Update.GetTransaction().GetTransaction().GetTransaction().GetMessage()
+	message.Instructions = nil
+	for _, tt := range []struct {
+		name string
+		keys [][]byte
+		want []string
+	}{
+		{"fee payer", [][]byte{testkey.Key(3), testkey.Key(1)}, []string{"solana:transaction:" + base58.Encode(testkey.Key(3))}},
+		{"no account keys", nil, []string{"solana:transaction"}},
+	} {
+		message.AccountKeys = tt.keys
+		if got := RoutingKeys("solana", ":", noPrograms.Update); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// Package duration holds Duration, the type of the durations of the
+// configuration sections, written as strings such as "500ms" in YAML and JSON.
+package duration
+
+import "time"
+
+// Duration is a time.Duration written as a string such as "500ms" or "1m".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
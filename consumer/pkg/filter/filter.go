@@ -0,0 +1,215 @@
+// Package filter selects the decoded messages a consumer writes, by the
+// programs, accounts, events and headers of their transactions or by a CEL
+// expression. A nil *Filter, as New returns for a Config that filters
+// nothing, lets every message through.
+package filter
+
+import (
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+)
+
+// Reasons reported by Filter.Allow, used as metric labels.
+const (
+	ReasonVote           = "vote"
+	ReasonFailed         = "failed"
+	ReasonProgramInclude = "program_include"
+	ReasonProgramExclude = "program_exclude"
+	ReasonAccountInclude = "account_include"
+	ReasonAccountExclude = "account_exclude"
+	ReasonEventInclude   = "event_include"
+	ReasonHeaderInclude  = "header_include"
+	ReasonExpression     = "expression"
+	// ReasonExpressionError counts the transactions filter.expression failed
+	// to evaluate for, they are dropped
+	ReasonExpressionError = "expression_error"
+	// ReasonDuplicate counts the signatures dropped by
+	// processing.signature_dedup
+	ReasonDuplicate = "duplicate"
+	// ReasonFailover counts the messages of the cluster not consumed, or of
+	// a slot the other one wrote past, see Failover
+	ReasonFailover = "failover"
+	// ReasonSampled counts the transactions decoding.sample left out
+	ReasonSampled = "sampled"
+)
+
+// Config selects the transactions passed to the sink. Keys are base58.
+// Updates other than transactions and transaction statuses always pass,
+// unless HeaderInclude drops them.
+type Config struct {
+	// ProgramInclude keeps only transactions invoking one of the programs,
+	// ProgramExclude drops transactions invoking any of them.
+	ProgramInclude []string `json:"program_include" yaml:"program_include"`
+	ProgramExclude []string `json:"program_exclude" yaml:"program_exclude"`
+	// AccountInclude keeps only transactions referencing one of the
+	// accounts, AccountExclude drops transactions referencing any of them.
+	AccountInclude []string `json:"account_include" yaml:"account_include"`
+	AccountExclude []string `json:"account_exclude" yaml:"account_exclude"`
+	// EventInclude keeps only transactions emitting one of the events, named
+	// by the IDL of their program, see ParseProgramLogs.
+	EventInclude  []string `json:"event_include" yaml:"event_include"`
+	ExcludeVote   bool     `json:"exclude_vote" yaml:"exclude_vote"`
+	ExcludeFailed bool     `json:"exclude_failed" yaml:"exclude_failed"`
+	// HeaderInclude keeps only updates of every kind whose record has each
+	// header with one of its values, such as source or commitment.
+	HeaderInclude map[string][]string `json:"header_include" yaml:"header_include"`
+	// Expression keeps only transactions it is true for, a CEL expression,
+	// see expressionFilter.
+	Expression string `json:"expression" yaml:"expression"`
+}
+
+func (c *Config) Validate() error {
+	_, err := New(*c)
+	return err
+}
+
+// Filter drops transactions before they reach the sink.
+type Filter struct {
+	programInclude decode.KeySet
+	programExclude decode.KeySet
+	accountInclude decode.KeySet
+	accountExclude decode.KeySet
+	eventInclude   map[string]struct{}
+	headerInclude  map[string][]string
+	expression     *expressionFilter
+	excludeVote    bool
+	excludeFailed  bool
+}
+
+// New returns nil when the config does not filter anything.
+func New(config Config) (*Filter, error) {
+	f := &Filter{excludeVote: config.ExcludeVote, excludeFailed: config.ExcludeFailed}
+	for header, values := range config.HeaderInclude {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("filter.header_include.%s: at least one value is required", header)
+		}
+		if f.headerInclude == nil {
+			f.headerInclude = make(map[string][]string, len(config.HeaderInclude))
+		}
+		f.headerInclude[header] = values
+	}
+	for _, set := range []struct {
+		name string
+		keys []string
+		dst  *decode.KeySet
+	}{
+		{"program_include", config.ProgramInclude, &f.programInclude},
+		{"program_exclude", config.ProgramExclude, &f.programExclude},
+		{"account_include", config.AccountInclude, &f.accountInclude},
+		{"account_exclude", config.AccountExclude, &f.accountExclude},
+	} {
+		keys, err := decode.NewKeySet(set.keys)
+		if err != nil {
+			return nil, fmt.Errorf("filter.%s: %w", set.name, err)
+		}
+		*set.dst = keys
+	}
+	for _, name := range config.EventInclude {
+		if f.eventInclude == nil {
+			f.eventInclude = make(map[string]struct{}, len(config.EventInclude))
+		}
+		f.eventInclude[name] = struct{}{}
+	}
+	if config.Expression != "" {
+		expression, err := newExpressionFilter(config.Expression)
+		if err != nil {
+			return nil, err
+		}
+		f.expression = expression
+	}
+
+	if f.programInclude == nil && f.programExclude == nil && f.accountInclude == nil &&
+		f.accountExclude == nil && f.eventInclude == nil && f.headerInclude == nil && f.expression == nil &&
+		!f.excludeVote && !f.excludeFailed {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// Allow reports whether msg passes the filter, and why it does not.
+func (f *Filter) Allow(msg *decode.Message) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+
+	for header, values := range f.headerInclude {
+		value, ok := msg.Headers[header]
+		if !ok || !slices.Contains(values, value) {
+			return false, ReasonHeaderInclude
+		}
+	}
+
+	if status := msg.Update.GetTransactionStatus(); status != nil {
+		if f.excludeVote && status.GetIsVote() {
+			return false, ReasonVote
+		}
+		if f.excludeFailed && status.GetErr() != nil {
+			return false, ReasonFailed
+		}
+		return true, ""
+	}
+
+	info := msg.Update.GetTransaction().GetTransaction()
+	if info == nil {
+		return true, ""
+	}
+	if f.excludeVote && info.GetIsVote() {
+		return false, ReasonVote
+	}
+	if f.excludeFailed && info.GetMeta().GetErr() != nil {
+		return false, ReasonFailed
+	}
+
+	if f.programInclude != nil || f.programExclude != nil {
+		programs := decode.TransactionPrograms(info)
+		if f.programExclude.ContainsAny(programs) {
+			return false, ReasonProgramExclude
+		}
+		if f.programInclude != nil && !f.programInclude.ContainsAny(programs) {
+			return false, ReasonProgramInclude
+		}
+	}
+	if f.accountInclude != nil || f.accountExclude != nil {
+		accounts := decode.TransactionAccounts(info)
+		if f.accountExclude.ContainsAny(accounts) {
+			return false, ReasonAccountExclude
+		}
+		if f.accountInclude != nil && !f.accountInclude.ContainsAny(accounts) {
+			return false, ReasonAccountInclude
+		}
+	}
+	if f.eventInclude != nil {
+		logs, _ := decode.ParseProgramLogs(info)
+		if !slices.ContainsFunc(logs.Events, func(event decode.ProgramEvent) bool {
+			_, ok := f.eventInclude[event.Name]
+			return ok && event.Name != ""
+		}) {
+			return false, ReasonEventInclude
+		}
+	}
+	if f.expression != nil {
+		pass, err := f.expression.match(msg)
+		if err != nil {
+			if ce := logging.Logger.Check(zap.DebugLevel, "filter expression failed"); ce != nil {
+				ce.Write(append(decode.MessageFields(msg), zap.Error(err))...)
+			}
+			return false, ReasonExpressionError
+		}
+		if !pass {
+			return false, ReasonExpression
+		}
+	}
+	return true, ""
+}
+
+// Prefilters reports whether the filter can run on a pruned transaction: it
+// filters something, and neither by the events nor by an expression, which
+// read the logs.
+func (f *Filter) Prefilters() bool {
+	return f != nil && f.eventInclude == nil && f.expression == nil
+}
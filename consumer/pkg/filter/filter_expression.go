@@ -0,0 +1,166 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// expressionFilter is a compiled filter.expression, a CEL expression over
+// the variables msg, the message with its record position, headers and
+// update as FormatJSON renders it, and tx, the transaction of the update
+// with its account_keys and programs. Both are built from the protobuf
+// fields of the update, a field only once the expression reads it.
+type expressionFilter struct {
+	program cel.Program
+}
+
+func newExpressionFilter(expression string) (*expressionFilter, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("msg", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("tx", cel.MapType(cel.StringType, cel.DynType)),
+		cel.CustomTypeAdapter(expressionAdapter{}),
+		// uint fields of the update are compared to int literals
+		cel.CrossTypeNumericComparisons(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("filter.expression: %w", err)
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		first := issues.Errors()[0]
+		return nil, fmt.Errorf("filter.expression: line %d: %s", first.Location.Line(), first.Message)
+	}
+	if output := ast.OutputType(); output != cel.BoolType && output != cel.DynType {
+		return nil, fmt.Errorf("filter.expression: must be a bool, not %s", output)
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("filter.expression: %w", err)
+	}
+	return &expressionFilter{program: program}, nil
+}
+
+// match reports whether the transaction msg passes the expression, an error
+// being returned when it fails to evaluate.
+func (f *expressionFilter) match(msg *decode.Message) (bool, error) {
+	out, _, err := f.program.Eval(map[string]any{
+		"msg": map[string]any{
+			"kind":      string(msg.Kind()),
+			"slot":      msg.Slot,
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"key":       string(msg.Key),
+			"headers":   msg.Headers,
+			"update":    lazyValue(sync.OnceValue(func() any { return decode.FormatMessage(msg.Update.ProtoReflect()) })),
+		},
+		// bound lazily, the activation keeps the value once read
+		"tx": func() any { return expressionTransaction(msg.Update.GetTransaction().GetTransaction()) },
+	})
+	if err != nil {
+		return false, err
+	}
+	pass, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is a %s, not a bool", out.Type())
+	}
+	return pass, nil
+}
+
+// expressionTransaction is the tx variable: the fields of info as
+// FormatMessage renders them, its decoded instructions, balance changes and
+// logs, and its account_keys and programs. The decoded fields are set even
+// when the transaction has none, to an empty list or null.
+func expressionTransaction(info *proto.SubscribeUpdateTransactionInfo) map[string]any {
+	tx := make(map[string]any)
+	m := info.ProtoReflect()
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !m.Has(fd) {
+			continue
+		}
+		tx[string(fd.Name())] = lazyValue(sync.OnceValue(func() any { return decode.FormatField(fd, m.Get(fd)) }))
+	}
+	for name, value := range map[string]func() any{
+		"token_instructions":  func() any { return decode.DecodeTokenInstructions(info) },
+		"system_instructions": func() any { return decode.DecodeSystemInstructions(info) },
+		"swaps":               func() any { return decode.DecodeSwaps(info) },
+		"mint_events":         func() any { return decode.DecodeMintEvents(info) },
+		"anchor_instructions": func() any { return decode.DefaultIDLDecoder.DecodeInstructions(info) },
+		"balance_changes":     func() any { return decode.BalanceChanges(info) },
+		"compute_budget": func() any {
+			if budget, ok := decode.DecodeComputeBudget(info); ok {
+				return budget
+			}
+			return nil
+		},
+		"program_logs": func() any {
+			if logs, ok := decode.ParseProgramLogs(info); ok {
+				return logs
+			}
+			return nil
+		},
+		"account_keys": func() any { return decode.EncodeKeys(decode.TransactionAccounts(info)) },
+		"programs":     func() any { return decode.EncodeKeys(decode.TransactionPrograms(info)) },
+	} {
+		tx[name] = lazyValue(sync.OnceValue(value))
+	}
+	return tx
+}
+
+// lazyValue is a value of msg or tx computed once the expression reads it.
+type lazyValue func() any
+
+// expressionAdapter converts the values of msg and tx for CEL, computing the
+// lazy ones. The decoded instructions, logs and balance changes are Go
+// structs, they are read as their JSON form.
+type expressionAdapter struct{}
+
+func (a expressionAdapter) NativeToValue(value any) ref.Val {
+	switch v := value.(type) {
+	case nil:
+		return types.NullValue
+	case ref.Val:
+		return v
+	case lazyValue:
+		return a.NativeToValue(v())
+	case map[string]any:
+		return types.NewStringInterfaceMap(a, v)
+	case []any:
+		return types.NewDynamicList(a, v)
+	}
+	if !holdsStruct(reflect.TypeOf(value)) {
+		return types.DefaultTypeAdapter.NativeToValue(value)
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Slice && v.IsNil() {
+		return types.NewDynamicList(a, []any{})
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return types.NewErr("%v", err)
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return types.NewErr("%v", err)
+	}
+	return a.NativeToValue(decoded)
+}
+
+// holdsStruct reports whether t is a struct, or a pointer, slice or array of
+// them.
+func holdsStruct(t reflect.Type) bool {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
@@ -0,0 +1,157 @@
+package filter
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestFilterAllow(t *testing.T) {
+	program, other := testkey.Key(1), testkey.Key(2)
+	account := testkey.Key(3)
+
+	tx := decodetest.TransactionMessage(10, program, account)
+	vote := decodetest.TransactionMessage(10, other)
+	vote.Update.GetTransaction().Transaction.IsVote = true
+	failed := decodetest.TransactionMessage(10, other)
+	failed.Update.GetTransaction().Transaction.Meta.Err = &proto.TransactionError{Err: []byte{1}}
+	// an inner instruction invoking program
+	inner := decodetest.TransactionMessage(10, other, program)
+	inner.Update.GetTransaction().Transaction.Meta.InnerInstructions = []*proto.InnerInstructions{{
+		Instructions: []*proto.InnerInstruction{{ProgramIdIndex: 0}},
+	}}
+	status := &decode.Message{Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_TransactionStatus{
+		TransactionStatus: &proto.SubscribeUpdateTransactionStatus{IsVote: true},
+	}}}
+	slot := decodetest.SlotMessage(10, 0, proto.CommitmentLevel_PROCESSED)
+	sourced := decodetest.SlotMessage(10, 0, proto.CommitmentLevel_PROCESSED)
+	sourced.Headers = map[string]string{decode.HeaderSource: "mainnet:10000"}
+	mainnet := map[string][]string{decode.HeaderSource: {"mainnet:10000", "backup:10000"}}
+	paid := decodetest.TransactionMessage(10, program, account)
+	paid.Update.GetTransaction().Transaction.Meta.PreBalances = []uint64{20000}
+	paid.Update.GetTransaction().Transaction.Meta.PostBalances = []uint64{15000}
+
+	tests := []struct {
+		name   string
+		config Config
+		msg    *decode.Message
+		reason string
+	}{
+		{"program include", Config{ProgramInclude: []string{testkey.String(1)}}, tx, ""},
+		{"program include misses", Config{ProgramInclude: []string{testkey.String(1)}}, vote, ReasonProgramInclude},
+		{"program include inner", Config{ProgramInclude: []string{testkey.String(1)}}, inner, ""},
+		{"program exclude", Config{ProgramExclude: []string{testkey.String(1)}}, tx, ReasonProgramExclude},
+		{"program exclude wins", Config{
+			ProgramInclude: []string{testkey.String(1)},
+			ProgramExclude: []string{testkey.String(1)},
+		}, tx, ReasonProgramExclude},
+		{"account include", Config{AccountInclude: []string{testkey.String(3)}}, tx, ""},
+		{"account include misses", Config{AccountInclude: []string{testkey.String(3)}}, vote, ReasonAccountInclude},
+		{"account exclude", Config{AccountExclude: []string{testkey.String(3)}}, tx, ReasonAccountExclude},
+		{"vote", Config{ExcludeVote: true}, vote, ReasonVote},
+		{"not vote", Config{ExcludeVote: true}, tx, ""},
+		{"failed", Config{ExcludeFailed: true}, failed, ReasonFailed},
+		{"vote status", Config{ExcludeVote: true}, status, ReasonVote},
+		{"status ignores programs", Config{ProgramInclude: []string{testkey.String(9)}}, status, ""},
+		{"other kinds pass", Config{ProgramInclude: []string{testkey.String(9)}, ExcludeVote: true}, slot, ""},
+		{"header include", Config{HeaderInclude: mainnet}, sourced, ""},
+		{"header include misses", Config{HeaderInclude: map[string][]string{decode.HeaderSource: {"devnet:10000"}}}, sourced, ReasonHeaderInclude},
+		{"header include without the header", Config{HeaderInclude: mainnet}, slot, ReasonHeaderInclude},
+		{"expression", Config{Expression: `"` + testkey.String(1) + `" in tx.programs && msg.slot == 10`}, inner, ""},
+		{"expression accounts", Config{Expression: `"` + testkey.String(3) + `" in tx.account_keys`}, vote, ReasonExpression},
+		{"expression meta", Config{Expression: "tx.meta.fee > 5000 // a comment"}, tx, ReasonExpression},
+		{"expression error", Config{Expression: "tx.meta.missing.field"}, tx, ReasonExpressionError},
+		{"expression ignores slots", Config{Expression: "false"}, slot, ""},
+		{"expression update", Config{Expression: "msg.update.transaction.slot == 10u && !msg.update.transaction.transaction.is_vote"}, tx, ""},
+		{"expression decoded", Config{Expression: "size(tx.swaps) == 0 && tx.compute_budget == null && tx.meta.fee == 0"}, tx, ""},
+		{"expression balance changes", Config{Expression: `tx.balance_changes.exists(c, c.account == "` + testkey.String(3) + `" && c.change == -5000)`}, paid, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, reason := f.Allow(tt.msg)
+			if ok != (tt.reason == "") || reason != tt.reason {
+				t.Fatalf("Allow = %v, %q, want reason %q", ok, reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNewFilter(t *testing.T) {
+	f, err := New(Config{})
+	if err != nil || f != nil {
+		t.Fatalf("NewFilter of an empty config = %v, %v, want nil", f, err)
+	}
+	if ok, _ := f.Allow(decodetest.TransactionMessage(1, testkey.Key(1))); !ok {
+		t.Fatal("nil filter dropped a transaction")
+	}
+	if _, err := New(Config{AccountExclude: []string{"short"}}); err == nil {
+		t.Fatal("NewFilter accepted an invalid key")
+	}
+	if _, err := New(Config{HeaderInclude: map[string][]string{decode.HeaderSource: nil}}); err == nil {
+		t.Fatal("NewFilter accepted a header without values")
+	}
+	if _, err := New(Config{Expression: "tx.meta.fee >"}); err == nil || !strings.Contains(err.Error(), "filter.expression: line 1") {
+		t.Fatalf("NewFilter of an invalid expression: %v", err)
+	}
+}
+
+func TestExpressionLazy(t *testing.T) {
+	msg := decodetest.TransactionMessage(10, testkey.Key(1))
+	msg.Update.GetTransaction().Transaction.Meta.LogMessages = slices.Repeat([]string{"Program log: swap"}, 1000)
+	allocs := func(expression string) float64 {
+		f, err := newExpressionFilter(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testing.AllocsPerRun(10, func() {
+			if _, err := f.match(msg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// the logs are only rendered for an expression reading them
+	if lazy, logs := allocs("msg.slot == 10 && tx.is_vote == false"), allocs("size(tx.meta.log_messages) > 0"); lazy*10 > logs {
+		t.Fatalf("%g allocations without reading the logs, %g reading them", lazy, logs)
+	}
+}
+
+func TestFilterEventInclude(t *testing.T) {
+	decode.DefaultIDLDecoder = decodetest.LoadIDLs(t)
+	t.Cleanup(func() { decode.DefaultIDLDecoder = nil })
+	filter, err := New(Config{EventInclude: []string{"Settled"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decodetest.TransactionMessage(10, testkey.Key(1))
+	if ok, reason := filter.Allow(msg); ok || reason != ReasonEventInclude {
+		t.Fatalf("got %v %s, want the transaction filtered", ok, reason)
+	}
+	msg.Update.GetTransaction().Transaction = decodetest.LoggedTransaction()
+	if ok, reason := filter.Allow(msg); !ok {
+		t.Fatalf("filtered by %s", reason)
+	}
+
+	out, err := decode.FormatJSON(decodetest.LoggedTransaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		ProgramLogs decode.ProgramLogs `json:"program_logs"`
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.ProgramLogs.Invocations) != 5 || decoded.ProgramLogs.Events[0].Name != "OrderPlaced" {
+		t.Fatalf("program_logs in %s", out)
+	}
+}
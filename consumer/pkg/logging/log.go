@@ -0,0 +1,81 @@
+// Package logging holds the logger shared by the packages of the consumer and
+// the log section of its configuration.
+package logging
+
+import (
+	"fmt"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// Level is shared by every logger built by NewLogger so it can be
+	// changed while running.
+	Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
+	// Logger is used by every package, the program replaces it once its
+	// config is loaded.
+	Logger = zap.Must(newLoggerConfig("console").Build())
+)
+
+type Config struct {
+	// Level is one of debug, info, warn or error.
+	Level string `json:"level" yaml:"level"`
+	// Format is console for human readable lines or json.
+	Format string `json:"format" yaml:"format"`
+}
+
+func (c *Config) Validate() error {
+	if _, err := zapcore.ParseLevel(c.Level); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+	if c.Format != "console" && c.Format != "json" {
+		return fmt.Errorf("log.format: expected console or json, got %q", c.Format)
+	}
+	return nil
+}
+
+// NewLogger builds the process logger and routes sarama's logs through it
+// at debug level.
+func NewLogger(config Config) (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	Level.SetLevel(level)
+
+	l, err := newLoggerConfig(config.Format).Build()
+	if err != nil {
+		return nil, err
+	}
+	saramaLogger, err := zap.NewStdLogAt(l.Named("sarama"), zap.DebugLevel)
+	if err != nil {
+		return nil, err
+	}
+	sarama.Logger = saramaLogger
+	return l, nil
+}
+
+func newLoggerConfig(format string) zap.Config {
+	config := zap.NewProductionConfig()
+	config.Level = Level
+	config.Encoding = format
+	config.Sampling = nil
+	config.DisableStacktrace = true
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	if format == "console" {
+		config.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	}
+	return config
+}
+
+// RecordFields locates a Kafka record in log lines.
+func RecordFields(record *sarama.ConsumerMessage) []zap.Field {
+	return []zap.Field{
+		zap.String("topic", record.Topic),
+		zap.Int32("partition", record.Partition),
+		zap.Int64("offset", record.Offset),
+	}
+}
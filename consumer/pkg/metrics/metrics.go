@@ -0,0 +1,570 @@
+// Package metrics holds the Prometheus collectors of the consumer, registered
+// with Registry, which a program embedding the pipeline serves or gathers to
+// expose them.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	MessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_messages_total",
+		Help: "Total number of consumed messages by topic and kind",
+	}, []string{"topic", "kind"})
+
+	DecodeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_decode_failures_total",
+		Help: "Total number of messages that failed to decode",
+	}, []string{"topic"})
+
+	FilteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_filtered_total",
+		Help: "Total number of messages dropped by the filter by reason",
+	}, []string{"topic", "reason"})
+
+	SamplingRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_sampling_rate",
+		Help: "1 of how many transactions decoding.sample keeps, the factor scaling their rates back up",
+	})
+
+	BytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_bytes_total",
+		Help: "Total number of payload bytes consumed",
+	}, []string{"topic"})
+
+	SinkRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_sink_retries_total",
+		Help: "Total number of retried sink writes",
+	})
+
+	ReorderDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_reorder_depth",
+		Help: "Updates held back by the slot reordering buffer",
+	})
+
+	ReorderLateTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_reorder_late_total",
+		Help: "Total number of updates dropped for arriving after a newer slot was written",
+	})
+
+	CommitmentPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_commitment_pending",
+		Help: "Updates held back until their slot reaches the commitment level",
+	})
+
+	CommitmentDiscardedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_commitment_discarded_total",
+		Help: "Total number of held updates discarded by reason",
+	}, []string{"reason"})
+
+	RollbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_rollbacks_total",
+		Help: "Total number of slots rolled back by reason",
+	}, []string{"reason"})
+
+	RollbackDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_rollback_dropped_total",
+		Help: "Total number of updates of rolled back slots dropped on arrival",
+	})
+
+	BlocksPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_blocks_pending",
+		Help: "Transactions and block metas held back until their block is complete",
+	})
+
+	BlocksWrittenTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_blocks_written_total",
+		Help: "Total number of blocks assembled from transactions and block metas",
+	})
+
+	BlocksIncompleteTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_blocks_incomplete_total",
+		Help: "Total number of blocks given up on as incomplete by reason",
+	}, []string{"reason"})
+
+	AccountDiffAccounts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_account_diff_accounts",
+		Help: "Accounts remembered to drop the updates leaving them unchanged",
+	})
+
+	AccountDiffUnchangedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_account_diff_unchanged_total",
+		Help: "Total number of account updates dropped as leaving the account unchanged",
+	})
+
+	SlotGapsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_slot_gaps_total",
+		Help: "Total number of runs of slots no update was consumed for",
+	})
+
+	MissingSlotsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_missing_slots_total",
+		Help: "Total number of slots in the reported gaps",
+	})
+
+	WebsocketClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_websocket_clients",
+		Help: "Connected WebSocket clients",
+	})
+
+	WebsocketSlowTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_websocket_slow_total",
+		Help: "Total number of WebSocket clients disconnected for falling behind",
+	})
+
+	GraphqlSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_graphql_subscriptions",
+		Help: "Active GraphQL subscriptions",
+	})
+
+	GraphqlSlowTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_graphql_slow_total",
+		Help: "Total number of GraphQL clients disconnected for falling behind",
+	})
+
+	QueryTransactions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_query_transactions",
+		Help: "Transactions kept for the query API",
+	})
+
+	QueryRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_query_requests_total",
+		Help: "Total number of query API requests by endpoint",
+	}, []string{"endpoint"})
+
+	GeyserClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_geyser_clients",
+		Help: "Open Yellowstone gRPC subscriptions",
+	})
+
+	GeyserSlowTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_geyser_slow_total",
+		Help: "Total number of gRPC subscriptions ended for falling behind",
+	})
+
+	WebhookRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_webhook_requests_total",
+		Help: "Total number of webhook requests by response status, error for network errors",
+	}, []string{"status"})
+
+	WebhookCircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_webhook_circuit_open",
+		Help: "1 while the webhook circuit breaker fails writes",
+	})
+
+	LookupTableRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_lookup_table_requests_total",
+		Help: "Total number of getMultipleAccounts requests reading lookup tables by result, ok or error",
+	}, []string{"result"})
+
+	LookupTableCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_lookup_table_cache_hits_total",
+		Help: "Total number of lookup tables served from the cache",
+	})
+
+	SwapsProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_swaps_produced_total",
+		Help: "Total number of swap records produced to the swaps topic",
+	})
+
+	MintsProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_mint_events_produced_total",
+		Help: "Total number of mint event records produced to the mints topic",
+	})
+
+	FeesUnitPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_fees_unit_price_micro_lamports",
+		Help: "Percentiles of the compute unit prices of the transactions of the last closed slots",
+	}, []string{"program", "quantile"})
+
+	FeesComputeUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_fees_compute_units",
+		Help: "Percentiles of the compute units consumed by the transactions of the last closed slots",
+	}, []string{"program", "quantile"})
+
+	FeeRecordsProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_fee_records_produced_total",
+		Help: "Total number of slot fee records produced to the fees topic",
+	})
+
+	ThroughputTPS = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_tps",
+		Help: "Non-vote transactions per second of the last closed window",
+	})
+
+	ThroughputTransactions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_window_transactions",
+		Help: "Transactions of the last closed window by program and status",
+	}, []string{"program", "status"})
+
+	ThroughputRecordsProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_throughput_records_produced_total",
+		Help: "Total number of window records produced to the throughput topic",
+	})
+
+	MEVEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_mev_events_total",
+		Help: "Total number of likely bundles and sandwiches detected by type",
+	}, []string{"type"})
+
+	MEVEventsProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_mev_events_produced_total",
+		Help: "Total number of MEV event records produced to the mev topic",
+	})
+
+	TransfersProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_transfers_produced_total",
+		Help: "Total number of balance change records produced to the transfers topic",
+	})
+
+	SlotCompletionPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_slot_completion_pending",
+		Help: "Slots whose transactions are not all written yet",
+	})
+
+	SlotCompletionExpiredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_slot_completion_expired_total",
+		Help: "Total number of slots given up on before all their transactions were written",
+	})
+
+	SlotCompletionsProducedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_slot_completions_produced_total",
+		Help: "Total number of complete slot records produced to the slot completion topic",
+	})
+
+	AlertsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_alerts_total",
+		Help: "Total number of alerts by destination and result: sent, failed, rate_limited or queue_full",
+	}, []string{"destination", "result"})
+
+	IDLDecodeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_idl_decode_failures_total",
+		Help: "Total number of instructions and events matching an IDL that failed to decode by program",
+	}, []string{"program"})
+
+	NATSDuplicatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_nats_duplicates_total",
+		Help: "Total number of NATS publishes JetStream acknowledged as duplicates",
+	})
+
+	ElasticsearchRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_elasticsearch_requests_total",
+		Help: "Total number of Elasticsearch requests by response status, error for network errors",
+	}, []string{"status"})
+
+	FileRotationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_file_rotations_total",
+		Help: "Total number of files finished by the file sink",
+	})
+
+	FileUploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_file_uploads_total",
+		Help: "Total number of upload commands run for finished files by result, ok or error",
+	}, []string{"result"})
+
+	ProducerReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc2kafka_received_total",
+		Help: "Total number of updates received from gRPC by kind",
+	}, []string{"kind"})
+
+	ProducerSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc2kafka_sent_total",
+		Help: "Total number of records acknowledged by Kafka by kind",
+	}, []string{"kind"})
+
+	ProducerFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc2kafka_failures_total",
+		Help: "Total number of records Kafka failed to accept by kind",
+	}, []string{"kind"})
+
+	DedupReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dedup_received_total",
+		Help: "Total number of records consumed by dedup by input topic",
+	}, []string{"topic"})
+
+	DedupDuplicatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dedup_duplicates_total",
+		Help: "Total number of records dropped as duplicates by input topic",
+	}, []string{"topic"})
+
+	DedupSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dedup_sent_total",
+		Help: "Total number of records produced to the dedup output topic",
+	})
+
+	DedupCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dedup_cache_hashes",
+		Help: "Record hashes currently remembered by dedup",
+	})
+
+	SignatureCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_signature_dedup_cache_size",
+		Help: "Signatures currently remembered by processing.signature_dedup",
+	})
+
+	CommitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_commits_total",
+		Help: "Total number of offset commits",
+	})
+
+	CommitFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_commit_failures_total",
+		Help: "Total number of failed offset commit requests by reason",
+	}, []string{"reason"})
+
+	PartitionLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_partition_lag",
+		Help: "Messages between the last consumed offset and the high water mark",
+	}, []string{"topic", "partition"})
+
+	SecondsBehindHead = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_seconds_behind_head",
+		Help: "Moving average of the age of the last message processed on the partitions with unread messages",
+	})
+
+	OffsetOutOfRangeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_offset_out_of_range_total",
+		Help: "Total number of committed offsets found out of the retained range by fallback",
+	}, []string{"topic", "fallback"})
+
+	DLQMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_dlq_messages_total",
+		Help: "Total number of messages sent to the dead-letter topic by failed stage",
+	}, []string{"stage"})
+
+	DLQFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_dlq_failures_total",
+		Help: "Total number of messages that could not be sent to the dead-letter topic",
+	})
+
+	RetryTopicMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_retry_topic_messages_total",
+		Help: "Total number of messages produced to a retry topic by retry topic",
+	}, []string{"topic"})
+
+	RetryTopicsWaiting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_retry_topics_waiting",
+		Help: "Number of claims of retry topics waiting for their next record to be due",
+	})
+
+	ConfigReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_config_reloads_total",
+		Help: "Total number of config reloads by result, applied or rejected",
+	}, []string{"result"})
+
+	AdminRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_admin_requests_total",
+		Help: "Total number of authorized admin API actions by action",
+	}, []string{"action"})
+
+	LazyDecodeSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_lazy_decode_skipped_total",
+		Help: "Total number of pruned transactions the filter dropped before a full decode",
+	}, []string{"topic"})
+
+	DiscoveredTopics = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_discovered_topics",
+		Help: "Number of topics consumed after the last lookup of kafka.topic_pattern",
+	})
+
+	FailoverActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_failover_active",
+		Help: "1 while the secondary cluster is consumed",
+	})
+
+	FailoverSwitchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_failover_switches_total",
+		Help: "Total number of switches between the clusters by the cluster switched to",
+	}, []string{"to"})
+
+	RouteMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_route_messages_total",
+		Help: "Total number of messages written to the sink of a route",
+	}, []string{"route"})
+
+	RouteErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_route_errors_total",
+		Help: "Total number of messages a route with on_error skip failed to write",
+	}, []string{"route"})
+
+	MiddlewareMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_middleware_messages_total",
+		Help: "Total number of messages seen by a metrics middleware by step and kind",
+	}, []string{"middleware", "kind"})
+
+	MiddlewareDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consumer_middleware_duration_seconds",
+		Help:    "Time the steps after a metrics middleware took per message",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"middleware"})
+
+	MiddlewareDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_middleware_dropped_total",
+		Help: "Total number of messages dropped by a sample or lua middleware by step",
+	}, []string{"middleware"})
+
+	ThrottleWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_throttle_waiting",
+		Help: "Number of claims held back by a throttle limit, by limit",
+	}, []string{"limit"})
+
+	ThrottleWaitSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_throttle_wait_seconds_total",
+		Help: "Total time claims were held back by a throttle limit, by limit",
+	}, []string{"limit"})
+
+	InflightMessages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_inflight_messages",
+		Help: "Number of messages dispatched and not yet acknowledged by the sink",
+	})
+
+	PartitionsPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_partitions_paused",
+		Help: "1 while fetching from the partitions is paused by backpressure",
+	})
+
+	PausesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_pauses_total",
+		Help: "Total number of times backpressure paused the partitions",
+	})
+
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consumer_handler_duration_seconds",
+		Help:    "Time spent handling a decoded message",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"kind"})
+
+	ConsumeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consumer_consume_latency_seconds",
+		Help:    "Time from the production of a message to its decoding",
+		Buckets: latencyBuckets,
+	}, []string{"topic"})
+
+	SinkAckLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consumer_sink_ack_latency_seconds",
+		Help:    "Time from the production of a message to its acknowledgement by the sink",
+		Buckets: latencyBuckets,
+	}, []string{"topic"})
+)
+
+// latencyBuckets range from 5ms to about 3 minutes behind.
+var latencyBuckets = prometheus.ExponentialBuckets(0.005, 2, 16)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MessagesTotal,
+		DecodeFailuresTotal,
+		LazyDecodeSkippedTotal,
+		FilteredTotal,
+		SamplingRate,
+		BytesTotal,
+		SinkRetriesTotal,
+		ReorderDepth,
+		ReorderLateTotal,
+		CommitmentPending,
+		CommitmentDiscardedTotal,
+		RollbacksTotal,
+		RollbackDroppedTotal,
+		BlocksPending,
+		BlocksWrittenTotal,
+		BlocksIncompleteTotal,
+		AccountDiffAccounts,
+		AccountDiffUnchangedTotal,
+		SlotGapsTotal,
+		MissingSlotsTotal,
+		WebsocketClients,
+		WebsocketSlowTotal,
+		GraphqlSubscriptions,
+		GraphqlSlowTotal,
+		QueryTransactions,
+		QueryRequestsTotal,
+		GeyserClients,
+		GeyserSlowTotal,
+		WebhookRequestsTotal,
+		WebhookCircuitOpen,
+		LookupTableRequestsTotal,
+		LookupTableCacheHitsTotal,
+		TransfersProducedTotal,
+		SwapsProducedTotal,
+		MintsProducedTotal,
+		FeesUnitPrice,
+		FeesComputeUnits,
+		FeeRecordsProducedTotal,
+		ThroughputTPS,
+		ThroughputTransactions,
+		ThroughputRecordsProducedTotal,
+		MEVEventsTotal,
+		MEVEventsProducedTotal,
+		SlotCompletionPending,
+		SlotCompletionExpiredTotal,
+		SlotCompletionsProducedTotal,
+		AlertsTotal,
+		IDLDecodeFailuresTotal,
+		NATSDuplicatesTotal,
+		ElasticsearchRequestsTotal,
+		FileRotationsTotal,
+		FileUploadsTotal,
+		ProducerReceivedTotal,
+		ProducerSentTotal,
+		ProducerFailuresTotal,
+		DedupReceivedTotal,
+		DedupDuplicatesTotal,
+		DedupSentTotal,
+		DedupCacheSize,
+		SignatureCacheSize,
+		CommitsTotal,
+		CommitFailuresTotal,
+		PartitionLag,
+		SecondsBehindHead,
+		OffsetOutOfRangeTotal,
+		DLQMessagesTotal,
+		DLQFailuresTotal,
+		RetryTopicMessagesTotal,
+		RetryTopicsWaiting,
+		ConfigReloadsTotal,
+		AdminRequestsTotal,
+		DiscoveredTopics,
+		FailoverActive,
+		FailoverSwitchesTotal,
+		RouteMessagesTotal,
+		RouteErrorsTotal,
+		MiddlewareMessagesTotal,
+		MiddlewareDuration,
+		MiddlewareDroppedTotal,
+		ThrottleWaiting,
+		ThrottleWaitSeconds,
+		InflightMessages,
+		PartitionsPaused,
+		PausesTotal,
+		HandlerDuration,
+		ConsumeLatency,
+		SinkAckLatency,
+	)
+}
+
+func SetPartitionLag(topic string, partition int32, highWaterMark, offset int64) {
+	// the high water mark is the offset of the next message to be produced
+	lag := highWaterMark - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	PartitionLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+}
+
+// ObserveLatency records the time since a message was produced, if known.
+// Clock skew between the hosts can make it negative, which counts as none.
+func ObserveLatency(histogram *prometheus.HistogramVec, topic string, produced time.Time) {
+	if produced.IsZero() {
+		return
+	}
+	histogram.WithLabelValues(topic).Observe(max(time.Since(produced).Seconds(), 0))
+}
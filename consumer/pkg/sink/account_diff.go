@@ -0,0 +1,172 @@
+package sink
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"sync"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// Headers AccountDiffSink sets on the account updates it writes.
+const (
+	headerDataChanged     = "data_changed"
+	headerLamportsChanged = "lamports_changed"
+)
+
+// AccountDiffConfig drops the account updates rewriting an account with the
+// data it already had.
+type AccountDiffConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// MaxAccounts bounds the accounts remembered, the least recently updated
+	// are forgotten first and their next update is written as changed.
+	MaxAccounts int `json:"max_accounts" yaml:"max_accounts"`
+	// Lamports also writes the updates changing only the lamports.
+	Lamports bool `json:"lamports" yaml:"lamports"`
+}
+
+func (c *AccountDiffConfig) Validate() error {
+	if c.Enable && c.MaxAccounts <= 0 {
+		return errors.New("processing.account_diff.max_accounts: must be positive")
+	}
+	return nil
+}
+
+// AccountDiffSink remembers a hash of the owner, the executable flag and the
+// data of every account written, and drops the account updates leaving it
+// unchanged. The updates written carry the data_changed and
+// lamports_changed headers, comparing them to the update of the account
+// written last. An update older than that one, in slot and write version, is
+// written through and leaves the account as it was. Every other update is
+// written through.
+type AccountDiffSink struct {
+	next        Sink
+	maxAccounts int
+	lamports    bool
+
+	mu       sync.Mutex
+	accounts map[string]*list.Element
+	// lru holds the accounts, most recently written first.
+	lru *list.List
+}
+
+// accountState is what an account written last was.
+type accountState struct {
+	pubkey       string
+	hash         [32]byte
+	lamports     uint64
+	slot         uint64
+	writeVersion uint64
+}
+
+func NewAccountDiffSink(next Sink, config AccountDiffConfig) *AccountDiffSink {
+	return &AccountDiffSink{
+		next:        next,
+		maxAccounts: config.MaxAccounts,
+		lamports:    config.Lamports,
+		accounts:    make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+func (s *AccountDiffSink) Write(ctx context.Context, msg *decode.Message) error {
+	update := msg.Update.GetAccount()
+	info := update.GetAccount()
+	if info == nil {
+		return s.next.Write(ctx, msg)
+	}
+	state := accountState{
+		pubkey:       string(info.GetPubkey()),
+		hash:         accountHash(info),
+		lamports:     info.GetLamports(),
+		slot:         update.GetSlot(),
+		writeVersion: info.GetWriteVersion(),
+	}
+
+	s.mu.Lock()
+	var previous *accountState
+	if element, ok := s.accounts[state.pubkey]; ok {
+		previous = element.Value.(*accountState)
+	}
+	s.mu.Unlock()
+	if previous != nil && previous.newer(state) {
+		return s.next.Write(ctx, msg)
+	}
+	dataChanged := previous == nil || previous.hash != state.hash
+	lamportsChanged := previous == nil || previous.lamports != state.lamports
+	if !dataChanged && (!lamportsChanged || !s.lamports) {
+		metrics.AccountDiffUnchangedTotal.Inc()
+		return nil
+	}
+
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string, 2)
+	}
+	msg.Headers[headerDataChanged] = strconv.FormatBool(dataChanged)
+	msg.Headers[headerLamportsChanged] = strconv.FormatBool(lamportsChanged)
+	if err := s.next.Write(ctx, msg); err != nil {
+		return err
+	}
+	s.store(&state)
+	return nil
+}
+
+// newer reports whether a is a later update of the account than b.
+func (a *accountState) newer(b accountState) bool {
+	if a.slot != b.slot {
+		return a.slot > b.slot
+	}
+	return a.writeVersion > b.writeVersion
+}
+
+// store remembers state as the account written last, forgetting the least
+// recently written account beyond maxAccounts.
+func (s *AccountDiffSink) store(state *accountState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.accounts[state.pubkey]; ok {
+		// a concurrent write of the account may have stored a later update
+		if element.Value.(*accountState).newer(*state) {
+			return
+		}
+		element.Value = state
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.accounts[state.pubkey] = s.lru.PushFront(state)
+	if s.lru.Len() > s.maxAccounts {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.accounts, oldest.Value.(*accountState).pubkey)
+	}
+	metrics.AccountDiffAccounts.Set(float64(s.lru.Len()))
+}
+
+// accountHash hashes what an account update compares by besides the
+// lamports.
+func accountHash(info *proto.SubscribeUpdateAccountInfo) [32]byte {
+	h := sha256.New()
+	h.Write(info.GetOwner())
+	if info.GetExecutable() {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write(info.GetData())
+	var hash [32]byte
+	h.Sum(hash[:0])
+	return hash
+}
+
+func (s *AccountDiffSink) Flush(ctx context.Context) error {
+	return s.next.Flush(ctx)
+}
+
+func (s *AccountDiffSink) Close() error {
+	return s.next.Close()
+}
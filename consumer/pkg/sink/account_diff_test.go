@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// accountUpdate returns an update of the account n of slot with data and
+// lamports.
+func accountUpdate(slot uint64, n byte, data string, lamports uint64) *decode.Message {
+	msg := decodetest.AccountMessage(slot, testkey.Key(n), testkey.Key(0))
+	info := msg.Update.GetAccount().GetAccount()
+	info.Data, info.Lamports = []byte(data), lamports
+	return msg
+}
+
+func TestAccountDiffSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewAccountDiffSink(next, AccountDiffConfig{Enable: true, MaxAccounts: 2})
+	ctx := context.Background()
+
+	for _, msg := range []*decode.Message{
+		accountUpdate(10, 1, "a", 5),
+		// unchanged
+		accountUpdate(11, 1, "a", 5),
+		// only the lamports changed
+		accountUpdate(12, 1, "a", 6),
+		accountUpdate(13, 1, "b", 6),
+		// older than the update written last
+		accountUpdate(9, 1, "b", 6),
+		decodetest.SlotMessage(14, 13, proto.CommitmentLevel_PROCESSED),
+	} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := next.Slots(); !slices.Equal(got, []uint64{10, 13, 9, 14}) {
+		t.Fatalf("written %v", got)
+	}
+	if headers := next.Written[1].Headers; headers[headerDataChanged] != "true" || headers[headerLamportsChanged] != "true" {
+		t.Fatalf("headers %v", headers)
+	}
+	if s.accounts[string(testkey.Key(1))].Value.(*accountState).slot != 13 {
+		t.Fatal("older update remembered")
+	}
+
+	// a failed write leaves the account to the retry
+	next.Fail = map[uint64]error{15: errors.New("unavailable")}
+	if err := s.Write(ctx, accountUpdate(15, 1, "c", 6)); err == nil {
+		t.Fatal("failed write not reported")
+	}
+	next.Fail = nil
+	msg := accountUpdate(15, 1, "c", 6)
+	if err := s.Write(ctx, msg); err != nil || len(next.Written) != 5 || msg.Headers[headerLamportsChanged] != "false" {
+		t.Fatalf("retry: %v, headers %v", err, msg.Headers)
+	}
+
+	// the least recently written account is forgotten
+	s.Write(ctx, accountUpdate(16, 2, "a", 1))
+	s.Write(ctx, accountUpdate(16, 3, "a", 1))
+	if err := s.Write(ctx, accountUpdate(17, 1, "c", 6)); err != nil || len(next.Written) != 8 || len(s.accounts) != 2 {
+		t.Fatalf("written %d, accounts %d", len(next.Written), len(s.accounts))
+	}
+}
+
+func TestAccountDiffSinkLamports(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewAccountDiffSink(next, AccountDiffConfig{Enable: true, MaxAccounts: 10, Lamports: true})
+	ctx := context.Background()
+	s.Write(ctx, accountUpdate(10, 1, "a", 5))
+	s.Write(ctx, accountUpdate(11, 1, "a", 5))
+	msg := accountUpdate(12, 1, "a", 6)
+	if err := s.Write(ctx, msg); err != nil || len(next.Written) != 2 {
+		t.Fatalf("lamports change not written, %v", err)
+	}
+	if msg.Headers[headerDataChanged] != "false" || msg.Headers[headerLamportsChanged] != "true" {
+		t.Fatalf("headers %v", msg.Headers)
+	}
+}
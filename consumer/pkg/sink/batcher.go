@@ -0,0 +1,121 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"consumer/pkg/logging"
+	"consumer/pkg/tracing"
+)
+
+// batcher buffers rows for sinks that write in batches. Rows are handed to
+// flush when the batch is full, when the interval elapses and on close. A
+// failed flush keeps its rows in front of the buffer for the next attempt,
+// and Add rejects new rows while a full batch cannot be flushed.
+type batcher[T any] struct {
+	name  string
+	size  int
+	flush func(ctx context.Context, rows []T) error
+
+	mu   sync.Mutex
+	rows []T
+
+	// flushMu keeps batches in write order.
+	flushMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBatcher[T any](name string, size int, interval time.Duration, flush func(ctx context.Context, rows []T) error) *batcher[T] {
+	b := &batcher[T]{
+		name:  name,
+		size:  size,
+		flush: flush,
+		rows:  make([]T, 0, size),
+		done:  make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.flushLoop(interval)
+	return b
+}
+
+// Add buffers row, flushing the full batch first. When that flush fails row
+// is not buffered, so the caller can retry it.
+func (b *batcher[T]) Add(ctx context.Context, row T) error {
+	b.mu.Lock()
+	full := len(b.rows) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		if err := b.Flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	b.rows = append(b.rows, row)
+	b.mu.Unlock()
+	return nil
+}
+
+// Flush writes the buffered rows, a nil batcher has nothing to flush.
+func (b *batcher[T]) Flush(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	rows := b.rows
+	b.rows = make([]T, 0, b.size)
+	b.mu.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+	ctx, span := tracing.Tracer.Start(ctx, b.name+" flush", trace.WithAttributes(attribute.Int("rows", len(rows))))
+	err := b.flush(ctx, rows)
+	tracing.EndSpan(span, err)
+	if err != nil {
+		b.mu.Lock()
+		b.rows = append(rows, b.rows...)
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (b *batcher[T]) flushLoop(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			if err := b.Flush(context.Background()); err != nil {
+				logging.Logger.Error("sink flush failed", zap.String("sink", b.name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Close stops the interval flushes and flushes what is left.
+func (b *batcher[T]) Close() error {
+	if b == nil {
+		return nil
+	}
+	close(b.done)
+	b.wg.Wait()
+	return b.Flush(context.Background())
+}
@@ -0,0 +1,267 @@
+package sink
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// Reasons for writing or discarding an incomplete block.
+const (
+	incompleteNoMeta       = "no_meta"
+	incompleteTransactions = "missing_transactions"
+)
+
+// BlocksConfig assembles the transactions and the block meta of a slot into
+// a single block update.
+type BlocksConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// MaxPendingSlots gives up on the blocks this many slots older than the
+	// newest block meta that are still incomplete.
+	MaxPendingSlots uint64 `json:"max_pending_slots" yaml:"max_pending_slots"`
+	// WriteIncomplete writes the blocks given up on with the transactions
+	// consumed so far instead of discarding them, provided their meta
+	// arrived.
+	WriteIncomplete bool `json:"write_incomplete" yaml:"write_incomplete"`
+}
+
+func (c *BlocksConfig) Validate() error {
+	if c.Enable && c.MaxPendingSlots == 0 {
+		return errors.New("processing.blocks.max_pending_slots: must be positive")
+	}
+	return nil
+}
+
+// BlockSink holds the transactions and the block meta of every slot and
+// writes them to the next sink as one block update once the block meta
+// arrived along with as many transactions as it executed. The transactions
+// are sorted by their index in the block, a transaction consumed again after
+// a rebalance replaces the copy held before. Every other update is written
+// through.
+//
+// Held updates keep their offsets from being committed, see Message.Hold,
+// until their block was written or given up on.
+type BlockSink struct {
+	next            Sink
+	maxPending      uint64
+	writeIncomplete bool
+
+	mu      sync.Mutex
+	pending map[uint64]*pendingBlock
+	// newest is the newest slot a block meta was consumed for.
+	newest uint64
+}
+
+type pendingBlock struct {
+	meta *heldMessage
+	// transactions are keyed by signature.
+	transactions map[string]*heldMessage
+}
+
+func NewBlockSink(next Sink, config BlocksConfig) *BlockSink {
+	return &BlockSink{
+		next:            next,
+		maxPending:      config.MaxPendingSlots,
+		writeIncomplete: config.WriteIncomplete,
+		pending:         make(map[uint64]*pendingBlock),
+	}
+}
+
+func (s *BlockSink) Write(ctx context.Context, msg *decode.Message) error {
+	meta := msg.Update.GetBlockMeta()
+	info := msg.Update.GetTransaction().GetTransaction()
+	if msg.Slot == 0 || meta == nil && info == nil {
+		return s.next.Write(ctx, msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Slot+s.maxPending < s.newest {
+		logging.Logger.Debug("update of a block given up on, dropped", decode.MessageFields(msg)...)
+		return nil
+	}
+	if meta != nil && msg.Slot > s.newest {
+		if err := s.expire(ctx, msg.Slot); err != nil {
+			return err
+		}
+		s.newest = msg.Slot
+	}
+	block := s.pending[msg.Slot]
+	if block == nil {
+		block = &pendingBlock{transactions: make(map[string]*heldMessage)}
+		s.pending[msg.Slot] = block
+	}
+	// msg is only held when this Write does not write its block
+	held := &heldMessage{msg: msg}
+	signature := string(info.GetSignature())
+	replaced := block.swap(meta != nil, signature, held)
+	if block.complete() {
+		if err := s.write(ctx, msg.Slot, block); err != nil {
+			// the retry of msg adds it again
+			block.swap(meta != nil, signature, replaced)
+			return err
+		}
+		if replaced != nil {
+			replaced.complete()
+			metrics.BlocksPending.Dec()
+		}
+		return nil
+	}
+	held.complete = msg.Hold()
+	if replaced != nil {
+		replaced.complete()
+	} else {
+		metrics.BlocksPending.Inc()
+	}
+	return nil
+}
+
+// swap puts held in place of the meta or the transaction of signature of b,
+// removing it when nil, and returns the update it replaced.
+func (b *pendingBlock) swap(meta bool, signature string, held *heldMessage) *heldMessage {
+	if meta {
+		replaced := b.meta
+		b.meta = held
+		return replaced
+	}
+	replaced := b.transactions[signature]
+	if held == nil {
+		delete(b.transactions, signature)
+	} else {
+		b.transactions[signature] = held
+	}
+	return replaced
+}
+
+// complete reports whether the meta of b arrived along with all the
+// transactions it executed.
+func (b *pendingBlock) complete() bool {
+	return b.meta != nil && uint64(len(b.transactions)) >= b.meta.msg.Update.GetBlockMeta().GetExecutedTransactionCount()
+}
+
+// write writes the block of slot, its updates are completed once the next
+// sink completed the block. They stay held when the next sink rejects it.
+func (s *BlockSink) write(ctx context.Context, slot uint64, b *pendingBlock) error {
+	msg := b.message()
+	held := b.Held()
+	msg.Complete = sync.OnceFunc(func() {
+		for _, h := range held {
+			// the update of the Write completing the block is not held
+			if h.complete != nil {
+				h.complete()
+				metrics.BlocksPending.Dec()
+			}
+		}
+	})
+	if err := WriteHeld(ctx, s.next, msg, msg.Complete); err != nil {
+		return fmt.Errorf("write block of slot %d: %w", slot, err)
+	}
+	delete(s.pending, slot)
+	metrics.BlocksWrittenTotal.Inc()
+	return nil
+}
+
+// Held returns the meta and the transactions of b.
+func (b *pendingBlock) Held() []*heldMessage {
+	held := slices.Collect(maps.Values(b.transactions))
+	if b.meta != nil {
+		held = append(held, b.meta)
+	}
+	return held
+}
+
+// message returns the block update of b, written as the record of its meta.
+func (b *pendingBlock) message() *decode.Message {
+	source := b.meta.msg
+	meta := source.Update.GetBlockMeta()
+	transactions := make([]*proto.SubscribeUpdateTransactionInfo, 0, len(b.transactions))
+	for _, held := range b.transactions {
+		transactions = append(transactions, held.msg.Update.GetTransaction().GetTransaction())
+	}
+	slices.SortFunc(transactions, func(a, b *proto.SubscribeUpdateTransactionInfo) int {
+		return cmp.Compare(a.GetIndex(), b.GetIndex())
+	})
+	return &decode.Message{
+		Topic:     source.Topic,
+		Partition: source.Partition,
+		Offset:    source.Offset,
+		Key:       source.Key,
+		Timestamp: source.Timestamp,
+		Headers:   source.Headers,
+		Slot:      source.Slot,
+		Update: &proto.SubscribeUpdate{
+			Filters:   source.Update.GetFilters(),
+			CreatedAt: source.Update.GetCreatedAt(),
+			UpdateOneof: &proto.SubscribeUpdate_Block{Block: &proto.SubscribeUpdateBlock{
+				Slot:                     meta.GetSlot(),
+				Blockhash:                meta.GetBlockhash(),
+				Rewards:                  meta.GetRewards(),
+				BlockTime:                meta.GetBlockTime(),
+				BlockHeight:              meta.GetBlockHeight(),
+				ParentSlot:               meta.GetParentSlot(),
+				ParentBlockhash:          meta.GetParentBlockhash(),
+				ExecutedTransactionCount: meta.GetExecutedTransactionCount(),
+				Transactions:             transactions,
+				EntriesCount:             meta.GetEntriesCount(),
+			}},
+		},
+	}
+}
+
+// expire gives up on the blocks of slots far enough behind newest, the slot
+// of a new block meta.
+func (s *BlockSink) expire(ctx context.Context, newest uint64) error {
+	if newest <= s.maxPending {
+		return nil
+	}
+	horizon := newest - s.maxPending
+	for _, slot := range slices.Sorted(maps.Keys(s.pending)) {
+		if slot >= horizon {
+			break
+		}
+		block := s.pending[slot]
+		reason := incompleteTransactions
+		if block.meta == nil {
+			reason = incompleteNoMeta
+		}
+		logging.Logger.Warn("giving up on an incomplete block", zap.Uint64("slot", slot), zap.String("reason", reason),
+			zap.Int("transactions", len(block.transactions)))
+		metrics.BlocksIncompleteTotal.WithLabelValues(reason).Inc()
+		if s.writeIncomplete && block.meta != nil {
+			if err := s.write(ctx, slot, block); err != nil {
+				return err
+			}
+			continue
+		}
+		held := block.Held()
+		for _, h := range held {
+			h.complete()
+		}
+		metrics.BlocksPending.Sub(float64(len(held)))
+		delete(s.pending, slot)
+	}
+	return nil
+}
+
+// Flush only flushes the next sink, held updates are written once their
+// block is complete.
+func (s *BlockSink) Flush(ctx context.Context) error {
+	return s.next.Flush(ctx)
+}
+
+// Close drops the held updates, their offsets were not committed so they are
+// consumed again after a restart.
+func (s *BlockSink) Close() error {
+	return s.next.Close()
+}
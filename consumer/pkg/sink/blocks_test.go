@@ -0,0 +1,116 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// blockTransaction returns the transaction at index of the block of slot.
+func blockTransaction(slot uint64, index uint64, offset int64, completed map[int64]int) *decode.Message {
+	msg := heldTransaction(slot, offset, completed)
+	info := msg.Update.GetTransaction().GetTransaction()
+	info.Signature, info.Index = testkey.Key(byte(index)), index
+	return msg
+}
+
+// blockMeta returns the block meta of slot executing count transactions.
+func blockMeta(slot, count uint64, offset int64, completed map[int64]int) *decode.Message {
+	return &decode.Message{
+		Topic:  "blocks",
+		Offset: offset,
+		Slot:   slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{BlockMeta: &proto.SubscribeUpdateBlockMeta{
+			Slot:                     slot,
+			Blockhash:                "hash",
+			ParentSlot:               slot - 1,
+			ExecutedTransactionCount: count,
+		}}},
+		Complete: func() { completed[offset]++ },
+	}
+}
+
+func TestBlockSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewBlockSink(next, BlocksConfig{Enable: true, MaxPendingSlots: 100})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	// a transaction consumed again replaces the copy held
+	for _, msg := range []*decode.Message{blockTransaction(10, 1, 0, completed), blockTransaction(10, 1, 1, completed), blockTransaction(10, 0, 2, completed)} {
+		if err := s.Write(ctx, msg); err != nil || !msg.Held() {
+			t.Fatalf("transaction not held, %v", err)
+		}
+	}
+	if len(next.Written) != 0 || completed[0] != 1 {
+		t.Fatalf("written %d, completed %v", len(next.Written), completed)
+	}
+	slot := decodetest.SlotMessage(10, 9, proto.CommitmentLevel_PROCESSED)
+	if err := s.Write(ctx, slot); err != nil || len(next.Written) != 1 {
+		t.Fatal("slot update not written through")
+	}
+
+	meta := blockMeta(10, 2, 3, completed)
+	if err := s.Write(ctx, meta); err != nil || meta.Held() {
+		t.Fatalf("meta completing the block held, %v", err)
+	}
+	block := next.Written[1].Update.GetBlock()
+	if block.GetBlockhash() != "hash" || block.GetParentSlot() != 9 || len(block.GetTransactions()) != 2 ||
+		block.GetTransactions()[0].GetIndex() != 0 || next.Written[1].Offset != 3 {
+		t.Fatalf("block %v", block)
+	}
+	if completed[0] != 1 || completed[1] != 1 || completed[2] != 1 || completed[3] != 0 || len(s.pending) != 0 {
+		t.Fatalf("completed %v", completed)
+	}
+
+	// the next sink failing the block leaves the update to the retry
+	next.Fail = map[uint64]error{11: errors.New("unavailable")}
+	s.Write(ctx, blockTransaction(11, 0, 4, completed))
+	meta = blockMeta(11, 1, 5, completed)
+	if err := s.Write(ctx, meta); err == nil || meta.Held() {
+		t.Fatalf("got %v, held %t", err, meta.Held())
+	}
+	next.Fail = nil
+	if err := s.Write(ctx, meta); err != nil || len(next.Written) != 3 || completed[4] != 1 {
+		t.Fatalf("retry: %v, completed %v", err, completed)
+	}
+}
+
+func TestBlockSinkIncomplete(t *testing.T) {
+	for _, writeIncomplete := range []bool{false, true} {
+		next := &sinktest.RecordSink{}
+		s := NewBlockSink(next, BlocksConfig{Enable: true, MaxPendingSlots: 10, WriteIncomplete: writeIncomplete})
+		ctx := context.Background()
+		completed := make(map[int64]int)
+
+		s.Write(ctx, blockTransaction(10, 0, 0, completed))
+		s.Write(ctx, blockMeta(10, 2, 1, completed))
+		// its meta never arrives
+		s.Write(ctx, blockTransaction(11, 0, 2, completed))
+		s.Write(ctx, blockMeta(30, 0, 3, completed))
+
+		want := []uint64{30}
+		if writeIncomplete {
+			want = []uint64{10, 30}
+		}
+		if got := next.Slots(); !slices.Equal(got, want) {
+			t.Fatalf("write incomplete %t: written %v, want %v", writeIncomplete, got, want)
+		}
+		if completed[0] != 1 || completed[1] != 1 || completed[2] != 1 || len(s.pending) != 0 {
+			t.Fatalf("completed %v, pending %v", completed, s.pending)
+		}
+
+		// an update of a block given up on is dropped
+		late := blockTransaction(11, 1, 4, completed)
+		if err := s.Write(ctx, late); err != nil || late.Held() || len(next.Written) != len(want) {
+			t.Fatal("late update held or written")
+		}
+	}
+}
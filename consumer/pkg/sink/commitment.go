@@ -0,0 +1,222 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// Reasons for discarding held updates.
+const (
+	DiscardDead    = "dead"
+	DiscardSkipped = "skipped"
+	discardExpired = "expired"
+)
+
+// CommitmentConfig holds updates back until their slot reaches a commitment
+// level, as reported by the slot updates consumed alongside them.
+type CommitmentConfig struct {
+	// Level is processed to write updates as they arrive, confirmed or
+	// finalized.
+	Level string `json:"level" yaml:"level"`
+	// MaxPendingSlots discards the updates of slots this far behind the
+	// newest finalized slot that never reached Level.
+	MaxPendingSlots uint64 `json:"max_pending_slots" yaml:"max_pending_slots"`
+}
+
+func (c *CommitmentConfig) Validate() error {
+	switch c.Level {
+	case decode.CommitmentProcessed, decode.CommitmentConfirmed, decode.CommitmentFinalized:
+	default:
+		return fmt.Errorf("processing.commitment.level: expected processed, confirmed or finalized, got %q", c.Level)
+	}
+	if c.MaxPendingSlots == 0 {
+		return errors.New("processing.commitment.max_pending_slots: must be positive")
+	}
+	return nil
+}
+
+// CommitmentSink writes slot updates through and holds every other update
+// until its slot is confirmed or finalized. Updates of slots that die or are
+// skipped by the finalized chain are discarded. Held updates keep their
+// offsets from being committed, see Message.Hold.
+type CommitmentSink struct {
+	next       Sink
+	finalized  bool
+	maxPending uint64
+
+	mu      sync.Mutex
+	pending map[uint64][]*heldMessage
+	// held indexes pending by record, a record consumed again after a
+	// rebalance replaces the copy held before.
+	held map[heldRecord]*heldMessage
+	// reached are the slots at the level, dropped the slots that will never
+	// get there.
+	reached map[uint64]struct{}
+	dropped map[uint64]string
+	// newestFinalized is the highest slot seen finalized.
+	newestFinalized uint64
+}
+
+type heldMessage struct {
+	msg      *decode.Message
+	complete func()
+}
+
+type heldRecord struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+func recordOf(msg *decode.Message) heldRecord {
+	return heldRecord{msg.Topic, msg.Partition, msg.Offset}
+}
+
+func NewCommitmentSink(next Sink, config CommitmentConfig) *CommitmentSink {
+	return &CommitmentSink{
+		next:       next,
+		finalized:  config.Level == decode.CommitmentFinalized,
+		maxPending: config.MaxPendingSlots,
+		pending:    make(map[uint64][]*heldMessage),
+		held:       make(map[heldRecord]*heldMessage),
+		reached:    make(map[uint64]struct{}),
+		dropped:    make(map[uint64]string),
+	}
+}
+
+func (s *CommitmentSink) Write(ctx context.Context, msg *decode.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slot := msg.Update.GetSlot(); slot != nil {
+		if err := s.next.Write(ctx, msg); err != nil {
+			return err
+		}
+		return s.slotStatus(ctx, slot)
+	}
+	if msg.Slot == 0 {
+		return s.next.Write(ctx, msg)
+	}
+	if _, ok := s.reached[msg.Slot]; ok {
+		return s.next.Write(ctx, msg)
+	}
+	if reason, ok := s.dropped[msg.Slot]; ok {
+		metrics.CommitmentDiscardedTotal.WithLabelValues(reason).Inc()
+		return nil
+	}
+	if msg.Slot+s.maxPending < s.newestFinalized {
+		metrics.CommitmentDiscardedTotal.WithLabelValues(discardExpired).Inc()
+		return nil
+	}
+	if held, ok := s.held[recordOf(msg)]; ok {
+		held.complete()
+		held.msg, held.complete = msg, msg.Hold()
+		return nil
+	}
+	held := &heldMessage{msg, msg.Hold()}
+	s.pending[msg.Slot] = append(s.pending[msg.Slot], held)
+	s.held[recordOf(msg)] = held
+	metrics.CommitmentPending.Inc()
+	return nil
+}
+
+func (s *CommitmentSink) slotStatus(ctx context.Context, update *proto.SubscribeUpdateSlot) error {
+	slot := update.GetSlot()
+	switch status := update.GetStatus(); {
+	case status == proto.CommitmentLevel_DEAD:
+		s.discard(slot, DiscardDead)
+		return nil
+	case status == proto.CommitmentLevel_FINALIZED:
+		if err := s.reach(ctx, slot); err != nil {
+			return err
+		}
+		if update.Parent != nil {
+			// the finalized chain goes from the parent straight to slot
+			for skipped := update.GetParent() + 1; skipped < slot; skipped++ {
+				s.discard(skipped, DiscardSkipped)
+			}
+		}
+		if slot > s.newestFinalized {
+			s.newestFinalized = slot
+			s.expire()
+		}
+	case status == proto.CommitmentLevel_CONFIRMED && !s.finalized:
+		return s.reach(ctx, slot)
+	}
+	return nil
+}
+
+// reach writes out the updates held for slot in arrival order. Those the next
+// sink rejects stay held for the retry of the slot update.
+func (s *CommitmentSink) reach(ctx context.Context, slot uint64) error {
+	held := s.pending[slot]
+	for len(held) > 0 {
+		if err := WriteHeld(ctx, s.next, held[0].msg, held[0].complete); err != nil {
+			s.pending[slot] = held
+			return fmt.Errorf("write held update of slot %d: %w", slot, err)
+		}
+		delete(s.held, recordOf(held[0].msg))
+		held = held[1:]
+		metrics.CommitmentPending.Dec()
+	}
+	delete(s.pending, slot)
+	delete(s.dropped, slot)
+	s.reached[slot] = struct{}{}
+	return nil
+}
+
+func (s *CommitmentSink) discard(slot uint64, reason string) {
+	if _, ok := s.reached[slot]; ok {
+		return
+	}
+	if held := s.pending[slot]; len(held) > 0 {
+		logging.Logger.Debug("discarding held updates", zap.Uint64("slot", slot), zap.String("reason", reason), zap.Int("updates", len(held)))
+		for _, h := range held {
+			h.complete()
+			delete(s.held, recordOf(h.msg))
+		}
+		metrics.CommitmentPending.Sub(float64(len(held)))
+		metrics.CommitmentDiscardedTotal.WithLabelValues(reason).Add(float64(len(held)))
+	}
+	delete(s.pending, slot)
+	s.dropped[slot] = reason
+}
+
+// expire discards what is left of slots far enough behind the newest
+// finalized one and forgets their state.
+func (s *CommitmentSink) expire() {
+	if s.newestFinalized <= s.maxPending {
+		return
+	}
+	horizon := s.newestFinalized - s.maxPending
+	for _, slot := range slices.Collect(maps.Keys(s.pending)) {
+		if slot < horizon {
+			s.discard(slot, discardExpired)
+		}
+	}
+	maps.DeleteFunc(s.reached, func(slot uint64, _ struct{}) bool { return slot < horizon })
+	maps.DeleteFunc(s.dropped, func(slot uint64, _ string) bool { return slot < horizon })
+}
+
+// Flush only flushes the next sink, held updates are written once their slot
+// reaches the level.
+func (s *CommitmentSink) Flush(ctx context.Context) error {
+	return s.next.Flush(ctx)
+}
+
+// Close drops the held updates, their offsets were not committed so they are
+// consumed again after a restart.
+func (s *CommitmentSink) Close() error {
+	return s.next.Close()
+}
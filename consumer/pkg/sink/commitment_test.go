@@ -0,0 +1,198 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// heldTransaction returns a transaction of slot whose completion is counted
+// in completed.
+func heldTransaction(slot uint64, offset int64, completed map[int64]int) *decode.Message {
+	msg := decodetest.TransactionMessage(slot, testkey.Key(1))
+	msg.Topic, msg.Offset = "transactions", offset
+	msg.Complete = func() { completed[offset]++ }
+	return msg
+}
+
+func TestCommitmentSinkConfirmed(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewCommitmentSink(next, CommitmentConfig{Level: decode.CommitmentConfirmed, MaxPendingSlots: 150})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	for i, msg := range []*decode.Message{heldTransaction(10, 0, completed), heldTransaction(11, 1, completed), heldTransaction(10, 2, completed)} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Held() {
+			t.Fatalf("update %d not held", i)
+		}
+	}
+	if len(next.Written) != 0 {
+		t.Fatalf("%d updates written before confirmation", len(next.Written))
+	}
+
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_PROCESSED))
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED))
+	if got, want := next.Slots(), []uint64{10, 10, 10, 10}; !slices.Equal(got, want) {
+		t.Fatalf("written %v, want both slot updates and the held updates of slot 10", got)
+	}
+	if completed[0] != 1 || completed[2] != 1 || completed[1] != 0 {
+		t.Fatalf("completed %v, want offsets 0 and 2 once", completed)
+	}
+
+	// the slot reached the level, later updates of it are written through
+	late := heldTransaction(10, 3, completed)
+	s.Write(ctx, late)
+	if late.Held() || len(next.Written) != 5 {
+		t.Fatal("update of a confirmed slot held back")
+	}
+}
+
+func TestCommitmentSinkFinalizedIgnoresConfirmed(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewCommitmentSink(next, CommitmentConfig{Level: decode.CommitmentFinalized, MaxPendingSlots: 150})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	s.Write(ctx, heldTransaction(10, 0, completed))
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED))
+	if len(next.Written) != 1 || completed[0] != 0 {
+		t.Fatal("update written at confirmed with level finalized")
+	}
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_FINALIZED))
+	if len(next.Written) != 3 || completed[0] != 1 {
+		t.Fatalf("written %v, completed %v after finalization", next.Slots(), completed)
+	}
+}
+
+func TestCommitmentSinkDiscards(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewCommitmentSink(next, CommitmentConfig{Level: decode.CommitmentFinalized, MaxPendingSlots: 10})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	s.Write(ctx, heldTransaction(10, 0, completed))
+	s.Write(ctx, heldTransaction(11, 1, completed))
+	s.Write(ctx, heldTransaction(12, 2, completed))
+	s.Write(ctx, heldTransaction(13, 3, completed))
+
+	// 11 dies, 13 is finalized on top of 10 so 11 and 12 were skipped
+	s.Write(ctx, decodetest.SlotMessage(11, 10, proto.CommitmentLevel_DEAD))
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_FINALIZED))
+	s.Write(ctx, decodetest.SlotMessage(13, 10, proto.CommitmentLevel_FINALIZED))
+	if got, want := next.Slots(), []uint64{11, 10, 10, 13, 13}; !slices.Equal(got, want) {
+		t.Fatalf("written %v, want %v", got, want)
+	}
+	for offset := range int64(4) {
+		if completed[offset] != 1 {
+			t.Fatalf("completed %v, want every offset once", completed)
+		}
+	}
+
+	// updates of dropped slots are discarded on arrival
+	dead := heldTransaction(11, 4, completed)
+	s.Write(ctx, dead)
+	skipped := heldTransaction(12, 5, completed)
+	s.Write(ctx, skipped)
+	if dead.Held() || skipped.Held() || len(next.Written) != 5 {
+		t.Fatal("update of a dropped slot held or written")
+	}
+
+	// a slot never finalized expires once max_pending_slots behind
+	s.Write(ctx, heldTransaction(14, 6, completed))
+	s.Write(ctx, decodetest.SlotMessage(30, 29, proto.CommitmentLevel_FINALIZED))
+	if completed[6] != 1 || len(s.pending) != 0 || len(s.held) != 0 {
+		t.Fatalf("pending %v after expiry, completed %v", s.pending, completed)
+	}
+	expired := heldTransaction(15, 7, completed)
+	s.Write(ctx, expired)
+	if expired.Held() {
+		t.Fatal("update far behind the finalized slot held")
+	}
+}
+
+func TestCommitmentSinkReplacesConsumedAgain(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := NewCommitmentSink(next, CommitmentConfig{Level: decode.CommitmentConfirmed, MaxPendingSlots: 150})
+	ctx := context.Background()
+	before, after := make(map[int64]int), make(map[int64]int)
+
+	s.Write(ctx, heldTransaction(10, 0, before))
+	// the partition is consumed again from the committed offset
+	again := heldTransaction(10, 0, after)
+	s.Write(ctx, again)
+	if !again.Held() || before[0] != 1 {
+		t.Fatal("copy consumed again did not replace the held one")
+	}
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED))
+	if len(next.Written) != 2 || next.Written[1] != again || after[0] != 1 {
+		t.Fatalf("written %v, want the update once", next.Slots())
+	}
+}
+
+func TestCommitmentSinkFailedReachStaysHeld(t *testing.T) {
+	failure := errors.New("sink down")
+	next := &sinktest.RecordSink{}
+	s := NewCommitmentSink(next, CommitmentConfig{Level: decode.CommitmentConfirmed, MaxPendingSlots: 150})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	s.Write(ctx, heldTransaction(10, 0, completed))
+	s.Write(ctx, heldTransaction(10, 1, completed))
+	next.Fail = map[uint64]error{10: failure}
+	if err := s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED)); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if len(completed) != 0 || len(s.pending[10]) != 2 {
+		t.Fatalf("completed %v, pending %d", completed, len(s.pending[10]))
+	}
+	next.Fail = nil
+	if err := s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED)); err != nil {
+		t.Fatal(err)
+	}
+	if completed[0] != 1 || completed[1] != 1 {
+		t.Fatalf("completed %v after the retry", completed)
+	}
+}
+
+// holdSink holds every write, as a sink uploading files does.
+type holdSink struct {
+	sinktest.RecordSink
+	completes []func()
+}
+
+func (s *holdSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.RecordSink.Write(ctx, msg); err != nil {
+		return err
+	}
+	s.completes = append(s.completes, msg.Hold())
+	return nil
+}
+
+func TestCommitmentSinkHandsOverHeld(t *testing.T) {
+	next := &holdSink{}
+	s := NewCommitmentSink(next, CommitmentConfig{Level: decode.CommitmentConfirmed, MaxPendingSlots: 150})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	s.Write(ctx, heldTransaction(10, 0, completed))
+	s.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED))
+	if len(completed) != 0 {
+		t.Fatalf("completed %v although the next sink held the update", completed)
+	}
+	for _, complete := range next.completes {
+		complete()
+	}
+	if completed[0] != 1 {
+		t.Fatalf("completed %v, want offset 0 once", completed)
+	}
+}
@@ -0,0 +1,153 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// UpdateHandler reacts to each kind of Yellowstone update. Implementations
+// that only care about some kinds can embed NopUpdateHandler.
+type UpdateHandler interface {
+	HandleAccount(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateAccount) error
+	HandleSlot(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateSlot) error
+	HandleTransaction(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateTransaction) error
+	HandleTransactionStatus(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateTransactionStatus) error
+	HandleBlock(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateBlock) error
+	HandleBlockMeta(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateBlockMeta) error
+	HandleEntry(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdateEntry) error
+	HandlePing(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdatePing) error
+	HandlePong(ctx context.Context, msg *decode.Message, update *proto.SubscribeUpdatePong) error
+}
+
+// Dispatch calls the handler method matching the kind of msg.
+func Dispatch(ctx context.Context, h UpdateHandler, msg *decode.Message) error {
+	switch u := msg.Update.GetUpdateOneof().(type) {
+	case *proto.SubscribeUpdate_Account:
+		return h.HandleAccount(ctx, msg, u.Account)
+	case *proto.SubscribeUpdate_Slot:
+		return h.HandleSlot(ctx, msg, u.Slot)
+	case *proto.SubscribeUpdate_Transaction:
+		return h.HandleTransaction(ctx, msg, u.Transaction)
+	case *proto.SubscribeUpdate_TransactionStatus:
+		return h.HandleTransactionStatus(ctx, msg, u.TransactionStatus)
+	case *proto.SubscribeUpdate_Block:
+		return h.HandleBlock(ctx, msg, u.Block)
+	case *proto.SubscribeUpdate_BlockMeta:
+		return h.HandleBlockMeta(ctx, msg, u.BlockMeta)
+	case *proto.SubscribeUpdate_Entry:
+		return h.HandleEntry(ctx, msg, u.Entry)
+	case *proto.SubscribeUpdate_Ping:
+		return h.HandlePing(ctx, msg, u.Ping)
+	case *proto.SubscribeUpdate_Pong:
+		return h.HandlePong(ctx, msg, u.Pong)
+	}
+	return fmt.Errorf("unsupported update %T", msg.Update.GetUpdateOneof())
+}
+
+// NopUpdateHandler ignores every update.
+type NopUpdateHandler struct{}
+
+func (NopUpdateHandler) HandleAccount(context.Context, *decode.Message, *proto.SubscribeUpdateAccount) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandleSlot(context.Context, *decode.Message, *proto.SubscribeUpdateSlot) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandleTransaction(context.Context, *decode.Message, *proto.SubscribeUpdateTransaction) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandleTransactionStatus(context.Context, *decode.Message, *proto.SubscribeUpdateTransactionStatus) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandleBlock(context.Context, *decode.Message, *proto.SubscribeUpdateBlock) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandleBlockMeta(context.Context, *decode.Message, *proto.SubscribeUpdateBlockMeta) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandleEntry(context.Context, *decode.Message, *proto.SubscribeUpdateEntry) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandlePing(context.Context, *decode.Message, *proto.SubscribeUpdatePing) error {
+	return nil
+}
+
+func (NopUpdateHandler) HandlePong(context.Context, *decode.Message, *proto.SubscribeUpdatePong) error {
+	return nil
+}
+
+// PrintHandler writes every update to stdout.
+type PrintHandler struct{}
+
+func (PrintHandler) HandleAccount(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateAccount) error {
+	return printUpdate("account", update)
+}
+
+func (PrintHandler) HandleSlot(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateSlot) error {
+	return printUpdate("slot", update)
+}
+
+func (PrintHandler) HandleTransaction(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateTransaction) error {
+	return printUpdate("tx", update.GetTransaction())
+}
+
+func (PrintHandler) HandleTransactionStatus(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateTransactionStatus) error {
+	return printUpdate("tx status", update)
+}
+
+func (PrintHandler) HandleBlock(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateBlock) error {
+	return printUpdate("block", update)
+}
+
+func (PrintHandler) HandleBlockMeta(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateBlockMeta) error {
+	return printUpdate("block meta", update)
+}
+
+func (PrintHandler) HandleEntry(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateEntry) error {
+	return printUpdate("entry", update)
+}
+
+func (PrintHandler) HandlePing(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdatePing) error {
+	return printUpdate("ping", update)
+}
+
+func (PrintHandler) HandlePong(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdatePong) error {
+	return printUpdate("pong", update)
+}
+
+// printUpdate writes a labelled update as one JSON line.
+func printUpdate(label string, update gproto.Message) error {
+	out, err := decode.FormatJSON(update)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", label, out)
+	return nil
+}
+
+// RPCPrintHandler writes transactions to stdout as Solana RPC getTransaction
+// responses, one per line, and ignores other updates.
+type RPCPrintHandler struct {
+	NopUpdateHandler
+}
+
+func (RPCPrintHandler) HandleTransaction(_ context.Context, msg *decode.Message, update *proto.SubscribeUpdateTransaction) error {
+	out, err := decode.FormatRPCTransaction(msg.Slot, update.GetTransaction())
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,371 @@
+package sink
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// programNames names well-known programs in the inspect output.
+var programNames = map[string]string{
+	decode.SystemProgramID:                         "System Program",
+	decode.ComputeBudgetProgramID:                  "Compute Budget Program",
+	decode.TokenProgramID:                          "Token Program",
+	decode.Token2022ProgramID:                      "Token-2022 Program",
+	"ATokenGPvbdGVxr1b2hvZbsiqW5xWH25efTNsLJA8knL": "Associated Token Account Program",
+	"MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr":  "Memo Program",
+	"Memo1UhkJRfHyvLMcVucJwxXeuD728EqVDDwQDxFMNo":  "Memo Program v1",
+	decode.VoteProgramID:                           "Vote Program",
+	"Stake11111111111111111111111111111111111111":  "Stake Program",
+	"BPFLoaderUpgradeab1e11111111111111111111111":  "BPF Upgradeable Loader",
+	decode.AddressLookupTableProgramID:             "Address Lookup Table Program",
+	decode.TokenMetadataProgramID:                  "Token Metadata Program",
+	decode.BubblegumProgramID:                      "Bubblegum Program",
+	decode.RaydiumAMMProgramID:                     "Raydium AMM",
+	decode.RaydiumCLMMProgramID:                    "Raydium CLMM",
+	decode.RaydiumCPMMProgramID:                    "Raydium CPMM",
+	decode.WhirlpoolProgramID:                      "Orca Whirlpool",
+	decode.PhoenixProgramID:                        "Phoenix",
+	decode.JupiterProgramID:                        "Jupiter Aggregator v6",
+}
+
+// named appends the name of a well-known program to its key.
+func named(key string) string {
+	if name, ok := programNames[key]; ok {
+		return key + " (" + name + ")"
+	}
+	return key
+}
+
+// InspectHandler writes transactions to stdout in a human readable form,
+// like solana confirm -v: the accounts, the instructions with what the
+// decoders make of them, the balance changes and the program logs as a tree.
+// Slots, accounts and blocks get a line each and other updates are printed
+// as labelled JSON.
+type InspectHandler struct {
+	PrintHandler
+}
+
+func (InspectHandler) HandleTransaction(_ context.Context, msg *decode.Message, update *proto.SubscribeUpdateTransaction) error {
+	fmt.Print(formatInspectTransaction(msg.Slot, update.GetTransaction()))
+	return nil
+}
+
+func (InspectHandler) HandleSlot(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateSlot) error {
+	line := fmt.Sprintf("Slot %d %s", update.GetSlot(), strings.ToLower(update.GetStatus().String()))
+	if update.Parent != nil {
+		line += fmt.Sprintf(", parent %d", update.GetParent())
+	}
+	if update.DeadError != nil {
+		line += ": " + update.GetDeadError()
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func (InspectHandler) HandleAccount(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateAccount) error {
+	info := update.GetAccount()
+	fmt.Printf("Account %s at slot %d: %s, %d bytes, owner %s\n", base58.Encode(info.GetPubkey()), update.GetSlot(),
+		formatLamports(info.GetLamports()), len(info.GetData()), named(base58.Encode(info.GetOwner())))
+	return nil
+}
+
+func (InspectHandler) HandleBlockMeta(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateBlockMeta) error {
+	fmt.Println(formatInspectBlock(update.GetSlot(), update.GetBlockhash(), update.GetBlockTime(), update.GetExecutedTransactionCount()))
+	return nil
+}
+
+func (InspectHandler) HandleBlock(_ context.Context, _ *decode.Message, update *proto.SubscribeUpdateBlock) error {
+	fmt.Println(formatInspectBlock(update.GetSlot(), update.GetBlockhash(), update.GetBlockTime(), update.GetExecutedTransactionCount()))
+	for _, info := range update.GetTransactions() {
+		fmt.Print(formatInspectTransaction(update.GetSlot(), info))
+	}
+	return nil
+}
+
+func formatInspectBlock(slot uint64, blockhash string, blockTime *proto.UnixTimestamp, transactions uint64) string {
+	line := fmt.Sprintf("Block %d %s, %d transactions", slot, blockhash, transactions)
+	if blockTime != nil {
+		line += ", " + time.Unix(blockTime.GetTimestamp(), 0).UTC().Format(time.RFC3339)
+	}
+	return line
+}
+
+// formatInspectTransaction renders a transaction over several lines, ending
+// with an empty one.
+func formatInspectTransaction(slot uint64, info *proto.SubscribeUpdateTransactionInfo) string {
+	var b strings.Builder
+	meta := info.GetMeta()
+	keys := decode.TransactionAccounts(info)
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = base58.Encode(key)
+	}
+
+	fmt.Fprintf(&b, "Transaction %s\n", base58.Encode(info.GetSignature()))
+	fmt.Fprintf(&b, "  Slot: %d, index %d", slot, info.GetIndex())
+	if info.GetIsVote() {
+		b.WriteString(", vote")
+	}
+	b.WriteString("\n")
+	if raw := meta.GetErr().GetErr(); raw != nil {
+		b.WriteString("  Status: Error " + formatTransactionError(raw) + "\n")
+	} else {
+		b.WriteString("  Status: Ok\n")
+	}
+	fmt.Fprintf(&b, "  Fee: %s\n", formatLamports(meta.GetFee()))
+	if meta.ComputeUnitsConsumed != nil {
+		fmt.Fprintf(&b, "  Compute units: %d\n", meta.GetComputeUnitsConsumed())
+	}
+	if budget, ok := decode.DecodeComputeBudget(info); ok {
+		var parts []string
+		if budget.UnitLimit != nil {
+			parts = append(parts, fmt.Sprintf("limit %d", *budget.UnitLimit))
+		}
+		if budget.UnitPrice != nil {
+			parts = append(parts, fmt.Sprintf("price %d micro-lamports", *budget.UnitPrice))
+		}
+		if budget.PriorityFee != nil {
+			parts = append(parts, "priority fee "+formatLamports(*budget.PriorityFee))
+		}
+		b.WriteString("  Compute budget: " + strings.Join(parts, ", ") + "\n")
+	}
+
+	b.WriteString("Accounts:\n")
+	for i, key := range encoded {
+		fmt.Fprintf(&b, "  %-3d %s %s", i, accountFlags(info, i), named(key))
+		if i == 0 {
+			b.WriteString(" fee payer")
+		}
+		b.WriteString("\n")
+	}
+
+	decoded := decodedInstructions(info)
+	innerInstructions := make(map[uint32][]*proto.InnerInstruction)
+	for _, list := range meta.GetInnerInstructions() {
+		innerInstructions[list.GetIndex()] = list.GetInstructions()
+	}
+	b.WriteString("Instructions:\n")
+	instruction := func(indent, label string, programIndex uint32, accounts, data []byte) {
+		program := "unknown program"
+		if int(programIndex) < len(encoded) {
+			program = named(encoded[programIndex])
+		}
+		fmt.Fprintf(&b, "%s%s %s\n", indent, label, program)
+		if len(accounts) > 0 {
+			indexes := make([]string, len(accounts))
+			for i, index := range accounts {
+				indexes[i] = strconv.Itoa(int(index))
+			}
+			fmt.Fprintf(&b, "%s    Accounts: %s\n", indent, strings.Join(indexes, ", "))
+		}
+		if len(data) > 0 {
+			fmt.Fprintf(&b, "%s    Data: %s\n", indent, base58.Encode(data))
+		}
+		for _, line := range decoded[label] {
+			fmt.Fprintf(&b, "%s    > %s\n", indent, line)
+		}
+	}
+	for i, ix := range info.GetTransaction().GetMessage().GetInstructions() {
+		instruction("  ", "#"+strconv.Itoa(i), ix.GetProgramIdIndex(), ix.GetAccounts(), ix.GetData())
+		for j, cpi := range innerInstructions[uint32(i)] {
+			instruction("    ", "#"+strconv.Itoa(i)+"."+strconv.Itoa(j), cpi.GetProgramIdIndex(), cpi.GetAccounts(), cpi.GetData())
+		}
+	}
+
+	if changes := decode.BalanceChanges(info); len(changes) > 0 {
+		b.WriteString("Balance changes:\n")
+		for _, change := range changes {
+			if change.Mint == "" {
+				fmt.Fprintf(&b, "  %s %s -> %s (%s)\n", change.Account,
+					formatLamports(change.Pre), formatLamports(change.Post), FormatSOL(change.Change))
+				continue
+			}
+			var decimals uint32
+			if change.Decimals != nil {
+				decimals = *change.Decimals
+			}
+			fmt.Fprintf(&b, "  %s %s -> %s (%s) of mint %s, owner %s\n", change.Account,
+				formatAmount(new(big.Int).SetUint64(change.Pre), decimals), formatAmount(new(big.Int).SetUint64(change.Post), decimals),
+				formatSignedAmount(change.Change, decimals), change.Mint, change.Owner)
+		}
+	}
+
+	if logs := meta.GetLogMessages(); len(logs) > 0 {
+		b.WriteString("Logs:\n")
+		for _, line := range logTree(logs) {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// accountFlags renders whether account i of a transaction signs and is
+// writable, like srw for a writable signer.
+func accountFlags(info *proto.SubscribeUpdateTransactionInfo, i int) string {
+	message := info.GetTransaction().GetMessage()
+	header := message.GetHeader()
+	static := len(message.GetAccountKeys())
+	signers := int(header.GetNumRequiredSignatures())
+	var signer, writable bool
+	switch {
+	case i < signers:
+		signer = true
+		writable = i < signers-int(header.GetNumReadonlySignedAccounts())
+	case i < static:
+		writable = i < static-int(header.GetNumReadonlyUnsignedAccounts())
+	default:
+		writable = i < static+len(info.GetMeta().GetLoadedWritableAddresses())
+	}
+	flags := []byte("---")
+	if signer {
+		flags[0] = 's'
+	}
+	flags[1] = 'r'
+	if writable {
+		flags[2] = 'w'
+	}
+	return string(flags)
+}
+
+// decodedInstructions describes what the decoders make of the instructions
+// of a transaction, by instruction label, #outer or #outer.inner.
+func decodedInstructions(info *proto.SubscribeUpdateTransactionInfo) map[string][]string {
+	out := make(map[string][]string)
+	add := func(outer int, inner *int, line string) {
+		label := "#" + strconv.Itoa(outer)
+		if inner != nil {
+			label += "." + strconv.Itoa(*inner)
+		}
+		out[label] = append(out[label], line)
+	}
+	for _, ix := range decode.DecodeSystemInstructions(info) {
+		line := fmt.Sprintf("%s %s from %s to %s", ix.Type, formatLamports(ix.Lamports), ix.Source, ix.Destination)
+		if ix.Owner != "" {
+			line += fmt.Sprintf(", %d bytes owned by %s", ix.Space, named(ix.Owner))
+		}
+		add(ix.Instruction, ix.InnerInstruction, line)
+	}
+	for _, ix := range decode.DecodeTokenInstructions(info) {
+		amount := strconv.FormatUint(ix.Amount, 10)
+		if ix.Decimals != nil {
+			amount = formatAmount(new(big.Int).SetUint64(ix.Amount), *ix.Decimals)
+		}
+		line := ix.Type + " " + amount
+		if ix.Mint != "" {
+			line += " of mint " + ix.Mint
+		}
+		if ix.Source != "" {
+			line += " from " + ix.Source
+		}
+		if ix.Destination != "" {
+			line += " to " + ix.Destination
+		}
+		add(ix.Instruction, ix.InnerInstruction, line+", authority "+ix.Authority)
+	}
+	for _, swap := range decode.DecodeSwaps(info) {
+		add(swap.Instruction, swap.InnerInstruction, fmt.Sprintf("%s swap of %d %s for %d %s by %s",
+			swap.Dex, swap.InputAmount, swap.InputMint, swap.OutputAmount, swap.OutputMint, swap.Signer))
+	}
+	for _, event := range decode.DecodeMintEvents(info) {
+		line := event.Type
+		if event.Mint != "" {
+			line += " " + event.Mint
+		}
+		if event.Name != "" {
+			line += fmt.Sprintf(" %q", event.Name)
+		}
+		add(event.Instruction, event.InnerInstruction, line)
+	}
+	for _, ix := range decode.DefaultIDLDecoder.DecodeInstructions(info) {
+		args, _ := json.Marshal(ix.Args)
+		add(ix.Instruction, ix.InnerInstruction, fmt.Sprintf("%s %s %s", ix.Program, ix.Name, args))
+	}
+	return out
+}
+
+// logTree indents the log messages of a transaction by invocation depth and
+// names the invoked programs known.
+func logTree(logs []string) []string {
+	lines := make([]string, 0, len(logs))
+	depth := 0
+	for _, line := range logs {
+		program, rest, isProgram := strings.Cut(strings.TrimPrefix(line, "Program "), " ")
+		isProgram = isProgram && strings.HasPrefix(line, "Program ")
+		switch {
+		case isProgram && strings.HasPrefix(rest, "invoke ["):
+			lines = append(lines, strings.Repeat("  ", depth)+"Program "+named(program)+" "+rest)
+			depth++
+		case isProgram && (rest == "success" || strings.HasPrefix(rest, "failed")):
+			depth = max(depth-1, 0)
+			lines = append(lines, strings.Repeat("  ", depth)+line)
+		default:
+			lines = append(lines, strings.Repeat("  ", depth)+line)
+		}
+	}
+	return lines
+}
+
+// formatTransactionError renders the error of a transaction in the JSON form
+// of the Solana RPC, base64 when it does not decode.
+func formatTransactionError(raw []byte) string {
+	if decoded, err := decode.DecodeTransactionError(raw); err == nil {
+		data, _ := json.Marshal(decoded)
+		return string(data)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// formatLamports renders lamports in SOL.
+func formatLamports(lamports uint64) string {
+	return "◎" + formatAmount(new(big.Int).SetUint64(lamports), 9)
+}
+
+// formatAmount renders an amount of base units with decimals, without the
+// trailing zeros of the fraction.
+func formatAmount(amount *big.Int, decimals uint32) string {
+	digits := new(big.Int).Abs(amount).String()
+	if decimals == 0 {
+		return digits
+	}
+	if len(digits) <= int(decimals) {
+		digits = strings.Repeat("0", int(decimals)-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-int(decimals)], strings.TrimRight(digits[len(digits)-int(decimals):], "0")
+	if fraction == "" {
+		return whole
+	}
+	return whole + "." + fraction
+}
+
+// formatSignedAmount renders a change of base units with its sign.
+func formatSignedAmount(change *big.Int, decimals uint32) string {
+	if change.Sign() < 0 {
+		return "-" + formatAmount(change, decimals)
+	}
+	return "+" + formatAmount(change, decimals)
+}
+
+// FormatSOL formats lamports as SOL, signed and without trailing zeros.
+func FormatSOL(lamports *big.Int) string {
+	whole, fraction := new(big.Int).QuoRem(new(big.Int).Abs(lamports), big.NewInt(1e9), new(big.Int))
+	text := whole.String()
+	if fraction.Sign() != 0 {
+		text += "." + strings.TrimRight(fmt.Sprintf("%09d", fraction), "0")
+	}
+	if lamports.Sign() < 0 {
+		return "-" + text
+	}
+	return "+" + text
+}
@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestFormatInspectTransaction(t *testing.T) {
+	info := decodetest.ProgramTransaction([]string{decode.SystemProgramID},
+		[]*proto.CompiledInstruction{{ProgramIdIndex: 3, Accounts: []byte{0, 1}, Data: decodetest.SystemData(decode.SystemTransfer, decodetest.LE64(500_000_000))}},
+		nil,
+	)
+	info.Transaction.Message.Header = &proto.MessageHeader{NumRequiredSignatures: 1, NumReadonlyUnsignedAccounts: 1}
+	info.Meta.Fee = 5000
+	info.Meta.PreBalances, info.Meta.PostBalances = []uint64{2_000_000_000, 0, 1, 1}, []uint64{1_499_995_000, 500_000_000, 1, 1}
+	info.Meta.LogMessages = []string{"Program 11111111111111111111111111111111 invoke [1]", "Program 11111111111111111111111111111111 success"}
+
+	got := formatInspectTransaction(10, info)
+	for _, want := range []string{
+		"Transaction " + testkey.String(0xff) + "\n  Slot: 10, index 0\n  Status: Ok\n  Fee: ◎0.000005\n",
+		"  0   srw " + testkey.String(1) + " fee payer\n",
+		"  3   -r- 11111111111111111111111111111111 (System Program)\n",
+		"  #0 11111111111111111111111111111111 (System Program)\n      Accounts: 0, 1\n",
+		"      > transfer ◎0.5 from " + testkey.String(1) + " to " + testkey.String(2) + "\n",
+		"  " + testkey.String(1) + " ◎2 -> ◎1.499995 (-0.500005)\n",
+		"  Program 11111111111111111111111111111111 (System Program) invoke [1]\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("missing %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestLogTree(t *testing.T) {
+	got := logTree([]string{
+		"Program JUP6LkbZbjS1jKKwapdHNy74zcZ3tLUZoi5QNyVTaV4 invoke [1]",
+		"Program TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA invoke [2]",
+		"Program log: Instruction: Transfer",
+		"Program TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA success",
+		"Program JUP6LkbZbjS1jKKwapdHNy74zcZ3tLUZoi5QNyVTaV4 failed: custom program error: 0x1771",
+	})
+	want := []string{
+		"Program JUP6LkbZbjS1jKKwapdHNy74zcZ3tLUZoi5QNyVTaV4 (Jupiter Aggregator v6) invoke [1]",
+		"  Program TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA (Token Program) invoke [2]",
+		"    Program log: Instruction: Transfer",
+		"  Program TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA success",
+		"Program JUP6LkbZbjS1jKKwapdHNy74zcZ3tLUZoi5QNyVTaV4 failed: custom program error: 0x1771",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	for _, tt := range []struct {
+		amount   int64
+		decimals uint32
+		want     string
+	}{
+		{1_500_000, 6, "1.5"},
+		{42, 6, "0.000042"},
+		{-7, 0, "7"},
+		{3_000_000_000, 9, "3"},
+	} {
+		if got := formatAmount(big.NewInt(tt.amount), tt.decimals); got != tt.want {
+			t.Errorf("formatAmount(%d, %d) = %q, want %q", tt.amount, tt.decimals, got, tt.want)
+		}
+	}
+	if got := formatSignedAmount(big.NewInt(-2500), 3); got != "-2.5" {
+		t.Errorf("formatSignedAmount = %q", got)
+	}
+}
+
+func TestFormatSOL(t *testing.T) {
+	for lamports, want := range map[int64]string{
+		1_500_000_000:  "+1.5",
+		-5_000:         "-0.000005",
+		-2_000_000_000: "-2",
+	} {
+		if got := FormatSOL(big.NewInt(lamports)); got != want {
+			t.Errorf("formatSOL(%d) = %s, want %s", lamports, got, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"time"
+
+	"consumer/internal/hostname"
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+)
+
+// MessageHandler takes a decoded message on its way to the sink. An error
+// fails the message as a sink write error does.
+type MessageHandler func(ctx context.Context, msg *decode.Message) error
+
+// Middleware wraps the handler of the next step. It may change msg, drop it
+// by returning nil without calling next, or fail it.
+type Middleware func(next MessageHandler) MessageHandler
+
+// MiddlewareConfig configures a step of processing.middlewares.
+type MiddlewareConfig struct {
+	// Type names a registered middleware, see RegisterMiddleware.
+	Type string `json:"type" yaml:"type"`
+	// Name labels the metrics of the step, Type when empty.
+	Name string `json:"name" yaml:"name"`
+	// Options configure the middleware of Type.
+	Options map[string]string `json:"options" yaml:"options"`
+}
+
+// MiddlewareFactory builds a middleware from the options of its config.
+type MiddlewareFactory func(config MiddlewareConfig) (Middleware, error)
+
+var middlewares = map[string]MiddlewareFactory{
+	"headers": newHeadersMiddleware,
+	"metrics": newMetricsMiddleware,
+	"sample":  newSampleMiddleware,
+}
+
+// RegisterMiddleware makes a middleware available to processing.middlewares
+// under name. It is meant to be called from init by the files adding custom
+// steps, and panics when name is taken.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	if _, ok := middlewares[name]; ok {
+		panic("middleware " + name + " registered twice")
+	}
+	middlewares[name] = factory
+}
+
+// NewMiddlewares builds the middlewares of configs, in order.
+func NewMiddlewares(configs []MiddlewareConfig) ([]Middleware, error) {
+	var chain []Middleware
+	for i, config := range configs {
+		factory, ok := middlewares[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("processing.middlewares[%d].type: unknown middleware %q", i, config.Type)
+		}
+		if config.Name == "" {
+			config.Name = config.Type
+		}
+		middleware, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("processing.middlewares[%d]: %w", i, err)
+		}
+		chain = append(chain, middleware)
+	}
+	return chain, nil
+}
+
+// MiddlewareSink passes every message through the middlewares, the first
+// one seeing it first, before writing it to the next sink.
+type MiddlewareSink struct {
+	Sink
+	handler MessageHandler
+}
+
+func NewMiddlewareSink(next Sink, chain []Middleware) *MiddlewareSink {
+	handler := MessageHandler(next.Write)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return &MiddlewareSink{Sink: next, handler: handler}
+}
+
+func (s *MiddlewareSink) Write(ctx context.Context, msg *decode.Message) error {
+	return s.handler(ctx, msg)
+}
+
+// newHeadersMiddleware sets the headers of its options on every message,
+// {hostname} in a value is replaced by the host name.
+func newHeadersMiddleware(config MiddlewareConfig) (Middleware, error) {
+	if len(config.Options) == 0 {
+		return nil, fmt.Errorf("%s: at least one header is required", config.Name)
+	}
+	headers := make(map[string]string, len(config.Options))
+	for key, value := range config.Options {
+		value, err := hostname.Expand(config.Name+"."+key, value)
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = value
+	}
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *decode.Message) error {
+			if msg.Headers == nil {
+				msg.Headers = make(map[string]string, len(headers))
+			}
+			for key, value := range headers {
+				msg.Headers[key] = value
+			}
+			return next(ctx, msg)
+		}
+	}, nil
+}
+
+// newMetricsMiddleware counts the messages by kind and times the steps after
+// it, labelled with the name of the step.
+func newMetricsMiddleware(config MiddlewareConfig) (Middleware, error) {
+	if len(config.Options) > 0 {
+		return nil, fmt.Errorf("%s: takes no options", config.Name)
+	}
+	duration := metrics.MiddlewareDuration.WithLabelValues(config.Name)
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *decode.Message) error {
+			metrics.MiddlewareMessagesTotal.WithLabelValues(config.Name, string(msg.Kind())).Inc()
+			start := time.Now()
+			err := next(ctx, msg)
+			duration.Observe(time.Since(start).Seconds())
+			return err
+		}
+	}, nil
+}
+
+// newSampleMiddleware keeps the fraction rate of the messages. Messages with
+// a key are sampled on its hash, so every consumer keeps the same ones.
+func newSampleMiddleware(config MiddlewareConfig) (Middleware, error) {
+	keys := slices.Sorted(maps.Keys(config.Options))
+	if len(keys) != 1 || keys[0] != "rate" {
+		return nil, fmt.Errorf("%s: expected the rate option only, got %v", config.Name, keys)
+	}
+	rate, err := strconv.ParseFloat(config.Options["rate"], 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("%s.rate: expected a fraction in (0, 1], got %q", config.Name, config.Options["rate"])
+	}
+	threshold := uint64(rate * math.MaxUint32)
+	dropped := metrics.MiddlewareDroppedTotal.WithLabelValues(config.Name)
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *decode.Message) error {
+			var sample uint64
+			if len(msg.Key) > 0 {
+				h := fnv.New32a()
+				h.Write(msg.Key)
+				sample = uint64(h.Sum32())
+			} else {
+				sample = uint64(rand.Uint32())
+			}
+			if sample > threshold {
+				dropped.Inc()
+				return nil
+			}
+			return next(ctx, msg)
+		}
+	}, nil
+}
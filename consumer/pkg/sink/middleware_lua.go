@@ -0,0 +1,232 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+)
+
+func init() {
+	RegisterMiddleware("lua", newLuaMiddleware)
+}
+
+// luaLibs are the libraries opened for the scripts, leaving out io, os,
+// package and debug.
+var luaLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+func compileLua(name, source string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// newLuaState returns a state with luaLibs opened and contains(list, value)
+// defined, reporting whether a list has the value.
+func newLuaState() *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range luaLibs {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	state.SetGlobal("contains", state.NewFunction(func(state *lua.LState) int {
+		list, value := state.CheckTable(1), state.CheckAny(2)
+		found := false
+		list.ForEach(func(_, item lua.LValue) {
+			found = found || state.Equal(item, value)
+		})
+		state.Push(lua.LBool(found))
+		return 1
+	}))
+	return state
+}
+
+// luaScript is a compiled script. A Lua state runs one call at a time, so
+// the workers take a state of their own from states.
+type luaScript struct {
+	name     string
+	function string
+	proto    *lua.FunctionProto
+	states   sync.Pool
+}
+
+// newLuaMiddleware runs the function of a Lua script on every message. It
+// gets the message as a table and keeps it when returning true; changes of
+// its key and headers are applied to the message, the update is read-only.
+func newLuaMiddleware(config MiddlewareConfig) (Middleware, error) {
+	for key := range config.Options {
+		if key != "script" && key != "function" {
+			return nil, fmt.Errorf("%s: unknown option %q, expected script or function", config.Name, key)
+		}
+	}
+	path := config.Options["script"]
+	if path == "" {
+		return nil, fmt.Errorf("%s.script: must not be empty", config.Name)
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s.script: %w", config.Name, err)
+	}
+	proto, err := compileLua(path, string(source))
+	if err != nil {
+		return nil, fmt.Errorf("%s.script: %w", config.Name, err)
+	}
+	s := &luaScript{name: config.Name, function: config.Options["function"], proto: proto}
+	if s.function == "" {
+		s.function = "process"
+	}
+	// run the script once, so that errors and a missing function fail at startup
+	state, err := s.state()
+	if err != nil {
+		return nil, fmt.Errorf("%s.script: %w", config.Name, err)
+	}
+	s.states.Put(state)
+
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *decode.Message) error {
+			keep, err := s.call(ctx, msg)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.name, err)
+			}
+			if !keep {
+				metrics.MiddlewareDroppedTotal.WithLabelValues(s.name).Inc()
+				return nil
+			}
+			return next(ctx, msg)
+		}
+	}, nil
+}
+
+// state returns a state with the script loaded, from the pool when it has one.
+func (s *luaScript) state() (*lua.LState, error) {
+	if state, ok := s.states.Get().(*lua.LState); ok {
+		return state, nil
+	}
+	state := newLuaState()
+	state.Push(state.NewFunctionFromProto(s.proto))
+	if err := state.PCall(0, 0, nil); err != nil {
+		state.Close()
+		return nil, err
+	}
+	if state.GetGlobal(s.function).Type() != lua.LTFunction {
+		state.Close()
+		return nil, fmt.Errorf("function %s is not defined", s.function)
+	}
+	return state, nil
+}
+
+// call runs the function of the script on msg and applies the changes of its
+// table. It reports whether the message is kept.
+func (s *luaScript) call(ctx context.Context, msg *decode.Message) (bool, error) {
+	state, err := s.state()
+	if err != nil {
+		return false, err
+	}
+	table, err := luaMessage(state, msg)
+	if err != nil {
+		s.states.Put(state)
+		return false, err
+	}
+	state.SetContext(ctx)
+	err = state.CallByParam(lua.P{Fn: state.GetGlobal(s.function), NRet: 1, Protect: true}, table)
+	state.RemoveContext()
+	if err != nil {
+		// a cancelled call leaves the state unusable
+		state.Close()
+		return false, err
+	}
+	keep := lua.LVAsBool(state.Get(-1))
+	state.Pop(1)
+	s.states.Put(state)
+
+	if key, ok := table.RawGetString("key").(lua.LString); ok && string(key) != string(msg.Key) {
+		msg.Key = []byte(key)
+	}
+	headers, ok := table.RawGetString("headers").(*lua.LTable)
+	if !ok {
+		return false, fmt.Errorf("%s: headers must stay a table", s.function)
+	}
+	msg.Headers = make(map[string]string)
+	headers.ForEach(func(key, value lua.LValue) {
+		msg.Headers[key.String()] = value.String()
+	})
+	return keep, nil
+}
+
+// luaMessage returns msg as the table the scripts get: the kind, slot,
+// topic, partition, offset, key and headers of the message, and the update
+// as rendered by FormatJSON.
+func luaMessage(state *lua.LState, msg *decode.Message) (*lua.LTable, error) {
+	table := state.NewTable()
+	table.RawSetString("kind", lua.LString(msg.Kind()))
+	table.RawSetString("slot", lua.LNumber(msg.Slot))
+	table.RawSetString("topic", lua.LString(msg.Topic))
+	table.RawSetString("partition", lua.LNumber(msg.Partition))
+	table.RawSetString("offset", lua.LNumber(msg.Offset))
+	table.RawSetString("key", lua.LString(msg.Key))
+	headers := state.NewTable()
+	for _, key := range slices.Sorted(maps.Keys(msg.Headers)) {
+		headers.RawSetString(key, lua.LString(msg.Headers[key]))
+	}
+	table.RawSetString("headers", headers)
+	if msg.Update != nil {
+		payload, err := decode.FormatJSON(msg.Update)
+		if err != nil {
+			return nil, err
+		}
+		var update any
+		if err := json.Unmarshal(payload, &update); err != nil {
+			return nil, err
+		}
+		table.RawSetString("update", luaValue(state, update))
+	}
+	return table, nil
+}
+
+// luaValue converts a value decoded by encoding/json, arrays becoming tables
+// indexed from 1.
+func luaValue(state *lua.LState, value any) lua.LValue {
+	switch v := value.(type) {
+	case map[string]any:
+		table := state.CreateTable(0, len(v))
+		for key, field := range v {
+			table.RawSetString(key, luaValue(state, field))
+		}
+		return table
+	case []any:
+		table := state.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(luaValue(state, item))
+		}
+		return table
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	default:
+		return lua.LNil
+	}
+}
@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+)
+
+func writeScript(t *testing.T, source string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "filter.lua")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLuaMiddleware(t *testing.T) {
+	script := writeScript(t, `
+function process(msg)
+  if msg.slot % 2 == 1 then
+    return false
+  end
+  msg.headers["program"] = msg.update.transaction.transaction.transaction.message.account_keys[1]
+  msg.headers["drop"] = nil
+  msg.key = msg.kind .. "_" .. msg.slot
+  return true
+end
+`)
+	chain, err := NewMiddlewares([]MiddlewareConfig{{Type: "lua", Options: map[string]string{"script": script}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.RecordSink{}
+	write := NewMiddlewareSink(sink, chain).Write
+	for slot := uint64(10); slot < 14; slot++ {
+		msg := decodetest.TransactionMessage(slot, testkey.Key(1))
+		msg.Headers = map[string]string{"drop": "1", "source": "node1"}
+		if err := write(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sink.Slots(); len(got) != 2 || got[0] != 10 || got[1] != 12 {
+		t.Fatalf("written slots %v", got)
+	}
+	msg := sink.Written[0]
+	if string(msg.Key) != "transaction_10" || msg.Headers["program"] != testkey.String(1) || msg.Headers["source"] != "node1" || len(msg.Headers) != 2 {
+		t.Fatalf("key %s, headers %v", msg.Key, msg.Headers)
+	}
+
+	// errors of a call fail the message, os is not available
+	failing := writeScript(t, `function check(msg) if os == nil then error("no " .. msg.topic) end return true end`)
+	chain, err = NewMiddlewares([]MiddlewareConfig{{Type: "lua", Name: "check", Options: map[string]string{"script": failing, "function": "check"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := decodetest.TransactionMessage(10, testkey.Key(1))
+	failed.Topic = "updates"
+	if err := NewMiddlewareSink(sink, chain).Write(context.Background(), failed); err == nil || !strings.Contains(err.Error(), "no updates") {
+		t.Fatalf("got %v", err)
+	}
+
+	for _, test := range []struct {
+		options map[string]string
+		want    string
+	}{
+		{map[string]string{}, "lua.script: must not be empty"},
+		{map[string]string{"script": script, "timeout": "1s"}, `unknown option "timeout"`},
+		{map[string]string{"script": writeScript(t, "function process(")}, "lua.script:"},
+		{map[string]string{"script": writeScript(t, `error("boom")`)}, "boom"},
+		{map[string]string{"script": script, "function": "filter"}, "function filter is not defined"},
+	} {
+		if _, err := NewMiddlewares([]MiddlewareConfig{{Type: "lua", Options: test.options}}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got %v, want %s", test.options, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+)
+
+func TestMiddlewareSink(t *testing.T) {
+	var order []string
+	step := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(ctx context.Context, msg *decode.Message) error {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	headers, err := newHeadersMiddleware(MiddlewareConfig{Name: "headers", Options: map[string]string{"team": "indexer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drop := func(MessageHandler) MessageHandler {
+		return func(context.Context, *decode.Message) error { return nil }
+	}
+	fail := func(MessageHandler) MessageHandler {
+		return func(context.Context, *decode.Message) error { return errors.New("rejected") }
+	}
+
+	sink := &sinktest.RecordSink{}
+	if err := NewMiddlewareSink(sink, []Middleware{step("first"), headers, step("second")}).Write(context.Background(), decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ",") != "first,second" || len(sink.Written) != 1 || sink.Written[0].Headers["team"] != "indexer" {
+		t.Fatalf("order %v, %d written", order, len(sink.Written))
+	}
+	if err := NewMiddlewareSink(sink, []Middleware{drop}).Write(context.Background(), decodetest.TransactionMessage(11, testkey.Key(1))); err != nil || len(sink.Written) != 1 {
+		t.Fatalf("dropped message: %v, %d written", err, len(sink.Written))
+	}
+	if err := NewMiddlewareSink(sink, []Middleware{fail}).Write(context.Background(), decodetest.TransactionMessage(12, testkey.Key(1))); err == nil || len(sink.Written) != 1 {
+		t.Fatalf("failed message: %v, %d written", err, len(sink.Written))
+	}
+}
+
+func TestSampleMiddleware(t *testing.T) {
+	sample, err := newSampleMiddleware(MiddlewareConfig{Name: "sample", Options: map[string]string{"rate": "0.25"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &sinktest.RecordSink{}
+	handler := sample(sink.Write)
+	kept := make(map[string]bool)
+	for i := range 1000 {
+		msg := decodetest.TransactionMessage(uint64(i), testkey.Key(1))
+		msg.Key = []byte(fmt.Sprintf("key%d", i%100))
+		before := len(sink.Written)
+		if err := handler(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+		key := string(msg.Key)
+		if was, seen := kept[key]; seen && was != (len(sink.Written) > before) {
+			t.Fatalf("%s kept and dropped", key)
+		}
+		kept[key] = len(sink.Written) > before
+	}
+	if len(sink.Written) < 100 || len(sink.Written) > 400 {
+		t.Fatalf("%d of 1000 kept at 0.25", len(sink.Written))
+	}
+
+	for _, options := range []map[string]string{nil, {"rate": "0"}, {"rate": "1.5"}, {"rate": "x"}, {"rate": "0.5", "seed": "1"}} {
+		if _, err := newSampleMiddleware(MiddlewareConfig{Name: "sample", Options: options}); err == nil {
+			t.Errorf("%v: no error", options)
+		}
+	}
+}
+
+func TestNewMiddlewares(t *testing.T) {
+	chain, err := NewMiddlewares([]MiddlewareConfig{{Type: "metrics"}, {Type: "sample", Options: map[string]string{"rate": "1"}}})
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("%d middlewares, %v", len(chain), err)
+	}
+	for _, test := range []struct {
+		configs []MiddlewareConfig
+		want    string
+	}{
+		{[]MiddlewareConfig{{Type: "metrics"}, {Type: "wasm"}}, `processing.middlewares[1].type: unknown middleware "wasm"`},
+		{[]MiddlewareConfig{{Type: "headers"}}, "processing.middlewares[0]: headers: at least one header"},
+		{[]MiddlewareConfig{{Type: "metrics", Name: "in", Options: map[string]string{"a": "b"}}}, "processing.middlewares[0]: in: takes no options"},
+	} {
+		if _, err := NewMiddlewares(test.configs); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %s", err, test.want)
+		}
+	}
+
+	RegisterMiddleware("test_noop", func(MiddlewareConfig) (Middleware, error) {
+		return func(next MessageHandler) MessageHandler { return next }, nil
+	})
+	defer delete(middlewares, "test_noop")
+	if _, err := NewMiddlewares([]MiddlewareConfig{{Type: "test_noop"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registered twice without a panic")
+		}
+	}()
+	RegisterMiddleware("test_noop", nil)
+}
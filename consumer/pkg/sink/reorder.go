@@ -0,0 +1,200 @@
+package sink
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// ReorderConfig holds updates back so they reach the sink in non-decreasing
+// slot order although the partitions deliver them interleaved.
+type ReorderConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// MaxSlots releases an update once one MaxSlots slots newer arrived.
+	MaxSlots uint64 `json:"max_slots" yaml:"max_slots"`
+	// MaxDelay releases an update with the next write this long after it
+	// arrived. Offset commits release everything in between.
+	MaxDelay duration.Duration `json:"max_delay" yaml:"max_delay"`
+}
+
+func (c *ReorderConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.MaxSlots == 0 {
+		return errors.New("processing.reorder.max_slots: must be positive")
+	}
+	if c.MaxDelay <= 0 {
+		return errors.New("processing.reorder.max_delay: must be positive")
+	}
+	return nil
+}
+
+// ReorderSink buffers writes and passes them to the next sink by slot. An
+// update older than one already passed on arrives too late and is dropped.
+// Flush releases everything buffered, so offset commits bound the window as
+// well. Updates without a slot and slot status updates are passed on
+// immediately, a slot is confirmed and finalized well after newer slots were
+// processed.
+//
+// Buffered updates are held, see Message.Hold. They are only released from
+// Write and Flush, so the consumer never marks an offset while it commits.
+type ReorderSink struct {
+	next     Sink
+	maxSlots uint64
+	maxDelay time.Duration
+
+	mu    sync.Mutex
+	queue reorderQueue
+	// arrivals lists the buffered items by arrival, items that left the
+	// buffer are skipped.
+	arrivals []*reorderItem
+	seq      uint64
+	newest   uint64
+	emitted  uint64
+}
+
+type reorderItem struct {
+	msg     *decode.Message
+	arrived time.Time
+	seq     uint64
+	// complete is set once the item is held, after the Write buffering it.
+	complete func()
+	// gone is set once the item left the buffer.
+	gone bool
+}
+
+// reorderQueue is a min-heap by slot, then arrival.
+type reorderQueue []*reorderItem
+
+func (q reorderQueue) Len() int { return len(q) }
+func (q reorderQueue) Less(i, j int) bool {
+	return cmp.Or(cmp.Compare(q[i].msg.Slot, q[j].msg.Slot), cmp.Compare(q[i].seq, q[j].seq)) < 0
+}
+func (q reorderQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *reorderQueue) Push(x any)   { *q = append(*q, x.(*reorderItem)) }
+func (q *reorderQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func NewReorderSink(next Sink, config ReorderConfig) *ReorderSink {
+	return &ReorderSink{
+		next:     next,
+		maxSlots: config.MaxSlots,
+		maxDelay: time.Duration(config.MaxDelay),
+	}
+}
+
+func (s *ReorderSink) Write(ctx context.Context, msg *decode.Message) error {
+	if msg.Slot == 0 || msg.Update.GetSlot() != nil {
+		return s.next.Write(ctx, msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Slot < s.emitted {
+		metrics.ReorderLateTotal.Inc()
+		logging.Logger.Warn("update arrived after a newer slot was written, dropped",
+			append(decode.MessageFields(msg), zap.Uint64("written_slot", s.emitted))...)
+		return nil
+	}
+	now := time.Now()
+	s.seq++
+	item := &reorderItem{msg: msg, arrived: now, seq: s.seq}
+	heap.Push(&s.queue, item)
+	s.arrivals = append(s.arrivals, item)
+	s.newest = max(s.newest, msg.Slot)
+
+	due := s.due(now)
+	err := s.release(ctx, func(queued *reorderItem) bool {
+		return queued.msg.Slot+s.maxSlots <= s.newest || queued.msg.Slot <= due
+	})
+	if item.gone {
+		return nil
+	}
+	if err == nil {
+		item.complete = msg.Hold()
+		return nil
+	}
+	// the failure is only reported for msg while it is still buffered, so a
+	// retry or dead-lettering of msg cannot write it twice
+	for i, queued := range s.queue {
+		if queued == item {
+			heap.Remove(&s.queue, i)
+			break
+		}
+	}
+	item.gone = true
+	metrics.ReorderDepth.Set(float64(s.queue.Len()))
+	return err
+}
+
+// due returns the newest slot among the overdue updates, which are released
+// with all updates of older slots, or 0.
+func (s *ReorderSink) due(now time.Time) uint64 {
+	for len(s.arrivals) > 0 && s.arrivals[0].gone {
+		s.arrivals[0] = nil
+		s.arrivals = s.arrivals[1:]
+	}
+	var due uint64
+	for _, item := range s.arrivals {
+		if now.Sub(item.arrived) < s.maxDelay {
+			break
+		}
+		if !item.gone {
+			due = max(due, item.msg.Slot)
+		}
+	}
+	return due
+}
+
+// release passes on the oldest updates while ready accepts them, an update
+// the next sink rejects stays buffered.
+func (s *ReorderSink) release(ctx context.Context, ready func(*reorderItem) bool) error {
+	defer func() { metrics.ReorderDepth.Set(float64(s.queue.Len())) }()
+	for s.queue.Len() > 0 && ready(s.queue[0]) {
+		item := s.queue[0]
+		var err error
+		if item.complete != nil {
+			err = WriteHeld(ctx, s.next, item.msg, item.complete)
+		} else {
+			// released by the Write that buffered it, the caller still owns it
+			err = s.next.Write(ctx, item.msg)
+		}
+		if err != nil {
+			return err
+		}
+		heap.Pop(&s.queue)
+		item.gone = true
+		s.emitted = item.msg.Slot
+	}
+	return nil
+}
+
+func (s *ReorderSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.release(ctx, func(*reorderItem) bool { return true })
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.next.Flush(ctx)
+}
+
+func (s *ReorderSink) Close() error {
+	err := s.Flush(context.Background())
+	return errors.Join(err, s.next.Close())
+}
@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+func newTestReorderSink(next Sink, maxSlots uint64) *ReorderSink {
+	return NewReorderSink(next, ReorderConfig{Enable: true, MaxSlots: maxSlots, MaxDelay: duration.Duration(time.Hour)})
+}
+
+func TestReorderSinkOrdersBySlot(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := newTestReorderSink(next, 2)
+	defer s.Close()
+	ctx := context.Background()
+
+	for _, slot := range []uint64{5, 3, 4, 6, 2, 7, 9} {
+		if err := s.Write(ctx, decodetest.TransactionMessage(slot, testkey.Key(1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 arrived after 4 was written and is dropped
+	if got, want := next.Slots(), []uint64{3, 4, 5, 6, 7}; !slices.Equal(got, want) {
+		t.Fatalf("written %v, want %v", got, want)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := next.Slots(), []uint64{3, 4, 5, 6, 7, 9}; !slices.Equal(got, want) {
+		t.Fatalf("written %v after flush, want %v", got, want)
+	}
+	if next.Flushes != 1 {
+		t.Fatalf("next flushed %d times, want 1", next.Flushes)
+	}
+}
+
+func TestReorderSinkKeepsArrivalOrderWithinSlot(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := newTestReorderSink(next, 1)
+	defer s.Close()
+	ctx := context.Background()
+
+	first, second := decodetest.TransactionMessage(5, testkey.Key(1)), decodetest.TransactionMessage(5, testkey.Key(2))
+	s.Write(ctx, first)
+	s.Write(ctx, second)
+	s.Write(ctx, decodetest.TransactionMessage(6, testkey.Key(1)))
+	if len(next.Written) != 2 || next.Written[0] != first || next.Written[1] != second {
+		t.Fatalf("written %v, want both updates of slot 5 in arrival order", next.Slots())
+	}
+}
+
+func TestReorderSinkPassesSlotUpdates(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	s := newTestReorderSink(next, 4)
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Write(ctx, decodetest.TransactionMessage(100, testkey.Key(1)))
+	s.Write(ctx, decodetest.TransactionMessage(110, testkey.Key(1)))
+	// the confirmation of an older slot is neither held back nor late
+	if err := s.Write(ctx, decodetest.SlotMessage(90, 89, proto.CommitmentLevel_CONFIRMED)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := next.Slots(), []uint64{100, 90}; !slices.Equal(got, want) {
+		t.Fatalf("written %v, want %v", got, want)
+	}
+	s.Write(ctx, &decode.Message{Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_Ping{Ping: &proto.SubscribeUpdatePing{}}}})
+	if n := len(next.Written); n != 3 {
+		t.Fatalf("%d updates written, want the ping passed on", n)
+	}
+}
+
+func TestReorderSinkFailedReleaseKeepsCallerOut(t *testing.T) {
+	failure := errors.New("sink down")
+	next := &sinktest.RecordSink{Fail: map[uint64]error{5: failure}}
+	s := newTestReorderSink(next, 1)
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Write(ctx, decodetest.TransactionMessage(5, testkey.Key(1)))
+	// releasing 5 fails, the caller's update of slot 6 is not kept buffered
+	// so its retry cannot write it twice
+	msg := decodetest.TransactionMessage(6, testkey.Key(1))
+	if err := s.Write(ctx, msg); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if s.queue.Len() != 1 {
+		t.Fatalf("%d updates buffered, want only slot 5", s.queue.Len())
+	}
+
+	delete(next.Fail, 5)
+	if err := s.Write(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := next.Slots(), []uint64{5, 6}; !slices.Equal(got, want) {
+		t.Fatalf("written %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package sink
+
+import (
+	"strings"
+
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// accountRow is the flattened account update written by the database sinks.
+type accountRow struct {
+	pubkey       string
+	slot         uint64
+	lamports     uint64
+	owner        string
+	executable   bool
+	rentEpoch    uint64
+	data         []byte
+	writeVersion uint64
+	// txnSignature is empty for startup snapshots and updates not caused by
+	// a transaction.
+	txnSignature string
+}
+
+func newAccountRow(msg *decode.Message) (accountRow, bool) {
+	update := msg.Update.GetAccount()
+	if update == nil {
+		return accountRow{}, false
+	}
+	info := update.GetAccount()
+
+	row := accountRow{
+		pubkey:       base58.Encode(info.GetPubkey()),
+		slot:         msg.Slot,
+		lamports:     info.GetLamports(),
+		owner:        base58.Encode(info.GetOwner()),
+		executable:   info.GetExecutable(),
+		rentEpoch:    info.GetRentEpoch(),
+		data:         info.GetData(),
+		writeVersion: info.GetWriteVersion(),
+	}
+	if signature := info.GetTxnSignature(); signature != nil {
+		row.txnSignature = base58.Encode(signature)
+	}
+	return row, true
+}
+
+// slotRow is a slot status change written by the database sinks.
+type slotRow struct {
+	slot   uint64
+	parent *uint64
+	// status is processed, confirmed, finalized and so on.
+	status    string
+	deadError string
+}
+
+func newSlotRow(msg *decode.Message) (slotRow, bool) {
+	update := msg.Update.GetSlot()
+	if update == nil {
+		return slotRow{}, false
+	}
+	return slotRow{
+		slot:      update.GetSlot(),
+		parent:    update.Parent,
+		status:    slotStatusName(update.GetStatus()),
+		deadError: update.GetDeadError(),
+	}, true
+}
+
+// slotStatusName turns FIRST_SHRED_RECEIVED into first_shred_received.
+func slotStatusName(status proto.CommitmentLevel) string {
+	return strings.ToLower(status.String())
+}
@@ -0,0 +1,272 @@
+// Package sink writes decoded messages to stdout, databases, object storage,
+// queues and webhooks.
+//
+// Every destination implements Sink. New creates the one a Config selects,
+// NewRouted adds the routes sending filtered messages to further sinks, and
+// the New*Sink constructors, such as NewPostgresSink, create a single one.
+// Others wrap a sink to hold messages back or derive new ones before passing
+// them on, such as NewCommitmentSink, NewBlockSink and NewMiddlewareSink.
+// The consumer commits the offset of a message once its sink flushed it, or
+// once the sink completed it if the sink held it, see decode.Message.Hold.
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"consumer/pkg/decode"
+)
+
+// Sink receives decoded messages. Write may buffer, Flush must return only
+// once everything written before it is durable, and Close flushes and
+// releases the sink. Writes can come from several partitions concurrently.
+// A message must not be kept past its Write unless held, see Message.Hold,
+// and not past its completion then: with decoding.reuse_messages it is
+// decoded into again.
+type Sink interface {
+	Write(ctx context.Context, msg *decode.Message) error
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// Config selects a sink by Type and configures it with the section of that
+// type.
+type Config struct {
+	// Type is one of stdout, postgres, clickhouse, parquet, webhook, redis,
+	// nats, elasticsearch, timescale, file, sqlite, mongodb, scylla, bigquery
+	// or arrow.
+	Type          string              `json:"type" yaml:"type"`
+	Stdout        StdoutConfig        `json:"stdout" yaml:"stdout"`
+	Postgres      PostgresConfig      `json:"postgres" yaml:"postgres"`
+	ClickHouse    ClickHouseConfig    `json:"clickhouse" yaml:"clickhouse"`
+	Parquet       ParquetConfig       `json:"parquet" yaml:"parquet"`
+	Webhook       WebhookConfig       `json:"webhook" yaml:"webhook"`
+	Redis         RedisConfig         `json:"redis" yaml:"redis"`
+	NATS          NATSConfig          `json:"nats" yaml:"nats"`
+	Elasticsearch ElasticsearchConfig `json:"elasticsearch" yaml:"elasticsearch"`
+	Timescale     TimescaleConfig     `json:"timescale" yaml:"timescale"`
+	File          FileConfig          `json:"file" yaml:"file"`
+	SQLite        SQLiteConfig        `json:"sqlite" yaml:"sqlite"`
+	MongoDB       MongoDBConfig       `json:"mongodb" yaml:"mongodb"`
+	Scylla        ScyllaConfig        `json:"scylla" yaml:"scylla"`
+	BigQuery      BigQueryConfig      `json:"bigquery" yaml:"bigquery"`
+	Arrow         ArrowConfig         `json:"arrow" yaml:"arrow"`
+}
+
+// DefaultConfig writes JSON to stdout and has the defaults of every sink.
+func DefaultConfig() Config {
+	return Config{
+		Type:          "stdout",
+		Stdout:        StdoutConfig{Format: "json"},
+		Postgres:      DefaultPostgresConfig(),
+		ClickHouse:    DefaultClickHouseConfig(),
+		Parquet:       DefaultParquetConfig(),
+		Webhook:       DefaultWebhookConfig(),
+		Redis:         DefaultRedisConfig(),
+		NATS:          DefaultNATSConfig(),
+		Elasticsearch: DefaultElasticsearchConfig(),
+		Timescale:     DefaultTimescaleConfig(),
+		File:          DefaultFileConfig(),
+		SQLite:        DefaultSQLiteConfig(),
+		MongoDB:       DefaultMongoDBConfig(),
+		Scylla:        DefaultScyllaConfig(),
+		BigQuery:      DefaultBigQueryConfig(),
+		Arrow:         DefaultArrowConfig(),
+	}
+}
+
+func (c *Config) Validate() error {
+	switch c.Type {
+	case "stdout":
+		return c.Stdout.Validate()
+	case "postgres":
+		return c.Postgres.Validate()
+	case "clickhouse":
+		return c.ClickHouse.Validate()
+	case "parquet":
+		return c.Parquet.Validate()
+	case "webhook":
+		return c.Webhook.Validate()
+	case "redis":
+		return c.Redis.Validate()
+	case "nats":
+		return c.NATS.Validate()
+	case "elasticsearch":
+		return c.Elasticsearch.Validate()
+	case "timescale":
+		return c.Timescale.Validate()
+	case "file":
+		return c.File.Validate()
+	case "sqlite":
+		return c.SQLite.Validate()
+	case "mongodb":
+		return c.MongoDB.Validate()
+	case "scylla":
+		return c.Scylla.Validate()
+	case "bigquery":
+		return c.BigQuery.Validate()
+	case "arrow":
+		return c.Arrow.Validate()
+	}
+	return fmt.Errorf("sink.type: unknown sink %q", c.Type)
+}
+
+// StdoutConfig configures the stdout sink.
+type StdoutConfig struct {
+	// Format is json for every update as labelled JSON lines, rpc for
+	// transactions only, shaped like Solana RPC getTransaction responses,
+	// ndjson for every message as a plain JSON object per line, inspect for
+	// transactions rendered for humans, see InspectHandler, or template for
+	// a line per message rendered by Template, see OutputTemplate.
+	Format   string `json:"format" yaml:"format"`
+	Template string `json:"template" yaml:"template"`
+}
+
+func (c *StdoutConfig) Validate() error {
+	switch c.Format {
+	case "json", "rpc", "ndjson", "inspect":
+		return nil
+	case "template":
+		return validateOutputTemplate("sink.stdout.template", c.Template)
+	}
+	return fmt.Errorf("sink.stdout.format: expected json, rpc, ndjson, inspect or template, got %q", c.Format)
+}
+
+// New creates the sink selected by the config.
+func New(ctx context.Context, config Config) (Sink, error) {
+	switch config.Type {
+	case "stdout":
+		switch config.Stdout.Format {
+		case "rpc":
+			return HandlerSink{Handler: RPCPrintHandler{}}, nil
+		case "ndjson":
+			return &NDJSONSink{w: os.Stdout}, nil
+		case "inspect":
+			return HandlerSink{Handler: InspectHandler{}}, nil
+		case "template":
+			t, err := ParseOutputTemplate(config.Stdout.Template)
+			if err != nil {
+				return nil, err
+			}
+			return &TemplateSink{w: os.Stdout, template: t}, nil
+		}
+		return HandlerSink{Handler: PrintHandler{}}, nil
+	case "postgres":
+		return NewPostgresSink(ctx, config.Postgres)
+	case "clickhouse":
+		return NewClickHouseSink(ctx, config.ClickHouse)
+	case "parquet":
+		return NewParquetSink(ctx, config.Parquet)
+	case "webhook":
+		return NewWebhookSink(config.Webhook)
+	case "redis":
+		return NewRedisSink(ctx, config.Redis)
+	case "nats":
+		return NewNATSSink(ctx, config.NATS)
+	case "elasticsearch":
+		return NewElasticsearchSink(ctx, config.Elasticsearch)
+	case "timescale":
+		return NewTimescaleSink(ctx, config.Timescale)
+	case "file":
+		return NewFileSink(config.File)
+	case "sqlite":
+		return NewSQLiteSink(ctx, config.SQLite)
+	case "mongodb":
+		return NewMongoDBSink(ctx, config.MongoDB)
+	case "scylla":
+		return NewScyllaSink(config.Scylla)
+	case "bigquery":
+		return NewBigQuerySink(ctx, config.BigQuery)
+	case "arrow":
+		return NewArrowSink(config.Arrow)
+	}
+	return nil, errors.New("unknown sink type")
+}
+
+// HandlerSink feeds every message to an UpdateHandler without buffering.
+type HandlerSink struct {
+	Handler UpdateHandler
+}
+
+func (s HandlerSink) Write(ctx context.Context, msg *decode.Message) error {
+	return Dispatch(ctx, s.Handler, msg)
+}
+
+func (HandlerSink) Flush(context.Context) error {
+	return nil
+}
+
+func (HandlerSink) Close() error {
+	return nil
+}
+
+// NDJSONSink writes every message to w as a JSON object per line, see
+// FormatRecordJSON. Lines are written whole, one write each, so a reader at
+// the end of a pipe sees them as soon as they are written.
+type NDJSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *NDJSONSink) Write(_ context.Context, msg *decode.Message) error {
+	line, err := decode.FormatRecordJSON(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (*NDJSONSink) Flush(context.Context) error {
+	return nil
+}
+
+func (*NDJSONSink) Close() error {
+	return nil
+}
+
+// TemplateSink writes every message to w as the line its template renders,
+// skipping messages rendered empty.
+type TemplateSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	template *OutputTemplate
+}
+
+func (s *TemplateSink) Write(_ context.Context, msg *decode.Message) error {
+	line, err := s.template.Render(msg)
+	if err != nil || line == nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (*TemplateSink) Flush(context.Context) error {
+	return nil
+}
+
+func (*TemplateSink) Close() error {
+	return nil
+}
+
+// WriteHeld passes a message the caller holds on to next and completes it,
+// unless next held it in turn.
+func WriteHeld(ctx context.Context, next Sink, msg *decode.Message, complete func()) error {
+	holds := msg.Holds()
+	if err := next.Write(ctx, msg); err != nil {
+		return err
+	}
+	if msg.Holds() == holds {
+		complete()
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+)
+
+// ArrowConfig writes transactions as Arrow IPC files to a local directory,
+// partitioned by slot range.
+type ArrowConfig struct {
+	Dir string `json:"dir" yaml:"dir"`
+	// SlotRange is the number of slots per slot_range partition.
+	SlotRange uint64 `json:"slot_range" yaml:"slot_range"`
+	// BatchRows is the number of rows per record batch of a file.
+	BatchRows int `json:"batch_rows" yaml:"batch_rows"`
+	// A file is finished once it reached MaxRows rows or was open for
+	// MaxAge.
+	MaxRows int               `json:"max_rows" yaml:"max_rows"`
+	MaxAge  duration.Duration `json:"max_age" yaml:"max_age"`
+	// Compression is zstd, lz4 or none.
+	Compression string `json:"compression" yaml:"compression"`
+	// PruneSlots deletes the partitions ending this many slots behind the
+	// newest slot written, none when 0.
+	PruneSlots uint64 `json:"prune_slots" yaml:"prune_slots"`
+}
+
+func DefaultArrowConfig() ArrowConfig {
+	return ArrowConfig{
+		SlotRange:   100_000,
+		BatchRows:   10_000,
+		MaxRows:     1_000_000,
+		MaxAge:      duration.Duration(time.Minute),
+		Compression: "zstd",
+	}
+}
+
+func (c *ArrowConfig) Validate() error {
+	if c.Dir == "" {
+		return errors.New("sink.arrow.dir: must not be empty")
+	}
+	if c.SlotRange == 0 {
+		return errors.New("sink.arrow.slot_range: must be positive")
+	}
+	if c.BatchRows <= 0 || c.MaxRows <= 0 || c.MaxAge <= 0 {
+		return errors.New("sink.arrow: batch_rows, max_rows and max_age must be positive")
+	}
+	if _, err := arrowCompression(c.Compression); err != nil {
+		return err
+	}
+	return nil
+}
+
+func arrowCompression(name string) ([]ipc.Option, error) {
+	switch name {
+	case "zstd":
+		return []ipc.Option{ipc.WithZstd()}, nil
+	case "lz4":
+		return []ipc.Option{ipc.WithLZ4()}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("sink.arrow.compression: expected zstd, lz4 or none, got %q", name)
+}
+
+// arrowSchema has the columns of the parquet sink.
+var arrowSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "slot", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "signature", Type: arrow.BinaryTypes.String},
+	{Name: "index", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "is_vote", Type: arrow.FixedWidthTypes.Boolean},
+	{Name: "success", Type: arrow.FixedWidthTypes.Boolean},
+	{Name: "err", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "fee", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "compute_units_consumed", Type: arrow.PrimitiveTypes.Uint64, Nullable: true},
+	{Name: "accounts", Type: arrow.ListOf(arrow.BinaryTypes.String)},
+	{Name: "programs", Type: arrow.ListOf(arrow.BinaryTypes.String)},
+	{Name: "log_messages", Type: arrow.ListOf(arrow.BinaryTypes.String)},
+	{Name: "kafka_timestamp", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+}, nil)
+
+// appendArrowRow appends row to the builders of arrowSchema.
+func appendArrowRow(b *array.RecordBuilder, row parquetTransaction) {
+	b.Field(0).(*array.Uint64Builder).Append(row.Slot)
+	b.Field(1).(*array.StringBuilder).Append(row.Signature)
+	b.Field(2).(*array.Uint64Builder).Append(row.Index)
+	b.Field(3).(*array.BooleanBuilder).Append(row.IsVote)
+	b.Field(4).(*array.BooleanBuilder).Append(row.Success)
+	if row.Err != nil {
+		b.Field(5).(*array.StringBuilder).Append(*row.Err)
+	} else {
+		b.Field(5).AppendNull()
+	}
+	b.Field(6).(*array.Uint64Builder).Append(row.Fee)
+	if row.ComputeUnitsConsumed != nil {
+		b.Field(7).(*array.Uint64Builder).Append(*row.ComputeUnitsConsumed)
+	} else {
+		b.Field(7).AppendNull()
+	}
+	for i, values := range [][]string{row.Accounts, row.Programs, row.LogMessages} {
+		list := b.Field(8 + i).(*array.ListBuilder)
+		list.Append(true)
+		list.ValueBuilder().(*array.StringBuilder).AppendValues(values, nil)
+	}
+	b.Field(11).(*array.TimestampBuilder).Append(arrow.Timestamp(row.KafkaTimestamp.UnixMilli()))
+}
+
+// ArrowSink writes transactions to one open Arrow IPC file per slot range,
+// appending a record batch every BatchRows rows, for ad-hoc SQL on recent
+// history with DuckDB, Polars or pyarrow. Files are written under a .tmp name
+// and renamed once finished, so readers globbing *.arrow see complete files
+// only. Written messages are held until their file was finished, see
+// Message.Hold. Other updates are ignored.
+type ArrowSink struct {
+	config      ArrowConfig
+	compression []ipc.Option
+	stop        chan struct{}
+	stopped     chan struct{}
+
+	mu    sync.Mutex
+	files map[uint64]*arrowFile
+	// newest is the newest slot written, which pruning keeps PruneSlots of.
+	newest uint64
+}
+
+type arrowFile struct {
+	start     uint64
+	file      *os.File
+	writer    *ipc.FileWriter
+	builder   *array.RecordBuilder
+	pending   int
+	rows      int
+	opened    time.Time
+	firstSlot uint64
+	lastSlot  uint64
+	completes []func()
+}
+
+func NewArrowSink(config ArrowConfig) (*ArrowSink, error) {
+	compression, err := arrowCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &ArrowSink{
+		config:      config,
+		compression: compression,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		files:       make(map[uint64]*arrowFile),
+	}
+	go s.rotateLoop()
+	return s, nil
+}
+
+// partition is the Hive style directory of the slot range starting at
+// start.
+func (s *ArrowSink) partition(start uint64) string {
+	return filepath.Join(s.config.Dir, "slot_range="+strconv.FormatUint(start, 10))
+}
+
+func (s *ArrowSink) Write(_ context.Context, msg *decode.Message) error {
+	row, ok := newParquetTransaction(msg)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := msg.Slot / s.config.SlotRange * s.config.SlotRange
+	f, ok := s.files[start]
+	if !ok {
+		var err error
+		if f, err = s.open(start); err != nil {
+			return err
+		}
+		s.files[start] = f
+	}
+	appendArrowRow(f.builder, row)
+	if f.rows == 0 {
+		f.firstSlot = msg.Slot
+	}
+	f.pending++
+	f.rows++
+	f.firstSlot = min(f.firstSlot, msg.Slot)
+	f.lastSlot = max(f.lastSlot, msg.Slot)
+	f.completes = append(f.completes, msg.Hold())
+	s.newest = max(s.newest, msg.Slot)
+
+	if f.pending >= s.config.BatchRows {
+		if err := f.writeBatch(); err != nil {
+			return err
+		}
+	}
+	if f.rows >= s.config.MaxRows {
+		s.finish(f)
+	}
+	return nil
+}
+
+func (s *ArrowSink) open(start uint64) (*arrowFile, error) {
+	dir := s.partition(start)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "transactions-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	options := append([]ipc.Option{ipc.WithSchema(arrowSchema)}, s.compression...)
+	writer, err := ipc.NewFileWriter(file, options...)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &arrowFile{
+		start:   start,
+		file:    file,
+		writer:  writer,
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, arrowSchema),
+		opened:  time.Now(),
+	}, nil
+}
+
+// writeBatch writes the pending rows as a record batch.
+func (f *arrowFile) writeBatch() error {
+	if f.pending == 0 {
+		return nil
+	}
+	record := f.builder.NewRecord()
+	defer record.Release()
+	f.pending = 0
+	if err := f.writer.Write(record); err != nil {
+		return fmt.Errorf("write %s: %w", f.file.Name(), err)
+	}
+	return nil
+}
+
+// finish writes out and closes f, renames it after its slots and completes
+// its messages. The caller holds s.mu.
+func (s *ArrowSink) finish(f *arrowFile) {
+	delete(s.files, f.start)
+	defer f.builder.Release()
+	err := f.writeBatch()
+	if err == nil {
+		err = errors.Join(f.writer.Close(), f.file.Sync())
+	}
+	err = errors.Join(err, f.file.Close())
+	name := filepath.Join(s.partition(f.start), fmt.Sprintf("%d-%d-%d.arrow", f.firstSlot, f.lastSlot, f.opened.UnixNano()))
+	if err == nil {
+		err = os.Rename(f.file.Name(), name)
+	}
+	if err != nil {
+		// the messages stay held and are consumed again after a restart
+		logging.Logger.Error("failed to finish arrow file", zap.String("file", f.file.Name()), zap.Error(err))
+		return
+	}
+	logging.Logger.Info("finished arrow file", zap.String("file", name), zap.Int("rows", f.rows))
+	for _, complete := range f.completes {
+		complete()
+	}
+	s.prune()
+}
+
+// prune deletes the partitions ending PruneSlots behind the newest slot,
+// unless a file of theirs is open. The caller holds s.mu.
+func (s *ArrowSink) prune() {
+	if s.config.PruneSlots == 0 || s.newest < s.config.PruneSlots {
+		return
+	}
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		logging.Logger.Warn("failed to list arrow partitions", zap.Error(err))
+		return
+	}
+	for _, entry := range entries {
+		start, err := strconv.ParseUint(strings.TrimPrefix(entry.Name(), "slot_range="), 10, 64)
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "slot_range=") || err != nil {
+			continue
+		}
+		if _, open := s.files[start]; open || start+s.config.SlotRange > s.newest-s.config.PruneSlots {
+			continue
+		}
+		if err := os.RemoveAll(s.partition(start)); err != nil {
+			logging.Logger.Warn("failed to prune arrow partition", zap.String("partition", entry.Name()), zap.Error(err))
+		}
+	}
+}
+
+// rotateLoop finishes the files open for MaxAge.
+func (s *ArrowSink) rotateLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for _, f := range s.files {
+				if now.Sub(f.opened) >= time.Duration(s.config.MaxAge) {
+					s.finish(f)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Flush does nothing, messages are committed once their file was finished.
+func (s *ArrowSink) Flush(context.Context) error {
+	return nil
+}
+
+// Close finishes the open files.
+func (s *ArrowSink) Close() error {
+	close(s.stop)
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.files {
+		s.finish(f)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package sink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+)
+
+func newTestArrowSink(t *testing.T, batchRows, maxRows int) *ArrowSink {
+	t.Helper()
+	config := DefaultArrowConfig()
+	config.Dir, config.BatchRows, config.MaxRows = t.TempDir(), batchRows, maxRows
+	s, err := NewArrowSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestArrowSinkRotatesByRows(t *testing.T) {
+	s := newTestArrowSink(t, 2, 3)
+	defer s.Close()
+	ctx := context.Background()
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var done completions
+
+	for _, msg := range []*decode.Message{done.message(11, day), done.message(10, day), decodetest.SlotMessage(12, 11, 0), done.message(12, day)} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if done.count(10) != 1 || done.count(12) != 1 {
+		t.Fatal("messages not completed once their file was finished")
+	}
+	files, _ := filepath.Glob(filepath.Join(s.config.Dir, "slot_range=0", "10-12-*.arrow"))
+	if len(files) != 1 {
+		t.Fatalf("files %v", files)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := ipc.NewFileReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.NumRecords() != 2 || !reader.Schema().Equal(arrowSchema) {
+		t.Fatalf("%d record batches of %v", reader.NumRecords(), reader.Schema())
+	}
+	var slots []uint64
+	for i := range reader.NumRecords() {
+		record, err := reader.Record(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots = append(slots, record.Column(0).(*array.Uint64).Uint64Values()...)
+		if i == 0 {
+			accounts := record.Column(8).(*array.List)
+			if record.Column(5).IsValid(0) || accounts.ListValues().(*array.String).Value(0) != testkey.String(1) ||
+				record.Column(11).(*array.Timestamp).Value(0) != arrow.Timestamp(day.UnixMilli()) {
+				t.Fatalf("first row of %v", record)
+			}
+		}
+	}
+	if !slices.Equal(slots, []uint64{11, 10, 12}) {
+		t.Fatalf("slots %v", slots)
+	}
+}
+
+func TestArrowSinkClosePrunes(t *testing.T) {
+	s := newTestArrowSink(t, 100, 100)
+	s.config.PruneSlots = 150_000
+	var done completions
+	for _, slot := range []uint64{10, 100_001, 250_000} {
+		if err := s.Write(context.Background(), done.message(slot, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if done.count(10) != 0 {
+		t.Fatal("message completed before its file was finished")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// slot_range=0 ends 150000 slots behind 250000
+	partitions, _ := filepath.Glob(filepath.Join(s.config.Dir, "*"))
+	for i := range partitions {
+		partitions[i] = filepath.Base(partitions[i])
+	}
+	if want := []string{"slot_range=100000", "slot_range=200000"}; !slices.Equal(partitions, want) {
+		t.Fatalf("partitions %v, want %v", partitions, want)
+	}
+	if done.count(10) != 1 || done.count(250_000) != 1 {
+		t.Fatal("messages not completed on close")
+	}
+}
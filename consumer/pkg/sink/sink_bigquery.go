@@ -0,0 +1,249 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+// bigQueryMaxRequest caps the serialized rows of an append, below the 10MB
+// limit of an AppendRows request.
+const bigQueryMaxRequest = 8 << 20
+
+type BigQueryConfig struct {
+	Project string `json:"project" yaml:"project"`
+	Dataset string `json:"dataset" yaml:"dataset"`
+	Table   string `json:"table" yaml:"table"`
+	// CredentialsFile is a service account key, the application default
+	// credentials are used when empty.
+	CredentialsFile string            `json:"credentials_file" yaml:"credentials_file"`
+	BatchSize       int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval   duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// CreateTable creates the table on startup when it does not exist,
+	// partitioned by day of kafka_timestamp and clustered by slot.
+	CreateTable bool `json:"create_table" yaml:"create_table"`
+}
+
+func DefaultBigQueryConfig() BigQueryConfig {
+	return BigQueryConfig{
+		Table:         "transactions",
+		BatchSize:     1000,
+		FlushInterval: duration.Duration(time.Second),
+	}
+}
+
+func (c *BigQueryConfig) Validate() error {
+	if c.Project == "" || c.Dataset == "" || c.Table == "" {
+		return errors.New("sink.bigquery: project, dataset and table must not be empty")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.bigquery.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("sink.bigquery.flush_interval: must be positive")
+	}
+	return nil
+}
+
+// bigQuerySchema is the schema of the table, the columns of the parquet sink.
+var bigQuerySchema = bigquery.Schema{
+	{Name: "slot", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "signature", Type: bigquery.StringFieldType, Required: true},
+	{Name: "index", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "is_vote", Type: bigquery.BooleanFieldType, Required: true},
+	{Name: "success", Type: bigquery.BooleanFieldType, Required: true},
+	{Name: "err", Type: bigquery.StringFieldType},
+	{Name: "fee", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "compute_units_consumed", Type: bigquery.IntegerFieldType},
+	{Name: "accounts", Type: bigquery.StringFieldType, Repeated: true},
+	{Name: "programs", Type: bigquery.StringFieldType, Repeated: true},
+	{Name: "log_messages", Type: bigquery.StringFieldType, Repeated: true},
+	{Name: "kafka_timestamp", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+// bigQueryDescriptor derives the protobuf message of a row from
+// bigQuerySchema, as the Storage Write API takes rows.
+func bigQueryDescriptor() (protoreflect.MessageDescriptor, error) {
+	schema, err := adapt.BQSchemaToStorageTableSchema(bigQuerySchema)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(schema, "transaction")
+	if err != nil {
+		return nil, err
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("schema converted to a %T", descriptor)
+	}
+	return message, nil
+}
+
+// bigQueryRow encodes the row of a transaction as a message of descriptor.
+func bigQueryRow(descriptor protoreflect.MessageDescriptor, row parquetTransaction) ([]byte, error) {
+	m := dynamicpb.NewMessage(descriptor)
+	fields := descriptor.Fields()
+	set := func(name string, v protoreflect.Value) {
+		m.Set(fields.ByName(protoreflect.Name(name)), v)
+	}
+	list := func(name string, values []string) {
+		l := m.Mutable(fields.ByName(protoreflect.Name(name))).List()
+		for _, v := range values {
+			l.Append(protoreflect.ValueOfString(v))
+		}
+	}
+	set("slot", protoreflect.ValueOfInt64(int64(row.Slot)))
+	set("signature", protoreflect.ValueOfString(row.Signature))
+	set("index", protoreflect.ValueOfInt64(int64(row.Index)))
+	set("is_vote", protoreflect.ValueOfBool(row.IsVote))
+	set("success", protoreflect.ValueOfBool(row.Success))
+	if row.Err != nil {
+		set("err", protoreflect.ValueOfString(*row.Err))
+	}
+	set("fee", protoreflect.ValueOfInt64(int64(row.Fee)))
+	if row.ComputeUnitsConsumed != nil {
+		set("compute_units_consumed", protoreflect.ValueOfInt64(int64(*row.ComputeUnitsConsumed)))
+	}
+	list("accounts", row.Accounts)
+	list("programs", row.Programs)
+	list("log_messages", row.LogMessages)
+	// timestamps are microseconds since the epoch
+	set("kafka_timestamp", protoreflect.ValueOfInt64(row.KafkaTimestamp.UnixMicro()))
+	return gproto.Marshal(m)
+}
+
+// BigQuerySink streams transactions into a BigQuery table with the Storage
+// Write API, other updates are ignored. Rows are appended to the default
+// stream of the table in batches, a flush returning once BigQuery
+// acknowledged them. The default stream is at-least-once, rows written
+// again after a failure are duplicated.
+type BigQuerySink struct {
+	client     *managedwriter.Client
+	stream     *managedwriter.ManagedStream
+	descriptor protoreflect.MessageDescriptor
+	rows       *batcher[[]byte]
+}
+
+func NewBigQuerySink(ctx context.Context, config BigQueryConfig) (*BigQuerySink, error) {
+	var options []option.ClientOption
+	if config.CredentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(config.CredentialsFile))
+	}
+	if config.CreateTable {
+		if err := createBigQueryTable(ctx, config, options); err != nil {
+			return nil, err
+		}
+	}
+	descriptor, err := bigQueryDescriptor()
+	if err != nil {
+		return nil, fmt.Errorf("bigquery descriptor: %w", err)
+	}
+	normalized, err := adapt.NormalizeDescriptor(descriptor)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery descriptor: %w", err)
+	}
+	client, err := managedwriter.NewClient(ctx, config.Project, options...)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery connect: %w", err)
+	}
+	stream, err := client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(config.Project, config.Dataset, config.Table)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(normalized))
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("bigquery open stream: %w", err)
+	}
+	s := &BigQuerySink{client: client, stream: stream, descriptor: descriptor}
+	s.rows = newBatcher("bigquery", config.BatchSize, time.Duration(config.FlushInterval), s.append)
+	return s, nil
+}
+
+// createBigQueryTable creates the table unless it exists.
+func createBigQueryTable(ctx context.Context, config BigQueryConfig, options []option.ClientOption) error {
+	client, err := bigquery.NewClient(ctx, config.Project, options...)
+	if err != nil {
+		return fmt.Errorf("bigquery connect: %w", err)
+	}
+	defer client.Close()
+	err = client.Dataset(config.Dataset).Table(config.Table).Create(ctx, &bigquery.TableMetadata{
+		Schema:           bigQuerySchema,
+		TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType, Field: "kafka_timestamp"},
+		Clustering:       &bigquery.Clustering{Fields: []string{"slot"}},
+	})
+	if apiErr := (*googleapi.Error)(nil); errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("bigquery create table %s.%s: %w", config.Dataset, config.Table, err)
+	}
+	return nil
+}
+
+func (s *BigQuerySink) Write(ctx context.Context, msg *decode.Message) error {
+	row, ok := newParquetTransaction(msg)
+	if !ok {
+		return nil
+	}
+	data, err := bigQueryRow(s.descriptor, row)
+	if err != nil {
+		return err
+	}
+	return s.rows.Add(ctx, data)
+}
+
+func (s *BigQuerySink) Flush(ctx context.Context) error {
+	return s.rows.Flush(ctx)
+}
+
+// append sends the rows in requests of up to bigQueryMaxRequest bytes and
+// waits for all of them to be acknowledged.
+func (s *BigQuerySink) append(ctx context.Context, rows [][]byte) error {
+	var results []*managedwriter.AppendResult
+	send := func(request [][]byte) error {
+		result, err := s.stream.AppendRows(ctx, request)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+		return nil
+	}
+	start, size := 0, 0
+	for i, row := range rows {
+		if size+len(row) > bigQueryMaxRequest && i > start {
+			if err := send(rows[start:i]); err != nil {
+				return fmt.Errorf("bigquery append %d rows: %w", len(rows), err)
+			}
+			start, size = i, 0
+		}
+		size += len(row)
+	}
+	if err := send(rows[start:]); err != nil {
+		return fmt.Errorf("bigquery append %d rows: %w", len(rows), err)
+	}
+	for _, result := range results {
+		if _, err := result.GetResult(ctx); err != nil {
+			return fmt.Errorf("bigquery append %d rows: %w", len(rows), err)
+		}
+	}
+	return nil
+}
+
+func (s *BigQuerySink) Close() error {
+	err := s.rows.Close()
+	return errors.Join(err, s.stream.Close(), s.client.Close())
+}
@@ -0,0 +1,43 @@
+package sink
+
+import (
+	"testing"
+	"time"
+
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+)
+
+func TestBigQueryRow(t *testing.T) {
+	descriptor, err := bigQueryDescriptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := descriptor.Fields(); fields.Len() != len(bigQuerySchema) || !fields.ByName("accounts").IsList() ||
+		fields.ByName("err").Cardinality() != protoreflect.Optional {
+		t.Fatalf("descriptor %v", descriptor)
+	}
+
+	msg := decodetest.TransactionMessage(10, testkey.Key(1), testkey.Key(2))
+	msg.Timestamp = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	row, _ := newParquetTransaction(msg)
+	data, err := bigQueryRow(descriptor, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := dynamicpb.NewMessage(descriptor)
+	if err := gproto.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	get := func(name string) protoreflect.Value {
+		return decoded.Get(descriptor.Fields().ByName(protoreflect.Name(name)))
+	}
+	if get("slot").Int() != 10 || get("signature").String() != testkey.String(0xff) || get("accounts").List().Len() != 2 ||
+		get("kafka_timestamp").Int() != msg.Timestamp.UnixMicro() || decoded.Has(descriptor.Fields().ByName("err")) {
+		t.Fatalf("row %v", decoded)
+	}
+}
@@ -0,0 +1,368 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+)
+
+type ClickHouseConfig struct {
+	Addr     []string `json:"addr" yaml:"addr"`
+	Database string   `json:"database" yaml:"database"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password" yaml:"password"`
+	Table    string   `json:"table" yaml:"table"`
+	// AccountTable and SlotTable receive account and slot updates, which
+	// are ignored when the table is empty.
+	AccountTable  string            `json:"account_table" yaml:"account_table"`
+	SlotTable     string            `json:"slot_table" yaml:"slot_table"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// AsyncInsert lets the server buffer inserts, WaitForAsyncInsert makes
+	// a flush return only once the server has written them.
+	AsyncInsert        bool `json:"async_insert" yaml:"async_insert"`
+	WaitForAsyncInsert bool `json:"wait_for_async_insert" yaml:"wait_for_async_insert"`
+	// CreateTable creates the tables on startup when they do not exist.
+	CreateTable bool `json:"create_table" yaml:"create_table"`
+	// MaxRetries is how many times a batch is retried after a temporary
+	// failure, waiting RetryBackoff and doubling it between attempts.
+	MaxRetries   int               `json:"max_retries" yaml:"max_retries"`
+	RetryBackoff duration.Duration `json:"retry_backoff" yaml:"retry_backoff"`
+}
+
+func DefaultClickHouseConfig() ClickHouseConfig {
+	return ClickHouseConfig{
+		Addr:               []string{"localhost:9000"},
+		Database:           "default",
+		Username:           "default",
+		Table:              "transactions",
+		BatchSize:          10_000,
+		FlushInterval:      duration.Duration(time.Second),
+		AsyncInsert:        true,
+		WaitForAsyncInsert: true,
+		MaxRetries:         5,
+		RetryBackoff:       duration.Duration(100 * time.Millisecond),
+	}
+}
+
+func (c *ClickHouseConfig) Validate() error {
+	if len(c.Addr) == 0 {
+		return errors.New("sink.clickhouse.addr: at least one address is required")
+	}
+	if c.Table == "" {
+		return errors.New("sink.clickhouse.table: must not be empty")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.clickhouse.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("sink.clickhouse.flush_interval: must be positive")
+	}
+	if c.MaxRetries < 0 {
+		return errors.New("sink.clickhouse.max_retries: must not be negative")
+	}
+	return nil
+}
+
+// clickHouseTables returns the CREATE TABLE statements of the enabled tables.
+func clickHouseTables(config ClickHouseConfig) []string {
+	tables := []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		signature String,
+		slot UInt64,
+		accounts Array(String),
+		err String,
+		logs Array(String),
+		rolled_back Bool DEFAULT false
+	) ENGINE = ReplacingMergeTree
+	ORDER BY (slot, signature)`, clickHouseIdentifier(config.Table))}
+	if config.AccountTable != "" {
+		tables = append(tables, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			pubkey String,
+			slot UInt64,
+			lamports UInt64,
+			owner String,
+			executable Bool,
+			rent_epoch UInt64,
+			data String,
+			write_version UInt64,
+			txn_signature String,
+			rolled_back Bool DEFAULT false
+		) ENGINE = ReplacingMergeTree
+		ORDER BY (pubkey, slot, write_version)`, clickHouseIdentifier(config.AccountTable)))
+	}
+	if config.SlotTable != "" {
+		tables = append(tables, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			slot UInt64,
+			parent Nullable(UInt64),
+			status LowCardinality(String),
+			dead_error String
+		) ENGINE = ReplacingMergeTree
+		ORDER BY (slot, status)`, clickHouseIdentifier(config.SlotTable)))
+	}
+	return tables
+}
+
+// clickHouseIdentifier quotes a table name, which may be database qualified.
+func clickHouseIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		part = strings.ReplaceAll(part, `\`, `\\`)
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "\\`") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// ClickHouseSink writes transactions, and optionally accounts and slots, in
+// column-oriented batches over the native protocol.
+type ClickHouseSink struct {
+	config       ClickHouseConfig
+	conn         driver.Conn
+	transactions *batcher[decode.TransactionRow]
+	// accounts and slots are nil when their table is disabled.
+	accounts *batcher[accountRow]
+	slots    *batcher[slotRow]
+}
+
+func NewClickHouseSink(ctx context.Context, config ClickHouseConfig) (*ClickHouseSink, error) {
+	conn, err := clickhouse.Open(&clickhouse.Options{
+		Addr: config.Addr,
+		Auth: clickhouse.Auth{
+			Database: config.Database,
+			Username: config.Username,
+			Password: config.Password,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse connect: %w", err)
+	}
+	if err := conn.Ping(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("clickhouse connect: %w", err)
+	}
+
+	if config.CreateTable {
+		for _, ddl := range clickHouseTables(config) {
+			if err := conn.Exec(ctx, ddl); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("clickhouse create table: %w", err)
+			}
+		}
+	}
+
+	return newClickHouseSink(config, conn), nil
+}
+
+// newClickHouseSink writes with conn, which is connected and has the tables.
+func newClickHouseSink(config ClickHouseConfig, conn driver.Conn) *ClickHouseSink {
+	s := &ClickHouseSink{config: config, conn: conn}
+	interval := time.Duration(config.FlushInterval)
+	s.transactions = newBatcher("clickhouse", config.BatchSize, interval, s.insertTransactions)
+	if config.AccountTable != "" {
+		s.accounts = newBatcher("clickhouse accounts", config.BatchSize, interval, s.insertAccounts)
+	}
+	if config.SlotTable != "" {
+		s.slots = newBatcher("clickhouse slots", config.BatchSize, interval, s.insertSlots)
+	}
+	return s
+}
+
+func (s *ClickHouseSink) Write(ctx context.Context, msg *decode.Message) error {
+	switch msg.Kind() {
+	case decode.KindTransaction:
+		if row, ok := decode.NewTransactionRow(msg); ok {
+			return s.transactions.Add(ctx, row)
+		}
+	case decode.KindAccount:
+		if row, ok := newAccountRow(msg); ok && s.accounts != nil {
+			return s.accounts.Add(ctx, row)
+		}
+	case decode.KindSlot:
+		if row, ok := newSlotRow(msg); ok && s.slots != nil {
+			return s.slots.Add(ctx, row)
+		}
+	}
+	return nil
+}
+
+func (s *ClickHouseSink) Flush(ctx context.Context) error {
+	return errors.Join(s.transactions.Flush(ctx), s.accounts.Flush(ctx), s.slots.Flush(ctx))
+}
+
+func (s *ClickHouseSink) Close() error {
+	err := errors.Join(s.transactions.Close(), s.accounts.Close(), s.slots.Close())
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RollbackSlots writes the pending rows out, then deletes the transactions
+// and accounts of slots or marks them rolled back. The mutations are waited
+// for so that the rows are gone once it returns.
+func (s *ClickHouseSink) RollbackSlots(ctx context.Context, slots []uint64, mark bool) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	tables := []string{s.config.Table}
+	if s.config.AccountTable != "" {
+		tables = append(tables, s.config.AccountTable)
+	}
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{"mutations_sync": 1}))
+	for _, table := range tables {
+		statement := "ALTER TABLE %s DELETE WHERE has(?, slot)"
+		if mark {
+			statement = "ALTER TABLE %s UPDATE rolled_back = true WHERE has(?, slot)"
+		}
+		if err := s.conn.Exec(ctx, fmt.Sprintf(statement, clickHouseIdentifier(table)), slots); err != nil {
+			return fmt.Errorf("clickhouse roll back %d slots of %s: %w", len(slots), table, err)
+		}
+	}
+	return nil
+}
+
+func (s *ClickHouseSink) insertTransactions(ctx context.Context, rows []decode.TransactionRow) error {
+	signatures := make([]string, len(rows))
+	slots := make([]uint64, len(rows))
+	accounts := make([][]string, len(rows))
+	errs := make([]string, len(rows))
+	logs := make([][]string, len(rows))
+	for i, row := range rows {
+		signatures[i] = row.Signature
+		slots[i] = row.Slot
+		accounts[i] = row.Accounts
+		errs[i] = string(row.Err)
+		logs[i] = row.Logs
+	}
+	return s.insertWithRetry(ctx, s.config.Table, "signature, slot, accounts, err, logs", len(rows),
+		[]any{signatures, slots, accounts, errs, logs})
+}
+
+func (s *ClickHouseSink) insertAccounts(ctx context.Context, rows []accountRow) error {
+	pubkeys := make([]string, len(rows))
+	slots := make([]uint64, len(rows))
+	lamports := make([]uint64, len(rows))
+	owners := make([]string, len(rows))
+	executable := make([]bool, len(rows))
+	rentEpochs := make([]uint64, len(rows))
+	data := make([]string, len(rows))
+	writeVersions := make([]uint64, len(rows))
+	txnSignatures := make([]string, len(rows))
+	for i, row := range rows {
+		pubkeys[i] = row.pubkey
+		slots[i] = row.slot
+		lamports[i] = row.lamports
+		owners[i] = row.owner
+		executable[i] = row.executable
+		rentEpochs[i] = row.rentEpoch
+		data[i] = string(row.data)
+		writeVersions[i] = row.writeVersion
+		txnSignatures[i] = row.txnSignature
+	}
+	return s.insertWithRetry(ctx, s.config.AccountTable,
+		"pubkey, slot, lamports, owner, executable, rent_epoch, data, write_version, txn_signature", len(rows),
+		[]any{pubkeys, slots, lamports, owners, executable, rentEpochs, data, writeVersions, txnSignatures})
+}
+
+func (s *ClickHouseSink) insertSlots(ctx context.Context, rows []slotRow) error {
+	slots := make([]uint64, len(rows))
+	parents := make([]*uint64, len(rows))
+	statuses := make([]string, len(rows))
+	deadErrors := make([]string, len(rows))
+	for i, row := range rows {
+		slots[i] = row.slot
+		parents[i] = row.parent
+		statuses[i] = row.status
+		deadErrors[i] = row.deadError
+	}
+	return s.insertWithRetry(ctx, s.config.SlotTable, "slot, parent, status, dead_error", len(rows),
+		[]any{slots, parents, statuses, deadErrors})
+}
+
+func (s *ClickHouseSink) insertWithRetry(ctx context.Context, table, columns string, rows int, values []any) error {
+	backoff := time.Duration(s.config.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		err := s.insertBatch(ctx, table, columns, rows, values)
+		if err == nil || attempt >= s.config.MaxRetries || !isClickHouseTemporary(err) {
+			return err
+		}
+
+		logging.Logger.Warn("clickhouse insert failed, retrying",
+			zap.String("table", table), zap.Int("rows", rows), zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// clickHouseInsertSettings returns the settings of the inserts, nil without
+// async_insert.
+func clickHouseInsertSettings(config ClickHouseConfig) clickhouse.Settings {
+	if !config.AsyncInsert {
+		return nil
+	}
+	wait := 0
+	if config.WaitForAsyncInsert {
+		wait = 1
+	}
+	return clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": wait,
+	}
+}
+
+func (s *ClickHouseSink) insertBatch(ctx context.Context, table, columns string, rows int, values []any) error {
+	if settings := clickHouseInsertSettings(s.config); settings != nil {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+	}
+
+	batch, err := s.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s (%s)", clickHouseIdentifier(table), columns))
+	if err != nil {
+		return fmt.Errorf("clickhouse prepare batch: %w", err)
+	}
+	for i, column := range values {
+		if err := batch.Column(i).Append(column); err != nil {
+			batch.Abort()
+			return fmt.Errorf("clickhouse append column %d: %w", i, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("clickhouse insert %d rows into %s: %w", rows, table, err)
+	}
+	return nil
+}
+
+// isClickHouseTemporary reports whether a failed insert is worth retrying.
+// Server exceptions are permanent unless they signal overload, anything
+// else is assumed to be a connection problem.
+func isClickHouseTemporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		switch exception.Code {
+		case 159, // TIMEOUT_EXCEEDED
+			202, // TOO_MANY_SIMULTANEOUS_QUERIES
+			209, // SOCKET_TIMEOUT
+			210, // NETWORK_ERROR
+			252, // TOO_MANY_PARTS
+			425: // SYSTEM_ERROR
+			return true
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+func TestClickHouseIdentifier(t *testing.T) {
+	for name, want := range map[string]string{
+		"transactions":        "`transactions`",
+		"solana.transactions": "`solana`.`transactions`",
+		"tx`; DROP TABLE x":   "`tx\\`; DROP TABLE x`",
+		`a\b`:                 "`a\\\\b`",
+	} {
+		if got := clickHouseIdentifier(name); got != want {
+			t.Errorf("clickHouseIdentifier(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestClickHouseTablesQuoteNames(t *testing.T) {
+	tables := clickHouseTables(ClickHouseConfig{Table: "db.tx", AccountTable: "accounts", SlotTable: "slots"})
+	for i, want := range []string{"`db`.`tx` (", "`accounts` (", "`slots` ("} {
+		if !strings.Contains(tables[i], "CREATE TABLE IF NOT EXISTS "+want) {
+			t.Errorf("statement %d does not create %s:\n%s", i, want, tables[i])
+		}
+	}
+}
+
+// clickHouseConn records the batches prepared on it, failing their Send with
+// the errors of sendErrs in turn.
+type clickHouseConn struct {
+	driver.Conn
+	sendErrs []error
+	batches  []*clickHouseBatch
+}
+
+func (c *clickHouseConn) PrepareBatch(_ context.Context, query string, _ ...driver.PrepareBatchOption) (driver.Batch, error) {
+	batch := &clickHouseBatch{query: query, conn: c}
+	c.batches = append(c.batches, batch)
+	return batch, nil
+}
+
+func (c *clickHouseConn) Close() error { return nil }
+
+type clickHouseBatch struct {
+	driver.Batch
+	conn    *clickHouseConn
+	query   string
+	columns []any
+}
+
+func (b *clickHouseBatch) Column(i int) driver.BatchColumn {
+	return clickHouseColumn{b, i}
+}
+
+func (b *clickHouseBatch) Send() error {
+	if len(b.conn.sendErrs) == 0 {
+		return nil
+	}
+	err := b.conn.sendErrs[0]
+	b.conn.sendErrs = b.conn.sendErrs[1:]
+	return err
+}
+
+type clickHouseColumn struct {
+	batch *clickHouseBatch
+	i     int
+}
+
+func (clickHouseColumn) AppendRow(any) error { return errors.New("rows are appended by column") }
+
+func (c clickHouseColumn) Append(values any) error {
+	if c.i != len(c.batch.columns) {
+		return errors.New("columns appended out of order")
+	}
+	c.batch.columns = append(c.batch.columns, values)
+	return nil
+}
+
+func TestClickHouseSinkColumns(t *testing.T) {
+	config := DefaultClickHouseConfig()
+	config.Table, config.AccountTable, config.SlotTable = "db.tx", "accounts", "slots"
+	conn := &clickHouseConn{}
+	s := newClickHouseSink(config, conn)
+	defer s.Close()
+
+	tx := decodetest.TransactionMessage(10, testkey.Key(1), testkey.Key(2))
+	tx.Update.GetTransaction().Transaction.Meta.LogMessages = []string{"Program log: hi"}
+	account := decodetest.AccountMessage(11, testkey.Key(3), testkey.Key(4))
+	info := account.Update.GetAccount().Account
+	info.Lamports, info.Executable, info.RentEpoch, info.Data, info.WriteVersion, info.TxnSignature = 5, true, 6, []byte("data"), 7, testkey.Key(0xff)
+	ctx := context.Background()
+	for _, msg := range []*decode.Message{tx, account, decodetest.SlotMessage(12, 11, proto.CommitmentLevel_CONFIRMED), decodetest.SlotMessage(13, 0, proto.CommitmentLevel_PROCESSED)} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	parent := uint64(11)
+	signature := testkey.String(0xff)
+	for i, want := range []struct {
+		query   string
+		columns []any
+	}{
+		{"INSERT INTO `db`.`tx` (signature, slot, accounts, err, logs)", []any{
+			[]string{signature}, []uint64{10}, [][]string{{testkey.String(2), testkey.String(1)}}, []string{""}, [][]string{{"Program log: hi"}},
+		}},
+		{"INSERT INTO `accounts` (pubkey, slot, lamports, owner, executable, rent_epoch, data, write_version, txn_signature)", []any{
+			[]string{testkey.String(3)}, []uint64{11}, []uint64{5}, []string{testkey.String(4)}, []bool{true}, []uint64{6}, []string{"data"}, []uint64{7}, []string{signature},
+		}},
+		{"INSERT INTO `slots` (slot, parent, status, dead_error)", []any{
+			[]uint64{12, 13}, []*uint64{&parent, nil}, []string{"confirmed", "processed"}, []string{"", ""},
+		}},
+	} {
+		batch := conn.batches[i]
+		if batch.query != want.query || !reflect.DeepEqual(batch.columns, want.columns) {
+			t.Errorf("batch %d: %s\n%#v\nwant %s\n%#v", i, batch.query, batch.columns, want.query, want.columns)
+		}
+	}
+}
+
+func TestClickHouseInsertSettings(t *testing.T) {
+	config := DefaultClickHouseConfig()
+	if settings := clickHouseInsertSettings(config); settings["async_insert"] != 1 || settings["wait_for_async_insert"] != 1 {
+		t.Errorf("settings %v", settings)
+	}
+	config.WaitForAsyncInsert = false
+	if settings := clickHouseInsertSettings(config); settings["async_insert"] != 1 || settings["wait_for_async_insert"] != 0 {
+		t.Errorf("settings %v without waiting", settings)
+	}
+	config.AsyncInsert = false
+	if settings := clickHouseInsertSettings(config); settings != nil {
+		t.Errorf("settings %v without async_insert", settings)
+	}
+}
+
+func TestClickHouseTemporary(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&clickhouse.Exception{Code: 252, Name: "TOO_MANY_PARTS"}, true},
+		{&clickhouse.Exception{Code: 202, Name: "TOO_MANY_SIMULTANEOUS_QUERIES"}, true},
+		{&clickhouse.Exception{Code: 159, Name: "TIMEOUT_EXCEEDED"}, true},
+		{&clickhouse.Exception{Code: 60, Name: "UNKNOWN_TABLE"}, false},
+		{&clickhouse.Exception{Code: 53, Name: "TYPE_MISMATCH"}, false},
+		{errors.New("read: connection reset by peer"), true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+	} {
+		// as insertBatch wraps them
+		err := errors.Join(errors.New("clickhouse insert 1 rows into tx"), test.err)
+		if got := isClickHouseTemporary(err); got != test.want {
+			t.Errorf("%v: temporary %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestClickHouseRetry(t *testing.T) {
+	config := DefaultClickHouseConfig()
+	config.MaxRetries, config.RetryBackoff = 2, duration.Duration(time.Millisecond)
+	rows := []decode.TransactionRow{{Signature: "s", Slot: 1}}
+
+	// a temporary failure is retried with the same rows
+	conn := &clickHouseConn{sendErrs: []error{&clickhouse.Exception{Code: 252}}}
+	s := &ClickHouseSink{config: config, conn: conn}
+	if err := s.insertTransactions(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.batches) != 2 || !reflect.DeepEqual(conn.batches[0].columns, conn.batches[1].columns) {
+		t.Fatalf("%d batches", len(conn.batches))
+	}
+
+	// a permanent one is returned at once
+	unknown := &clickhouse.Exception{Code: 60}
+	conn = &clickHouseConn{sendErrs: []error{unknown}}
+	s.conn = conn
+	if err := s.insertTransactions(context.Background(), rows); !errors.Is(err, unknown) || len(conn.batches) != 1 {
+		t.Fatalf("got %v after %d batches", err, len(conn.batches))
+	}
+
+	// and temporary ones once max_retries were made
+	conn = &clickHouseConn{sendErrs: []error{errors.New("reset"), errors.New("reset"), errors.New("reset"), nil}}
+	s.conn = conn
+	if err := s.insertTransactions(context.Background(), rows); err == nil || len(conn.batches) != 3 {
+		t.Fatalf("got %v after %d batches", err, len(conn.batches))
+	}
+}
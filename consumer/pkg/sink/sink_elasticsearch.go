@@ -0,0 +1,334 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// elasticsearchDate is the placeholder of the day in the index name.
+const elasticsearchDate = "{date}"
+
+type ElasticsearchConfig struct {
+	// URL of the cluster, Elasticsearch or OpenSearch.
+	URL      string `json:"url" yaml:"url"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	// APIKey is sent as an ApiKey authorization instead of the username
+	// and password.
+	APIKey string `json:"api_key" yaml:"api_key"`
+	// Index names the index of a transaction, {date} is replaced by the day
+	// of its Kafka record as 2006.01.02 for daily indices.
+	Index string `json:"index" yaml:"index"`
+	// CreateTemplate puts an index template mapping the fields on startup,
+	// so logs are searchable as full text and keys match exactly.
+	CreateTemplate bool              `json:"create_template" yaml:"create_template"`
+	BatchSize      int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval  duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	Timeout        duration.Duration `json:"timeout" yaml:"timeout"`
+	// MaxRetries is how many times a bulk request is retried after a network
+	// error, a 429 or a 5xx, waiting RetryBackoff and doubling it up to
+	// MaxBackoff between attempts. Only the rejected documents are sent again.
+	MaxRetries   int               `json:"max_retries" yaml:"max_retries"`
+	RetryBackoff duration.Duration `json:"retry_backoff" yaml:"retry_backoff"`
+	MaxBackoff   duration.Duration `json:"max_backoff" yaml:"max_backoff"`
+}
+
+func DefaultElasticsearchConfig() ElasticsearchConfig {
+	return ElasticsearchConfig{
+		URL:           "http://localhost:9200",
+		Index:         "solana-transactions-" + elasticsearchDate,
+		BatchSize:     1000,
+		FlushInterval: duration.Duration(time.Second),
+		Timeout:       duration.Duration(30 * time.Second),
+		MaxRetries:    5,
+		RetryBackoff:  duration.Duration(200 * time.Millisecond),
+		MaxBackoff:    duration.Duration(10 * time.Second),
+	}
+}
+
+func (c *ElasticsearchConfig) Validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("sink.elasticsearch.url: expected an http or https URL, got %q", c.URL)
+	}
+	if c.Index == "" || strings.ToLower(c.Index) != c.Index {
+		return fmt.Errorf("sink.elasticsearch.index: expected a lower case name, got %q", c.Index)
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.elasticsearch.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 || c.Timeout <= 0 {
+		return errors.New("sink.elasticsearch: flush_interval and timeout must be positive")
+	}
+	if c.MaxRetries < 0 {
+		return errors.New("sink.elasticsearch.max_retries: must not be negative")
+	}
+	if c.RetryBackoff < 0 || c.MaxBackoff < c.RetryBackoff {
+		return errors.New("sink.elasticsearch: max_backoff must be at least retry_backoff")
+	}
+	return nil
+}
+
+// elasticsearchIndex names the index of a record written at when.
+func elasticsearchIndex(pattern string, when time.Time) string {
+	if when.IsZero() {
+		when = time.Now()
+	}
+	return strings.ReplaceAll(pattern, elasticsearchDate, when.UTC().Format("2006.01.02"))
+}
+
+// elasticsearchDocument is the indexed transaction, the columns of the parquet
+// sink.
+type elasticsearchDocument struct {
+	Timestamp            time.Time `json:"@timestamp"`
+	Slot                 uint64    `json:"slot"`
+	Signature            string    `json:"signature"`
+	Index                uint64    `json:"index"`
+	IsVote               bool      `json:"is_vote"`
+	Success              bool      `json:"success"`
+	Err                  *string   `json:"err,omitempty"`
+	Fee                  uint64    `json:"fee"`
+	ComputeUnitsConsumed *uint64   `json:"compute_units_consumed,omitempty"`
+	Accounts             []string  `json:"accounts"`
+	Programs             []string  `json:"programs"`
+	LogMessages          []string  `json:"log_messages"`
+}
+
+// elasticsearchMapping maps the document fields, keys are matched exactly and
+// logs and errors are analyzed for full-text search.
+const elasticsearchMapping = `{
+	"properties": {
+		"@timestamp": {"type": "date"},
+		"slot": {"type": "long"},
+		"signature": {"type": "keyword"},
+		"index": {"type": "long"},
+		"is_vote": {"type": "boolean"},
+		"success": {"type": "boolean"},
+		"err": {"type": "text"},
+		"fee": {"type": "long"},
+		"compute_units_consumed": {"type": "long"},
+		"accounts": {"type": "keyword"},
+		"programs": {"type": "keyword"},
+		"log_messages": {"type": "text"}
+	}
+}`
+
+// elasticsearchAction is one bulk index action and its document.
+type elasticsearchAction struct {
+	index     string
+	signature string
+	document  []byte
+}
+
+// ElasticsearchSink indexes transactions with the bulk API, other updates are
+// ignored. Documents are identified by their signature, so writing a
+// transaction again overwrites it.
+type ElasticsearchSink struct {
+	config ElasticsearchConfig
+	client *http.Client
+	batch  *batcher[elasticsearchAction]
+}
+
+func NewElasticsearchSink(ctx context.Context, config ElasticsearchConfig) (*ElasticsearchSink, error) {
+	s := &ElasticsearchSink{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout)},
+	}
+	if config.CreateTemplate {
+		if err := s.createTemplate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	s.batch = newBatcher("elasticsearch", config.BatchSize, time.Duration(config.FlushInterval), s.bulk)
+	return s, nil
+}
+
+// createTemplate maps the indices matching the index name.
+func (s *ElasticsearchSink) createTemplate(ctx context.Context) error {
+	name := strings.Trim(strings.ReplaceAll(s.config.Index, elasticsearchDate, ""), "-_.")
+	template := fmt.Sprintf(`{"index_patterns": [%q], "template": {"mappings": %s}}`,
+		strings.ReplaceAll(s.config.Index, elasticsearchDate, "*"), elasticsearchMapping)
+	status, body, err := s.do(ctx, http.MethodPut, "/_index_template/"+url.PathEscape(name), "application/json", []byte(template))
+	if err != nil {
+		return fmt.Errorf("create index template %s: %w", name, err)
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("create index template %s: %d %s", name, status, body[:min(len(body), 512)])
+	}
+	return nil
+}
+
+func (s *ElasticsearchSink) Write(ctx context.Context, msg *decode.Message) error {
+	row, ok := newParquetTransaction(msg)
+	if !ok {
+		return nil
+	}
+	document, err := json.Marshal(elasticsearchDocument{
+		Timestamp:            row.KafkaTimestamp,
+		Slot:                 row.Slot,
+		Signature:            row.Signature,
+		Index:                row.Index,
+		IsVote:               row.IsVote,
+		Success:              row.Success,
+		Err:                  row.Err,
+		Fee:                  row.Fee,
+		ComputeUnitsConsumed: row.ComputeUnitsConsumed,
+		Accounts:             row.Accounts,
+		Programs:             row.Programs,
+		LogMessages:          row.LogMessages,
+	})
+	if err != nil {
+		return err
+	}
+	return s.batch.Add(ctx, elasticsearchAction{
+		index:     elasticsearchIndex(s.config.Index, msg.Timestamp),
+		signature: row.Signature,
+		document:  document,
+	})
+}
+
+func (s *ElasticsearchSink) Flush(ctx context.Context) error {
+	return s.batch.Flush(ctx)
+}
+
+func (s *ElasticsearchSink) Close() error {
+	return s.batch.Close()
+}
+
+// bulk indexes the actions, sending those rejected as temporary again until
+// MaxRetries is used up.
+func (s *ElasticsearchSink) bulk(ctx context.Context, actions []elasticsearchAction) error {
+	backoff := time.Duration(s.config.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		retry, err := s.send(ctx, actions)
+		if err == nil || retry == nil || attempt >= s.config.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		logging.Logger.Warn("elasticsearch bulk failed, retrying",
+			zap.Int("documents", len(retry)), zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, time.Duration(s.config.MaxBackoff))
+		actions = retry
+	}
+}
+
+// elasticsearchTemporary reports whether a request or item status may succeed
+// when sent again.
+func elasticsearchTemporary(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// send posts one bulk request. It returns the actions worth sending again
+// along with the error when the request or some of its items failed.
+func (s *ElasticsearchSink) send(ctx context.Context, actions []elasticsearchAction) ([]elasticsearchAction, error) {
+	var body bytes.Buffer
+	for _, action := range actions {
+		meta, _ := json.Marshal(map[string]map[string]string{"index": {"_index": action.index, "_id": action.signature}})
+		body.Write(meta)
+		body.WriteByte('\n')
+		body.Write(action.document)
+		body.WriteByte('\n')
+	}
+
+	status, response, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return actions, err
+	}
+	if status < 200 || status >= 300 {
+		err := fmt.Errorf("elasticsearch bulk returned %d %s", status, response[:min(len(response), 512)])
+		if elasticsearchTemporary(status) {
+			return actions, err
+		}
+		return nil, err
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("decode bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(actions) {
+		return nil, fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(actions))
+	}
+
+	var retry []elasticsearchAction
+	var failed error
+	for i, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status < 300 {
+				continue
+			}
+			if elasticsearchTemporary(outcome.Status) {
+				retry = append(retry, actions[i])
+				if failed == nil {
+					failed = fmt.Errorf("elasticsearch rejected %s: %d %s", actions[i].signature, outcome.Status, outcome.Error.Type)
+				}
+				continue
+			}
+			// a document the cluster refuses fails the batch
+			return nil, fmt.Errorf("elasticsearch rejected %s: %d %s: %s",
+				actions[i].signature, outcome.Status, outcome.Error.Type, outcome.Error.Reason)
+		}
+	}
+	return retry, failed
+}
+
+// do sends a request to the cluster and returns the status and body.
+func (s *ElasticsearchSink) do(ctx context.Context, method, path, contentType string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.config.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case s.config.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.config.APIKey)
+	case s.config.Username != "":
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		metrics.ElasticsearchRequestsTotal.WithLabelValues("error").Inc()
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	metrics.ElasticsearchRequestsTotal.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	return resp.StatusCode, bytes.TrimSpace(response), nil
+}
@@ -0,0 +1,214 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+// bulkServer answers bulk requests. respond returns the status of every
+// document of a request, the requests are kept as their action lines.
+type bulkServer struct {
+	*httptest.Server
+	respond func(request int, ids []string) []int
+
+	mu        sync.Mutex
+	requests  [][]string
+	indices   []string
+	documents []map[string]any
+	templates []string
+}
+
+func newBulkServer(t *testing.T, respond func(request int, ids []string) []int) *bulkServer {
+	s := &bulkServer{respond: respond}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/") {
+			s.templates = append(s.templates, strings.TrimPrefix(r.URL.Path, "/_index_template/")+" "+string(body))
+			fmt.Fprint(w, `{"acknowledged":true}`)
+			return
+		}
+		var ids []string
+		lines := bufio.NewScanner(bytes.NewReader(body))
+		for lines.Scan() {
+			var action struct {
+				Index struct {
+					Index string `json:"_index"`
+					ID    string `json:"_id"`
+				} `json:"index"`
+			}
+			json.Unmarshal(lines.Bytes(), &action)
+			lines.Scan()
+			var document map[string]any
+			json.Unmarshal(lines.Bytes(), &document)
+			ids = append(ids, action.Index.ID)
+			s.indices = append(s.indices, action.Index.Index)
+			s.documents = append(s.documents, document)
+		}
+		statuses := s.respond(len(s.requests), ids)
+		s.requests = append(s.requests, ids)
+		if len(statuses) == 1 && len(ids) != 1 {
+			w.WriteHeader(statuses[0])
+			return
+		}
+		var items []string
+		failed := false
+		for _, status := range statuses {
+			failed = failed || status >= 300
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d,"error":{"type":"test","reason":"because"}}}`, status))
+		}
+		fmt.Fprintf(w, `{"errors":%t,"items":[%s]}`, failed, strings.Join(items, ","))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func okResponses(_ int, ids []string) []int {
+	statuses := make([]int, len(ids))
+	for i := range statuses {
+		statuses[i] = http.StatusCreated
+	}
+	return statuses
+}
+
+func newTestElasticsearchSink(t *testing.T, url string) *ElasticsearchSink {
+	t.Helper()
+	config := DefaultElasticsearchConfig()
+	config.URL, config.FlushInterval = url, duration.Duration(time.Hour)
+	config.RetryBackoff, config.MaxBackoff = duration.Duration(time.Millisecond), duration.Duration(time.Millisecond)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewElasticsearchSink(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// signedTransaction is a transaction of slot with a signature of its own.
+func signedTransaction(slot uint64, signature byte, when time.Time) *decode.Message {
+	msg := decodetest.TransactionMessage(slot, testkey.Key(1))
+	msg.Timestamp = when
+	info := msg.Update.GetTransaction().GetTransaction()
+	info.Signature = testkey.Key(signature)
+	info.Meta.LogMessages = []string{"Program log: hello"}
+	return msg
+}
+
+func TestElasticsearchSinkIndexes(t *testing.T) {
+	server := newBulkServer(t, okResponses)
+	s := newTestElasticsearchSink(t, server.URL)
+	ctx := context.Background()
+	day := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+
+	for _, msg := range []*decode.Message{signedTransaction(10, 1, day), decodetest.SlotMessage(11, 10, 0), signedTransaction(11, 2, day.Add(time.Hour))} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.requests) != 1 || len(server.requests[0]) != 2 || server.requests[0][0] != testkey.String(1) {
+		t.Fatalf("requests %v", server.requests)
+	}
+	if server.indices[0] != "solana-transactions-2024.05.01" || server.indices[1] != "solana-transactions-2024.05.02" {
+		t.Fatalf("indices %v", server.indices)
+	}
+	document := server.documents[0]
+	if document["slot"] != 10.0 || document["signature"] != testkey.String(1) || document["success"] != true ||
+		document["@timestamp"] != "2024-05-01T23:00:00Z" || fmt.Sprint(document["log_messages"]) != "[Program log: hello]" {
+		t.Fatalf("document %v", document)
+	}
+}
+
+func TestElasticsearchSinkRetriesRejected(t *testing.T) {
+	server := newBulkServer(t, func(request int, ids []string) []int {
+		switch request {
+		case 0:
+			return []int{http.StatusTooManyRequests}
+		case 1:
+			return []int{http.StatusCreated, http.StatusTooManyRequests}
+		}
+		return okResponses(request, ids)
+	})
+	s := newTestElasticsearchSink(t, server.URL)
+	ctx := context.Background()
+
+	for i := byte(1); i <= 2; i++ {
+		if err := s.Write(ctx, signedTransaction(10, i, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the whole batch, then only the document rejected with a 429
+	if len(server.requests) != 3 || len(server.requests[1]) != 2 || len(server.requests[2]) != 1 || server.requests[2][0] != testkey.String(2) {
+		t.Fatalf("requests %v", server.requests)
+	}
+}
+
+func TestElasticsearchSinkPermanentRejection(t *testing.T) {
+	server := newBulkServer(t, func(int, []string) []int {
+		return []int{http.StatusCreated, http.StatusBadRequest}
+	})
+	s := newTestElasticsearchSink(t, server.URL)
+	ctx := context.Background()
+
+	for i := byte(1); i <= 2; i++ {
+		if err := s.Write(ctx, signedTransaction(10, i, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err == nil || !strings.Contains(err.Error(), "400 test: because") {
+		t.Fatalf("got %v, want the rejection", err)
+	}
+	if len(server.requests) != 1 {
+		t.Fatalf("%d requests, want no retry", len(server.requests))
+	}
+}
+
+func TestElasticsearchSinkCreatesTemplate(t *testing.T) {
+	server := newBulkServer(t, okResponses)
+	config := DefaultElasticsearchConfig()
+	config.URL, config.CreateTemplate = server.URL, true
+	s, err := NewElasticsearchSink(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(server.templates) != 1 || !strings.HasPrefix(server.templates[0], `solana-transactions {"index_patterns": ["solana-transactions-*"]`) {
+		t.Fatalf("templates %v", server.templates)
+	}
+}
+
+func TestElasticsearchConfigValidate(t *testing.T) {
+	config := DefaultElasticsearchConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Index = "Solana-{date}"
+	if err := config.Validate(); err == nil {
+		t.Fatal("validated an upper case index")
+	}
+}
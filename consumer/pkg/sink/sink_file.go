@@ -0,0 +1,284 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// FileConfig writes every update to local files, rotated by size and age.
+type FileConfig struct {
+	Dir string `json:"dir" yaml:"dir"`
+	// Prefix starts the file names.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Format is json for a JSON line per update, protobuf for every
+	// SubscribeUpdate prefixed by its varint encoded length, or template
+	// for the line Template renders, see OutputTemplate.
+	Format   string `json:"format" yaml:"format"`
+	Template string `json:"template" yaml:"template"`
+	// Compression is zstd or none.
+	Compression string `json:"compression" yaml:"compression"`
+	// A file is finished once it reached MaxBytes bytes on disk or was open
+	// for MaxAge.
+	MaxBytes int64             `json:"max_bytes" yaml:"max_bytes"`
+	MaxAge   duration.Duration `json:"max_age" yaml:"max_age"`
+	// UploadCommand runs for every finished file, {file} in the arguments
+	// being replaced by its path. DeleteUploaded removes the file once the
+	// command succeeded.
+	UploadCommand  []string `json:"upload_command" yaml:"upload_command"`
+	DeleteUploaded bool     `json:"delete_uploaded" yaml:"delete_uploaded"`
+}
+
+func DefaultFileConfig() FileConfig {
+	return FileConfig{
+		Prefix:      "updates",
+		Format:      "json",
+		Compression: "zstd",
+		MaxBytes:    256 << 20,
+		MaxAge:      duration.Duration(time.Hour),
+	}
+}
+
+func (c *FileConfig) Validate() error {
+	if c.Dir == "" {
+		return errors.New("sink.file.dir: must not be empty")
+	}
+	if c.Prefix == "" || strings.ContainsRune(c.Prefix, filepath.Separator) {
+		return fmt.Errorf("sink.file.prefix: must be a non-empty file name, got %q", c.Prefix)
+	}
+	switch c.Format {
+	case "json", "protobuf":
+	case "template":
+		if err := validateOutputTemplate("sink.file.template", c.Template); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("sink.file.format: expected json, protobuf or template, got %q", c.Format)
+	}
+	if c.Compression != "zstd" && c.Compression != "none" {
+		return fmt.Errorf("sink.file.compression: expected zstd or none, got %q", c.Compression)
+	}
+	if c.MaxBytes <= 0 || c.MaxAge <= 0 {
+		return errors.New("sink.file: max_bytes and max_age must be positive")
+	}
+	if c.DeleteUploaded && len(c.UploadCommand) == 0 {
+		return errors.New("sink.file.delete_uploaded: needs an upload_command")
+	}
+	return nil
+}
+
+// FileSink appends every update to one open file, which is finished and
+// handed to the upload command once it is full or old enough. A flush
+// writes out the pending compressed block and syncs the file, so a file cut
+// short by a crash still holds every update committed, the last frame
+// lacking its end.
+type FileSink struct {
+	config   FileConfig
+	template *OutputTemplate
+
+	mu     sync.Mutex
+	file   *os.File
+	size   *countingWriter
+	zw     *zstd.Encoder
+	opened time.Time
+
+	uploads sync.WaitGroup
+}
+
+func NewFileSink(config FileConfig) (*FileSink, error) {
+	s := &FileSink{config: config}
+	if config.Format == "template" {
+		var err error
+		if s.template, err = ParseOutputTemplate(config.Template); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// encode returns the bytes of msg in the file format, none for a message
+// the template skips.
+func (s *FileSink) encode(msg *decode.Message) ([]byte, error) {
+	var line []byte
+	var err error
+	switch s.config.Format {
+	case "protobuf":
+		var buf bytes.Buffer
+		if _, err := protodelim.MarshalTo(&buf, msg.Update); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "template":
+		if line, err = s.template.Render(msg); line == nil {
+			return nil, err
+		}
+	default:
+		if line, err = decode.FormatRecordJSON(msg); err != nil {
+			return nil, err
+		}
+	}
+	return append(line, '\n'), nil
+}
+
+func (s *FileSink) Write(_ context.Context, msg *decode.Message) error {
+	data, err := s.encode(msg)
+	if err != nil || data == nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil && time.Since(s.opened) >= time.Duration(s.config.MaxAge) {
+		if err := s.finish(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer().Write(data); err != nil {
+		return fmt.Errorf("write %s: %w", s.file.Name(), err)
+	}
+	if s.size.n >= s.config.MaxBytes {
+		return s.finish()
+	}
+	return nil
+}
+
+func (s *FileSink) writer() io.Writer {
+	if s.zw != nil {
+		return s.zw
+	}
+	return s.size
+}
+
+// open creates the next file, named by the time it is opened. The caller
+// holds s.mu.
+func (s *FileSink) open() error {
+	now := time.Now().UTC()
+	name := s.config.Prefix + "-" + now.Format("20060102T150405.000000000Z")
+	switch s.config.Format {
+	case "protobuf":
+		name += ".pb"
+	case "template":
+		name += ".txt"
+	default:
+		name += ".ndjson"
+	}
+	if s.config.Compression == "zstd" {
+		name += ".zst"
+	}
+	file, err := os.OpenFile(filepath.Join(s.config.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file, s.size, s.opened = file, &countingWriter{w: file}, now
+	if s.config.Compression == "zstd" {
+		if s.zw, err = zstd.NewWriter(s.size); err != nil {
+			file.Close()
+			s.file = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// finish closes the open file and starts its upload. The caller holds s.mu.
+func (s *FileSink) finish() error {
+	file := s.file
+	var err error
+	if s.zw != nil {
+		err = s.zw.Close()
+	}
+	err = errors.Join(err, file.Sync(), file.Close())
+	s.file, s.size, s.zw = nil, nil, nil
+	if err != nil {
+		return fmt.Errorf("finish %s: %w", file.Name(), err)
+	}
+	metrics.FileRotationsTotal.Inc()
+	if len(s.config.UploadCommand) > 0 {
+		s.uploads.Add(1)
+		go func() {
+			defer s.uploads.Done()
+			s.upload(file.Name())
+		}()
+	}
+	return nil
+}
+
+// upload runs the upload command for a finished file. A failed upload is
+// logged and the file left in Dir.
+func (s *FileSink) upload(path string) {
+	args := make([]string, len(s.config.UploadCommand))
+	for i, arg := range s.config.UploadCommand {
+		args[i] = strings.ReplaceAll(arg, "{file}", path)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		metrics.FileUploadsTotal.WithLabelValues("error").Inc()
+		logging.Logger.Error("file upload command failed", zap.String("file", path), zap.Error(err), zap.ByteString("output", out))
+		return
+	}
+	metrics.FileUploadsTotal.WithLabelValues("ok").Inc()
+	if s.config.DeleteUploaded {
+		if err := os.Remove(path); err != nil {
+			logging.Logger.Warn("failed to delete uploaded file", zap.String("file", path), zap.Error(err))
+		}
+	}
+}
+
+// Flush writes the buffered updates to the open file and syncs it, or
+// finishes it once it is MaxAge old.
+func (s *FileSink) Flush(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if time.Since(s.opened) >= time.Duration(s.config.MaxAge) {
+		return s.finish()
+	}
+	if s.zw != nil {
+		if err := s.zw.Flush(); err != nil {
+			return fmt.Errorf("flush %s: %w", s.file.Name(), err)
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("flush %s: %w", s.file.Name(), err)
+	}
+	return nil
+}
+
+// Close finishes the open file and waits for the running uploads.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.file != nil {
+		err = s.finish()
+	}
+	s.mu.Unlock()
+	s.uploads.Wait()
+	return err
+}
@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// readFiles returns the paths of the files in dir.
+func readFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestFileSinkJSON(t *testing.T) {
+	config := DefaultFileConfig()
+	config.Dir = t.TempDir()
+	s, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	msg := decodetest.TransactionMessage(10, testkey.Key(1))
+	msg.Topic, msg.Offset = "updates", 7
+	if err := s.Write(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, decodetest.SlotMessage(11, 10, proto.CommitmentLevel_CONFIRMED)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a flushed file reads back before it is finished
+	paths := readFiles(t, config.Dir)
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], ".ndjson.zst") {
+		t.Fatalf("files %v", paths)
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	lines := bufio.NewScanner(zr)
+	var records []decode.JSONRecord
+	for len(records) < 2 && lines.Scan() {
+		var record decode.JSONRecord
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Kind != decode.KindTransaction || records[0].Offset != 7 || records[1].Slot != 11 {
+		t.Fatalf("records %+v", records)
+	}
+	if !strings.Contains(string(records[0].Update), testkey.String(0xff)) {
+		t.Fatalf("update %s", records[0].Update)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSinkRotatesAndUploads(t *testing.T) {
+	config := DefaultFileConfig()
+	config.Dir, config.Format, config.Compression, config.MaxBytes = t.TempDir(), "protobuf", "none", 1
+	uploaded := t.TempDir()
+	config.UploadCommand, config.DeleteUploaded = []string{"cp", "{file}", uploaded}, true
+	s, err := NewFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for slot := uint64(1); slot <= 3; slot++ {
+		if err := s.Write(ctx, decodetest.SlotMessage(slot, slot-1, proto.CommitmentLevel_PROCESSED)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := readFiles(t, config.Dir); len(paths) != 0 {
+		t.Fatalf("uploaded files kept: %v", paths)
+	}
+	paths := readFiles(t, uploaded)
+	if len(paths) != 3 {
+		t.Fatalf("uploaded %v", paths)
+	}
+	file, err := os.Open(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var update proto.SubscribeUpdate
+	if err := protodelim.UnmarshalFrom(bufio.NewReader(file), &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.GetSlot().GetSlot() != 2 || !strings.HasSuffix(paths[1], ".pb") {
+		t.Fatalf("file %s holds %v", paths[1], &update)
+	}
+}
+
+func TestFileConfigValidate(t *testing.T) {
+	config := DefaultFileConfig()
+	config.Dir = "/tmp"
+	config.DeleteUploaded = true
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "delete_uploaded") {
+		t.Fatalf("got %v", err)
+	}
+}
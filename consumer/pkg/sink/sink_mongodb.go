@@ -0,0 +1,242 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+// mongoDuplicateKey is the code of a write error inserting an _id that
+// exists.
+const mongoDuplicateKey = 11000
+
+type MongoDBConfig struct {
+	// URI is a mongodb:// or mongodb+srv:// connection string.
+	URI      string `json:"uri" yaml:"uri"`
+	Database string `json:"database" yaml:"database"`
+	// Prefix starts every collection name, see RoutingKeys.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Route is kind for a collection per update kind, <prefix>_<kind>, or
+	// program for transactions in a collection per program they invoke,
+	// <prefix>_transaction_<program>, and accounts in one per owner.
+	Route string `json:"route" yaml:"route"`
+	// Document is record for every update as the JSON object of the ndjson
+	// format, or transaction for transactions only, as the columns of the
+	// parquet sink.
+	Document      string            `json:"document" yaml:"document"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	Timeout       duration.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func DefaultMongoDBConfig() MongoDBConfig {
+	return MongoDBConfig{
+		URI:           "mongodb://localhost:27017",
+		Database:      "solana",
+		Prefix:        "solana",
+		Route:         "kind",
+		Document:      "record",
+		BatchSize:     1000,
+		FlushInterval: duration.Duration(time.Second),
+		Timeout:       duration.Duration(30 * time.Second),
+	}
+}
+
+func (c *MongoDBConfig) Validate() error {
+	if c.URI == "" {
+		return errors.New("sink.mongodb.uri: must not be empty")
+	}
+	if c.Database == "" {
+		return errors.New("sink.mongodb.database: must not be empty")
+	}
+	if c.Prefix == "" {
+		return errors.New("sink.mongodb.prefix: must not be empty")
+	}
+	if c.Route != "kind" && c.Route != "program" {
+		return fmt.Errorf("sink.mongodb.route: expected kind or program, got %q", c.Route)
+	}
+	if c.Document != "record" && c.Document != "transaction" {
+		return fmt.Errorf("sink.mongodb.document: expected record or transaction, got %q", c.Document)
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.mongodb.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 || c.Timeout <= 0 {
+		return errors.New("sink.mongodb: flush_interval and timeout must be positive")
+	}
+	return nil
+}
+
+// mongoTransaction is the document of a transaction, the columns of the
+// parquet sink identified by the signature.
+type mongoTransaction struct {
+	Signature            string    `bson:"_id"`
+	Slot                 int64     `bson:"slot"`
+	Index                int64     `bson:"index"`
+	IsVote               bool      `bson:"is_vote"`
+	Success              bool      `bson:"success"`
+	Err                  *string   `bson:"err,omitempty"`
+	Fee                  int64     `bson:"fee"`
+	ComputeUnitsConsumed *int64    `bson:"compute_units_consumed,omitempty"`
+	Accounts             []string  `bson:"accounts"`
+	Programs             []string  `bson:"programs"`
+	LogMessages          []string  `bson:"log_messages"`
+	KafkaTimestamp       time.Time `bson:"kafka_timestamp"`
+}
+
+// mongoDocument is one document inserted into a collection.
+type mongoDocument struct {
+	collection string
+	document   bson.Raw
+}
+
+// mongoDocuments returns the documents of msg, none for updates the mapping
+// of config leaves out.
+func mongoDocuments(msg *decode.Message, config MongoDBConfig) ([]mongoDocument, error) {
+	var document any
+	switch config.Document {
+	case "record":
+		record, err := decode.FormatRecordJSON(msg)
+		if err != nil {
+			return nil, err
+		}
+		// relaxed Extended JSON keeps the integers int64, those beyond it
+		// become doubles
+		var fields bson.D
+		if err := bson.UnmarshalExtJSON(record, false, &fields); err != nil {
+			return nil, err
+		}
+		// the record position identifies it, so a record written again is
+		// not inserted twice
+		id := msg.Topic + ":" + strconv.FormatInt(int64(msg.Partition), 10) + ":" + strconv.FormatInt(msg.Offset, 10)
+		document = append(bson.D{{Key: "_id", Value: id}}, fields...)
+	case "transaction":
+		row, ok := newParquetTransaction(msg)
+		if !ok {
+			return nil, nil
+		}
+		transaction := mongoTransaction{
+			Signature:      row.Signature,
+			Slot:           int64(row.Slot),
+			Index:          int64(row.Index),
+			IsVote:         row.IsVote,
+			Success:        row.Success,
+			Err:            row.Err,
+			Fee:            int64(row.Fee),
+			Accounts:       row.Accounts,
+			Programs:       row.Programs,
+			LogMessages:    row.LogMessages,
+			KafkaTimestamp: row.KafkaTimestamp,
+		}
+		if units := row.ComputeUnitsConsumed; units != nil {
+			consumed := int64(*units)
+			transaction.ComputeUnitsConsumed = &consumed
+		}
+		document = transaction
+	}
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	collections := []string{config.Prefix + "_" + string(msg.Kind())}
+	if config.Route == "program" {
+		collections = decode.RoutingKeys(config.Prefix, "_", msg.Update)
+	}
+	documents := make([]mongoDocument, len(collections))
+	for i, collection := range collections {
+		documents[i] = mongoDocument{collection: collection, document: raw}
+	}
+	return documents, nil
+}
+
+// MongoDBSink inserts updates as BSON documents into collections routed by
+// kind or program, with unordered bulk writes per collection. Documents have
+// an _id derived from their update, a document inserted again is a
+// duplicate key error the sink ignores, so a batch can be retried after a
+// failure.
+type MongoDBSink struct {
+	config   MongoDBConfig
+	client   *mongo.Client
+	database *mongo.Database
+	batch    *batcher[mongoDocument]
+}
+
+func NewMongoDBSink(ctx context.Context, config MongoDBConfig) (*MongoDBSink, error) {
+	client, err := mongo.Connect(options.Client().ApplyURI(config.URI).SetTimeout(time.Duration(config.Timeout)))
+	if err != nil {
+		return nil, fmt.Errorf("mongodb connect: %w", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("mongodb connect: %w", err)
+	}
+	s := &MongoDBSink{config: config, client: client, database: client.Database(config.Database)}
+	s.batch = newBatcher("mongodb", config.BatchSize, time.Duration(config.FlushInterval), s.insert)
+	return s, nil
+}
+
+func (s *MongoDBSink) Write(ctx context.Context, msg *decode.Message) error {
+	documents, err := mongoDocuments(msg, s.config)
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		if err := s.batch.Add(ctx, document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MongoDBSink) Flush(ctx context.Context) error {
+	return s.batch.Flush(ctx)
+}
+
+// insert bulk writes the documents of every collection, unordered so one
+// failing document does not stop the others.
+func (s *MongoDBSink) insert(ctx context.Context, documents []mongoDocument) error {
+	models := make(map[string][]mongo.WriteModel)
+	var collections []string
+	for _, document := range documents {
+		if models[document.collection] == nil {
+			collections = append(collections, document.collection)
+		}
+		models[document.collection] = append(models[document.collection], mongo.NewInsertOneModel().SetDocument(document.document))
+	}
+	for _, collection := range collections {
+		_, err := s.database.Collection(collection).BulkWrite(ctx, models[collection], options.BulkWrite().SetOrdered(false))
+		if err := ignoreDuplicates(err); err != nil {
+			return fmt.Errorf("mongodb insert %d documents into %s: %w", len(models[collection]), collection, err)
+		}
+	}
+	return nil
+}
+
+// ignoreDuplicates returns err unless every write error it holds is a
+// duplicate key, a document already inserted.
+func ignoreDuplicates(err error) error {
+	var bulk mongo.BulkWriteException
+	if !errors.As(err, &bulk) || bulk.WriteConcernError != nil {
+		return err
+	}
+	for _, writeErr := range bulk.WriteErrors {
+		if writeErr.Code != mongoDuplicateKey {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MongoDBSink) Close() error {
+	err := s.batch.Close()
+	return errors.Join(err, s.client.Disconnect(context.Background()))
+}
@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+)
+
+func TestMongoDocuments(t *testing.T) {
+	config := DefaultMongoDBConfig()
+	msg := decodetest.TransactionMessage(10, testkey.Key(1), testkey.Key(2))
+	msg.Topic, msg.Partition, msg.Offset = "updates", 3, 42
+	msg.Update.GetTransaction().GetTransaction().Meta.Fee = 5000
+
+	documents, err := mongoDocuments(msg, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 1 || documents[0].collection != "solana_transaction" {
+		t.Fatalf("documents %+v", documents)
+	}
+	var record struct {
+		ID     string `bson:"_id"`
+		Kind   string `bson:"kind"`
+		Slot   int64  `bson:"slot"`
+		Update struct {
+			Transaction struct {
+				Transaction struct {
+					Signature string `bson:"signature"`
+					Meta      struct {
+						Fee int64 `bson:"fee"`
+					} `bson:"meta"`
+				} `bson:"transaction"`
+			} `bson:"transaction"`
+		} `bson:"update"`
+	}
+	if err := bson.Unmarshal(documents[0].document, &record); err != nil {
+		t.Fatal(err)
+	}
+	if tx := record.Update.Transaction.Transaction; record.ID != "updates:3:42" || record.Kind != "transaction" || record.Slot != 10 ||
+		tx.Signature != testkey.String(0xff) || tx.Meta.Fee != 5000 {
+		t.Fatalf("record %+v", record)
+	}
+
+	config.Route, config.Document = "program", "transaction"
+	documents, err = mongoDocuments(msg, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 1 || documents[0].collection != "solana_transaction_"+testkey.String(1) {
+		t.Fatalf("documents %+v", documents)
+	}
+	var transaction mongoTransaction
+	if err := bson.Unmarshal(documents[0].document, &transaction); err != nil {
+		t.Fatal(err)
+	}
+	if transaction.Signature != testkey.String(0xff) || transaction.Fee != 5000 || len(transaction.Accounts) != 2 {
+		t.Fatalf("transaction %+v", transaction)
+	}
+	if documents, err := mongoDocuments(decodetest.AccountMessage(10, testkey.Key(3), testkey.Key(1)), config); err != nil || len(documents) != 0 {
+		t.Fatalf("account documents %+v, %v", documents, err)
+	}
+}
+
+func TestIgnoreDuplicates(t *testing.T) {
+	duplicate := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: mongoDuplicateKey}}}}
+	if err := ignoreDuplicates(duplicate); err != nil {
+		t.Fatalf("duplicates: %v", err)
+	}
+	duplicate.WriteErrors = append(duplicate.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Code: 121}})
+	if err := ignoreDuplicates(duplicate); err == nil {
+		t.Fatal("validation error ignored")
+	}
+	if err := ignoreDuplicates(errors.New("timeout")); err == nil {
+		t.Fatal("timeout ignored")
+	}
+}
@@ -0,0 +1,155 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mr-tron/base58"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+)
+
+func runJetStream(t *testing.T) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	return s
+}
+
+func newTestNATSSink(t *testing.T, url string, createStream bool) *NATSSink {
+	t.Helper()
+	config := DefaultNATSConfig()
+	config.URL, config.CreateStream = url, createStream
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewNATSSink(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func streamMessages(t *testing.T, s *NATSSink) []*jetstream.RawStreamMsg {
+	t.Helper()
+	ctx := context.Background()
+	stream, err := s.js.Stream(ctx, s.config.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*jetstream.RawStreamMsg
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq && info.State.Msgs > 0; seq++ {
+		msg, err := stream.GetMsg(ctx, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestNATSSinkPublishes(t *testing.T) {
+	s := newTestNATSSink(t, runJetStream(t).ClientURL(), true)
+	ctx := context.Background()
+
+	tx := decodetest.TransactionMessage(10, testkey.Key(1))
+	tx.Key = []byte("10_abc")
+	slot := decodetest.SlotMessage(11, 10, 0)
+	slot.Topic, slot.Partition, slot.Offset = "slots", 2, 7
+	for _, msg := range []*decode.Message{tx, slot} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := streamMessages(t, s)
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages in the stream, want 2", len(msgs))
+	}
+	want := []struct{ subject, id string }{
+		{"solana.transaction." + base58.Encode(testkey.Key(1)), "10_abc/solana.transaction." + base58.Encode(testkey.Key(1))},
+		{"solana.slot", "slots/2/7/solana.slot"},
+	}
+	for i, msg := range msgs {
+		if msg.Subject != want[i].subject || msg.Header.Get(nats.MsgIdHdr) != want[i].id || !json.Valid(msg.Data) {
+			t.Errorf("message %d: subject %s, id %s", i, msg.Subject, msg.Header.Get(nats.MsgIdHdr))
+		}
+	}
+}
+
+func TestNATSSinkDeduplicates(t *testing.T) {
+	s := newTestNATSSink(t, runJetStream(t).ClientURL(), true)
+	ctx := context.Background()
+
+	// redundant copies of a record from two topics share its key
+	for _, topic := range []string{"transactions-a", "transactions-b"} {
+		msg := decodetest.TransactionMessage(10, testkey.Key(1))
+		msg.Topic, msg.Key = topic, []byte("10_abc")
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := streamMessages(t, s); len(msgs) != 1 {
+		t.Fatalf("%d messages in the stream, want 1", len(msgs))
+	}
+}
+
+func TestNATSSinkRepublishesRejected(t *testing.T) {
+	s := newTestNATSSink(t, runJetStream(t).ClientURL(), false)
+	ctx := context.Background()
+
+	// no stream captures the subject yet
+	if err := s.Write(ctx, decodetest.SlotMessage(11, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("flush succeeded without a stream")
+	}
+
+	_, err := s.js.CreateStream(ctx, jetstream.StreamConfig{Name: s.config.Stream, Subjects: []string{"solana.>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := streamMessages(t, s); len(msgs) != 1 || msgs[0].Subject != "solana.slot" {
+		t.Fatalf("%d messages in the stream", len(msgs))
+	}
+}
+
+func TestNATSConfigValidate(t *testing.T) {
+	config := DefaultNATSConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.MsgID = "signature"
+	if err := config.Validate(); err == nil {
+		t.Fatal("validated an unknown msg_id")
+	}
+}
@@ -0,0 +1,407 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mr-tron/base58"
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+)
+
+// ParquetConfig archives transactions as Parquet files in an S3 bucket,
+// partitioned by day and slot range.
+type ParquetConfig struct {
+	Bucket string `json:"bucket" yaml:"bucket"`
+	// Prefix is prepended to the object keys.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	Region string `json:"region" yaml:"region"`
+	// Endpoint replaces the AWS endpoint for S3 compatible stores such as
+	// MinIO or GCS, which usually also need PathStyle.
+	Endpoint  string `json:"endpoint" yaml:"endpoint"`
+	PathStyle bool   `json:"path_style" yaml:"path_style"`
+	// Dir holds the files being written until they are uploaded.
+	Dir string `json:"dir" yaml:"dir"`
+	// SlotRange is the number of slots per slot_range partition.
+	SlotRange uint64 `json:"slot_range" yaml:"slot_range"`
+	// A file is closed and uploaded once it reached MaxRows rows, MaxBytes
+	// bytes or was open for MaxAge.
+	MaxRows  int               `json:"max_rows" yaml:"max_rows"`
+	MaxBytes int64             `json:"max_bytes" yaml:"max_bytes"`
+	MaxAge   duration.Duration `json:"max_age" yaml:"max_age"`
+	// Compression is zstd, snappy, gzip or none.
+	Compression string `json:"compression" yaml:"compression"`
+}
+
+func DefaultParquetConfig() ParquetConfig {
+	return ParquetConfig{
+		Dir:         os.TempDir(),
+		SlotRange:   100_000,
+		MaxRows:     1_000_000,
+		MaxBytes:    128 << 20,
+		MaxAge:      duration.Duration(5 * time.Minute),
+		Compression: "zstd",
+	}
+}
+
+func (c *ParquetConfig) Validate() error {
+	if c.Bucket == "" {
+		return errors.New("sink.parquet.bucket: must not be empty")
+	}
+	if c.Dir == "" {
+		return errors.New("sink.parquet.dir: must not be empty")
+	}
+	if c.SlotRange == 0 {
+		return errors.New("sink.parquet.slot_range: must be positive")
+	}
+	if c.MaxRows <= 0 || c.MaxBytes <= 0 || c.MaxAge <= 0 {
+		return errors.New("sink.parquet: max_rows, max_bytes and max_age must be positive")
+	}
+	if _, err := parquetCompression(c.Compression); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parquetCompression(name string) (parquet.WriterOption, error) {
+	switch name {
+	case "zstd":
+		return parquet.Compression(&parquet.Zstd), nil
+	case "snappy":
+		return parquet.Compression(&parquet.Snappy), nil
+	case "gzip":
+		return parquet.Compression(&parquet.Gzip), nil
+	case "none":
+		return parquet.Compression(&parquet.Uncompressed), nil
+	}
+	return nil, fmt.Errorf("sink.parquet.compression: expected zstd, snappy, gzip or none, got %q", name)
+}
+
+// parquetTransaction is the row of the archived files.
+type parquetTransaction struct {
+	Slot      uint64 `parquet:"slot"`
+	Signature string `parquet:"signature"`
+	Index     uint64 `parquet:"index"`
+	IsVote    bool   `parquet:"is_vote"`
+	Success   bool   `parquet:"success"`
+	// Err is the error in the JSON form of the Solana RPC.
+	Err                  *string   `parquet:"err,optional"`
+	Fee                  uint64    `parquet:"fee"`
+	ComputeUnitsConsumed *uint64   `parquet:"compute_units_consumed,optional"`
+	Accounts             []string  `parquet:"accounts,list"`
+	Programs             []string  `parquet:"programs,list"`
+	LogMessages          []string  `parquet:"log_messages,list"`
+	KafkaTimestamp       time.Time `parquet:"kafka_timestamp,timestamp(millisecond)"`
+}
+
+func newParquetTransaction(msg *decode.Message) (parquetTransaction, bool) {
+	update := msg.Update.GetTransaction()
+	if update == nil {
+		return parquetTransaction{}, false
+	}
+	info := update.GetTransaction()
+	meta := info.GetMeta()
+
+	row := parquetTransaction{
+		Slot:                 msg.Slot,
+		Signature:            base58.Encode(info.GetSignature()),
+		Index:                info.GetIndex(),
+		IsVote:               info.GetIsVote(),
+		Success:              meta.GetErr() == nil,
+		Fee:                  meta.GetFee(),
+		ComputeUnitsConsumed: meta.ComputeUnitsConsumed,
+		Accounts:             decode.EncodeKeys(decode.TransactionAccounts(info)),
+		Programs:             decode.EncodeKeys(decode.TransactionPrograms(info)),
+		LogMessages:          meta.GetLogMessages(),
+		KafkaTimestamp:       msg.Timestamp,
+	}
+	row.Err = decode.TransactionErrorJSON(info)
+	return row, true
+}
+
+// ObjectStore receives the finished files. NewParquetSink uploads them to S3.
+type ObjectStore interface {
+	Upload(ctx context.Context, key string, file *os.File) error
+}
+
+type s3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3Store(ctx context.Context, config ParquetConfig) (*s3Store, error) {
+	var options []func(*awsconfig.LoadOptions) error
+	if config.Region != "" {
+		options = append(options, awsconfig.WithRegion(config.Region))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(config.Endpoint)
+		}
+		o.UsePathStyle = config.PathStyle
+	})
+	return &s3Store{client: client, bucket: config.Bucket}, nil
+}
+
+func (s *s3Store) Upload(ctx context.Context, key string, file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String("application/vnd.apache.parquet"),
+	})
+	return err
+}
+
+// ParquetSink writes transactions to one open file per partition. Written
+// messages are held until their file was uploaded, so their offsets are
+// committed only then, see Message.Hold. Other updates are ignored. Files are
+// uploaded by a background goroutine, so writes to the other files go on
+// during an upload.
+type ParquetSink struct {
+	config      ParquetConfig
+	store       ObjectStore
+	compression parquet.WriterOption
+	// finished wakes rotateLoop once a file was finished.
+	finished chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+
+	mu    sync.Mutex
+	files map[string]*parquetFile
+	// uploads are the finished files waiting for their upload, or for the
+	// retry of a failed one.
+	uploads []*parquetFile
+}
+
+type parquetFile struct {
+	partition string
+	file      *os.File
+	size      *countingWriter
+	writer    *parquet.GenericWriter[parquetTransaction]
+	rows      int
+	opened    time.Time
+	firstSlot uint64
+	lastSlot  uint64
+	completes []func()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewParquetSink returns a sink uploading its files to the bucket of config.
+func NewParquetSink(ctx context.Context, config ParquetConfig) (*ParquetSink, error) {
+	store, err := newS3Store(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewParquetSinkWithStore(config, store)
+}
+
+// NewParquetSinkWithStore returns a sink uploading its files to store.
+func NewParquetSinkWithStore(config ParquetConfig, store ObjectStore) (*ParquetSink, error) {
+	compression, err := parquetCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &ParquetSink{
+		config:      config,
+		store:       store,
+		compression: compression,
+		finished:    make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		files:       make(map[string]*parquetFile),
+	}
+	go s.rotateLoop()
+	return s, nil
+}
+
+// partition is the Hive style directory of a row, by the day of the Kafka
+// record and the slot range.
+func (s *ParquetSink) partition(msg *decode.Message) string {
+	start := msg.Slot / s.config.SlotRange * s.config.SlotRange
+	return fmt.Sprintf("date=%s/slot_range=%d", msg.Timestamp.UTC().Format(time.DateOnly), start)
+}
+
+func (s *ParquetSink) Write(_ context.Context, msg *decode.Message) error {
+	row, ok := newParquetTransaction(msg)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	partition := s.partition(msg)
+	f, ok := s.files[partition]
+	if !ok {
+		var err error
+		if f, err = s.open(partition); err != nil {
+			return err
+		}
+		s.files[partition] = f
+	}
+	if _, err := f.writer.Write([]parquetTransaction{row}); err != nil {
+		return fmt.Errorf("write %s: %w", f.file.Name(), err)
+	}
+	if f.rows == 0 {
+		f.firstSlot = msg.Slot
+	}
+	f.rows++
+	f.firstSlot = min(f.firstSlot, msg.Slot)
+	f.lastSlot = max(f.lastSlot, msg.Slot)
+	f.completes = append(f.completes, msg.Hold())
+
+	if f.rows >= s.config.MaxRows || f.size.n >= s.config.MaxBytes {
+		s.finish(f)
+	}
+	return nil
+}
+
+func (s *ParquetSink) open(partition string) (*parquetFile, error) {
+	file, err := os.CreateTemp(s.config.Dir, "transactions-*.parquet")
+	if err != nil {
+		return nil, err
+	}
+	size := &countingWriter{w: file}
+	return &parquetFile{
+		partition: partition,
+		file:      file,
+		size:      size,
+		writer:    parquet.NewGenericWriter[parquetTransaction](size, s.compression),
+		opened:    time.Now(),
+	}, nil
+}
+
+// finish closes f and queues it for upload. The caller holds s.mu.
+func (s *ParquetSink) finish(f *parquetFile) {
+	delete(s.files, f.partition)
+	if err := f.writer.Close(); err != nil {
+		// the messages stay held and are consumed again after a restart
+		logging.Logger.Error("failed to close parquet file", zap.String("file", f.file.Name()), zap.Error(err))
+		f.file.Close()
+		return
+	}
+	s.uploads = append(s.uploads, f)
+	select {
+	case s.finished <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ParquetSink) upload(ctx context.Context, f *parquetFile) error {
+	key := path.Join(strings.TrimSuffix(s.config.Prefix, "/"), f.partition,
+		fmt.Sprintf("%d-%d-%d.parquet", f.firstSlot, f.lastSlot, f.opened.UnixNano()))
+	if err := s.store.Upload(ctx, key, f.file); err != nil {
+		return err
+	}
+	logging.Logger.Info("uploaded parquet file", zap.String("key", key), zap.Int("rows", f.rows))
+	f.file.Close()
+	os.Remove(f.file.Name())
+	for _, complete := range f.completes {
+		complete()
+	}
+	return nil
+}
+
+// rotateLoop finishes the files open for MaxAge and uploads the finished
+// files, failed uploads are retried every second.
+func (s *ParquetSink) rotateLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.finished:
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for _, f := range s.files {
+				if now.Sub(f.opened) >= time.Duration(s.config.MaxAge) {
+					s.finish(f)
+				}
+			}
+			s.mu.Unlock()
+		}
+		if err := s.uploadFinished(context.Background()); err != nil {
+			logging.Logger.Warn("parquet upload failed, retrying", zap.Error(err))
+		}
+	}
+}
+
+// uploadFinished uploads the queued files without holding s.mu, the files
+// that failed are queued again.
+func (s *ParquetSink) uploadFinished(ctx context.Context) error {
+	s.mu.Lock()
+	uploads := s.uploads
+	s.uploads = nil
+	s.mu.Unlock()
+
+	var errs []error
+	var failed []*parquetFile
+	for _, f := range uploads {
+		if err := s.upload(ctx, f); err != nil {
+			errs = append(errs, fmt.Errorf("upload %s: %w", filepath.Base(f.file.Name()), err))
+			failed = append(failed, f)
+		}
+	}
+	if len(failed) > 0 {
+		s.mu.Lock()
+		s.uploads = append(failed, s.uploads...)
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Flush does nothing, messages are committed once their file was uploaded.
+func (s *ParquetSink) Flush(context.Context) error {
+	return nil
+}
+
+// Close uploads the open files. Files that could not be uploaded are left in
+// Dir, their messages are consumed again after a restart.
+func (s *ParquetSink) Close() error {
+	close(s.stop)
+	<-s.stopped
+
+	s.mu.Lock()
+	for _, f := range s.files {
+		s.finish(f)
+	}
+	s.mu.Unlock()
+	return s.uploadFinished(context.Background())
+}
@@ -0,0 +1,225 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+)
+
+// memoryStore keeps the uploaded files. An upload waits for block when it is
+// set and fails while fail is set.
+type memoryStore struct {
+	block chan struct{}
+
+	mu    sync.Mutex
+	keys  []string
+	files [][]byte
+	fail  error
+}
+
+func (s *memoryStore) Upload(_ context.Context, key string, file *os.File) error {
+	if s.block != nil {
+		<-s.block
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	s.keys = append(s.keys, key)
+	s.files = append(s.files, data)
+	return nil
+}
+
+func (s *memoryStore) uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+func (s *memoryStore) setFail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = err
+}
+
+func newTestParquetSink(t *testing.T, store ObjectStore, maxRows int) *ParquetSink {
+	t.Helper()
+	config := DefaultParquetConfig()
+	config.Bucket, config.Prefix, config.Dir, config.MaxRows = "archive", "solana/", t.TempDir(), maxRows
+	s, err := NewParquetSinkWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// completions counts the completions of the messages by slot.
+type completions struct {
+	mu    sync.Mutex
+	slots map[uint64]int
+}
+
+func (c *completions) message(slot uint64, when time.Time) *decode.Message {
+	msg := decodetest.TransactionMessage(slot, testkey.Key(1))
+	msg.Timestamp = when
+	msg.Complete = func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.slots == nil {
+			c.slots = make(map[uint64]int)
+		}
+		c.slots[slot]++
+	}
+	return msg
+}
+
+func (c *completions) count(slot uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slots[slot]
+}
+
+func TestParquetSinkRotatesByRows(t *testing.T) {
+	store := &memoryStore{}
+	s := newTestParquetSink(t, store, 2)
+	defer s.Close()
+	ctx := context.Background()
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var done completions
+
+	for _, msg := range []*decode.Message{done.message(11, day), done.message(10, day), decodetest.SlotMessage(12, 11, 0)} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return done.count(10) == 1 && done.count(11) == 1 })
+
+	if store.uploads() != 1 || !strings.HasPrefix(store.keys[0], "solana/date=2024-05-01/slot_range=0/10-11-") {
+		t.Fatalf("uploaded %v", store.keys)
+	}
+	rows, err := parquet.Read[parquetTransaction](bytes.NewReader(store.files[0]), int64(len(store.files[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Slot != 11 || rows[1].Slot != 10 || !rows[0].KafkaTimestamp.Equal(day) {
+		t.Fatalf("rows %+v", rows)
+	}
+	if entries, _ := os.ReadDir(s.config.Dir); len(entries) != 0 {
+		t.Fatalf("%d files left in dir after the upload", len(entries))
+	}
+}
+
+func TestParquetSinkRetriesUpload(t *testing.T) {
+	store := &memoryStore{fail: errors.New("bucket unavailable")}
+	s := newTestParquetSink(t, store, 1)
+	defer s.Close()
+	var done completions
+
+	if err := s.Write(context.Background(), done.message(10, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if done.count(10) != 0 {
+		t.Fatal("message completed although the upload failed")
+	}
+	store.setFail(nil)
+	waitFor(t, func() bool { return store.uploads() == 1 && done.count(10) == 1 })
+}
+
+func TestParquetSinkWritesDuringUpload(t *testing.T) {
+	store := &memoryStore{block: make(chan struct{})}
+	s := newTestParquetSink(t, store, 1)
+	defer s.Close()
+	defer close(store.block)
+	ctx := context.Background()
+	var done completions
+
+	// the first file is finished by its first row, its upload blocks
+	written := make(chan error)
+	go func() {
+		err := s.Write(ctx, done.message(10, time.Now()))
+		if err == nil {
+			err = s.Write(ctx, done.message(200_000, time.Now()))
+		}
+		if err == nil {
+			err = s.Write(ctx, done.message(200_001, time.Now()))
+		}
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by an upload")
+	}
+	if done.count(10) != 0 {
+		t.Fatal("message completed before its file was uploaded")
+	}
+}
+
+func TestParquetSinkClose(t *testing.T) {
+	store := &memoryStore{}
+	s := newTestParquetSink(t, store, 100)
+	var done completions
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, msg := range []*decode.Message{done.message(10, day), done.message(100_001, day), done.message(20, day.AddDate(0, 0, 1))} {
+		if err := s.Write(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(store.keys)
+	var partitions []string
+	for _, key := range store.keys {
+		partitions = append(partitions, filepath.Dir(key))
+	}
+	want := []string{"solana/date=2024-05-01/slot_range=0", "solana/date=2024-05-01/slot_range=100000", "solana/date=2024-05-02/slot_range=0"}
+	if !slices.Equal(partitions, want) {
+		t.Fatalf("partitions %v, want %v", partitions, want)
+	}
+	if done.count(10) != 1 || done.count(100_001) != 1 || done.count(20) != 1 {
+		t.Fatalf("completed %v", done.slots)
+	}
+}
+
+func TestParquetSinkCloseKeepsFailedFiles(t *testing.T) {
+	failure := errors.New("bucket unavailable")
+	store := &memoryStore{fail: failure}
+	s := newTestParquetSink(t, store, 100)
+	var done completions
+	if err := s.Write(context.Background(), done.message(10, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if entries, _ := os.ReadDir(s.config.Dir); len(entries) != 1 || done.count(10) != 0 {
+		t.Fatalf("%d files left in dir, %d completions", len(entries), done.count(10))
+	}
+}
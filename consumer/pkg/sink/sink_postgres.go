@@ -0,0 +1,484 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+// Names of the statements prepared on every pool connection.
+const (
+	postgresInsertTransaction = "insert_transaction"
+	postgresInsertAccount     = "insert_account"
+	postgresInsertSlot        = "insert_slot"
+	postgresStoreOffset       = "store_offset"
+)
+
+type PostgresConfig struct {
+	DSN   string `json:"dsn" yaml:"dsn"`
+	Table string `json:"table" yaml:"table"`
+	// AccountTable and SlotTable receive account and slot updates, which
+	// are ignored when the table is empty.
+	AccountTable  string            `json:"account_table" yaml:"account_table"`
+	SlotTable     string            `json:"slot_table" yaml:"slot_table"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// OffsetsTable stores the next offset of every partition in the
+	// transaction inserting the rows of its messages, and the consumer starts
+	// the partitions there. The rows of every table are then batched
+	// together.
+	OffsetsTable string `json:"offsets_table" yaml:"offsets_table"`
+	// CreateTable creates the tables on startup when they do not exist.
+	CreateTable bool `json:"create_table" yaml:"create_table"`
+}
+
+func DefaultPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		Table:         "transactions",
+		BatchSize:     500,
+		FlushInterval: duration.Duration(time.Second),
+	}
+}
+
+func (c *PostgresConfig) Validate() error {
+	if c.DSN == "" {
+		return errors.New("sink.postgres.dsn: must not be empty")
+	}
+	if c.Table == "" {
+		return errors.New("sink.postgres.table: must not be empty")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.postgres.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("sink.postgres.flush_interval: must be positive")
+	}
+	return nil
+}
+
+// postgresTable is one table written by the sink.
+type postgresTable struct {
+	name      string
+	statement string
+	create    string
+	insert    string
+}
+
+// postgresTables lists the enabled tables, the transaction table first.
+func postgresTables(config PostgresConfig) []postgresTable {
+	tables := []postgresTable{{
+		name:      config.Table,
+		statement: postgresInsertTransaction,
+		create: `CREATE TABLE IF NOT EXISTS %s (
+			signature text NOT NULL,
+			slot bigint NOT NULL,
+			accounts text[] NOT NULL,
+			err bytea,
+			logs text[],
+			rolled_back boolean NOT NULL DEFAULT false,
+			PRIMARY KEY (signature, slot)
+		)`,
+		insert: `INSERT INTO %s (signature, slot, accounts, err, logs)
+			VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+	}}
+	if config.AccountTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.AccountTable,
+			statement: postgresInsertAccount,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				pubkey text NOT NULL,
+				slot bigint NOT NULL,
+				lamports bigint NOT NULL,
+				owner text NOT NULL,
+				executable boolean NOT NULL,
+				rent_epoch numeric(20) NOT NULL,
+				data bytea NOT NULL,
+				write_version bigint NOT NULL,
+				txn_signature text,
+				rolled_back boolean NOT NULL DEFAULT false,
+				PRIMARY KEY (pubkey, slot, write_version)
+			)`,
+			insert: `INSERT INTO %s (pubkey, slot, lamports, owner, executable, rent_epoch, data, write_version, txn_signature)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING`,
+		})
+	}
+	if config.SlotTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.SlotTable,
+			statement: postgresInsertSlot,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				slot bigint NOT NULL,
+				parent bigint,
+				status text NOT NULL,
+				dead_error text,
+				PRIMARY KEY (slot, status)
+			)`,
+			insert: `INSERT INTO %s (slot, parent, status, dead_error)
+				VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		})
+	}
+	if config.OffsetsTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.OffsetsTable,
+			statement: postgresStoreOffset,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				topic text NOT NULL,
+				partition integer NOT NULL,
+				next_offset bigint NOT NULL,
+				PRIMARY KEY (topic, partition)
+			)`,
+			// rows of a partition are written in offset order, the offset
+			// never goes back all the same
+			insert: `INSERT INTO %s AS o (topic, partition, next_offset) VALUES ($1, $2, $3)
+				ON CONFLICT (topic, partition) DO UPDATE SET next_offset = GREATEST(o.next_offset, EXCLUDED.next_offset)`,
+		})
+	}
+	return tables
+}
+
+// postgresPool is the connection pool of the sink, a *pgxpool.Pool.
+type postgresPool interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Close()
+}
+
+// postgresPreparer is a connection of the pool, a *pgx.Conn.
+type postgresPreparer interface {
+	Prepare(ctx context.Context, name, sql string) (*pgconn.StatementDescription, error)
+}
+
+// PostgresSink batches transactions, and optionally accounts and slots, into
+// tables. Inserts ignore rows that already exist so a batch can be retried
+// after a failure.
+type PostgresSink struct {
+	pool         postgresPool
+	transactions *batcher[decode.TransactionRow]
+	// accounts and slots are nil when their table is disabled.
+	accounts     *batcher[accountRow]
+	slots        *batcher[slotRow]
+	accountTable bool
+	slotTable    bool
+	// records replaces the batchers above when the offsets are stored in
+	// offsetsTable, so the rows and offsets of a batch commit together.
+	records      *batcher[postgresRecord]
+	offsetsTable string
+	// rollbackTables are the tables whose rows of a slot are rolled back.
+	rollbackTables []string
+}
+
+// postgresRecord is the row of a message for any of the tables, along with
+// the position of the message.
+type postgresRecord struct {
+	topic       string
+	partition   int32
+	offset      int64
+	transaction *decode.TransactionRow
+	account     *accountRow
+	slot        *slotRow
+}
+
+func NewPostgresSink(ctx context.Context, config PostgresConfig) (*PostgresSink, error) {
+	tables := postgresTables(config)
+
+	if config.CreateTable {
+		conn, err := pgx.Connect(ctx, config.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("postgres connect: %w", err)
+		}
+		for _, table := range tables {
+			if _, err = conn.Exec(ctx, fmt.Sprintf(table.create, postgresIdentifier(table.name))); err != nil {
+				err = fmt.Errorf("postgres create table %s: %w", table.name, err)
+				break
+			}
+		}
+		conn.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("postgres dsn: %w", err)
+	}
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		return preparePostgresStatements(ctx, conn, tables)
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("postgres connect: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("postgres connect: %w", err)
+	}
+	return newPostgresSink(config, pool), nil
+}
+
+// newPostgresSink writes to pool, whose connections prepared the statements
+// of the tables.
+func newPostgresSink(config PostgresConfig, pool postgresPool) *PostgresSink {
+	s := &PostgresSink{
+		pool:         pool,
+		accountTable: config.AccountTable != "",
+		slotTable:    config.SlotTable != "",
+		offsetsTable: config.OffsetsTable,
+	}
+	s.rollbackTables = []string{config.Table}
+	if config.AccountTable != "" {
+		s.rollbackTables = append(s.rollbackTables, config.AccountTable)
+	}
+	interval := time.Duration(config.FlushInterval)
+	if config.OffsetsTable != "" {
+		s.records = newBatcher("postgres", config.BatchSize, interval, s.insertRecords)
+		return s
+	}
+	s.transactions = newBatcher("postgres", config.BatchSize, interval, s.insertTransactions)
+	if config.AccountTable != "" {
+		s.accounts = newBatcher("postgres accounts", config.BatchSize, interval, s.insertAccounts)
+	}
+	if config.SlotTable != "" {
+		s.slots = newBatcher("postgres slots", config.BatchSize, interval, s.insertSlots)
+	}
+	return s
+}
+
+// preparePostgresStatements prepares the inserts of tables on a new
+// connection of the pool, the batches queue them by statement name.
+func preparePostgresStatements(ctx context.Context, conn postgresPreparer, tables []postgresTable) error {
+	for _, table := range tables {
+		if _, err := conn.Prepare(ctx, table.statement, fmt.Sprintf(table.insert, postgresIdentifier(table.name))); err != nil {
+			return fmt.Errorf("postgres prepare %s: %w", table.statement, err)
+		}
+	}
+	return nil
+}
+
+func postgresIdentifier(name string) string {
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
+
+func (s *PostgresSink) Write(ctx context.Context, msg *decode.Message) error {
+	record := postgresRecord{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset}
+	switch msg.Kind() {
+	case decode.KindTransaction:
+		row, ok := decode.NewTransactionRow(msg)
+		if !ok {
+			return nil
+		}
+		if s.records == nil {
+			return s.transactions.Add(ctx, row)
+		}
+		record.transaction = &row
+	case decode.KindAccount:
+		row, ok := newAccountRow(msg)
+		if !ok || !s.accountTable {
+			return nil
+		}
+		if s.records == nil {
+			return s.accounts.Add(ctx, row)
+		}
+		record.account = &row
+	case decode.KindSlot:
+		row, ok := newSlotRow(msg)
+		if !ok || !s.slotTable {
+			return nil
+		}
+		if s.records == nil {
+			return s.slots.Add(ctx, row)
+		}
+		record.slot = &row
+	default:
+		return nil
+	}
+	return s.records.Add(ctx, record)
+}
+
+func (s *PostgresSink) Flush(ctx context.Context) error {
+	return errors.Join(s.transactions.Flush(ctx), s.accounts.Flush(ctx), s.slots.Flush(ctx), s.records.Flush(ctx))
+}
+
+func (s *PostgresSink) insertTransactions(ctx context.Context, rows []decode.TransactionRow) error {
+	batch := &pgx.Batch{}
+	for _, row := range rows {
+		queueTransaction(batch, row)
+	}
+	if err := s.send(ctx, batch); err != nil {
+		return fmt.Errorf("postgres insert %d transactions: %w", len(rows), err)
+	}
+	return nil
+}
+
+func (s *PostgresSink) insertAccounts(ctx context.Context, rows []accountRow) error {
+	batch := &pgx.Batch{}
+	for _, row := range rows {
+		queueAccount(batch, row)
+	}
+	if err := s.send(ctx, batch); err != nil {
+		return fmt.Errorf("postgres insert %d accounts: %w", len(rows), err)
+	}
+	return nil
+}
+
+func (s *PostgresSink) insertSlots(ctx context.Context, rows []slotRow) error {
+	batch := &pgx.Batch{}
+	for _, row := range rows {
+		queueSlot(batch, row)
+	}
+	if err := s.send(ctx, batch); err != nil {
+		return fmt.Errorf("postgres insert %d slots: %w", len(rows), err)
+	}
+	return nil
+}
+
+// insertRecords inserts the rows of every table and stores the next offset
+// of their partitions in one transaction.
+func (s *PostgresSink) insertRecords(ctx context.Context, records []postgresRecord) error {
+	batch := &pgx.Batch{}
+	for _, record := range records {
+		switch {
+		case record.transaction != nil:
+			queueTransaction(batch, *record.transaction)
+		case record.account != nil:
+			queueAccount(batch, *record.account)
+		case record.slot != nil:
+			queueSlot(batch, *record.slot)
+		}
+	}
+	for p, next := range nextOffsets(records) {
+		batch.Queue(postgresStoreOffset, p.topic, p.partition, next)
+	}
+	if err := s.send(ctx, batch); err != nil {
+		return fmt.Errorf("postgres insert %d rows with their offsets: %w", len(records), err)
+	}
+	return nil
+}
+
+// postgresPartition is a partition whose offsets are stored in the database.
+type postgresPartition struct {
+	topic     string
+	partition int32
+}
+
+// nextOffsets returns the offset after the last record of every partition.
+func nextOffsets(records []postgresRecord) map[postgresPartition]int64 {
+	next := make(map[postgresPartition]int64)
+	for _, record := range records {
+		p := postgresPartition{record.topic, record.partition}
+		next[p] = max(next[p], record.offset+1)
+	}
+	return next
+}
+
+// StoredOffsets returns the next offset stored for the claimed partitions,
+// none unless the offsets are stored in the database.
+func (s *PostgresSink) StoredOffsets(ctx context.Context, claims map[string][]int32) (map[string]map[int32]int64, error) {
+	if s.offsetsTable == "" {
+		return nil, nil
+	}
+	topics := make([]string, 0, len(claims))
+	for topic := range claims {
+		topics = append(topics, topic)
+	}
+	rows, err := s.pool.Query(ctx, fmt.Sprintf("SELECT topic, partition, next_offset FROM %s WHERE topic = ANY($1)",
+		postgresIdentifier(s.offsetsTable)), topics)
+	if err != nil {
+		return nil, fmt.Errorf("postgres read offsets: %w", err)
+	}
+	defer rows.Close()
+	stored := make(map[string]map[int32]int64)
+	for rows.Next() {
+		var topic string
+		var partition int32
+		var next int64
+		if err := rows.Scan(&topic, &partition, &next); err != nil {
+			return nil, fmt.Errorf("postgres read offsets: %w", err)
+		}
+		if !slices.Contains(claims[topic], partition) {
+			continue
+		}
+		if stored[topic] == nil {
+			stored[topic] = make(map[int32]int64)
+		}
+		stored[topic][partition] = next
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres read offsets: %w", err)
+	}
+	return stored, nil
+}
+
+func queueTransaction(batch *pgx.Batch, row decode.TransactionRow) {
+	batch.Queue(postgresInsertTransaction, row.Signature, int64(row.Slot), row.Accounts, row.Err, row.Logs)
+}
+
+func queueAccount(batch *pgx.Batch, row accountRow) {
+	var txnSignature *string
+	if row.txnSignature != "" {
+		txnSignature = &row.txnSignature
+	}
+	batch.Queue(postgresInsertAccount, row.pubkey, int64(row.slot), int64(row.lamports), row.owner,
+		row.executable, row.rentEpoch, row.data, int64(row.writeVersion), txnSignature)
+}
+
+func queueSlot(batch *pgx.Batch, row slotRow) {
+	var parent *int64
+	if row.parent != nil {
+		p := int64(*row.parent)
+		parent = &p
+	}
+	var deadError *string
+	if row.deadError != "" {
+		deadError = &row.deadError
+	}
+	batch.Queue(postgresInsertSlot, int64(row.slot), parent, row.status, deadError)
+}
+
+// RollbackSlots writes the pending rows out, then deletes the transactions
+// and accounts of slots or marks them rolled back, in one transaction.
+func (s *PostgresSink) RollbackSlots(ctx context.Context, slots []uint64, mark bool) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	values := make([]int64, len(slots))
+	for i, slot := range slots {
+		values[i] = int64(slot)
+	}
+	batch := &pgx.Batch{}
+	for _, table := range s.rollbackTables {
+		statement := "DELETE FROM %s WHERE slot = ANY($1)"
+		if mark {
+			statement = "UPDATE %s SET rolled_back = true WHERE slot = ANY($1)"
+		}
+		batch.Queue(fmt.Sprintf(statement, postgresIdentifier(table)), values)
+	}
+	if err := s.send(ctx, batch); err != nil {
+		return fmt.Errorf("postgres roll back %d slots: %w", len(slots), err)
+	}
+	return nil
+}
+
+// send runs a batch of inserts in one transaction.
+func (s *PostgresSink) send(ctx context.Context, batch *pgx.Batch) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+}
+
+func (s *PostgresSink) Close() error {
+	err := errors.Join(s.transactions.Close(), s.accounts.Close(), s.slots.Close(), s.records.Close())
+	s.pool.Close()
+	return err
+}
@@ -0,0 +1,375 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+// postgresFake is a pool whose transactions keep the arguments of the
+// statements queued in their batches, by statement, once committed. A batch
+// queueing a statement that was not prepared fails as it does on the server.
+// The offsets stored are kept as the conflict clause of the prepared
+// statement resolves them.
+type postgresFake struct {
+	mu         sync.Mutex
+	statements map[string]string
+	rows       map[string][][]any
+	offsets    map[postgresPartition]int64
+	// commitErr fails the commits while set.
+	commitErr error
+}
+
+func newPostgresFake(t *testing.T, config PostgresConfig) *postgresFake {
+	t.Helper()
+	db := &postgresFake{statements: make(map[string]string), rows: make(map[string][][]any), offsets: make(map[postgresPartition]int64)}
+	if err := preparePostgresStatements(context.Background(), db, postgresTables(config)); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func (db *postgresFake) Prepare(_ context.Context, name, sql string) (*pgconn.StatementDescription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.statements[name] = sql
+	return &pgconn.StatementDescription{Name: name, SQL: sql}, nil
+}
+
+func (db *postgresFake) Begin(context.Context) (pgx.Tx, error) {
+	return &postgresFakeTx{db: db}, nil
+}
+
+// Query reads the offsets of the topics, the only query of the sink.
+func (db *postgresFake) Query(_ context.Context, _ string, args ...any) (pgx.Rows, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := &postgresFakeRows{}
+	for p, next := range db.offsets {
+		if slices.Contains(args[0].([]string), p.topic) {
+			rows.values = append(rows.values, []any{p.topic, p.partition, next})
+		}
+	}
+	return rows, nil
+}
+
+// storeOffset applies the conflict clause of the prepared statement.
+func (db *postgresFake) storeOffset(topic string, partition int32, next int64) {
+	p := postgresPartition{topic, partition}
+	stored, ok := db.offsets[p]
+	statement := db.statements[postgresStoreOffset]
+	switch {
+	case !ok:
+		db.offsets[p] = next
+	case strings.Contains(statement, "DO UPDATE SET next_offset = GREATEST(o.next_offset, EXCLUDED.next_offset)"):
+		db.offsets[p] = max(stored, next)
+	case strings.Contains(statement, "DO NOTHING"):
+	default:
+		db.offsets[p] = next
+	}
+}
+
+func (db *postgresFake) Close() {}
+
+// committed returns the arguments committed for statement.
+func (db *postgresFake) committed(statement string) [][]any {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.rows[statement]
+}
+
+type postgresFakeTx struct {
+	pgx.Tx
+	db     *postgresFake
+	queued []*pgx.QueuedQuery
+	closed bool
+}
+
+func (tx *postgresFakeTx) SendBatch(_ context.Context, batch *pgx.Batch) pgx.BatchResults {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	for _, query := range batch.QueuedQueries {
+		if _, ok := tx.db.statements[query.SQL]; !ok && !strings.Contains(query.SQL, " ") {
+			return postgresFakeResults{err: &pgconn.PgError{Code: "26000", Message: "prepared statement " + query.SQL + " does not exist"}}
+		}
+	}
+	tx.queued = append(tx.queued, batch.QueuedQueries...)
+	return postgresFakeResults{}
+}
+
+func (tx *postgresFakeTx) Commit(context.Context) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.closed = true
+	if tx.db.commitErr != nil {
+		return tx.db.commitErr
+	}
+	for _, query := range tx.queued {
+		tx.db.rows[query.SQL] = append(tx.db.rows[query.SQL], query.Arguments)
+		if query.SQL == postgresStoreOffset {
+			tx.db.storeOffset(query.Arguments[0].(string), query.Arguments[1].(int32), query.Arguments[2].(int64))
+		}
+	}
+	return nil
+}
+
+func (tx *postgresFakeTx) Rollback(context.Context) error {
+	if tx.closed {
+		return pgx.ErrTxClosed
+	}
+	tx.closed = true
+	return nil
+}
+
+type postgresFakeResults struct {
+	pgx.BatchResults
+	err error
+}
+
+func (r postgresFakeResults) Close() error { return r.err }
+
+type postgresFakeRows struct {
+	pgx.Rows
+	values  [][]any
+	current []any
+}
+
+func (r *postgresFakeRows) Next() bool {
+	if len(r.values) == 0 {
+		return false
+	}
+	r.current, r.values = r.values[0], r.values[1:]
+	return true
+}
+
+func (r *postgresFakeRows) Scan(dest ...any) error {
+	*dest[0].(*string), *dest[1].(*int32), *dest[2].(*int64) = r.current[0].(string), r.current[1].(int32), r.current[2].(int64)
+	return nil
+}
+
+func (r *postgresFakeRows) Err() error { return nil }
+
+func (r *postgresFakeRows) Close() {}
+
+func TestNextOffsets(t *testing.T) {
+	next := nextOffsets([]postgresRecord{
+		{topic: "updates", partition: 0, offset: 10},
+		{topic: "updates", partition: 0, offset: 12},
+		{topic: "updates", partition: 1, offset: 4},
+		{topic: "slots", partition: 0, offset: 99},
+	})
+	if len(next) != 3 || next[postgresPartition{"updates", 0}] != 13 || next[postgresPartition{"updates", 1}] != 5 ||
+		next[postgresPartition{"slots", 0}] != 100 {
+		t.Fatalf("next offsets %v", next)
+	}
+}
+
+func TestPreparePostgresStatements(t *testing.T) {
+	config := PostgresConfig{Table: "solana.transactions", AccountTable: "accounts", SlotTable: "slots", OffsetsTable: "offsets"}
+	db := newPostgresFake(t, config)
+	for name, want := range map[string]string{
+		postgresInsertTransaction: `INSERT INTO "solana"."transactions" (signature,`,
+		postgresInsertAccount:     `INSERT INTO "accounts" (pubkey,`,
+		postgresInsertSlot:        `INSERT INTO "slots" (slot,`,
+		postgresStoreOffset:       `INSERT INTO "offsets" AS o (topic,`,
+	} {
+		if !strings.HasPrefix(db.statements[name], want) {
+			t.Errorf("%s prepared as %q, want %s", name, db.statements[name], want)
+		}
+	}
+
+	// the disabled tables prepare nothing
+	db = newPostgresFake(t, PostgresConfig{Table: "transactions"})
+	if len(db.statements) != 1 {
+		t.Errorf("prepared %v", db.statements)
+	}
+}
+
+func TestPostgresSinkBatches(t *testing.T) {
+	config := DefaultPostgresConfig()
+	config.AccountTable, config.SlotTable = "accounts", "slots"
+	config.BatchSize, config.FlushInterval = 2, duration.Duration(time.Hour)
+	db := newPostgresFake(t, config)
+	s := newPostgresSink(config, db)
+	defer s.Close()
+
+	ctx := context.Background()
+	for slot := uint64(10); slot < 13; slot++ {
+		if err := s.Write(ctx, decodetest.TransactionMessage(slot, testkey.Key(1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the third transaction flushed the full batch
+	if rows := db.committed(postgresInsertTransaction); len(rows) != 2 || rows[0][1] != int64(10) || rows[1][1] != int64(11) {
+		t.Fatalf("transactions %v", rows)
+	}
+
+	account := decodetest.AccountMessage(13, testkey.Key(2), testkey.Key(3))
+	account.Update.GetAccount().Account.Lamports = 5
+	for _, msg := range []*decode.Message{account, decodetest.SlotMessage(14, 13, proto.CommitmentLevel_CONFIRMED), decodetest.SlotMessage(15, 0, proto.CommitmentLevel_PROCESSED)} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rows := db.committed(postgresInsertTransaction); len(rows) != 3 || rows[2][1] != int64(12) {
+		t.Fatalf("transactions %v", rows)
+	}
+	var signature *string
+	if want := []any{testkey.String(2), int64(13), int64(5), testkey.String(3), false, uint64(0), []byte(nil), int64(0), signature}; !reflect.DeepEqual(db.committed(postgresInsertAccount), [][]any{want}) {
+		t.Errorf("accounts %v", db.committed(postgresInsertAccount))
+	}
+	parent := int64(13)
+	var deadError *string
+	if want := [][]any{{int64(14), &parent, "confirmed", deadError}, {int64(15), (*int64)(nil), "processed", deadError}}; !reflect.DeepEqual(db.committed(postgresInsertSlot), want) {
+		t.Errorf("slots %v", db.committed(postgresInsertSlot))
+	}
+}
+
+func TestPostgresSinkRequeues(t *testing.T) {
+	config := DefaultPostgresConfig()
+	config.FlushInterval = duration.Duration(time.Hour)
+	db := newPostgresFake(t, config)
+	s := newPostgresSink(config, db)
+	defer s.Close()
+
+	ctx := context.Background()
+	db.commitErr = errors.New("connection reset")
+	if err := s.Write(ctx, decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); !errors.Is(err, db.commitErr) {
+		t.Fatalf("got %v", err)
+	}
+	if rows := db.committed(postgresInsertTransaction); len(rows) != 0 {
+		t.Fatalf("a failed flush committed %v", rows)
+	}
+
+	// the rows of the failed flush are written first by the next one
+	db.mu.Lock()
+	db.commitErr = nil
+	db.mu.Unlock()
+	if err := s.Write(ctx, decodetest.TransactionMessage(11, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rows := db.committed(postgresInsertTransaction); len(rows) != 2 || rows[0][1] != int64(10) || rows[1][1] != int64(11) {
+		t.Fatalf("transactions %v", rows)
+	}
+}
+
+func TestPostgresSinkUnprepared(t *testing.T) {
+	config := DefaultPostgresConfig()
+	config.FlushInterval = duration.Duration(time.Hour)
+	// a connection that did not prepare the statements
+	db := &postgresFake{statements: make(map[string]string), rows: make(map[string][][]any)}
+	s := newPostgresSink(config, db)
+	defer s.Close()
+	if err := s.Write(context.Background(), decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	var pgErr *pgconn.PgError
+	if err := s.Flush(context.Background()); !errors.As(err, &pgErr) || pgErr.Code != "26000" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestPostgresOffsetsFailedCommit(t *testing.T) {
+	config := DefaultPostgresConfig()
+	config.OffsetsTable, config.FlushInterval = "offsets", duration.Duration(time.Hour)
+	db := newPostgresFake(t, config)
+	s := newPostgresSink(config, db)
+	defer s.Close()
+
+	ctx := context.Background()
+	write := func(offsets ...int64) {
+		t.Helper()
+		for _, offset := range offsets {
+			msg := decodetest.TransactionMessage(uint64(offset), testkey.Key(1))
+			msg.Topic, msg.Partition, msg.Offset = "updates", 0, offset
+			if err := s.Write(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	claims := map[string][]int32{"updates": {0}}
+
+	write(10, 11)
+	db.commitErr = errors.New("could not serialize access")
+	if err := s.Flush(ctx); !errors.Is(err, db.commitErr) {
+		t.Fatalf("got %v", err)
+	}
+	// neither the rows nor the offset advanced
+	stored, err := s.StoredOffsets(ctx, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := db.committed(postgresInsertTransaction); len(rows) != 0 || len(stored) != 0 {
+		t.Fatalf("a failed commit stored %v and offsets %v", rows, stored)
+	}
+
+	// the next commit writes them together
+	db.mu.Lock()
+	db.commitErr = nil
+	db.mu.Unlock()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = s.StoredOffsets(ctx, claims); err != nil || stored["updates"][0] != 12 {
+		t.Fatalf("stored %v, %v", stored, err)
+	}
+	if rows := db.committed(postgresInsertTransaction); len(rows) != 2 {
+		t.Fatalf("transactions %v", rows)
+	}
+}
+
+func TestPostgresOffsetsNeverGoBack(t *testing.T) {
+	config := DefaultPostgresConfig()
+	config.OffsetsTable, config.FlushInterval = "offsets", duration.Duration(time.Hour)
+	db := newPostgresFake(t, config)
+	s := newPostgresSink(config, db)
+	defer s.Close()
+
+	ctx := context.Background()
+	// a member consuming a partition again from an older offset, as after a
+	// rebalance, stores a lower offset than the one already stored
+	for _, offset := range []int64{20, 5} {
+		msg := decodetest.TransactionMessage(uint64(offset), testkey.Key(1))
+		msg.Topic, msg.Partition, msg.Offset = "updates", 0, offset
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stored := db.committed(postgresStoreOffset); len(stored) != 2 || stored[1][2] != int64(6) {
+		t.Fatalf("offsets stored %v", stored)
+	}
+	stored, err := s.StoredOffsets(ctx, map[string][]int32{"updates": {0}})
+	if err != nil || stored["updates"][0] != 21 {
+		t.Fatalf("stored %v, %v: the offset went back", stored, err)
+	}
+	// partitions not claimed are left out
+	if stored, err = s.StoredOffsets(ctx, map[string][]int32{"updates": {1}}); err != nil || len(stored) != 0 {
+		t.Fatalf("stored %v, %v", stored, err)
+	}
+}
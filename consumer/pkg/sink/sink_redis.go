@@ -0,0 +1,137 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+type RedisConfig struct {
+	// URL is redis://[user:password@]host:port[/db], rediss:// for TLS.
+	URL string `json:"url" yaml:"url"`
+	// Mode is stream to XADD the updates to Redis Streams or pubsub to
+	// PUBLISH them on channels.
+	Mode string `json:"mode" yaml:"mode"`
+	// Prefix starts every stream and channel name, see RoutingKeys.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// MaxLen trims every stream to about that many entries, zero keeps
+	// them all.
+	MaxLen        int64             `json:"max_len" yaml:"max_len"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+}
+
+func DefaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		URL:           "redis://localhost:6379/0",
+		Mode:          "stream",
+		Prefix:        "solana",
+		MaxLen:        100_000,
+		BatchSize:     500,
+		FlushInterval: duration.Duration(100 * time.Millisecond),
+	}
+}
+
+func (c *RedisConfig) Validate() error {
+	if _, err := redis.ParseURL(c.URL); err != nil {
+		return fmt.Errorf("sink.redis.url: %w", err)
+	}
+	if c.Mode != "stream" && c.Mode != "pubsub" {
+		return fmt.Errorf("sink.redis.mode: expected stream or pubsub, got %q", c.Mode)
+	}
+	if c.Prefix == "" {
+		return errors.New("sink.redis.prefix: must not be empty")
+	}
+	if c.MaxLen < 0 {
+		return errors.New("sink.redis.max_len: must not be negative")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.redis.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("sink.redis.flush_interval: must be positive")
+	}
+	return nil
+}
+
+// redisEntry is one update added to a stream or published on a channel.
+type redisEntry struct {
+	key    string
+	kind   decode.UpdateKind
+	slot   uint64
+	update []byte
+}
+
+// RedisSink forwards updates as JSON to Redis Streams or Pub/Sub channels, so
+// clients without Kafka support can follow them. A stream entry has the
+// fields kind, slot and update, a channel message is the update itself.
+type RedisSink struct {
+	config RedisConfig
+	client *redis.Client
+	batch  *batcher[redisEntry]
+}
+
+func NewRedisSink(ctx context.Context, config RedisConfig) (*RedisSink, error) {
+	options, err := redis.ParseURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+	s := &RedisSink{config: config, client: client}
+	s.batch = newBatcher("redis", config.BatchSize, time.Duration(config.FlushInterval), s.send)
+	return s, nil
+}
+
+func (s *RedisSink) Write(ctx context.Context, msg *decode.Message) error {
+	update, err := decode.FormatJSON(msg.Update)
+	if err != nil {
+		return err
+	}
+	for _, key := range decode.RoutingKeys(s.config.Prefix, ":", msg.Update) {
+		if err := s.batch.Add(ctx, redisEntry{key: key, kind: msg.Kind(), slot: msg.Slot, update: update}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisSink) Flush(ctx context.Context) error {
+	return s.batch.Flush(ctx)
+}
+
+func (s *RedisSink) Close() error {
+	err := s.batch.Close()
+	return errors.Join(err, s.client.Close())
+}
+
+// send writes a batch in one pipeline.
+func (s *RedisSink) send(ctx context.Context, entries []redisEntry) error {
+	pipe := s.client.Pipeline()
+	for _, entry := range entries {
+		if s.config.Mode == "pubsub" {
+			pipe.Publish(ctx, entry.key, entry.update)
+			continue
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: entry.key,
+			MaxLen: s.config.MaxLen,
+			Approx: true,
+			Values: []any{"kind", string(entry.kind), "slot", strconv.FormatUint(entry.slot, 10), "update", entry.update},
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis pipeline: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mr-tron/base58"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/duration"
+)
+
+func newTestRedisSink(t *testing.T, mode string) (*miniredis.Miniredis, *RedisSink) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	config := DefaultRedisConfig()
+	config.URL, config.Mode, config.FlushInterval = "redis://"+server.Addr(), mode, duration.Duration(time.Hour)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRedisSink(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return server, s
+}
+
+func TestRedisSinkStream(t *testing.T) {
+	server, s := newTestRedisSink(t, "stream")
+	s.config.MaxLen = 2
+	ctx := context.Background()
+
+	for slot := uint64(10); slot < 13; slot++ {
+		if err := s.Write(ctx, decodetest.TransactionMessage(slot, testkey.Key(1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Write(ctx, decodetest.SlotMessage(12, 11, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := server.Stream("solana:transaction:" + base58.Encode(testkey.Key(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want the stream trimmed to 2", len(entries))
+	}
+	values := entries[1].Values
+	if len(values) != 6 || values[0] != "kind" || values[1] != "transaction" || values[2] != "slot" || values[3] != "12" {
+		t.Fatalf("values %v", values)
+	}
+	var update map[string]any
+	if err := json.Unmarshal([]byte(values[5]), &update); err != nil {
+		t.Fatal(err)
+	}
+	if slots, err := server.Stream("solana:slot"); err != nil || len(slots) != 1 {
+		t.Fatalf("%d slot entries, %v", len(slots), err)
+	}
+}
+
+func TestRedisSinkPubSub(t *testing.T) {
+	server, s := newTestRedisSink(t, "pubsub")
+	ctx := context.Background()
+	subscriber := server.NewSubscriber()
+	defer subscriber.Close()
+	channel := "solana:account:" + base58.Encode(testkey.Key(1))
+	subscriber.Subscribe(channel)
+	// the subscriber is not buffered, publishing waits for the receive
+	received := make(chan string, 1)
+	go func() { received <- (<-subscriber.Messages()).Message }()
+
+	if err := s.Write(ctx, decodetest.AccountMessage(10, testkey.Key(2), testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if !json.Valid([]byte(msg)) {
+			t.Fatalf("message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message published")
+	}
+}
+
+func TestRedisSinkFlushFailureKeepsEntries(t *testing.T) {
+	server, s := newTestRedisSink(t, "stream")
+	ctx := context.Background()
+	if err := s.Write(ctx, decodetest.SlotMessage(10, 9, 0)); err != nil {
+		t.Fatal(err)
+	}
+	server.SetError("LOADING")
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("flush succeeded")
+	}
+	server.SetError("")
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := server.Stream("solana:slot"); err != nil || len(entries) != 1 {
+		t.Fatalf("%d entries, %v", len(entries), err)
+	}
+}
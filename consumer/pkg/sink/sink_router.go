@@ -0,0 +1,233 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// Actions for RouteConfig.OnError.
+const (
+	RouteErrorFail = "fail"
+	RouteErrorSkip = "skip"
+)
+
+// RouteConfig adds a named sink receiving the messages its filter
+// passes, besides the sink of the sink section, which receives every one.
+type RouteConfig struct {
+	// Name labels the metrics and logs of the route.
+	Name string `json:"name" yaml:"name"`
+	// Kinds are the update kinds the route receives, every kind when empty.
+	Kinds  []string      `json:"kinds" yaml:"kinds"`
+	Filter filter.Config `json:"filter" yaml:"filter"`
+	// OnError is fail to fail the message as a write error of the main sink
+	// does, or skip to log the error and drop the message for this route.
+	OnError string `json:"on_error" yaml:"on_error"`
+	Sink    Config `json:"sink" yaml:"sink"`
+}
+
+// DefaultRouteConfig has the defaults of every sink but no sink type,
+// which the config of a route has to name.
+func DefaultRouteConfig() RouteConfig {
+	config := RouteConfig{OnError: RouteErrorFail, Sink: DefaultConfig()}
+	config.Sink.Type = ""
+	return config
+}
+
+func (c *RouteConfig) UnmarshalJSON(data []byte) error {
+	type plain RouteConfig
+	route := plain(DefaultRouteConfig())
+	if err := json.Unmarshal(data, &route); err != nil {
+		return err
+	}
+	*c = RouteConfig(route)
+	return nil
+}
+
+func (c *RouteConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain RouteConfig
+	route := plain(DefaultRouteConfig())
+	if err := node.Decode(&route); err != nil {
+		return err
+	}
+	*c = RouteConfig(route)
+	return nil
+}
+
+// ValidateRoutes checks the routes, the errors being prefixed by routes[i].
+func ValidateRoutes(routes []RouteConfig) error {
+	names := make(map[string]struct{}, len(routes))
+	for i, route := range routes {
+		if route.Name == "" {
+			return fmt.Errorf("routes[%d].name: must not be empty", i)
+		}
+		if _, ok := names[route.Name]; ok {
+			return fmt.Errorf("routes[%d].name: %q is used twice", i, route.Name)
+		}
+		names[route.Name] = struct{}{}
+		for _, kind := range route.Kinds {
+			if _, err := decode.ParseUpdateKind(kind); err != nil {
+				return fmt.Errorf("routes[%d].kinds: %w", i, err)
+			}
+		}
+		if _, err := filter.New(route.Filter); err != nil {
+			return fmt.Errorf("routes[%d].%w", i, err)
+		}
+		switch route.OnError {
+		case RouteErrorFail, RouteErrorSkip:
+		default:
+			return fmt.Errorf("routes[%d].on_error: expected fail or skip, got %q", i, route.OnError)
+		}
+		if err := route.Sink.Validate(); err != nil {
+			return fmt.Errorf("routes[%d].%w", i, err)
+		}
+		if route.Sink.Type == "postgres" && route.Sink.Postgres.OffsetsTable != "" {
+			return fmt.Errorf("routes[%d].sink.postgres.offsets_table: only the main sink can store the offsets", i)
+		}
+	}
+	return nil
+}
+
+type sinkRoute struct {
+	name   string
+	kinds  []decode.UpdateKind
+	filter *filter.Filter
+	skip   bool
+	sink   Sink
+}
+
+// RouterSink writes every message to the main sink it wraps, and to the
+// routes whose kinds and filter select it, in the order of the routes and
+// before the main sink.
+type RouterSink struct {
+	Sink
+	routes []*sinkRoute
+}
+
+// NewRouterSink creates the sinks of the routes, closing those created when
+// one fails.
+func NewRouterSink(ctx context.Context, next Sink, configs []RouteConfig) (*RouterSink, error) {
+	s := &RouterSink{Sink: next}
+	for _, config := range configs {
+		route := &sinkRoute{name: config.Name, skip: config.OnError == RouteErrorSkip}
+		for _, kind := range config.Kinds {
+			parsed, _ := decode.ParseUpdateKind(kind)
+			route.kinds = append(route.kinds, parsed)
+		}
+		var err error
+		if route.filter, err = filter.New(config.Filter); err == nil {
+			route.sink, err = New(ctx, config.Sink)
+		}
+		if err != nil {
+			for _, created := range s.routes {
+				created.sink.Close()
+			}
+			return nil, fmt.Errorf("route %s: %w", config.Name, err)
+		}
+		s.routes = append(s.routes, route)
+	}
+	return s, nil
+}
+
+// Write counts the sinks holding msg, see Message.Hold, and marks its
+// offset once the last of them completed it.
+func (s *RouterSink) Write(ctx context.Context, msg *decode.Message) error {
+	complete := msg.Complete
+	holds := msg.Holds()
+	// pending is one until every sink was written to
+	var pending atomic.Int32
+	pending.Store(1)
+	msg.Complete = func() {
+		if pending.Add(-1) == 0 && complete != nil {
+			complete()
+		}
+	}
+	defer func() { msg.Complete = complete }()
+
+	for _, route := range s.routes {
+		if !route.match(msg) {
+			continue
+		}
+		if err := route.sink.Write(ctx, msg); err != nil {
+			if !route.skip {
+				return fmt.Errorf("route %s: %w", route.name, err)
+			}
+			metrics.RouteErrorsTotal.WithLabelValues(route.name).Inc()
+			logging.Logger.Warn("route write failed, skipping", append(decode.MessageFields(msg), zap.String("route", route.name), zap.Error(err))...)
+			continue
+		}
+		metrics.RouteMessagesTotal.WithLabelValues(route.name).Inc()
+	}
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	if held := msg.Holds() - holds; held > 0 && pending.Add(held-1) == 0 && complete != nil {
+		complete()
+	}
+	return nil
+}
+
+func (r *sinkRoute) match(msg *decode.Message) bool {
+	if len(r.kinds) > 0 && !slices.Contains(r.kinds, msg.Kind()) {
+		return false
+	}
+	ok, _ := r.filter.Allow(msg)
+	return ok
+}
+
+// Flush flushes the routes, then the main sink.
+func (s *RouterSink) Flush(ctx context.Context) error {
+	for _, route := range s.routes {
+		if err := route.sink.Flush(ctx); err != nil {
+			return fmt.Errorf("route %s: %w", route.name, err)
+		}
+	}
+	return s.Sink.Flush(ctx)
+}
+
+func (s *RouterSink) Close() error {
+	var errs []error
+	for _, route := range s.routes {
+		if err := route.sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", route.name, err))
+		}
+	}
+	errs = append(errs, s.Sink.Close())
+	return errors.Join(errs...)
+}
+
+// NewRouted creates the sink of config wrapped by a RouterSink when
+// there are routes.
+func NewRouted(ctx context.Context, config Config, routes []RouteConfig) (Sink, error) {
+	sink, err := New(ctx, config)
+	if err != nil || len(routes) == 0 {
+		return sink, err
+	}
+	router, err := NewRouterSink(ctx, sink, routes)
+	if err != nil {
+		sink.Close()
+		return nil, err
+	}
+	return router, nil
+}
+
+// RouteNames lists the names of the routes for the logs.
+func RouteNames(routes []RouteConfig) string {
+	names := make([]string, len(routes))
+	for i, route := range routes {
+		names[i] = route.Name
+	}
+	return strings.Join(names, ",")
+}
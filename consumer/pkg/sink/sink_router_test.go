@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/filter"
+	"consumer/proto"
+)
+
+func TestRouterSink(t *testing.T) {
+	main, transactions, program := &sinktest.RecordSink{}, &sinktest.RecordSink{}, &sinktest.RecordSink{Fail: map[uint64]error{12: errors.New("down")}}
+	programs, err := filter.New(filter.Config{ProgramInclude: []string{testkey.String(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RouterSink{Sink: main, routes: []*sinkRoute{
+		{name: "transactions", kinds: []decode.UpdateKind{decode.KindTransaction}, sink: transactions},
+		{name: "program", filter: programs, skip: true, sink: program},
+	}}
+	for _, msg := range []*decode.Message{
+		decodetest.TransactionMessage(10, testkey.Key(1)),
+		decodetest.TransactionMessage(11, testkey.Key(2)),
+		decodetest.TransactionMessage(12, testkey.Key(1)),
+		decodetest.SlotMessage(13, 0, proto.CommitmentLevel_PROCESSED),
+	} {
+		if err := s.Write(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// other kinds pass the program filter, a skipped error does not fail the message
+	if got := main.Slots(); len(got) != 4 {
+		t.Fatalf("main sink got slots %v", got)
+	}
+	if got := transactions.Slots(); len(got) != 3 || got[2] != 12 {
+		t.Fatalf("transactions route got slots %v", got)
+	}
+	if got := program.Slots(); len(got) != 2 || got[0] != 10 || got[1] != 13 {
+		t.Fatalf("program route got slots %v", got)
+	}
+
+	s.routes[1].skip = false
+	if err := s.Write(context.Background(), decodetest.TransactionMessage(12, testkey.Key(1))); err == nil || !strings.Contains(err.Error(), "route program: down") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestRouterSinkHolds(t *testing.T) {
+	main, route := &sinktest.HoldingSink{}, &sinktest.HoldingSink{}
+	s := &RouterSink{Sink: main, routes: []*sinkRoute{{name: "all", sink: route}}}
+	completed := 0
+	msg := decodetest.TransactionMessage(10, testkey.Key(1))
+	msg.Complete = func() { completed++ }
+	if err := s.Write(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Held() || len(main.Held) != 1 || len(route.Held) != 1 {
+		t.Fatalf("held %t by %d and %d", msg.Held(), len(main.Held), len(route.Held))
+	}
+	route.Held[0]()
+	if completed != 0 {
+		t.Fatal("completed while the main sink holds the message")
+	}
+	main.Held[0]()
+	if completed != 1 {
+		t.Fatalf("%d completions", completed)
+	}
+
+	// not held by any sink, the caller completes it
+	plain := &RouterSink{Sink: &sinktest.RecordSink{}, routes: []*sinkRoute{{name: "all", sink: &sinktest.RecordSink{}}}}
+	msg = decodetest.TransactionMessage(11, testkey.Key(1))
+	msg.Complete = func() { completed++ }
+	if err := plain.Write(context.Background(), msg); err != nil || msg.Held() || completed != 1 {
+		t.Fatalf("held %t, %d completions, %v", msg.Held(), completed, err)
+	}
+}
@@ -0,0 +1,322 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+// scyllaMaxBatch caps the statements of an unlogged batch, larger batches
+// trip the batch size warnings of the cluster.
+const scyllaMaxBatch = 100
+
+type ScyllaConfig struct {
+	// Hosts are contact points of the cluster, host:port, the others are
+	// discovered.
+	Hosts    []string `json:"hosts" yaml:"hosts"`
+	Keyspace string   `json:"keyspace" yaml:"keyspace"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password" yaml:"password"`
+	// LocalDC keeps the queries in a datacenter, any datacenter when empty.
+	LocalDC     string `json:"local_dc" yaml:"local_dc"`
+	Consistency string `json:"consistency" yaml:"consistency"`
+	// SignatureTable maps signatures to their slot, block time and status,
+	// AddressTable the accounts to the signatures of their transactions in
+	// partitions of BucketSlots slots, disabled when empty.
+	SignatureTable string `json:"signature_table" yaml:"signature_table"`
+	AddressTable   string `json:"address_table" yaml:"address_table"`
+	BucketSlots    uint64 `json:"bucket_slots" yaml:"bucket_slots"`
+	// Votes writes vote transactions too.
+	Votes         bool              `json:"votes" yaml:"votes"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// Concurrency is the number of statements and batches a flush sends at
+	// once.
+	Concurrency int               `json:"concurrency" yaml:"concurrency"`
+	Timeout     duration.Duration `json:"timeout" yaml:"timeout"`
+	// CreateTable creates the tables on startup when they do not exist, the
+	// keyspace has to.
+	CreateTable bool `json:"create_table" yaml:"create_table"`
+}
+
+func DefaultScyllaConfig() ScyllaConfig {
+	return ScyllaConfig{
+		Hosts:          []string{"127.0.0.1:9042"},
+		Keyspace:       "solana",
+		Consistency:    "local_quorum",
+		SignatureTable: "signatures",
+		AddressTable:   "address_signatures",
+		BucketSlots:    432_000,
+		BatchSize:      1000,
+		FlushInterval:  duration.Duration(time.Second),
+		Concurrency:    64,
+		Timeout:        duration.Duration(10 * time.Second),
+	}
+}
+
+func (c *ScyllaConfig) Validate() error {
+	if len(c.Hosts) == 0 {
+		return errors.New("sink.scylla.hosts: must not be empty")
+	}
+	if c.Keyspace == "" {
+		return errors.New("sink.scylla.keyspace: must not be empty")
+	}
+	if _, err := gocql.ParseConsistencyWrapper(c.Consistency); err != nil {
+		return fmt.Errorf("sink.scylla.consistency: %w", err)
+	}
+	if c.SignatureTable == "" && c.AddressTable == "" {
+		return errors.New("sink.scylla: needs a signature_table or address_table")
+	}
+	if c.BucketSlots == 0 {
+		return errors.New("sink.scylla.bucket_slots: must be positive")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.scylla.batch_size: must be positive")
+	}
+	if c.Concurrency <= 0 {
+		return errors.New("sink.scylla.concurrency: must be positive")
+	}
+	if c.FlushInterval <= 0 || c.Timeout <= 0 {
+		return errors.New("sink.scylla: flush_interval and timeout must be positive")
+	}
+	return nil
+}
+
+// scyllaTables returns the statements creating the enabled tables. The
+// address partitions are listed newest first, as getSignaturesForAddress
+// pages through them.
+func scyllaTables(config ScyllaConfig) []string {
+	var tables []string
+	if config.SignatureTable != "" {
+		tables = append(tables, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			signature text PRIMARY KEY,
+			slot bigint,
+			block_time timestamp,
+			status text,
+			err text
+		)`, scyllaIdentifier(config.SignatureTable)))
+	}
+	if config.AddressTable != "" {
+		tables = append(tables, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			address text,
+			bucket bigint,
+			slot bigint,
+			signature text,
+			PRIMARY KEY ((address, bucket), slot, signature)
+		) WITH CLUSTERING ORDER BY (slot DESC, signature ASC)`, scyllaIdentifier(config.AddressTable)))
+	}
+	return tables
+}
+
+// scyllaIdentifier quotes a table name, a dot separating its keyspace.
+func scyllaIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// scyllaSignature is the row of a transaction in the signature table.
+type scyllaSignature struct {
+	signature string
+	slot      uint64
+	blockTime time.Time
+	// status is success or failed, err the error in the JSON form of the
+	// Solana RPC, nil when the transaction succeeded.
+	status string
+	err    *string
+}
+
+// scyllaAddress is the row of an account of a transaction in the address
+// table.
+type scyllaAddress struct {
+	address   string
+	bucket    uint64
+	slot      uint64
+	signature string
+}
+
+// scyllaRow is a row of either table.
+type scyllaRow struct {
+	signature *scyllaSignature
+	address   *scyllaAddress
+}
+
+// scyllaRows returns the rows of the transactions of msg: a signature row
+// each, and an address row for every account it loads. Transactions are
+// timed by the block when it is known and by the Kafka record otherwise.
+func scyllaRows(msg *decode.Message, config ScyllaConfig) []scyllaRow {
+	at := msg.ProducedAt()
+	if blockTime := msg.Update.GetBlock().GetBlockTime(); blockTime != nil {
+		at = time.Unix(blockTime.GetTimestamp(), 0)
+	}
+	var rows []scyllaRow
+	for _, info := range decode.MessageTransactions(msg) {
+		if info.GetIsVote() && !config.Votes {
+			continue
+		}
+		signature := base58.Encode(info.GetSignature())
+		if config.SignatureTable != "" {
+			row := &scyllaSignature{signature: signature, slot: msg.Slot, blockTime: at, status: "success", err: decode.TransactionErrorJSON(info)}
+			if row.err != nil {
+				row.status = "failed"
+			}
+			rows = append(rows, scyllaRow{signature: row})
+		}
+		if config.AddressTable != "" {
+			for _, account := range decode.TransactionAccounts(info) {
+				row := &scyllaAddress{address: base58.Encode(account), bucket: msg.Slot / config.BucketSlots, slot: msg.Slot, signature: signature}
+				rows = append(rows, scyllaRow{address: row})
+			}
+		}
+	}
+	return rows
+}
+
+// scyllaPartition is the partition key of an address row.
+type scyllaPartition struct {
+	address string
+	bucket  uint64
+}
+
+// ScyllaSink writes the signature history explorers query to Cassandra or
+// ScyllaDB: the slot, block time and status of every signature, and the
+// signatures of every address by slot. Statements are prepared and routed
+// to a replica of their partition, the address rows of a partition are sent
+// in unlogged batches. Writes are upserts, so a batch can be retried after
+// a failure.
+type ScyllaSink struct {
+	session *gocql.Session
+	config  ScyllaConfig
+	rows    *batcher[scyllaRow]
+	// insertSignature and insertAddress insert into the tables, prepared
+	// by the session on their first use.
+	insertSignature string
+	insertAddress   string
+}
+
+func NewScyllaSink(config ScyllaConfig) (*ScyllaSink, error) {
+	cluster := gocql.NewCluster(config.Hosts...)
+	cluster.Keyspace = config.Keyspace
+	cluster.Consistency, _ = gocql.ParseConsistencyWrapper(config.Consistency)
+	cluster.Timeout = time.Duration(config.Timeout)
+	fallback := gocql.RoundRobinHostPolicy()
+	if config.LocalDC != "" {
+		fallback = gocql.DCAwareRoundRobinPolicy(config.LocalDC)
+	}
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(fallback)
+	if config.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: config.Username, Password: config.Password}
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("scylla connect: %w", err)
+	}
+	if config.CreateTable {
+		for _, table := range scyllaTables(config) {
+			if err := session.Query(table).Exec(); err != nil {
+				session.Close()
+				return nil, fmt.Errorf("scylla create table: %w", err)
+			}
+		}
+	}
+	s := &ScyllaSink{
+		session:         session,
+		config:          config,
+		insertSignature: fmt.Sprintf("INSERT INTO %s (signature, slot, block_time, status, err) VALUES (?, ?, ?, ?, ?)", scyllaIdentifier(config.SignatureTable)),
+		insertAddress:   fmt.Sprintf("INSERT INTO %s (address, bucket, slot, signature) VALUES (?, ?, ?, ?)", scyllaIdentifier(config.AddressTable)),
+	}
+	s.rows = newBatcher("scylla", config.BatchSize, time.Duration(config.FlushInterval), s.insert)
+	return s, nil
+}
+
+func (s *ScyllaSink) Write(ctx context.Context, msg *decode.Message) error {
+	switch msg.Kind() {
+	case decode.KindTransaction, decode.KindBlock:
+	default:
+		return nil
+	}
+	for _, row := range scyllaRows(msg, s.config) {
+		if err := s.rows.Add(ctx, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ScyllaSink) Flush(ctx context.Context) error {
+	return s.rows.Flush(ctx)
+}
+
+// insert sends a statement per signature and a batch per address partition,
+// concurrency at a time.
+func (s *ScyllaSink) insert(ctx context.Context, rows []scyllaRow) error {
+	var sends []func() error
+	partitions := make(map[scyllaPartition][]*scyllaAddress)
+	var order []scyllaPartition
+	for _, row := range rows {
+		if r := row.signature; r != nil {
+			query := s.session.Query(s.insertSignature, r.signature, int64(r.slot), r.blockTime, r.status, r.err).WithContext(ctx)
+			sends = append(sends, query.Exec)
+			continue
+		}
+		p := scyllaPartition{row.address.address, row.address.bucket}
+		if partitions[p] == nil {
+			order = append(order, p)
+		}
+		partitions[p] = append(partitions[p], row.address)
+	}
+	for _, p := range order {
+		for chunk := range slices.Chunk(partitions[p], scyllaMaxBatch) {
+			batch := s.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+			for _, r := range chunk {
+				batch.Query(s.insertAddress, r.address, int64(r.bucket), int64(r.slot), r.signature)
+			}
+			sends = append(sends, func() error { return s.session.ExecuteBatch(batch) })
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	inflight := make(chan struct{}, s.config.Concurrency)
+	for _, send := range sends {
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inflight }()
+			if err := send(); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return fmt.Errorf("scylla insert %d rows: %w", len(rows), firstErr)
+	}
+	return nil
+}
+
+func (s *ScyllaSink) Close() error {
+	err := s.rows.Close()
+	s.session.Close()
+	return err
+}
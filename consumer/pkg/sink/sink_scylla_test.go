@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/proto"
+)
+
+func TestScyllaRows(t *testing.T) {
+	produced := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := DefaultScyllaConfig()
+	config.BucketSlots = 100
+	msg := decodetest.TransactionMessage(250, testkey.Key(9), testkey.Key(1))
+	msg.Timestamp = produced
+	rows := scyllaRows(msg, config)
+	if len(rows) != 3 || rows[0].signature == nil || rows[1].address == nil {
+		t.Fatalf("rows %+v", rows)
+	}
+	if sig := rows[0].signature; sig.signature != testkey.String(0xff) || sig.slot != 250 || !sig.blockTime.Equal(produced) ||
+		sig.status != "success" || sig.err != nil {
+		t.Fatalf("signature %+v", sig)
+	}
+	if address := rows[2].address; address.address != testkey.String(9) || address.bucket != 2 || address.signature != testkey.String(0xff) {
+		t.Fatalf("address %+v", address)
+	}
+
+	msg.Update.GetTransaction().GetTransaction().Meta.Err = &proto.TransactionError{Err: []byte{1, 0, 0, 0}}
+	if sig := scyllaRows(msg, config)[0].signature; sig.status != "failed" || sig.err == nil {
+		t.Fatalf("failed signature %+v", sig)
+	}
+	config.SignatureTable = ""
+	if rows := scyllaRows(msg, config); len(rows) != 2 {
+		t.Fatalf("address rows %+v", rows)
+	}
+	msg.Update.GetTransaction().GetTransaction().IsVote = true
+	if rows := scyllaRows(msg, config); len(rows) != 0 {
+		t.Fatalf("vote rows %+v", rows)
+	}
+}
+
+func TestScyllaTablesQuoteNames(t *testing.T) {
+	config := DefaultScyllaConfig()
+	config.SignatureTable, config.AddressTable = "history.signatures", `by"address`
+	tables := scyllaTables(config)
+	for i, want := range []string{`"history"."signatures" (`, `"by""address" (`} {
+		if !strings.Contains(tables[i], "CREATE TABLE IF NOT EXISTS "+want) {
+			t.Errorf("statement %d does not create %s:\n%s", i, want, tables[i])
+		}
+	}
+	config.Consistency = "most"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sink.scylla.consistency") {
+		t.Fatalf("got %v", err)
+	}
+}
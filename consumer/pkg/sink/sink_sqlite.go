@@ -0,0 +1,330 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+)
+
+type SQLiteConfig struct {
+	// Path is the database file, created when missing.
+	Path  string `json:"path" yaml:"path"`
+	Table string `json:"table" yaml:"table"`
+	// AccountTable and SlotTable receive account and slot updates, which
+	// are ignored when the table is empty.
+	AccountTable  string            `json:"account_table" yaml:"account_table"`
+	SlotTable     string            `json:"slot_table" yaml:"slot_table"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// CreateTable creates the tables and their slot indexes on startup when
+	// they do not exist.
+	CreateTable bool `json:"create_table" yaml:"create_table"`
+	// PruneSlots deletes the rows this many slots behind the newest slot
+	// written with every batch, none when 0.
+	PruneSlots uint64 `json:"prune_slots" yaml:"prune_slots"`
+}
+
+func DefaultSQLiteConfig() SQLiteConfig {
+	return SQLiteConfig{
+		Table:         "transactions",
+		BatchSize:     1000,
+		FlushInterval: duration.Duration(time.Second),
+	}
+}
+
+func (c *SQLiteConfig) Validate() error {
+	if c.Path == "" {
+		return errors.New("sink.sqlite.path: must not be empty")
+	}
+	if c.Table == "" {
+		return errors.New("sink.sqlite.table: must not be empty")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.sqlite.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("sink.sqlite.flush_interval: must be positive")
+	}
+	return nil
+}
+
+// sqliteTables lists the enabled tables, the transaction table first. The
+// lists of a transaction are JSON arrays, for json_each.
+func sqliteTables(config SQLiteConfig) []postgresTable {
+	tables := []postgresTable{{
+		name:      config.Table,
+		statement: postgresInsertTransaction,
+		create: `CREATE TABLE IF NOT EXISTS %s (
+			signature TEXT NOT NULL,
+			slot INTEGER NOT NULL,
+			accounts TEXT NOT NULL,
+			err BLOB,
+			logs TEXT,
+			rolled_back INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (signature, slot)
+		) WITHOUT ROWID`,
+		insert: `INSERT INTO %s (signature, slot, accounts, err, logs) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+	}}
+	if config.AccountTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.AccountTable,
+			statement: postgresInsertAccount,
+			// rent_epoch is text as u64::MAX, that of rent exempt accounts,
+			// does not fit an INTEGER
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				pubkey TEXT NOT NULL,
+				slot INTEGER NOT NULL,
+				lamports INTEGER NOT NULL,
+				owner TEXT NOT NULL,
+				executable INTEGER NOT NULL,
+				rent_epoch TEXT NOT NULL,
+				data BLOB NOT NULL,
+				write_version INTEGER NOT NULL,
+				txn_signature TEXT,
+				rolled_back INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (pubkey, slot, write_version)
+			) WITHOUT ROWID`,
+			insert: `INSERT INTO %s (pubkey, slot, lamports, owner, executable, rent_epoch, data, write_version, txn_signature)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		})
+	}
+	if config.SlotTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.SlotTable,
+			statement: postgresInsertSlot,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				slot INTEGER NOT NULL,
+				parent INTEGER,
+				status TEXT NOT NULL,
+				dead_error TEXT,
+				PRIMARY KEY (slot, status)
+			) WITHOUT ROWID`,
+			insert: `INSERT INTO %s (slot, parent, status, dead_error) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		})
+	}
+	return tables
+}
+
+// sqliteRecord is the row of a message for any of the tables.
+type sqliteRecord struct {
+	transaction *decode.TransactionRow
+	account     *accountRow
+	slot        *slotRow
+}
+
+// SQLiteSink batches transactions, and optionally accounts and slots, into
+// the tables of a single SQLite file in WAL mode, for development machines
+// and small indexers. Every batch is inserted in one transaction, ignoring
+// rows that already exist so a batch can be retried after a failure.
+type SQLiteSink struct {
+	db *sql.DB
+	// inserts are the insert statements of the enabled tables by name.
+	inserts map[string]*sql.Stmt
+	records *batcher[sqliteRecord]
+	// tables are the quoted names of the enabled tables, rollbackTables
+	// those whose rows of a slot are rolled back.
+	tables         []string
+	rollbackTables []string
+	pruneSlots     uint64
+	// newest is the newest slot written, by insert, which the batcher runs
+	// one batch at a time.
+	newest uint64
+}
+
+func NewSQLiteSink(ctx context.Context, config SQLiteConfig) (*SQLiteSink, error) {
+	// the pragmas apply to every connection of the pool
+	dsn := "file:" + (&url.URL{Path: config.Path}).EscapedPath() +
+		"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite open %s: %w", config.Path, err)
+	}
+	// SQLite has a single writer, more connections would only wait for it
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteSink{db: db, inserts: make(map[string]*sql.Stmt), pruneSlots: config.PruneSlots}
+	for _, table := range sqliteTables(config) {
+		name := sqliteIdentifier(table.name)
+		if config.CreateTable {
+			if err := s.createTable(ctx, table, name); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		insert, err := db.PrepareContext(ctx, fmt.Sprintf(table.insert, name))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite prepare insert into %s: %w", table.name, err)
+		}
+		s.inserts[table.statement] = insert
+		s.tables = append(s.tables, name)
+		if table.statement != postgresInsertSlot {
+			s.rollbackTables = append(s.rollbackTables, name)
+		}
+	}
+	s.records = newBatcher("sqlite", config.BatchSize, time.Duration(config.FlushInterval), s.insert)
+	return s, nil
+}
+
+// createTable creates table and the index on its slot, which pruning and
+// rollbacks select by.
+func (s *SQLiteSink) createTable(ctx context.Context, table postgresTable, name string) error {
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(table.create, name)); err != nil {
+		return fmt.Errorf("sqlite create table %s: %w", table.name, err)
+	}
+	index := sqliteIdentifier(table.name + "_slot")
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (slot)", index, name)); err != nil {
+		return fmt.Errorf("sqlite create index on %s: %w", table.name, err)
+	}
+	return nil
+}
+
+func sqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (s *SQLiteSink) Write(ctx context.Context, msg *decode.Message) error {
+	var record sqliteRecord
+	switch msg.Kind() {
+	case decode.KindTransaction:
+		row, ok := decode.NewTransactionRow(msg)
+		if !ok {
+			return nil
+		}
+		record.transaction = &row
+	case decode.KindAccount:
+		row, ok := newAccountRow(msg)
+		if !ok || s.inserts[postgresInsertAccount] == nil {
+			return nil
+		}
+		record.account = &row
+	case decode.KindSlot:
+		row, ok := newSlotRow(msg)
+		if !ok || s.inserts[postgresInsertSlot] == nil {
+			return nil
+		}
+		record.slot = &row
+	default:
+		return nil
+	}
+	return s.records.Add(ctx, record)
+}
+
+func (s *SQLiteSink) Flush(ctx context.Context) error {
+	return s.records.Flush(ctx)
+}
+
+// insert inserts the rows of every table and prunes the old slots in one
+// transaction.
+func (s *SQLiteSink) insert(ctx context.Context, records []sqliteRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := make(map[string]*sql.Stmt, len(s.inserts))
+	for name, insert := range s.inserts {
+		statements[name] = tx.StmtContext(ctx, insert)
+	}
+	newest := s.newest
+	for _, record := range records {
+		switch {
+		case record.transaction != nil:
+			r := record.transaction
+			newest = max(newest, r.Slot)
+			accounts, _ := json.Marshal(r.Accounts)
+			var logs []byte
+			if r.Logs != nil {
+				logs, _ = json.Marshal(r.Logs)
+			}
+			_, err = statements[postgresInsertTransaction].ExecContext(ctx, r.Signature, int64(r.Slot), string(accounts), r.Err, nullString(string(logs)))
+		case record.account != nil:
+			r := record.account
+			newest = max(newest, r.slot)
+			// nil would be NULL
+			data := r.data
+			if data == nil {
+				data = []byte{}
+			}
+			_, err = statements[postgresInsertAccount].ExecContext(ctx, r.pubkey, int64(r.slot), int64(r.lamports), r.owner, r.executable,
+				strconv.FormatUint(r.rentEpoch, 10), data, int64(r.writeVersion), nullString(r.txnSignature))
+		case record.slot != nil:
+			r := record.slot
+			newest = max(newest, r.slot)
+			var parent *int64
+			if r.parent != nil {
+				p := int64(*r.parent)
+				parent = &p
+			}
+			_, err = statements[postgresInsertSlot].ExecContext(ctx, int64(r.slot), parent, r.status, nullString(r.deadError))
+		}
+		if err != nil {
+			return fmt.Errorf("sqlite insert %d rows: %w", len(records), err)
+		}
+	}
+	if s.pruneSlots > 0 && newest > s.pruneSlots {
+		for _, table := range s.tables {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE slot < ?", table), int64(newest-s.pruneSlots)); err != nil {
+				return fmt.Errorf("sqlite prune %s: %w", table, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqlite insert %d rows: %w", len(records), err)
+	}
+	s.newest = newest
+	return nil
+}
+
+// nullString turns an empty string into NULL.
+func nullString(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+// RollbackSlots writes the pending rows out, then deletes the transactions
+// and accounts of slots or marks them rolled back, in one transaction.
+func (s *SQLiteSink) RollbackSlots(ctx context.Context, slots []uint64, mark bool) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite begin: %w", err)
+	}
+	defer tx.Rollback()
+	for _, table := range s.rollbackTables {
+		statement := "DELETE FROM %s WHERE slot = ?"
+		if mark {
+			statement = "UPDATE %s SET rolled_back = 1 WHERE slot = ?"
+		}
+		for _, slot := range slots {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(statement, table), int64(slot)); err != nil {
+				return fmt.Errorf("sqlite roll back %d slots: %w", len(slots), err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqlite roll back %d slots: %w", len(slots), err)
+	}
+	return nil
+}
+
+func (s *SQLiteSink) Close() error {
+	err := s.records.Close()
+	for _, insert := range s.inserts {
+		insert.Close()
+	}
+	return errors.Join(err, s.db.Close())
+}
@@ -0,0 +1,80 @@
+package sink
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	config := DefaultSQLiteConfig()
+	config.Path = filepath.Join(t.TempDir(), "solana.db")
+	config.AccountTable, config.SlotTable = "accounts", "slots"
+	config.CreateTable = true
+	config.PruneSlots = 100
+	ctx := context.Background()
+	s, err := NewSQLiteSink(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tx := decodetest.TransactionMessage(10, testkey.Key(1), testkey.Key(2))
+	tx.Update.GetTransaction().GetTransaction().Meta.LogMessages = []string{"Program log: hi"}
+	for _, msg := range []*decode.Message{tx, tx, decodetest.AccountMessage(10, testkey.Key(3), testkey.Key(1)), decodetest.SlotMessage(10, 9, proto.CommitmentLevel_CONFIRMED),
+		decodetest.TransactionMessage(11, testkey.Key(1)), {Slot: 11, Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{
+			BlockMeta: &proto.SubscribeUpdateBlockMeta{Slot: 11},
+		}}}} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	count := func(table string) (n int) {
+		if err := s.db.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count("transactions"); n != 2 {
+		t.Fatalf("%d transactions", n)
+	}
+	var accounts, logs, rentEpoch string
+	if err := s.db.QueryRow(`SELECT t.accounts, t.logs, a.rent_epoch FROM transactions t JOIN accounts a USING (slot)
+		WHERE t.slot = 10`).Scan(&accounts, &logs, &rentEpoch); err != nil {
+		t.Fatal(err)
+	}
+	if want := `["` + testkey.String(2) + `","` + testkey.String(1) + `"]`; accounts != want || logs != `["Program log: hi"]` || rentEpoch != "0" {
+		t.Fatalf("accounts %s, logs %s, rent epoch %s", accounts, logs, rentEpoch)
+	}
+	var status string
+	if err := s.db.QueryRow("SELECT status FROM slots WHERE slot = 10 AND parent = 9").Scan(&status); err != nil || status != "confirmed" {
+		t.Fatalf("status %q, %v", status, err)
+	}
+
+	if err := s.RollbackSlots(ctx, []uint64{11}, true); err != nil {
+		t.Fatal(err)
+	}
+	var rolledBack int
+	if err := s.db.QueryRow("SELECT rolled_back FROM transactions WHERE slot = 11").Scan(&rolledBack); err != nil || rolledBack != 1 {
+		t.Fatalf("rolled back %d, %v", rolledBack, err)
+	}
+
+	// slot 10 falls 100 slots behind
+	if err := s.Write(ctx, decodetest.TransactionMessage(111, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, accounts, slots := count("transactions"), count("accounts"), count("slots"); n != 2 || accounts != 0 || slots != 0 {
+		t.Fatalf("%d transactions, %d accounts and %d slots after pruning", n, accounts, slots)
+	}
+}
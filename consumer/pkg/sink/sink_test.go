@@ -0,0 +1,56 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestNDJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	s := &NDJSONSink{w: &out}
+	msg := decodetest.TransactionMessage(10, testkey.Key(1))
+	msg.Topic, msg.Partition, msg.Offset = "updates", 2, 7
+	ctx := context.Background()
+	if err := s.Write(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, decodetest.SlotMessage(11, 10, proto.CommitmentLevel_CONFIRMED)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines %q", lines)
+	}
+	var record struct {
+		Kind      decode.UpdateKind `json:"kind"`
+		Partition int32             `json:"partition"`
+		Offset    int64             `json:"offset"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Kind != decode.KindTransaction || record.Partition != 2 || record.Offset != 7 {
+		t.Fatalf("record %+v", record)
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,430 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+// Names of the statements prepared on every pool connection.
+const (
+	timescaleInsertSlot        = "insert_slot_metrics"
+	timescaleInsertTransaction = "insert_transaction_metrics"
+	timescaleInsertBalance     = "insert_balance_delta"
+)
+
+type TimescaleConfig struct {
+	DSN string `json:"dsn" yaml:"dsn"`
+	// SlotTable, TransactionTable and BalanceTable are the hypertables of
+	// the block metrics, transaction metrics and balance deltas, each
+	// disabled when empty.
+	SlotTable        string `json:"slot_table" yaml:"slot_table"`
+	TransactionTable string `json:"transaction_table" yaml:"transaction_table"`
+	BalanceTable     string `json:"balance_table" yaml:"balance_table"`
+	// Votes writes the metrics and balance deltas of vote transactions too.
+	Votes         bool              `json:"votes" yaml:"votes"`
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// CreateTable creates the tables on startup when they do not exist and
+	// turns them into hypertables with chunks of ChunkInterval, dropped
+	// after Retention when set.
+	CreateTable   bool              `json:"create_table" yaml:"create_table"`
+	ChunkInterval duration.Duration `json:"chunk_interval" yaml:"chunk_interval"`
+	Retention     duration.Duration `json:"retention" yaml:"retention"`
+}
+
+func DefaultTimescaleConfig() TimescaleConfig {
+	return TimescaleConfig{
+		SlotTable:        "slot_metrics",
+		TransactionTable: "transaction_metrics",
+		BalanceTable:     "balance_deltas",
+		BatchSize:        1000,
+		FlushInterval:    duration.Duration(time.Second),
+		ChunkInterval:    duration.Duration(time.Hour),
+	}
+}
+
+func (c *TimescaleConfig) Validate() error {
+	if c.DSN == "" {
+		return errors.New("sink.timescale.dsn: must not be empty")
+	}
+	if c.SlotTable == "" && c.TransactionTable == "" && c.BalanceTable == "" {
+		return errors.New("sink.timescale: needs a slot_table, transaction_table or balance_table")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.timescale.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("sink.timescale.flush_interval: must be positive")
+	}
+	if c.ChunkInterval <= 0 {
+		return errors.New("sink.timescale.chunk_interval: must be positive")
+	}
+	if c.Retention < 0 {
+		return errors.New("sink.timescale.retention: must not be negative")
+	}
+	return nil
+}
+
+// timescaleTables lists the enabled tables. Unique keys of a hypertable have
+// to contain its time column.
+func timescaleTables(config TimescaleConfig) []postgresTable {
+	var tables []postgresTable
+	if config.SlotTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.SlotTable,
+			statement: timescaleInsertSlot,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				time timestamptz NOT NULL,
+				slot bigint NOT NULL,
+				parent_slot bigint NOT NULL,
+				block_height bigint,
+				transactions bigint NOT NULL,
+				entries bigint NOT NULL,
+				rolled_back boolean NOT NULL DEFAULT false,
+				PRIMARY KEY (slot, time)
+			)`,
+			insert: `INSERT INTO %s (time, slot, parent_slot, block_height, transactions, entries)
+				VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+		})
+	}
+	if config.TransactionTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.TransactionTable,
+			statement: timescaleInsertTransaction,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				time timestamptz NOT NULL,
+				slot bigint NOT NULL,
+				signature text NOT NULL,
+				fee bigint NOT NULL,
+				compute_units bigint,
+				unit_price bigint,
+				failed boolean NOT NULL,
+				vote boolean NOT NULL,
+				rolled_back boolean NOT NULL DEFAULT false,
+				PRIMARY KEY (signature, time)
+			)`,
+			insert: `INSERT INTO %s (time, slot, signature, fee, compute_units, unit_price, failed, vote)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING`,
+		})
+	}
+	if config.BalanceTable != "" {
+		tables = append(tables, postgresTable{
+			name:      config.BalanceTable,
+			statement: timescaleInsertBalance,
+			create: `CREATE TABLE IF NOT EXISTS %s (
+				time timestamptz NOT NULL,
+				slot bigint NOT NULL,
+				signature text NOT NULL,
+				account text NOT NULL,
+				mint text NOT NULL,
+				owner text,
+				pre numeric(20) NOT NULL,
+				post numeric(20) NOT NULL,
+				change numeric(21) NOT NULL,
+				rolled_back boolean NOT NULL DEFAULT false,
+				PRIMARY KEY (signature, account, mint, time)
+			)`,
+			insert: `INSERT INTO %s (time, slot, signature, account, mint, owner, pre, post, change)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING`,
+		})
+	}
+	return tables
+}
+
+// timescaleSlotRow holds the metrics of a block.
+type timescaleSlotRow struct {
+	time         time.Time
+	slot         uint64
+	parentSlot   uint64
+	blockHeight  *uint64
+	transactions uint64
+	entries      uint64
+}
+
+// timescaleTransactionRow holds the metrics of a transaction.
+type timescaleTransactionRow struct {
+	time         time.Time
+	slot         uint64
+	signature    string
+	fee          uint64
+	computeUnits *uint64
+	unitPrice    *uint64
+	failed       bool
+	vote         bool
+}
+
+// timescaleBalanceRow is one balance change of a transaction, of lamports
+// when mint is empty.
+type timescaleBalanceRow struct {
+	time      time.Time
+	slot      uint64
+	signature string
+	change    decode.BalanceChange
+}
+
+// timescaleRow is a row of any of the tables.
+type timescaleRow struct {
+	slot        *timescaleSlotRow
+	transaction *timescaleTransactionRow
+	balance     *timescaleBalanceRow
+}
+
+// timescaleRows returns the rows of msg: a block metrics row for blocks and
+// block metas, and a metrics row and balance deltas for every transaction.
+// Transactions are timed by the block when it is known and by the Kafka
+// record otherwise, a record written again keeps its time so inserting it
+// again is a no-op.
+func timescaleRows(msg *decode.Message, votes bool) []timescaleRow {
+	at := msg.ProducedAt()
+	var rows []timescaleRow
+	var block interface {
+		GetBlockTime() *proto.UnixTimestamp
+		GetBlockHeight() *proto.BlockHeight
+		GetParentSlot() uint64
+		GetExecutedTransactionCount() uint64
+		GetEntriesCount() uint64
+	}
+	if meta := msg.Update.GetBlockMeta(); meta != nil {
+		block = meta
+	} else if b := msg.Update.GetBlock(); b != nil {
+		block = b
+	}
+	if block != nil {
+		if blockTime := block.GetBlockTime(); blockTime != nil {
+			at = time.Unix(blockTime.GetTimestamp(), 0)
+		}
+		row := &timescaleSlotRow{
+			time:         at,
+			slot:         msg.Slot,
+			parentSlot:   block.GetParentSlot(),
+			transactions: block.GetExecutedTransactionCount(),
+			entries:      block.GetEntriesCount(),
+		}
+		if height := block.GetBlockHeight(); height != nil {
+			blockHeight := height.GetBlockHeight()
+			row.blockHeight = &blockHeight
+		}
+		rows = append(rows, timescaleRow{slot: row})
+	}
+
+	for _, info := range decode.MessageTransactions(msg) {
+		if info.GetIsVote() && !votes {
+			continue
+		}
+		meta := info.GetMeta()
+		signature := base58.Encode(info.GetSignature())
+		row := &timescaleTransactionRow{
+			time:         at,
+			slot:         msg.Slot,
+			signature:    signature,
+			fee:          meta.GetFee(),
+			computeUnits: meta.ComputeUnitsConsumed,
+			failed:       meta.GetErr() != nil,
+			vote:         info.GetIsVote(),
+		}
+		if budget, ok := decode.DecodeComputeBudget(info); ok {
+			row.unitPrice = budget.UnitPrice
+		}
+		rows = append(rows, timescaleRow{transaction: row})
+		for _, change := range decode.BalanceChanges(info) {
+			rows = append(rows, timescaleRow{balance: &timescaleBalanceRow{time: at, slot: msg.Slot, signature: signature, change: change}})
+		}
+	}
+	return rows
+}
+
+// TimescaleSink writes per-block and per-transaction metrics and balance
+// deltas to TimescaleDB hypertables, for dashboards over chain activity.
+// Other updates are ignored. Inserts ignore rows that already exist so a
+// batch can be retried after a failure.
+type TimescaleSink struct {
+	pool  *pgxpool.Pool
+	rows  *batcher[timescaleRow]
+	votes bool
+	// enabled are the statements of the enabled tables.
+	enabled map[string]bool
+	// tables are the names of the enabled tables.
+	tables []string
+}
+
+func NewTimescaleSink(ctx context.Context, config TimescaleConfig) (*TimescaleSink, error) {
+	tables := timescaleTables(config)
+
+	if config.CreateTable {
+		conn, err := pgx.Connect(ctx, config.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("timescale connect: %w", err)
+		}
+		for _, table := range tables {
+			if err = createHypertable(ctx, conn, table, config); err != nil {
+				break
+			}
+		}
+		conn.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("timescale dsn: %w", err)
+	}
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for _, table := range tables {
+			if _, err := conn.Prepare(ctx, table.statement, fmt.Sprintf(table.insert, postgresIdentifier(table.name))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("timescale connect: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("timescale connect: %w", err)
+	}
+
+	s := &TimescaleSink{pool: pool, votes: config.Votes, enabled: make(map[string]bool)}
+	for _, table := range tables {
+		s.enabled[table.statement] = true
+		s.tables = append(s.tables, table.name)
+	}
+	s.rows = newBatcher("timescale", config.BatchSize, time.Duration(config.FlushInterval), s.insert)
+	return s, nil
+}
+
+// createHypertable creates table as a hypertable on its time column, with
+// the retention policy of config.
+func createHypertable(ctx context.Context, conn *pgx.Conn, table postgresTable, config TimescaleConfig) error {
+	name := postgresIdentifier(table.name)
+	if _, err := conn.Exec(ctx, fmt.Sprintf(table.create, name)); err != nil {
+		return fmt.Errorf("timescale create table %s: %w", table.name, err)
+	}
+	chunk := time.Duration(config.ChunkInterval).Seconds()
+	if _, err := conn.Exec(ctx, `SELECT create_hypertable($1::regclass, 'time',
+		chunk_time_interval => make_interval(secs => $2), if_not_exists => true)`, name, chunk); err != nil {
+		return fmt.Errorf("timescale create hypertable %s: %w", table.name, err)
+	}
+	if config.Retention > 0 {
+		retention := time.Duration(config.Retention).Seconds()
+		if _, err := conn.Exec(ctx, `SELECT add_retention_policy($1::regclass, make_interval(secs => $2), if_not_exists => true)`,
+			name, retention); err != nil {
+			return fmt.Errorf("timescale add retention policy %s: %w", table.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *TimescaleSink) Write(ctx context.Context, msg *decode.Message) error {
+	switch msg.Kind() {
+	case decode.KindTransaction, decode.KindBlock, decode.KindBlockMeta:
+	default:
+		return nil
+	}
+	for _, row := range timescaleRows(msg, s.votes) {
+		if !s.enabled[row.statement()] {
+			continue
+		}
+		if err := s.rows.Add(ctx, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statement returns the insert statement of the row.
+func (r timescaleRow) statement() string {
+	switch {
+	case r.slot != nil:
+		return timescaleInsertSlot
+	case r.transaction != nil:
+		return timescaleInsertTransaction
+	}
+	return timescaleInsertBalance
+}
+
+func (s *TimescaleSink) Flush(ctx context.Context) error {
+	return s.rows.Flush(ctx)
+}
+
+func (s *TimescaleSink) insert(ctx context.Context, rows []timescaleRow) error {
+	batch := &pgx.Batch{}
+	for _, row := range rows {
+		switch {
+		case row.slot != nil:
+			r := row.slot
+			batch.Queue(timescaleInsertSlot, r.time, int64(r.slot), int64(r.parentSlot), r.blockHeight, int64(r.transactions), int64(r.entries))
+		case row.transaction != nil:
+			r := row.transaction
+			batch.Queue(timescaleInsertTransaction, r.time, int64(r.slot), r.signature, int64(r.fee), r.computeUnits, r.unitPrice, r.failed, r.vote)
+		case row.balance != nil:
+			r := row.balance
+			var owner *string
+			if r.change.Owner != "" {
+				owner = &r.change.Owner
+			}
+			batch.Queue(timescaleInsertBalance, r.time, int64(r.slot), r.signature, r.change.Account, r.change.Mint, owner,
+				pgNumeric(new(big.Int).SetUint64(r.change.Pre)), pgNumeric(new(big.Int).SetUint64(r.change.Post)), pgNumeric(r.change.Change))
+		}
+	}
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	if err != nil {
+		return fmt.Errorf("timescale insert %d rows: %w", len(rows), err)
+	}
+	return nil
+}
+
+// pgNumeric encodes an integer of any size for a numeric column.
+func pgNumeric(v *big.Int) pgtype.Numeric {
+	return pgtype.Numeric{Int: v, Valid: true}
+}
+
+// RollbackSlots writes the pending rows out, then deletes the rows of slots
+// or marks them rolled back, in one transaction.
+func (s *TimescaleSink) RollbackSlots(ctx context.Context, slots []uint64, mark bool) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	values := make([]int64, len(slots))
+	for i, slot := range slots {
+		values[i] = int64(slot)
+	}
+	batch := &pgx.Batch{}
+	for _, table := range s.tables {
+		statement := "DELETE FROM %s WHERE slot = ANY($1)"
+		if mark {
+			statement = "UPDATE %s SET rolled_back = true WHERE slot = ANY($1)"
+		}
+		batch.Queue(fmt.Sprintf(statement, postgresIdentifier(table)), values)
+	}
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	if err != nil {
+		return fmt.Errorf("timescale roll back %d slots: %w", len(slots), err)
+	}
+	return nil
+}
+
+func (s *TimescaleSink) Close() error {
+	err := s.rows.Close()
+	s.pool.Close()
+	return err
+}
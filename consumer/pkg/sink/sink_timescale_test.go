@@ -0,0 +1,64 @@
+package sink
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestTimescaleRows(t *testing.T) {
+	produced := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := decodetest.TransactionMessage(10, testkey.Key(9), testkey.Key(1), testkey.Key(2))
+	msg.Timestamp = produced
+	meta := msg.Update.GetTransaction().GetTransaction().Meta
+	meta.Fee, meta.PreBalances, meta.PostBalances = 5000, []uint64{100, 7, 1}, []uint64{40, 62, 1}
+	rows := timescaleRows(msg, false)
+	if len(rows) != 3 || rows[0].transaction == nil || rows[1].balance == nil {
+		t.Fatalf("rows %+v", rows)
+	}
+	tx := rows[0].transaction
+	if tx.signature != testkey.String(0xff) || tx.slot != 10 || tx.fee != 5000 || !tx.time.Equal(produced) || tx.failed {
+		t.Fatalf("transaction %+v", tx)
+	}
+	if balance := rows[2].balance; balance.change.Account != testkey.String(2) || balance.change.Change.Int64() != 55 ||
+		rows[2].statement() != timescaleInsertBalance {
+		t.Fatalf("balance %+v", balance)
+	}
+
+	msg.Update.GetTransaction().GetTransaction().IsVote = true
+	if rows := timescaleRows(msg, false); len(rows) != 0 {
+		t.Fatalf("vote rows %+v", rows)
+	}
+
+	block := &decode.Message{Slot: 11, Timestamp: produced, Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{
+		BlockMeta: &proto.SubscribeUpdateBlockMeta{
+			Slot: 11, ParentSlot: 10, ExecutedTransactionCount: 1200, EntriesCount: 64,
+			BlockTime:   &proto.UnixTimestamp{Timestamp: 1714564800},
+			BlockHeight: &proto.BlockHeight{BlockHeight: 99},
+		},
+	}}}
+	rows = timescaleRows(block, false)
+	if len(rows) != 1 || rows[0].slot == nil {
+		t.Fatalf("block rows %+v", rows)
+	}
+	if slot := rows[0].slot; slot.parentSlot != 10 || slot.transactions != 1200 || *slot.blockHeight != 99 || slot.time.Unix() != 1714564800 {
+		t.Fatalf("slot %+v", slot)
+	}
+}
+
+func TestTimescaleConfigValidate(t *testing.T) {
+	config := DefaultTimescaleConfig()
+	config.DSN = "postgres://localhost/solana"
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.SlotTable, config.TransactionTable, config.BalanceTable = "", "", ""
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sink.timescale") {
+		t.Fatalf("got %v", err)
+	}
+}
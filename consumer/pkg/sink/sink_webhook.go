@@ -0,0 +1,327 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// WebhookConfig posts the updates to an HTTP endpoint, such as a serverless
+// function.
+type WebhookConfig struct {
+	URL string `json:"url" yaml:"url"`
+	// Headers are sent with every request, e.g. an Authorization header.
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// Secret signs every request with HMAC-SHA256, see webhookSignature.
+	// Requests are not signed when empty.
+	Secret string `json:"secret" yaml:"secret"`
+	// Template replaces the JSON object of every update by what it renders,
+	// see OutputTemplate, such as the payload of a chat message. Updates it
+	// renders empty are not posted. The Content-Type stays that of JSON
+	// unless set in Headers.
+	Template string `json:"template" yaml:"template"`
+	// BatchSize is the number of updates per request. One posts every
+	// update as a JSON object, more post NDJSON.
+	BatchSize     int               `json:"batch_size" yaml:"batch_size"`
+	FlushInterval duration.Duration `json:"flush_interval" yaml:"flush_interval"`
+	Timeout       duration.Duration `json:"timeout" yaml:"timeout"`
+	// MaxRetries is how many times a request is retried after a network
+	// error, a 429 or a 5xx, waiting RetryBackoff and doubling it up to
+	// MaxBackoff between attempts. A Retry-After header takes precedence.
+	MaxRetries   int               `json:"max_retries" yaml:"max_retries"`
+	RetryBackoff duration.Duration `json:"retry_backoff" yaml:"retry_backoff"`
+	MaxBackoff   duration.Duration `json:"max_backoff" yaml:"max_backoff"`
+	// The circuit opens after BreakerThreshold requests failed in a row,
+	// failing writes without calling the endpoint until BreakerCooldown
+	// passed and a trial request succeeded. Zero disables the breaker.
+	BreakerThreshold int               `json:"breaker_threshold" yaml:"breaker_threshold"`
+	BreakerCooldown  duration.Duration `json:"breaker_cooldown" yaml:"breaker_cooldown"`
+}
+
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		BatchSize:        100,
+		FlushInterval:    duration.Duration(time.Second),
+		Timeout:          duration.Duration(10 * time.Second),
+		MaxRetries:       5,
+		RetryBackoff:     duration.Duration(200 * time.Millisecond),
+		MaxBackoff:       duration.Duration(10 * time.Second),
+		BreakerThreshold: 5,
+		BreakerCooldown:  duration.Duration(30 * time.Second),
+	}
+}
+
+func (c *WebhookConfig) Validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("sink.webhook.url: expected an http or https URL, got %q", c.URL)
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("sink.webhook.batch_size: must be positive")
+	}
+	if c.FlushInterval <= 0 || c.Timeout <= 0 {
+		return errors.New("sink.webhook: flush_interval and timeout must be positive")
+	}
+	if c.MaxRetries < 0 || c.BreakerThreshold < 0 {
+		return errors.New("sink.webhook: max_retries and breaker_threshold must not be negative")
+	}
+	if c.RetryBackoff < 0 || c.MaxBackoff < c.RetryBackoff {
+		return errors.New("sink.webhook: max_backoff must be at least retry_backoff")
+	}
+	if c.BreakerThreshold > 0 && c.BreakerCooldown <= 0 {
+		return errors.New("sink.webhook.breaker_cooldown: must be positive")
+	}
+	if c.Template != "" {
+		return validateOutputTemplate("sink.webhook.template", c.Template)
+	}
+	return nil
+}
+
+// Headers of the signed requests.
+const (
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// errCircuitOpen fails writes while the endpoint is considered down.
+var errCircuitOpen = errors.New("webhook circuit open")
+
+// webhookUpdate is the JSON object posted for every update.
+type webhookUpdate struct {
+	Kind      decode.UpdateKind `json:"kind"`
+	Slot      uint64            `json:"slot"`
+	Topic     string            `json:"topic"`
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Update    json.RawMessage   `json:"update"`
+}
+
+// webhookSignature is the value of the signature header: the hex HMAC-SHA256
+// of the timestamp header, a dot and the body, so a receiver can reject
+// replayed requests by their timestamp.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSink posts updates in batches, a flush returns once the endpoint
+// accepted them with a 2xx.
+type WebhookSink struct {
+	config   WebhookConfig
+	template *OutputTemplate
+	client   *http.Client
+	batch    *batcher[[]byte]
+	breaker  *circuitBreaker
+}
+
+func NewWebhookSink(config WebhookConfig) (*WebhookSink, error) {
+	s := &WebhookSink{
+		config:  config,
+		client:  &http.Client{Timeout: time.Duration(config.Timeout)},
+		breaker: newCircuitBreaker(config.BreakerThreshold, time.Duration(config.BreakerCooldown)),
+	}
+	if config.Template != "" {
+		var err error
+		if s.template, err = ParseOutputTemplate(config.Template); err != nil {
+			return nil, err
+		}
+	}
+	s.batch = newBatcher("webhook", config.BatchSize, time.Duration(config.FlushInterval), s.post)
+	return s, nil
+}
+
+func (s *WebhookSink) Write(ctx context.Context, msg *decode.Message) error {
+	if s.template != nil {
+		body, err := s.template.Render(msg)
+		if err != nil || body == nil {
+			return err
+		}
+		return s.batch.Add(ctx, body)
+	}
+	update, err := decode.FormatJSON(msg.Update)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(webhookUpdate{
+		Kind:      msg.Kind(),
+		Slot:      msg.Slot,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Headers:   msg.Headers,
+		Update:    update,
+	})
+	if err != nil {
+		return err
+	}
+	return s.batch.Add(ctx, body)
+}
+
+func (s *WebhookSink) Flush(ctx context.Context) error {
+	return s.batch.Flush(ctx)
+}
+
+func (s *WebhookSink) Close() error {
+	return s.batch.Close()
+}
+
+func (s *WebhookSink) post(ctx context.Context, rows [][]byte) error {
+	contentType := "application/json"
+	body := rows[0]
+	if s.config.BatchSize > 1 {
+		contentType = "application/x-ndjson"
+		body = append(bytes.Join(rows, []byte("\n")), '\n')
+	}
+
+	backoff := time.Duration(s.config.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		if !s.breaker.allow() {
+			return errCircuitOpen
+		}
+		retryAfter, err := s.send(ctx, contentType, body)
+		s.breaker.record(err == nil)
+		var permanent *webhookPermanentError
+		if err == nil || attempt >= s.config.MaxRetries || errors.As(err, &permanent) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := backoff
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		logging.Logger.Warn("webhook request failed, retrying",
+			zap.Int("updates", len(rows)), zap.Int("attempt", attempt+1), zap.Duration("backoff", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, time.Duration(s.config.MaxBackoff))
+	}
+}
+
+// webhookPermanentError is a response not worth retrying.
+type webhookPermanentError struct {
+	status int
+	body   string
+}
+
+func (e *webhookPermanentError) Error() string {
+	return fmt.Sprintf("webhook rejected the request: %d %s", e.status, e.body)
+}
+
+// send posts body once. It returns the delay asked for by a Retry-After
+// header along with the error of a failed request.
+func (s *WebhookSink) send(ctx context.Context, contentType string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range s.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if s.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, webhookSignature(s.config.Secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		metrics.WebhookRequestsTotal.WithLabelValues("error").Inc()
+		return 0, err
+	}
+	defer resp.Body.Close()
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	metrics.WebhookRequestsTotal.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = min(time.Duration(seconds)*time.Second, time.Duration(s.config.MaxBackoff))
+		}
+		return retryAfter, fmt.Errorf("webhook returned %d %s", resp.StatusCode, bytes.TrimSpace(text))
+	}
+	return 0, &webhookPermanentError{status: resp.StatusCode, body: string(bytes.TrimSpace(text))}
+}
+
+// circuitBreaker stops calling an endpoint that keeps failing. After
+// threshold failures in a row it opens for cooldown, then lets one trial
+// request through, whose outcome closes or reopens it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 || b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 {
+		return
+	}
+	b.trial = false
+	if ok {
+		if b.failures >= b.threshold {
+			logging.Logger.Info("webhook circuit closed")
+		}
+		b.failures = 0
+		metrics.WebhookCircuitOpen.Set(0)
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			logging.Logger.Warn("webhook circuit opened", zap.Int("failures", b.failures), zap.Duration("cooldown", b.cooldown))
+		}
+		b.openedAt = time.Now()
+		metrics.WebhookCircuitOpen.Set(1)
+	}
+}
@@ -0,0 +1,262 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/proto"
+)
+
+// webhookServer answers the requests with the queued statuses, 200 once they
+// ran out, and keeps the requests.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.headers = append(s.headers, r.Header.Clone())
+		s.bodies = append(s.bodies, body)
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func newTestWebhookSink(t *testing.T, url string, batchSize int) *WebhookSink {
+	t.Helper()
+	config := DefaultWebhookConfig()
+	config.URL, config.BatchSize, config.FlushInterval = url, batchSize, duration.Duration(time.Hour)
+	config.RetryBackoff, config.MaxBackoff = duration.Duration(time.Millisecond), duration.Duration(time.Millisecond)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewWebhookSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestWebhookSinkSigned(t *testing.T) {
+	server := newWebhookServer(t)
+	s := newTestWebhookSink(t, server.URL, 1)
+	s.config.Secret = "secret"
+	s.config.Headers = map[string]string{"Authorization": "Bearer token"}
+
+	ctx := context.Background()
+	if err := s.Write(ctx, decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests() != 1 {
+		t.Fatalf("%d requests, want 1", server.requests())
+	}
+	header, body := server.headers[0], server.bodies[0]
+	if header.Get("Content-Type") != "application/json" || header.Get("Authorization") != "Bearer token" {
+		t.Fatalf("headers %v", header)
+	}
+	want := webhookSignature("secret", header.Get(webhookTimestampHeader), body)
+	if header.Get(webhookTimestampHeader) == "" || header.Get(webhookSignatureHeader) != want {
+		t.Fatalf("signature %q, want %q", header.Get(webhookSignatureHeader), want)
+	}
+	var update webhookUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Kind != decode.KindTransaction || update.Slot != 10 || len(update.Update) == 0 {
+		t.Fatalf("update %+v", update)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	got := webhookSignature("secret", "1700000000", []byte("{}"))
+	if got != "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+	server := newWebhookServer(t)
+	s := newTestWebhookSink(t, server.URL, 3)
+	ctx := context.Background()
+
+	for _, msg := range []*decode.Message{decodetest.TransactionMessage(10, testkey.Key(1)), decodetest.AccountMessage(11, testkey.Key(2), testkey.Key(3)), decodetest.SlotMessage(12, 11, 0)} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Write(ctx, decodetest.TransactionMessage(13, testkey.Key(3))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests() != 2 || server.headers[0].Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("%d requests, headers %v", server.requests(), server.headers)
+	}
+	var kinds []decode.UpdateKind
+	lines := bufio.NewScanner(bytes.NewReader(server.bodies[0]))
+	for lines.Scan() {
+		var update webhookUpdate
+		if err := json.Unmarshal(lines.Bytes(), &update); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, update.Kind)
+	}
+	if len(kinds) != 3 || kinds[0] != decode.KindTransaction || kinds[1] != decode.KindAccount || kinds[2] != decode.KindSlot {
+		t.Fatalf("kinds %v", kinds)
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	server := newWebhookServer(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	s := newTestWebhookSink(t, server.URL, 1)
+
+	ctx := context.Background()
+	if err := s.Write(ctx, decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests() != 3 {
+		t.Fatalf("%d requests, want 3", server.requests())
+	}
+}
+
+func TestWebhookSinkPermanentFailure(t *testing.T) {
+	server := newWebhookServer(t, http.StatusBadRequest)
+	s := newTestWebhookSink(t, server.URL, 1)
+
+	ctx := context.Background()
+	if err := s.Write(ctx, decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	var permanent *webhookPermanentError
+	if err := s.Flush(ctx); !errors.As(err, &permanent) || permanent.status != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400", err)
+	}
+	if server.requests() != 1 {
+		t.Fatalf("%d requests, want 1", server.requests())
+	}
+}
+
+func TestWebhookSinkCircuitBreaker(t *testing.T) {
+	server := newWebhookServer(t, 500, 500, 500, 500)
+	s := newTestWebhookSink(t, server.URL, 1)
+	s.config.MaxRetries = 1
+	s.breaker = newCircuitBreaker(3, 50*time.Millisecond)
+	ctx := context.Background()
+	if err := s.Write(ctx, decodetest.TransactionMessage(10, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// two requests, then the third failure opens the circuit
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("flush succeeded")
+	}
+	if err := s.Flush(ctx); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("got %v, want %v", err, errCircuitOpen)
+	}
+	if server.requests() != 3 {
+		t.Fatalf("%d requests, want 3", server.requests())
+	}
+
+	// the trial fails and reopens the circuit
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Flush(ctx); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("got %v, want %v", err, errCircuitOpen)
+	}
+	if server.requests() != 4 {
+		t.Fatalf("%d requests, want 4", server.requests())
+	}
+
+	// the trial succeeds and closes it, the failed update is kept for it
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, decodetest.TransactionMessage(11, testkey.Key(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests() != 6 || !bytes.Equal(server.bodies[0], server.bodies[4]) {
+		t.Fatalf("%d requests", server.requests())
+	}
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	config := DefaultWebhookConfig()
+	if err := config.Validate(); err == nil {
+		t.Fatal("validated without an URL")
+	}
+	config.URL = "https://example.com/hook"
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxBackoff = duration.Duration(time.Millisecond)
+	if err := config.Validate(); err == nil {
+		t.Fatal("validated max_backoff below retry_backoff")
+	}
+}
+
+func TestWebhookSinkTemplate(t *testing.T) {
+	server := newWebhookServer(t)
+	s := newTestWebhookSink(t, server.URL, 1)
+	var err error
+	if s.template, err = ParseOutputTemplate(`{{if eq .kind "transaction"}}{"text":"slot {{.slot}}"}{{end}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, msg := range []*decode.Message{decodetest.SlotMessage(9, 8, proto.CommitmentLevel_PROCESSED), decodetest.TransactionMessage(10, testkey.Key(1))} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests() != 1 || string(server.bodies[0]) != `{"text":"slot 10"}` {
+		t.Fatalf("bodies %q", server.bodies)
+	}
+}
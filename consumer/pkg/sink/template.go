@@ -0,0 +1,122 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"text/template"
+
+	"consumer/pkg/decode"
+)
+
+// templateFuncs are the functions an output template can call besides the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// json renders a value, such as a whole update or an instruction list,
+	// as compact JSON.
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// int converts a number of the update to an int64, for comparisons
+	// such as {{if gt (int .update.transaction.transaction.meta.fee) 5000}}.
+	"int": func(v any) (int64, error) {
+		switch n := v.(type) {
+		case json.Number:
+			return n.Int64()
+		case nil:
+			return 0, nil
+		}
+		return 0, fmt.Errorf("int: expected a number, got %T", v)
+	},
+	// sol renders a number of lamports in SOL.
+	"sol": func(v any) (string, error) {
+		n, ok := v.(json.Number)
+		if !ok {
+			return "", fmt.Errorf("sol: expected a number, got %T", v)
+		}
+		lamports, ok := new(big.Int).SetString(n.String(), 10)
+		if !ok {
+			return "", fmt.Errorf("sol: expected lamports, got %s", n)
+		}
+		if lamports.Sign() < 0 {
+			return "-" + formatAmount(lamports, 9), nil
+		}
+		return formatAmount(lamports, 9), nil
+	},
+	// default returns fallback when v is missing or empty.
+	"default": func(fallback, v any) any {
+		if v == nil || v == "" {
+			return fallback
+		}
+		return v
+	},
+	"join": func(sep string, values []any) string {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, sep)
+	},
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"trim":     strings.TrimSpace,
+	"replace":  strings.ReplaceAll,
+	"contains": strings.Contains,
+}
+
+// OutputTemplate renders every message through a text/template. The
+// template sees the message as the JSON object of FormatRecordJSON, so
+// {{.slot}} and {{.update.transaction.transaction.signature}} are what jq
+// would select from the ndjson output, numbers keeping every digit.
+type OutputTemplate struct {
+	template *template.Template
+}
+
+// ParseOutputTemplate parses the text of an output template, failing on
+// unknown functions and syntax errors.
+func ParseOutputTemplate(text string) (*OutputTemplate, error) {
+	t, err := template.New("output").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &OutputTemplate{template: t}, nil
+}
+
+// validateOutputTemplate checks the template of a sink set to format
+// template, field naming it in the error.
+func validateOutputTemplate(field, text string) error {
+	if text == "" {
+		return fmt.Errorf("%s: must not be empty", field)
+	}
+	if _, err := ParseOutputTemplate(text); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return nil
+}
+
+// Render returns the output of msg without a trailing newline. Messages the
+// template renders as nothing but white space, such as those failing an
+// {{if}}, return nil and are meant to be skipped.
+func (t *OutputTemplate) Render(msg *decode.Message) ([]byte, error) {
+	record, err := decode.FormatRecordJSON(msg)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	decoder.UseNumber()
+	var data map[string]any
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := t.template.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out.Bytes())) == 0 {
+		return nil, nil
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
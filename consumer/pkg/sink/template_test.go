@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestOutputTemplate(t *testing.T) {
+	tmpl, err := ParseOutputTemplate(`{{if eq .kind "transaction"}}{{.slot}} {{.update.transaction.transaction.signature}}` +
+		` {{sol .update.transaction.transaction.meta.fee}}{{if gt (int .update.transaction.transaction.meta.fee) 5000}} high{{end}}` +
+		` {{default "-" .headers.source}}{{end}}` + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decodetest.TransactionMessage(10, testkey.Key(1))
+	msg.Update.GetTransaction().GetTransaction().Meta.Fee = 12_500
+	got, err := tmpl.Render(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10 " + testkey.String(0xff) + " 0.0000125 high -"; string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// skipped by the {{if}}
+	if got, err := tmpl.Render(decodetest.SlotMessage(11, 10, proto.CommitmentLevel_CONFIRMED)); got != nil || err != nil {
+		t.Fatalf("slot rendered %q, %v", got, err)
+	}
+}
+
+func TestTemplateSink(t *testing.T) {
+	tmpl, err := ParseOutputTemplate(`{{if eq .kind "slot"}}slot {{.slot}} at offset {{.offset}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	s := &TemplateSink{w: &out, template: tmpl}
+	ctx := context.Background()
+	for _, msg := range []*decode.Message{decodetest.TransactionMessage(10, testkey.Key(1)), decodetest.SlotMessage(11, 10, proto.CommitmentLevel_PROCESSED)} {
+		msg.Offset = 3
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "slot 11 at offset 3\n" {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestValidateOutputTemplate(t *testing.T) {
+	config := StdoutConfig{Format: "template"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sink.stdout.template: must not be empty") {
+		t.Fatalf("got %v", err)
+	}
+	config.Template = "{{nope .slot}}"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), `function "nope" not defined`) {
+		t.Fatalf("got %v", err)
+	}
+}
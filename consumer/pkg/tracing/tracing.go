@@ -0,0 +1,155 @@
+// Package tracing holds the OpenTelemetry tracer of the consumer, the spans of
+// the consumed records and the tracing section of its configuration.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer uses the global provider, a no-op until NewTracerProvider installs
+// the OTLP one.
+var Tracer = otel.Tracer("consumer")
+
+type Config struct {
+	// Enable exports spans over OTLP.
+	Enable bool `json:"enable" yaml:"enable"`
+	// Protocol is grpc or http.
+	Protocol string `json:"protocol" yaml:"protocol"`
+	// Endpoint is the collector host:port, the OTEL_EXPORTER_OTLP_* variables
+	// apply when it is empty.
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	Insecure bool   `json:"insecure" yaml:"insecure"`
+	// SampleRatio is the share of traces started here that are sampled,
+	// traces continued from a record header keep the producer's decision.
+	SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio"`
+	ServiceName string  `json:"service_name" yaml:"service_name"`
+}
+
+func (c *Config) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.Protocol != "grpc" && c.Protocol != "http" {
+		return fmt.Errorf("tracing.protocol: expected grpc or http, got %q", c.Protocol)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return errors.New("tracing.sample_ratio: must be between 0 and 1")
+	}
+	if c.ServiceName == "" {
+		return errors.New("tracing.service_name: must not be empty")
+	}
+	return nil
+}
+
+// NewTracerProvider installs an OTLP exporting provider and the W3C
+// propagators globally. Shutting it down flushes the pending spans.
+func NewTracerProvider(ctx context.Context, config Config) (*sdktrace.TracerProvider, error) {
+	var client otlptrace.Client
+	switch config.Protocol {
+	case "grpc":
+		var options []otlptracegrpc.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(options...)
+	default:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(options...)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(config.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider, nil
+}
+
+// HeaderCarrier exposes the headers of a consumed record to propagators.
+type HeaderCarrier []*sarama.RecordHeader
+
+func (c HeaderCarrier) Get(key string) string {
+	for _, header := range c {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Set is unused, consumed records are read only.
+func (c HeaderCarrier) Set(string, string) {}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, len(c))
+	for i, header := range c {
+		keys[i] = string(header.Key)
+	}
+	return keys
+}
+
+// StartConsumeSpan starts the span covering one record, continuing the trace
+// found in its headers, if any.
+func StartConsumeSpan(ctx context.Context, group string, message *sarama.ConsumerMessage) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier(message.Headers))
+	return Tracer.Start(ctx, message.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(message.Topic),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(int(message.Partition))),
+			semconv.MessagingKafkaMessageOffset(int(message.Offset)),
+			semconv.MessagingKafkaMessageKey(string(message.Key)),
+			semconv.MessagingKafkaConsumerGroup(group),
+			semconv.MessagingMessageBodySize(len(message.Value)),
+		))
+}
+
+// EndSpan records err, if any, and ends span.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func SlotAttribute(slot uint64) attribute.KeyValue {
+	return attribute.Int64("solana.slot", int64(slot))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mr-tron/base58"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// Limits of the transactions listed for an address.
+const (
+	queryDefaultLimit = 20
+	queryMaxLimit     = 1000
+)
+
+type QueryConfig struct {
+	// Address is the listen address of the query API, disabled when empty.
+	Address string `json:"address" yaml:"address"`
+	// Token is the bearer token every request has to carry, none when empty.
+	Token string `json:"token" yaml:"token"`
+	// Slots are the newest slots whose transactions are kept in memory.
+	Slots int `json:"slots" yaml:"slots"`
+	// Votes keeps the vote transactions too.
+	Votes bool `json:"votes" yaml:"votes"`
+}
+
+func (c *QueryConfig) Validate() error {
+	if c.Address == "" {
+		return nil
+	}
+	if c.Slots <= 0 {
+		return errors.New("query.slots: must be positive")
+	}
+	return nil
+}
+
+// queryTransaction is a transaction kept by a RecentStore, in the format of
+// the json stdout sink.
+type queryTransaction struct {
+	Signature   string          `json:"signature"`
+	Slot        uint64          `json:"slot"`
+	Index       uint64          `json:"index"`
+	Transaction json.RawMessage `json:"transaction"`
+
+	accounts []string
+}
+
+// RecentStore keeps the transactions of the newest slots written, alone or
+// in a block, and serves them by signature, by slot and by the accounts they
+// reference. Transactions are encoded when written, the messages are
+// recycled once written.
+type RecentStore struct {
+	slotCount int
+	votes     bool
+	token     string
+
+	mu sync.RWMutex
+	// slots are the slots kept in ascending order, with their transactions in
+	// the order they were written.
+	slots        []uint64
+	transactions map[uint64][]*queryTransaction
+	bySignature  map[string]*queryTransaction
+	// byAddress are the transactions referencing an account, oldest first.
+	byAddress map[string][]*queryTransaction
+}
+
+func NewRecentStore(config QueryConfig) *RecentStore {
+	return &RecentStore{
+		slotCount:    config.Slots,
+		votes:        config.Votes,
+		token:        config.Token,
+		transactions: make(map[uint64][]*queryTransaction),
+		bySignature:  make(map[string]*queryTransaction),
+		byAddress:    make(map[string][]*queryTransaction),
+	}
+}
+
+// Publish keeps the transactions of msg. Those of a slot older than all the
+// slots kept, once there are QueryConfig.Slots of them, are dropped.
+func (s *RecentStore) Publish(msg *decode.Message) {
+	transactions := decode.MessageTransactions(msg)
+	if len(transactions) == 0 {
+		return
+	}
+	var kept []*queryTransaction
+	for _, info := range transactions {
+		if info.GetIsVote() && !s.votes {
+			continue
+		}
+		value, err := decode.FormatJSON(info)
+		if err != nil {
+			logging.Logger.Warn("failed to encode transaction for the query API", append(decode.MessageFields(msg), zap.Error(err))...)
+			continue
+		}
+		tx := &queryTransaction{Signature: base58.Encode(info.GetSignature()), Slot: msg.Slot, Index: info.GetIndex(), Transaction: value}
+		for _, key := range decode.TransactionAccounts(info) {
+			tx.accounts = append(tx.accounts, base58.Encode(key))
+		}
+		kept = append(kept, tx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, found := slices.BinarySearch(s.slots, msg.Slot)
+	if !found {
+		if len(s.slots) >= s.slotCount && at == 0 {
+			return
+		}
+		s.slots = slices.Insert(s.slots, at, msg.Slot)
+	}
+	for _, tx := range kept {
+		if _, ok := s.bySignature[tx.Signature]; ok {
+			continue
+		}
+		s.transactions[msg.Slot] = append(s.transactions[msg.Slot], tx)
+		s.bySignature[tx.Signature] = tx
+		for _, account := range tx.accounts {
+			s.byAddress[account] = append(s.byAddress[account], tx)
+		}
+	}
+	for len(s.slots) > s.slotCount {
+		s.evict(s.slots[0])
+		s.slots = s.slots[1:]
+	}
+	metrics.QueryTransactions.Set(float64(len(s.bySignature)))
+}
+
+// evict forgets the transactions of slot.
+func (s *RecentStore) evict(slot uint64) {
+	for _, tx := range s.transactions[slot] {
+		delete(s.bySignature, tx.Signature)
+		for _, account := range tx.accounts {
+			list := slices.DeleteFunc(s.byAddress[account], func(t *queryTransaction) bool { return t.Slot == slot })
+			if len(list) == 0 {
+				delete(s.byAddress, account)
+			} else {
+				s.byAddress[account] = list
+			}
+		}
+	}
+	delete(s.transactions, slot)
+}
+
+// RunQueryServer serves the query API of s on config.Address in the
+// background.
+func RunQueryServer(config QueryConfig, s *RecentStore) error {
+	return serveHTTP("query", config.Address, s.Handler())
+}
+
+// Handler returns the endpoints of the API.
+func (s *RecentStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tx/{signature}", s.authorized("tx", s.transaction))
+	mux.HandleFunc("GET /slot/{slot}", s.authorized("slot", s.slot))
+	mux.HandleFunc("GET /address/{pubkey}/recent", s.authorized("address", s.address))
+	return mux
+}
+
+// authorized counts the requests of endpoint and answers 401 to those
+// without the bearer token, when there is one.
+func (s *RecentStore) authorized(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.QueryRequestsTotal.WithLabelValues(endpoint).Inc()
+		if s.token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAdmin(w, http.StatusUnauthorized, adminError{"invalid token"})
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (s *RecentStore) transaction(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	tx := s.bySignature[r.PathValue("signature")]
+	s.mu.RUnlock()
+	if tx == nil {
+		writeAdmin(w, http.StatusNotFound, adminError{"transaction not in the recent slots"})
+		return
+	}
+	writeAdmin(w, http.StatusOK, tx)
+}
+
+type querySlot struct {
+	Slot         uint64              `json:"slot"`
+	Transactions []*queryTransaction `json:"transactions"`
+}
+
+// slot lists the transactions of a slot by their index in it.
+func (s *RecentStore) slot(w http.ResponseWriter, r *http.Request) {
+	slot, err := strconv.ParseUint(r.PathValue("slot"), 10, 64)
+	if err != nil {
+		writeAdmin(w, http.StatusBadRequest, adminError{"invalid slot"})
+		return
+	}
+	s.mu.RLock()
+	_, found := slices.BinarySearch(s.slots, slot)
+	transactions := slices.Clone(s.transactions[slot])
+	s.mu.RUnlock()
+	if !found {
+		writeAdmin(w, http.StatusNotFound, adminError{"slot not in the recent slots"})
+		return
+	}
+	slices.SortStableFunc(transactions, func(a, b *queryTransaction) int { return cmp.Compare(a.Index, b.Index) })
+	writeAdmin(w, http.StatusOK, querySlot{Slot: slot, Transactions: transactions})
+}
+
+type queryAddress struct {
+	Address      string              `json:"address"`
+	Transactions []*queryTransaction `json:"transactions"`
+}
+
+// address lists the newest transactions referencing an account, limit of
+// them, newest first.
+func (s *RecentStore) address(w http.ResponseWriter, r *http.Request) {
+	address := r.PathValue("pubkey")
+	limit := queryDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > queryMaxLimit {
+			writeAdmin(w, http.StatusBadRequest, adminError{"limit: must be in [1, " + strconv.Itoa(queryMaxLimit) + "]"})
+			return
+		}
+		limit = n
+	}
+	s.mu.RLock()
+	transactions := slices.Clone(s.byAddress[address])
+	s.mu.RUnlock()
+	slices.SortStableFunc(transactions, func(a, b *queryTransaction) int {
+		return cmp.Or(cmp.Compare(b.Slot, a.Slot), cmp.Compare(b.Index, a.Index))
+	})
+	transactions = transactions[:min(len(transactions), limit)]
+	writeAdmin(w, http.StatusOK, queryAddress{Address: address, Transactions: transactions})
+}
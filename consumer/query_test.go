@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+)
+
+// queryTransactionMessage returns the transaction signature at index of slot
+// referencing the account n.
+func queryTransactionMessage(slot uint64, signature byte, index uint64, n byte) *decode.Message {
+	msg := decodetest.TransactionMessage(slot, testkey.Key(9), testkey.Key(n))
+	info := msg.Update.GetTransaction().GetTransaction()
+	info.Signature, info.Index = testkey.Key(signature), index
+	return msg
+}
+
+// signatures returns the signatures of the transactions of a response.
+func signatures(response map[string]any) []string {
+	var out []string
+	transactions, _ := response["transactions"].([]any)
+	for _, tx := range transactions {
+		out = append(out, tx.(map[string]any)["signature"].(string))
+	}
+	return out
+}
+
+func TestRecentStore(t *testing.T) {
+	store := NewRecentStore(QueryConfig{Slots: 2, Token: "secret"})
+	vote := queryTransactionMessage(11, 5, 1, 2)
+	vote.Update.GetTransaction().GetTransaction().IsVote = true
+	for _, msg := range []*decode.Message{
+		queryTransactionMessage(10, 1, 1, 1),
+		queryTransactionMessage(10, 2, 0, 1),
+		// written again after a retry
+		queryTransactionMessage(10, 2, 0, 1),
+		queryTransactionMessage(11, 3, 0, 1),
+		vote,
+	} {
+		store.Publish(msg)
+	}
+	server := httptest.NewServer(store.Handler())
+	defer server.Close()
+
+	if code, _ := adminRequest(t, server, http.MethodGet, "/slot/10", "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("got %d without token", code)
+	}
+	code, response := adminRequest(t, server, http.MethodGet, "/slot/10", "secret", "")
+	if got := signatures(response); code != http.StatusOK || len(got) != 2 || got[0] != testkey.String(2) {
+		t.Fatalf("slot: %d %v", code, response)
+	}
+	code, response = adminRequest(t, server, http.MethodGet, "/tx/"+testkey.String(3), "secret", "")
+	if code != http.StatusOK || response["slot"] != float64(11) || response["transaction"] == nil {
+		t.Fatalf("tx: %d %v", code, response)
+	}
+	if code, _ := adminRequest(t, server, http.MethodGet, "/tx/"+testkey.String(5), "secret", ""); code != http.StatusNotFound {
+		t.Fatalf("vote kept, %d", code)
+	}
+	code, response = adminRequest(t, server, http.MethodGet, "/address/"+testkey.String(1)+"/recent?limit=2", "secret", "")
+	if got := signatures(response); code != http.StatusOK || len(got) != 2 || got[0] != testkey.String(3) || got[1] != testkey.String(1) {
+		t.Fatalf("address: %d %v", code, response)
+	}
+	if code, _ := adminRequest(t, server, http.MethodGet, "/address/"+testkey.String(1)+"/recent?limit=0", "secret", ""); code != http.StatusBadRequest {
+		t.Fatalf("limit 0 accepted, %d", code)
+	}
+
+	// slot 10 is evicted, then a slot older than those kept is dropped
+	store.Publish(queryTransactionMessage(12, 4, 0, 1))
+	store.Publish(queryTransactionMessage(9, 6, 0, 1))
+	if code, _ := adminRequest(t, server, http.MethodGet, "/slot/10", "secret", ""); code != http.StatusNotFound {
+		t.Fatalf("evicted slot: %d", code)
+	}
+	if code, _ := adminRequest(t, server, http.MethodGet, "/tx/"+testkey.String(6), "secret", ""); code != http.StatusNotFound {
+		t.Fatalf("old slot kept: %d", code)
+	}
+	code, response = adminRequest(t, server, http.MethodGet, "/address/"+testkey.String(1)+"/recent", "secret", "")
+	if got := signatures(response); len(got) != 2 || len(store.bySignature) != 2 {
+		t.Fatalf("address after eviction: %d %v", code, response)
+	}
+}
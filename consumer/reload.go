@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/duration"
+	"consumer/pkg/filter"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// ReloadConfig reloads the config file while consuming, see Reloader. A
+// SIGHUP reloads it regardless of Watch.
+type ReloadConfig struct {
+	// Watch reloads the file when its size or modification time changed,
+	// checked every Interval.
+	Watch    bool              `json:"watch" yaml:"watch"`
+	Interval duration.Duration `json:"interval" yaml:"interval"`
+}
+
+func DefaultReloadConfig() ReloadConfig {
+	return ReloadConfig{Interval: duration.Duration(5 * time.Second)}
+}
+
+func (c *ReloadConfig) Validate() error {
+	if c.Watch && c.Interval <= 0 {
+		return errors.New("reload.interval: must be positive")
+	}
+	return nil
+}
+
+// Reloader applies a reloaded config to the running consumer without
+// leaving the group: the log level, the filter, the rates of
+// processing.throttle and the rules of alerts. Other changes need a restart,
+// they are logged and left out. A config failing to load or validate, or
+// changing what cannot change while running, such as enabling a throttle,
+// is rejected as a whole and the running one stays.
+type Reloader struct {
+	source  *configSource
+	handler *consumer.Handler
+	// alerts is nil without alerts.rules at startup.
+	alerts *AlertSink
+
+	mu sync.Mutex
+	// running is the config in effect, the startup one with the changes
+	// reloaded.
+	running *Config
+}
+
+func NewReloader(source *configSource, running *Config, handler *consumer.Handler, alerts *AlertSink) *Reloader {
+	return &Reloader{source: source, handler: handler, alerts: alerts, running: running}
+}
+
+// Reload loads the config again and applies it, or returns why it was
+// rejected.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next, err := r.source.Load()
+	if err == nil {
+		err = r.apply(next)
+	}
+	if err != nil {
+		metrics.ConfigReloadsTotal.WithLabelValues("rejected").Inc()
+		return err
+	}
+	metrics.ConfigReloadsTotal.WithLabelValues("applied").Inc()
+	return nil
+}
+
+func (r *Reloader) apply(next *Config) error {
+	// everything is checked before anything is applied
+	level, err := zapcore.ParseLevel(next.Log.Level)
+	if err != nil {
+		return err
+	}
+	filter, err := filter.New(next.Filter)
+	if err != nil {
+		return err
+	}
+	if err := r.handler.Throttle().CheckReload(next.Processing.Throttle); err != nil {
+		return err
+	}
+	applyAlerts, err := r.alerts.prepareReload(next.Alerts)
+	if err != nil {
+		return err
+	}
+
+	logging.Level.SetLevel(level)
+	r.handler.SetFilter(filter)
+	r.handler.Throttle().SetRates(next.Processing.Throttle)
+	applyAlerts()
+
+	running := *r.running
+	running.Log.Level = next.Log.Level
+	running.Filter = next.Filter
+	running.Processing.Throttle = next.Processing.Throttle
+	running.Alerts.Rules = next.Alerts.Rules
+	if sections := restartNeeded(&running, next); len(sections) > 0 {
+		logging.Logger.Warn("config changes need a restart, they are left out", zap.Strings("sections", sections))
+	}
+	r.running = &running
+	return nil
+}
+
+// restartNeeded returns the top-level sections of the config that differ.
+func restartNeeded(running, next *Config) []string {
+	var sections []string
+	a, b := reflect.ValueOf(running).Elem(), reflect.ValueOf(next).Elem()
+	for i := range a.NumField() {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			sections = append(sections, a.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return sections
+}
+
+// Run reloads the config on SIGHUP and, with config.Watch, when the file
+// changes, until ctx is done.
+func (r *Reloader) Run(ctx context.Context, config ReloadConfig) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var changes <-chan time.Time
+	path := *r.source.path
+	stamp := fileStamp(path)
+	if config.Watch && path != "" {
+		ticker := time.NewTicker(time.Duration(config.Interval))
+		defer ticker.Stop()
+		changes = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			r.reload("sighup")
+		case <-changes:
+			if next := fileStamp(path); next != stamp {
+				stamp = next
+				r.reload("file changed")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(trigger string) {
+	if err := r.Reload(); err != nil {
+		logging.Logger.Error("config reload rejected, the running config stays", zap.String("trigger", trigger), zap.Error(err))
+		return
+	}
+	logging.Logger.Info("config reloaded", zap.String("trigger", trigger))
+}
+
+// fileVersion identifies a version of a file by its size and modification
+// time.
+type fileVersion struct {
+	size    int64
+	modTime int64
+}
+
+// fileStamp returns the version of the file at path, zero when it cannot be
+// read.
+func fileStamp(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/consumer"
+	"consumer/pkg/duration"
+	"consumer/pkg/logging"
+)
+
+func TestReloader(t *testing.T) {
+	defer logging.Level.SetLevel(logging.Level.Level())
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+processing:
+  throttle:
+    messages_per_second: 100
+    max_inflight: 10
+`)
+	source := &configSource{path: &path, overrides: RegisterOverrides(flag.NewFlagSet("test", flag.ContinueOnError))}
+	config, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := consumer.NewHandler(consumer.HandlerConfig{Processing: config.Processing})
+	r := NewReloader(source, config, handler, nil)
+
+	// the filter, the log level and the rates change, the brokers need a restart
+	write(`
+log:
+  level: debug
+kafka:
+  brokers: [kafka:9092]
+filter:
+  exclude_vote: true
+processing:
+  throttle:
+    bytes_per_second: 1000
+    max_inflight: 10
+`)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Filter() == nil || logging.Level.Level() != zapcore.DebugLevel {
+		t.Fatalf("filter %v, level %s", handler.Filter(), logging.Level.Level())
+	}
+	if got := strings.Join(restartNeeded(config, r.running), ","); got != "processing,filter,log" {
+		t.Fatalf("sections reloaded %s", got)
+	}
+	if r.running.Kafka.Brokers[0] != "localhost:9092" {
+		t.Fatalf("running brokers %v", r.running.Kafka.Brokers)
+	}
+
+	// rejected configs leave everything as it is
+	filter := handler.Filter()
+	for _, test := range []struct {
+		config string
+		want   string
+	}{
+		{"filter: [", "load config"},
+		{"filter:\n  program_include: [short]", "filter.program_include"},
+		{"processing:\n  throttle:\n    max_inflight: 20", "max_inflight: changing it needs a restart"},
+		{"processing:\n  throttle:\n    max_inflight: 10\nalerts:\n  rules: [{name: big, min_sol: 1000, destinations: [ops]}]\n  destinations: [{name: ops, type: slack, url: https://hooks.slack.com/x}]", "alerts: were disabled at startup"},
+	} {
+		write(test.config)
+		if err := r.Reload(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %s", err, test.want)
+		}
+	}
+	if handler.Filter() != filter || logging.Level.Level() != zapcore.DebugLevel {
+		t.Fatal("a rejected config was applied")
+	}
+
+	// a change of the file is picked up with reload.watch
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx, ReloadConfig{Watch: true, Interval: duration.Duration(10 * time.Millisecond)})
+	}()
+	// the watcher reads the logger other tests replace
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond)
+	write("log:\n  level: warn\nprocessing:\n  throttle:\n    max_inflight: 10\n")
+	for deadline := time.Now().Add(5 * time.Second); logging.Level.Level() != zapcore.WarnLevel; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the changed file was not reloaded")
+		}
+	}
+}
+
+func TestAlertSinkReload(t *testing.T) {
+	config := DefaultAlertsConfig()
+	config.Destinations = []AlertDestinationConfig{{Name: "ops", Type: "slack", URL: "https://hooks.slack.com/x"}}
+	config.Rules = []AlertRuleConfig{{Name: "big", MinSOL: 1000, Destinations: []string{"ops"}}}
+	s, err := NewAlertSink(&sinktest.RecordSink{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	next := config
+	next.Rules = []AlertRuleConfig{{Name: "token", Programs: []string{testkey.String(1)}, Destinations: []string{"ops"}}}
+	apply, err := s.prepareReload(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply()
+	rules := *s.rules.Load()
+	if len(rules) != 1 || rules[0].name != "token" || rules[0].destinations[0] != s.destinations[0] {
+		t.Fatalf("rules %+v", rules)
+	}
+
+	next.Destinations = []AlertDestinationConfig{{Name: "ops", Type: "discord", URL: "https://discord.com/api/webhooks/x"}}
+	if _, err := s.prepareReload(next); err == nil || !strings.Contains(err.Error(), "only the rules") {
+		t.Fatalf("got %v", err)
+	}
+}
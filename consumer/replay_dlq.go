@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/sink"
+	"consumer/pkg/tracing"
+)
+
+// Destinations of DLQReplayOptions.To.
+const (
+	replayToTopic = "topic"
+	replayToSink  = "sink"
+)
+
+// DLQReplayOptions select the dead letters the replay-dlq command replays
+// and where to. They are flags only, not part of the config file.
+type DLQReplayOptions struct {
+	Stages string
+	Error  string
+	Since  string
+	Until  string
+	To     string
+	DryRun bool
+}
+
+func RegisterDLQReplayFlags(fs *flag.FlagSet) *DLQReplayOptions {
+	o := &DLQReplayOptions{}
+	fs.StringVar(&o.Stages, "stage", "", "comma-separated stages to replay: decode, resolve or sink, all when empty")
+	fs.StringVar(&o.Error, "error", "", "replay only the dead letters whose error contains this text")
+	fs.StringVar(&o.Since, "since", "", "replay only the messages failed at or after an RFC 3339 time, or a duration ago such as 2h")
+	fs.StringVar(&o.Until, "until", "", "replay only the messages failed before an RFC 3339 time, or a duration ago")
+	fs.StringVar(&o.To, "to", replayToTopic, "topic to produce the messages to their source topic, or sink to write them to the sink")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "log the dead letters selected without replaying them")
+	return o
+}
+
+// dlqFilter is a parsed DLQReplayOptions selection. A zero field selects
+// every dead letter.
+type dlqFilter struct {
+	stages []string
+	error  string
+	since  time.Time
+	until  time.Time
+}
+
+// Filter parses the selection of the options.
+func (o *DLQReplayOptions) Filter(now time.Time) (*dlqFilter, error) {
+	f := &dlqFilter{stages: splitList(o.Stages), error: o.Error}
+	for _, stage := range f.stages {
+		switch stage {
+		case consumer.StageDecode, consumer.StageResolve, consumer.StageSink:
+		default:
+			return nil, fmt.Errorf("--stage: expected decode, resolve or sink, got %q", stage)
+		}
+	}
+	if o.Since != "" {
+		t, ok := parseTimeOrAgo(o.Since, now)
+		if !ok {
+			return nil, fmt.Errorf("--since: expected an RFC 3339 time or a duration, got %q", o.Since)
+		}
+		f.since = t
+	}
+	if o.Until != "" {
+		t, ok := parseTimeOrAgo(o.Until, now)
+		if !ok {
+			return nil, fmt.Errorf("--until: expected an RFC 3339 time or a duration, got %q", o.Until)
+		}
+		f.until = t
+	}
+	if !f.since.IsZero() && !f.until.IsZero() && !f.since.Before(f.until) {
+		return nil, errors.New("--since: must be before --until")
+	}
+	switch o.To {
+	case replayToTopic, replayToSink:
+	default:
+		return nil, fmt.Errorf("--to: expected topic or sink, got %q", o.To)
+	}
+	return f, nil
+}
+
+// match reports whether the dead letter record is selected.
+func (f *dlqFilter) match(record *sarama.ConsumerMessage) bool {
+	headers := tracing.HeaderCarrier(record.Headers)
+	if len(f.stages) > 0 && !slices.Contains(f.stages, headers.Get(consumer.HeaderDLQStage)) {
+		return false
+	}
+	if f.error != "" && !strings.Contains(headers.Get(consumer.HeaderDLQError), f.error) {
+		return false
+	}
+	if f.since.IsZero() && f.until.IsZero() {
+		return true
+	}
+	failed, err := time.Parse(time.RFC3339Nano, headers.Get(consumer.HeaderDLQTime))
+	if err != nil {
+		return false
+	}
+	return !failed.Before(f.since) && (f.until.IsZero() || failed.Before(f.until))
+}
+
+// deadLetterSource returns the record a dead letter was made from, with its
+// topic, partition and offset and without the headers the dead-letter and
+// retry topics added.
+func deadLetterSource(record *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	headers := tracing.HeaderCarrier(record.Headers)
+	topic := headers.Get(consumer.HeaderDLQTopic)
+	partition, perr := strconv.ParseInt(headers.Get(consumer.HeaderDLQPartition), 10, 32)
+	offset, oerr := strconv.ParseInt(headers.Get(consumer.HeaderDLQOffset), 10, 64)
+	if topic == "" || perr != nil || oerr != nil {
+		return nil, fmt.Errorf("%s/%d/%d: not a dead letter, the %s, %s and %s headers are required",
+			record.Topic, record.Partition, record.Offset, consumer.HeaderDLQTopic, consumer.HeaderDLQPartition, consumer.HeaderDLQOffset)
+	}
+	source := *record
+	source.Topic = topic
+	source.Partition = int32(partition)
+	source.Offset = offset
+	source.Headers = nil
+	for _, header := range record.Headers {
+		key := string(header.Key)
+		if !strings.HasPrefix(key, "dlq.") && !strings.HasPrefix(key, "retry.") {
+			source.Headers = append(source.Headers, header)
+		}
+	}
+	return &source, nil
+}
+
+// replayer replays a dead letter, given as the record it was made from.
+type replayer func(ctx context.Context, source *sarama.ConsumerMessage) error
+
+// produceReplayer produces the records to the partition of their source
+// topic they were consumed from, producer using a manual partitioner.
+func produceReplayer(producer sarama.SyncProducer) replayer {
+	return func(_ context.Context, source *sarama.ConsumerMessage) error {
+		msg := &sarama.ProducerMessage{
+			Topic:     source.Topic,
+			Partition: source.Partition,
+			Value:     sarama.ByteEncoder(source.Value),
+			Headers:   make([]sarama.RecordHeader, len(source.Headers)),
+		}
+		if source.Key != nil {
+			msg.Key = sarama.ByteEncoder(source.Key)
+		}
+		for i, header := range source.Headers {
+			msg.Headers[i] = *header
+		}
+		_, _, err := producer.SendMessage(msg)
+		return err
+	}
+}
+
+// sinkReplayer decodes the records and writes them to sink, retrying as the
+// consumer does.
+func sinkReplayer(decoder *decode.Decoder, sink sink.Sink, retry consumer.RetryConfig) replayer {
+	return func(ctx context.Context, source *sarama.ConsumerMessage) error {
+		msg, err := decoder.Decode(source)
+		if err != nil {
+			return fmt.Errorf("decode: %w", err)
+		}
+		return retry.Do(ctx, func() error {
+			return sink.Write(ctx, msg)
+		}, func(attempt int, delay time.Duration, err error) {
+			logging.Logger.Warn("sink write failed, retrying",
+				append(decode.MessageFields(msg), zap.Int("attempt", attempt), zap.Duration("backoff", delay), zap.Error(err))...)
+		})
+	}
+}
+
+// DLQReplay reads the dead-letter topic up to its high water marks at the
+// start and replays the dead letters selected by filter. No group is joined
+// and no offsets are committed, a run replays every dead letter selected.
+type DLQReplay struct {
+	client sarama.Client
+	topic  string
+	filter *dlqFilter
+	// replay is nil for a dry run.
+	replay replayer
+}
+
+func NewDLQReplay(client sarama.Client, topic string, filter *dlqFilter, replay replayer) *DLQReplay {
+	return &DLQReplay{client: client, topic: topic, filter: filter, replay: replay}
+}
+
+// dlqReplayStats counts the dead letters read by a DLQReplay.
+type dlqReplayStats struct {
+	Read     int
+	Selected int
+	Replayed int
+	Failed   int
+}
+
+// Run returns once every partition was read, or ctx is cancelled. Dead
+// letters failing to replay are logged and counted, they stay in the topic.
+func (r *DLQReplay) Run(ctx context.Context) (dlqReplayStats, error) {
+	var stats dlqReplayStats
+	partitions, err := r.client.Partitions(r.topic)
+	if err != nil {
+		return stats, fmt.Errorf("partitions of %s: %w", r.topic, err)
+	}
+	consumer, err := sarama.NewConsumerFromClient(r.client)
+	if err != nil {
+		return stats, err
+	}
+	defer consumer.Close()
+	for _, partition := range partitions {
+		if err := r.partition(ctx, consumer, partition, &stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (r *DLQReplay) partition(ctx context.Context, consumer sarama.Consumer, partition int32, stats *dlqReplayStats) error {
+	oldest, err := r.client.GetOffset(r.topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return fmt.Errorf("fetch offsets of %s/%d: %w", r.topic, partition, err)
+	}
+	newest, err := r.client.GetOffset(r.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return fmt.Errorf("fetch offsets of %s/%d: %w", r.topic, partition, err)
+	}
+	if oldest >= newest {
+		return nil
+	}
+	pc, err := consumer.ConsumePartition(r.topic, partition, oldest)
+	if err != nil {
+		return fmt.Errorf("consume %s/%d: %w", r.topic, partition, err)
+	}
+	defer pc.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-pc.Errors():
+			return fmt.Errorf("consume %s/%d: %w", r.topic, partition, err)
+		case record, ok := <-pc.Messages():
+			if !ok {
+				return nil
+			}
+			r.handle(ctx, record, stats)
+			if record.Offset >= newest-1 {
+				return nil
+			}
+		}
+	}
+}
+
+// handle replays record when it is selected.
+func (r *DLQReplay) handle(ctx context.Context, record *sarama.ConsumerMessage, stats *dlqReplayStats) {
+	stats.Read++
+	if !r.filter.match(record) {
+		return
+	}
+	stats.Selected++
+	headers := tracing.HeaderCarrier(record.Headers)
+	fields := append(logging.RecordFields(record),
+		zap.String("stage", headers.Get(consumer.HeaderDLQStage)),
+		zap.String("error", headers.Get(consumer.HeaderDLQError)),
+		zap.String("failed_at", headers.Get(consumer.HeaderDLQTime)))
+	source, err := deadLetterSource(record)
+	if err != nil {
+		stats.Failed++
+		logging.Logger.Warn("dead letter skipped", append(fields, zap.NamedError("replay_error", err))...)
+		return
+	}
+	fields = append(fields,
+		zap.String("source_topic", source.Topic),
+		zap.Int32("source_partition", source.Partition),
+		zap.Int64("source_offset", source.Offset))
+	if r.replay == nil {
+		logging.Logger.Info("dead letter selected", fields...)
+		return
+	}
+	if err := r.replay(ctx, source); err != nil {
+		stats.Failed++
+		logging.Logger.Error("dead letter replay failed", append(fields, zap.NamedError("replay_error", err))...)
+		return
+	}
+	stats.Replayed++
+	if ce := logging.Logger.Check(zap.DebugLevel, "dead letter replayed"); ce != nil {
+		ce.Write(fields...)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	gproto "google.golang.org/protobuf/proto"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/consumer"
+	"consumer/pkg/decode"
+)
+
+// replayProducer keeps the records produced.
+type replayProducer struct {
+	sarama.SyncProducer
+	sent []*sarama.ProducerMessage
+}
+
+func (p *replayProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent = append(p.sent, msg)
+	return msg.Partition, int64(len(p.sent) - 1), nil
+}
+
+func TestDLQReplayFilter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, options := range []DLQReplayOptions{
+		{Stages: "sink,encode", To: replayToTopic},
+		{Since: "yesterday", To: replayToTopic},
+		{Since: "1h", Until: "2h", To: replayToTopic},
+		{To: "stdout"},
+	} {
+		if _, err := options.Filter(now); err == nil {
+			t.Errorf("%+v: no error", options)
+		}
+	}
+
+	options := DLQReplayOptions{Stages: "sink", Error: "timeout", Since: "2h", Until: "2024-05-01T11:30:00Z", To: replayToTopic}
+	filter, err := options.Filter(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetter := func(stage, cause string, failed time.Time) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Headers: []*sarama.RecordHeader{
+			{Key: []byte(consumer.HeaderDLQStage), Value: []byte(stage)},
+			{Key: []byte(consumer.HeaderDLQError), Value: []byte(cause)},
+			{Key: []byte(consumer.HeaderDLQTime), Value: []byte(failed.Format(time.RFC3339Nano))},
+		}}
+	}
+	for _, test := range []struct {
+		name   string
+		record *sarama.ConsumerMessage
+		want   bool
+	}{
+		{"selected", deadLetter(consumer.StageSink, "write: i/o timeout", now.Add(-time.Hour)), true},
+		{"other stage", deadLetter(consumer.StageDecode, "write: i/o timeout", now.Add(-time.Hour)), false},
+		{"other error", deadLetter(consumer.StageSink, "connection refused", now.Add(-time.Hour)), false},
+		{"too old", deadLetter(consumer.StageSink, "write: i/o timeout", now.Add(-3*time.Hour)), false},
+		{"too recent", deadLetter(consumer.StageSink, "write: i/o timeout", now.Add(-time.Minute)), false},
+		{"no time", &sarama.ConsumerMessage{}, false},
+	} {
+		if got := filter.match(test.record); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+	if all, err := (&DLQReplayOptions{To: replayToSink}).Filter(now); err != nil || !all.match(&sarama.ConsumerMessage{}) {
+		t.Fatalf("filter without selection: %v", err)
+	}
+}
+
+func TestDLQReplay(t *testing.T) {
+	value, err := gproto.Marshal(decodetest.TransactionMessage(10, testkey.Key(1)).Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a dead letter as the consumer writes it, from a retry topic
+	source := &sarama.ConsumerMessage{Topic: "updates", Partition: 3, Offset: 42, Key: []byte("10_key"), Value: value, Headers: []*sarama.RecordHeader{
+		{Key: []byte(decode.HeaderSource), Value: []byte("node1")},
+		{Key: []byte(consumer.HeaderRetryTier), Value: []byte("2")},
+	}}
+	deadLetter := &sarama.ConsumerMessage{Topic: "updates.dlq", Key: source.Key, Value: value, Headers: append(source.Headers[:2:2],
+		&sarama.RecordHeader{Key: []byte(consumer.HeaderDLQTopic), Value: []byte("updates")},
+		&sarama.RecordHeader{Key: []byte(consumer.HeaderDLQPartition), Value: []byte("3")},
+		&sarama.RecordHeader{Key: []byte(consumer.HeaderDLQOffset), Value: []byte("42")},
+		&sarama.RecordHeader{Key: []byte(consumer.HeaderDLQStage), Value: []byte(consumer.StageSink)},
+		&sarama.RecordHeader{Key: []byte(consumer.HeaderDLQError), Value: []byte("sink down")},
+		&sarama.RecordHeader{Key: []byte(consumer.HeaderDLQTime), Value: []byte(time.Now().Format(time.RFC3339Nano))},
+	)}
+	filter, err := (&DLQReplayOptions{To: replayToTopic}).Filter(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// back to the partition of the source topic, without the added headers
+	producer := &replayProducer{}
+	var stats dlqReplayStats
+	NewDLQReplay(nil, "updates.dlq", filter, produceReplayer(producer)).handle(context.Background(), deadLetter, &stats)
+	if stats != (dlqReplayStats{Read: 1, Selected: 1, Replayed: 1}) || len(producer.sent) != 1 {
+		t.Fatalf("stats %+v, %d produced", stats, len(producer.sent))
+	}
+	replayed := producer.sent[0]
+	if replayed.Topic != "updates" || replayed.Partition != 3 || len(replayed.Headers) != 1 || string(replayed.Headers[0].Key) != decode.HeaderSource {
+		t.Fatalf("replayed to %s/%d with headers %v", replayed.Topic, replayed.Partition, replayed.Headers)
+	}
+
+	// written to the sink as consumed from the source
+	sink := &sinktest.RecordSink{}
+	decoder, err := decode.NewDecoder(decode.Config{Kind: string(decode.KindUpdate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = dlqReplayStats{}
+	NewDLQReplay(nil, "updates.dlq", filter, sinkReplayer(decoder, sink, consumer.RetryConfig{MaxAttempts: 1})).handle(context.Background(), deadLetter, &stats)
+	if len(sink.Written) != 1 || stats.Replayed != 1 {
+		t.Fatalf("%d written, stats %+v", len(sink.Written), stats)
+	}
+	if msg := sink.Written[0]; msg.Topic != "updates" || msg.Partition != 3 || msg.Offset != 42 || msg.Slot != 10 {
+		t.Fatalf("written %s/%d/%d slot %d", msg.Topic, msg.Partition, msg.Offset, msg.Slot)
+	}
+
+	// a dry run and a record without the dead-letter headers replay nothing
+	stats = dlqReplayStats{}
+	dryRun := NewDLQReplay(nil, "updates.dlq", filter, nil)
+	dryRun.handle(context.Background(), deadLetter, &stats)
+	dryRun.handle(context.Background(), source, &stats)
+	if stats != (dlqReplayStats{Read: 2, Selected: 2, Failed: 1}) {
+		t.Fatalf("stats %+v", stats)
+	}
+	if _, err := deadLetterSource(source); err == nil || !strings.Contains(err.Error(), "not a dead letter") {
+		t.Fatalf("got %v", err)
+	}
+}
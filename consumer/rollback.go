@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+	"consumer/proto"
+)
+
+// Actions for RollbackConfig.Action.
+const (
+	rollbackNone   = "none"
+	rollbackDelete = "delete"
+	rollbackMark   = "mark"
+)
+
+// RollbackConfig rolls back the slots that die or are skipped by the
+// finalized chain, as reported by the slot updates consumed alongside the
+// data.
+type RollbackConfig struct {
+	// Topic receives a JSON rollback event per slot keyed by slot, disabled
+	// when empty.
+	Topic string `json:"topic" yaml:"topic"`
+	// Action is none, delete to delete the rows of the slot from the
+	// postgres, clickhouse, timescale or sqlite sink, or mark to set their
+	// rolled_back column.
+	Action string `json:"action" yaml:"action"`
+	// MaxSlots forgets the slots rolled back this many slots behind the newest
+	// finalized slot, until then their late updates are dropped.
+	MaxSlots uint64 `json:"max_slots" yaml:"max_slots"`
+}
+
+func DefaultRollbackConfig() RollbackConfig {
+	return RollbackConfig{Action: rollbackNone, MaxSlots: 150}
+}
+
+func (c *RollbackConfig) enabled() bool {
+	return c.Topic != "" || c.Action != rollbackNone
+}
+
+func (c *RollbackConfig) Validate(topics []string, sinkType string) error {
+	switch c.Action {
+	case rollbackNone:
+	case rollbackDelete, rollbackMark:
+		if sinkType != "postgres" && sinkType != "clickhouse" && sinkType != "timescale" && sinkType != "sqlite" {
+			return fmt.Errorf("rollback.action: %s needs sink.type postgres, clickhouse, timescale or sqlite, got %s", c.Action, sinkType)
+		}
+	default:
+		return fmt.Errorf("rollback.action: expected none, delete or mark, got %q", c.Action)
+	}
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("rollback.topic: %s is also consumed", c.Topic)
+	}
+	if c.enabled() && c.MaxSlots == 0 {
+		return errors.New("rollback.max_slots: must be positive")
+	}
+	return nil
+}
+
+// slotRollback is implemented by sinks that roll back the rows they wrote
+// for slots: delete them, or set their rolled_back column with mark.
+type slotRollback interface {
+	RollbackSlots(ctx context.Context, slots []uint64, mark bool) error
+}
+
+// rollbackEvent is the record produced to RollbackConfig.Topic.
+type rollbackEvent struct {
+	Slot uint64 `json:"slot"`
+	// Reason is dead or skipped.
+	Reason string `json:"reason"`
+	// FinalizedSlot is the finalized slot whose parent skipped Slot.
+	FinalizedSlot uint64 `json:"finalized_slot,omitempty"`
+	DeadError     string `json:"dead_error,omitempty"`
+}
+
+// RollbackSink writes the slot updates through and rolls back every slot
+// reported dead, or skipped by a finalized slot naming an older parent: the
+// rows the sink wrote for it are deleted or marked, a rollback event is
+// produced and the updates of the slot arriving later are dropped. A failed
+// rollback fails the write of the slot update, whose retry rolls the slot
+// back again.
+type RollbackSink struct {
+	next     sink.Sink
+	target   slotRollback
+	mark     bool
+	producer sarama.SyncProducer
+	topic    string
+	maxSlots uint64
+
+	mu sync.Mutex
+	// rolledBack are the slots rolled back by reason.
+	rolledBack      map[uint64]string
+	newestFinalized uint64
+}
+
+// NewRollbackSink rolls back the rows of target, when not nil, and produces
+// the events with producer, when not nil.
+func NewRollbackSink(next sink.Sink, target slotRollback, producer sarama.SyncProducer, config RollbackConfig) *RollbackSink {
+	s := &RollbackSink{
+		next:       next,
+		mark:       config.Action == rollbackMark,
+		producer:   producer,
+		topic:      config.Topic,
+		maxSlots:   config.MaxSlots,
+		rolledBack: make(map[uint64]string),
+	}
+	if config.Action != rollbackNone {
+		s.target = target
+	}
+	return s
+}
+
+func (s *RollbackSink) Write(ctx context.Context, msg *decode.Message) error {
+	update := msg.Update.GetSlot()
+	if update == nil {
+		s.mu.Lock()
+		_, ok := s.rolledBack[msg.Slot]
+		s.mu.Unlock()
+		if ok && msg.Slot != 0 {
+			metrics.RollbackDroppedTotal.Inc()
+			return nil
+		}
+		return s.next.Write(ctx, msg)
+	}
+	if err := s.next.Write(ctx, msg); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := update.GetSlot()
+	var events []rollbackEvent
+	switch update.GetStatus() {
+	case proto.CommitmentLevel_DEAD:
+		events = append(events, rollbackEvent{Slot: slot, Reason: sink.DiscardDead, DeadError: update.GetDeadError()})
+	case proto.CommitmentLevel_FINALIZED:
+		if update.Parent != nil && slot > s.newestFinalized {
+			// the finalized chain goes from the parent straight to slot
+			for skipped := max(update.GetParent()+1, slot-min(slot, s.maxSlots)); skipped < slot; skipped++ {
+				events = append(events, rollbackEvent{Slot: skipped, Reason: sink.DiscardSkipped, FinalizedSlot: slot})
+			}
+		}
+	}
+	events = slices.DeleteFunc(events, func(event rollbackEvent) bool {
+		_, ok := s.rolledBack[event.Slot]
+		return ok
+	})
+	if len(events) > 0 {
+		if err := s.rollback(ctx, events); err != nil {
+			return err
+		}
+	}
+	if update.GetStatus() == proto.CommitmentLevel_FINALIZED && slot > s.newestFinalized {
+		s.newestFinalized = slot
+		if slot > s.maxSlots {
+			horizon := slot - s.maxSlots
+			maps.DeleteFunc(s.rolledBack, func(slot uint64, _ string) bool { return slot < horizon })
+		}
+	}
+	return nil
+}
+
+// rollback rolls back the slots of events in the sink and produces the
+// events.
+func (s *RollbackSink) rollback(ctx context.Context, events []rollbackEvent) error {
+	slots := make([]uint64, len(events))
+	for i, event := range events {
+		slots[i] = event.Slot
+	}
+	if s.target != nil {
+		if err := s.target.RollbackSlots(ctx, slots, s.mark); err != nil {
+			return fmt.Errorf("roll back slots %v: %w", slots, err)
+		}
+	}
+	if s.producer != nil {
+		records := make([]*sarama.ProducerMessage, len(events))
+		for i, event := range events {
+			value, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			records[i] = &sarama.ProducerMessage{
+				Topic: s.topic,
+				Key:   sarama.StringEncoder(strconv.FormatUint(event.Slot, 10)),
+				Value: sarama.ByteEncoder(value),
+			}
+		}
+		if err := s.producer.SendMessages(records); err != nil {
+			return fmt.Errorf("produce rollback events: %w", err)
+		}
+	}
+	for _, event := range events {
+		logging.Logger.Info("slot rolled back", zap.Uint64("slot", event.Slot), zap.String("reason", event.Reason))
+		metrics.RollbacksTotal.WithLabelValues(event.Reason).Inc()
+		s.rolledBack[event.Slot] = event.Reason
+	}
+	return nil
+}
+
+func (s *RollbackSink) Flush(ctx context.Context) error {
+	return s.next.Flush(ctx)
+}
+
+func (s *RollbackSink) Close() error {
+	return s.next.Close()
+}
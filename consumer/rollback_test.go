@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/sink"
+	"consumer/proto"
+)
+
+// rollbackTarget records the slots rolled back, or fails with err.
+type rollbackTarget struct {
+	err    error
+	mark   bool
+	slots  []uint64
+	events []rollbackEvent
+}
+
+func (r *rollbackTarget) RollbackSlots(_ context.Context, slots []uint64, mark bool) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.slots, r.mark = append(r.slots, slots...), mark
+	return nil
+}
+
+// rollbackProducer records the events it sends into target.
+type rollbackProducer struct {
+	sarama.SyncProducer
+	target *rollbackTarget
+}
+
+func (p rollbackProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		value, _ := msg.Value.Encode()
+		var event rollbackEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			return err
+		}
+		p.target.events = append(p.target.events, event)
+	}
+	return nil
+}
+
+func TestRollbackSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	target := &rollbackTarget{}
+	config := DefaultRollbackConfig()
+	config.Topic, config.Action = "rollbacks", rollbackMark
+	s := NewRollbackSink(next, target, rollbackProducer{target: target}, config)
+	ctx := context.Background()
+
+	s.Write(ctx, decodetest.TransactionMessage(11, testkey.Key(1)))
+	s.Write(ctx, decodetest.SlotMessage(11, 10, proto.CommitmentLevel_DEAD))
+	// 13 is finalized on top of 10, 11 died already and 12 was skipped
+	s.Write(ctx, decodetest.SlotMessage(13, 10, proto.CommitmentLevel_FINALIZED))
+	if !slices.Equal(target.slots, []uint64{11, 12}) || !target.mark {
+		t.Fatalf("rolled back %v", target.slots)
+	}
+	if len(target.events) != 2 || target.events[0] != (rollbackEvent{Slot: 11, Reason: sink.DiscardDead}) ||
+		target.events[1] != (rollbackEvent{Slot: 12, Reason: sink.DiscardSkipped, FinalizedSlot: 13}) {
+		t.Fatalf("events %+v", target.events)
+	}
+
+	// late updates of a rolled back slot are dropped
+	s.Write(ctx, decodetest.TransactionMessage(12, testkey.Key(1)))
+	if got := next.Slots(); !slices.Equal(got, []uint64{11, 11, 13}) {
+		t.Fatalf("written %v", got)
+	}
+
+	// a failed rollback fails the slot update, whose retry rolls back again
+	target.err = errors.New("unavailable")
+	dead := decodetest.SlotMessage(14, 13, proto.CommitmentLevel_DEAD)
+	if err := s.Write(ctx, dead); err == nil {
+		t.Fatal("failed rollback not reported")
+	}
+	target.err = nil
+	if err := s.Write(ctx, dead); err != nil || !slices.Equal(target.slots, []uint64{11, 12, 14}) {
+		t.Fatalf("retry: %v, rolled back %v", err, target.slots)
+	}
+}
+
+func TestRollbackConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Rollback.Action = rollbackDelete
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sink.type") {
+		t.Fatalf("got %v", err)
+	}
+	config.Rollback.Action = "drop"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "rollback.action") {
+		t.Fatalf("got %v", err)
+	}
+}
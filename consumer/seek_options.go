@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"consumer/pkg/consumer"
+)
+
+// SeekOptions moves the committed offsets of the group before consuming, to
+// reprocess a historical window. At most one of the options is set.
+type SeekOptions struct {
+	FromTimestamp string
+	FromOffset    string
+	FromSlot      string
+}
+
+func RegisterSeekFlags(fs *flag.FlagSet) *SeekOptions {
+	o := &SeekOptions{}
+	fs.StringVar(&o.FromTimestamp, "from-timestamp", "", "reset the group to the first record at or after an RFC 3339 time, or a duration ago such as 2h")
+	fs.StringVar(&o.FromOffset, "from-offset", "", "reset the group to an offset on every partition, or partition:offset pairs such as 0:100,1:250")
+	fs.StringVar(&o.FromSlot, "from-slot", "", "reset the group to the first record of a slot, read from the <slot>_<hash> record keys")
+	return o
+}
+
+// Target parses the options, it returns nil when no seek was requested.
+func (o *SeekOptions) Target(now time.Time) (*consumer.SeekTarget, error) {
+	set := 0
+	for _, v := range []string{o.FromTimestamp, o.FromOffset, o.FromSlot} {
+		if v != "" {
+			set++
+		}
+	}
+	switch set {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, errors.New("only one of --from-timestamp, --from-offset and --from-slot can be set")
+	}
+
+	target := &consumer.SeekTarget{}
+	switch {
+	case o.FromTimestamp != "":
+		t, ok := parseTimeOrAgo(o.FromTimestamp, now)
+		if !ok {
+			return nil, fmt.Errorf("--from-timestamp: expected an RFC 3339 time or a duration, got %q", o.FromTimestamp)
+		}
+		target.Timestamp = t
+	case o.FromOffset != "":
+		if offset, err := strconv.ParseInt(o.FromOffset, 10, 64); err == nil {
+			target.Offset = &offset
+			break
+		}
+		target.Offsets = make(map[int32]int64)
+		for _, pair := range splitList(o.FromOffset) {
+			partition, offset, ok := strings.Cut(pair, ":")
+			p, perr := strconv.ParseInt(partition, 10, 32)
+			n, oerr := strconv.ParseInt(offset, 10, 64)
+			if !ok || perr != nil || oerr != nil {
+				return nil, fmt.Errorf("--from-offset: expected an offset or partition:offset pairs, got %q", o.FromOffset)
+			}
+			target.Offsets[int32(p)] = n
+		}
+	case o.FromSlot != "":
+		slot, err := strconv.ParseUint(o.FromSlot, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("--from-slot: %w", err)
+		}
+		target.Slot = &slot
+	}
+	return target, nil
+}
+
+// parseTimeOrAgo parses an RFC 3339 time, or a duration before now such as
+// 2h.
+func parseTimeOrAgo(value string, now time.Time) (time.Time, bool) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeekOptionsTarget(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	target, err := (&SeekOptions{FromTimestamp: "2h"}).Target(now)
+	if err != nil || !target.Timestamp.Equal(now.Add(-2*time.Hour)) {
+		t.Fatalf("duration: %+v, %v", target, err)
+	}
+	target, err = (&SeekOptions{FromTimestamp: "2024-04-30T00:00:00Z"}).Target(now)
+	if err != nil || !target.Timestamp.Equal(time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("time: %+v, %v", target, err)
+	}
+	target, err = (&SeekOptions{FromOffset: "0:100,1:250"}).Target(now)
+	if err != nil || target.Offsets[0] != 100 || target.Offsets[1] != 250 || target.Offset != nil {
+		t.Fatalf("pairs: %+v, %v", target, err)
+	}
+	target, err = (&SeekOptions{FromSlot: "265000104"}).Target(now)
+	if err != nil || *target.Slot != 265000104 {
+		t.Fatalf("slot: %+v, %v", target, err)
+	}
+	if target, err := (&SeekOptions{}).Target(now); target != nil || err != nil {
+		t.Fatalf("no options: %+v, %v", target, err)
+	}
+	for _, o := range []SeekOptions{
+		{FromOffset: "1", FromSlot: "2"},
+		{FromTimestamp: "yesterday"},
+		{FromOffset: "0:x"},
+		{FromSlot: "-1"},
+	} {
+		if _, err := o.Target(now); err == nil {
+			t.Errorf("%+v accepted", o)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// serveHTTP binds address and serves handler on it in the background. It
+// returns the error of the bind, such as the address being in use, so the
+// command fails at startup instead of running without the server; fields
+// are logged along with the address once it is bound.
+func serveHTTP(name, address string, handler http.Handler, fields ...zap.Field) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("%s server: %w", name, err)
+	}
+	logging.Logger.Info(name+" server started", append([]zap.Field{zap.String("address", listener.Addr().String())}, fields...)...)
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			logging.Logger.Error(name+" server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// StreamServerConfig is the listener of a server streaming the written
+// updates to its clients over WebSocket, the websocket and graphql
+// sections.
+type StreamServerConfig struct {
+	// Address is the listen address of the server, disabled when empty.
+	Address string `json:"address" yaml:"address"`
+	Path    string `json:"path" yaml:"path"`
+	// QueueSize is the number of updates buffered per client, a client
+	// falling further behind is disconnected.
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+	// AllowedOrigins restricts the browser origins allowed to connect, any
+	// origin is accepted when empty.
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+}
+
+// validate checks the config of the section.
+func (c *StreamServerConfig) validate(section string) error {
+	if c.Address == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("%s.path: must start with /", section)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("%s.queue_size: must be positive", section)
+	}
+	return nil
+}
+
+// checkOrigin is the CheckOrigin of the WebSocket upgrader. Requests without
+// an Origin header do not come from a browser and are accepted.
+func (c *StreamServerConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return len(c.AllowedOrigins) == 0 || origin == "" || slices.Contains(c.AllowedOrigins, origin)
+}
+
+// serve serves handler on c.Path of c.Address in the background.
+func (c *StreamServerConfig) serve(name string, handler http.Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle(c.Path, handler)
+	return serveHTTP(name, c.Address, mux, zap.String("path", c.Path))
+}
+
+// RunMetricsServer serves /metrics on address in the background, along with
+// the health endpoints when health is not nil.
+func RunMetricsServer(address string, health *consumer.Health) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	if health != nil {
+		mux.HandleFunc("/healthz", health.ServeLive)
+		mux.HandleFunc("/readyz", health.ServeReady)
+	}
+
+	return serveHTTP("prometheus", address, mux)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"consumer/pkg/consumer"
+)
+
+func TestServeHTTP(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	if err := serveHTTP("test", taken.Addr().String(), handler); err == nil || !strings.HasPrefix(err.Error(), "test server:") {
+		t.Fatalf("address in use: got %v", err)
+	}
+	for name, run := range map[string]func(address string) error{
+		"metrics": func(address string) error { return RunMetricsServer(address, nil) },
+		"query": func(address string) error {
+			return RunQueryServer(QueryConfig{Address: address}, NewRecentStore(QueryConfig{}))
+		},
+		"websocket": func(address string) error {
+			return RunWebSocketServer(StreamServerConfig{Address: address, Path: "/ws"}, NewBroadcaster(StreamServerConfig{}))
+		},
+		"graphql": func(address string) error {
+			return RunGraphQLServer(StreamServerConfig{Address: address, Path: "/graphql"}, NewGraphQLServer(StreamServerConfig{}))
+		},
+		"admin": func(address string) error {
+			return RunAdminServer(AdminConfig{Address: address}, NewAdmin(AdminConfig{}, consumer.NewHandler(consumer.HandlerConfig{})))
+		},
+	} {
+		if err := run(taken.Addr().String()); err == nil {
+			t.Errorf("%s: address in use accepted", name)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// SlotCompletionConfig produces a record once every transaction of a slot
+// was written, for batch jobs waiting for a slot to be safe to aggregate.
+type SlotCompletionConfig struct {
+	// Topic receives a JSON record per complete slot keyed by slot, disabled
+	// when empty.
+	Topic string `json:"topic" yaml:"topic"`
+	// MaxPendingSlots gives up on the slots this many slots older than the
+	// newest block meta that are still incomplete.
+	MaxPendingSlots uint64 `json:"max_pending_slots" yaml:"max_pending_slots"`
+}
+
+func (c *SlotCompletionConfig) Validate(topics []string) error {
+	if c.Topic == "" {
+		return nil
+	}
+	if slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("slot_completion.topic: %s is also consumed", c.Topic)
+	}
+	if c.MaxPendingSlots == 0 {
+		return errors.New("slot_completion.max_pending_slots: must be positive")
+	}
+	return nil
+}
+
+// slotCompletionRecord is the record produced to SlotCompletionConfig.Topic.
+type slotCompletionRecord struct {
+	Slot         uint64 `json:"slot"`
+	ParentSlot   uint64 `json:"parent_slot"`
+	Blockhash    string `json:"blockhash"`
+	BlockTime    int64  `json:"block_time,omitempty"`
+	Transactions uint64 `json:"transactions"`
+}
+
+// SlotCompletionSink counts the transactions of every slot written to the
+// next sink, alone or in a block, against the executed transaction count of
+// its block meta. Complete slots are produced after the next Flush succeeded,
+// so that their updates were written out by then. A failed produce fails the
+// Flush, and the slots are produced again with the next one.
+type SlotCompletionSink struct {
+	sink.Sink
+	producer   sarama.SyncProducer
+	topic      string
+	maxPending uint64
+
+	mu      sync.Mutex
+	pending map[uint64]*slotProgress
+	// complete are the slots to produce after the next Flush.
+	complete []slotCompletionRecord
+	newest   uint64
+}
+
+// slotProgress is what was written of a slot, record is set once its block
+// meta was.
+type slotProgress struct {
+	signatures map[string]struct{}
+	record     *slotCompletionRecord
+}
+
+func NewSlotCompletionSink(next sink.Sink, producer sarama.SyncProducer, config SlotCompletionConfig) *SlotCompletionSink {
+	return &SlotCompletionSink{
+		Sink:       next,
+		producer:   producer,
+		topic:      config.Topic,
+		maxPending: config.MaxPendingSlots,
+		pending:    make(map[uint64]*slotProgress),
+	}
+}
+
+func (s *SlotCompletionSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	transactions := decode.MessageTransactions(msg)
+	var record *slotCompletionRecord
+	if meta := msg.Update.GetBlockMeta(); meta != nil {
+		record = &slotCompletionRecord{Slot: meta.GetSlot(), ParentSlot: meta.GetParentSlot(), Blockhash: meta.GetBlockhash(),
+			BlockTime: meta.GetBlockTime().GetTimestamp(), Transactions: meta.GetExecutedTransactionCount()}
+	} else if block := msg.Update.GetBlock(); block != nil {
+		record = &slotCompletionRecord{Slot: block.GetSlot(), ParentSlot: block.GetParentSlot(), Blockhash: block.GetBlockhash(),
+			BlockTime: block.GetBlockTime().GetTimestamp(), Transactions: block.GetExecutedTransactionCount()}
+	}
+	if msg.Slot == 0 || record == nil && len(transactions) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Slot+s.maxPending < s.newest {
+		return nil
+	}
+	progress := s.pending[msg.Slot]
+	if progress == nil {
+		progress = &slotProgress{signatures: make(map[string]struct{})}
+		s.pending[msg.Slot] = progress
+	}
+	// a transaction written again after a retry or a rebalance counts once
+	for _, info := range transactions {
+		progress.signatures[string(info.GetSignature())] = struct{}{}
+	}
+	if record != nil {
+		progress.record = record
+		if msg.Slot > s.newest {
+			s.newest = msg.Slot
+			s.expire()
+		}
+	}
+	if progress.record != nil && uint64(len(progress.signatures)) >= progress.record.Transactions {
+		s.complete = append(s.complete, *progress.record)
+		delete(s.pending, msg.Slot)
+	}
+	metrics.SlotCompletionPending.Set(float64(len(s.pending)))
+	return nil
+}
+
+// expire gives up on the slots far enough behind the newest block meta.
+func (s *SlotCompletionSink) expire() {
+	if s.newest <= s.maxPending {
+		return
+	}
+	horizon := s.newest - s.maxPending
+	for _, slot := range slices.Collect(maps.Keys(s.pending)) {
+		if slot < horizon {
+			logging.Logger.Warn("slot never completed", zap.Uint64("slot", slot), zap.Int("transactions", len(s.pending[slot].signatures)))
+			metrics.SlotCompletionExpiredTotal.Inc()
+			delete(s.pending, slot)
+		}
+	}
+}
+
+func (s *SlotCompletionSink) Flush(ctx context.Context) error {
+	if err := s.Sink.Flush(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	complete := s.complete
+	s.mu.Unlock()
+	if len(complete) == 0 {
+		return nil
+	}
+	records := make([]*sarama.ProducerMessage, len(complete))
+	for i, record := range complete {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		records[i] = &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(strconv.FormatUint(record.Slot, 10)),
+			Value: sarama.ByteEncoder(value),
+		}
+	}
+	if err := s.producer.SendMessages(records); err != nil {
+		return fmt.Errorf("produce slot completions: %w", err)
+	}
+	s.mu.Lock()
+	s.complete = slices.Delete(s.complete, 0, len(complete))
+	s.mu.Unlock()
+	metrics.SlotCompletionsProducedTotal.Add(float64(len(complete)))
+	return nil
+}
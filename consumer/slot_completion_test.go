@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+// heldTransaction returns a transaction of slot whose completion is counted
+// in completed.
+func heldTransaction(slot uint64, offset int64, completed map[int64]int) *decode.Message {
+	msg := decodetest.TransactionMessage(slot, testkey.Key(1))
+	msg.Topic, msg.Offset = "transactions", offset
+	msg.Complete = func() { completed[offset]++ }
+	return msg
+}
+
+// blockTransaction returns the transaction at index of the block of slot.
+func blockTransaction(slot uint64, index uint64, offset int64, completed map[int64]int) *decode.Message {
+	msg := heldTransaction(slot, offset, completed)
+	info := msg.Update.GetTransaction().GetTransaction()
+	info.Signature, info.Index = testkey.Key(byte(index)), index
+	return msg
+}
+
+// blockMeta returns the block meta of slot executing count transactions.
+func blockMeta(slot, count uint64, offset int64, completed map[int64]int) *decode.Message {
+	return &decode.Message{
+		Topic:  "blocks",
+		Offset: offset,
+		Slot:   slot,
+		Update: &proto.SubscribeUpdate{UpdateOneof: &proto.SubscribeUpdate_BlockMeta{BlockMeta: &proto.SubscribeUpdateBlockMeta{
+			Slot:                     slot,
+			Blockhash:                "hash",
+			ParentSlot:               slot - 1,
+			ExecutedTransactionCount: count,
+		}}},
+		Complete: func() { completed[offset]++ },
+	}
+}
+
+func TestSlotCompletionSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	producer := &jsonProducer[slotCompletionRecord]{}
+	s := NewSlotCompletionSink(next, producer, SlotCompletionConfig{Topic: "slots.complete", MaxPendingSlots: 10})
+	ctx := context.Background()
+	completed := make(map[int64]int)
+
+	for _, msg := range []*decode.Message{
+		blockTransaction(10, 0, 0, completed),
+		blockMeta(10, 2, 1, completed),
+		// written again after a retry
+		blockTransaction(10, 0, 0, completed),
+		blockMeta(11, 0, 2, completed),
+	} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.records) != 1 || producer.records[0].Slot != 11 {
+		t.Fatalf("produced %+v, want slot 11 only", producer.records)
+	}
+
+	// slot 10 completes, its record waits for a Flush succeeding
+	s.Write(ctx, blockTransaction(10, 1, 3, completed))
+	producer.err = errors.New("unavailable")
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("failed produce not reported")
+	}
+	producer.err = nil
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.records) != 2 || producer.records[1] != (slotCompletionRecord{Slot: 10, ParentSlot: 9, Blockhash: "hash", Transactions: 2}) {
+		t.Fatalf("produced %+v", producer.records)
+	}
+	if len(next.Written) != 5 {
+		t.Fatalf("%d updates written", len(next.Written))
+	}
+
+	// a slot missing transactions is given up on
+	s.Write(ctx, blockMeta(12, 1, 4, completed))
+	s.Write(ctx, blockMeta(30, 1, 5, completed))
+	if _, ok := s.pending[12]; ok || len(s.pending) != 1 {
+		t.Fatalf("pending %v", s.pending)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"consumer/pkg/consumer"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+)
+
+// statsDumper logs a snapshot of the consumer on SIGUSR1, for hosts without
+// Prometheus. The counters come from the metrics registry, so they count
+// since startup, the rate since the previous snapshot.
+type statsDumper struct {
+	health *consumer.Health
+
+	last     time.Time
+	messages float64
+}
+
+func newStatsDumper(health *consumer.Health) *statsDumper {
+	return &statsDumper{health: health, last: time.Now()}
+}
+
+// RunStatsDump logs a snapshot on every SIGUSR1 until ctx is done. It
+// returns at once where there is no SIGUSR1.
+func RunStatsDump(ctx context.Context, health *consumer.Health) {
+	if statsSignal == nil {
+		return
+	}
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, statsSignal)
+	defer signal.Stop(dump)
+
+	d := newStatsDumper(health)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dump:
+			logging.Logger.Info("stats", d.snapshot(time.Now())...)
+		}
+	}
+}
+
+// snapshot returns the fields of a snapshot taken at now.
+func (d *statsDumper) snapshot(now time.Time) []zap.Field {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		logging.Logger.Warn("failed to gather metrics", zap.Error(err))
+	}
+	messages := metricSum(families, "consumer_messages_total")
+	rate := 0.0
+	if elapsed := now.Sub(d.last).Seconds(); elapsed > 0 {
+		rate = (messages - d.messages) / elapsed
+	}
+	d.last, d.messages = now, messages
+
+	fields := []zap.Field{
+		zap.Float64("messages", messages),
+		zap.Float64("messages_per_second", rate),
+		zap.Float64("decode_failures", metricSum(families, "consumer_decode_failures_total")),
+		zap.Float64("filtered", metricSum(families, "consumer_filtered_total")),
+		zap.Float64("sink_retries", metricSum(families, "consumer_sink_retries_total")),
+		zap.Float64("dead_letters", metricSum(families, "consumer_dlq_messages_total")),
+		zap.Float64("commits", metricSum(families, "consumer_commits_total")),
+		zap.Float64("inflight", metricSum(families, "consumer_inflight_messages")),
+		zap.Int("goroutines", runtime.NumGoroutine()),
+	}
+	if d.health != nil {
+		status, _, _ := d.health.Status(now)
+		fields = append(fields,
+			zap.Bool("in_session", status.InSession),
+			zap.Any("partitions", withLag(status.Partitions)))
+	}
+	return fields
+}
+
+// metricSum adds up the counters or gauges of the family name over their
+// labels.
+func metricSum(families []*dto.MetricFamily, name string) float64 {
+	var sum float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			sum += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+	return sum
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statsSignal is nil, Windows has no SIGUSR1.
+var statsSignal os.Signal
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"consumer/pkg/metrics"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	d := newStatsDumper(nil)
+	d.snapshot(d.last)
+	metrics.MessagesTotal.WithLabelValues("updates", "slot").Add(20)
+	metrics.InflightMessages.Set(3)
+	defer metrics.InflightMessages.Set(0)
+
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range d.snapshot(d.last.Add(2 * time.Second)) {
+		field.AddTo(encoder)
+	}
+	if rate := encoder.Fields["messages_per_second"]; rate != 10.0 {
+		t.Fatalf("rate %v", rate)
+	}
+	if encoder.Fields["inflight"] != 3.0 || encoder.Fields["goroutines"].(int64) <= 0 {
+		t.Fatalf("fields %v", encoder.Fields)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// SwapsConfig produces the swaps of the written transactions to a topic of
+// their own, for price and volume services.
+type SwapsConfig struct {
+	// Topic receives a JSON record per swap keyed by pool, disabled when
+	// empty.
+	Topic string `json:"topic" yaml:"topic"`
+}
+
+func (c *SwapsConfig) Validate(topics []string) error {
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("swaps.topic: %s is also consumed", c.Topic)
+	}
+	return nil
+}
+
+// swapRecord is the record produced to SwapsConfig.Topic.
+type swapRecord struct {
+	Signature string `json:"signature"`
+	Slot      uint64 `json:"slot"`
+	decode.Swap
+}
+
+// SwapsSink produces the swaps of every transaction written, alone or in a
+// block, after passing it on. A failed produce fails the write, so a retry
+// writes the message to the next sink again.
+type SwapsSink struct {
+	sink.Sink
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewSwapsSink(next sink.Sink, producer sarama.SyncProducer, config SwapsConfig) *SwapsSink {
+	return &SwapsSink{Sink: next, producer: producer, topic: config.Topic}
+}
+
+func (s *SwapsSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	var records []*sarama.ProducerMessage
+	for _, info := range decode.MessageTransactions(msg) {
+		if info.GetMeta().GetErr() != nil {
+			continue
+		}
+		signature := base58.Encode(info.GetSignature())
+		for _, swap := range decode.DecodeSwaps(info) {
+			value, err := json.Marshal(swapRecord{Signature: signature, Slot: msg.Slot, Swap: swap})
+			if err != nil {
+				return err
+			}
+			records = append(records, &sarama.ProducerMessage{
+				Topic:   s.topic,
+				Key:     sarama.StringEncoder(swap.Pool),
+				Value:   sarama.ByteEncoder(value),
+				Headers: decode.ProducerHeaders(msg),
+			})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := s.producer.SendMessages(records); err != nil {
+		return fmt.Errorf("produce swaps: %w", err)
+	}
+	metrics.SwapsProducedTotal.Add(float64(len(records)))
+	return nil
+}
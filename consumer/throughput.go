@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/duration"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// Statuses of the transactions counted by ThroughputSink.
+const (
+	throughputSuccess = "success"
+	throughputFailed  = "failed"
+	throughputVote    = "vote"
+)
+
+// ThroughputConfig counts the written transactions in tumbling windows, by
+// status and by program.
+type ThroughputConfig struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	// Window is the length of a window, aligned on the epoch.
+	Window duration.Duration `json:"window" yaml:"window"`
+	// Delay closes a window once a transaction produced this long after its
+	// end was written, the transactions of a closed window are not counted.
+	Delay duration.Duration `json:"delay" yaml:"delay"`
+	// Topic receives a JSON record per window keyed by its start, disabled
+	// when empty.
+	Topic string `json:"topic" yaml:"topic"`
+	// Programs get counts of their own in the metrics and are the only
+	// programs in the records, every program is in the records when empty.
+	Programs []string `json:"programs" yaml:"programs"`
+}
+
+func DefaultThroughputConfig() ThroughputConfig {
+	return ThroughputConfig{Window: duration.Duration(10 * time.Second), Delay: duration.Duration(2 * time.Second)}
+}
+
+func (c *ThroughputConfig) Validate(topics []string) error {
+	if !c.Enable {
+		if c.Topic != "" {
+			return errors.New("throughput.topic: needs throughput.enable")
+		}
+		return nil
+	}
+	if c.Window <= 0 {
+		return errors.New("throughput.window: must be positive")
+	}
+	if c.Delay < 0 {
+		return errors.New("throughput.delay: must not be negative")
+	}
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("throughput.topic: %s is also consumed", c.Topic)
+	}
+	for _, program := range c.Programs {
+		if key, err := base58.Decode(program); err != nil || len(key) != 32 {
+			return fmt.Errorf("throughput.programs: %q is not a base58 public key", program)
+		}
+	}
+	return nil
+}
+
+// throughputRecord is the record produced to ThroughputConfig.Topic, TPS
+// leaves out the votes.
+type throughputRecord struct {
+	Start        time.Time                 `json:"start"`
+	End          time.Time                 `json:"end"`
+	Transactions int                       `json:"transactions"`
+	Votes        int                       `json:"votes"`
+	TPS          float64                   `json:"tps"`
+	Statuses     map[string]int            `json:"statuses"`
+	Programs     map[string]map[string]int `json:"programs,omitempty"`
+}
+
+// throughputSample is what is counted of a transaction.
+type throughputSample struct {
+	status   string
+	programs []string
+}
+
+// ThroughputSink counts the transactions written, alone or in a block, in
+// windows of the time they were produced, see Message.ProducedAt, or of the
+// time they were written when it is not known. A window is closed Delay
+// after its end: its counts, overall, by status and by program, are queued
+// as a record and set in the metrics. Votes are counted apart and left out
+// of the programs. Records are produced after the next Flush succeeded, a
+// failed produce fails the Flush and they are produced again with the next
+// one.
+type ThroughputSink struct {
+	sink.Sink
+	producer sarama.SyncProducer
+	topic    string
+	window   time.Duration
+	delay    time.Duration
+	// programs are those of ThroughputConfig.Programs, nil for every program.
+	programs map[string]struct{}
+	now      func() time.Time
+
+	mu sync.Mutex
+	// pending are the samples of the open windows by start and signature, so
+	// that a transaction written again counts once.
+	pending map[int64]map[string]throughputSample
+	newest  time.Time
+	records []throughputRecord
+}
+
+// NewThroughputSink produces the records with producer, which is nil without
+// ThroughputConfig.Topic.
+func NewThroughputSink(next sink.Sink, producer sarama.SyncProducer, config ThroughputConfig) *ThroughputSink {
+	s := &ThroughputSink{
+		Sink:     next,
+		producer: producer,
+		topic:    config.Topic,
+		window:   time.Duration(config.Window),
+		delay:    time.Duration(config.Delay),
+		now:      time.Now,
+		pending:  make(map[int64]map[string]throughputSample),
+	}
+	if len(config.Programs) > 0 {
+		s.programs = make(map[string]struct{}, len(config.Programs))
+		for _, program := range config.Programs {
+			s.programs[program] = struct{}{}
+		}
+	}
+	return s
+}
+
+func (s *ThroughputSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	transactions := decode.MessageTransactions(msg)
+	if len(transactions) == 0 {
+		return nil
+	}
+	produced := msg.ProducedAt()
+	if produced.IsZero() {
+		produced = s.now()
+	}
+	start := produced.Truncate(s.window)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !start.Add(s.window + s.delay).After(s.newest) {
+		return nil
+	}
+	samples := s.pending[start.UnixNano()]
+	if samples == nil {
+		samples = make(map[string]throughputSample)
+		s.pending[start.UnixNano()] = samples
+	}
+	for _, info := range transactions {
+		sample := throughputSample{status: throughputSuccess}
+		switch {
+		case info.GetIsVote():
+			sample.status = throughputVote
+		case info.GetMeta().GetErr() != nil:
+			sample.status = throughputFailed
+		}
+		if sample.status != throughputVote {
+			for _, program := range decode.TransactionPrograms(info) {
+				id := base58.Encode(program)
+				if _, ok := s.programs[id]; ok || s.programs == nil {
+					sample.programs = append(sample.programs, id)
+				}
+			}
+		}
+		samples[string(info.GetSignature())] = sample
+	}
+	if produced.After(s.newest) {
+		s.newest = produced
+		s.close()
+	}
+	return nil
+}
+
+// close closes the windows ending Delay before the newest transaction.
+func (s *ThroughputSink) close() {
+	for _, start := range slices.Sorted(maps.Keys(s.pending)) {
+		record := throughputRecord{Start: time.Unix(0, start).UTC()}
+		record.End = record.Start.Add(s.window)
+		if record.End.Add(s.delay).After(s.newest) {
+			break
+		}
+		record.Statuses = make(map[string]int)
+		record.Programs = make(map[string]map[string]int)
+		for _, sample := range s.pending[start] {
+			if sample.status == throughputVote {
+				record.Votes++
+				continue
+			}
+			record.Transactions++
+			record.Statuses[sample.status]++
+			for _, program := range sample.programs {
+				if record.Programs[program] == nil {
+					record.Programs[program] = make(map[string]int)
+				}
+				record.Programs[program][sample.status]++
+			}
+		}
+		record.TPS = float64(record.Transactions) / s.window.Seconds()
+		delete(s.pending, start)
+		s.observe(record)
+		if s.producer != nil {
+			s.records = append(s.records, record)
+		}
+	}
+}
+
+// observe sets the metrics to the counts of the window of record.
+func (s *ThroughputSink) observe(record throughputRecord) {
+	metrics.ThroughputTPS.Set(record.TPS)
+	metrics.ThroughputTransactions.WithLabelValues(allPrograms, throughputVote).Set(float64(record.Votes))
+	for _, status := range []string{throughputSuccess, throughputFailed} {
+		metrics.ThroughputTransactions.WithLabelValues(allPrograms, status).Set(float64(record.Statuses[status]))
+		for program := range s.programs {
+			metrics.ThroughputTransactions.WithLabelValues(program, status).Set(float64(record.Programs[program][status]))
+		}
+	}
+}
+
+func (s *ThroughputSink) Flush(ctx context.Context) error {
+	if err := s.Sink.Flush(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	records := s.records
+	s.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+	messages := make([]*sarama.ProducerMessage, len(records))
+	for i, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		messages[i] = &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(strconv.FormatInt(record.Start.Unix(), 10)),
+			Value: sarama.ByteEncoder(value),
+		}
+	}
+	if err := s.producer.SendMessages(messages); err != nil {
+		return fmt.Errorf("produce throughput records: %w", err)
+	}
+	s.mu.Lock()
+	s.records = slices.Delete(s.records, 0, len(records))
+	s.mu.Unlock()
+	metrics.ThroughputRecordsProducedTotal.Add(float64(len(records)))
+	return nil
+}
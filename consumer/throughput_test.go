@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+// producedTransaction returns the transaction signature of program produced
+// at seconds past start.
+func producedTransaction(start time.Time, seconds int, signature byte, program []byte) *decode.Message {
+	msg := decodetest.TransactionMessage(10, program)
+	msg.Update.GetTransaction().GetTransaction().Signature = testkey.Key(signature)
+	msg.Timestamp = start.Add(time.Duration(seconds) * time.Second)
+	return msg
+}
+
+func TestThroughputSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	producer := &jsonProducer[throughputRecord]{}
+	config := DefaultThroughputConfig()
+	config.Enable, config.Topic, config.Programs = true, "stats", []string{testkey.String(2)}
+	s := NewThroughputSink(next, producer, config)
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	failed := producedTransaction(start, 3, 2, testkey.Key(2))
+	failed.Update.GetTransaction().GetTransaction().Meta.Err = &proto.TransactionError{Err: []byte{1}}
+	vote := producedTransaction(start, 4, 3, testkey.Key(3))
+	vote.Update.GetTransaction().GetTransaction().IsVote = true
+	for _, msg := range []*decode.Message{
+		producedTransaction(start, 1, 1, testkey.Key(2)),
+		failed,
+		vote,
+		// written again after a retry
+		producedTransaction(start, 1, 1, testkey.Key(2)),
+		producedTransaction(start, 9, 4, testkey.Key(3)),
+		// within the delay of the first window
+		producedTransaction(start, 11, 5, testkey.Key(3)),
+		producedTransaction(start, 12, 6, testkey.Key(3)),
+		// after the first window was closed
+		producedTransaction(start, 5, 7, testkey.Key(3)),
+	} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.records) != 1 {
+		t.Fatalf("produced %+v", producer.records)
+	}
+	record := producer.records[0]
+	if !record.Start.Equal(start) || record.Transactions != 3 || record.Votes != 1 || record.TPS != 0.3 ||
+		record.Statuses[throughputSuccess] != 2 || record.Statuses[throughputFailed] != 1 {
+		t.Fatalf("record %+v", record)
+	}
+	if programs := record.Programs; len(programs) != 1 || programs[testkey.String(2)][throughputFailed] != 1 {
+		t.Fatalf("programs %v", programs)
+	}
+	if got := testutil.ToFloat64(metrics.ThroughputTransactions.WithLabelValues(testkey.String(2), throughputSuccess)); got != 1 {
+		t.Fatalf("program successes %v", got)
+	}
+	if len(s.pending) != 1 {
+		t.Fatalf("%d windows open", len(s.pending))
+	}
+}
+
+func TestThroughputConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Throughput.Enable = true
+	config.Kafka.Topics = []string{"accounts"}
+	config.Decoding.Topics = map[string]string{"accounts": string(decode.KindAccount)}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "throughput: needs transactions") {
+		t.Fatalf("got %v", err)
+	}
+	config.Throughput.Window = 0
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "throughput.window") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/IBM/sarama"
+	"github.com/mr-tron/base58"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// TransfersConfig produces the balance changes of the written transactions
+// to a topic of their own, for consumers tracking wallets.
+type TransfersConfig struct {
+	// Topic receives a JSON record per balance change keyed by account,
+	// disabled when empty.
+	Topic string `json:"topic" yaml:"topic"`
+	// ExcludeFailed leaves out failed transactions, whose only change is the
+	// fee paid.
+	ExcludeFailed bool `json:"exclude_failed" yaml:"exclude_failed"`
+}
+
+func (c *TransfersConfig) Validate(topics []string) error {
+	if c.Topic != "" && slices.Contains(topics, c.Topic) {
+		return fmt.Errorf("transfers.topic: %s is also consumed", c.Topic)
+	}
+	return nil
+}
+
+// transferRecord is the record produced to TransfersConfig.Topic.
+type transferRecord struct {
+	Signature string `json:"signature"`
+	Slot      uint64 `json:"slot"`
+	Failed    bool   `json:"failed,omitempty"`
+	decode.BalanceChange
+}
+
+// TransfersSink produces the balance changes of every transaction written,
+// alone or in a block, after passing it on. A failed produce fails the write,
+// so a retry writes the message to the next sink again.
+type TransfersSink struct {
+	sink.Sink
+	producer      sarama.SyncProducer
+	topic         string
+	excludeFailed bool
+}
+
+func NewTransfersSink(next sink.Sink, producer sarama.SyncProducer, config TransfersConfig) *TransfersSink {
+	return &TransfersSink{Sink: next, producer: producer, topic: config.Topic, excludeFailed: config.ExcludeFailed}
+}
+
+func (s *TransfersSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	var records []*sarama.ProducerMessage
+	for _, info := range decode.MessageTransactions(msg) {
+		failed := info.GetMeta().GetErr() != nil
+		if failed && s.excludeFailed {
+			continue
+		}
+		signature := base58.Encode(info.GetSignature())
+		for _, change := range decode.BalanceChanges(info) {
+			value, err := json.Marshal(transferRecord{Signature: signature, Slot: msg.Slot, Failed: failed, BalanceChange: change})
+			if err != nil {
+				return err
+			}
+			records = append(records, &sarama.ProducerMessage{
+				Topic:   s.topic,
+				Key:     sarama.StringEncoder(change.Account),
+				Value:   sarama.ByteEncoder(value),
+				Headers: decode.ProducerHeaders(msg),
+			})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := s.producer.SendMessages(records); err != nil {
+		return fmt.Errorf("produce transfers: %w", err)
+	}
+	metrics.TransfersProducedTotal.Add(float64(len(records)))
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/proto"
+)
+
+func TestTransfersSink(t *testing.T) {
+	next := &sinktest.RecordSink{}
+	producer := &jsonProducer[transferRecord]{}
+	s := NewTransfersSink(next, producer, TransfersConfig{Topic: "transfers", ExcludeFailed: true})
+	ctx := context.Background()
+
+	transaction := decodetest.BalanceTransaction(10)
+	transaction.Headers = map[string]string{decode.HeaderSource: "mainnet:10000"}
+	failed := decodetest.BalanceTransaction(11)
+	failed.Update.GetTransaction().GetTransaction().Meta.Err = &proto.TransactionError{Err: []byte{1}}
+	for _, msg := range []*decode.Message{transaction, decodetest.AccountMessage(10, testkey.Key(1), testkey.Key(2)), failed} {
+		if err := s.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(next.Written) != 3 {
+		t.Fatalf("%d messages written, want all", len(next.Written))
+	}
+	if len(producer.records) != 4 || producer.keys[0] != testkey.String(1) {
+		t.Fatalf("records %+v keys %v", producer.records, producer.keys)
+	}
+	if headers := producer.headers[0]; len(headers) != 1 || string(headers[0].Value) != "mainnet:10000" {
+		t.Fatalf("record headers %v, want the source of the transaction", headers)
+	}
+	record := producer.records[3]
+	if record.Signature != testkey.String(0xff) || record.Slot != 10 || record.Mint != testkey.String(20) || record.Change.Int64() != 30 {
+		t.Fatalf("record %+v", record)
+	}
+
+	producer.err = errors.New("broker down")
+	if err := s.Write(ctx, decodetest.BalanceTransaction(12)); err == nil {
+		t.Fatal("write succeeded without producing the transfers")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"consumer/pkg/decode"
+	"consumer/pkg/logging"
+	"consumer/pkg/metrics"
+	"consumer/pkg/sink"
+)
+
+// wsSubscription selects the updates sent to a client. Programs match the
+// programs invoked by transactions and the owners of accounts, accounts the
+// accounts referenced by transactions and the account updates themselves.
+// Both only restrict transactions and accounts, empty fields match all.
+type wsSubscription struct {
+	Kinds    []string `json:"kinds"`
+	Programs []string `json:"programs"`
+	Accounts []string `json:"accounts"`
+
+	kinds    map[decode.UpdateKind]struct{}
+	programs decode.KeySet
+	accounts decode.KeySet
+}
+
+func (s *wsSubscription) compile() error {
+	s.kinds = nil
+	for _, name := range s.Kinds {
+		kind, err := decode.ParseUpdateKind(name)
+		if err != nil {
+			return fmt.Errorf("kinds: %w", err)
+		}
+		if s.kinds == nil {
+			s.kinds = make(map[decode.UpdateKind]struct{})
+		}
+		s.kinds[kind] = struct{}{}
+	}
+	var err error
+	if s.programs, err = decode.NewKeySet(s.Programs); err != nil {
+		return fmt.Errorf("programs: %w", err)
+	}
+	if s.accounts, err = decode.NewKeySet(s.Accounts); err != nil {
+		return fmt.Errorf("accounts: %w", err)
+	}
+	return nil
+}
+
+func (s *wsSubscription) match(msg *decode.Message) bool {
+	if s.kinds != nil {
+		if _, ok := s.kinds[msg.Kind()]; !ok {
+			return false
+		}
+	}
+	if s.programs == nil && s.accounts == nil {
+		return true
+	}
+	if info := msg.Update.GetTransaction().GetTransaction(); info != nil {
+		return (s.programs == nil || s.programs.ContainsAny(decode.TransactionPrograms(info))) &&
+			(s.accounts == nil || s.accounts.ContainsAny(decode.TransactionAccounts(info)))
+	}
+	if account := msg.Update.GetAccount().GetAccount(); account != nil {
+		return (s.programs == nil || s.programs.ContainsAny([][]byte{account.GetOwner()})) &&
+			(s.accounts == nil || s.accounts.ContainsAny([][]byte{account.GetPubkey()}))
+	}
+	return true
+}
+
+// wsMaxMessageSize bounds the subscription messages read from a client.
+const wsMaxMessageSize = 1 << 20
+
+// wsUpdate is the JSON frame sent for every update.
+type wsUpdate struct {
+	Kind   decode.UpdateKind `json:"kind"`
+	Slot   uint64            `json:"slot"`
+	Topic  string            `json:"topic"`
+	Update json.RawMessage   `json:"update"`
+}
+
+// Broadcaster serves a WebSocket endpoint and sends the written updates to
+// every client whose subscription matches them.
+type Broadcaster struct {
+	queueSize int
+	upgrader  websocket.Upgrader
+
+	mu      sync.RWMutex
+	clients map[*wsClient]struct{}
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+
+	mu           sync.RWMutex
+	subscription *wsSubscription
+	// slow is closed once the client fell behind and is disconnected, and
+	// counted in slowTotal.
+	slow      chan struct{}
+	slowOnce  sync.Once
+	slowTotal prometheus.Counter
+}
+
+func NewBroadcaster(config StreamServerConfig) *Broadcaster {
+	b := &Broadcaster{
+		queueSize: config.QueueSize,
+		clients:   make(map[*wsClient]struct{}),
+	}
+	b.upgrader.CheckOrigin = config.checkOrigin
+	return b
+}
+
+// RunWebSocketServer serves b on config.Address in the background.
+func RunWebSocketServer(config StreamServerConfig, b *Broadcaster) error {
+	return config.serve("websocket", b)
+}
+
+// ServeHTTP upgrades the request. The initial subscription is taken from the
+// kinds, programs and accounts query parameters, comma-separated, and a JSON
+// text message with the same fields replaces it later.
+func (b *Broadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	subscription := &wsSubscription{
+		Kinds:    splitList(query.Get("kinds")),
+		Programs: splitList(query.Get("programs")),
+		Accounts: splitList(query.Get("accounts")),
+	}
+	if err := subscription.compile(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	client := &wsClient{
+		conn:         conn,
+		send:         make(chan []byte, b.queueSize),
+		subscription: subscription,
+		slow:         make(chan struct{}),
+		slowTotal:    metrics.WebsocketSlowTotal,
+	}
+	b.mu.Lock()
+	b.clients[client] = struct{}{}
+	metrics.WebsocketClients.Set(float64(len(b.clients)))
+	b.mu.Unlock()
+	logging.Logger.Debug("websocket client connected", zap.String("remote", r.RemoteAddr))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		defer cancel()
+		client.readLoop()
+	}()
+	client.writeLoop(ctx)
+
+	b.mu.Lock()
+	delete(b.clients, client)
+	metrics.WebsocketClients.Set(float64(len(b.clients)))
+	b.mu.Unlock()
+	conn.Close()
+	logging.Logger.Debug("websocket client disconnected", zap.String("remote", r.RemoteAddr))
+}
+
+// readLoop applies subscription messages until the connection fails.
+func (c *wsClient) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		subscription := &wsSubscription{}
+		if err = json.Unmarshal(data, subscription); err == nil {
+			err = subscription.compile()
+		}
+		if err != nil {
+			// reported through the write loop, writes are not concurrency safe
+			frame, _ := json.Marshal(map[string]string{"error": err.Error()})
+			c.enqueue(frame)
+			continue
+		}
+		c.mu.Lock()
+		c.subscription = subscription
+		c.mu.Unlock()
+	}
+}
+
+func (c *wsClient) writeLoop(ctx context.Context) {
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.slow:
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"), time.Now().Add(time.Second))
+			return
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// enqueue queues frame without blocking, a full queue disconnects the client.
+func (c *wsClient) enqueue(frame []byte) {
+	select {
+	case c.send <- frame:
+	default:
+		c.slowOnce.Do(func() {
+			c.slowTotal.Inc()
+			close(c.slow)
+		})
+	}
+}
+
+func (c *wsClient) matches(msg *decode.Message) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.subscription.match(msg)
+}
+
+// Publish sends msg to the matching clients. It is encoded once, only when a
+// client wants it.
+func (b *Broadcaster) Publish(msg *decode.Message) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var frame []byte
+	for client := range b.clients {
+		if !client.matches(msg) {
+			continue
+		}
+		if frame == nil {
+			update, err := decode.FormatJSON(msg.Update)
+			if err == nil {
+				frame, err = json.Marshal(wsUpdate{Kind: msg.Kind(), Slot: msg.Slot, Topic: msg.Topic, Update: update})
+			}
+			if err != nil {
+				logging.Logger.Warn("failed to encode update for websocket clients", append(decode.MessageFields(msg), zap.Error(err))...)
+				return
+			}
+		}
+		client.enqueue(frame)
+	}
+}
+
+// Publisher fans the written updates out to clients, Broadcaster and
+// GeyserServer are publishers.
+type Publisher interface {
+	Publish(msg *decode.Message)
+}
+
+// BroadcastSink publishes every write to a Publisher before passing it on.
+type BroadcastSink struct {
+	sink.Sink
+	publisher Publisher
+}
+
+func NewBroadcastSink(next sink.Sink, publisher Publisher) *BroadcastSink {
+	return &BroadcastSink{Sink: next, publisher: publisher}
+}
+
+func (s *BroadcastSink) Write(ctx context.Context, msg *decode.Message) error {
+	if err := s.Sink.Write(ctx, msg); err != nil {
+		return err
+	}
+	s.publisher.Publish(msg)
+	return nil
+}
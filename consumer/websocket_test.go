@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"consumer/internal/decodetest"
+	"consumer/internal/sinktest"
+	"consumer/internal/testkey"
+	"consumer/pkg/decode"
+	"consumer/pkg/metrics"
+	"consumer/proto"
+)
+
+func TestWebSocketSubscription(t *testing.T) {
+	program := testkey.Key(1)
+	account, owner := testkey.Key(3), testkey.Key(4)
+
+	tx := decodetest.TransactionMessage(10, program, account)
+	acc := decodetest.AccountMessage(10, account, owner)
+	slot := decodetest.SlotMessage(10, 0, proto.CommitmentLevel_CONFIRMED)
+
+	tests := []struct {
+		name         string
+		subscription wsSubscription
+		want         []bool // tx, acc, slot
+	}{
+		{"empty matches all", wsSubscription{}, []bool{true, true, true}},
+		{"kinds", wsSubscription{Kinds: []string{"slot", "account"}}, []bool{false, true, true}},
+		{"program of transaction", wsSubscription{Programs: []string{testkey.String(1)}}, []bool{true, false, true}},
+		{"owner of account", wsSubscription{Programs: []string{testkey.String(4)}}, []bool{false, true, true}},
+		{"account", wsSubscription{Accounts: []string{testkey.String(3)}}, []bool{true, true, true}},
+		{"other account", wsSubscription{Accounts: []string{testkey.String(2)}}, []bool{false, false, true}},
+		{"program and account", wsSubscription{
+			Programs: []string{testkey.String(1)},
+			Accounts: []string{testkey.String(2)},
+		}, []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.subscription.compile(); err != nil {
+				t.Fatal(err)
+			}
+			for i, msg := range []*decode.Message{tx, acc, slot} {
+				if got := tt.subscription.match(msg); got != tt.want[i] {
+					t.Errorf("match(%s) = %v, want %v", msg.Kind(), got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketSubscriptionErrors(t *testing.T) {
+	for _, subscription := range []wsSubscription{
+		{Kinds: []string{"bogus"}},
+		{Programs: []string{"not-base58-0OIl"}},
+		{Accounts: []string{testkey.String(1)[:10]}},
+	} {
+		if err := subscription.compile(); err == nil {
+			t.Errorf("compile(%+v) succeeded", subscription)
+		}
+	}
+}
+
+func TestWebSocketBroadcast(t *testing.T) {
+	b := NewBroadcaster(StreamServerConfig{QueueSize: 16})
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?kinds=slot,transaction&programs=" + testkey.String(1)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return len(b.clients) == 1
+	})
+
+	read := func() map[string]any {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frame map[string]any
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	sink := NewBroadcastSink(&sinktest.RecordSink{}, b)
+	ctx := context.Background()
+	for _, msg := range []*decode.Message{
+		decodetest.TransactionMessage(5, testkey.Key(2)),
+		decodetest.AccountMessage(6, testkey.Key(3), testkey.Key(1)),
+		decodetest.TransactionMessage(7, testkey.Key(1)),
+		decodetest.SlotMessage(8, 7, proto.CommitmentLevel_PROCESSED),
+	} {
+		msg.Topic = "updates"
+		if err := sink.Write(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []struct {
+		kind string
+		slot float64
+	}{{"transaction", 7}, {"slot", 8}} {
+		frame := read()
+		if frame["kind"] != want.kind || frame["slot"] != want.slot || frame["topic"] != "updates" {
+			t.Fatalf("frame = %v, want %s of slot %v", frame, want.kind, want.slot)
+		}
+		if _, ok := frame["update"].(map[string]any); !ok {
+			t.Fatalf("frame without update: %v", frame)
+		}
+	}
+
+	// an invalid subscription is reported and keeps the current one
+	for _, invalid := range []string{`{"kinds":["bogus"]}`, `not json`} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(invalid)); err != nil {
+			t.Fatal(err)
+		}
+		if frame := read(); frame["error"] == nil {
+			t.Fatalf("frame = %v, want an error", frame)
+		}
+	}
+	sink.Write(ctx, decodetest.AccountMessage(9, testkey.Key(3), testkey.Key(2)))
+	sink.Write(ctx, decodetest.SlotMessage(9, 8, proto.CommitmentLevel_PROCESSED))
+	if frame := read(); frame["kind"] != "slot" {
+		t.Fatalf("frame = %v, want the slot after the invalid subscriptions", frame)
+	}
+
+	// messages are applied in order, the error acknowledges the replacement
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"kinds":["account"]}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{}x`))
+	if frame := read(); frame["error"] == nil {
+		t.Fatalf("frame = %v, want an error", frame)
+	}
+	sink.Write(ctx, decodetest.SlotMessage(10, 9, proto.CommitmentLevel_PROCESSED))
+	sink.Write(ctx, decodetest.AccountMessage(10, testkey.Key(3), testkey.Key(2)))
+	if frame := read(); frame["kind"] != "account" || frame["slot"] != float64(10) {
+		t.Fatalf("frame = %v, want the account of slot 10", frame)
+	}
+}
+
+func TestWebSocketSlowClient(t *testing.T) {
+	b := NewBroadcaster(StreamServerConfig{QueueSize: 1})
+	client := &wsClient{send: make(chan []byte, 1), subscription: &wsSubscription{}, slow: make(chan struct{}), slowTotal: metrics.WebsocketSlowTotal}
+	b.clients[client] = struct{}{}
+
+	b.Publish(decodetest.SlotMessage(1, 0, proto.CommitmentLevel_PROCESSED))
+	select {
+	case <-client.slow:
+		t.Fatal("client marked slow with room in its queue")
+	default:
+	}
+	b.Publish(decodetest.SlotMessage(2, 1, proto.CommitmentLevel_PROCESSED))
+	b.Publish(decodetest.SlotMessage(3, 2, proto.CommitmentLevel_PROCESSED))
+	select {
+	case <-client.slow:
+	default:
+		t.Fatal("client with a full queue not marked slow")
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}